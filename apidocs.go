@@ -0,0 +1,299 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/openapi"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// apiDocBase is the hand-written API documentation that the generated OpenAPI
+// document starts from.
+const apiDocBase = "./api.yml"
+
+// bulkResults is the response from the endpoints that act on several analyses
+// at once.
+var bulkResults = openapi.Fields{"results": []internal.BulkOperationResult{}}
+
+// timeLimit is the response from the time limit endpoints.
+var timeLimit = openapi.Fields{"time_limit": ""}
+
+// apiOperations gives the request and response types of the routes. Routes
+// that aren't listed here are still documented, without schemas.
+var apiOperations = []openapi.Operation{
+	{
+		Method:  http.MethodPost,
+		Path:    "/vice/launch",
+		Request: internal.LaunchRequest{},
+		Responses: map[int]interface{}{
+			http.StatusOK:       internal.ExistingLaunch{},
+			http.StatusAccepted: internal.LaunchAccepted{},
+			http.StatusConflict: nil,
+		},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/launch/validate",
+		Request:   internal.LaunchRequest{},
+		Responses: map[int]interface{}{http.StatusOK: internal.LaunchValidation{}},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/batch/launch",
+		Request:   internal.BatchLaunchRequest{},
+		Responses: map[int]interface{}{http.StatusAccepted: internal.LaunchAccepted{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/launches/:id",
+		Responses: map[int]interface{}{http.StatusOK: internal.LaunchProgress{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/queue",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"launches": []internal.QueuePosition{}}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/queue",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"launches": []internal.QueuePosition{}}},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/admin/queue/:external-id/position",
+		Request:   internal.QueueMove{},
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"launches": []internal.QueuePosition{}}},
+	},
+
+	// Listings and descriptions.
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/listing",
+		Responses: map[int]interface{}{http.StatusOK: internal.ResourceInfo{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/listing/",
+		Responses: map[int]interface{}{http.StatusOK: internal.ResourceInfo{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/listing/deployments",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"deployments": []internal.DeploymentInfo{}}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/listing/pods",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"pods": []internal.PodInfo{}}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/listing/configmaps",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"configmaps": []internal.ConfigMapInfo{}}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/listing/services",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"services": []internal.ServiceInfo{}}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/listing/ingresses",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"ingresses": []internal.IngressInfo{}}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/listing",
+		Responses: map[int]interface{}{http.StatusOK: internal.ResourceInfo{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/",
+		Responses: map[int]interface{}{http.StatusOK: internal.ResourceInfo{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/:host/description",
+		Responses: map[int]interface{}{http.StatusOK: internal.ResourceInfo{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/:host/description",
+		Responses: map[int]interface{}{http.StatusOK: internal.ResourceInfo{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/:host/url-ready",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"ready": true}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/:host/url-ready",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"ready": true}},
+	},
+
+	// The lifecycle of an analysis.
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/:analysis-id/time-limit",
+		Responses: map[int]interface{}{http.StatusOK: timeLimit},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/:analysis-id/time-limit",
+		Responses: map[int]interface{}{http.StatusOK: timeLimit},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/:analysis-id/time-limit",
+		Responses: map[int]interface{}{http.StatusOK: timeLimit},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/admin/analyses/:analysis-id/time-limit",
+		Responses: map[int]interface{}{http.StatusOK: timeLimit},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/:analysis-id/state",
+		Responses: map[int]interface{}{http.StatusOK: internal.AnalysisStateResponse{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/:analysis-id/state",
+		Responses: map[int]interface{}{http.StatusOK: internal.AnalysisStateResponse{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/:analysis-id/uptime",
+		Responses: map[int]interface{}{http.StatusOK: internal.AnalysisUptimeResponse{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/:analysis-id/uptime",
+		Responses: map[int]interface{}{http.StatusOK: internal.AnalysisUptimeResponse{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/:analysis-id/teardown",
+		Responses: map[int]interface{}{http.StatusOK: internal.TeardownProgress{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/:analysis-id/teardown",
+		Responses: map[int]interface{}{http.StatusOK: internal.TeardownProgress{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/:analysis-id/external-id",
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"externalID": ""}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/:analysis-id/launch-record",
+		Responses: map[int]interface{}{http.StatusOK: apps.LaunchRecord{}},
+	},
+	{
+		Method:    http.MethodPut,
+		Path:      "/vice/:analysis-id/subdomain",
+		Request:   internal.SubdomainRequest{},
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"externalID": "", "subdomain": ""}},
+	},
+	{
+		Method:    http.MethodPut,
+		Path:      "/vice/admin/analyses/:analysis-id/subdomain",
+		Request:   internal.SubdomainRequest{},
+		Responses: map[int]interface{}{http.StatusOK: openapi.Fields{"externalID": "", "subdomain": ""}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/:analysis-id/protection",
+		Responses: map[int]interface{}{http.StatusOK: internal.DeletionProtection{}},
+	},
+	{
+		Method:    http.MethodPut,
+		Path:      "/vice/:analysis-id/protection",
+		Request:   internal.DeletionProtectionRequest{},
+		Responses: map[int]interface{}{http.StatusOK: internal.DeletionProtection{}},
+	},
+	{
+		Method:    http.MethodGet,
+		Path:      "/vice/admin/analyses/:analysis-id/protection",
+		Responses: map[int]interface{}{http.StatusOK: internal.DeletionProtection{}},
+	},
+	{
+		Method:    http.MethodPut,
+		Path:      "/vice/admin/analyses/:analysis-id/protection",
+		Request:   internal.DeletionProtectionRequest{},
+		Responses: map[int]interface{}{http.StatusOK: internal.DeletionProtection{}},
+	},
+
+	// Bulk operations and termination.
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/my/terminate-all",
+		Responses: map[int]interface{}{http.StatusOK: bulkResults},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/my/extend-all",
+		Responses: map[int]interface{}{http.StatusOK: bulkResults},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/admin/terminate",
+		Request:   openapi.Schema{"type": "object", "additionalProperties": openapi.Schema{"type": "string"}},
+		Responses: map[int]interface{}{http.StatusAccepted: bulkResults},
+	},
+	{
+		Method:    http.MethodDelete,
+		Path:      "/vice/admin/analyses/:external-id",
+		Responses: map[int]interface{}{http.StatusAccepted: internal.TeardownProgress{}},
+	},
+	{
+		Method:    http.MethodPost,
+		Path:      "/vice/admin/users/:username/freeze",
+		Request:   internal.FreezeRequest{},
+		Responses: map[int]interface{}{http.StatusOK: internal.UserFreeze{}},
+	},
+}
+
+// openAPIDocument generates the OpenAPI document for the routes registered
+// with the router. It's generated once, the first time it's asked for, since
+// the routes don't change after the app is created.
+func (e *ExposerApp) openAPIDocument() ([]byte, error) {
+	e.openAPIOnce.Do(func() {
+		base, err := ioutil.ReadFile(apiDocBase)
+		if err != nil && !os.IsNotExist(err) {
+			e.openAPIErr = errors.Wrapf(err, "error reading %s", apiDocBase)
+			return
+		}
+
+		routes := []openapi.Route{}
+		for _, route := range e.router.Routes() {
+			routes = append(routes, openapi.Route{
+				Method:  route.Method,
+				Path:    route.Path,
+				Handler: route.Name,
+			})
+		}
+
+		e.openAPIDoc, e.openAPIErr = openapi.Generate(base, routes, apiOperations)
+	})
+	return e.openAPIDoc, e.openAPIErr
+}
+
+// OpenAPIHandler returns the OpenAPI 3 document for the HTTP API, which is
+// what the Swagger UI at /docs displays.
+func (e *ExposerApp) OpenAPIHandler(c echo.Context) error {
+	doc, err := e.openAPIDocument()
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, doc)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestOpenAPIHandler(t *testing.T) {
+	mockdb, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	testinit := &ExposerAppInit{
+		Namespace:     "testing",
+		ViceNamespace: "vice-apps",
+		db:            sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	testapp := NewExposerApp(testinit, "linkerd", fake.NewSimpleClientset())
+
+	req := httptest.NewRequest(http.MethodGet, "/docs/openapi.json", nil)
+	rec := httptest.NewRecorder()
+	testapp.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code was %d not %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	doc := struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}{}
+	if err = json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.0.2" {
+		t.Errorf("openapi was %s not 3.0.2", doc.OpenAPI)
+	}
+
+	// Every registered route is documented.
+	params := regexp.MustCompile(`:([^/]+)`)
+	for _, route := range testapp.router.Routes() {
+		if route.Method != http.MethodGet && route.Method != http.MethodPost {
+			continue
+		}
+		path := params.ReplaceAllString(route.Path, "{$1}")
+		if _, ok := doc.Paths[path]; !ok && path != "/docs/*" {
+			t.Errorf("%s isn't documented", path)
+		}
+	}
+
+	// The hand-written documentation in api.yml is kept.
+	if summary := doc.Paths["/vice/launch"]["post"]["summary"]; summary != "Launch a new VICE analysis" {
+		t.Errorf("summary of /vice/launch was %v", summary)
+	}
+
+	launchResponses, _ := doc.Paths["/vice/launch"]["post"]["responses"].(map[string]interface{})
+	for _, code := range []string{"200", "202", "409"} {
+		if _, ok := launchResponses[code]; !ok {
+			t.Errorf("the %s response of /vice/launch isn't documented", code)
+		}
+	}
+
+	for _, name := range []string{"ExistingLaunch", "LaunchRequest", "LaunchProgress", "ResourceInfo", "DeploymentInfo", "TeardownProgress", "AnalysisStateResponse"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("there's no schema for %s", name)
+		}
+	}
+}
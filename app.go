@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/app-exposer/external"
 	"github.com/cyverse-de/app-exposer/instantlaunches"
 	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/tracing"
 	"github.com/jmoiron/sqlx"
+	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 )
 
 // ExposerApp encapsulates the overall application-logic, tying together the
@@ -24,6 +31,10 @@ type ExposerApp struct {
 	router          *echo.Echo
 	db              *sqlx.DB
 	instantlaunches *instantlaunches.App
+
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+	openAPIErr  error
 }
 
 // ExposerAppInit contains configuration settings for creating a new ExposerApp.
@@ -33,6 +44,7 @@ type ExposerAppInit struct {
 	PorklockImage                 string // The image containing the porklock tool
 	PorklockTag                   string // The docker tag for the image containing the porklock tool
 	UseCSIDriver                  bool   // Yes to use CSI Driver for data input/output, No to use Vice-file-transfer
+	ExposeExtraPorts              bool   // Yes to route requests to the extra ports an app declares through the VICE proxy
 	InputPathListIdentifier       string // Header line for input path lists
 	TicketInputPathListIdentifier string // Header line for ticket input path lists
 	JobStatusURL                  string
@@ -49,10 +61,78 @@ type ExposerAppInit struct {
 	UserSuffix                    string
 	MetadataBaseURL               string
 	PermissionsURL                string
+	PermissionsCacheTTL           time.Duration          // How long permission checks are cached. Zero disables caching.
+	PermissionsCacheMaxEntries    int                    // The most permission checks that are cached at once.
+	PermissionsInvalidationToken  string                 // The token services send to drop cached permission checks.
+	LookupCache                   apps.LookupCacheConfig // The cache of user and analysis ID lookups.
+	NotificationAgentURL          string
 	KeycloakBaseURL               string
 	KeycloakRealm                 string
 	KeycloakClientID              string
 	KeycloakClientSecret          string
+	ListingCacheTTL               time.Duration                      // How long admin listings are cached. Zero disables caching.
+	IngressClass                  string                             // The ingress class for VICE Ingresses. Defaults to the --ingress-class flag.
+	ExposureBackend               string                             // Either ingress or tunnel. Defaults to ingress.
+	TunnelClientImage             string                             // The tunnel client image added to analysis pods in tunnel mode.
+	TunnelGatewayURL              string                             // The URL of the gateway that tunnel clients connect to.
+	IngressAnnotations            map[string]string                  // Extra annotations added to VICE Ingresses.
+	IngressTLS                    bool                               // Yes to add a TLS section to VICE Ingresses.
+	CertManagerIssuer             string                             // The cert-manager issuer for VICE Ingress certificates, if any.
+	CertManagerIssuerKind         string                             // Either Issuer or ClusterIssuer. Defaults to ClusterIssuer.
+	IngressProxyReadTimeout       int                                // Seconds the ingress controller waits for a response from an analysis. Zero uses the controller's default.
+	IngressProxySendTimeout       int                                // Seconds the ingress controller waits while sending a request to an analysis. Zero uses the controller's default.
+	IngressWebSockets             bool                               // Yes to mark analysis Services as WebSocket services.
+	AppIngressAnnotations         map[string]map[string]string       // Ingress annotations for specific apps, keyed by app ID.
+	AppTLSModes                   map[string]string                  // TLS passthrough or client-cert forwarding for specific apps, keyed by app ID.
+	IngressClientCertSecret       string                             // The namespace/name of the Secret with the CA that client certificates are verified against.
+	PortProtocols                 map[string]map[string]string       // Protocols for the ports of specific apps, keyed by app ID and then port.
+	DefaultLabels                 map[string]string                  // Labels added to every resource created for an analysis.
+	DefaultAnnotations            map[string]string                  // Annotations added to every resource created for an analysis.
+	LabelPrefix                   string                             // The prefix for the keys of the labels describing an analysis.
+	MigrateLabelKeys              bool                               // Whether resources labeled before the prefix was configured are still matched.
+	DefaultTolerations            []apiv1.Toleration                 // Tolerations added to every analysis pod.
+	HeadlessServiceApps           []string                           // IDs of the apps that get a headless Service for their pods.
+	Scheduling                    internal.SchedulingConfig          // Node selector, tolerations, and anti-affinity for all analysis pods.
+	AppScheduling                 internal.AppSchedulingConfig       // Scheduling settings for specific apps, keyed by app ID.
+	Sidecars                      []internal.SidecarConfig           // Extra containers added to every analysis pod.
+	ImagePullSecrets              []string                           // Names of the image pull secrets added to analysis pods.
+	ToolImagePullSecrets          map[string][]string                // Image pull secrets for specific tool images, keyed by image name.
+	UsageReportGroups             []internal.UsageReportGroup        // Recipients and schedules for usage reports.
+	LaunchShaping                 internal.LaunchShapingConfig       // Queueing of launches while the cluster is busy.
+	PlanEnforcement               bool                               // Yes to hold launches to the resource ceilings of the user's plan.
+	BlockedEnvironment            []string                           // Extra patterns for environment variables users can't set.
+	SubdomainWebhooks             internal.SubdomainWebhookConfig    // Endpoints told when subdomains are allocated and released.
+	PriorityClasses               internal.PriorityClassConfig       // PriorityClasses for analysis pods and system workloads.
+	ResultManifests               map[string][]string                // Result files previewed for specific apps, keyed by app ID.
+	PodSecurity                   internal.PodSecurityConfig         // Hardened security settings for tool containers.
+	Zones                         internal.ZoneConfig                // Zone-aware scheduling for clusters spanning availability zones.
+	Preemptible                   internal.PreemptibleConfig         // Apps whose analyses can run on preemptible nodes.
+	ProxyWatchdog                 internal.ProxyWatchdogConfig       // Heartbeat watchdog for the VICE proxy sidecars.
+	CredentialRotation            internal.CredentialRotationConfig  // Rotation of the credentials mounted into analyses.
+	TimeLimits                    internal.TimeLimitConfig           // Enforcement of analysis time limits.
+	IdleShutdown                  internal.IdleShutdownConfig        // Shutdown of analyses nobody is using.
+	PersistentHostnames           internal.PersistentHostnameConfig  // Hostnames users on paid plans can claim for an app.
+	Publication                   internal.PublicationConfig         // Publication of analysis outputs to a data-publication service.
+	RBACEnabled                   bool                               // Yes to check the roles of users before letting them use routes.
+	RoleMembers                   map[string][]string                // The users with each role other than user, keyed by role.
+	IdentityKey                   string                             // The key that identity tokens are signed with.
+	Exec                          internal.ExecConfig                // Limits on exec sessions into analyses.
+	AppInitContainers             internal.AppInitContainersConfig   // Init containers for specific apps, keyed by app ID.
+	ImageProbeNamespace           string                             // The sandbox namespace that image compatibility probes run in.
+	ImageProbeTimeout             time.Duration                      // How long a probed image has to become ready.
+	ImageProbeEnforced            bool                               // Yes to refuse launches of images that failed their last probe.
+	SaveAndExitTimeout            time.Duration                      // How long save-and-exit waits for the outputs to upload.
+	NetworkPolicyEnabled          bool                               // Yes to create a NetworkPolicy for each analysis.
+	NetworkPolicyFromNamespaces   []string                           // Namespaces allowed to connect to analyses.
+	NetworkPolicyEgress           []internal.NetworkPolicyEgressRule // Destinations analyses are allowed to connect to.
+	AuditLog                      internal.AuditConfig               // Where audit events are recorded.
+	LifecycleEvents               bool                               // Yes to record Kubernetes Events for analysis lifecycle milestones.
+	Quotas                        internal.QuotaConfig               // Enforcement of the aggregate CPU and memory allotments of plans.
+	NamespaceQuotas               internal.NamespaceQuotaConfig      // The ResourceQuota and LimitRange managed in the VICE namespace.
+	AsyncLaunches                 bool                               // Yes to provision launches in the background and return 202 right away.
+	DataInfoBaseURL               string                             // The data-info service that input paths are checked with.
+	ImagePrepull                  internal.ImagePrepullConfig        // The tool images kept pulled on the VICE nodes.
+	LaunchSchedules               internal.LaunchScheduleConfig      // Launching saved templates at set times.
 }
 
 // NewExposerApp creates and returns a newly instantiated *ExposerApp.
@@ -62,6 +142,7 @@ func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Inte
 		PorklockImage:                 init.PorklockImage,
 		PorklockTag:                   init.PorklockTag,
 		UseCSIDriver:                  init.UseCSIDriver,
+		ExposeExtraPorts:              init.ExposeExtraPorts,
 		InputPathListIdentifier:       init.InputPathListIdentifier,
 		TicketInputPathListIdentifier: init.TicketInputPathListIdentifier,
 		ViceProxyImage:                init.ViceProxyImage,
@@ -76,10 +157,82 @@ func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Inte
 		JobStatusURL:                  init.JobStatusURL,
 		UserSuffix:                    init.UserSuffix,
 		PermissionsURL:                init.PermissionsURL,
+		PermissionsCacheTTL:           init.PermissionsCacheTTL,
+		PermissionsCacheMaxEntries:    init.PermissionsCacheMaxEntries,
+		PermissionsInvalidationToken:  init.PermissionsInvalidationToken,
+		LookupCache:                   init.LookupCache,
+		NotificationAgentURL:          init.NotificationAgentURL,
 		KeycloakBaseURL:               init.KeycloakBaseURL,
 		KeycloakRealm:                 init.KeycloakRealm,
 		KeycloakClientID:              init.KeycloakClientID,
 		KeycloakClientSecret:          init.KeycloakClientSecret,
+		ListingCacheTTL:               init.ListingCacheTTL,
+		IngressClass:                  init.IngressClass,
+		ExposureBackend:               init.ExposureBackend,
+		TunnelClientImage:             init.TunnelClientImage,
+		TunnelGatewayURL:              init.TunnelGatewayURL,
+		IngressAnnotations:            init.IngressAnnotations,
+		IngressTLS:                    init.IngressTLS,
+		CertManagerIssuer:             init.CertManagerIssuer,
+		CertManagerIssuerKind:         init.CertManagerIssuerKind,
+		IngressProxyReadTimeout:       init.IngressProxyReadTimeout,
+		IngressProxySendTimeout:       init.IngressProxySendTimeout,
+		IngressWebSockets:             init.IngressWebSockets,
+		AppIngressAnnotations:         init.AppIngressAnnotations,
+		AppTLSModes:                   init.AppTLSModes,
+		IngressClientCertSecret:       init.IngressClientCertSecret,
+		PortProtocols:                 init.PortProtocols,
+		DefaultLabels:                 init.DefaultLabels,
+		DefaultAnnotations:            init.DefaultAnnotations,
+		LabelPrefix:                   init.LabelPrefix,
+		MigrateLabelKeys:              init.MigrateLabelKeys,
+		DefaultTolerations:            init.DefaultTolerations,
+		HeadlessServiceApps:           init.HeadlessServiceApps,
+		Scheduling:                    init.Scheduling,
+		AppScheduling:                 init.AppScheduling,
+		Sidecars:                      init.Sidecars,
+		ImagePullSecrets:              init.ImagePullSecrets,
+		ToolImagePullSecrets:          init.ToolImagePullSecrets,
+		UsageReportGroups:             init.UsageReportGroups,
+		LaunchShaping:                 init.LaunchShaping,
+		PlanEnforcement:               init.PlanEnforcement,
+		BlockedEnvironment:            init.BlockedEnvironment,
+		SubdomainWebhooks:             init.SubdomainWebhooks,
+		PriorityClasses:               init.PriorityClasses,
+		ResultManifests:               init.ResultManifests,
+		PodSecurity:                   init.PodSecurity,
+		Zones:                         init.Zones,
+		Preemptible:                   init.Preemptible,
+		ProxyWatchdog:                 init.ProxyWatchdog,
+		CredentialRotation:            init.CredentialRotation,
+		TimeLimits:                    init.TimeLimits,
+		IdleShutdown:                  init.IdleShutdown,
+		PersistentHostnames:           init.PersistentHostnames,
+		Publication:                   init.Publication,
+		RBACEnabled:                   init.RBACEnabled,
+		RoleMembers:                   init.RoleMembers,
+		IdentityKey:                   init.IdentityKey,
+		Exec:                          init.Exec,
+		AppInitContainers:             init.AppInitContainers,
+		ImageProbeNamespace:           init.ImageProbeNamespace,
+		ImageProbeTimeout:             init.ImageProbeTimeout,
+		ImageProbeEnforced:            init.ImageProbeEnforced,
+		SaveAndExitTimeout:            init.SaveAndExitTimeout,
+		NetworkPolicyEnabled:          init.NetworkPolicyEnabled,
+		NetworkPolicyFromNamespaces:   init.NetworkPolicyFromNamespaces,
+		NetworkPolicyEgress:           init.NetworkPolicyEgress,
+		AuditLog:                      init.AuditLog,
+		LifecycleEvents:               init.LifecycleEvents,
+		Quotas:                        init.Quotas,
+		NamespaceQuotas:               init.NamespaceQuotas,
+		AsyncLaunches:                 init.AsyncLaunches,
+		DataInfoBaseURL:               init.DataInfoBaseURL,
+		ImagePrepull:                  init.ImagePrepull,
+		LaunchSchedules:               init.LaunchSchedules,
+	}
+
+	if internalInit.IngressClass == "" {
+		internalInit.IngressClass = ingressClass
 	}
 
 	app := &ExposerApp{
@@ -92,9 +245,10 @@ func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Inte
 	}
 
 	ilInit := &instantlaunches.Init{
-		UserSuffix:      init.UserSuffix,
-		MetadataBaseURL: init.MetadataBaseURL,
-		PermissionsURL:  init.PermissionsURL,
+		UserSuffix:         init.UserSuffix,
+		MetadataBaseURL:    init.MetadataBaseURL,
+		PermissionsURL:     init.PermissionsURL,
+		BlockedEnvironment: init.BlockedEnvironment,
 	}
 
 	app.router.HTTPErrorHandler = func(err error, c echo.Context) {
@@ -122,47 +276,197 @@ func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Inte
 		c.JSON(code, body)
 	}
 
+	// Spans for requests continue the trace of the caller, if there is one.
+	app.router.Use(otelecho.Middleware(tracing.ServiceName))
+
 	app.router.GET("/", app.Greeting).Name = "greeting"
 	app.router.Static("/docs", "./docs")
+	app.router.GET("/docs/openapi.json", app.OpenAPIHandler)
+	app.router.GET("/metrics", app.MetricsHandler)
+
+	// The permission each route needs, checked against the role of the user
+	// in the identity token if role-based access control is on. Routes called
+	// by other services without a user aren't checked.
+	useAnalyses := app.internal.RequirePermission(internal.PermissionUseAnalyses)
+	viewAnalyses := app.internal.RequirePermission(internal.PermissionViewAnalyses)
+	controlAnalyses := app.internal.RequirePermission(internal.PermissionControlAnalyses)
+	manageUsers := app.internal.RequirePermission(internal.PermissionManageUsers)
+	execAnalyses := app.internal.RequirePermission(internal.PermissionExecAnalyses)
+
+	// Admin and destructive actions are recorded in the audit log. The audit
+	// middleware comes before the permission checks so that denied attempts
+	// are recorded too.
+	audit := app.internal.Audit
 
 	vice := app.router.Group("/vice")
 	vice.POST("/launch", app.internal.LaunchAppHandler)
-	vice.POST("/apply-labels", app.internal.ApplyAsyncLabelsHandler)
+	vice.POST("/launch/validate", app.internal.ValidateLaunchHandler)
+	vice.POST("/batch/launch", app.internal.BatchLaunchHandler)
+	vice.GET("/launches/:id", app.internal.LaunchProgressHandler)
+	vice.POST("/apply-labels", app.internal.ApplyAsyncLabelsHandler, audit(internal.AuditRelabel))
+	vice.POST("/labels/check", app.internal.CheckLabelsHandler)
 	vice.GET("/async-data", app.internal.AsyncDataHandler)
-	vice.GET("/listing", app.internal.FilterableResourcesHandler)
+	vice.GET("/listing", app.internal.FilterableResourcesHandler, useAnalyses)
+	vice.GET("/me/permissions", app.internal.MyPermissionsHandler)
+	vice.GET("/queue", app.internal.LaunchQueueHandler, useAnalyses)
+	vice.GET("/my/gpu-budget", app.internal.GPUBudgetHandler, useAnalyses)
+	vice.GET("/quota/:username", app.internal.QuotaHandler, useAnalyses)
+	vice.GET("/analyses/diff", app.internal.AnalysisDiffHandler, useAnalyses)
+	vice.GET("/my/hostnames", app.internal.ListHostnamesHandler, useAnalyses)
+	vice.PUT("/my/hostnames/:hostname", app.internal.ClaimHostnameHandler, useAnalyses)
+	vice.DELETE("/my/hostnames/:hostname", app.internal.ReleaseHostnameHandler, useAnalyses)
+	vice.GET("/my/network-groups", app.internal.ListNetworkGroupsHandler, useAnalyses)
+	vice.PUT("/my/network-groups/:group/:analysis-id", app.internal.JoinNetworkGroupHandler, useAnalyses)
+	vice.DELETE("/my/network-groups/:group/:analysis-id", app.internal.LeaveNetworkGroupHandler, useAnalyses)
+	vice.GET("/my/templates", app.internal.ListLaunchTemplatesHandler, useAnalyses)
+	vice.POST("/my/templates", app.internal.AddLaunchTemplateHandler, useAnalyses)
+	vice.GET("/my/templates/:template-id", app.internal.GetLaunchTemplateHandler, useAnalyses)
+	vice.PUT("/my/templates/:template-id", app.internal.UpdateLaunchTemplateHandler, useAnalyses)
+	vice.DELETE("/my/templates/:template-id", app.internal.DeleteLaunchTemplateHandler, useAnalyses)
+	vice.PUT("/my/templates/:template-id/shares", app.internal.ShareLaunchTemplateHandler, useAnalyses)
+	vice.POST("/my/templates/:template-id/launch", app.internal.LaunchTemplateHandler, useAnalyses)
+	vice.GET("/my/schedules", app.internal.ListLaunchSchedulesHandler, useAnalyses)
+	vice.POST("/my/schedules", app.internal.AddLaunchScheduleHandler, useAnalyses)
+	vice.GET("/my/schedules/:schedule-id", app.internal.GetLaunchScheduleHandler, useAnalyses)
+	vice.PUT("/my/schedules/:schedule-id", app.internal.UpdateLaunchScheduleHandler, useAnalyses)
+	vice.DELETE("/my/schedules/:schedule-id", app.internal.DeleteLaunchScheduleHandler, useAnalyses)
+	vice.POST("/my/terminate-all", app.internal.TerminateAllHandler, audit(internal.AuditBulkTerminate), useAnalyses)
+	vice.POST("/my/extend-all", app.internal.ExtendAllHandler, audit(internal.AuditTimeLimitChange), useAnalyses)
 	vice.POST("/:id/download-input-files", app.internal.TriggerDownloadsHandler)
 	vice.POST("/:id/save-output-files", app.internal.TriggerUploadsHandler)
-	vice.POST("/:id/exit", app.internal.ExitHandler)
-	vice.POST("/:id/save-and-exit", app.internal.SaveAndExitHandler)
-	vice.GET("/:analysis-id/pods", app.internal.PodsHandler)
-	vice.GET("/:analysis-id/logs", app.internal.LogsHandler)
-	vice.POST("/:analysis-id/time-limit", app.internal.TimeLimitUpdateHandler)
-	vice.GET("/:analysis-id/time-limit", app.internal.GetTimeLimitHandler)
-	vice.GET("/:host/url-ready", app.internal.URLReadyHandler)
-	vice.GET("/:host/description", app.internal.DescribeAnalysisHandler)
+	vice.POST("/:id/exit", app.internal.ExitHandler, audit(internal.AuditExit))
+	vice.POST("/:id/save-and-exit", app.internal.SaveAndExitHandler, audit(internal.AuditSaveAndExit))
+	vice.POST("/:id/snapshot-outputs", app.internal.SnapshotOutputsHandler)
+	vice.GET("/:analysis-id/pods", app.internal.PodsHandler, useAnalyses)
+	vice.GET("/:analysis-id/logs", app.internal.LogsHandler, useAnalyses)
+	vice.POST("/:analysis-id/time-limit", app.internal.TimeLimitUpdateHandler, audit(internal.AuditTimeLimitChange), useAnalyses)
+	vice.GET("/:analysis-id/time-limit", app.internal.GetTimeLimitHandler, useAnalyses)
+	vice.GET("/:analysis-id/state", app.internal.GetStateHandler, useAnalyses)
+	vice.GET("/:analysis-id/uptime", app.internal.GetUptimeHandler, useAnalyses)
+	vice.GET("/:analysis-id/teardown", app.internal.GetTeardownHandler, useAnalyses)
+	vice.GET("/:analysis-id/mount-health", app.internal.MountHealthHandler, useAnalyses)
+	vice.PUT("/:analysis-id/subdomain", app.internal.SubdomainUpdateHandler, useAnalyses)
+	vice.GET("/:analysis-id/protection", app.internal.GetProtectionHandler, useAnalyses)
+	vice.PUT("/:analysis-id/protection", app.internal.ProtectAnalysisHandler, useAnalyses)
+	vice.DELETE("/:analysis-id/protection", app.internal.UnprotectAnalysisHandler, useAnalyses)
+	vice.POST("/:analysis-id/pause", app.internal.PauseAnalysisHandler, useAnalyses)
+	vice.POST("/:analysis-id/resume", app.internal.ResumeAnalysisHandler, useAnalyses)
+	vice.GET("/:analysis-id/publication", app.internal.GetPublicationHandler, useAnalyses)
+	vice.POST("/:analysis-id/publication", app.internal.PublishOutputsHandler, useAnalyses)
+	vice.GET("/reference-data", app.internal.ListReferenceDataHandler, useAnalyses)
+	vice.GET("/:host/url-ready", app.internal.URLReadyHandler, useAnalyses)
+	vice.GET("/:host/description", app.internal.DescribeAnalysisHandler, useAnalyses)
+	vice.GET("/:host/results/preview", app.internal.ResultPreviewHandler, useAnalyses)
+
+	vice.POST("/permissions/invalidate", app.internal.InvalidatePermissionsHandler, audit(internal.AuditInvalidatePermissions), app.internal.RequireInvalidationToken)
+
+	vice.POST("/proxies/:external-id/heartbeat", app.internal.ProxyHeartbeatHandler)
+	vice.POST("/proxies/:external-id/activity", app.internal.ProxyActivityHandler)
+
+	vicetunnels := vice.Group("/tunnels")
+	vicetunnels.GET("/hosts/:host", app.internal.TunnelLookupHandler)
+	vicetunnels.POST("/:external-id/register", app.internal.RegisterTunnelHandler)
+	vicetunnels.POST("/:external-id/heartbeat", app.internal.TunnelHeartbeatHandler)
+	vicetunnels.DELETE("/:external-id", app.internal.DeregisterTunnelHandler)
 
 	vicelisting := vice.Group("/listing")
-	vicelisting.GET("/", app.internal.FilterableResourcesHandler)
-	vicelisting.GET("/deployments", app.internal.FilterableDeploymentsHandler)
-	vicelisting.GET("/pods", app.internal.FilterablePodsHandler)
-	vicelisting.GET("/configmaps", app.internal.FilterableConfigMapsHandler)
-	vicelisting.GET("/services", app.internal.FilterableServicesHandler)
-	vicelisting.GET("/ingresses", app.internal.FilterableIngressesHandler)
+	vicelisting.GET("/", app.internal.FilterableResourcesHandler, useAnalyses)
+	vicelisting.GET("/deployments", app.internal.FilterableDeploymentsHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	vicelisting.GET("/pods", app.internal.FilterablePodsHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	vicelisting.GET("/configmaps", app.internal.FilterableConfigMapsHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	vicelisting.GET("/services", app.internal.FilterableServicesHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	vicelisting.GET("/ingresses", app.internal.FilterableIngressesHandler, audit(internal.AuditAdminListing), viewAnalyses)
 
 	viceadmin := vice.Group("/admin")
-	viceadmin.GET("/listing", app.internal.AdminFilterableResourcesHandler)
-	viceadmin.GET("/:host/description", app.internal.AdminDescribeAnalysisHandler)
-	viceadmin.GET("/:host/url-ready", app.internal.AdminURLReadyHandler)
+	viceadmin.GET("/listing", app.internal.AdminFilterableResourcesHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceadmin.GET("/:host/description", app.internal.AdminDescribeAnalysisHandler, viewAnalyses)
+	viceadmin.GET("/:host/url-ready", app.internal.AdminURLReadyHandler, viewAnalyses)
+	viceadmin.GET("/:host/results/preview", app.internal.AdminResultPreviewHandler, viewAnalyses)
+	viceadmin.GET("/:host/logs", app.internal.AdminHostLogsHandler, viewAnalyses)
+
+	viceusers := viceadmin.Group("/users")
+	viceusers.POST("/:username/freeze", app.internal.AdminFreezeUserHandler, audit(internal.AuditFreezeUser), manageUsers)
+	viceusers.POST("/:username/unfreeze", app.internal.AdminUnfreezeUserHandler, audit(internal.AuditUnfreezeUser), manageUsers)
+
+	viceadmin.POST("/permissions/invalidate", app.internal.InvalidatePermissionsHandler, audit(internal.AuditInvalidatePermissions), manageUsers)
+
+	viceadmin.POST("/images/pull-check", app.internal.AdminPullCheckHandler, audit(internal.AuditPullCheck), viewAnalyses)
+	viceadmin.GET("/images/prepull", app.internal.AdminPrepullStatusHandler, viewAnalyses)
+	viceadmin.POST("/images/prepull", app.internal.AdminPrepullImageHandler, audit(internal.AuditPrepullImage), controlAnalyses)
+	viceadmin.GET("/usage-report", app.internal.AdminUsageReportHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceadmin.GET("/accounting", app.internal.AdminUsageAccountingHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceadmin.GET("/namespace-quotas", app.internal.AdminNamespaceQuotasHandler, viewAnalyses)
+	viceadmin.POST("/namespace-quotas", app.internal.AdminApplyNamespaceQuotasHandler, audit(internal.AuditApplyNamespaceQuotas), controlAnalyses)
+	viceadmin.GET("/queue", app.internal.AdminLaunchQueueHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceadmin.POST("/queue/:external-id/position", app.internal.AdminMoveQueuedLaunchHandler, audit(internal.AuditMoveQueuedLaunch), controlAnalyses)
+	viceadmin.GET("/proxy-incidents", app.internal.AdminListProxyIncidentsHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceadmin.GET("/hostnames", app.internal.AdminListHostnamesHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceadmin.GET("/exec-sessions", app.internal.AdminListExecSessionsHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceadmin.GET("/backup", app.internal.AdminExportBackupHandler, audit(internal.AuditExportBackup), controlAnalyses)
+	viceadmin.POST("/simulate", app.internal.AdminSimulateLaunchHandler, viewAnalyses)
+	viceadmin.POST("/terminate", app.internal.AdminBulkTerminateHandler, audit(internal.AuditBulkTerminate), controlAnalyses)
+	viceadmin.POST("/restore", app.internal.AdminRestoreBackupHandler, audit(internal.AuditRestoreBackup), manageUsers)
+
+	vicereferencedata := viceadmin.Group("/reference-data")
+	vicereferencedata.GET("/", app.internal.ListReferenceDataHandler, viewAnalyses)
+	vicereferencedata.POST("/", app.internal.AdminAddReferenceDataHandler, audit(internal.AuditReferenceData), controlAnalyses)
+	vicereferencedata.GET("/usage", app.internal.AdminReferenceDataUsageHandler, viewAnalyses)
+	vicereferencedata.PUT("/:name", app.internal.AdminUpdateReferenceDataHandler, audit(internal.AuditReferenceData), controlAnalyses)
+	vicereferencedata.DELETE("/:name", app.internal.AdminDeleteReferenceDataHandler, audit(internal.AuditReferenceData), controlAnalyses)
+
+	viceconfigtemplates := viceadmin.Group("/config-templates")
+	viceconfigtemplates.GET("/", app.internal.AdminListConfigTemplatesHandler, viewAnalyses)
+	viceconfigtemplates.POST("/render", app.internal.AdminRenderConfigTemplateHandler, viewAnalyses)
+	viceconfigtemplates.PUT("/:app-id/:name", app.internal.AdminPutConfigTemplateHandler, audit(internal.AuditConfigTemplate), controlAnalyses)
+	viceconfigtemplates.DELETE("/:app-id/:name", app.internal.AdminDeleteConfigTemplateHandler, audit(internal.AuditConfigTemplate), controlAnalyses)
+
+	vicewebhooks := viceadmin.Group("/subdomain-webhooks")
+	vicewebhooks.GET("/deliveries", app.internal.AdminListWebhookDeliveriesHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	vicewebhooks.POST("/deliveries/:delivery-id/retry", app.internal.AdminRetryWebhookDeliveryHandler, audit(internal.AuditRetryWebhook), controlAnalyses)
+
+	viceappconcurrency := viceadmin.Group("/app-concurrency")
+	viceappconcurrency.GET("/", app.internal.AdminListAppConcurrencyHandler, viewAnalyses)
+	viceappconcurrency.PUT("/:app-id", app.internal.AdminPutAppConcurrencyHandler, audit(internal.AuditAppConcurrency), controlAnalyses)
+	viceappconcurrency.DELETE("/:app-id", app.internal.AdminDeleteAppConcurrencyHandler, audit(internal.AuditAppConcurrency), controlAnalyses)
+
+	vicecredentials := viceadmin.Group("/credentials")
+	vicecredentials.GET("/", app.internal.AdminListCredentialsHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	vicecredentials.POST("/porklock-config/rotate", app.internal.AdminRotatePorklockConfigHandler, audit(internal.AuditRotateCredentials), controlAnalyses)
+
+	viceimageprobes := viceadmin.Group("/image-probes")
+	viceimageprobes.GET("/", app.internal.AdminGetImageProbeHandler, viewAnalyses)
+	viceimageprobes.POST("/", app.internal.AdminStartImageProbeHandler, audit(internal.AuditImageProbe), controlAnalyses)
+
+	vicenodes := viceadmin.Group("/nodes")
+	vicenodes.GET("/:node/analyses", app.internal.AdminNodeAnalysesHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	vicenodes.GET("/:node/drain", app.internal.AdminGetNodeDrainHandler, viewAnalyses)
+	vicenodes.POST("/:node/drain", app.internal.AdminDrainNodeHandler, audit(internal.AuditDrainNode), controlAnalyses)
 
 	viceanalyses := viceadmin.Group("/analyses")
-	viceanalyses.GET("/", app.internal.AdminFilterableResourcesHandler)
-	viceanalyses.POST("/:analysis-id/download-input-files", app.internal.AdminTriggerDownloadsHandler)
-	viceanalyses.POST("/:analysis-id/save-output-files", app.internal.AdminTriggerUploadsHandler)
-	viceanalyses.POST("/:analysis-id/exit", app.internal.AdminExitHandler)
-	viceanalyses.POST("/:analysis-id/save-and-exit", app.internal.AdminSaveAndExitHandler)
-	viceanalyses.GET("/:analysis-id/time-limit", app.internal.AdminGetTimeLimitHandler)
-	viceanalyses.POST("/:analysis-id/time-limit", app.internal.AdminTimeLimitUpdateHandler)
-	viceanalyses.GET("/:analysis-id/external-id", app.internal.AdminGetExternalIDHandler)
+	viceanalyses.GET("/", app.internal.AdminFilterableResourcesHandler, audit(internal.AuditAdminListing), viewAnalyses)
+	viceanalyses.DELETE("/:external-id", app.internal.AdminTerminateAnalysisHandler, audit(internal.AuditTerminate), controlAnalyses)
+	viceanalyses.POST("/:analysis-id/download-input-files", app.internal.AdminTriggerDownloadsHandler, audit(internal.AuditDownloadInputs), controlAnalyses)
+	viceanalyses.POST("/:analysis-id/save-output-files", app.internal.AdminTriggerUploadsHandler, audit(internal.AuditSaveOutputs), controlAnalyses)
+	viceanalyses.POST("/:analysis-id/exit", app.internal.AdminExitHandler, audit(internal.AuditExit), controlAnalyses)
+	viceanalyses.POST("/:analysis-id/save-and-exit", app.internal.AdminSaveAndExitHandler, audit(internal.AuditSaveAndExit), controlAnalyses)
+	viceanalyses.POST("/:analysis-id/snapshot-outputs", app.internal.AdminSnapshotOutputsHandler, audit(internal.AuditSnapshotOutputs), controlAnalyses)
+	viceanalyses.GET("/:analysis-id/time-limit", app.internal.AdminGetTimeLimitHandler, viewAnalyses)
+	viceanalyses.POST("/:analysis-id/time-limit", app.internal.AdminTimeLimitUpdateHandler, audit(internal.AuditTimeLimitChange), controlAnalyses)
+	viceanalyses.GET("/:analysis-id/external-id", app.internal.AdminGetExternalIDHandler, viewAnalyses)
+	viceanalyses.GET("/:analysis-id/state", app.internal.AdminGetStateHandler, viewAnalyses)
+	viceanalyses.GET("/:analysis-id/uptime", app.internal.AdminGetUptimeHandler, viewAnalyses)
+	viceanalyses.GET("/:analysis-id/teardown", app.internal.AdminGetTeardownHandler, viewAnalyses)
+	viceanalyses.GET("/:analysis-id/launch-record", app.internal.AdminGetLaunchRecordHandler, viewAnalyses)
+	viceanalyses.GET("/:analysis-id/mount-health", app.internal.AdminMountHealthHandler, viewAnalyses)
+	viceanalyses.GET("/:analysis-id/network-check", app.internal.AdminNetworkCheckHandler, viewAnalyses)
+	viceanalyses.GET("/:analysis-id/exec", app.internal.AdminExecHandler, audit(internal.AuditExec), execAnalyses)
+	viceanalyses.PUT("/:analysis-id/subdomain", app.internal.AdminSubdomainUpdateHandler, audit(internal.AuditSubdomainChange), controlAnalyses)
+	viceanalyses.GET("/:analysis-id/protection", app.internal.AdminGetProtectionHandler, viewAnalyses)
+	viceanalyses.PUT("/:analysis-id/protection", app.internal.AdminProtectAnalysisHandler, audit(internal.AuditProtect), controlAnalyses)
+	viceanalyses.DELETE("/:analysis-id/protection", app.internal.AdminUnprotectAnalysisHandler, audit(internal.AuditUnprotect), controlAnalyses)
+	viceanalyses.POST("/:analysis-id/pause", app.internal.AdminPauseAnalysisHandler, audit(internal.AuditPause), controlAnalyses)
+	viceanalyses.POST("/:analysis-id/resume", app.internal.AdminResumeAnalysisHandler, audit(internal.AuditResume), controlAnalyses)
+	viceanalyses.GET("/:analysis-id/publication", app.internal.AdminGetPublicationHandler, viewAnalyses)
 
 	svc := app.router.Group("/service")
 	svc.POST("/:name", app.external.CreateServiceHandler)
@@ -188,6 +492,20 @@ func NewExposerApp(init *ExposerAppInit, ingressClass string, cs kubernetes.Inte
 	return app
 }
 
+// MetricsHandler publishes the statistics of the database connection pool in
+// the Prometheus text format.
+func (e *ExposerApp) MetricsHandler(c echo.Context) error {
+	var buf bytes.Buffer
+
+	if e.db != nil {
+		if err := apps.WritePoolMetrics(&buf, e.db.Stats()); err != nil {
+			return err
+		}
+	}
+
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
 // Greeting lets the caller know that the service is up and should be receiving
 // requests.
 func (e *ExposerApp) Greeting(context echo.Context) error {
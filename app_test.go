@@ -9,7 +9,9 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/cyverse-de/app-exposer/external"
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"k8s.io/client-go/kubernetes/fake"
 )
@@ -735,3 +737,48 @@ func TestDeleteIngress(t *testing.T) {
 		t.Errorf("status code was %d not 200", resp.StatusCode)
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	mockdb, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	testinit := &ExposerAppInit{
+		Namespace: "testing",
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	testapp := NewExposerApp(testinit, "linkerd", fake.NewSimpleClientset())
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	testapp.router.ServeHTTP(w, req)
+
+	resp := w.Result()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("status code was %d not 200", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, expected := range []string{
+		"# TYPE app_exposer_db_in_use_connections gauge\napp_exposer_db_in_use_connections 0\n",
+		"# TYPE app_exposer_db_wait_count_total counter\napp_exposer_db_wait_count_total 0\n",
+		"app_exposer_db_idle_connections ",
+	} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("metrics didn't contain %q:\n%s", expected, body)
+		}
+	}
+}
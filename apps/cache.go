@@ -0,0 +1,224 @@
+package apps
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultLookupCacheMaxEntries is the number of IDs cached if no maximum is
+// configured.
+const DefaultLookupCacheMaxEntries = 10000
+
+// sharedLookupTimeout bounds a lookup that other callers may be waiting on.
+// The lookup doesn't use the deadline of the caller that started it, since
+// that caller going away shouldn't fail the lookup for everyone else.
+const sharedLookupTimeout = 30 * time.Second
+
+// LookupCacheConfig contains the settings for the cache of ID lookups. A TTL
+// of zero turns the cache off.
+type LookupCacheConfig struct {
+	TTL        time.Duration `mapstructure:"ttl"`
+	MaxEntries int           `mapstructure:"max_entries"`
+}
+
+type lookupEntry struct {
+	value   string
+	expires time.Time
+}
+
+// lookupCall is a lookup in progress that other callers wait on.
+type lookupCall struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// LookupCache remembers the IDs found by lookups whose results don't change
+// once they're set, such as the UUID of a user, keyed by the kind of lookup
+// and its argument. Concurrent lookups of the same key are made once, with
+// the other callers waiting on the result. Failed lookups, including ones
+// that found nothing, aren't cached.
+type LookupCache struct {
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	entries    map[string]lookupEntry
+	calls      map[string]*lookupCall
+}
+
+// NewLookupCache returns a *LookupCache that keeps IDs for the TTL and holds
+// at most maxEntries of them. A maxEntries of zero or less uses
+// DefaultLookupCacheMaxEntries.
+func NewLookupCache(ttl time.Duration, maxEntries int) *LookupCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultLookupCacheMaxEntries
+	}
+	return &LookupCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]lookupEntry{},
+		calls:      map[string]*lookupCall{},
+	}
+}
+
+// detachedContext carries the values of its parent, such as the trace span,
+// without its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (d detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (d detachedContext) Done() <-chan struct{}             { return nil }
+func (d detachedContext) Err() error                        { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+type bypassCacheKey struct{}
+
+// WithoutCache returns a context for lookups that go to the database even if
+// the result is cached. The result still replaces the cached one.
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassCacheKey{}, true)
+}
+
+// bypassCache returns true if the context asks for lookups to skip the cache.
+func bypassCache(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassCacheKey{}).(bool)
+	return bypass
+}
+
+func lookupKey(kind, arg string) string {
+	return kind + "\x00" + arg
+}
+
+// get returns the cached value for the key and whether there was one.
+func (c *LookupCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.value, true
+}
+
+// set caches the value for the key. The caller must hold the lock. If the
+// cache is full, the expired entries are dropped, followed by the one closest
+// to expiring if that doesn't make enough room.
+func (c *LookupCache) set(key, value string) {
+	now := time.Now()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		var (
+			oldestKey string
+			oldest    time.Time
+		)
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldestKey == "" || entry.expires.Before(oldest) {
+				oldestKey, oldest = k, entry.expires
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldestKey)
+		}
+	}
+
+	c.entries[key] = lookupEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+// lookup returns the cached value for the key, or calls fn to look it up and
+// caches the result. Callers that ask for a key that's already being looked
+// up wait for that lookup instead of making their own. The lookup runs with
+// a context detached from the caller that started it and bounded by
+// sharedLookupTimeout, and each caller stops waiting when its own context is
+// done.
+func (c *LookupCache) lookup(ctx context.Context, key string, fn func(context.Context) (string, error)) (string, error) {
+	if !bypassCache(ctx) {
+		if value, ok := c.get(key); ok {
+			return value, nil
+		}
+	}
+
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &lookupCall{done: make(chan struct{})}
+		c.calls[key] = call
+		go c.run(ctx, key, call, fn)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// run makes the lookup for the call and caches the result.
+func (c *LookupCache) run(ctx context.Context, key string, call *lookupCall, fn func(context.Context) (string, error)) {
+	lookupCtx, cancel := context.WithTimeout(detachedContext{parent: ctx}, sharedLookupTimeout)
+	defer cancel()
+
+	call.value, call.err = fn(lookupCtx)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil {
+		c.set(key, call.value)
+	}
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// lookupMany returns the cached values for the arguments of the kind of
+// lookup, calling fn to look up the rest in one go and caching what it finds.
+// The returned map doesn't contain the arguments that weren't found.
+func (c *LookupCache) lookupMany(ctx context.Context, kind string, args []string, fn func([]string) (map[string]string, error)) (map[string]string, error) {
+	values := map[string]string{}
+	missing := []string{}
+	seen := map[string]bool{}
+
+	for _, arg := range args {
+		if seen[arg] {
+			continue
+		}
+		seen[arg] = true
+
+		if !bypassCache(ctx) {
+			if value, ok := c.get(lookupKey(kind, arg)); ok {
+				values[arg] = value
+				continue
+			}
+		}
+		missing = append(missing, arg)
+	}
+
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	found, err := fn(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for arg, value := range found {
+		c.set(lookupKey(kind, arg), value)
+		values[arg] = value
+	}
+
+	return values, nil
+}
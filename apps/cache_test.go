@@ -0,0 +1,214 @@
+package apps
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupApps(t *testing.T, cache *LookupCache) (*Apps, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %v", err)
+	}
+
+	a := NewApps(sqlx.NewDb(db, "postgres"), "@iplantcollaborative.org")
+	a.Cache = cache
+	return a, mock
+}
+
+func TestGetUserIDCached(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, mock := setupApps(t, NewLookupCache(time.Minute, 0))
+	mock.ExpectQuery("SELECT u.id FROM users u").
+		WithArgs("alice@iplantcollaborative.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+
+	for idx := 0; idx < 2; idx++ {
+		id, err := a.GetUserID(ctx, "alice@iplantcollaborative.org")
+		assert.NoError(err)
+		assert.Equal("u1", id)
+	}
+
+	// Skipping the cache looks the ID up again.
+	mock.ExpectQuery("SELECT u.id FROM users u").
+		WithArgs("alice@iplantcollaborative.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	id, err := a.GetUserID(WithoutCache(ctx), "alice@iplantcollaborative.org")
+	assert.NoError(err)
+	assert.Equal("u1", id)
+
+	// Users that aren't found aren't cached.
+	for idx := 0; idx < 2; idx++ {
+		mock.ExpectQuery("SELECT u.id FROM users u").
+			WithArgs("bob@iplantcollaborative.org").
+			WillReturnError(sql.ErrNoRows)
+		_, err = a.GetUserID(ctx, "bob@iplantcollaborative.org")
+		assert.Equal(sql.ErrNoRows, err)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestGetAnalysisIDByExternalIDUncached(t *testing.T) {
+	assert := assert.New(t)
+
+	a, mock := setupApps(t, nil)
+	for idx := 0; idx < 2; idx++ {
+		mock.ExpectQuery("SELECT j.id FROM jobs j").
+			WithArgs("e1").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+		id, err := a.GetAnalysisIDByExternalID(context.Background(), "e1")
+		assert.NoError(err)
+		assert.Equal("a1", id)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLookupCacheConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := NewLookupCache(time.Minute, 0)
+	release := make(chan struct{})
+	calls := 0
+
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for idx := range results {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			results[idx], _ = cache.lookup(context.Background(), "k", func(context.Context) (string, error) {
+				calls++
+				<-release
+				return "v", nil
+			})
+		}(idx)
+	}
+
+	// Give the callers time to pile up behind the first lookup.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(1, calls)
+	assert.Equal([]string{"v", "v", "v", "v", "v"}, results)
+}
+
+func TestLookupCacheCanceledCaller(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := NewLookupCache(time.Minute, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	// The caller that starts the lookup gives up on it.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := cache.lookup(ctx, "k", func(lookupCtx context.Context) (string, error) {
+			close(started)
+			<-release
+			return "v", lookupCtx.Err()
+		})
+		errs <- err
+	}()
+	<-started
+	cancel()
+	assert.Equal(context.Canceled, <-errs)
+
+	// The lookup carries on for the callers still waiting on it.
+	results := make(chan string)
+	go func() {
+		value, _ := cache.lookup(context.Background(), "k", func(context.Context) (string, error) {
+			return "other", nil
+		})
+		results <- value
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	assert.Equal("v", <-results)
+}
+
+func TestLookupCacheExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := NewLookupCache(time.Minute, 2)
+	lookup := func(key, value string) string {
+		result, _ := cache.lookup(context.Background(), key, func(context.Context) (string, error) {
+			return value, nil
+		})
+		return result
+	}
+
+	assert.Equal("1", lookup("a", "1"))
+	assert.Equal("1", lookup("a", "2"))
+
+	// The entry closest to expiring makes room for new ones.
+	lookup("b", "1")
+	lookup("c", "1")
+	assert.Len(cache.entries, 2)
+	assert.Equal("2", lookup("a", "2"))
+
+	// Expired entries are looked up again.
+	cache.entries["b"] = lookupEntry{value: "1", expires: time.Now().Add(-time.Second)}
+	assert.Equal("3", lookup("b", "3"))
+}
+
+func TestGetAnalysisIDsByExternalIDs(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	a, mock := setupApps(t, NewLookupCache(time.Minute, 0))
+	mock.ExpectQuery("SELECT j.id FROM jobs j").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+	_, err := a.GetAnalysisIDByExternalID(ctx, "e1")
+	assert.NoError(err)
+
+	// Only the IDs that aren't cached are looked up, and the ones that
+	// aren't found are left out.
+	mock.ExpectQuery("SELECT s.external_id, j.id FROM jobs j").
+		WithArgs(pq.Array([]string{"e2", "e3"})).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "id"}).AddRow("e2", "a2"))
+	ids, err := a.GetAnalysisIDsByExternalIDs(ctx, []string{"e1", "e2", "e3", "e1"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"e1": "a1", "e2": "a2"}, ids)
+
+	// The IDs that were found are cached.
+	ids, err = a.GetAnalysisIDsByExternalIDs(ctx, []string{"e2"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"e2": "a2"}, ids)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestGetUserIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	a, mock := setupApps(t, nil)
+	mock.ExpectQuery("SELECT u.username, u.id FROM users u").
+		WithArgs(pq.Array([]string{"alice", "bob"})).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("alice", "u1").AddRow("bob", "u2"))
+
+	ids, err := a.GetUserIDs(context.Background(), []string{"alice", "bob"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"alice": "u1", "bob": "u2"}, ids)
+
+	// Nothing is looked up for an empty list.
+	ids, err = a.GetUserIDs(context.Background(), []string{})
+	assert.NoError(err)
+	assert.Empty(ids)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,153 @@
+package apps
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+)
+
+// LaunchRecord contains the names of the k8s objects created for an analysis
+// along with the parameters it was launched with. It outlives the objects, so
+// that they can still be found if their labels go missing or get changed.
+type LaunchRecord struct {
+	ExternalID     string         `db:"external_id" json:"externalID"`
+	DeploymentName string         `db:"deployment_name" json:"deploymentName"`
+	ServiceName    string         `db:"service_name" json:"serviceName"`
+	IngressName    string         `db:"ingress_name" json:"ingressName,omitempty"`
+	PVCNames       pq.StringArray `db:"pvc_names" json:"pvcNames"`
+	Subdomain      string         `db:"subdomain" json:"subdomain"`
+	Params         types.JSONText `db:"params" json:"params"`
+	LaunchedAt     time.Time      `db:"launched_at" json:"launchedAt"`
+	TerminatedAt   *time.Time     `db:"terminated_at" json:"terminatedAt,omitempty"`
+}
+
+const recordLaunchQuery = `
+	INSERT INTO vice_launch_records (external_id, deployment_name, service_name, ingress_name, pvc_names, subdomain, params, launched_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET deployment_name = EXCLUDED.deployment_name,
+	       service_name = EXCLUDED.service_name,
+	       ingress_name = EXCLUDED.ingress_name,
+	       pvc_names = EXCLUDED.pvc_names,
+	       subdomain = EXCLUDED.subdomain,
+	       params = EXCLUDED.params,
+	       launched_at = EXCLUDED.launched_at,
+	       terminated_at = NULL
+`
+
+// RecordLaunch saves the launch record, replacing the one from an earlier
+// launch of the same analysis.
+func (a *Apps) RecordLaunch(ctx context.Context, record *LaunchRecord) error {
+	ctx, span := startSpan(ctx, "RecordLaunch", recordLaunchQuery)
+	defer span.End()
+
+	params := record.Params
+	if len(params) == 0 {
+		params = types.JSONText("{}")
+	}
+
+	pvcNames := record.PVCNames
+	if pvcNames == nil {
+		pvcNames = pq.StringArray{}
+	}
+
+	_, err := a.DB.ExecContext(
+		ctx,
+		recordLaunchQuery,
+		record.ExternalID,
+		record.DeploymentName,
+		record.ServiceName,
+		record.IngressName,
+		pvcNames,
+		record.Subdomain,
+		params,
+	)
+	return err
+}
+
+const launchRecordColumns = `
+	SELECT external_id,
+	       deployment_name,
+	       service_name,
+	       COALESCE(ingress_name, '') AS ingress_name,
+	       pvc_names,
+	       COALESCE(subdomain, '') AS subdomain,
+	       params,
+	       launched_at,
+	       terminated_at
+	  FROM vice_launch_records
+`
+
+const launchRecordQuery = launchRecordColumns + `
+	 WHERE external_id = $1
+`
+
+// GetLaunchRecord returns the launch record for the external ID, or nil if
+// there isn't one.
+func (a *Apps) GetLaunchRecord(ctx context.Context, externalID string) (*LaunchRecord, error) {
+	ctx, span := startSpan(ctx, "GetLaunchRecord", launchRecordQuery)
+	defer span.End()
+
+	record := &LaunchRecord{}
+	err := a.DB.QueryRowxContext(ctx, launchRecordQuery, externalID).StructScan(record)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+const launchRecordsQuery = launchRecordColumns + `
+	 WHERE external_id = ANY($1)
+`
+
+// GetLaunchRecords returns the launch records for all of the external IDs in
+// a single query, keyed by external ID. External IDs without a record are left
+// out of the map.
+func (a *Apps) GetLaunchRecords(ctx context.Context, externalIDs []string) (map[string]*LaunchRecord, error) {
+	records := map[string]*LaunchRecord{}
+	if len(externalIDs) == 0 {
+		return records, nil
+	}
+
+	ctx, span := startSpan(ctx, "GetLaunchRecords", launchRecordsQuery)
+	defer span.End()
+
+	rows, err := a.DB.QueryxContext(ctx, launchRecordsQuery, pq.Array(externalIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record := &LaunchRecord{}
+		if err = rows.StructScan(record); err != nil {
+			return nil, err
+		}
+		records[record.ExternalID] = record
+	}
+
+	return records, rows.Err()
+}
+
+const setLaunchTerminatedQuery = `
+	UPDATE vice_launch_records
+	   SET terminated_at = now()
+	 WHERE external_id = $1
+	   AND terminated_at IS NULL
+`
+
+// SetLaunchTerminated records that the objects in the launch record for the
+// external ID have been deleted.
+func (a *Apps) SetLaunchTerminated(ctx context.Context, externalID string) error {
+	ctx, span := startSpan(ctx, "SetLaunchTerminated", setLaunchTerminatedQuery)
+	defer span.End()
+
+	_, err := a.DB.ExecContext(ctx, setLaunchTerminatedQuery, externalID)
+	return err
+}
@@ -1,24 +1,105 @@
 package apps
 
 import (
+	"context"
 	"database/sql"
 	"strings"
+	"time"
 
+	"github.com/cyverse-de/app-exposer/tracing"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Apps provides an API for accessing information about apps.
 type Apps struct {
 	DB         *sqlx.DB
 	UserSuffix string
+
+	// Cache holds the results of the ID lookups. Lookups aren't cached if
+	// it's nil.
+	Cache *LookupCache
 }
 
-// NewApps allocates a new *Apps instance.
+// NewApps allocates a new *Apps instance that doesn't cache lookups.
 func NewApps(db *sqlx.DB, userSuffix string) *Apps {
+	return NewCachedApps(db, userSuffix, nil)
+}
+
+// NewCachedApps allocates a new *Apps instance that caches lookups in the
+// cache. A nil cache turns caching off.
+func NewCachedApps(db *sqlx.DB, userSuffix string, cache *LookupCache) *Apps {
 	return &Apps{
 		DB:         db,
 		UserSuffix: userSuffix,
+		Cache:      cache,
+	}
+}
+
+// The kinds of lookups that are cached.
+const (
+	analysisIDLookup = "analysis-id"
+	userIDLookup     = "user-id"
+)
+
+// cachedLookup returns the result of fn, cached under the kind of lookup and
+// its argument if the Apps has a cache.
+func (a *Apps) cachedLookup(ctx context.Context, kind, arg string, fn func(context.Context) (string, error)) (string, error) {
+	if a.Cache == nil {
+		return fn(ctx)
+	}
+	return a.Cache.lookup(ctx, lookupKey(kind, arg), fn)
+}
+
+// cachedLookups returns the results of fn for the arguments, looking up only
+// the ones that aren't cached if the Apps has a cache.
+func (a *Apps) cachedLookups(ctx context.Context, kind string, args []string, fn func([]string) (map[string]string, error)) (map[string]string, error) {
+	if a.Cache == nil {
+		return fn(args)
+	}
+	return a.Cache.lookupMany(ctx, kind, args, fn)
+}
+
+// queryIDs runs a query that takes an array of arguments and returns pairs
+// of an argument and the ID found for it, returning the IDs keyed by their
+// arguments.
+func (a *Apps) queryIDs(ctx context.Context, method, query string, args []string) (map[string]string, error) {
+	ids := map[string]string{}
+	if len(args) == 0 {
+		return ids, nil
+	}
+
+	ctx, span := startSpan(ctx, method, query)
+	defer span.End()
+
+	rows, err := a.DB.QueryContext(ctx, query, pq.Array(args))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var arg, id string
+		if err = rows.Scan(&arg, &id); err != nil {
+			return nil, err
+		}
+		ids[arg] = id
 	}
+
+	return ids, rows.Err()
+}
+
+// startSpan starts a client span for the query made by the method.
+func startSpan(ctx context.Context, method, query string) (context.Context, trace.Span) {
+	return tracing.StartSpan(ctx, "apps."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", strings.TrimSpace(query)),
+		),
+	)
 }
 
 const analysisIDByExternalIDQuery = `
@@ -29,16 +110,41 @@ const analysisIDByExternalIDQuery = `
 `
 
 // GetAnalysisIDByExternalID returns the analysis ID based on the external ID
-// passed in.
-func (a *Apps) GetAnalysisIDByExternalID(externalID string) (string, error) {
+// passed in. The result is cached, since the ID doesn't change.
+func (a *Apps) GetAnalysisIDByExternalID(ctx context.Context, externalID string) (string, error) {
+	return a.cachedLookup(ctx, analysisIDLookup, externalID, func(ctx context.Context) (string, error) {
+		return a.getAnalysisIDByExternalID(ctx, externalID)
+	})
+}
+
+func (a *Apps) getAnalysisIDByExternalID(ctx context.Context, externalID string) (string, error) {
+	ctx, span := startSpan(ctx, "GetAnalysisIDByExternalID", analysisIDByExternalIDQuery)
+	defer span.End()
+
 	var analysisID string
-	err := a.DB.QueryRow(analysisIDByExternalIDQuery, externalID).Scan(&analysisID)
+	err := a.DB.QueryRowContext(ctx, analysisIDByExternalIDQuery, externalID).Scan(&analysisID)
 	if err != nil {
 		return "", err
 	}
 	return analysisID, nil
 }
 
+const analysisIDsByExternalIDsQuery = `
+	SELECT s.external_id, j.id
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	 WHERE s.external_id = ANY($1)
+`
+
+// GetAnalysisIDsByExternalIDs returns the analysis IDs for all of the external
+// IDs, keyed by external ID, in a single query for the ones that aren't
+// cached. External IDs that weren't found are left out of the map.
+func (a *Apps) GetAnalysisIDsByExternalIDs(ctx context.Context, externalIDs []string) (map[string]string, error) {
+	return a.cachedLookups(ctx, analysisIDLookup, externalIDs, func(missing []string) (map[string]string, error) {
+		return a.queryIDs(ctx, "GetAnalysisIDsByExternalIDs", analysisIDsByExternalIDsQuery, missing)
+	})
+}
+
 const analysisIDBySubdomainQuery = `
 	SELECT j.id
 	  FROM jobs j
@@ -47,9 +153,12 @@ const analysisIDBySubdomainQuery = `
 
 // GetAnalysisIDBySubdomain returns the analysis ID based on the subdomain
 // generated for it.
-func (a *Apps) GetAnalysisIDBySubdomain(subdomain string) (string, error) {
+func (a *Apps) GetAnalysisIDBySubdomain(ctx context.Context, subdomain string) (string, error) {
+	ctx, span := startSpan(ctx, "GetAnalysisIDBySubdomain", analysisIDBySubdomainQuery)
+	defer span.End()
+
 	var analysisID string
-	err := a.DB.QueryRow(analysisIDBySubdomainQuery, subdomain).Scan(&analysisID)
+	err := a.DB.QueryRowContext(ctx, analysisIDBySubdomainQuery, subdomain).Scan(&analysisID)
 	if err != nil {
 		return "", err
 	}
@@ -66,13 +175,16 @@ const getUserIPQuery = `
 `
 
 // GetUserIP returns the latest login ip address for the given user ID.
-func (a *Apps) GetUserIP(userID string) (string, error) {
+func (a *Apps) GetUserIP(ctx context.Context, userID string) (string, error) {
+	ctx, span := startSpan(ctx, "GetUserIP", getUserIPQuery)
+	defer span.End()
+
 	var (
 		ipAddr sql.NullString
 		retval string
 	)
 
-	err := a.DB.QueryRow(getUserIPQuery, userID).Scan(&ipAddr)
+	err := a.DB.QueryRowContext(ctx, getUserIPQuery, userID).Scan(&ipAddr)
 	if err != nil {
 		return "", err
 	}
@@ -93,9 +205,12 @@ const getAnalysisStatusQuery = `
 `
 
 // GetAnalysisStatus gets the current status of the overall Analysis/Job in the database.
-func (a *Apps) GetAnalysisStatus(analysisID string) (string, error) {
+func (a *Apps) GetAnalysisStatus(ctx context.Context, analysisID string) (string, error) {
+	ctx, span := startSpan(ctx, "GetAnalysisStatus", getAnalysisStatusQuery)
+	defer span.End()
+
 	var status string
-	err := a.DB.QueryRow(getAnalysisStatusQuery, analysisID).Scan(&status)
+	err := a.DB.QueryRowContext(ctx, getAnalysisStatusQuery, analysisID).Scan(&status)
 	if err != nil {
 		return "", err
 	}
@@ -111,9 +226,12 @@ const userByAnalysisIDQuery = `
 `
 
 // GetUserByAnalysisID returns the username and id of the user that launched the analysis.
-func (a *Apps) GetUserByAnalysisID(analysisID string) (string, string, error) {
+func (a *Apps) GetUserByAnalysisID(ctx context.Context, analysisID string) (string, string, error) {
+	ctx, span := startSpan(ctx, "GetUserByAnalysisID", userByAnalysisIDQuery)
+	defer span.End()
+
 	var username, id string
-	err := a.DB.QueryRow(userByAnalysisIDQuery, analysisID).Scan(&username, &id)
+	err := a.DB.QueryRowContext(ctx, userByAnalysisIDQuery, analysisID).Scan(&username, &id)
 	if err != nil {
 		return "", "", err
 	}
@@ -130,8 +248,233 @@ const userByUsername = `
 `
 
 // GetUserID returns the user's UUID based on their full username, including domain suffix.
-func (a *Apps) GetUserID(username string) (string, error) {
+// The result is cached, since the UUID doesn't change.
+func (a *Apps) GetUserID(ctx context.Context, username string) (string, error) {
+	return a.cachedLookup(ctx, userIDLookup, username, func(ctx context.Context) (string, error) {
+		return a.getUserID(ctx, username)
+	})
+}
+
+func (a *Apps) getUserID(ctx context.Context, username string) (string, error) {
+	ctx, span := startSpan(ctx, "GetUserID", userByUsername)
+	defer span.End()
+
 	var id string
-	err := a.DB.QueryRow(userByUsername, username).Scan(&id)
+	err := a.DB.QueryRowContext(ctx, userByUsername, username).Scan(&id)
 	return id, err
 }
+
+const usersByUsernames = `
+	SELECT u.username, u.id
+	  FROM users u
+	 WHERE u.username = ANY($1)
+`
+
+// GetUserIDs returns the UUIDs of the users with the full usernames, keyed by
+// username, in a single query for the ones that aren't cached. Usernames that
+// weren't found are left out of the map.
+func (a *Apps) GetUserIDs(ctx context.Context, usernames []string) (map[string]string, error) {
+	return a.cachedLookups(ctx, userIDLookup, usernames, func(missing []string) (map[string]string, error) {
+		return a.queryIDs(ctx, "GetUserIDs", usersByUsernames, missing)
+	})
+}
+
+// AnalysisRecord contains the information about an analysis that's stored in
+// the database and also used to label its k8s resources.
+type AnalysisRecord struct {
+	ExternalID   string `db:"external_id"`
+	AnalysisID   string `db:"analysis_id"`
+	AnalysisName string `db:"analysis_name"`
+	AppID        string `db:"app_id"`
+	AppName      string `db:"app_name"`
+	UserID       string `db:"user_id"`
+	Username     string `db:"username"`
+}
+
+const analysisRecordsByExternalIDsQuery = `
+	SELECT s.external_id,
+	       j.id AS analysis_id,
+	       COALESCE(j.job_name, '') AS analysis_name,
+	       COALESCE(j.app_id, '') AS app_id,
+	       COALESCE(j.app_name, '') AS app_name,
+	       u.id AS user_id,
+	       u.username
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN users u ON j.user_id = u.id
+	 WHERE s.external_id = ANY($1)
+`
+
+// GetAnalysisRecordsByExternalIDs looks up the analyses for all of the
+// external IDs in a single query. The returned map is keyed by external ID and
+// won't contain entries for external IDs that weren't found.
+func (a *Apps) GetAnalysisRecordsByExternalIDs(ctx context.Context, externalIDs []string) (map[string]*AnalysisRecord, error) {
+	ctx, span := startSpan(ctx, "GetAnalysisRecordsByExternalIDs", analysisRecordsByExternalIDsQuery)
+	defer span.End()
+
+	records := map[string]*AnalysisRecord{}
+
+	rows, err := a.DB.QueryxContext(ctx, analysisRecordsByExternalIDsQuery, pq.Array(externalIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record := &AnalysisRecord{}
+		if err = rows.StructScan(record); err != nil {
+			return nil, err
+		}
+		records[record.ExternalID] = record
+	}
+
+	return records, rows.Err()
+}
+
+// UserPlan contains the resource ceilings of the subscription plan a user is
+// on. The Max fields limit each analysis and the Total fields limit all of the
+// user's running analyses together. GPUHours is the number of GPU-hours the
+// user can use each month. A nil ceiling means the plan doesn't
+// limit that resource.
+type UserPlan struct {
+	Name              string   `db:"name"`
+	MaxCPUCores       *float64 `db:"max_cpu_cores"`
+	MaxMemory         *int64   `db:"max_memory"`
+	MaxGPUs           *int64   `db:"max_gpus"`
+	MaxConcurrentJobs *int     `db:"max_concurrent_jobs"`
+	TotalCPUCores     *float64 `db:"total_cpu_cores"`
+	TotalMemory       *int64   `db:"total_memory"`
+	GPUHours          *float64 `db:"gpu_hours"`
+}
+
+const userPlanQuery = `
+	SELECT p.name,
+	       p.max_cpu_cores,
+	       p.max_memory,
+	       p.max_gpus,
+	       p.max_concurrent_jobs,
+	       p.total_cpu_cores,
+	       p.total_memory,
+	       p.gpu_hours
+	  FROM user_plans up
+	  JOIN plans p ON up.plan_id = p.id
+	  JOIN users u ON up.user_id = u.id
+	 WHERE u.username = $1
+	   AND up.effective_start_date <= now()
+	   AND (up.effective_end_date IS NULL OR up.effective_end_date > now())
+	 ORDER BY up.effective_start_date DESC
+	 LIMIT 1
+`
+
+// GetUserPlan returns the plan the user is currently on, or nil if they
+// aren't on one. The username should include the domain suffix.
+func (a *Apps) GetUserPlan(ctx context.Context, username string) (*UserPlan, error) {
+	ctx, span := startSpan(ctx, "GetUserPlan", userPlanQuery)
+	defer span.End()
+
+	plan := &UserPlan{}
+	err := a.DB.QueryRowxContext(ctx, userPlanQuery, username).StructScan(plan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// AnalysisProvenance contains the information recorded about an analysis
+// that describes where its outputs came from.
+type AnalysisProvenance struct {
+	AnalysisID   string     `db:"analysis_id" json:"analysisID"`
+	AnalysisName string     `db:"analysis_name" json:"analysisName"`
+	Description  string     `db:"description" json:"description"`
+	AppID        string     `db:"app_id" json:"appID"`
+	AppName      string     `db:"app_name" json:"appName"`
+	Username     string     `db:"username" json:"username"`
+	ResultFolder string     `db:"result_folder" json:"resultFolder"`
+	StartDate    *time.Time `db:"start_date" json:"startDate,omitempty"`
+	EndDate      *time.Time `db:"end_date" json:"endDate,omitempty"`
+}
+
+const analysisProvenanceQuery = `
+	SELECT j.id AS analysis_id,
+	       COALESCE(j.job_name, '') AS analysis_name,
+	       COALESCE(j.job_description, '') AS description,
+	       COALESCE(j.app_id, '') AS app_id,
+	       COALESCE(j.app_name, '') AS app_name,
+	       u.username,
+	       COALESCE(j.result_folder_path, '') AS result_folder,
+	       j.start_date,
+	       j.end_date
+	  FROM jobs j
+	  JOIN users u ON j.user_id = u.id
+	 WHERE j.id = $1
+`
+
+// GetAnalysisProvenance returns the provenance of the analysis.
+func (a *Apps) GetAnalysisProvenance(ctx context.Context, analysisID string) (*AnalysisProvenance, error) {
+	ctx, span := startSpan(ctx, "GetAnalysisProvenance", analysisProvenanceQuery)
+	defer span.End()
+
+	provenance := &AnalysisProvenance{}
+	err := a.DB.QueryRowxContext(ctx, analysisProvenanceQuery, analysisID).StructScan(provenance)
+	if err != nil {
+		return nil, err
+	}
+	return provenance, nil
+}
+
+const analysisSubmissionQuery = `
+	SELECT COALESCE(j.submission::text, '{}')
+	  FROM jobs j
+	 WHERE j.id = $1
+`
+
+// GetAnalysisSubmission returns the JSON submission the analysis was launched
+// with.
+func (a *Apps) GetAnalysisSubmission(ctx context.Context, analysisID string) ([]byte, error) {
+	ctx, span := startSpan(ctx, "GetAnalysisSubmission", analysisSubmissionQuery)
+	defer span.End()
+
+	var submission string
+	if err := a.DB.QueryRowContext(ctx, analysisSubmissionQuery, analysisID).Scan(&submission); err != nil {
+		return nil, err
+	}
+	return []byte(submission), nil
+}
+
+const externalIDsByAnalysisIDsQuery = `
+	SELECT s.external_id
+	  FROM job_steps s
+	 WHERE s.job_id = ANY($1)
+	   AND s.external_id IS NOT NULL
+`
+
+// GetExternalIDsByAnalysisIDs returns the external IDs of the steps of the
+// analyses.
+func (a *Apps) GetExternalIDsByAnalysisIDs(ctx context.Context, analysisIDs []string) ([]string, error) {
+	ctx, span := startSpan(ctx, "GetExternalIDsByAnalysisIDs", externalIDsByAnalysisIDsQuery)
+	defer span.End()
+
+	externalIDs := []string{}
+	if len(analysisIDs) == 0 {
+		return externalIDs, nil
+	}
+
+	rows, err := a.DB.QueryContext(ctx, externalIDsByAnalysisIDsQuery, pq.Array(analysisIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var externalID string
+		if err = rows.Scan(&externalID); err != nil {
+			return nil, err
+		}
+		externalIDs = append(externalIDs, externalID)
+	}
+
+	return externalIDs, rows.Err()
+}
@@ -0,0 +1,111 @@
+package apps
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PoolConfig contains the connection pool settings for the database handle.
+// Zero values leave the database/sql defaults in place.
+type PoolConfig struct {
+	MaxOpenConns    int           `mapstructure:"max_open_conns"`
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`
+}
+
+// Configure applies the pool settings to the database handle.
+func (c *PoolConfig) Configure(db *sqlx.DB) {
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+}
+
+// poolMetric is a statistic of the connection pool published as a metric.
+type poolMetric struct {
+	name       string
+	metricType string
+	help       string
+	value      func(stats *sql.DBStats) float64
+}
+
+var poolMetrics = []poolMetric{
+	{
+		name:       "app_exposer_db_max_open_connections",
+		metricType: "gauge",
+		help:       "The maximum number of open connections to the database.",
+		value:      func(s *sql.DBStats) float64 { return float64(s.MaxOpenConnections) },
+	},
+	{
+		name:       "app_exposer_db_open_connections",
+		metricType: "gauge",
+		help:       "The number of established connections to the database, in use or idle.",
+		value:      func(s *sql.DBStats) float64 { return float64(s.OpenConnections) },
+	},
+	{
+		name:       "app_exposer_db_in_use_connections",
+		metricType: "gauge",
+		help:       "The number of connections to the database currently in use.",
+		value:      func(s *sql.DBStats) float64 { return float64(s.InUse) },
+	},
+	{
+		name:       "app_exposer_db_idle_connections",
+		metricType: "gauge",
+		help:       "The number of idle connections to the database.",
+		value:      func(s *sql.DBStats) float64 { return float64(s.Idle) },
+	},
+	{
+		name:       "app_exposer_db_wait_count_total",
+		metricType: "counter",
+		help:       "The total number of connections waited for.",
+		value:      func(s *sql.DBStats) float64 { return float64(s.WaitCount) },
+	},
+	{
+		name:       "app_exposer_db_wait_duration_seconds_total",
+		metricType: "counter",
+		help:       "The total time blocked waiting for a new connection.",
+		value:      func(s *sql.DBStats) float64 { return s.WaitDuration.Seconds() },
+	},
+	{
+		name:       "app_exposer_db_max_idle_closed_total",
+		metricType: "counter",
+		help:       "The total number of connections closed because of the idle connection limit.",
+		value:      func(s *sql.DBStats) float64 { return float64(s.MaxIdleClosed) },
+	},
+	{
+		name:       "app_exposer_db_max_lifetime_closed_total",
+		metricType: "counter",
+		help:       "The total number of connections closed because of the connection lifetime.",
+		value:      func(s *sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) },
+	},
+}
+
+// WritePoolMetrics writes the statistics of the connection pool in the
+// Prometheus text exposition format.
+func WritePoolMetrics(w io.Writer, stats sql.DBStats) error {
+	for _, metric := range poolMetrics {
+		_, err := fmt.Fprintf(
+			w,
+			"# HELP %s %s\n# TYPE %s %s\n%s %g\n",
+			metric.name,
+			metric.help,
+			metric.name,
+			metric.metricType,
+			metric.name,
+			metric.value(&stats),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
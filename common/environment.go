@@ -0,0 +1,77 @@
+package common
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Limits on the environment variables users can set for an analysis.
+const (
+	MaxEnvironmentVariables   = 50
+	MaxEnvironmentValueLength = 4096
+)
+
+// BlockedEnvironmentPatterns are the names of environment variables that users
+// can never set, as shell glob patterns. They're either set by VICE itself or
+// change how programs in the container are loaded.
+var BlockedEnvironmentPatterns = []string{
+	"IPLANT_*",
+	"REDIRECT_URL",
+	"KUBERNETES_*",
+	"LD_*",
+	"PATH",
+	"HOME",
+}
+
+// blockedEnvironmentName returns the pattern that blocks the name, if any.
+func blockedEnvironmentName(name string, blocked []string) (string, bool) {
+	upper := strings.ToUpper(name)
+	for _, pattern := range blocked {
+		if matched, _ := path.Match(strings.ToUpper(pattern), upper); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// ValidateEnvironment returns an ErrorResponse listing the problems with
+// environment variables supplied by a user. Names matching the default
+// blocklist or any of the extra patterns are rejected.
+func ValidateEnvironment(env map[string]string, extraBlocked []string) error {
+	problems := []string{}
+	blocked := append(append([]string{}, BlockedEnvironmentPatterns...), extraBlocked...)
+
+	if len(env) > MaxEnvironmentVariables {
+		problems = append(problems, fmt.Sprintf("at most %d variables can be set", MaxEnvironmentVariables))
+	}
+
+	for name, value := range env {
+		for _, msg := range validation.IsEnvVarName(name) {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, msg))
+		}
+		if pattern, ok := blockedEnvironmentName(name, blocked); ok {
+			problems = append(problems, fmt.Sprintf("%s is reserved (%s)", name, pattern))
+		}
+		if len(value) > MaxEnvironmentValueLength {
+			problems = append(problems, fmt.Sprintf("%s is longer than %d characters", name, MaxEnvironmentValueLength))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+
+	return ErrorResponse{
+		ErrorCode: "ERR_ENVIRONMENT_NOT_ALLOWED",
+		Message:   fmt.Sprintf("the environment variables can't be set: %s", strings.Join(problems, "; ")),
+		Details: &map[string]interface{}{
+			"problems": problems,
+		},
+	}
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEnvironment(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		extra   []string
+		allowed bool
+	}{
+		{nil, nil, true},
+		{map[string]string{"JUPYTER_ENABLE_LAB": "yes", "MY_TOKEN": "abc"}, nil, true},
+		{map[string]string{"IPLANT_USER": "someone-else"}, nil, false},
+		{map[string]string{"ld_preload": "/tmp/evil.so"}, nil, false},
+		{map[string]string{"PATH": "/tmp"}, nil, false},
+		{map[string]string{"1BAD=NAME": "x"}, nil, false},
+		{map[string]string{"LONG": strings.Repeat("x", MaxEnvironmentValueLength+1)}, nil, false},
+		{map[string]string{"AWS_SECRET_ACCESS_KEY": "x"}, []string{"AWS_*"}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateEnvironment(test.env, test.extra)
+		if test.allowed && err != nil {
+			t.Errorf("%v should be allowed: %s", test.env, err)
+		}
+		if !test.allowed {
+			if err == nil {
+				t.Errorf("%v should not be allowed", test.env)
+			} else if err.(ErrorResponse).ErrorCode != "ERR_ENVIRONMENT_NOT_ALLOWED" {
+				t.Errorf("unexpected error code for %v: %s", test.env, err)
+			}
+		}
+	}
+}
+
+func TestValidateEnvironmentCount(t *testing.T) {
+	env := map[string]string{}
+	for i := 0; i <= MaxEnvironmentVariables; i++ {
+		env[strings.Repeat("A", i+1)] = "x"
+	}
+
+	if err := ValidateEnvironment(env, nil); err == nil {
+		t.Error("too many variables should not be allowed")
+	}
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/gosimple/slug"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// labelValueHashLength is the number of hex digits of the hash added to label
+// values that had to be truncated.
+const labelValueHashLength = 8
+
+// The replacers leave non-ASCII characters alone, since slug transliterates
+// them.
+var leadingLabelReplacerRegexp = regexp.MustCompile(`^[^0-9A-Za-z\x{80}-\x{10FFFF}]+`)
+var trailingLabelReplacerRegexp = regexp.MustCompile(`[^0-9A-Za-z\x{80}-\x{10FFFF}]+$`)
+var labelValueHashRegexp = regexp.MustCompile("-([0-9a-f]{8})$")
+
+// The replacers used before long label values were truncated with a hash
+// suffix, which stripped leading and trailing non-ASCII characters too.
+var legacyLeadingLabelReplacerRegexp = regexp.MustCompile("^[^0-9A-Za-z]+")
+var legacyTrailingLabelReplacerRegexp = regexp.MustCompile("[^0-9A-Za-z]+$")
+
+// labelReplacerFn returns a function that can be used to replace invalid leading and trailing characters
+// in label values. Hyphens are replaced by the letter "h". Underscores are replaced by the letter "u".
+// Other characters in the match are replaced by the empty string. The prefix and suffix are placed before
+// and after the replacement, respectively.
+func labelReplacerFn(prefix, suffix string) func(string) string {
+	replacementFor := map[rune]string{
+		'-': "h",
+		'_': "u",
+	}
+
+	return func(match string) string {
+		runes := []rune(match)
+		elems := make([]string, len(runes))
+		for i, c := range runes {
+			elems[i] = replacementFor[c]
+		}
+		return prefix + strings.Join(elems, "-") + suffix
+	}
+}
+
+// LabelValueHash returns the hash of the string that's added to its label value
+// if the label value has to be truncated.
+func LabelValueHash(str string) string {
+	sum := sha256.Sum256([]byte(str))
+	return hex.EncodeToString(sum[:])[:labelValueHashLength]
+}
+
+// LabelValueString returns a version of the given string that may be used as a value in a Kubernetes
+// label. See: https://kubernetes.io/docs/concepts/overview/working-with-objects/labels/. Leading and
+// trailing underscores and hyphens are replaced by sequences of `u` and `h`, separated by hyphens.
+// These sequences are separated from the main part of the label value by `-xxx-`. This is kind of
+// hokey, but it makes it at least fairly unlikely that we'll encounter collisions.
+//
+// Values that would be longer than 63 characters are truncated and end with a hyphen and the first
+// eight hex digits of the SHA-256 hash of the original string, so that long strings with the same
+// beginning still get different label values.
+func LabelValueString(str string) string {
+	original := str
+	str = leadingLabelReplacerRegexp.ReplaceAllStringFunc(str, labelReplacerFn("", "-xxx-"))
+	str = trailingLabelReplacerRegexp.ReplaceAllStringFunc(str, labelReplacerFn("-xxx-", ""))
+	str = slug.Make(str)
+
+	if len(str) <= validation.LabelValueMaxLength {
+		return str
+	}
+
+	// Slugs only contain ASCII characters, so they can be cut anywhere. Label
+	// values have to start and end with an alphanumeric character.
+	str = str[:validation.LabelValueMaxLength-labelValueHashLength-1]
+	str = strings.TrimRight(str, "-_")
+	return str + "-" + LabelValueHash(original)
+}
+
+// LabelValueHashSuffix returns the hash at the end of a label value that may
+// have been truncated by LabelValueString. The second return value is false if
+// the label value isn't long enough to have been truncated or doesn't end with
+// a hash. A label value that ends with something that looks like a hash may
+// not have been truncated; LabelValueMatches tells for sure.
+func LabelValueHashSuffix(value string) (string, bool) {
+	if len(value) < validation.LabelValueMaxLength-labelValueHashLength {
+		return "", false
+	}
+
+	matches := labelValueHashRegexp.FindStringSubmatch(value)
+	if matches == nil {
+		return "", false
+	}
+
+	return matches[1], true
+}
+
+// LabelValueMatches returns true if the label value is the one LabelValueString
+// returns for the string.
+func LabelValueMatches(value, str string) bool {
+	return LabelValueString(str) == value
+}
+
+// FindLabelValueOriginal returns the candidate that LabelValueString turns
+// into the label value, which makes it possible to find the original of a
+// truncated label value. The second return value is false if none of the
+// candidates match.
+func FindLabelValueOriginal(value string, candidates []string) (string, bool) {
+	for _, candidate := range candidates {
+		if LabelValueMatches(value, candidate) {
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
+
+// LegacyLabelValueString returns the label value LabelValueString returned for
+// the string before long values were truncated with a hash suffix. Resources
+// created before then are still labeled with it.
+func LegacyLabelValueString(str string) string {
+	str = legacyLeadingLabelReplacerRegexp.ReplaceAllStringFunc(str, labelReplacerFn("", "-xxx-"))
+	str = legacyTrailingLabelReplacerRegexp.ReplaceAllStringFunc(str, labelReplacerFn("-xxx-", ""))
+	return legacyTruncate(slug.Make(str), validation.LabelValueMaxLength)
+}
+
+// legacyTruncate cuts the slug down to the last whole word that fits in the
+// maximum length, the way slug does when its MaxLength is set.
+func legacyTruncate(text string, max int) string {
+	if len(text) < max {
+		return text
+	}
+
+	words := strings.SplitAfter(text, "-")
+	if len(words[0]) > max {
+		return words[0][:max]
+	}
+
+	var truncated string
+	for _, word := range words {
+		if len(truncated)+len(word)-1 > max {
+			break
+		}
+		truncated += word
+	}
+	return strings.Trim(truncated, "-")
+}
+
+// LabelValues returns the values a label for the string can have on existing
+// resources: the one LabelValueString returns, followed by the legacy one if
+// it's different. Resources should be looked up by all of them until the ones
+// labeled with legacy values are gone.
+func LabelValues(str string) []string {
+	values := []string{LabelValueString(str)}
+	if legacy := LegacyLabelValueString(str); legacy != values[0] {
+		values = append(values, legacy)
+	}
+	return values
+}
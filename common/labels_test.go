@@ -0,0 +1,114 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestLabelValueReplacement(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("foo-xxx-u", LabelValueString("foo_"))
+	assert.Equal("foo-xxx-u-u", LabelValueString("foo__"))
+	assert.Equal("foo-xxx-u-h-u", LabelValueString("foo_-_"))
+	assert.Equal("h-xxx-foo", LabelValueString("-foo"))
+	assert.Equal("h-u-h-xxx-foo", LabelValueString("-_-foo"))
+	assert.Equal("h-u-h-xxx-foo-bar-xxx-h-u-h", LabelValueString("-_-foo-bar-_-"))
+	assert.Equal("u-u-u-xxx-foo_bar-xxx-u-u-u", LabelValueString("___foo_bar___"))
+	assert.Equal("u-u-u-u-xxx-foo__bar-baz__quux-xxx-u-u-u-u", LabelValueString("____foo__bar--baz__quux____"))
+}
+
+func TestLabelValueTruncation(t *testing.T) {
+	assert := assert.New(t)
+
+	short := "my analysis"
+	assert.Equal("my-analysis", LabelValueString(short))
+
+	long := strings.Repeat("analysis ", 10)
+	value := LabelValueString(long)
+	assert.True(len(value) <= 63)
+	assert.Empty(validation.IsValidLabelValue(value))
+	assert.True(strings.HasSuffix(value, "-"+LabelValueHash(long)))
+
+	// Long strings with the same beginning get different values.
+	other := LabelValueString(long + "2")
+	assert.NotEqual(value, other)
+	assert.Equal(value[:40], other[:40])
+
+	// The same string always gets the same value.
+	assert.Equal(value, LabelValueString(long))
+}
+
+func TestLabelValueUnicode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("resume-final", LabelValueString("Résumé final"))
+	assert.Equal("emile", LabelValueString("émile"))
+	assert.Equal("shu-ju-fen-xi", LabelValueString("数据分析"))
+	assert.Equal("h-xxx-genome", LabelValueString("-🧬 genome"))
+
+	inputs := []string{
+		strings.Repeat("数据分析", 20),
+		strings.Repeat("Größenverhältnis ", 8),
+		strings.Repeat("🧬 genome ", 12),
+		"_" + strings.Repeat("é", 100) + "_",
+	}
+	for _, input := range inputs {
+		value := LabelValueString(input)
+		assert.True(utf8.RuneCountInString(value) <= 63, input)
+		assert.Empty(validation.IsValidLabelValue(value), input)
+		assert.Equal(value, LabelValueString(input), input)
+	}
+
+	assert.NotEqual(LabelValueString(inputs[0]), LabelValueString(inputs[0]+"数"))
+}
+
+func TestLabelValueReverseLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	long := strings.Repeat("数据分析", 20)
+	candidates := []string{"short", long + "a", long}
+	value := LabelValueString(long)
+
+	hash, ok := LabelValueHashSuffix(value)
+	assert.True(ok)
+	assert.Equal(LabelValueHash(long), hash)
+
+	_, ok = LabelValueHashSuffix("short")
+	assert.False(ok)
+
+	original, ok := FindLabelValueOriginal(value, candidates)
+	assert.True(ok)
+	assert.Equal(long, original)
+
+	original, ok = FindLabelValueOriginal(LabelValueString("short"), candidates)
+	assert.True(ok)
+	assert.Equal("short", original)
+
+	_, ok = FindLabelValueOriginal(value, []string{"unrelated"})
+	assert.False(ok)
+}
+
+func TestLegacyLabelValueString(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("foo-xxx-u", LegacyLabelValueString("foo_"))
+	assert.Equal("xxx-mile", LegacyLabelValueString("émile"))
+
+	// Long values were cut at the last whole word that fit.
+	long := strings.Repeat("analysis ", 10)
+	assert.Equal(strings.TrimSuffix(strings.Repeat("analysis-", 7), "-"), LegacyLabelValueString(long))
+}
+
+func TestLabelValues(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"alice"}, LabelValues("alice"))
+
+	long := strings.Repeat("analysis ", 10)
+	assert.Equal([]string{LabelValueString(long), LegacyLabelValueString(long)}, LabelValues(long))
+}
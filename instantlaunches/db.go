@@ -1,6 +1,10 @@
 package instantlaunches
 
 import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx/types"
 	"github.com/lib/pq"
 )
 
@@ -457,3 +461,97 @@ func (a *App) ListViablePublicQuickLaunches(user string) ([]QuickLaunch, error)
 	err := a.DB.Select(&l, listPublicQLsQuery, user)
 	return l, err
 }
+
+const userLaunchDefaultsQuery = `
+	SELECT d.defaults
+	  FROM user_instant_launch_defaults d
+	  JOIN users ON d.user_id = users.id
+	 WHERE users.username = $1;
+`
+
+// UserLaunchDefaults returns the defaults the user set for their instant launches.
+func (a *App) UserLaunchDefaults(user string) (*UserLaunchDefaults, error) {
+	defaults := &UserLaunchDefaults{}
+	err := a.DB.QueryRowx(userLaunchDefaultsQuery, user).Scan(defaults)
+	return defaults, err
+}
+
+const setUserLaunchDefaultsQuery = `
+	INSERT INTO user_instant_launch_defaults (defaults, user_id)
+	VALUES ( $1, (SELECT id FROM users WHERE username = $2) )
+	ON CONFLICT (user_id) DO UPDATE SET defaults = EXCLUDED.defaults
+	RETURNING defaults;
+`
+
+// SetUserLaunchDefaults adds or replaces the defaults for the user's instant launches.
+func (a *App) SetUserLaunchDefaults(user string, defaults *UserLaunchDefaults) (*UserLaunchDefaults, error) {
+	saved := &UserLaunchDefaults{}
+	err := a.DB.QueryRowx(setUserLaunchDefaultsQuery, defaults, user).Scan(saved)
+	return saved, err
+}
+
+const deleteUserLaunchDefaultsQuery = `
+	DELETE FROM ONLY user_instant_launch_defaults
+	USING users
+	WHERE user_instant_launch_defaults.user_id = users.id
+	  AND users.username = $1;
+`
+
+// DeleteUserLaunchDefaults removes the defaults for the user's instant launches.
+func (a *App) DeleteUserLaunchDefaults(user string) error {
+	_, err := a.DB.Exec(deleteUserLaunchDefaultsQuery, user)
+	return err
+}
+
+const userMappingJSONQuery = `
+    SELECT u.instant_launches
+      FROM user_instant_launches u
+      JOIN users ON u.user_id = users.id
+     WHERE users.username = $1
+  ORDER BY u.version DESC
+     LIMIT 1;
+`
+
+const latestDefaultsJSONQuery = `
+    SELECT def.instant_launches
+      FROM default_instant_launches def
+  ORDER BY def.version DESC
+     LIMIT 1;
+`
+
+// mappingSelector returns the selector for the pattern in the mapping
+// returned by the query, or nil if there isn't one.
+func (a *App) mappingSelector(pattern, query string, args ...interface{}) (*InstantLaunchSelector, error) {
+	var mappingJSON types.JSONText
+	if err := a.DB.QueryRowx(query, args...).Scan(&mappingJSON); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	mapping := InstantLaunchMapping{}
+	if err := json.Unmarshal(mappingJSON, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping[pattern], nil
+}
+
+// LaunchSelector returns the selector for the pattern from the user's latest
+// mapping, falling back to the latest defaults if the user's mapping doesn't
+// have one. Returns sql.ErrNoRows if neither of them has the pattern.
+func (a *App) LaunchSelector(user, pattern string) (*InstantLaunchSelector, error) {
+	selector, err := a.mappingSelector(pattern, userMappingJSONQuery, user)
+	if err != nil || selector != nil {
+		return selector, err
+	}
+
+	selector, err = a.mappingSelector(pattern, latestDefaultsJSONQuery)
+	if err != nil {
+		return nil, err
+	}
+	if selector == nil {
+		return nil, sql.ErrNoRows
+	}
+	return selector, nil
+}
@@ -54,6 +54,10 @@ func (a *App) UpdateLatestDefaultsHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
 	}
+
+	if err = newdefaults.Validate(a.BlockedEnvironment); err != nil {
+		return err
+	}
 	updated, err := a.UpdateLatestDefaults(newdefaults)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -87,6 +91,10 @@ func (a *App) AddLatestDefaultsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
 	}
 
+	if err = update.Validate(a.BlockedEnvironment); err != nil {
+		return err
+	}
+
 	newentry, err := a.AddLatestDefaults(update, addedBy)
 	if err != nil {
 		return err
@@ -124,6 +132,10 @@ func (a *App) UpdateDefaultsByVersionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
 	}
 
+	if err = newvalue.Validate(a.BlockedEnvironment); err != nil {
+		return err
+	}
+
 	version, err := strconv.ParseInt(c.Param("version"), 10, 0)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "cannot process version")
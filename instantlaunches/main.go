@@ -23,6 +23,7 @@ import (
 	"io"
 	"io/ioutil"
 
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/app-exposer/permissions"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
@@ -105,6 +106,10 @@ type InstantLaunchSelector struct {
 	Kind       string          `json:"kind"`
 	Default    InstantLaunch   `json:"default"`
 	Compatible []InstantLaunch `json:"compatible"`
+
+	// Environment is extra environment variables for analyses launched
+	// through the selector.
+	Environment map[string]string `json:"environment,omitempty"`
 }
 
 // InstantLaunchMapping maps a pattern string to an InstantLaunchSelector.
@@ -129,6 +134,35 @@ func (i InstantLaunchMapping) Value() (driver.Value, error) {
 	return json.Marshal(&i)
 }
 
+// Validate returns an error if any of the selectors set environment
+// variables that users aren't allowed to set. Names matching the blocked
+// patterns are rejected along with the ones that are always blocked.
+func (i InstantLaunchMapping) Validate(blocked []string) error {
+	for _, selector := range i {
+		if selector == nil {
+			continue
+		}
+		if err := common.ValidateEnvironment(selector.Environment, blocked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Selects returns true if the instant launch is the selector's default or one
+// of its compatible instant launches.
+func (s *InstantLaunchSelector) Selects(id string) bool {
+	if s.Default.ID == id {
+		return true
+	}
+	for _, il := range s.Compatible {
+		if il.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
 // InstantLaunchMappingFromJSON creates a new *InstantLaunchMapping from the io.ReadCloser
 // passed in. Calls ioutil.ReadAll on the ReadCloser and closes it.
 func InstantLaunchMappingFromJSON(r io.ReadCloser) (*InstantLaunchMapping, error) {
@@ -173,13 +207,18 @@ type App struct {
 	UserSuffix      string
 	MetadataBaseURL string
 	Permissions     *permissions.Permissions
+
+	// BlockedEnvironment is the extra patterns for environment variables
+	// that selectors can't set.
+	BlockedEnvironment []string
 }
 
 // Init configuration for the instant launches.
 type Init struct {
-	UserSuffix      string
-	MetadataBaseURL string
-	PermissionsURL  string
+	UserSuffix         string
+	MetadataBaseURL    string
+	PermissionsURL     string
+	BlockedEnvironment []string
 }
 
 // New returns a newly created *App.
@@ -192,6 +231,7 @@ func New(db *sqlx.DB, group *echo.Group, init *Init) *App {
 		Permissions: &permissions.Permissions{
 			BaseURL: init.PermissionsURL,
 		},
+		BlockedEnvironment: init.BlockedEnvironment,
 	}
 
 	instance.Group.GET("/quicklaunches/public", instance.ListViablePublicQuickLaunchesHandler)
@@ -211,6 +251,9 @@ func New(db *sqlx.DB, group *echo.Group, init *Init) *App {
 	instance.Group.GET("/mappings/:username/:version", instance.UserMappingsByVersionHandler)
 	instance.Group.POST("/mappings/:username/:version", instance.UpdateUserMappingsByVersionHandler)
 	instance.Group.DELETE("/mappings/:username/:version", instance.DeleteUserMappingsByVersionHandler)
+	instance.Group.GET("/user-defaults/:username", instance.UserLaunchDefaultsHandler)
+	instance.Group.PUT("/user-defaults/:username", instance.SetUserLaunchDefaultsHandler)
+	instance.Group.DELETE("/user-defaults/:username", instance.DeleteUserLaunchDefaultsHandler)
 	instance.Group.GET("/metadata", instance.ListMetadataHandler)
 	instance.Group.GET("/metadata/full", instance.FullListMetadataHandler)
 	instance.Group.PUT("/", instance.AddInstantLaunchHandler)
@@ -225,6 +268,7 @@ func New(db *sqlx.DB, group *echo.Group, init *Init) *App {
 	instance.Group.GET("/:id/metadata", instance.GetMetadataHandler)
 	instance.Group.POST("/:id/metadata", instance.AddOrUpdateMetadataHandler)
 	instance.Group.PUT("/:id/metadata", instance.SetAllMetadataHandler)
+	instance.Group.POST("/:id/submission/:username", instance.LaunchSubmissionHandler)
 
 	return instance
 }
@@ -0,0 +1,313 @@
+package instantlaunches
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo/v4"
+)
+
+// ResourceSize is the resources requested for the analysis launched by an
+// instant launch. MemoryLimit is in bytes.
+type ResourceSize struct {
+	CPUCores    float64 `json:"cpu_cores,omitempty"`
+	MemoryLimit int64   `json:"memory_limit,omitempty"`
+}
+
+// UserLaunchDefaults are the settings a user wants used for their instant
+// launches when they don't give any explicitly. They're also the shape of the
+// explicit parameters for a launch, which take precedence over the defaults.
+type UserLaunchDefaults struct {
+	// OutputFolder is the folder in the data store the outputs are written to.
+	OutputFolder string `json:"output_folder,omitempty"`
+
+	// ResourceSize is the CPU and memory requested for the analysis.
+	ResourceSize *ResourceSize `json:"resource_size,omitempty"`
+
+	// MountCollections are the data store collections mounted into the
+	// analysis along with its inputs.
+	MountCollections []string `json:"mount_collections,omitempty"`
+}
+
+// Scan implements the Scan function for database values.
+func (d *UserLaunchDefaults) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	default:
+		return fmt.Errorf("unsupported type: %T", v)
+	}
+}
+
+// Value implements the Value() function for database values.
+func (d UserLaunchDefaults) Value() (driver.Value, error) {
+	return json.Marshal(&d)
+}
+
+// Validate returns an error if the folders aren't absolute paths or the
+// resource size is negative.
+func (d *UserLaunchDefaults) Validate() error {
+	if d.OutputFolder != "" && !path.IsAbs(d.OutputFolder) {
+		return fmt.Errorf("the output folder %s is not an absolute path", d.OutputFolder)
+	}
+
+	if d.ResourceSize != nil && (d.ResourceSize.CPUCores < 0 || d.ResourceSize.MemoryLimit < 0) {
+		return fmt.Errorf("the resource size can't be negative")
+	}
+
+	for _, collection := range d.MountCollections {
+		if !path.IsAbs(collection) {
+			return fmt.Errorf("the collection %s is not an absolute path", collection)
+		}
+	}
+
+	return nil
+}
+
+// Merge returns the settings in d with any that aren't set filled in from
+// defaults.
+func (d UserLaunchDefaults) Merge(defaults *UserLaunchDefaults) *UserLaunchDefaults {
+	merged := d
+	if defaults == nil {
+		return &merged
+	}
+
+	if merged.OutputFolder == "" {
+		merged.OutputFolder = defaults.OutputFolder
+	}
+	if merged.ResourceSize == nil {
+		merged.ResourceSize = defaults.ResourceSize
+	}
+	if len(merged.MountCollections) == 0 {
+		merged.MountCollections = defaults.MountCollections
+	}
+
+	return &merged
+}
+
+// ApplyToSubmission returns a copy of the quick launch submission with the
+// settings applied to it. The resource size is requested for the first step,
+// which is the one VICE analyses run.
+func (d *UserLaunchDefaults) ApplyToSubmission(submission types.JSONText) (types.JSONText, error) {
+	sub := map[string]interface{}{}
+	if len(submission) > 0 {
+		if err := json.Unmarshal(submission, &sub); err != nil {
+			return nil, fmt.Errorf("unable to parse the submission: %s", err)
+		}
+	}
+
+	if d.OutputFolder != "" {
+		sub["output_dir"] = d.OutputFolder
+	}
+
+	if d.ResourceSize != nil {
+		requirements, _ := sub["requirements"].([]interface{})
+
+		var step map[string]interface{}
+		for _, r := range requirements {
+			if m, ok := r.(map[string]interface{}); ok && m["step_number"] == float64(0) {
+				step = m
+			}
+		}
+		if step == nil {
+			step = map[string]interface{}{"step_number": 0}
+			requirements = append(requirements, step)
+		}
+
+		if d.ResourceSize.CPUCores > 0 {
+			step["min_cpu_cores"] = d.ResourceSize.CPUCores
+		}
+		if d.ResourceSize.MemoryLimit > 0 {
+			step["min_memory_limit"] = d.ResourceSize.MemoryLimit
+		}
+		sub["requirements"] = requirements
+	}
+
+	if len(d.MountCollections) > 0 {
+		sub["mount_collections"] = d.MountCollections
+	}
+
+	return json.Marshal(sub)
+}
+
+// applyLaunchEnvironment returns a copy of the submission with the
+// environment variables added to the ones it sets with launch_environment.
+// Variables already in the submission take precedence.
+func applyLaunchEnvironment(submission types.JSONText, env map[string]string) (types.JSONText, error) {
+	if len(env) == 0 {
+		return submission, nil
+	}
+
+	sub := map[string]interface{}{}
+	if len(submission) > 0 {
+		if err := json.Unmarshal(submission, &sub); err != nil {
+			return nil, fmt.Errorf("unable to parse the submission: %s", err)
+		}
+	}
+
+	launchEnv, _ := sub["launch_environment"].(map[string]interface{})
+	if launchEnv == nil {
+		launchEnv = map[string]interface{}{}
+	}
+	for name, value := range env {
+		if _, ok := launchEnv[name]; !ok {
+			launchEnv[name] = value
+		}
+	}
+	sub["launch_environment"] = launchEnv
+
+	return json.Marshal(sub)
+}
+
+// UserLaunchDefaultsHandler is the echo handler for the http API that returns
+// the defaults for the user's instant launches.
+func (a *App) UserLaunchDefaultsHandler(c echo.Context) error {
+	user := c.Param("username")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+	}
+
+	if !strings.HasSuffix(user, a.UserSuffix) {
+		user = fmt.Sprintf("%s%s", user, a.UserSuffix)
+	}
+
+	defaults, err := a.UserLaunchDefaults(user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, defaults)
+}
+
+// SetUserLaunchDefaultsHandler is the echo handler for the http API that adds
+// or replaces the defaults for the user's instant launches.
+func (a *App) SetUserLaunchDefaultsHandler(c echo.Context) error {
+	user := c.Param("username")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+	}
+
+	if !strings.HasSuffix(user, a.UserSuffix) {
+		user = fmt.Sprintf("%s%s", user, a.UserSuffix)
+	}
+
+	defaults := &UserLaunchDefaults{}
+	if err := c.Bind(defaults); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+	}
+
+	if err := defaults.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	saved, err := a.SetUserLaunchDefaults(user, defaults)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, saved)
+}
+
+// DeleteUserLaunchDefaultsHandler is the echo handler for the http API that
+// removes the defaults for the user's instant launches.
+func (a *App) DeleteUserLaunchDefaultsHandler(c echo.Context) error {
+	user := c.Param("username")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+	}
+
+	if !strings.HasSuffix(user, a.UserSuffix) {
+		user = fmt.Sprintf("%s%s", user, a.UserSuffix)
+	}
+
+	return a.DeleteUserLaunchDefaults(user)
+}
+
+// LaunchSubmissionHandler is the echo handler for the http API that returns
+// the submission for launching the instant launch as the user. The body may
+// give explicit parameters for the launch; the ones it leaves out, or all of
+// them if there's no body, come from the user's defaults. If the pattern query
+// parameter is set, the environment of the selector for that pattern in the
+// user's mapping, or the default mapping, is added to the launch_environment
+// of the submission.
+func (a *App) LaunchSubmissionHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id is missing")
+	}
+
+	user := c.Param("username")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user was not set")
+	}
+
+	if !strings.HasSuffix(user, a.UserSuffix) {
+		user = fmt.Sprintf("%s%s", user, a.UserSuffix)
+	}
+
+	explicit := &UserLaunchDefaults{}
+	if err := c.Bind(explicit); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
+	}
+
+	if err := explicit.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	il, err := a.FullInstantLaunch(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		return err
+	}
+
+	defaults, err := a.UserLaunchDefaults(user)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return err
+		}
+		defaults = nil
+	}
+
+	submission, err := explicit.Merge(defaults).ApplyToSubmission(il.Submission)
+	if err != nil {
+		return err
+	}
+
+	if pattern := c.QueryParam("pattern"); pattern != "" {
+		selector, err := a.LaunchSelector(user, pattern)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no instant launches are mapped to %s", pattern))
+			}
+			return err
+		}
+
+		if !selector.Selects(id) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("instant launch %s isn't mapped to %s", id, pattern))
+		}
+
+		if err = common.ValidateEnvironment(selector.Environment, a.BlockedEnvironment); err != nil {
+			return err
+		}
+
+		if submission, err = applyLaunchEnvironment(submission, selector.Environment); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, submission)
+}
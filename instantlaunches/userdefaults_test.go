@@ -0,0 +1,308 @@
+package instantlaunches
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserLaunchDefaultsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&UserLaunchDefaults{}).Validate())
+	assert.NoError((&UserLaunchDefaults{
+		OutputFolder:     "/iplant/home/test/analyses",
+		ResourceSize:     &ResourceSize{CPUCores: 2, MemoryLimit: 4294967296},
+		MountCollections: []string{"/iplant/home/test/data"},
+	}).Validate())
+
+	assert.Error((&UserLaunchDefaults{OutputFolder: "analyses"}).Validate())
+	assert.Error((&UserLaunchDefaults{ResourceSize: &ResourceSize{CPUCores: -1}}).Validate())
+	assert.Error((&UserLaunchDefaults{MountCollections: []string{"data"}}).Validate())
+}
+
+func TestUserLaunchDefaultsMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	defaults := &UserLaunchDefaults{
+		OutputFolder:     "/iplant/home/test/analyses",
+		ResourceSize:     &ResourceSize{CPUCores: 2},
+		MountCollections: []string{"/iplant/home/test/data"},
+	}
+
+	explicit := UserLaunchDefaults{OutputFolder: "/iplant/home/test/other"}
+	assert.Equal(&UserLaunchDefaults{
+		OutputFolder:     "/iplant/home/test/other",
+		ResourceSize:     &ResourceSize{CPUCores: 2},
+		MountCollections: []string{"/iplant/home/test/data"},
+	}, explicit.Merge(defaults))
+
+	assert.Equal(&explicit, explicit.Merge(nil))
+}
+
+func TestUserLaunchDefaultsApplyToSubmission(t *testing.T) {
+	assert := assert.New(t)
+
+	submission := types.JSONText(`{
+		"app_id": "a1",
+		"output_dir": "/iplant/home/creator/analyses",
+		"requirements": [{"step_number": 0, "min_cpu_cores": 1, "max_cpu_cores": 4}]
+	}`)
+
+	defaults := &UserLaunchDefaults{
+		OutputFolder:     "/iplant/home/test/analyses",
+		ResourceSize:     &ResourceSize{CPUCores: 2, MemoryLimit: 4294967296},
+		MountCollections: []string{"/iplant/home/test/data"},
+	}
+
+	applied, err := defaults.ApplyToSubmission(submission)
+	assert.NoError(err)
+	assert.JSONEq(`{
+		"app_id": "a1",
+		"output_dir": "/iplant/home/test/analyses",
+		"requirements": [{"step_number": 0, "min_cpu_cores": 2, "max_cpu_cores": 4, "min_memory_limit": 4294967296}],
+		"mount_collections": ["/iplant/home/test/data"]
+	}`, string(applied))
+
+	// Submissions without requirements get them for the first step.
+	applied, err = (&UserLaunchDefaults{ResourceSize: &ResourceSize{CPUCores: 2}}).ApplyToSubmission(types.JSONText(`{"app_id": "a1"}`))
+	assert.NoError(err)
+	assert.JSONEq(`{"app_id": "a1", "requirements": [{"step_number": 0, "min_cpu_cores": 2}]}`, string(applied))
+
+	// Nothing changes without any settings.
+	applied, err = (&UserLaunchDefaults{}).ApplyToSubmission(submission)
+	assert.NoError(err)
+	assert.JSONEq(string(submission), string(applied))
+}
+
+func TestUserLaunchDefaultsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	app, mock, router, err := SetupApp()
+	if err != nil {
+		t.Fatalf("error setting up app: %s", err)
+	}
+	defer app.DB.Close()
+
+	mock.ExpectQuery("SELECT d.defaults FROM user_instant_launch_defaults d").
+		WithArgs("test" + app.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"defaults"}).AddRow(`{"output_folder": "/iplant/home/test/analyses"}`))
+
+	req := httptest.NewRequest("GET", "http://localhost/instantlaunches/user-defaults/test", nil)
+	rec := httptest.NewRecorder()
+	c := router.NewContext(req, rec)
+	c.SetPath("/instantlaunches/user-defaults/:username")
+	c.SetParamNames("username")
+	c.SetParamValues("test")
+
+	err = app.UserLaunchDefaultsHandler(c)
+	if assert.NoError(err) {
+		assert.Equal(http.StatusOK, rec.Code)
+
+		actual := &UserLaunchDefaults{}
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), actual))
+		assert.Equal(&UserLaunchDefaults{OutputFolder: "/iplant/home/test/analyses"}, actual)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestSetUserLaunchDefaultsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	app, mock, router, err := SetupApp()
+	if err != nil {
+		t.Fatalf("error setting up app: %s", err)
+	}
+	defer app.DB.Close()
+
+	defaults := UserLaunchDefaults{
+		OutputFolder: "/iplant/home/test/analyses",
+		ResourceSize: &ResourceSize{CPUCores: 2},
+	}
+	body, err := json.Marshal(defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("INSERT INTO user_instant_launch_defaults").
+		WithArgs(defaults, "test"+app.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"defaults"}).AddRow(string(body)))
+
+	req := httptest.NewRequest("PUT", "http://localhost/instantlaunches/user-defaults/test", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	c := router.NewContext(req, rec)
+	c.SetPath("/instantlaunches/user-defaults/:username")
+	c.SetParamNames("username")
+	c.SetParamValues("test")
+
+	err = app.SetUserLaunchDefaultsHandler(c)
+	if assert.NoError(err) {
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.JSONEq(string(body), rec.Body.String())
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// Invalid defaults aren't saved.
+	req = httptest.NewRequest("PUT", "http://localhost/instantlaunches/user-defaults/test", bytes.NewReader([]byte(`{"output_folder": "relative"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	c = router.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("username")
+	c.SetParamValues("test")
+
+	assert.Error(app.SetUserLaunchDefaultsHandler(c))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func expectFullInstantLaunch(mock sqlmock.Sqlmock, id, submission string) {
+	mock.ExpectQuery("SELECT il.id, ilu.username AS added_by").
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "added_by", "added_on", "quick_launch_id", "ql_name", "ql_description", "ql_creator",
+			"submission", "app_id", "is_public", "app_name", "app_description", "app_deleted",
+			"app_disabled", "integrator",
+		}).AddRow(
+			id, "admin", "2020-01-01", "ql1", "ql", "", "creator",
+			submission, "a1", true, "app", "", false,
+			false, "integrator",
+		))
+}
+
+func TestLaunchSubmissionHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	app, mock, router, err := SetupApp()
+	if err != nil {
+		t.Fatalf("error setting up app: %s", err)
+	}
+	defer app.DB.Close()
+
+	submission := `{"app_id": "a1", "output_dir": "/iplant/home/creator/analyses"}`
+
+	// Without explicit parameters, the user's defaults are used.
+	expectFullInstantLaunch(mock, "il1", submission)
+	mock.ExpectQuery("SELECT d.defaults FROM user_instant_launch_defaults d").
+		WithArgs("test" + app.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"defaults"}).AddRow(`{"output_folder": "/iplant/home/test/analyses", "mount_collections": ["/iplant/home/test/data"]}`))
+
+	req := httptest.NewRequest("POST", "http://localhost/instantlaunches/il1/submission/test", nil)
+	rec := httptest.NewRecorder()
+	c := router.NewContext(req, rec)
+	c.SetPath("/instantlaunches/:id/submission/:username")
+	c.SetParamNames("id", "username")
+	c.SetParamValues("il1", "test")
+
+	err = app.LaunchSubmissionHandler(c)
+	if assert.NoError(err) {
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.JSONEq(`{
+			"app_id": "a1",
+			"output_dir": "/iplant/home/test/analyses",
+			"mount_collections": ["/iplant/home/test/data"]
+		}`, rec.Body.String())
+	}
+
+	// Explicit parameters take precedence, and users without defaults get
+	// the submission as it was otherwise.
+	expectFullInstantLaunch(mock, "il1", submission)
+	mock.ExpectQuery("SELECT d.defaults FROM user_instant_launch_defaults d").
+		WithArgs("test" + app.UserSuffix).
+		WillReturnError(sql.ErrNoRows)
+
+	req = httptest.NewRequest("POST", "http://localhost/instantlaunches/il1/submission/test", bytes.NewReader([]byte(`{"resource_size": {"cpu_cores": 4}}`)))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	c = router.NewContext(req, rec)
+	c.SetParamNames("id", "username")
+	c.SetParamValues("il1", "test")
+
+	err = app.LaunchSubmissionHandler(c)
+	if assert.NoError(err) {
+		assert.JSONEq(`{
+			"app_id": "a1",
+			"output_dir": "/iplant/home/creator/analyses",
+			"requirements": [{"step_number": 0, "min_cpu_cores": 4}]
+		}`, rec.Body.String())
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchSubmissionHandlerPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	app, mock, router, err := SetupApp()
+	if err != nil {
+		t.Fatalf("error setting up app: %s", err)
+	}
+	defer app.DB.Close()
+	app.BlockedEnvironment = []string{"AWS_*"}
+
+	submission := `{"app_id": "a1", "launch_environment": {"MODE": "batch"}}`
+	launch := func(pattern string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest("POST", "http://localhost/instantlaunches/il1/submission/test?pattern="+pattern, nil)
+		rec := httptest.NewRecorder()
+		c := router.NewContext(req, rec)
+		c.SetParamNames("id", "username")
+		c.SetParamValues("il1", "test")
+		return rec, app.LaunchSubmissionHandler(c)
+	}
+	expectLaunch := func() {
+		expectFullInstantLaunch(mock, "il1", submission)
+		mock.ExpectQuery("SELECT d.defaults FROM user_instant_launch_defaults d").
+			WithArgs("test" + app.UserSuffix).
+			WillReturnError(sql.ErrNoRows)
+	}
+
+	// The user's mapping doesn't have the pattern, so the selector comes
+	// from the defaults. The submission's own variables take precedence.
+	expectLaunch()
+	mock.ExpectQuery("SELECT u.instant_launches FROM user_instant_launches u").
+		WithArgs("test" + app.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"instant_launches"}).AddRow(`{}`))
+	mock.ExpectQuery("SELECT def.instant_launches FROM default_instant_launches def").
+		WillReturnRows(sqlmock.NewRows([]string{"instant_launches"}).AddRow(`{
+			"*.csv": {"pattern": "*.csv", "default": {"id": "il1"}, "environment": {"MODE": "interactive", "DATA_FORMAT": "csv"}}
+		}`))
+
+	rec, err := launch("*.csv")
+	if assert.NoError(err) {
+		assert.JSONEq(`{
+			"app_id": "a1",
+			"launch_environment": {"MODE": "batch", "DATA_FORMAT": "csv"}
+		}`, rec.Body.String())
+	}
+
+	// Selectors can't set blocked variables, even ones saved before they
+	// were blocked.
+	expectLaunch()
+	mock.ExpectQuery("SELECT u.instant_launches FROM user_instant_launches u").
+		WithArgs("test" + app.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"instant_launches"}).AddRow(`{
+			"*.csv": {"pattern": "*.csv", "default": {"id": "il1"}, "environment": {"AWS_SECRET_ACCESS_KEY": "x"}}
+		}`))
+
+	_, err = launch("*.csv")
+	assert.Error(err)
+
+	// The instant launch has to be one the selector offers.
+	expectLaunch()
+	mock.ExpectQuery("SELECT u.instant_launches FROM user_instant_launches u").
+		WithArgs("test" + app.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"instant_launches"}).AddRow(`{
+			"*.csv": {"pattern": "*.csv", "default": {"id": "il2"}, "environment": {"DATA_FORMAT": "csv"}}
+		}`))
+
+	_, err = launch("*.csv")
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -49,6 +49,10 @@ func (a *App) UpdateUserMappingHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
 	}
 
+	if err = newdefaults.Validate(a.BlockedEnvironment); err != nil {
+		return err
+	}
+
 	updated, err := a.UpdateUserMapping(user, newdefaults)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -89,6 +93,10 @@ func (a *App) AddUserMappingHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
 	}
 
+	if err = newvalue.Validate(a.BlockedEnvironment); err != nil {
+		return err
+	}
+
 	retval, err := a.AddUserMapping(user, newvalue)
 	if err != nil {
 		return err
@@ -172,6 +180,10 @@ func (a *App) UpdateUserMappingsByVersionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "cannot parse JSON")
 	}
 
+	if err = update.Validate(a.BlockedEnvironment); err != nil {
+		return err
+	}
+
 	newversion, err := a.UpdateUserMappingsByVersion(user, int(version), update)
 	if err != nil {
 		if err == sql.ErrNoRows {
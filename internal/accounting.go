@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// defaultAccountingPeriod is how far back usage is aggregated if the request
+// doesn't give a start time.
+const defaultAccountingPeriod = 30 * 24 * time.Hour
+
+// UsageRecord is the accounting record of a single replica of an analysis:
+// who ran which app, what it asked for, where it ran, and for how long. Most
+// analyses have a single replica, numbered 0, but array jobs have one for
+// each of their Jobs. StoppedAt is nil while the analysis is still running.
+type UsageRecord struct {
+	ExternalID  string     `json:"externalID" db:"external_id"`
+	Replica     int        `json:"replica" db:"replica"`
+	Username    string     `json:"username" db:"username"`
+	AppID       string     `json:"appID" db:"app_id"`
+	AppName     string     `json:"appName" db:"app_name"`
+	CPUCores    float64    `json:"cpuCores" db:"cpu_cores"`
+	MemoryBytes int64      `json:"memoryBytes" db:"memory_bytes"`
+	GPUs        int64      `json:"gpus" db:"gpus"`
+	GPUResource string     `json:"gpuResource,omitempty" db:"gpu_resource"`
+	NodeName    string     `json:"nodeName,omitempty" db:"node_name"`
+	StartedAt   time.Time  `json:"startedAt" db:"started_at"`
+	StoppedAt   *time.Time `json:"stoppedAt,omitempty" db:"stopped_at"`
+}
+
+// newUsageRecord returns the usage record for the replica of the job as it's
+// launched.
+func newUsageRecord(job *model.Job, replica int) *UsageRecord {
+	gpuResource, gpus := gpuRequest(job)
+
+	return &UsageRecord{
+		ExternalID:  job.InvocationID,
+		Replica:     replica,
+		Username:    job.Submitter,
+		AppID:       job.AppID,
+		AppName:     job.AppName,
+		CPUCores:    float64(cpuResourceRequest(job)),
+		MemoryBytes: memResourceRequest(job),
+		GPUs:        gpus,
+		GPUResource: string(gpuResource),
+	}
+}
+
+// A replica that already has a record that hasn't been stopped keeps it, so
+// retried launches don't start a second one.
+const startUsageRecordSQL = `
+	INSERT INTO vice_usage_records
+		(external_id, replica, username, app_id, app_name, cpu_cores, memory_bytes, gpus, gpu_resource, node_name, started_at)
+	SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, '', now()
+	 WHERE NOT EXISTS (
+	       SELECT 1
+	         FROM vice_usage_records
+	        WHERE external_id = $1
+	          AND replica = $2
+	          AND stopped_at IS NULL
+	       )
+`
+
+// The records of all of the replicas of the analysis are stopped together.
+const stopUsageRecordSQL = `
+	UPDATE vice_usage_records
+	   SET stopped_at = now(),
+	       node_name = CASE WHEN node_name = '' THEN $2 ELSE node_name END
+	 WHERE external_id = $1
+	   AND stopped_at IS NULL
+`
+
+// A resumed analysis gets a new record for each replica with the same requests
+// as the replica's most recent record, unless it already has open records.
+const resumeUsageRecordSQL = `
+	INSERT INTO vice_usage_records
+		(external_id, replica, username, app_id, app_name, cpu_cores, memory_bytes, gpus, gpu_resource, node_name, started_at)
+	SELECT DISTINCT ON (replica)
+	       external_id, replica, username, app_id, app_name, cpu_cores, memory_bytes, gpus, gpu_resource, '', now()
+	  FROM vice_usage_records
+	 WHERE external_id = $1
+	   AND NOT EXISTS (
+	       SELECT 1
+	         FROM vice_usage_records
+	        WHERE external_id = $1
+	          AND stopped_at IS NULL
+	       )
+	 ORDER BY replica, started_at DESC
+`
+
+// recordUsageStart records that each of the replicas of the analysis was
+// launched with the resources requested by the job. Failures are logged,
+// since accounting shouldn't stop launches.
+func (i *Internal) recordUsageStart(job *model.Job, replicas int) {
+	for replica := 0; replica < replicas; replica++ {
+		record := newUsageRecord(job, replica)
+
+		_, err := i.db.Exec(
+			startUsageRecordSQL,
+			record.ExternalID,
+			record.Replica,
+			record.Username,
+			record.AppID,
+			record.AppName,
+			record.CPUCores,
+			record.MemoryBytes,
+			record.GPUs,
+			record.GPUResource,
+		)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error recording the start of replica %d of analysis %s for accounting", replica, job.InvocationID))
+		}
+	}
+}
+
+// analysisNodes returns the names of the nodes the pods of the analysis are
+// scheduled on, separated by commas.
+func (i *Internal) analysisNodes(externalID string) (string, error) {
+	podlist, err := i.podList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return "", err
+	}
+
+	seen := map[string]bool{}
+	nodes := []string{}
+	for _, pod := range podlist.Items {
+		if pod.Spec.NodeName != "" && !seen[pod.Spec.NodeName] {
+			seen[pod.Spec.NodeName] = true
+			nodes = append(nodes, pod.Spec.NodeName)
+		}
+	}
+	sort.Strings(nodes)
+
+	return strings.Join(nodes, ","), nil
+}
+
+// recordUsageStop records that the analysis stopped, along with the nodes it
+// was running on. It has to be called before the pods of the analysis go away.
+// Failures are logged, since accounting shouldn't stop teardowns.
+func (i *Internal) recordUsageStop(externalID string) {
+	nodes, err := i.analysisNodes(externalID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up the nodes of analysis %s for accounting", externalID))
+	}
+
+	if _, err = i.db.Exec(stopUsageRecordSQL, externalID, nodes); err != nil {
+		log.Error(errors.Wrapf(err, "error recording the end of analysis %s for accounting", externalID))
+	}
+}
+
+// recordUsageResume records that a paused analysis is running again. Paused
+// analyses have their usage stopped, so the time they spend paused isn't
+// counted towards accounting or GPU budgets. Failures are logged, since
+// accounting shouldn't stop resumes.
+func (i *Internal) recordUsageResume(externalID string) {
+	if _, err := i.db.Exec(resumeUsageRecordSQL, externalID); err != nil {
+		log.Error(errors.Wrapf(err, "error recording that analysis %s was resumed for accounting", externalID))
+	}
+}
+
+// UserUsage is the usage of a single user over a time range.
+type UserUsage struct {
+	Username string  `json:"username" db:"username"`
+	Analyses int     `json:"analyses" db:"analyses"`
+	CPUHours float64 `json:"cpuHours" db:"cpu_hours"`
+	GPUHours float64 `json:"gpuHours" db:"gpu_hours"`
+}
+
+// AppResourceUsage is the usage of a single app over a time range.
+type AppResourceUsage struct {
+	AppID    string  `json:"appID" db:"app_id"`
+	AppName  string  `json:"appName" db:"app_name"`
+	Analyses int     `json:"analyses" db:"analyses"`
+	CPUHours float64 `json:"cpuHours" db:"cpu_hours"`
+	GPUHours float64 `json:"gpuHours" db:"gpu_hours"`
+}
+
+// UsageAccounting is the aggregated usage over a time range.
+type UsageAccounting struct {
+	Start time.Time          `json:"start"`
+	End   time.Time          `json:"end"`
+	Users []UserUsage        `json:"users"`
+	Apps  []AppResourceUsage `json:"apps"`
+}
+
+// Only the part of each analysis's runtime that falls within the range counts
+// towards it. Analyses that are still running count up to now.
+const usageInRange = `
+	  FROM (
+	       SELECT r.*,
+	              GREATEST(EXTRACT(EPOCH FROM LEAST(COALESCE(r.stopped_at, now()), $2) - GREATEST(r.started_at, $1)), 0) AS seconds
+	         FROM vice_usage_records r
+	        WHERE r.started_at < $2
+	          AND (r.stopped_at IS NULL OR r.stopped_at > $1)
+	       ) u
+`
+
+const usageTotals = `
+	       count(DISTINCT u.external_id) AS analyses,
+	       COALESCE(sum(u.cpu_cores * u.seconds), 0) / 3600 AS cpu_hours,
+	       COALESCE(sum(u.gpus * u.seconds), 0) / 3600 AS gpu_hours
+`
+
+const usageByUserSQL = `
+	SELECT u.username,
+` + usageTotals + usageInRange + `
+	 GROUP BY u.username
+	 ORDER BY cpu_hours DESC, u.username
+`
+
+const usageByAppSQL = `
+	SELECT u.app_id,
+	       max(u.app_name) AS app_name,
+` + usageTotals + usageInRange + `
+	 GROUP BY u.app_id
+	 ORDER BY cpu_hours DESC, u.app_id
+`
+
+// usageAccounting aggregates the usage recorded between start and end by
+// user and by app.
+func (i *Internal) usageAccounting(start, end time.Time) (*UsageAccounting, error) {
+	accounting := &UsageAccounting{
+		Start: start,
+		End:   end,
+		Users: []UserUsage{},
+		Apps:  []AppResourceUsage{},
+	}
+
+	if err := i.db.Select(&accounting.Users, usageByUserSQL, start, end); err != nil {
+		return nil, errors.Wrap(err, "error adding up usage by user")
+	}
+
+	if err := i.db.Select(&accounting.Apps, usageByAppSQL, start, end); err != nil {
+		return nil, errors.Wrap(err, "error adding up usage by app")
+	}
+
+	return accounting, nil
+}
+
+// accountingTime parses an RFC 3339 timestamp from the query parameter, or
+// returns the default if the parameter isn't set.
+func accountingTime(c echo.Context, name string, defaultValue time.Time) (time.Time, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp, not %s", name, value))
+	}
+	return t, nil
+}
+
+// AdminUsageAccountingHandler returns the CPU-hours and GPU-hours used by each
+// user and each app between the start and end query parameters, which are
+// RFC 3339 timestamps. The end defaults to now and the start to 30 days
+// before the end.
+func (i *Internal) AdminUsageAccountingHandler(c echo.Context) error {
+	end, err := accountingTime(c, "end", time.Now())
+	if err != nil {
+		return err
+	}
+
+	start, err := accountingTime(c, "start", end.Add(-defaultAccountingPeriod))
+	if err != nil {
+		return err
+	}
+
+	if !start.Before(end) {
+		return echo.NewHTTPError(http.StatusBadRequest, "start must be before end")
+	}
+
+	accounting, err := i.usageAccounting(start.UTC(), end.UTC())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, accounting)
+}
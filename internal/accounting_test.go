@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestNewUsageRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	job := deviceJob("/dev/nvidia0", "/dev/nvidia1", "/dev/nvidiactl")
+	job.InvocationID = "e1"
+	job.Submitter = "alice"
+	job.AppID = "a1"
+	job.AppName = "JupyterLab"
+	job.Steps[0].Component.Container.MinCPUCores = 2
+
+	record := newUsageRecord(job, 2)
+	assert.Equal("e1", record.ExternalID)
+	assert.Equal(2, record.Replica)
+	assert.Equal("alice", record.Username)
+	assert.Equal("a1", record.AppID)
+	assert.Equal("JupyterLab", record.AppName)
+	assert.Equal(2.0, record.CPUCores)
+	assert.Equal(int64(2*gibibyte), record.MemoryBytes)
+	assert.Equal(int64(2), record.GPUs)
+	assert.Equal(string(nvidiaGPUResource), record.GPUResource)
+}
+
+func TestRecordUsageStart(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	job := batchJob()
+	job.InvocationID = "e1"
+
+	// Each replica of an array job gets a record of its own.
+	for replica := 0; replica < 3; replica++ {
+		mock.ExpectExec("INSERT INTO vice_usage_records").
+			WithArgs("e1", replica, "alice", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	i.recordUsageStart(job, 3)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRecordUsageStop(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := func(name, node string) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"app-type": "interactive", "external-id": "e1"},
+			},
+			Spec: apiv1.PodSpec{NodeName: node},
+		}
+	}
+
+	i, mock := setupInternal(t, []runtime.Object{
+		pod("p2", "node-b"),
+		pod("p1", "node-a"),
+		pod("p3", "node-a"),
+	})
+
+	mock.ExpectExec("UPDATE vice_usage_records").
+		WithArgs("e1", "node-a,node-b").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	i.recordUsageStop("e1")
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminUsageAccountingHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("GROUP BY u.username").
+		WithArgs(start, end).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "analyses", "cpu_hours", "gpu_hours"}).
+			AddRow("alice", 3, 12.5, 2.0))
+	mock.ExpectQuery("GROUP BY u.app_id").
+		WithArgs(start, end).
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "app_name", "analyses", "cpu_hours", "gpu_hours"}).
+			AddRow("a1", "JupyterLab", 3, 12.5, 2.0))
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/vice/admin/accounting?start=2020-03-01T00:00:00Z&end=2020-04-01T00:00:00Z", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(i.AdminUsageAccountingHandler(e.NewContext(req, rec)))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	var accounting UsageAccounting
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &accounting))
+	assert.Equal([]UserUsage{{"alice", 3, 12.5, 2.0}}, accounting.Users)
+	assert.Equal([]AppResourceUsage{{"a1", "JupyterLab", 3, 12.5, 2.0}}, accounting.Apps)
+}
+
+func TestAdminUsageAccountingHandlerBadRange(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{})
+	e := echo.New()
+
+	for _, query := range []string{
+		"start=yesterday",
+		"start=2020-04-01T00:00:00Z&end=2020-03-01T00:00:00Z",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/vice/admin/accounting?"+query, nil)
+		err := i.AdminUsageAccountingHandler(e.NewContext(req, httptest.NewRecorder()))
+		if assert.Error(err, query) {
+			assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code, query)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package internal
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 
-	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
 )
 
 // AsyncDataHandler returns data that is generately asynchronously from the job launch.
@@ -15,9 +17,9 @@ func (i *Internal) AsyncDataHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "external-id not set")
 	}
 
-	apps := apps.NewApps(i.db, i.UserSuffix)
+	apps := i.newApps()
 
-	analysisID, err := apps.GetAnalysisIDByExternalID(externalID)
+	analysisID, err := apps.GetAnalysisIDByExternalID(c.Request().Context(), externalID)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -37,10 +39,10 @@ func (i *Internal) AsyncDataHandler(c echo.Context) error {
 	}
 
 	labels := deployments.Items[0].GetLabels()
-	userID := labels["user-id"]
+	userID := i.labelKeys.get(labels, "user-id")
 
-	subdomain := IngressName(userID, externalID)
-	ipAddr, err := apps.GetUserIP(userID)
+	subdomain := i.subdomain(userID, externalID)
+	ipAddr, err := apps.GetUserIP(c.Request().Context(), userID)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -56,25 +58,34 @@ func (i *Internal) AsyncDataHandler(c echo.Context) error {
 // getExternalID returns the externalID associated with the analysisID. For now,
 // only returns the first result, since VICE analyses only have a single step in
 // the database.
-func (i *Internal) getExternalIDByAnalysisID(analysisID string) (string, error) {
-	apps := apps.NewApps(i.db, i.UserSuffix)
-	username, _, err := apps.GetUserByAnalysisID(analysisID)
+func (i *Internal) getExternalIDByAnalysisID(ctx context.Context, analysisID string) (string, error) {
+	apps := i.newApps()
+	username, _, err := apps.GetUserByAnalysisID(ctx, analysisID)
 	if err != nil {
-		return "", err
+		return "", analysisLookupError(err, analysisID)
 	}
 
 	log.Infof("username %s", username)
 
 	externalIDs, err := i.getExternalIDs(username, analysisID)
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "error looking up the external IDs of analysis %s", analysisID)
 	}
 
 	if len(externalIDs) == 0 {
-		return "", fmt.Errorf("no external-id found for analysis-id %s", analysisID)
+		return "", echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
 	}
 
 	// For now, just use the first external ID
 	externalID := externalIDs[0]
 	return externalID, nil
 }
+
+// analysisLookupError returns a 404 for an analysis that doesn't exist. Other
+// errors from looking it up are wrapped, so they're reported as 500s.
+func analysisLookupError(err error, analysisID string) error {
+	if errors.Cause(err) == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s not found", analysisID))
+	}
+	return errors.Wrapf(err, "error looking up analysis %s", analysisID)
+}
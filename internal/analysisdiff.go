@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// LaunchProvenance describes how an analysis was launched. The image and
+// resources are only known while the analysis is still in the cluster.
+type LaunchProvenance struct {
+	AnalysisID   string `json:"analysisID"`
+	AppID        string `json:"appID"`
+	AppName      string `json:"appName"`
+	AppVersionID string `json:"appVersionID,omitempty"`
+
+	// Image is the image of the analysis container and ImageDigest is the
+	// digest the cluster resolved it to.
+	Image       string `json:"image,omitempty"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+
+	// Resources contains the requests and limits of the analysis container,
+	// keyed by "requests.<resource>" and "limits.<resource>".
+	Resources map[string]string `json:"resources,omitempty"`
+
+	// Requirements contains the resource requirements from the submission.
+	Requirements interface{} `json:"requirements,omitempty"`
+
+	// Config contains the input and parameter values from the submission,
+	// keyed by parameter ID.
+	Config map[string]interface{} `json:"config,omitempty"`
+}
+
+// ProvenanceDifference is a field that has different values in the
+// provenances of two analyses. A nil value means the field isn't set for that
+// analysis.
+type ProvenanceDifference struct {
+	Field string      `json:"field"`
+	A     interface{} `json:"a"`
+	B     interface{} `json:"b"`
+}
+
+// AnalysisDiff is the comparison of the provenances of two analyses.
+type AnalysisDiff struct {
+	A           *LaunchProvenance      `json:"a"`
+	B           *LaunchProvenance      `json:"b"`
+	Differences []ProvenanceDifference `json:"differences"`
+}
+
+// launchSubmission contains the fields of a job submission that are compared.
+type launchSubmission struct {
+	AppVersionID string                 `json:"app_version_id"`
+	Requirements interface{}            `json:"requirements"`
+	Config       map[string]interface{} `json:"config"`
+}
+
+// addClusterProvenance fills in the image and resources of the analysis from
+// its Deployment and pods, if it's still in the cluster.
+func (i *Internal) addClusterProvenance(provenance *LaunchProvenance, externalID string) error {
+	filter := map[string]string{"external-id": externalID}
+
+	deplist, err := i.deploymentList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return err
+	}
+
+	for _, dep := range deplist.Items {
+		for _, container := range dep.Spec.Template.Spec.Containers {
+			if container.Name != analysisContainerName {
+				continue
+			}
+
+			provenance.Image = container.Image
+			provenance.Resources = map[string]string{}
+			for name, quantity := range container.Resources.Requests {
+				provenance.Resources["requests."+string(name)] = quantity.String()
+			}
+			for name, quantity := range container.Resources.Limits {
+				provenance.Resources["limits."+string(name)] = quantity.String()
+			}
+		}
+	}
+
+	podlist, err := i.podList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range podlist.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != analysisContainerName || status.ImageID == "" {
+				continue
+			}
+
+			// The image ID looks like docker-pullable://<repository>@<digest>.
+			provenance.ImageDigest = status.ImageID
+			if idx := strings.LastIndex(status.ImageID, "@"); idx >= 0 {
+				provenance.ImageDigest = status.ImageID[idx+1:]
+			}
+		}
+	}
+
+	return nil
+}
+
+// launchProvenance returns the provenance of the analysis after making sure
+// it's owned by the user.
+func (i *Internal) launchProvenance(ctx context.Context, user, analysisID string) (*LaunchProvenance, error) {
+	a := i.newApps()
+
+	owner, _, err := a.GetUserByAnalysisID(ctx, analysisID)
+	if err == sql.ErrNoRows {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s not found", analysisID))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the owner of analysis %s", analysisID)
+	}
+
+	if i.fixUsername(owner) != i.fixUsername(user) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s does not own analysis %s", user, analysisID))
+	}
+
+	analysis, err := a.GetAnalysisProvenance(ctx, analysisID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the provenance of analysis %s", analysisID)
+	}
+
+	rawSubmission, err := a.GetAnalysisSubmission(ctx, analysisID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the submission of analysis %s", analysisID)
+	}
+
+	submission := &launchSubmission{}
+	if err = json.Unmarshal(rawSubmission, submission); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the submission of analysis %s", analysisID)
+	}
+
+	provenance := &LaunchProvenance{
+		AnalysisID:   analysisID,
+		AppID:        analysis.AppID,
+		AppName:      analysis.AppName,
+		AppVersionID: submission.AppVersionID,
+		Requirements: submission.Requirements,
+		Config:       submission.Config,
+	}
+
+	// Analyses that never made it into the cluster don't have an external ID,
+	// so there's nothing more to add.
+	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
+	if httpErr, ok := err.(*echo.HTTPError); ok && httpErr.Code == http.StatusNotFound {
+		log.Debugf("analysis %s has no external ID, so its cluster provenance is left out", analysisID)
+		return provenance, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = i.addClusterProvenance(provenance, externalID); err != nil {
+		return nil, err
+	}
+
+	return provenance, nil
+}
+
+// flattenProvenance adds the leaf values of the decoded JSON value to fields,
+// keyed by their dotted paths. Array elements are keyed by their indexes.
+func flattenProvenance(prefix string, value interface{}, fields map[string]interface{}) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenProvenance(join(key), child, fields)
+		}
+	case []interface{}:
+		for idx, child := range v {
+			flattenProvenance(fmt.Sprintf("%s[%d]", prefix, idx), child, fields)
+		}
+	default:
+		fields[prefix] = v
+	}
+}
+
+// diffProvenances returns the fields that differ between the two provenances,
+// sorted by field. The analysis IDs always differ, so they're left out.
+func diffProvenances(a, b *LaunchProvenance) ([]ProvenanceDifference, error) {
+	flatten := func(provenance *LaunchProvenance) (map[string]interface{}, error) {
+		encoded, err := json.Marshal(provenance)
+		if err != nil {
+			return nil, err
+		}
+
+		var decoded interface{}
+		if err = json.Unmarshal(encoded, &decoded); err != nil {
+			return nil, err
+		}
+
+		fields := map[string]interface{}{}
+		flattenProvenance("", decoded, fields)
+		delete(fields, "analysisID")
+		return fields, nil
+	}
+
+	aFields, err := flatten(a)
+	if err != nil {
+		return nil, err
+	}
+
+	bFields, err := flatten(b)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for field := range aFields {
+		names[field] = true
+	}
+	for field := range bFields {
+		names[field] = true
+	}
+
+	differences := []ProvenanceDifference{}
+	for field := range names {
+		aValue, aOK := aFields[field]
+		bValue, bOK := bFields[field]
+		if aOK != bOK || aValue != bValue {
+			differences = append(differences, ProvenanceDifference{Field: field, A: aValue, B: bValue})
+		}
+	}
+
+	sort.Slice(differences, func(x, y int) bool {
+		return differences[x].Field < differences[y].Field
+	})
+
+	return differences, nil
+}
+
+// AnalysisDiffHandler compares the provenances of the two analyses in the 'a'
+// and 'b' query parameters, both of which must be owned by the user in the
+// 'user' query parameter. The response contains both provenances along with
+// the fields that differ between them.
+func (i *Internal) AnalysisDiffHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	aID := c.QueryParam("a")
+	bID := c.QueryParam("b")
+	if aID == "" || bID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "both a and b must be set")
+	}
+
+	a, err := i.launchProvenance(c.Request().Context(), user, aID)
+	if err != nil {
+		return err
+	}
+
+	b, err := i.launchProvenance(c.Request().Context(), user, bID)
+	if err != nil {
+		return err
+	}
+
+	differences, err := diffProvenances(a, b)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &AnalysisDiff{A: a, B: b, Differences: differences})
+}
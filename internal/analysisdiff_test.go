@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDiffProvenances(t *testing.T) {
+	assert := assert.New(t)
+
+	a := &LaunchProvenance{
+		AnalysisID:  "a1",
+		AppID:       "app1",
+		AppName:     "Jupyter Lab",
+		Image:       "harbor.cyverse.org/de/jupyter:latest",
+		ImageDigest: "sha256:aaaa",
+		Resources:   map[string]string{"requests.cpu": "1", "limits.memory": "4Gi"},
+		Config: map[string]interface{}{
+			"step_input": []interface{}{"/iplant/home/alice/data.csv"},
+			"step_flag":  true,
+		},
+	}
+	b := &LaunchProvenance{
+		AnalysisID:  "a2",
+		AppID:       "app1",
+		AppName:     "Jupyter Lab",
+		Image:       "harbor.cyverse.org/de/jupyter:latest",
+		ImageDigest: "sha256:bbbb",
+		Resources:   map[string]string{"requests.cpu": "1", "limits.memory": "8Gi"},
+		Config: map[string]interface{}{
+			"step_input": []interface{}{"/iplant/home/alice/data.csv"},
+		},
+	}
+
+	differences, err := diffProvenances(a, b)
+	assert.NoError(err)
+	assert.Equal([]ProvenanceDifference{
+		{Field: "config.step_flag", A: true, B: nil},
+		{Field: "imageDigest", A: "sha256:aaaa", B: "sha256:bbbb"},
+		{Field: "resources.limits.memory", A: "4Gi", B: "8Gi"},
+	}, differences)
+
+	differences, err = diffProvenances(a, a)
+	assert.NoError(err)
+	assert.Empty(differences)
+}
+
+func TestAddClusterProvenance(t *testing.T) {
+	assert := assert.New(t)
+
+	dep := appDeployment("e1", "app1")
+	dep.Spec.Template.Spec.Containers = []apiv1.Container{
+		{
+			Name:  analysisContainerName,
+			Image: "harbor.cyverse.org/de/jupyter:latest",
+			Resources: apiv1.ResourceRequirements{
+				Requests: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("500m")},
+				Limits:   apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("4Gi")},
+			},
+		},
+	}
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "p1",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "external-id": "e1"},
+		},
+		Status: apiv1.PodStatus{
+			ContainerStatuses: []apiv1.ContainerStatus{
+				{Name: analysisContainerName, ImageID: "docker-pullable://harbor.cyverse.org/de/jupyter@sha256:aaaa"},
+			},
+		},
+	}
+	i, _ := setupInternal(t, []runtime.Object{dep, pod})
+
+	provenance := &LaunchProvenance{AnalysisID: "a1"}
+	assert.NoError(i.addClusterProvenance(provenance, "e1"))
+	assert.Equal("harbor.cyverse.org/de/jupyter:latest", provenance.Image)
+	assert.Equal("sha256:aaaa", provenance.ImageDigest)
+	assert.Equal(map[string]string{"requests.cpu": "500m", "limits.memory": "4Gi"}, provenance.Resources)
+}
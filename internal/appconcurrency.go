@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// AppConcurrencyLimit is the most analyses of an app that can run at once
+// across all users, for apps that talk to shared services that can only
+// handle so many clients. Launches past the limit wait in the launch queue.
+type AppConcurrencyLimit struct {
+	AppID      string    `json:"appID" db:"app_id"`
+	MaxRunning int       `json:"maxRunning" db:"max_running"`
+	UpdatedAt  time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// AppConcurrencyStats is a concurrency limit along with how many analyses of
+// the app are running and waiting.
+type AppConcurrencyStats struct {
+	AppConcurrencyLimit
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+}
+
+const getAppConcurrencyLimitSQL = `
+	SELECT app_id, max_running, updated_at
+	  FROM vice_app_concurrency_limits
+	 WHERE app_id = $1
+`
+
+const listAppConcurrencyLimitsSQL = `
+	SELECT app_id, max_running, updated_at
+	  FROM vice_app_concurrency_limits
+	 ORDER BY app_id
+`
+
+const upsertAppConcurrencyLimitSQL = `
+	INSERT INTO vice_app_concurrency_limits (app_id, max_running, updated_at)
+	VALUES ($1, $2, now())
+	ON CONFLICT (app_id) DO UPDATE
+	   SET max_running = EXCLUDED.max_running,
+	       updated_at = EXCLUDED.updated_at
+	RETURNING app_id, max_running, updated_at
+`
+
+const deleteAppConcurrencyLimitSQL = `
+	DELETE FROM vice_app_concurrency_limits
+	 WHERE app_id = $1
+`
+
+// appConcurrencyLimit returns the concurrency limit for the app, or nil if it
+// doesn't have one.
+func (i *Internal) appConcurrencyLimit(appID string) (*AppConcurrencyLimit, error) {
+	if appID == "" {
+		return nil, nil
+	}
+
+	limit := &AppConcurrencyLimit{}
+	err := i.db.QueryRowx(getAppConcurrencyLimitSQL, appID).StructScan(limit)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the concurrency limit for app %s", appID)
+	}
+
+	return limit, nil
+}
+
+// appConcurrencyLimits returns every app concurrency limit, keyed by app ID.
+func (i *Internal) appConcurrencyLimits() (map[string]*AppConcurrencyLimit, error) {
+	rows := []AppConcurrencyLimit{}
+	if err := i.db.Select(&rows, listAppConcurrencyLimitsSQL); err != nil {
+		return nil, errors.Wrap(err, "error listing the app concurrency limits")
+	}
+
+	limits := map[string]*AppConcurrencyLimit{}
+	for idx := range rows {
+		limits[rows[idx].AppID] = &rows[idx]
+	}
+
+	return limits, nil
+}
+
+// queuedAnalysesByApp counts the queued launches of each app. The caller must
+// hold the queue lock.
+func (i *Internal) queuedAnalysesByApp() map[string]int {
+	queued := map[string]int{}
+	for _, launch := range i.launchQueue.launches {
+		queued[launch.job.AppID]++
+	}
+	return queued
+}
+
+// appAtLimit returns true if a new launch of the app has to wait for one of
+// its analyses to finish, given the number of analyses of each app that are
+// running. Launches of an app already have to wait if others are queued ahead
+// of them, so that they go in order. The caller must hold the queue lock.
+func (i *Internal) appAtLimit(limit *AppConcurrencyLimit, running map[string]int) bool {
+	if i.queuedAnalysesByApp()[limit.AppID] > 0 {
+		return true
+	}
+	return running[limit.AppID] >= limit.MaxRunning
+}
+
+// AdminListAppConcurrencyHandler lists the app concurrency limits along with
+// the number of analyses of each app that are running and queued.
+func (i *Internal) AdminListAppConcurrencyHandler(c echo.Context) error {
+	limits, err := i.appConcurrencyLimits()
+	if err != nil {
+		return err
+	}
+
+	counts, err := i.countAnalyses()
+	if err != nil {
+		return err
+	}
+
+	i.launchQueue.mu.Lock()
+	queued := i.queuedAnalysesByApp()
+	i.launchQueue.mu.Unlock()
+
+	stats := []AppConcurrencyStats{}
+	for _, limit := range limits {
+		stats = append(stats, AppConcurrencyStats{
+			AppConcurrencyLimit: *limit,
+			Running:             counts.byApp[limit.AppID],
+			Queued:              queued[limit.AppID],
+		})
+	}
+	sort.Slice(stats, func(a, b int) bool { return stats[a].AppID < stats[b].AppID })
+
+	return c.JSON(http.StatusOK, map[string][]AppConcurrencyStats{
+		"limits": stats,
+	})
+}
+
+// AdminPutAppConcurrencyHandler sets the concurrency limit for an app.
+// Lowering a limit doesn't stop analyses that are already running.
+func (i *Internal) AdminPutAppConcurrencyHandler(c echo.Context) error {
+	appID := c.Param("app-id")
+
+	request := &AppConcurrencyLimit{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if request.MaxRunning < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "maxRunning must be at least 1")
+	}
+
+	limit := &AppConcurrencyLimit{}
+	if err := i.db.QueryRowx(upsertAppConcurrencyLimitSQL, appID, request.MaxRunning).StructScan(limit); err != nil {
+		return errors.Wrapf(err, "error saving the concurrency limit for app %s", appID)
+	}
+
+	return c.JSON(http.StatusOK, limit)
+}
+
+// AdminDeleteAppConcurrencyHandler removes the concurrency limit from an app.
+// Its queued launches are admitted at the next check.
+func (i *Internal) AdminDeleteAppConcurrencyHandler(c echo.Context) error {
+	appID := c.Param("app-id")
+
+	result, err := i.db.Exec(deleteAppConcurrencyLimitSQL, appID)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting the concurrency limit for app %s", appID)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("app %s has no concurrency limit", appID))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
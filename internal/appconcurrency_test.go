@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// appDeployment returns a running analysis deployment for the app.
+func appDeployment(externalID, appID string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      externalID,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "external-id": externalID, "app-id": appID},
+		},
+	}
+}
+
+func registerAppLimitQuery(mock sqlmock.Sqlmock, appID string, maxRunning int) {
+	mock.ExpectQuery("FROM vice_app_concurrency_limits").
+		WithArgs(appID).
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_running", "updated_at"}).AddRow(appID, maxRunning, time.Now()))
+}
+
+func TestQueueLaunchIfAppAtLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		appDeployment("e1", "license-app"),
+	})
+
+	// The app has room, so the launch goes ahead.
+	registerAppLimitQuery(mock, "license-app", 2)
+	position, err := i.queueLaunchIfBusy(&model.Job{InvocationID: "e2", AppID: "license-app", Submitter: "alice"})
+	assert.NoError(err)
+	assert.Nil(position)
+
+	// The app is at its limit, so the launch waits.
+	registerAppLimitQuery(mock, "license-app", 1)
+	position, err = i.queueLaunchIfBusy(&model.Job{InvocationID: "e3", AppID: "license-app", Submitter: "alice"})
+	assert.NoError(err)
+	assert.Equal(1, position.Position)
+
+	// Launches of other apps aren't held up.
+	mock.ExpectQuery("FROM vice_app_concurrency_limits").WithArgs("other-app").WillReturnRows(
+		sqlmock.NewRows([]string{"app_id", "max_running", "updated_at"}),
+	)
+	position, err = i.queueLaunchIfBusy(&model.Job{InvocationID: "e4", AppID: "other-app", Submitter: "bob"})
+	assert.NoError(err)
+	assert.Nil(position)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNextAdmissible(t *testing.T) {
+	now := time.Now()
+	first := queued("e1", "alice", now)
+	first.job.AppID = "license-app"
+	second := queued("e2", "bob", now)
+	second.job.AppID = "other-app"
+
+	limits := map[string]*AppConcurrencyLimit{"license-app": {AppID: "license-app", MaxRunning: 1}}
+
+	assert.Equal(t, first, nextAdmissible([]*queuedLaunch{first, second}, limits, map[string]int{}, neverOverQuota))
+	assert.Equal(t, second, nextAdmissible([]*queuedLaunch{first, second}, limits, map[string]int{"license-app": 1}, neverOverQuota))
+	assert.Nil(t, nextAdmissible([]*queuedLaunch{first}, limits, map[string]int{"license-app": 1}, neverOverQuota))
+}
+
+func TestAdminListAppConcurrencyHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		appDeployment("e1", "license-app"),
+		appDeployment("e2", "license-app"),
+	})
+	i.launchQueue.launches = append(i.launchQueue.launches, &queuedLaunch{
+		job: &model.Job{InvocationID: "e3", AppID: "license-app"},
+	})
+
+	mock.ExpectQuery("FROM vice_app_concurrency_limits").
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_running", "updated_at"}).AddRow("license-app", 2, time.Now()))
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/vice/admin/app-concurrency/", nil), rec)
+
+	assert.NoError(i.AdminListAppConcurrencyHandler(c))
+
+	result := map[string][]AppConcurrencyStats{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Len(result["limits"], 1)
+	assert.Equal(2, result["limits"][0].MaxRunning)
+	assert.Equal(2, result["limits"][0].Running)
+	assert.Equal(1, result["limits"][0].Queued)
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// AppInitContainersConfig maps app IDs to the init containers declared for
+// their analyses. They run in order after the input files are downloaded and
+// before the analysis container starts, which makes them useful for fetching
+// reference data or fixing permissions on the working directory.
+type AppInitContainersConfig map[string][]SidecarConfig
+
+// ValidateAppInitContainers returns an error if any of the init containers
+// declared for apps can't be added to analysis pods.
+func ValidateAppInitContainers(apps AppInitContainersConfig) error {
+	problems := []string{}
+
+	for appID, containers := range apps {
+		problems = append(problems, validateContainerConfigs(fmt.Sprintf("app %s init container", appID), containers)...)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid app init containers: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// appInitContainers returns the init containers declared for the app used by
+// the analysis, with their templates rendered. It does not call the k8s API.
+func (i *Internal) appInitContainers(job *model.Job) ([]apiv1.Container, error) {
+	containers := []apiv1.Container{}
+
+	configs := i.AppInitContainers[job.AppID]
+	if len(configs) == 0 {
+		return containers, nil
+	}
+
+	data := i.sidecarTemplateData(job)
+
+	for idx := range configs {
+		container, err := i.renderContainer(job, &configs[idx], data)
+		if err != nil {
+			return nil, err
+		}
+
+		// Init containers have to finish, so they can't have ports.
+		container.Ports = nil
+
+		containers = append(containers, *container)
+	}
+
+	return containers, nil
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAppInitContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateAppInitContainers(nil))
+	assert.NoError(ValidateAppInitContainers(AppInitContainersConfig{
+		"app1": {{Name: "fetch-refs", Image: "example.org/fetch:1.0"}},
+		"app2": {{Name: "fetch-refs", Image: "example.org/fetch:1.0"}},
+	}))
+
+	err := ValidateAppInitContainers(AppInitContainersConfig{
+		"app1": {{Name: fileTransfersInitContainerName, Image: "example.org/fetch:1.0"}},
+	})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "app app1 init container name input-files-init is reserved")
+	}
+}
+
+func TestAppInitContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	defer internal.db.Close()
+
+	internal.AppInitContainers = AppInitContainersConfig{
+		"app1": {
+			{Name: "fetch-refs", Image: "example.org/fetch:1.0", Args: []string{"--dest={{.ExternalID}}"}, Ports: []int32{8080}},
+			{Name: "fix-perms", Image: "busybox", Command: []string{"chown", "-R", "1000", "/data"}, MountWorkingDir: true, RunAsRoot: true},
+		},
+	}
+
+	job := multiPortJob(8888)
+
+	// Apps without init containers don't touch the database.
+	containers, err := internal.appInitContainers(job)
+	assert.NoError(err)
+	assert.Empty(containers)
+
+	job.AppID = "app1"
+	registerSubdomainQuery(mock, job.InvocationID, "")
+	containers, err = internal.appInitContainers(job)
+	assert.NoError(err)
+	assert.Len(containers, 2)
+
+	assert.Equal("fetch-refs", containers[0].Name)
+	assert.Equal([]string{"--dest=e1"}, containers[0].Args)
+	assert.Empty(containers[0].Ports)
+	assert.Nil(containers[0].SecurityContext)
+
+	assert.Equal("fix-perms", containers[1].Name)
+	assert.Len(containers[1].VolumeMounts, 1)
+	assert.Equal(int64(0), *containers[1].SecurityContext.RunAsUser)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// launchFieldManager is the field manager the resources for analyses are
+// applied as.
+const launchFieldManager = "app-exposer"
+
+// labelFieldManager is the field manager the labels added by relabeling are
+// applied as. An apply removes the fields its manager set before that it
+// leaves out, so label-only applies need a manager of their own or they'd
+// strip everything the launch set.
+const labelFieldManager = "app-exposer-labels"
+
+// applyResources are the resources of the kinds of objects that get applied.
+var applyResources = map[string]string{
+	"ConfigMap":             "configmaps",
+	"Deployment":            "deployments",
+	"Job":                   "jobs",
+	"PersistentVolume":      "persistentvolumes",
+	"PersistentVolumeClaim": "persistentvolumeclaims",
+	"Service":               "services",
+	"Ingress":               "ingresses",
+	"NetworkPolicy":         "networkpolicies",
+}
+
+// ObjectApplier creates or updates objects with server-side apply. Fields set
+// by other field managers are left alone unless the object sets them too.
+// Cluster-scoped objects are applied with an empty namespace.
+type ObjectApplier interface {
+	Apply(namespace string, obj runtime.Object, fieldManager string) error
+}
+
+// dynamicApplier applies objects through the dynamic client, since the typed
+// clients in this version of client-go can't pass the field manager along
+// with a patch.
+type dynamicApplier struct {
+	client dynamic.Interface
+}
+
+// NewServerSideApplier returns an ObjectApplier that applies objects to the
+// cluster the config is for.
+func NewServerSideApplier(config *rest.Config) (ObjectApplier, error) {
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating the dynamic client")
+	}
+	return &dynamicApplier{client: client}, nil
+}
+
+// objectKind returns the group, version and kind of the object. Unstructured
+// objects carry their own; typed ones are looked up in the client-go scheme.
+func objectKind(obj runtime.Object) (schema.GroupVersionKind, error) {
+	if u, ok := obj.(*unstructured.Unstructured); ok {
+		return u.GroupVersionKind(), nil
+	}
+
+	gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return gvks[0], nil
+}
+
+// Apply sends the object as an apply patch. Ownership of fields that another
+// manager set to something else isn't forced, so the apply fails with a
+// conflict instead of overwriting them.
+func (d *dynamicApplier) Apply(namespace string, obj runtime.Object, fieldManager string) error {
+	gvk, err := objectKind(obj)
+	if err != nil {
+		return errors.Wrap(err, "error determining the kind of the object to apply")
+	}
+
+	resource, ok := applyResources[gvk.Kind]
+	if !ok {
+		return fmt.Errorf("objects of kind %s can't be applied", gvk.Kind)
+	}
+
+	// Apply patches have to say what they are.
+	obj = obj.DeepCopyObject()
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "error encoding %s %s", gvk.Kind, accessor.GetName())
+	}
+
+	resourceClient := d.client.Resource(gvk.GroupVersion().WithResource(resource))
+	var client dynamic.ResourceInterface = resourceClient
+	if namespace != "" {
+		client = resourceClient.Namespace(namespace)
+	}
+
+	_, err = client.Patch(accessor.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: fieldManager,
+	})
+	return errors.Wrapf(err, "error applying %s %s", gvk.Kind, accessor.GetName())
+}
+
+// SetObjectApplier sets the ObjectApplier used to create and update the
+// resources for analyses. Without one, they're created and updated with the
+// typed clients instead.
+func (i *Internal) SetObjectApplier(applier ObjectApplier) {
+	i.objectApplier = applier
+}
+
+// applyObject creates or updates the object in the namespace with
+// server-side apply, or with upsert if no applier is set.
+func (i *Internal) applyObject(namespace string, obj runtime.Object, upsert func() error) error {
+	if i.objectApplier == nil {
+		return upsert()
+	}
+	return i.objectApplier.Apply(namespace, obj, launchFieldManager)
+}
+
+// copyLabels returns a copy of the labels that can be changed without
+// changing the original.
+func copyLabels(labels map[string]string) map[string]string {
+	copied := map[string]string{}
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// applyLabels saves the labels relabeling added to or changed on the object
+// in the VICE namespace. With server-side apply, all of the analysis labels
+// the object has are applied, changed or not, and nothing else about the
+// object is touched; otherwise update is called. An apply drops the fields
+// its manager set before that it leaves out, so applying only the changed
+// labels would remove the ones added by earlier relabelings. Objects whose
+// labels didn't change aren't written to at all.
+func (i *Internal) applyLabels(gvk schema.GroupVersionKind, name string, original, updated map[string]string, update func() error) error {
+	changed := false
+	for k, v := range updated {
+		if value, ok := original[k]; !ok || value != v {
+			changed = true
+			break
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if i.objectApplier == nil {
+		return update()
+	}
+
+	owned := map[string]interface{}{}
+	for k, v := range updated {
+		if i.labelKeys.isAnalysisKey(k) {
+			owned[k] = v
+		}
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": owned,
+		},
+	}}
+	obj.SetGroupVersionKind(gvk)
+
+	return i.objectApplier.Apply(i.ViceNamespace, obj, labelFieldManager)
+}
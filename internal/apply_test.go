@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+)
+
+// appliedObject is an object that was passed to a recordingApplier.
+type appliedObject struct {
+	namespace    string
+	obj          runtime.Object
+	fieldManager string
+}
+
+// recordingApplier is an ObjectApplier that records what it's asked to apply.
+type recordingApplier struct {
+	applied []appliedObject
+}
+
+func (r *recordingApplier) Apply(namespace string, obj runtime.Object, fieldManager string) error {
+	r.applied = append(r.applied, appliedObject{namespace: namespace, obj: obj, fieldManager: fieldManager})
+	return nil
+}
+
+func TestApplyObject(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	cm := &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-e1"}}
+
+	// Without an applier, the upsert is used.
+	upserted := false
+	err := internal.applyObject("vice-apps", cm, func() error {
+		upserted = true
+		return nil
+	})
+	assert.NoError(err)
+	assert.True(upserted)
+
+	applier := &recordingApplier{}
+	internal.SetObjectApplier(applier)
+
+	upserted = false
+	err = internal.applyObject("vice-apps", cm, func() error {
+		upserted = true
+		return nil
+	})
+	assert.NoError(err)
+	assert.False(upserted)
+	assert.Equal([]appliedObject{{namespace: "vice-apps", obj: cm, fieldManager: launchFieldManager}}, applier.applied)
+}
+
+func TestApplyLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	applier := &recordingApplier{}
+	internal.SetObjectApplier(applier)
+
+	gvk := appsv1.SchemeGroupVersion.WithKind("Deployment")
+	original := map[string]string{"app-name": "jupyter", "subdomain": "old", "app": "vice-e1"}
+	updated := map[string]string{"app-name": "jupyter", "subdomain": "new", "login-ip": "127.0.0.1", "app": "vice-e1"}
+
+	update := func() error {
+		t.Error("update shouldn't be called when there's an applier")
+		return nil
+	}
+
+	assert.NoError(internal.applyLabels(gvk, "e1", original, updated, update))
+	if assert.Len(applier.applied, 1) {
+		applied := applier.applied[0]
+		assert.Equal("vice-apps", applied.namespace)
+		assert.Equal(labelFieldManager, applied.fieldManager)
+
+		obj := applied.obj.(*unstructured.Unstructured)
+		assert.Equal(gvk, obj.GroupVersionKind())
+		assert.Equal("e1", obj.GetName())
+		// All of the analysis labels are applied, not just the ones that
+		// changed, so the ones applied before aren't dropped.
+		assert.Equal(map[string]string{"app-name": "jupyter", "subdomain": "new", "login-ip": "127.0.0.1"}, obj.GetLabels())
+	}
+
+	// Nothing is written when the labels didn't change.
+	assert.NoError(internal.applyLabels(gvk, "e1", original, copyLabels(original), update))
+	assert.Len(applier.applied, 1)
+}
+
+func TestApplyLabelsFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	gvk := apiv1.SchemeGroupVersion.WithKind("Service")
+
+	updates := 0
+	update := func() error {
+		updates++
+		return nil
+	}
+
+	assert.NoError(internal.applyLabels(gvk, "vice-e1", map[string]string{}, map[string]string{"subdomain": "a"}, update))
+	assert.NoError(internal.applyLabels(gvk, "vice-e1", map[string]string{"subdomain": "a"}, map[string]string{"subdomain": "a"}, update))
+	assert.Equal(1, updates)
+}
+
+func TestServerSideApplier(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		method      string
+		path        string
+		contentType string
+		query       map[string][]string
+		body        string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		query = r.URL.Query()
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"e1","namespace":"vice-apps"}}`))
+	}))
+	defer server.Close()
+
+	applier, err := NewServerSideApplier(&rest.Config{Host: server.URL})
+	if !assert.NoError(err) {
+		return
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps"}}
+	assert.NoError(applier.Apply("vice-apps", deployment, launchFieldManager))
+
+	assert.Equal(http.MethodPatch, method)
+	assert.Equal("/apis/apps/v1/namespaces/vice-apps/deployments/e1", path)
+	assert.Equal("application/apply-patch+yaml", contentType)
+	assert.Equal([]string{launchFieldManager}, query["fieldManager"])
+	assert.Empty(query["force"])
+	assert.Contains(body, `"kind":"Deployment"`)
+	assert.Contains(body, `"apiVersion":"apps/v1"`)
+
+	// The object passed in is left alone.
+	assert.Empty(deployment.Kind)
+
+	// Cluster-scoped objects aren't put in a namespace.
+	assert.NoError(applier.Apply("", &apiv1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "csi-e1"}}, launchFieldManager))
+	assert.Equal("/api/v1/persistentvolumes/csi-e1", path)
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// maxAuditBodySize is the most of a request body recorded in an audit event.
+const maxAuditBodySize = 64 * 1024
+
+// Audited actions.
+const (
+	AuditAdminListing    = "admin-listing"
+	AuditTerminate       = "terminate"
+	AuditBulkTerminate   = "bulk-terminate"
+	AuditExit            = "exit"
+	AuditSaveAndExit     = "save-and-exit"
+	AuditRelabel         = "relabel"
+	AuditExec            = "exec"
+	AuditTimeLimitChange = "time-limit-change"
+	AuditFreezeUser      = "freeze-user"
+	AuditUnfreezeUser    = "unfreeze-user"
+	AuditRestoreBackup   = "restore-backup"
+	AuditExportBackup    = "export-backup"
+
+	AuditApplyNamespaceQuotas  = "apply-namespace-quotas"
+	AuditMoveQueuedLaunch      = "move-queued-launch"
+	AuditPrepullImage          = "prepull-image"
+	AuditPullCheck             = "pull-check"
+	AuditImageProbe            = "image-probe"
+	AuditReferenceData         = "reference-data-change"
+	AuditConfigTemplate        = "config-template-change"
+	AuditRetryWebhook          = "retry-webhook-delivery"
+	AuditAppConcurrency        = "app-concurrency-change"
+	AuditRotateCredentials     = "rotate-credentials"
+	AuditDrainNode             = "drain-node"
+	AuditDownloadInputs        = "download-input-files"
+	AuditSaveOutputs           = "save-output-files"
+	AuditSnapshotOutputs       = "snapshot-outputs"
+	AuditSubdomainChange       = "subdomain-change"
+	AuditProtect               = "protect"
+	AuditUnprotect             = "unprotect"
+	AuditPause                 = "pause"
+	AuditResume                = "resume"
+	AuditInvalidatePermissions = "invalidate-permissions"
+)
+
+// Results of audited actions.
+const (
+	AuditSucceeded = "succeeded"
+	AuditFailed    = "failed"
+)
+
+// AuditConfig controls where audit events are recorded. Events are always
+// written to stdout as JSON, one per line. If Database is true they're also
+// stored in the vice_audit_log table.
+type AuditConfig struct {
+	Database bool `mapstructure:"database"`
+}
+
+// AuditEvent records an admin or destructive action. User is who the action
+// was done by, taken from the identity token of the request; it's empty if the
+// request wasn't authenticated. Target identifies the analysis, user, or node
+// it was done to. Parameters contains the path and query parameters of the
+// request, including the 'user' the caller claimed to be, along with its body,
+// if it has one.
+type AuditEvent struct {
+	Time       time.Time         `json:"time"`
+	Action     string            `json:"action"`
+	User       string            `json:"user"`
+	Target     string            `json:"target,omitempty"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+	Result     string            `json:"result"`
+	Status     int               `json:"status"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// AuditSink is somewhere audit events are recorded.
+type AuditSink interface {
+	Record(event *AuditEvent) error
+}
+
+// JSONAuditSink writes audit events to a writer as JSON, one per line.
+type JSONAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditSink returns a *JSONAuditSink that writes to w.
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// Record writes the event.
+func (s *JSONAuditSink) Record(event *AuditEvent) error {
+	line, err := json.Marshal(map[string]interface{}{"audit": event})
+	if err != nil {
+		return errors.Wrap(err, "error encoding an audit event")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// DBAuditSink stores audit events in the vice_audit_log table.
+type DBAuditSink struct {
+	db *sqlx.DB
+}
+
+const recordAuditEventSQL = `
+	INSERT INTO vice_audit_log (recorded_at, action, username, target, method, path, parameters, body, result, status, error)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+`
+
+// Record stores the event.
+func (s *DBAuditSink) Record(event *AuditEvent) error {
+	params, err := json.Marshal(event.Parameters)
+	if err != nil {
+		return errors.Wrap(err, "error encoding the parameters of an audit event")
+	}
+
+	var body interface{}
+	if len(event.Body) > 0 {
+		body = string(event.Body)
+	}
+
+	_, err = s.db.Exec(
+		recordAuditEventSQL,
+		event.Time,
+		event.Action,
+		event.User,
+		event.Target,
+		event.Method,
+		event.Path,
+		string(params),
+		body,
+		event.Result,
+		event.Status,
+		event.Error,
+	)
+	return errors.Wrapf(err, "error storing the %s audit event", event.Action)
+}
+
+// newAuditSinks returns where audit events are recorded.
+func newAuditSinks(config *AuditConfig, db *sqlx.DB) []AuditSink {
+	sinks := []AuditSink{NewJSONAuditSink(os.Stdout)}
+	if config.Database {
+		sinks = append(sinks, &DBAuditSink{db: db})
+	}
+	return sinks
+}
+
+// SetAuditSinks replaces where audit events are recorded.
+func (i *Internal) SetAuditSinks(sinks ...AuditSink) {
+	i.auditSinks = sinks
+}
+
+// recordAudit records the event in every sink. Failures are logged, since the
+// action has already happened.
+func (i *Internal) recordAudit(event *AuditEvent) {
+	for _, sink := range i.auditSinks {
+		if err := sink.Record(event); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// auditTarget returns the analysis, user, or node the request acts on, taken
+// from the path parameters.
+func auditTarget(c echo.Context) string {
+	for _, name := range []string{"analysis-id", "external-id", "id", "host", "username", "node"} {
+		if value := c.Param(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// auditParameters returns the path and query parameters of the request.
+func auditParameters(c echo.Context) map[string]string {
+	params := map[string]string{}
+
+	for _, name := range c.ParamNames() {
+		params[name] = c.Param(name)
+	}
+
+	for name, values := range c.QueryParams() {
+		if len(values) == 0 {
+			continue
+		}
+		params[name] = values[0]
+	}
+
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// auditBody reads the start of the request body so that it can be recorded,
+// then puts it back in front of the rest so the handler can read all of it.
+// No more than one byte past the most that's recorded is read, so large
+// bodies aren't held in memory. Bodies that are too large or aren't JSON are
+// left out.
+func auditBody(c echo.Context) json.RawMessage {
+	req := c.Request()
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, maxAuditBodySize+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+	if err != nil {
+		log.Error(errors.Wrap(err, "error reading a request body for the audit log"))
+		return nil
+	}
+
+	if len(b) == 0 || len(b) > maxAuditBodySize || !json.Valid(b) {
+		return nil
+	}
+	return json.RawMessage(b)
+}
+
+// Audit returns middleware that records the action after the handler is done
+// with the request, whether or not it succeeded.
+func (i *Internal) Audit(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			event := &AuditEvent{
+				Time:       time.Now(),
+				Action:     action,
+				User:       i.identifiedUser(c),
+				Target:     auditTarget(c),
+				Method:     c.Request().Method,
+				Path:       c.Request().URL.Path,
+				Parameters: auditParameters(c),
+				Body:       auditBody(c),
+			}
+
+			err := next(c)
+
+			event.Status = c.Response().Status
+			if err != nil {
+				event.Error = err.Error()
+				switch e := err.(type) {
+				case *echo.HTTPError:
+					event.Status = e.Code
+				case common.ErrorResponse, *common.ErrorResponse:
+					event.Status = http.StatusBadRequest
+				default:
+					event.Status = http.StatusInternalServerError
+				}
+			}
+
+			event.Result = AuditSucceeded
+			if err != nil || event.Status >= http.StatusBadRequest {
+				event.Result = AuditFailed
+			}
+
+			i.recordAudit(event)
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingAuditSink struct {
+	events []*AuditEvent
+}
+
+func (s *recordingAuditSink) Record(event *AuditEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestAuditRecordsAction(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	sink := &recordingAuditSink{}
+	internal.SetAuditSinks(sink)
+
+	var handlerBody string
+	handler := internal.Audit(AuditTimeLimitChange)(func(c echo.Context) error {
+		b, err := ioutil.ReadAll(c.Request().Body)
+		handlerBody = string(b)
+		if err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	internal.IdentityKey = testIdentityKey
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/vice/admin/analyses/a1/time-limit?user=mallory&force=true", strings.NewReader(`{"hours":4}`))
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+userToken(t, "alice"))
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("analysis-id")
+	c.SetParamValues("a1")
+
+	assert.NoError(handler(c))
+
+	// The handler still gets the body after it's been recorded.
+	assert.Equal(`{"hours":4}`, handlerBody)
+
+	if assert.Len(sink.events, 1) {
+		event := sink.events[0]
+		assert.Equal(AuditTimeLimitChange, event.Action)
+
+		// The user comes from the identity token, not the query parameter,
+		// which is kept along with the other parameters.
+		assert.Equal(internal.fixUsername("alice"), event.User)
+		assert.Equal("a1", event.Target)
+		assert.Equal(map[string]string{"analysis-id": "a1", "force": "true", "user": "mallory"}, event.Parameters)
+		assert.JSONEq(`{"hours":4}`, string(event.Body))
+		assert.Equal(AuditSucceeded, event.Result)
+		assert.Equal(http.StatusOK, event.Status)
+	}
+}
+
+func TestAuditRecordsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	sink := &recordingAuditSink{}
+	internal.SetAuditSinks(sink)
+
+	handler := internal.Audit(AuditTerminate)(func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusForbidden, "not allowed")
+	})
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodDelete, "/vice/admin/analyses/e1?user=bob", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("external-id")
+	c.SetParamValues("e1")
+
+	assert.Error(handler(c))
+
+	if assert.Len(sink.events, 1) {
+		event := sink.events[0]
+		assert.Equal("e1", event.Target)
+		assert.Equal(AuditFailed, event.Result)
+		assert.Equal(http.StatusForbidden, event.Status)
+		assert.Contains(event.Error, "not allowed")
+		assert.Nil(event.Body)
+
+		// Requests without an identity token aren't attributed to anyone.
+		assert.Empty(event.User)
+	}
+}
+
+func TestAuditBodyLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	// Bodies past the limit aren't recorded, but the handler still gets all
+	// of it.
+	large := `{"data":"` + strings.Repeat("x", maxAuditBodySize) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/vice/admin/restore", strings.NewReader(large))
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	assert.Nil(auditBody(c))
+
+	b, err := ioutil.ReadAll(c.Request().Body)
+	assert.NoError(err)
+	assert.Equal(large, string(b))
+	assert.NoError(c.Request().Body.Close())
+}
+
+func TestJSONAuditSink(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	sink := NewJSONAuditSink(&buf)
+
+	assert.NoError(sink.Record(&AuditEvent{Action: AuditExec, User: "alice", Target: "a1", Result: AuditSucceeded}))
+	assert.NoError(sink.Record(&AuditEvent{Action: AuditRelabel, User: "bob", Result: AuditFailed}))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(lines, 2) {
+		line := map[string]*AuditEvent{}
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &line))
+		assert.Equal(AuditExec, line["audit"].Action)
+		assert.Equal("a1", line["audit"].Target)
+	}
+}
+
+func TestDBAuditSink(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	sink := &DBAuditSink{db: internal.db}
+
+	mock.ExpectExec("INSERT INTO vice_audit_log").
+		WithArgs(sqlmock.AnyArg(), AuditTerminate, "alice", "e1", http.MethodDelete, "/vice/admin/analyses/e1", `{"external-id":"e1"}`, nil, AuditSucceeded, http.StatusOK, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	assert.NoError(sink.Record(&AuditEvent{
+		Action:     AuditTerminate,
+		User:       "alice",
+		Target:     "e1",
+		Method:     http.MethodDelete,
+		Path:       "/vice/admin/analyses/e1",
+		Parameters: map[string]string{"external-id": "e1"},
+		Result:     AuditSucceeded,
+		Status:     http.StatusOK,
+	}))
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// auxiliaryContainerPrefix starts the names of the containers for the
+	// steps after the first, so they can't collide with the containers
+	// app-exposer adds itself.
+	auxiliaryContainerPrefix = "aux-"
+
+	// sharedVolumeName is the volume mounted into the analysis container and
+	// every auxiliary container, so that they can share files outside of the
+	// working directory, such as sockets.
+	sharedVolumeName      = "shared"
+	sharedVolumeMountPath = "/vice-shared"
+)
+
+var nonContainerNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// auxiliarySteps returns the steps of the job after the first that declare a
+// container image. Those run as auxiliary containers next to the analysis
+// container, such as a database that the analysis UI talks to.
+func auxiliarySteps(job *model.Job) []model.Step {
+	steps := []model.Step{}
+	if len(job.Steps) < 2 {
+		return steps
+	}
+
+	for _, step := range job.Steps[1:] {
+		if step.Component.Container.Image.Name != "" {
+			steps = append(steps, step)
+		}
+	}
+
+	return steps
+}
+
+// auxiliaryContainerName returns the name of the container for an auxiliary
+// step. It's based on the container or component name, falling back to the
+// step's position.
+func auxiliaryContainerName(step *model.Step, idx int) string {
+	base := step.Component.Container.Name
+	if base == "" {
+		base = step.Component.Name
+	}
+
+	base = nonContainerNameChars.ReplaceAllString(strings.ToLower(base), "-")
+	base = strings.Trim(base, "-")
+	if base == "" {
+		base = fmt.Sprintf("%d", idx+1)
+	}
+
+	name := auxiliaryContainerPrefix + base
+	if len(name) > maxSubdomainLength {
+		name = strings.TrimRight(name[:maxSubdomainLength], "-")
+	}
+
+	return name
+}
+
+// validateAuxiliaryContainers makes sure the auxiliary containers of the job
+// can run in the same pod as the analysis container. The containers share a
+// network namespace, so none of them can listen on a port that another one
+// uses.
+func (i *Internal) validateAuxiliaryContainers(job *model.Job) (int, error) {
+	steps := auxiliarySteps(job)
+	if len(steps) == 0 {
+		return http.StatusOK, nil
+	}
+
+	problems := []string{}
+
+	names := map[string]bool{}
+	for _, sidecar := range i.Sidecars {
+		names[sidecar.Name] = true
+	}
+
+	ports := map[int]string{
+		int(viceProxyPort):     viceProxyContainerName,
+		int(fileTransfersPort): fileTransfersContainerName,
+	}
+	for _, p := range job.Steps[0].Component.Container.Ports {
+		ports[p.ContainerPort] = analysisContainerName
+	}
+
+	for idx := range steps {
+		name := auxiliaryContainerName(&steps[idx], idx)
+		if names[name] {
+			problems = append(problems, fmt.Sprintf("container name %s is used more than once", name))
+		}
+		names[name] = true
+
+		for _, p := range steps[idx].Component.Container.Ports {
+			if other, ok := ports[p.ContainerPort]; ok {
+				problems = append(problems, fmt.Sprintf("port %d of %s is already used by %s", p.ContainerPort, name, other))
+				continue
+			}
+			ports[p.ContainerPort] = name
+		}
+	}
+
+	if len(problems) == 0 {
+		return http.StatusOK, nil
+	}
+
+	sort.Strings(problems)
+
+	return http.StatusBadRequest, common.ErrorResponse{
+		ErrorCode: "ERR_INVALID_AUXILIARY_CONTAINERS",
+		Message:   fmt.Sprintf("the auxiliary containers can't run with the analysis: %s", strings.Join(problems, "; ")),
+		Details: &map[string]interface{}{
+			"problems": problems,
+		},
+	}
+}
+
+// sharedVolumeMount returns the mount for the shared volume.
+func sharedVolumeMount() apiv1.VolumeMount {
+	return apiv1.VolumeMount{
+		Name:      sharedVolumeName,
+		MountPath: sharedVolumeMountPath,
+	}
+}
+
+// auxiliaryResources returns the resource requirements of an auxiliary
+// container. Only the requests and limits declared for it are set.
+func auxiliaryResources(container *model.Container) apiv1.ResourceRequirements {
+	requests := apiv1.ResourceList{}
+	limits := apiv1.ResourceList{}
+
+	if container.MinCPUCores != 0 {
+		requests[apiv1.ResourceCPU] = *resourcev1.NewMilliQuantity(int64(container.MinCPUCores*1000), resourcev1.DecimalSI)
+	}
+	if container.MinMemoryLimit != 0 {
+		requests[apiv1.ResourceMemory] = *resourcev1.NewQuantity(container.MinMemoryLimit, resourcev1.BinarySI)
+	}
+	if container.MaxCPUCores != 0 {
+		limits[apiv1.ResourceCPU] = *resourcev1.NewMilliQuantity(int64(container.MaxCPUCores*1000), resourcev1.DecimalSI)
+	}
+	if container.MemoryLimit != 0 {
+		limits[apiv1.ResourceMemory] = *resourcev1.NewQuantity(container.MemoryLimit, resourcev1.BinarySI)
+	}
+
+	return apiv1.ResourceRequirements{Requests: requests, Limits: limits}
+}
+
+// auxiliaryContainers returns the containers for the auxiliary steps of the
+// job. They reach the analysis container, and each other, on localhost, and
+// share its working directory and the shared volume.
+func (i *Internal) auxiliaryContainers(job *model.Job) []apiv1.Container {
+	containers := []apiv1.Container{}
+
+	steps := auxiliarySteps(job)
+	for idx := range steps {
+		step := &steps[idx]
+		container := &step.Component.Container
+
+		env := []apiv1.EnvVar{}
+		for name, value := range step.Environment {
+			env = append(env, apiv1.EnvVar{Name: name, Value: value})
+		}
+		sort.Slice(env, func(a, b int) bool { return env[a].Name < env[b].Name })
+		env = append(env,
+			apiv1.EnvVar{Name: "IPLANT_USER", Value: job.Submitter},
+			apiv1.EnvVar{Name: "IPLANT_EXECUTION_ID", Value: job.InvocationID},
+			apiv1.EnvVar{Name: "VICE_SHARED_DIR", Value: sharedVolumeMountPath},
+		)
+
+		ports := []apiv1.ContainerPort{}
+		for portIdx, p := range container.Ports {
+			ports = append(ports, apiv1.ContainerPort{
+				ContainerPort: int32(p.ContainerPort),
+				Name:          fmt.Sprintf("tcp-x%d-%d", idx, portIdx),
+				Protocol:      apiv1.ProtocolTCP,
+			})
+		}
+
+		aux := apiv1.Container{
+			Name:            auxiliaryContainerName(step, idx),
+			Image:           fmt.Sprintf("%s:%s", container.Image.Name, container.Image.Tag),
+			ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
+			Env:             env,
+			Resources:       auxiliaryResources(container),
+			VolumeMounts:    append(i.analysisVolumeMounts(job), sharedVolumeMount()),
+			Ports:           ports,
+			WorkingDir:      container.WorkingDir,
+			SecurityContext: &apiv1.SecurityContext{
+				RunAsUser:  int64Ptr(int64(container.UID)),
+				RunAsGroup: int64Ptr(int64(container.UID)),
+			},
+		}
+
+		if container.EntryPoint != "" {
+			aux.Command = []string{container.EntryPoint}
+		}
+
+		if args := step.Arguments(); len(args) != 0 {
+			aux.Args = args
+		}
+
+		containers = append(containers, aux)
+	}
+
+	return containers
+}
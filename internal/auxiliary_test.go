@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// auxiliaryJob returns a job with an analysis container listening on 8888
+// and an auxiliary database container listening on the given ports.
+func auxiliaryJob(ports ...int) *model.Job {
+	job := multiPortJob(8888)
+	job.Submitter = "ipctest"
+
+	declared := []model.Ports{}
+	for _, p := range ports {
+		declared = append(declared, model.Ports{ContainerPort: p})
+	}
+
+	job.Steps = append(job.Steps, model.Step{
+		Component: model.StepComponent{
+			Name: "Postgres DB",
+			Container: model.Container{
+				Image:       model.ContainerImage{Name: "postgres", Tag: "12"},
+				Ports:       declared,
+				MinCPUCores: 0.5,
+				MemoryLimit: gibibyte,
+				UID:         999,
+			},
+		},
+		Environment: model.StepEnvironment{"POSTGRES_PASSWORD": "secret"},
+	})
+
+	return job
+}
+
+func TestAuxiliaryContainerName(t *testing.T) {
+	assert := assert.New(t)
+
+	step := &model.Step{}
+	assert.Equal("aux-3", auxiliaryContainerName(step, 2))
+
+	step.Component.Name = "Postgres DB"
+	assert.Equal("aux-postgres-db", auxiliaryContainerName(step, 0))
+
+	step.Component.Container.Name = "redis_cache"
+	assert.Equal("aux-redis-cache", auxiliaryContainerName(step, 0))
+}
+
+func TestAuxiliarySteps(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(auxiliarySteps(multiPortJob(8888)))
+
+	job := auxiliaryJob(5432)
+	job.Steps = append(job.Steps, model.Step{})
+	assert.Len(auxiliarySteps(job), 1)
+}
+
+func TestValidateAuxiliaryContainers(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupInternal(t, nil)
+
+	_, err := internal.validateAuxiliaryContainers(auxiliaryJob(5432))
+	assert.NoError(err)
+
+	_, err = internal.validateAuxiliaryContainers(auxiliaryJob(8888))
+	assert.Error(err)
+	assert.IsType(common.ErrorResponse{}, err)
+
+	_, err = internal.validateAuxiliaryContainers(auxiliaryJob(int(viceProxyPort)))
+	assert.Error(err)
+}
+
+func TestAuxiliaryContainers(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupInternal(t, nil)
+
+	job := auxiliaryJob(5432)
+	containers := internal.auxiliaryContainers(job)
+	assert.Len(containers, 1)
+
+	aux := containers[0]
+	assert.Equal("aux-postgres-db", aux.Name)
+	assert.Equal("postgres:12", aux.Image)
+	assert.Equal(int32(5432), aux.Ports[0].ContainerPort)
+	assert.Equal(int64(999), *aux.SecurityContext.RunAsUser)
+	assert.Equal(int64(500), aux.Resources.Requests.Cpu().MilliValue())
+	assert.Equal(int64(gibibyte), aux.Resources.Limits.Memory().Value())
+	assert.Contains(aux.Env, apiv1.EnvVar{Name: "POSTGRES_PASSWORD", Value: "secret"})
+	assert.Contains(aux.VolumeMounts, sharedVolumeMount())
+
+	volumes := internal.deploymentVolumes(job)
+	assert.Equal(sharedVolumeName, volumes[len(volumes)-1].Name)
+}
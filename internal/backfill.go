@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+)
+
+// metaInfoCacheTTL is how long analysis records looked up for back-filling
+// listings are kept around.
+const metaInfoCacheTTL = 10 * time.Minute
+
+// metaInfoMissingTTL is how long the absence of a record is remembered, so
+// that analyses that aren't in the database aren't looked up on every
+// listing. It's shorter than metaInfoCacheTTL since the record may show up.
+const metaInfoMissingTTL = time.Minute
+
+// metaInfoCacheMaxEntries is the most external IDs the cache holds.
+const metaInfoCacheMaxEntries = 10000
+
+// metaInfoCacheSweepInterval is how often the expired entries are dropped
+// from the cache, so that ones that are never read again don't pile up.
+const metaInfoCacheSweepInterval = time.Minute
+
+type cachedAnalysisRecord struct {
+	record  *apps.AnalysisRecord // nil if the analysis wasn't found.
+	expires time.Time
+}
+
+// metaInfoCache caches analysis records by external ID.
+type metaInfoCache struct {
+	mu        sync.Mutex
+	records   map[string]cachedAnalysisRecord
+	lastSweep time.Time
+}
+
+func newMetaInfoCache() *metaInfoCache {
+	return &metaInfoCache{
+		records:   map[string]cachedAnalysisRecord{},
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the cached record for the external ID. The second return value
+// is false if there's no unexpired entry for it.
+func (m *metaInfoCache) get(externalID string) (*apps.AnalysisRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cached, ok := m.records[externalID]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(cached.expires) {
+		delete(m.records, externalID)
+		return nil, false
+	}
+
+	return cached.record, true
+}
+
+// set caches the record for the external ID, or its absence if the record is
+// nil. The expired entries are dropped every metaInfoCacheSweepInterval. If
+// the cache is still full, the entry closest to expiring is dropped to make
+// room.
+func (m *metaInfoCache) set(externalID string, record *apps.AnalysisRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(m.lastSweep) >= metaInfoCacheSweepInterval {
+		for id, cached := range m.records {
+			if now.After(cached.expires) {
+				delete(m.records, id)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	if _, ok := m.records[externalID]; !ok && len(m.records) >= metaInfoCacheMaxEntries {
+		var (
+			oldestID string
+			oldest   time.Time
+		)
+		for id, cached := range m.records {
+			if oldestID == "" || cached.expires.Before(oldest) {
+				oldestID, oldest = id, cached.expires
+			}
+		}
+		delete(m.records, oldestID)
+	}
+
+	ttl := metaInfoCacheTTL
+	if record == nil {
+		ttl = metaInfoMissingTTL
+	}
+
+	m.records[externalID] = cachedAnalysisRecord{
+		record:  record,
+		expires: now.Add(ttl),
+	}
+}
+
+// needsBackfill returns true if any of the fields that come from labels are
+// blank.
+func needsBackfill(meta *MetaInfo) bool {
+	return meta.ExternalID != "" && (meta.AnalysisName == "" ||
+		meta.AppName == "" ||
+		meta.AppID == "" ||
+		meta.UserID == "" ||
+		meta.Username == "")
+}
+
+// backfillMetaInfo fills in blank fields in the MetaInfo structs from the
+// analysis records in the database. Older resources may be missing labels or
+// have had them mangled. All of the uncached external IDs are looked up in a
+// single query. Lookup failures are logged rather than returned so that a
+// listing never fails because of them.
+func (i *Internal) backfillMetaInfo(metas []*MetaInfo) {
+	records := map[string]*apps.AnalysisRecord{}
+	missing := []string{}
+	seen := map[string]bool{}
+
+	for _, meta := range metas {
+		if !needsBackfill(meta) || seen[meta.ExternalID] {
+			continue
+		}
+		seen[meta.ExternalID] = true
+
+		if record, ok := i.metaCache.get(meta.ExternalID); ok {
+			records[meta.ExternalID] = record
+		} else {
+			missing = append(missing, meta.ExternalID)
+		}
+	}
+
+	if len(missing) > 0 {
+		a := i.newApps()
+		found, err := a.GetAnalysisRecordsByExternalIDs(context.Background(), missing)
+		if err != nil {
+			log.Errorf("error back-filling listing info: %s", err.Error())
+		} else {
+			for _, externalID := range missing {
+				records[externalID] = found[externalID]
+				i.metaCache.set(externalID, found[externalID])
+			}
+		}
+	}
+
+	for _, meta := range metas {
+		record := records[meta.ExternalID]
+		if record == nil || !needsBackfill(meta) {
+			continue
+		}
+
+		if meta.AnalysisName == "" {
+			meta.AnalysisName = record.AnalysisName
+		}
+		if meta.AppName == "" {
+			meta.AppName = record.AppName
+		}
+		if meta.AppID == "" {
+			meta.AppID = record.AppID
+		}
+		if meta.UserID == "" {
+			meta.UserID = record.UserID
+		}
+		if meta.Username == "" {
+			meta.Username = record.Username
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfillMetaInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+
+	rows := sqlmock.NewRows([]string{
+		"external_id", "analysis_id", "analysis_name", "app_id", "app_name", "user_id", "username",
+	}).AddRow("e1", "a1", "My Analysis", "app1", "JupyterLab", "u1", "test@example.org")
+	mock.ExpectQuery("SELECT s.external_id").WillReturnRows(rows)
+
+	labelled := &MetaInfo{
+		ExternalID:   "e2",
+		AnalysisName: "labelled",
+		AppName:      "app",
+		AppID:        "app2",
+		UserID:       "u2",
+		Username:     "someone",
+	}
+	legacy := &MetaInfo{ExternalID: "e1", AnalysisName: "kept"}
+	duplicate := &MetaInfo{ExternalID: "e1"}
+	unknown := &MetaInfo{ExternalID: "e3"}
+
+	internal.backfillMetaInfo([]*MetaInfo{labelled, legacy, duplicate, unknown})
+
+	assert.Equal("labelled", labelled.AnalysisName)
+	assert.Equal("kept", legacy.AnalysisName)
+	assert.Equal("JupyterLab", legacy.AppName)
+	assert.Equal("app1", legacy.AppID)
+	assert.Equal("u1", legacy.UserID)
+	assert.Equal("test@example.org", legacy.Username)
+	assert.Equal("My Analysis", duplicate.AnalysisName)
+	assert.Equal("", unknown.Username)
+
+	// Both the found and missing records are cached, so no more queries
+	// should be made.
+	again := &MetaInfo{ExternalID: "e1"}
+	internal.backfillMetaInfo([]*MetaInfo{again, {ExternalID: "e3"}})
+	assert.Equal("u1", again.UserID)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMetaInfoCache(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newMetaInfoCache()
+	record := &apps.AnalysisRecord{AnalysisID: "a1"}
+
+	// Records that weren't found expire sooner than ones that were.
+	cache.set("e1", record)
+	cache.set("e2", nil)
+	assert.True(cache.records["e2"].expires.Before(cache.records["e1"].expires))
+
+	// Expired entries are swept out once the interval has passed, even if
+	// they're never read again.
+	cache.records["e2"] = cachedAnalysisRecord{expires: time.Now().Add(-time.Second)}
+	cache.lastSweep = time.Now().Add(-metaInfoCacheSweepInterval)
+	cache.set("e3", record)
+	assert.NotContains(cache.records, "e2")
+
+	// The cache doesn't grow past its limit.
+	for i := 0; i < metaInfoCacheMaxEntries+10; i++ {
+		cache.set(fmt.Sprintf("extra-%d", i), record)
+	}
+	assert.Len(cache.records, metaInfoCacheMaxEntries)
+
+	got, ok := cache.get(fmt.Sprintf("extra-%d", metaInfoCacheMaxEntries+9))
+	assert.True(ok)
+	assert.Equal(record, got)
+}
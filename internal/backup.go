@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// backupVersion is the version of the backup archive format. Archives from a
+// newer version can't be restored.
+const backupVersion = 2
+
+// retiredBackupTables are the tables that archives from before version 2
+// included but that aren't restored anymore, since they belong to the
+// environment they were exported from. They're skipped when restoring those
+// archives.
+var retiredBackupTables = map[string]bool{
+	"vice_subdomains":      true,
+	"vice_hostname_claims": true,
+}
+
+// backupTable is a table holding state app-exposer owns. Columns are the ones
+// carried over to another environment, which leaves out generated IDs, and
+// Key is the unique key that decides which rows a restore replaces.
+type backupTable struct {
+	Name    string
+	Columns []string
+	Key     []string
+}
+
+// backupTables lists the tables included in backups, in the order they're
+// restored, which puts the tables that others refer to first. Subdomains and
+// hostname claims route to analyses in the environment they were made in, so
+// they stay with it, as do the records about individual launches such as
+// states and uptime. Launch templates and schedules are carried over with
+// their IDs so that the schedules still refer to their templates.
+var backupTables = []backupTable{
+	{
+		Name:    "vice_reference_datasets",
+		Columns: []string{"name", "description", "source_type", "source", "mount_path", "created_at", "updated_at"},
+		Key:     []string{"name"},
+	},
+	{
+		Name:    "vice_app_config_templates",
+		Columns: []string{"app_id", "name", "mount_path", "files", "created_at", "updated_at"},
+		Key:     []string{"app_id", "name"},
+	},
+	{
+		Name:    "vice_app_concurrency_limits",
+		Columns: []string{"app_id", "max_running", "updated_at"},
+		Key:     []string{"app_id"},
+	},
+	{
+		Name:    "vice_user_freezes",
+		Columns: []string{"username", "reason", "frozen_at"},
+		Key:     []string{"username"},
+	},
+	{
+		Name:    "vice_launch_templates",
+		Columns: []string{"id", "name", "description", "owner", "request", "shared_with", "created_at", "updated_at"},
+		Key:     []string{"id"},
+	},
+	{
+		Name: "vice_launch_schedules",
+		Columns: []string{
+			"id", "name", "template_id", "owner", "run_at", "cron", "timezone",
+			"duration_minutes", "enabled", "next_run", "last_run", "created_at",
+		},
+		Key: []string{"id"},
+	},
+	{
+		Name:    "vice_scheduled_launches",
+		Columns: []string{"analysis_id", "schedule_id", "username", "launched_at", "teardown_at", "torn_down"},
+		Key:     []string{"analysis_id"},
+	},
+	{
+		Name:    "vice_network_group_members",
+		Columns: []string{"external_id", "username", "group_name", "alias", "added_at"},
+		Key:     []string{"external_id"},
+	},
+	{
+		Name:    "vice_deletion_protections",
+		Columns: []string{"external_id", "protected_by", "reason", "protected_at"},
+		Key:     []string{"external_id"},
+	},
+}
+
+// BackupArchive is the app-exposer state exported from an environment. Each
+// table is a list of rows as JSON objects keyed by column name.
+type BackupArchive struct {
+	Version    int                        `json:"version"`
+	ExportedAt time.Time                  `json:"exportedAt"`
+	Tables     map[string]json.RawMessage `json:"tables"`
+}
+
+// RestoredTable is the outcome of restoring a table. Deleted is the number of
+// rows removed because they weren't in the archive.
+type RestoredTable struct {
+	Table    string `json:"table"`
+	Restored int64  `json:"restored"`
+	Deleted  int64  `json:"deleted"`
+}
+
+// exportSQL returns the query that selects the rows of the table as a JSON
+// array.
+func (b *backupTable) exportSQL() string {
+	return fmt.Sprintf(
+		"SELECT COALESCE(json_agg(t), '[]') FROM (SELECT %s FROM %s ORDER BY %s) t",
+		strings.Join(b.Columns, ", "), b.Name, strings.Join(b.Key, ", "),
+	)
+}
+
+// restoreSQL returns the statement that upserts the rows in a JSON array into
+// the table.
+func (b *backupTable) restoreSQL() string {
+	key := map[string]bool{}
+	for _, column := range b.Key {
+		key[column] = true
+	}
+
+	updates := []string{}
+	for _, column := range b.Columns {
+		if !key[column] {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+		}
+	}
+
+	columns := strings.Join(b.Columns, ", ")
+	return fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM json_populate_recordset(NULL::%s, $1) ON CONFLICT (%s) DO UPDATE SET %s",
+		b.Name, columns, columns, b.Name, strings.Join(b.Key, ", "), strings.Join(updates, ", "),
+	)
+}
+
+// pruneSQL returns the statement that deletes the rows of the table that
+// aren't in a JSON array.
+func (b *backupTable) pruneSQL() string {
+	key := strings.Join(b.Key, ", ")
+	return fmt.Sprintf(
+		"DELETE FROM %s WHERE (%s) NOT IN (SELECT %s FROM json_populate_recordset(NULL::%s, $1))",
+		b.Name, key, key, b.Name,
+	)
+}
+
+// exportBackup returns the current contents of the backed up tables.
+func (i *Internal) exportBackup() (*BackupArchive, error) {
+	archive := &BackupArchive{
+		Version:    backupVersion,
+		ExportedAt: time.Now(),
+		Tables:     map[string]json.RawMessage{},
+	}
+
+	for _, table := range backupTables {
+		var rows []byte
+		if err := i.db.QueryRow(table.exportSQL()).Scan(&rows); err != nil {
+			return nil, errors.Wrapf(err, "error exporting table %s", table.Name)
+		}
+		archive.Tables[table.Name] = json.RawMessage(rows)
+	}
+
+	return archive, nil
+}
+
+// restoreBackup writes the tables in the archive in a single transaction.
+// Rows are added or replaced by key. If prune is true, rows that aren't in the
+// archive are deleted as well, so that the tables match it exactly. Tables
+// left out of the archive aren't touched.
+func (i *Internal) restoreBackup(archive *BackupArchive, prune bool) ([]RestoredTable, error) {
+	if archive.Version < 1 || archive.Version > backupVersion {
+		return nil, echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("backup version %d is not supported; the latest supported version is %d", archive.Version, backupVersion),
+		)
+	}
+
+	known := map[string]bool{}
+	for _, table := range backupTables {
+		known[table.Name] = true
+	}
+	for name := range archive.Tables {
+		if archive.Version < 2 && retiredBackupTables[name] {
+			continue
+		}
+		if !known[name] {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("table %s can't be restored", name))
+		}
+	}
+
+	tx, err := i.db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "error starting the restore")
+	}
+
+	results := []RestoredTable{}
+	for _, table := range backupTables {
+		rows, ok := archive.Tables[table.Name]
+		if !ok {
+			continue
+		}
+
+		result := RestoredTable{Table: table.Name}
+
+		if prune {
+			deleted, err := tx.Exec(table.pruneSQL(), string(rows))
+			if err != nil {
+				tx.Rollback()
+				return nil, errors.Wrapf(err, "error pruning table %s", table.Name)
+			}
+			if result.Deleted, err = deleted.RowsAffected(); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+
+		restored, err := tx.Exec(table.restoreSQL(), string(rows))
+		if err != nil {
+			tx.Rollback()
+			return nil, errors.Wrapf(err, "error restoring table %s", table.Name)
+		}
+		if result.Restored, err = restored.RowsAffected(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "error finishing the restore")
+	}
+
+	return results, nil
+}
+
+// AdminExportBackupHandler returns an archive of the state app-exposer owns,
+// which can be restored in another environment.
+func (i *Internal) AdminExportBackupHandler(c echo.Context) error {
+	archive, err := i.exportBackup()
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("app-exposer-backup-%s.json", archive.ExportedAt.UTC().Format("20060102T150405Z"))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+
+	return c.JSON(http.StatusOK, archive)
+}
+
+// AdminRestoreBackupHandler restores the archive in the body of the request.
+// Setting the prune query parameter to true also deletes the rows that aren't
+// in the archive.
+func (i *Internal) AdminRestoreBackupHandler(c echo.Context) error {
+	prune := c.QueryParam("prune") == "true"
+
+	archive := &BackupArchive{}
+	if err := c.Bind(archive); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	results, err := i.restoreBackup(archive, prune)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("restored a backup exported at %s", archive.ExportedAt.Format(time.RFC3339))
+
+	return c.JSON(http.StatusOK, map[string][]RestoredTable{
+		"tables": results,
+	})
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupTableSQL(t *testing.T) {
+	assert := assert.New(t)
+
+	table := &backupTable{
+		Name:    "vice_app_config_templates",
+		Columns: []string{"app_id", "name", "files"},
+		Key:     []string{"app_id", "name"},
+	}
+
+	assert.Equal(
+		"SELECT COALESCE(json_agg(t), '[]') FROM (SELECT app_id, name, files FROM vice_app_config_templates ORDER BY app_id, name) t",
+		table.exportSQL(),
+	)
+	assert.Equal(
+		"INSERT INTO vice_app_config_templates (app_id, name, files) "+
+			"SELECT app_id, name, files FROM json_populate_recordset(NULL::vice_app_config_templates, $1) "+
+			"ON CONFLICT (app_id, name) DO UPDATE SET files = EXCLUDED.files",
+		table.restoreSQL(),
+	)
+	assert.Equal(
+		"DELETE FROM vice_app_config_templates WHERE (app_id, name) NOT IN "+
+			"(SELECT app_id, name FROM json_populate_recordset(NULL::vice_app_config_templates, $1))",
+		table.pruneSQL(),
+	)
+}
+
+func TestExportBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	for _, table := range backupTables {
+		rows := "[]"
+		if table.Name == "vice_user_freezes" {
+			rows = `[{"username":"alice","reason":"abuse","frozen_at":"2020-01-01T00:00:00Z"}]`
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(table.exportSQL())).
+			WillReturnRows(sqlmock.NewRows([]string{"rows"}).AddRow([]byte(rows)))
+	}
+
+	archive, err := i.exportBackup()
+	assert.NoError(err)
+	assert.Equal(backupVersion, archive.Version)
+	assert.Len(archive.Tables, len(backupTables))
+
+	freezes := []map[string]string{}
+	assert.NoError(json.Unmarshal(archive.Tables["vice_user_freezes"], &freezes))
+	assert.Equal("alice", freezes[0]["username"])
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRestoreBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	rows := `[{"app_id":"app1","max_running":2,"updated_at":"2020-01-01T00:00:00Z"}]`
+	archive := &BackupArchive{
+		Version: backupVersion,
+		Tables:  map[string]json.RawMessage{"vice_app_concurrency_limits": json.RawMessage(rows)},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM vice_app_concurrency_limits").WithArgs(rows).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("INSERT INTO vice_app_concurrency_limits").WithArgs(rows).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	results, err := i.restoreBackup(archive, true)
+	assert.NoError(err)
+	assert.Equal([]RestoredTable{{Table: "vice_app_concurrency_limits", Restored: 1, Deleted: 3}}, results)
+
+	// A failure rolls back the whole restore.
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO vice_app_concurrency_limits").WithArgs(rows).WillReturnError(errors.New("bad row"))
+	mock.ExpectRollback()
+
+	_, err = i.restoreBackup(archive, false)
+	assert.Error(err)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRestoreBackupRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	_, err := i.restoreBackup(&BackupArchive{Version: backupVersion + 1}, false)
+	assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	_, err = i.restoreBackup(&BackupArchive{
+		Version: backupVersion,
+		Tables:  map[string]json.RawMessage{"vice_analysis_states": json.RawMessage("[]")},
+	}, false)
+	assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	// Subdomains stay with the environment they were made in.
+	_, err = i.restoreBackup(&BackupArchive{
+		Version: backupVersion,
+		Tables:  map[string]json.RawMessage{"vice_subdomains": json.RawMessage("[]")},
+	}, false)
+	assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRestoreBackupSkipsRetiredTables(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	// Archives from before subdomains were left out of backups can still be
+	// restored, without their subdomains.
+	archive := &BackupArchive{
+		Version: 1,
+		Tables: map[string]json.RawMessage{
+			"vice_subdomains":      json.RawMessage(`[{"external_id":"e1","subdomain":"notebook"}]`),
+			"vice_hostname_claims": json.RawMessage("[]"),
+			"vice_user_freezes":    json.RawMessage("[]"),
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO vice_user_freezes").WithArgs("[]").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	results, err := i.restoreBackup(archive, false)
+	assert.NoError(err)
+	assert.Equal([]RestoredTable{{Table: "vice_user_freezes"}}, results)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestBackupTablesMatchMigrations(t *testing.T) {
+	assert := assert.New(t)
+
+	migration, err := ioutil.ReadFile("../migrations/000001_vice_tables.up.sql")
+	if !assert.NoError(err) {
+		return
+	}
+
+	for _, table := range backupTables {
+		assert.Contains(string(migration), "CREATE TABLE IF NOT EXISTS "+table.Name+" (", table.Name)
+	}
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// maxBatchArraySize is the largest number of replicas an array job can have.
+const maxBatchArraySize = 1000
+
+// Annotations recording the place of a Job in an array job.
+const (
+	batchArraySizeAnnotation  = "vice.cyverse.org/array-size"
+	batchArrayIndexAnnotation = "vice.cyverse.org/array-index"
+)
+
+// batchArrayIndexEnvVar is the environment variable holding the index of the
+// replica, named the same as in indexed Jobs so that tools work with either.
+const batchArrayIndexEnvVar = "JOB_COMPLETION_INDEX"
+
+// BatchArray describes the replicas of an array job, such as a parameter
+// sweep. Each replica is a Job of its own, so that it can be given different
+// arguments. The placeholder {{index}} in the tool's arguments and
+// environment is replaced with the index of the replica, and {{name}} with the
+// value of the name parameter for it.
+type BatchArray struct {
+	// Count is the number of replicas. It defaults to the number of
+	// parameter sets.
+	Count int `json:"count"`
+
+	// Parameters are the values substituted for each replica, by index.
+	Parameters []map[string]string `json:"parameters"`
+}
+
+// size returns the number of replicas.
+func (a *BatchArray) size() int {
+	if a.Count > 0 {
+		return a.Count
+	}
+	return len(a.Parameters)
+}
+
+// validate makes sure the array has a sensible number of replicas, and a set
+// of parameters for each of them if it has any.
+func (a *BatchArray) validate() error {
+	size := a.size()
+	if size < 1 || size > maxBatchArraySize {
+		return fmt.Errorf("array jobs need between 1 and %d replicas", maxBatchArraySize)
+	}
+	if len(a.Parameters) > 0 && len(a.Parameters) != size {
+		return fmt.Errorf("array job has %d replicas but %d sets of parameters", size, len(a.Parameters))
+	}
+	return nil
+}
+
+// replacer returns the replacer that fills in the placeholders for the replica
+// at the index.
+func (a *BatchArray) replacer(index int) *strings.Replacer {
+	pairs := []string{"{{index}}", strconv.Itoa(index)}
+	if len(a.Parameters) > index {
+		for name, value := range a.Parameters[index] {
+			pairs = append(pairs, fmt.Sprintf("{{%s}}", name), value)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// batchReplicaName returns the name of the Job for the replica at the index.
+func batchReplicaName(job *model.Job, index int) string {
+	return fmt.Sprintf("%s-%d", job.InvocationID, index)
+}
+
+// getBatchJobs assembles the Jobs for the batch analysis: one Job, or one for
+// each replica of an array job. It does not call the k8s API.
+func (i *Internal) getBatchJobs(job *model.Job, backoffLimit int32, array *BatchArray) ([]*batchv1.Job, error) {
+	base, err := i.getBatchJob(job, backoffLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	if array == nil {
+		return []*batchv1.Job{base}, nil
+	}
+
+	size := array.size()
+	replicas := []*batchv1.Job{}
+	for index := 0; index < size; index++ {
+		replica := base.DeepCopy()
+		replica.Name = batchReplicaName(job, index)
+
+		for _, meta := range []*metav1.ObjectMeta{&replica.ObjectMeta, &replica.Spec.Template.ObjectMeta} {
+			meta.Annotations[batchArraySizeAnnotation] = strconv.Itoa(size)
+			meta.Annotations[batchArrayIndexAnnotation] = strconv.Itoa(index)
+		}
+
+		replacer := array.replacer(index)
+		container := &replica.Spec.Template.Spec.Containers[0]
+		for idx := range container.Command {
+			container.Command[idx] = replacer.Replace(container.Command[idx])
+		}
+		for idx := range container.Args {
+			container.Args[idx] = replacer.Replace(container.Args[idx])
+		}
+		for idx := range container.Env {
+			container.Env[idx].Value = replacer.Replace(container.Env[idx].Value)
+		}
+		container.Env = append(container.Env, apiv1.EnvVar{
+			Name:  batchArrayIndexEnvVar,
+			Value: strconv.Itoa(index),
+		})
+
+		replicas = append(replicas, replica)
+	}
+
+	return replicas, nil
+}
+
+// batchJobSummary counts the Jobs of a batch analysis in each state.
+type batchJobSummary struct {
+	size      int
+	active    int
+	succeeded int
+	failed    int
+	failures  []string
+}
+
+// finished returns true if every Job of the analysis has succeeded or failed.
+func (s *batchJobSummary) finished() bool {
+	return s.succeeded+s.failed >= s.size
+}
+
+// message describes the progress of the analysis.
+func (s *batchJobSummary) message(analysisName string) string {
+	if s.size == 1 {
+		msg := fmt.Sprintf("job for analysis %s summary: \n active: %d succeeded: %d failed: %d", analysisName, s.active, s.succeeded, s.failed)
+		if len(s.failures) > 0 {
+			msg = fmt.Sprintf("%s\n %s", msg, s.failures[0])
+		}
+		return msg
+	}
+
+	msg := fmt.Sprintf(
+		"array job for analysis %s summary: \n replicas: %d active: %d succeeded: %d failed: %d",
+		analysisName,
+		s.size,
+		s.active,
+		s.succeeded,
+		s.failed,
+	)
+	if len(s.failures) > 0 {
+		msg = fmt.Sprintf("%s\n %s", msg, strings.Join(s.failures, "\n "))
+	}
+	return msg
+}
+
+// analysisBatchJobs lists the Jobs of the batch analysis.
+func (i *Internal) analysisBatchJobs(externalID string) ([]batchv1.Job, error) {
+	set := labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID}))
+	joblist, err := i.clientset.BatchV1().Jobs(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the jobs for analysis %s", externalID)
+	}
+	return joblist.Items, nil
+}
+
+// summarizeBatchJobs counts the Jobs of the batch analysis in each state. The
+// Job that changed is counted as it is in the event, since the listing might
+// not have caught up with it yet.
+func (i *Internal) summarizeBatchJobs(changed *batchv1.Job, externalID string) (*batchJobSummary, error) {
+	items, err := i.analysisBatchJobs(externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := map[string]*batchv1.Job{changed.Name: changed}
+	for idx := range items {
+		if items[idx].Name != changed.Name {
+			jobs[items[idx].Name] = &items[idx]
+		}
+	}
+
+	names := []string{}
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	summary := &batchJobSummary{size: len(jobs)}
+	for _, name := range names {
+		batchJob := jobs[name]
+
+		if size, err := strconv.Atoi(batchJob.Annotations[batchArraySizeAnnotation]); err == nil && size > summary.size {
+			summary.size = size
+		}
+
+		if condition := batchJobCondition(batchJob, batchv1.JobFailed); condition != nil {
+			summary.failed++
+			summary.failures = append(summary.failures, fmt.Sprintf("job %s failed: %s %s", name, condition.Reason, condition.Message))
+		} else if batchJobCondition(batchJob, batchv1.JobComplete) != nil {
+			summary.succeeded++
+		} else if batchJob.Status.Active > 0 {
+			summary.active++
+		}
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,517 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaultBatchBackoffLimit is the number of times the pod of a batch job is
+// retried when the launch request doesn't say. Like the Condor jobs they
+// replace, batch jobs aren't retried by default.
+const defaultBatchBackoffLimit = 0
+
+// BatchLaunchRequest is the request to run a non-interactive job as a
+// Kubernetes Job.
+type BatchLaunchRequest struct {
+	LaunchRequest
+
+	// BackoffLimit is the number of times the job's pod is retried after it
+	// fails.
+	BackoffLimit *int32 `json:"backoff_limit"`
+
+	// Array turns the job into an array job with a replica for each index.
+	Array *BatchArray `json:"array"`
+}
+
+// backoffLimit returns the backoff limit for the Job.
+func (r *BatchLaunchRequest) backoffLimit() int32 {
+	if r.BackoffLimit == nil {
+		return defaultBatchBackoffLimit
+	}
+	return *r.BackoffLimit
+}
+
+// replicas returns the number of Jobs the request runs.
+func (r *BatchLaunchRequest) replicas() int {
+	if r.Array == nil {
+		return 1
+	}
+	return r.Array.size()
+}
+
+// validateBatchLaunch checks the parts of the request that only apply to batch
+// jobs. Batch jobs write their outputs straight to the data store through the
+// CSI driver, since nothing is left running to upload them afterwards.
+func (i *Internal) validateBatchLaunch(request *BatchLaunchRequest) error {
+	job := &request.Job
+
+	if len(job.Steps) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the job has no steps")
+	}
+	if job.Steps[0].Component.IsInteractive {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("analysis %s is interactive and has to be launched as a VICE analysis", job.Name))
+	}
+	if len(auxiliarySteps(job)) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "batch jobs can't have auxiliary containers")
+	}
+	if !i.UseCSIDriver {
+		return echo.NewHTTPError(http.StatusBadRequest, "batch jobs need the CSI driver to save their outputs")
+	}
+	if request.BackoffLimit != nil && *request.BackoffLimit < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "backoff_limit can't be negative")
+	}
+	if request.Array != nil {
+		if err := request.Array.validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// jobDeleteOptions returns the options for deleting a Job. Its pods are
+// deleted along with it, since the API leaves them behind by default.
+func jobDeleteOptions() *metav1.DeleteOptions {
+	propagation := metav1.DeletePropagationBackground
+	return &metav1.DeleteOptions{PropagationPolicy: &propagation}
+}
+
+// activeDeadlineSeconds returns the time limit of the job's tool, or nil if
+// it doesn't have one.
+func activeDeadlineSeconds(job *model.Job) *int64 {
+	if job.Steps[0].Component.TimeLimit <= 0 {
+		return nil
+	}
+	return int64Ptr(int64(job.Steps[0].Component.TimeLimit))
+}
+
+// batchContainer returns the container that runs the job's tool. It's the
+// analysis container without the ports, since nothing connects to it.
+func (i *Internal) batchContainer(job *model.Job) apiv1.Container {
+	container := i.defineAnalysisContainer(job)
+	container.Ports = nil
+	container.ReadinessProbe = nil
+	return container
+}
+
+// getBatchJob assembles the Job for the batch analysis. It has the same
+// labels, volumes, and placement as a VICE analysis, but is labeled as a
+// batch job and runs the tool until it exits. It does not call the k8s API.
+func (i *Internal) getBatchJob(job *model.Job, backoffLimit int32) (*batchv1.Job, error) {
+	labels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+	i.labelKeys.set(labels, "app-type", "batch")
+
+	autoMount := false
+
+	batchJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        job.InvocationID,
+			Labels:      labels,
+			Annotations: i.annotationsFromJob(job),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          int32Ptr(backoffLimit),
+			ActiveDeadlineSeconds: activeDeadlineSeconds(job),
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: i.annotationsFromJob(job),
+				},
+				Spec: apiv1.PodSpec{
+					RestartPolicy:                apiv1.RestartPolicyNever,
+					Volumes:                      i.deploymentVolumes(job),
+					InitContainers:               i.initContainers(job),
+					Containers:                   []apiv1.Container{i.batchContainer(job)},
+					AutomountServiceAccountToken: &autoMount,
+					ImagePullSecrets:             i.imagePullSecrets(job),
+					SecurityContext: &apiv1.PodSecurityContext{
+						RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+						RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+						FSGroup:    int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+					},
+					Tolerations: i.analysisTolerations(job),
+					Affinity:    i.analysisAffinity(job),
+				},
+			},
+		},
+	}
+
+	spec := &batchJob.Spec.Template.Spec
+
+	datasets, err := i.addReferenceData(job, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = i.addConfigTemplates(job, spec); err != nil {
+		return nil, err
+	}
+
+	appInitContainers, err := i.appInitContainers(job)
+	if err != nil {
+		return nil, err
+	}
+	spec.InitContainers = append(spec.InitContainers, appInitContainers...)
+
+	if err = i.applyZones(job, spec, datasets); err != nil {
+		return nil, err
+	}
+	spec.PriorityClassName = i.analysisPriorityClass(job)
+	i.hardenPodTemplate(job, &batchJob.Spec.Template)
+
+	return batchJob, nil
+}
+
+// UpsertBatchJob assembles the Jobs for the batch analysis and applies them
+// along with its data mount. Without server-side apply, existing Jobs are left
+// alone, since their pod templates can't be changed.
+func (i *Internal) UpsertBatchJob(job *model.Job, backoffLimit int32, array *BatchArray) error {
+	batchJobs, err := i.getBatchJobs(job, backoffLimit, array)
+	if err != nil {
+		return err
+	}
+
+	if err = i.upsertAnalysisVolumes(job); err != nil {
+		return err
+	}
+
+	for _, batchJob := range batchJobs {
+		err = i.applyObject(i.ViceNamespace, batchJob, func() error {
+			jobclient := i.clientset.BatchV1().Jobs(i.ViceNamespace)
+			_, err := jobclient.Get(batchJob.Name, metav1.GetOptions{})
+			if err != nil {
+				_, err = jobclient.Create(batchJob)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// provisionBatchJob creates the k8s resources for the batch analysis. If a
+// step fails, the resources created by the earlier steps are removed again.
+func (i *Internal) provisionBatchJob(ctx context.Context, request *BatchLaunchRequest) error {
+	var err error
+
+	job := &request.Job
+
+	i.transitionAndLog(job.InvocationID, ProvisioningState, fmt.Sprintf("creating resources for batch analysis %s", job.Name))
+
+	existing, err := i.analysisResources(job.InvocationID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "unable to list the existing resources for analysis %s; it won't be rolled back if the launch fails", job.InvocationID))
+	}
+
+	if err = provisionStep(ctx, "UpsertExcludesConfigMap", func() error { return i.UpsertExcludesConfigMap(job) }); err != nil {
+		return i.failLaunch(job, existing, "create the excludes file", err)
+	}
+
+	if err = provisionStep(ctx, "UpsertInputPathListConfigMap", func() error { return i.UpsertInputPathListConfigMap(job) }); err != nil {
+		return i.failLaunch(job, existing, "create the input path list", err)
+	}
+
+	if err = provisionStep(ctx, "UpsertConfigTemplateConfigMaps", func() error { return i.UpsertConfigTemplateConfigMaps(job) }); err != nil {
+		return i.failLaunch(job, existing, "render the config templates", err)
+	}
+
+	if err = provisionStep(ctx, "UpsertBatchJob", func() error { return i.UpsertBatchJob(job, request.backoffLimit(), request.Array) }); err != nil {
+		return i.failLaunch(job, existing, "create the job", err)
+	}
+
+	i.recordUsageStart(job, request.replicas())
+
+	return nil
+}
+
+// BatchLaunchHandler is the HTTP handler that launches a non-interactive
+// analysis as a Kubernetes Job, or as a Job for each replica of an array job.
+// The Job is passed in as the body of the request, along with its backoff
+// limit and array settings. Batch jobs aren't held in the launch
+// queue; they wait for room in the cluster like any other Job.
+func (i *Internal) BatchLaunchHandler(c echo.Context) error {
+	request := &BatchLaunchRequest{}
+
+	if err := c.Bind(request); err != nil {
+		return err
+	}
+
+	if err := i.validateBatchLaunch(request); err != nil {
+		return err
+	}
+
+	job := &request.Job
+
+	begun, err := i.launching.begin(job.InvocationID)
+	if err != nil {
+		return err
+	}
+	if !begun {
+		return (&ExistingLaunch{ExternalID: job.InvocationID}).respond(c)
+	}
+
+	inBackground := false
+	defer func() {
+		if !inBackground {
+			i.launching.end(job.InvocationID)
+		}
+	}()
+
+	existing, err := i.existingLaunch(job.InvocationID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		log.Infof("launch of batch analysis %s was already requested", job.InvocationID)
+		return existing.respond(c)
+	}
+
+	referenceData, err := i.checkLaunch(c.Request().Context(), &request.LaunchRequest, request.replicas())
+	if err != nil {
+		return err
+	}
+
+	if err = i.recordReferenceData(job.InvocationID, referenceData); err != nil {
+		return err
+	}
+
+	i.transitionAndLog(job.InvocationID, RequestedState, fmt.Sprintf("launch requested for batch analysis %s", job.Name))
+
+	if i.AsyncLaunches {
+		inBackground = true
+		i.provisionInBackground(job.InvocationID, func(ctx context.Context) error {
+			return i.provisionBatchJob(ctx, request)
+		})
+		return c.JSON(http.StatusAccepted, launchAccepted(job.InvocationID, nil))
+	}
+
+	return i.provisionBatchJob(c.Request().Context(), request)
+}
+
+// batchJobCondition returns the condition of the given type if it's true for
+// the Job.
+func batchJobCondition(batchJob *batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for idx := range batchJob.Status.Conditions {
+		condition := &batchJob.Status.Conditions[idx]
+		if condition.Type == conditionType && condition.Status == apiv1.ConditionTrue {
+			return condition
+		}
+	}
+	return nil
+}
+
+// batchJobFinished returns true if the Job has succeeded or failed.
+func batchJobFinished(batchJob *batchv1.Job) bool {
+	return batchJobCondition(batchJob, batchv1.JobComplete) != nil || batchJobCondition(batchJob, batchv1.JobFailed) != nil
+}
+
+// runningBatchJobs lists the Jobs of the user's batch analyses that haven't
+// finished. The username is the label value for the user.
+func (i *Internal) runningBatchJobs(username string) ([]batchv1.Job, error) {
+	set := labels.Set(i.labelKeys.selector(map[string]string{
+		"username": username,
+		"app-type": "batch",
+	}))
+	joblist, err := i.clientset.BatchV1().Jobs(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the batch jobs of %s", username)
+	}
+
+	running := []batchv1.Job{}
+	for idx := range joblist.Items {
+		if !batchJobFinished(&joblist.Items[idx]) {
+			running = append(running, joblist.Items[idx])
+		}
+	}
+	return running, nil
+}
+
+// eventBatchJobModified moves the batch analysis along as its Jobs run. The
+// Jobs of an array job are reported on together. Once all of them have
+// finished, the resources for the analysis are removed; it's failed if any of
+// them failed, and marked as completed once the Jobs are deleted otherwise.
+func (i *Internal) eventBatchJobModified(batchJob *batchv1.Job, jobID string) error {
+	if batchJob.DeletionTimestamp != nil {
+		return nil
+	}
+
+	analysisName := i.labelKeys.get(batchJob.Labels, "analysis-name")
+
+	// Finished jobs have already been dealt with, or are being dealt with.
+	state, err := i.currentState(jobID, ProvisioningState)
+	if err != nil {
+		return err
+	}
+	if state.IsTerminal() || state == TerminatingState {
+		return nil
+	}
+
+	summary, err := i.summarizeBatchJobs(batchJob, jobID)
+	if err != nil {
+		return err
+	}
+
+	if summary.finished() {
+		state = TerminatingState
+		if summary.failed > 0 {
+			state = FailedState
+		}
+		err = i.transition(jobID, state, summary.message(analysisName))
+		go i.cleanUpBatchJob(jobID)
+		return err
+	}
+
+	if summary.active > 0 && state == ProvisioningState {
+		state = RunningState
+	}
+
+	return i.transition(jobID, state, summary.message(analysisName))
+}
+
+// cleanUpBatchJob removes the resources of a batch analysis that has stopped.
+func (i *Internal) cleanUpBatchJob(jobID string) {
+	if err := i.doExit(jobID); err != nil {
+		log.Error(errors.Wrapf(err, "error removing the resources for batch analysis %s", jobID))
+	}
+}
+
+// MonitorBatchJobs fires up a goroutine that forwards the progress of batch
+// analyses to the status receiving service, the same way MonitorVICEEvents
+// does for VICE analyses.
+func (i *Internal) MonitorBatchJobs() {
+	go func(clientset kubernetes.Interface) {
+		for {
+			log.Debug("beginning to monitor k8s jobs")
+			set := labels.Set(i.labelKeys.selector(map[string]string{
+				"app-type": "batch",
+			}))
+			factory := informers.NewSharedInformerFactoryWithOptions(
+				clientset,
+				0,
+				informers.WithNamespace(i.ViceNamespace),
+				informers.WithTweakListOptions(func(listoptions *metav1.ListOptions) {
+					listoptions.LabelSelector = set.AsSelector().String()
+				}),
+			)
+
+			jobInformer := factory.Batch().V1().Jobs().Informer()
+			jobInformerStop := make(chan struct{})
+			defer close(jobInformerStop)
+
+			jobInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc: func(obj interface{}) {
+					batchJob, ok := obj.(*batchv1.Job)
+					if !ok {
+						log.Error(errors.New("unexpected type job object"))
+						return
+					}
+
+					jobID := i.labelKeys.get(batchJob.Labels, "external-id")
+					if jobID == "" {
+						log.Error(errors.New("job is missing external-id label"))
+						return
+					}
+
+					log.Infof("processing job addition for job %s", jobID)
+
+					// The informer replays existing jobs when it starts up, so jobs
+					// that have already finished are handled like any other change.
+					state, err := i.currentState(jobID, ProvisioningState)
+					if err != nil {
+						log.Error(err)
+						return
+					}
+
+					if state == RequestedState {
+						if err = i.transition(
+							jobID,
+							ProvisioningState,
+							fmt.Sprintf("job %s has started for analysis %s", batchJob.Name, i.labelKeys.get(batchJob.Labels, "analysis-name")),
+						); err != nil {
+							log.Error(err)
+						}
+					}
+
+					if err = i.eventBatchJobModified(batchJob, jobID); err != nil {
+						log.Error(err)
+					}
+				},
+
+				DeleteFunc: func(obj interface{}) {
+					jobObj, ok := obj.(metav1.Object)
+					if !ok {
+						log.Error(errors.New("unexpected type job object"))
+						return
+					}
+
+					jobID := i.labelKeys.get(jobObj.GetLabels(), "external-id")
+					if jobID == "" {
+						log.Error(errors.New("job is missing external-id label"))
+						return
+					}
+
+					log.Infof("processing job deletion for job %s", jobID)
+
+					// The analysis isn't done until all of its jobs are gone.
+					remaining, err := i.analysisBatchJobs(jobID)
+					if err != nil {
+						log.Error(err)
+						return
+					}
+					if len(remaining) > 0 {
+						return
+					}
+
+					if err = i.markTerminated(
+						jobID,
+						fmt.Sprintf("job %s has been deleted for analysis %s", jobObj.GetName(), i.labelKeys.get(jobObj.GetLabels(), "analysis-name")),
+					); err != nil {
+						log.Error(err)
+					}
+				},
+
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					batchJob, ok := newObj.(*batchv1.Job)
+					if !ok {
+						log.Error(errors.New("unexpected type job object"))
+						return
+					}
+
+					jobID := i.labelKeys.get(batchJob.Labels, "external-id")
+					if jobID == "" {
+						log.Error(errors.New("job is missing external-id label"))
+						return
+					}
+
+					log.Infof("processing job change for job %s", jobID)
+
+					if err := i.eventBatchJobModified(batchJob, jobID); err != nil {
+						log.Error(err)
+					}
+				},
+			})
+
+			jobInformer.Run(jobInformerStop)
+		}
+	}(i.clientset)
+}
@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// batchJob returns a job for a tool that doesn't listen on any ports.
+func batchJob() *model.Job {
+	job := multiPortJob()
+	job.Name = "blast"
+	job.Submitter = "alice"
+	job.ExecutionTarget = "interapps"
+	job.Steps[0].Component.TimeLimit = 3600
+	return job
+}
+
+func TestValidateBatchLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, nil)
+	i.UseCSIDriver = true
+
+	interactive := batchJob()
+	interactive.Steps[0].Component.IsInteractive = true
+
+	negative := int32(-1)
+
+	for _, request := range []*BatchLaunchRequest{
+		{LaunchRequest: LaunchRequest{Job: model.Job{InvocationID: "e1"}}},
+		{LaunchRequest: LaunchRequest{Job: *interactive}},
+		{LaunchRequest: LaunchRequest{Job: *auxiliaryJob(5432)}},
+		{LaunchRequest: LaunchRequest{Job: *batchJob()}, BackoffLimit: &negative},
+	} {
+		err := i.validateBatchLaunch(request)
+		if assert.IsType(&echo.HTTPError{}, err) {
+			assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+		}
+	}
+
+	request := &BatchLaunchRequest{LaunchRequest: LaunchRequest{Job: *batchJob()}}
+	assert.NoError(i.validateBatchLaunch(request))
+	assert.Equal(int32(0), request.backoffLimit())
+
+	// Without the CSI driver, there'd be nothing to save the outputs.
+	i.UseCSIDriver = false
+	assert.Error(i.validateBatchLaunch(request))
+}
+
+func TestGetBatchJob(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	i.UseCSIDriver = true
+	mock.MatchExpectationsInOrder(false)
+	registerUserIPQuery(mock, "10.0.0.1")
+	registerSubdomainQuery(mock, "e1", "")
+	mock.ExpectQuery("JOIN vice_analysis_reference_data").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(referenceDatasetRowColumns))
+
+	job := batchJob()
+	batchJob, err := i.getBatchJob(job, 2)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal("e1", batchJob.Name)
+	assert.Equal("batch", i.labelKeys.get(batchJob.Labels, "app-type"))
+	assert.Equal("batch", i.labelKeys.get(batchJob.Spec.Template.Labels, "app-type"))
+	assert.Equal(int32(2), *batchJob.Spec.BackoffLimit)
+	assert.Equal(int64(3600), *batchJob.Spec.ActiveDeadlineSeconds)
+
+	spec := batchJob.Spec.Template.Spec
+	assert.Equal(apiv1.RestartPolicyNever, spec.RestartPolicy)
+	if assert.Len(spec.Containers, 1) {
+		assert.Equal(analysisContainerName, spec.Containers[0].Name)
+		assert.Empty(spec.Containers[0].Ports)
+		assert.Nil(spec.Containers[0].ReadinessProbe)
+	}
+	assert.NotEmpty(spec.Tolerations)
+
+	// Tools without a time limit run until they're done.
+	job.Steps[0].Component.TimeLimit = 0
+	assert.Nil(activeDeadlineSeconds(job))
+}
+
+func TestBatchJobCondition(t *testing.T) {
+	assert := assert.New(t)
+
+	batchJob := &batchv1.Job{
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobComplete, Status: apiv1.ConditionFalse},
+				{Type: batchv1.JobFailed, Status: apiv1.ConditionTrue, Reason: "DeadlineExceeded"},
+			},
+		},
+	}
+
+	assert.Nil(batchJobCondition(batchJob, batchv1.JobComplete))
+	if condition := batchJobCondition(batchJob, batchv1.JobFailed); assert.NotNil(condition) {
+		assert.Equal("DeadlineExceeded", condition.Reason)
+	}
+}
+
+func TestEventBatchJobModified(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+
+	batchJob := &batchv1.Job{Status: batchv1.JobStatus{Active: 1}}
+	batchJob.Name = "e1"
+
+	// A running pod moves a provisioning analysis along.
+	provisioning := ProvisioningState
+	registerStateQuery(mock, "e1", &provisioning)
+	registerStateQuery(mock, "e1", &provisioning)
+	mock.ExpectExec("INSERT INTO vice_analysis_states").
+		WithArgs("e1", "Running").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO vice_analysis_uptime").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(i.eventBatchJobModified(batchJob, "e1"))
+
+	// Jobs that are already being cleaned up are left alone.
+	batchJob.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: apiv1.ConditionTrue}}
+	terminating := TerminatingState
+	registerStateQuery(mock, "e1", &terminating)
+	assert.NoError(i.eventBatchJobModified(batchJob, "e1"))
+
+	assert.Equal([]string{"Running"}, publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestBatchArrayValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&BatchArray{Count: 3}).validate())
+	assert.NoError((&BatchArray{Parameters: []map[string]string{{"n": "1"}, {"n": "2"}}}).validate())
+	assert.Error((&BatchArray{}).validate())
+	assert.Error((&BatchArray{Count: maxBatchArraySize + 1}).validate())
+	assert.Error((&BatchArray{Count: 3, Parameters: []map[string]string{{"n": "1"}}}).validate())
+}
+
+func TestGetBatchJobsArray(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	i.UseCSIDriver = true
+	mock.MatchExpectationsInOrder(false)
+	registerUserIPQuery(mock, "10.0.0.1")
+	registerSubdomainQuery(mock, "e1", "")
+	mock.ExpectQuery("JOIN vice_analysis_reference_data").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(referenceDatasetRowColumns))
+
+	job := batchJob()
+	job.Steps[0].Component.Container.EntryPoint = "sweep"
+	job.Steps[0].Environment = map[string]string{"SEED": "seed-{{index}}"}
+
+	array := &BatchArray{Parameters: []map[string]string{{"alpha": "0.1"}, {"alpha": "0.5"}}}
+	replicas, err := i.getBatchJobs(job, 0, array)
+	if !assert.NoError(err) || !assert.Len(replicas, 2) {
+		return
+	}
+
+	for index, replica := range replicas {
+		assert.Equal(batchReplicaName(job, index), replica.Name)
+		assert.Equal("e1", i.labelKeys.get(replica.Labels, "external-id"))
+		assert.Equal("2", replica.Annotations[batchArraySizeAnnotation])
+		assert.Equal(strconv.Itoa(index), replica.Spec.Template.Annotations[batchArrayIndexAnnotation])
+
+		env := map[string]string{}
+		for _, v := range replica.Spec.Template.Spec.Containers[0].Env {
+			env[v.Name] = v.Value
+		}
+		assert.Equal(strconv.Itoa(index), env[batchArrayIndexEnvVar])
+		assert.Equal("seed-"+strconv.Itoa(index), env["SEED"])
+	}
+
+	// Parameters are substituted into each replica's own arguments.
+	assert.Equal("0.1", array.replacer(0).Replace("{{alpha}}"))
+	assert.Equal("0.5 1", array.replacer(1).Replace("{{alpha}} {{index}}"))
+	assert.Equal("{{beta}}", array.replacer(1).Replace("{{beta}}"))
+
+	// Jobs that aren't arrays are a single Job named after the analysis.
+	registerUserIPQuery(mock, "10.0.0.1")
+	registerSubdomainQuery(mock, "e1", "")
+	mock.ExpectQuery("JOIN vice_analysis_reference_data").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(referenceDatasetRowColumns))
+	single, err := i.getBatchJobs(job, 0, nil)
+	if assert.NoError(err) && assert.Len(single, 1) {
+		assert.Equal("e1", single[0].Name)
+		assert.Empty(single[0].Annotations[batchArraySizeAnnotation])
+	}
+}
+
+func TestSummarizeBatchJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	replica := func(index int, status batchv1.JobStatus) *batchv1.Job {
+		batchJob := &batchv1.Job{Status: status}
+		batchJob.Name = "e1-" + strconv.Itoa(index)
+		batchJob.Namespace = "vice-apps"
+		batchJob.Labels = map[string]string{"external-id": "e1"}
+		batchJob.Annotations = map[string]string{batchArraySizeAnnotation: "3"}
+		return batchJob
+	}
+
+	failed := batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+		{Type: batchv1.JobFailed, Status: apiv1.ConditionTrue, Reason: "BackoffLimitExceeded"},
+	}}
+	complete := batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+		{Type: batchv1.JobComplete, Status: apiv1.ConditionTrue},
+	}}
+
+	i, _ := setupInternal(t, []runtime.Object{
+		replica(0, failed),
+		replica(1, batchv1.JobStatus{Active: 1}),
+	})
+
+	// The third replica hasn't shown up in the listing yet.
+	summary, err := i.summarizeBatchJobs(replica(1, complete), "e1")
+	if assert.NoError(err) {
+		assert.Equal(3, summary.size)
+		assert.Equal(0, summary.active)
+		assert.Equal(1, summary.succeeded)
+		assert.Equal(1, summary.failed)
+		assert.False(summary.finished())
+		assert.Contains(summary.message("sweep"), "replicas: 3 active: 0 succeeded: 1 failed: 1")
+		assert.Contains(summary.message("sweep"), "job e1-0 failed: BackoffLimitExceeded")
+	}
+
+	// It's done once the last of them finishes.
+	_, err = i.clientset.BatchV1().Jobs("vice-apps").Create(replica(2, complete))
+	assert.NoError(err)
+	summary, err = i.summarizeBatchJobs(replica(1, complete), "e1")
+	if assert.NoError(err) {
+		assert.True(summary.finished())
+		assert.Equal(2, summary.succeeded)
+	}
+}
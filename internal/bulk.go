@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// BulkOperationResult is the outcome of a bulk operation for a single
+// analysis.
+type BulkOperationResult struct {
+	ExternalID string `json:"externalID"`
+	AnalysisID string `json:"analysisID,omitempty"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	TimeLimit  string `json:"timeLimit,omitempty"`
+}
+
+// userExternalIDs returns the external IDs of the running VICE analyses that
+// belong to the user.
+func (i *Internal) userExternalIDs(ctx context.Context, user string) ([]string, error) {
+	fixedUser := i.fixUsername(user)
+
+	a := i.newApps()
+	userID, err := a.GetUserID(ctx, fixedUser)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", fixedUser))
+		}
+		return nil, errors.Wrapf(err, "error looking up the user ID for %s", fixedUser)
+	}
+
+	return i.filterExternalIDs(map[string]string{"user-id": userID})
+}
+
+// filterExternalIDs returns the external IDs of the running VICE analyses
+// whose labels match the filter.
+func (i *Internal) filterExternalIDs(filter map[string]string) ([]string, error) {
+	deployments, err := i.deploymentList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	externalIDs := []string{}
+	for _, deployment := range deployments.Items {
+		if externalID := i.labelKeys.get(deployment.Labels, "external-id"); externalID != "" {
+			externalIDs = append(externalIDs, externalID)
+		}
+	}
+
+	return externalIDs, nil
+}
+
+// doForAllUserAnalyses runs the operation on each of the user's analyses and
+// returns the per-analysis results. A failure for one analysis doesn't stop
+// the operation from being tried on the rest.
+func (i *Internal) doForAllUserAnalyses(ctx context.Context, user string, op func(result *BulkOperationResult) error) ([]*BulkOperationResult, error) {
+	externalIDs, err := i.userExternalIDs(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.doForAnalyses(ctx, externalIDs, op), nil
+}
+
+// doForAnalyses runs the operation on each of the analyses and returns the
+// per-analysis results. A failure for one analysis doesn't stop the operation
+// from being tried on the rest.
+func (i *Internal) doForAnalyses(ctx context.Context, externalIDs []string, op func(result *BulkOperationResult) error) []*BulkOperationResult {
+	a := i.newApps()
+	results := []*BulkOperationResult{}
+
+	analysisIDs, err := a.GetAnalysisIDsByExternalIDs(ctx, externalIDs)
+	if err != nil {
+		log.Error(errors.Wrap(err, "error getting the analysis IDs"))
+		analysisIDs = map[string]string{}
+	}
+
+	for _, externalID := range externalIDs {
+		result := &BulkOperationResult{ExternalID: externalID}
+
+		analysisID, ok := analysisIDs[externalID]
+		if !ok && err == nil {
+			log.Errorf("analysis ID for %s not found", externalID)
+		}
+		result.AnalysisID = analysisID
+
+		if err := op(result); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Success = true
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// TerminateAllHandler shuts down all of the VICE analyses belonging to the user
+// in the 'user' query parameter. Outputs aren't saved first, just like with
+// ExitHandler, and analyses protected from deletion are skipped unless the
+// force query parameter is true.
+func (i *Internal) TerminateAllHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	results, err := i.doForAllUserAnalyses(c.Request().Context(), user, func(result *BulkOperationResult) error {
+		if err := i.checkDeletionProtection(c, result.ExternalID); err != nil {
+			return err
+		}
+		return i.doExit(result.ExternalID)
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"results": results,
+	})
+}
+
+// ExtendAllHandler extends the time limits of all of the VICE analyses
+// belonging to the user in the 'user' query parameter.
+func (i *Internal) ExtendAllHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	results, err := i.doForAllUserAnalyses(c.Request().Context(), user, func(result *BulkOperationResult) error {
+		if result.AnalysisID == "" {
+			return fmt.Errorf("no analysis ID found for %s", result.ExternalID)
+		}
+
+		outputMap, err := i.updateTimeLimit(user, result.AnalysisID)
+		if err != nil {
+			return err
+		}
+
+		result.TimeLimit = outputMap["time_limit"]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"results": results,
+	})
+}
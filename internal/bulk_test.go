@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/apps/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// userDeployment creates a fake VICE analysis Deployment owned by the user.
+func userDeployment(userID, externalID string) *v1.Deployment {
+	return &v1.Deployment{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace: testConfig.ViceNamespace,
+			Name:      externalID,
+			Labels: map[string]string{
+				"app-type":    "interactive",
+				"user-id":     userID,
+				"external-id": externalID,
+			},
+		},
+	}
+}
+
+func TestDoForAllUserAnalyses(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, []runtime.Object{
+		userDeployment("u1", "e1"),
+		userDeployment("u1", "e2"),
+		userDeployment("u2", "e3"),
+	})
+
+	mock.ExpectQuery("SELECT u.id FROM users u").
+		WithArgs("test" + testConfig.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	mock.ExpectQuery("SELECT s.external_id, j.id FROM jobs j").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "id"}).AddRow("e1", "a1").AddRow("e2", "a2"))
+
+	seen := []string{}
+	results, err := internal.doForAllUserAnalyses(context.Background(), "test", func(result *BulkOperationResult) error {
+		seen = append(seen, result.AnalysisID)
+		if result.ExternalID == "e2" {
+			return errors.New("it broke")
+		}
+		return nil
+	})
+	assert.NoError(err)
+
+	// One failure doesn't stop the others.
+	assert.ElementsMatch([]string{"a1", "a2"}, seen)
+	assert.Len(results, 2)
+	for _, result := range results {
+		if result.ExternalID == "e1" {
+			assert.True(result.Success)
+			assert.Empty(result.Error)
+		} else {
+			assert.False(result.Success)
+			assert.Equal("it broke", result.Error)
+		}
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDoForAllUserAnalysesUnknownUser(t *testing.T) {
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectQuery("SELECT u.id FROM users u").WillReturnError(sql.ErrNoRows)
+
+	_, err := internal.doForAllUserAnalyses(context.Background(), "nobody", func(result *BulkOperationResult) error {
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestFilterExternalIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	dep := userDeployment("u2", "e3")
+	dep.Labels["app-id"] = "app1"
+	internal, _ := setupInternal(t, []runtime.Object{
+		userDeployment("u1", "e1"),
+		userDeployment("u1", "e2"),
+		dep,
+	})
+
+	externalIDs, err := internal.filterExternalIDs(map[string]string{"user-id": "u1"})
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"e1", "e2"}, externalIDs)
+
+	externalIDs, err = internal.filterExternalIDs(map[string]string{"user-id": "u2", "app-id": "app1"})
+	assert.NoError(err)
+	assert.Equal([]string{"e3"}, externalIDs)
+}
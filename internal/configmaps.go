@@ -27,8 +27,9 @@ func (i *Internal) excludesConfigMap(job *model.Job) (*apiv1.ConfigMap, error) {
 
 	return &apiv1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   excludesConfigMapName(job),
-			Labels: labels,
+			Name:        excludesConfigMapName(job),
+			Labels:      labels,
+			Annotations: i.annotationsFromJob(job),
 		},
 		Data: map[string]string{
 			excludesFileName: jobtmpl.ExcludesFileContents(job).String(),
@@ -60,8 +61,9 @@ func (i *Internal) inputPathListConfigMap(job *model.Job) (*apiv1.ConfigMap, err
 
 	return &apiv1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   inputPathListConfigMapName(job),
-			Labels: labels,
+			Name:        inputPathListConfigMapName(job),
+			Labels:      labels,
+			Annotations: i.annotationsFromJob(job),
 		},
 		Data: map[string]string{
 			inputPathListFileName: fileContents.String(),
@@ -0,0 +1,482 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	configTemplateVolumePrefix  = "cfg-"
+	maxConfigTemplateNameLength = validation.DNS1123LabelMaxLength - len(configTemplateVolumePrefix)
+
+	// configTemplateLabel marks the ConfigMaps rendered from config templates
+	// and holds the name of the template.
+	configTemplateLabel = "config-template"
+
+	// configTemplateMountAnnotation holds the directory the rendered files
+	// are mounted in.
+	configTemplateMountAnnotation = "vice.cyverse.org/mount-path"
+)
+
+// ConfigTemplate is a set of files for an app that are rendered as Go
+// templates over the job metadata at launch and mounted into the analysis
+// container, such as a Jupyter config file or RStudio preferences. Files maps
+// file names to templates, and each file is mounted in MountPath.
+type ConfigTemplate struct {
+	AppID     string            `json:"appID"`
+	Name      string            `json:"name"`
+	MountPath string            `json:"mountPath"`
+	Files     map[string]string `json:"files"`
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// configTemplateRow is a ConfigTemplate as stored in the database.
+type configTemplateRow struct {
+	AppID     string    `db:"app_id"`
+	Name      string    `db:"name"`
+	MountPath string    `db:"mount_path"`
+	Files     []byte    `db:"files"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (r *configTemplateRow) template() (*ConfigTemplate, error) {
+	t := &ConfigTemplate{
+		AppID:     r.AppID,
+		Name:      r.Name,
+		MountPath: r.MountPath,
+		Files:     map[string]string{},
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+	}
+	if err := json.Unmarshal(r.Files, &t.Files); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the files of config template %s for app %s", r.Name, r.AppID)
+	}
+	return t, nil
+}
+
+const configTemplateColumns = `
+	SELECT app_id, name, mount_path, files, created_at, updated_at
+	  FROM vice_app_config_templates
+`
+
+const listConfigTemplatesSQL = configTemplateColumns + `
+	 ORDER BY app_id, name
+`
+
+const listAppConfigTemplatesSQL = configTemplateColumns + `
+	 WHERE app_id = $1
+	 ORDER BY name
+`
+
+const upsertConfigTemplateSQL = `
+	INSERT INTO vice_app_config_templates (app_id, name, mount_path, files, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, now(), now())
+	ON CONFLICT (app_id, name) DO UPDATE
+	   SET mount_path = EXCLUDED.mount_path,
+	       files = EXCLUDED.files,
+	       updated_at = EXCLUDED.updated_at
+	RETURNING app_id, name, mount_path, files, created_at, updated_at
+`
+
+const deleteConfigTemplateSQL = `
+	DELETE FROM vice_app_config_templates
+	 WHERE app_id = $1
+	   AND name = $2
+`
+
+// sampleTemplateData is the job metadata that templates are rendered with to
+// validate them and for dry runs.
+var sampleTemplateData = SidecarTemplateData{
+	ExternalID:   "00000000-0000-0000-0000-000000000000",
+	AnalysisName: "sample-analysis",
+	AppID:        "00000000-0000-0000-0000-000000000001",
+	AppName:      "Sample App",
+	Username:     "sample-user",
+	UserID:       "00000000-0000-0000-0000-000000000002",
+	Email:        "sample-user@example.org",
+	Subdomain:    "a1b2c3d4e",
+	URL:          "https://a1b2c3d4e.example.org",
+	Namespace:    "vice-apps",
+}
+
+// renderConfigTemplate renders each of the files in the template with the
+// job metadata.
+func renderConfigTemplate(t *ConfigTemplate, data *SidecarTemplateData) (map[string]string, error) {
+	rendered := map[string]string{}
+	for name, text := range t.Files {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing file %s of config template %s", name, t.Name)
+		}
+
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, data); err != nil {
+			return nil, errors.Wrapf(err, "error rendering file %s of config template %s", name, t.Name)
+		}
+		rendered[name] = buf.String()
+	}
+	return rendered, nil
+}
+
+// validateConfigTemplate cleans up the mount path and returns an error if the
+// template can't be rendered and mounted.
+func validateConfigTemplate(t *ConfigTemplate) error {
+	problems := []string{}
+
+	if len(t.Name) > maxConfigTemplateNameLength {
+		problems = append(problems, fmt.Sprintf("name must be at most %d characters", maxConfigTemplateNameLength))
+	}
+	for _, msg := range validation.IsDNS1123Label(t.Name) {
+		problems = append(problems, fmt.Sprintf("name %s: %s", t.Name, msg))
+	}
+
+	if !path.IsAbs(t.MountPath) || path.Clean(t.MountPath) == "/" {
+		problems = append(problems, fmt.Sprintf("mountPath %s must be an absolute path other than /", t.MountPath))
+	}
+	t.MountPath = path.Clean(t.MountPath)
+
+	if len(t.Files) == 0 {
+		problems = append(problems, "files must not be empty")
+	}
+	for name := range t.Files {
+		for _, msg := range validation.IsConfigMapKey(name) {
+			problems = append(problems, fmt.Sprintf("file name %s: %s", name, msg))
+		}
+	}
+
+	if len(problems) == 0 {
+		if _, err := renderConfigTemplate(t, &sampleTemplateData); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_INVALID_CONFIG_TEMPLATE",
+		Message:   fmt.Sprintf("the config template is invalid: %s", strings.Join(problems, "; ")),
+		Details: &map[string]interface{}{
+			"problems": problems,
+		},
+	}
+}
+
+// appConfigTemplates returns the config templates for the app.
+func (i *Internal) appConfigTemplates(appID string) ([]ConfigTemplate, error) {
+	rows := []configTemplateRow{}
+	if err := i.db.Select(&rows, listAppConfigTemplatesSQL, appID); err != nil {
+		return nil, errors.Wrapf(err, "error looking up the config templates for app %s", appID)
+	}
+
+	templates := []ConfigTemplate{}
+	for idx := range rows {
+		t, err := rows[idx].template()
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, *t)
+	}
+
+	return templates, nil
+}
+
+// configTemplateConfigMapName returns the name of the ConfigMap the template
+// is rendered into for the analysis.
+func configTemplateConfigMapName(job *model.Job, name string) string {
+	return fmt.Sprintf("app-config-%s-%s", name, job.InvocationID)
+}
+
+// configTemplateConfigMaps returns the ConfigMaps rendered from the config
+// templates for the job's app. This does NOT call the k8s API to actually
+// create the ConfigMaps.
+func (i *Internal) configTemplateConfigMaps(job *model.Job) ([]*apiv1.ConfigMap, error) {
+	templates, err := i.appConfigTemplates(job.AppID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(templates) == 0 {
+		return []*apiv1.ConfigMap{}, nil
+	}
+
+	// The labels and annotations are looked up once and copied for each
+	// template, since the labels need a database lookup.
+	jobLabels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+	jobAnnotations := i.annotationsFromJob(job)
+
+	data := i.sidecarTemplateData(job)
+	configMaps := []*apiv1.ConfigMap{}
+
+	for idx := range templates {
+		t := &templates[idx]
+
+		files, err := renderConfigTemplate(t, data)
+		if err != nil {
+			return nil, err
+		}
+
+		cmLabels := map[string]string{configTemplateLabel: t.Name}
+		for k, v := range jobLabels {
+			cmLabels[k] = v
+		}
+
+		annotations := map[string]string{configTemplateMountAnnotation: t.MountPath}
+		for k, v := range jobAnnotations {
+			annotations[k] = v
+		}
+
+		configMaps = append(configMaps, &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        configTemplateConfigMapName(job, t.Name),
+				Labels:      cmLabels,
+				Annotations: annotations,
+			},
+			Data: files,
+		})
+	}
+
+	return configMaps, nil
+}
+
+// UpsertConfigTemplateConfigMaps renders the config templates for the job's
+// app and applies their ConfigMaps.
+func (i *Internal) UpsertConfigTemplateConfigMaps(job *model.Job) error {
+	configMaps, err := i.configTemplateConfigMaps(job)
+	if err != nil {
+		return err
+	}
+
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+
+	for _, cm := range configMaps {
+		cm := cm
+		err = i.applyObject(i.ViceNamespace, cm, func() error {
+			_, err := cmclient.Get(cm.Name, metav1.GetOptions{})
+			if err != nil {
+				_, err = cmclient.Create(cm)
+			} else {
+				_, err = cmclient.Update(cm)
+			}
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error saving config map %s", cm.Name)
+		}
+	}
+
+	return nil
+}
+
+// addConfigTemplates mounts the files rendered from the config templates into
+// the analysis container. Each file is mounted on its own so that the rest of
+// the directory is left alone.
+func (i *Internal) addConfigTemplates(job *model.Job, spec *apiv1.PodSpec) error {
+	set := labels.Set(i.labelKeys.selector(map[string]string{"external-id": job.InvocationID}))
+	cmlist, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s,%s", set.AsSelector().String(), configTemplateLabel),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error listing the config templates for analysis %s", job.InvocationID)
+	}
+
+	configMaps := []*apiv1.ConfigMap{}
+	for idx := range cmlist.Items {
+		configMaps = append(configMaps, &cmlist.Items[idx])
+	}
+	mountConfigTemplates(configMaps, spec)
+
+	return nil
+}
+
+// mountConfigTemplates mounts the files in the config template ConfigMaps into
+// the analysis container.
+func mountConfigTemplates(configMaps []*apiv1.ConfigMap, spec *apiv1.PodSpec) {
+	var container *apiv1.Container
+	for c := range spec.Containers {
+		if spec.Containers[c].Name == analysisContainerName {
+			container = &spec.Containers[c]
+			break
+		}
+	}
+
+	for _, cm := range configMaps {
+		volumeName := configTemplateVolumePrefix + cm.Labels[configTemplateLabel]
+		spec.Volumes = append(spec.Volumes, apiv1.Volume{
+			Name: volumeName,
+			VolumeSource: apiv1.VolumeSource{
+				ConfigMap: &apiv1.ConfigMapVolumeSource{
+					LocalObjectReference: apiv1.LocalObjectReference{
+						Name: cm.Name,
+					},
+				},
+			},
+		})
+
+		if container == nil {
+			continue
+		}
+
+		files := []string{}
+		for name := range cm.Data {
+			files = append(files, name)
+		}
+		sort.Strings(files)
+
+		for _, name := range files {
+			container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{
+				Name:      volumeName,
+				MountPath: path.Join(cm.Annotations[configTemplateMountAnnotation], name),
+				SubPath:   name,
+				ReadOnly:  true,
+			})
+		}
+	}
+}
+
+// AdminListConfigTemplatesHandler lists the config templates, optionally only
+// those for the app in the app-id query parameter.
+func (i *Internal) AdminListConfigTemplatesHandler(c echo.Context) error {
+	var (
+		templates []ConfigTemplate
+		err       error
+	)
+
+	if appID := c.QueryParam("app-id"); appID != "" {
+		templates, err = i.appConfigTemplates(appID)
+		if err != nil {
+			return err
+		}
+	} else {
+		rows := []configTemplateRow{}
+		if err = i.db.Select(&rows, listConfigTemplatesSQL); err != nil {
+			return errors.Wrap(err, "error listing the config templates")
+		}
+
+		templates = []ConfigTemplate{}
+		for idx := range rows {
+			t, err := rows[idx].template()
+			if err != nil {
+				return err
+			}
+			templates = append(templates, *t)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ConfigTemplate{
+		"templates": templates,
+	})
+}
+
+// AdminPutConfigTemplateHandler validates the config template in the body and
+// saves it for the app. Running analyses keep the files they were launched
+// with.
+func (i *Internal) AdminPutConfigTemplateHandler(c echo.Context) error {
+	request := &ConfigTemplate{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	request.AppID = c.Param("app-id")
+	request.Name = c.Param("name")
+
+	if err := validateConfigTemplate(request); err != nil {
+		return err
+	}
+
+	files, err := json.Marshal(request.Files)
+	if err != nil {
+		return errors.Wrapf(err, "error encoding the files of config template %s", request.Name)
+	}
+
+	row := &configTemplateRow{}
+	if err = i.db.QueryRowx(upsertConfigTemplateSQL, request.AppID, request.Name, request.MountPath, files).StructScan(row); err != nil {
+		return errors.Wrapf(err, "error saving config template %s for app %s", request.Name, request.AppID)
+	}
+
+	saved, err := row.template()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, saved)
+}
+
+// AdminDeleteConfigTemplateHandler removes a config template from an app.
+func (i *Internal) AdminDeleteConfigTemplateHandler(c echo.Context) error {
+	appID := c.Param("app-id")
+	name := c.Param("name")
+
+	result, err := i.db.Exec(deleteConfigTemplateSQL, appID, name)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting config template %s for app %s", name, appID)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("config template %s not found for app %s", name, appID))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// RenderConfigTemplateRequest is the body of a dry-run rendering request. The
+// sample job metadata is used if Data is omitted.
+type RenderConfigTemplateRequest struct {
+	Template ConfigTemplate       `json:"template"`
+	Data     *SidecarTemplateData `json:"data"`
+}
+
+// AdminRenderConfigTemplateHandler validates the config template in the body
+// and returns the files it renders to, without saving anything.
+func (i *Internal) AdminRenderConfigTemplateHandler(c echo.Context) error {
+	request := &RenderConfigTemplateRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateConfigTemplate(&request.Template); err != nil {
+		return err
+	}
+
+	data := request.Data
+	if data == nil {
+		data = &sampleTemplateData
+	}
+
+	files, err := renderConfigTemplate(&request.Template, data)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"mountPath": request.Template.MountPath,
+		"files":     files,
+	})
+}
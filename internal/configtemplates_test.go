@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateConfigTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpl := &ConfigTemplate{
+		Name:      "jupyter",
+		MountPath: "/home/jovyan/.jupyter/",
+		Files:     map[string]string{"jupyter_server_config.py": "c.ServerApp.base_url = '{{.URL}}'"},
+	}
+	assert.NoError(validateConfigTemplate(tmpl))
+	assert.Equal("/home/jovyan/.jupyter", tmpl.MountPath)
+
+	invalid := []*ConfigTemplate{
+		{Name: "Jupyter", MountPath: "/etc", Files: map[string]string{"a": "b"}},
+		{Name: "jupyter", MountPath: "etc", Files: map[string]string{"a": "b"}},
+		{Name: "jupyter", MountPath: "/etc"},
+		{Name: "jupyter", MountPath: "/etc", Files: map[string]string{"../a": "b"}},
+		{Name: "jupyter", MountPath: "/etc", Files: map[string]string{"a": "{{.URL"}},
+		{Name: "jupyter", MountPath: "/etc", Files: map[string]string{"a": "{{.Password}}"}},
+	}
+	for _, tmpl := range invalid {
+		err := validateConfigTemplate(tmpl)
+		assert.Error(err)
+		assert.Equal("ERR_INVALID_CONFIG_TEMPLATE", err.(common.ErrorResponse).ErrorCode)
+	}
+}
+
+func TestConfigTemplateConfigMaps(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	job := multiPortJob(8888)
+	job.AppID = "app1"
+	job.Name = "test analysis"
+	job.Submitter = "ipctest"
+
+	now := time.Now()
+	mock.ExpectQuery("FROM vice_app_config_templates").
+		WithArgs("app1").
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "name", "mount_path", "files", "created_at", "updated_at"}).
+			AddRow("app1", "rstudio", "/home/rstudio/.config/rstudio", []byte(`{"rstudio-prefs.json":"{\"user\": \"{{.Username}}\"}"}`), now, now))
+	registerUserIPQuery(mock, "10.0.0.1")
+
+	assert.NoError(internal.UpsertConfigTemplateConfigMaps(job))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	cm, err := internal.clientset.CoreV1().ConfigMaps("vice-apps").Get("app-config-rstudio-e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(`{"user": "ipctest"}`, cm.Data["rstudio-prefs.json"])
+	assert.Equal("e1", cm.Labels["external-id"])
+
+	spec := &apiv1.PodSpec{Containers: internal.deploymentContainers(job)}
+	assert.NoError(internal.addConfigTemplates(job, spec))
+
+	assert.Len(spec.Volumes, 1)
+	assert.Equal("app-config-rstudio-e1", spec.Volumes[0].ConfigMap.Name)
+
+	for _, container := range spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+		mount := container.VolumeMounts[len(container.VolumeMounts)-1]
+		assert.Equal("cfg-rstudio", mount.Name)
+		assert.Equal("/home/rstudio/.config/rstudio/rstudio-prefs.json", mount.MountPath)
+		assert.Equal("rstudio-prefs.json", mount.SubPath)
+	}
+}
+
+func TestAdminRenderConfigTemplateHandler(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupInternal(t, nil)
+
+	body := `{"template": {"name": "jupyter", "mountPath": "/etc/jupyter", "files": {"config.py": "user = '{{.Username}}'"}}}`
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/vice/admin/config-templates/render", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	assert.NoError(internal.AdminRenderConfigTemplateHandler(e.NewContext(req, rec)))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	result := struct {
+		MountPath string            `json:"mountPath"`
+		Files     map[string]string `json:"files"`
+	}{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal("/etc/jupyter", result.MountPath)
+	assert.Equal("user = 'sample-user'", result.Files["config.py"])
+}
@@ -66,3 +66,4 @@ const (
 
 func int32Ptr(i int32) *int32 { return &i }
 func int64Ptr(i int64) *int64 { return &i }
+func boolPtr(b bool) *bool    { return &b }
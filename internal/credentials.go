@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultRotationCheckInterval = 10 * time.Minute
+
+// Annotations recording which version of the staged credentials the live
+// Secret holds and when it was rotated.
+const (
+	credentialVersionAnnotation   = "vice.cyverse.org/credential-version"
+	credentialRotatedAtAnnotation = "vice.cyverse.org/credential-rotated-at"
+)
+
+// Kinds of credentials, and the outcomes of rotation checks.
+const (
+	CredentialKindMountedSecret = "mounted-secret"
+	CredentialKindWebhookSecret = "webhook-secret"
+
+	RotationRotated   = "rotated"
+	RotationUnchanged = "unchanged"
+	RotationFailed    = "failed"
+)
+
+// CredentialRotationConfig turns on rotation of the porklock configuration
+// mounted into analyses. Operators write the new credentials into the
+// StagedPorklockSecret in the VICE namespace; every CheckInterval, app-exposer
+// copies them into the Secret the analyses mount if they've changed. Running
+// analyses pick up the new files when the kubelet refreshes the mount, so the
+// old credentials should stay valid for a few minutes after a rotation.
+// FingerprintKey keys the fingerprints reported for each credential, so that
+// they can't be used to check guesses of the credentials offline.
+type CredentialRotationConfig struct {
+	StagedPorklockSecret string        `mapstructure:"staged_porklock_secret"`
+	CheckInterval        time.Duration `mapstructure:"check_interval"`
+	FingerprintKey       string        `mapstructure:"fingerprint_key"`
+}
+
+func (r *CredentialRotationConfig) enabled() bool {
+	return r.StagedPorklockSecret != ""
+}
+
+func (r *CredentialRotationConfig) checkInterval() time.Duration {
+	if r.CheckInterval <= 0 {
+		return defaultRotationCheckInterval
+	}
+	return r.CheckInterval
+}
+
+// fingerprintKey returns the key for credential fingerprints. Without a
+// configured key, a random one is used, so the fingerprints change whenever
+// app-exposer restarts.
+func (r *CredentialRotationConfig) fingerprintKey() []byte {
+	if r.FingerprintKey != "" {
+		return []byte(r.FingerprintKey)
+	}
+
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(errors.Wrap(err, "error generating the credential fingerprint key"))
+	}
+	if r.enabled() {
+		log.Warn("vice.credential_rotation.fingerprint_key is not set, so credential fingerprints won't survive a restart")
+	}
+	return key
+}
+
+// CredentialRotation is the outcome of a check for new credentials.
+type CredentialRotation struct {
+	Credential string    `json:"credential" db:"credential"`
+	Version    string    `json:"version" db:"version"`
+	Status     string    `json:"status" db:"status"`
+	Message    string    `json:"message" db:"message"`
+	CheckedAt  time.Time `json:"checkedAt" db:"checked_at"`
+}
+
+// CredentialStatus describes a credential app-exposer hands out, without
+// revealing it. DualKey is true while a previous value is still accepted.
+// LastRotation is the most recent rotation or failed rotation.
+type CredentialStatus struct {
+	Name         string              `json:"name"`
+	Kind         string              `json:"kind"`
+	Version      string              `json:"version,omitempty"`
+	RotatedAt    string              `json:"rotatedAt,omitempty"`
+	DualKey      bool                `json:"dualKey"`
+	LastRotation *CredentialRotation `json:"lastRotation,omitempty"`
+	Automatic    bool                `json:"automatic"`
+}
+
+const recordCredentialRotationSQL = `
+	INSERT INTO vice_credential_rotations (credential, version, status, message, checked_at)
+	VALUES ($1, $2, $3, $4, now())
+`
+
+const lastCredentialRotationSQL = `
+	SELECT credential, version, status, message, checked_at
+	  FROM vice_credential_rotations
+	 WHERE credential = $1
+	 ORDER BY checked_at DESC
+	 LIMIT 1
+`
+
+// credentialVersion returns a short fingerprint of the credential data that
+// can be shown without revealing the data. It's an HMAC keyed with the
+// fingerprint key, since a plain hash of a short secret can be brute forced.
+func (i *Internal) credentialVersion(data map[string][]byte) string {
+	keys := []string{}
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := hmac.New(sha256.New, i.fingerprintKey)
+	for _, key := range keys {
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write(data[key])
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// recordRotation saves the outcome of a rotation check. Failures are logged,
+// since they shouldn't hide the outcome from the caller.
+func (i *Internal) recordRotation(rotation *CredentialRotation) {
+	if _, err := i.db.Exec(recordCredentialRotationSQL, rotation.Credential, rotation.Version, rotation.Status, rotation.Message); err != nil {
+		log.Error(errors.Wrapf(err, "error recording the rotation of %s", rotation.Credential))
+	}
+}
+
+// rotatePorklockConfig copies the staged porklock configuration into the
+// Secret mounted by analyses if it has changed. The live Secret is created if
+// it doesn't exist yet.
+func (i *Internal) rotatePorklockConfig() (*CredentialRotation, error) {
+	rotation := &CredentialRotation{Credential: porklockConfigSecretName, CheckedAt: time.Now()}
+
+	secrets := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+
+	staged, err := secrets.Get(i.CredentialRotation.StagedPorklockSecret, metav1.GetOptions{})
+	if err != nil {
+		rotation.Status = RotationFailed
+		rotation.Message = err.Error()
+		i.recordRotation(rotation)
+		return rotation, errors.Wrapf(err, "error getting the staged secret %s", i.CredentialRotation.StagedPorklockSecret)
+	}
+	rotation.Version = i.credentialVersion(staged.Data)
+
+	live, err := secrets.Get(porklockConfigSecretName, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		rotation.Status = RotationFailed
+		rotation.Message = err.Error()
+		i.recordRotation(rotation)
+		return rotation, errors.Wrapf(err, "error getting secret %s", porklockConfigSecretName)
+	}
+
+	if err == nil && i.credentialVersion(live.Data) == rotation.Version {
+		rotation.Status = RotationUnchanged
+		return rotation, nil
+	}
+
+	annotations := map[string]string{
+		credentialVersionAnnotation:   rotation.Version,
+		credentialRotatedAtAnnotation: rotation.CheckedAt.UTC().Format(time.RFC3339),
+	}
+
+	if k8serrors.IsNotFound(err) {
+		_, err = secrets.Create(&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        porklockConfigSecretName,
+				Namespace:   i.ViceNamespace,
+				Annotations: annotations,
+			},
+			Type: staged.Type,
+			Data: staged.Data,
+		})
+	} else {
+		if live.Annotations == nil {
+			live.Annotations = map[string]string{}
+		}
+		for key, value := range annotations {
+			live.Annotations[key] = value
+		}
+		live.Data = staged.Data
+		_, err = secrets.Update(live)
+	}
+
+	if err != nil {
+		rotation.Status = RotationFailed
+		rotation.Message = err.Error()
+		i.recordRotation(rotation)
+		return rotation, errors.Wrapf(err, "error rotating secret %s", porklockConfigSecretName)
+	}
+
+	rotation.Status = RotationRotated
+	i.recordRotation(rotation)
+	log.Infof("rotated secret %s to version %s", porklockConfigSecretName, rotation.Version)
+
+	return rotation, nil
+}
+
+// StartCredentialRotation periodically checks for new staged credentials. It
+// does nothing unless a staged secret is configured.
+func (i *Internal) StartCredentialRotation() {
+	if !i.CredentialRotation.enabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(i.CredentialRotation.checkInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := i.rotatePorklockConfig(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// lastRotation returns the most recent rotation recorded for the credential,
+// or nil if there isn't one.
+func (i *Internal) lastRotation(credential string) (*CredentialRotation, error) {
+	rotation := &CredentialRotation{}
+	err := i.db.QueryRowx(lastCredentialRotationSQL, credential).StructScan(rotation)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the last rotation of %s", credential)
+	}
+	return rotation, nil
+}
+
+// credentialStatuses describes the porklock configuration and the webhook
+// secrets.
+func (i *Internal) credentialStatuses() ([]CredentialStatus, error) {
+	porklock := CredentialStatus{
+		Name:      porklockConfigSecretName,
+		Kind:      CredentialKindMountedSecret,
+		Automatic: i.CredentialRotation.enabled(),
+	}
+
+	live, err := i.clientset.CoreV1().Secrets(i.ViceNamespace).Get(porklockConfigSecretName, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "error getting secret %s", porklockConfigSecretName)
+	}
+	if err == nil {
+		porklock.Version = i.credentialVersion(live.Data)
+		porklock.RotatedAt = live.Annotations[credentialRotatedAtAnnotation]
+	}
+
+	if porklock.LastRotation, err = i.lastRotation(porklockConfigSecretName); err != nil {
+		return nil, err
+	}
+
+	statuses := []CredentialStatus{porklock}
+
+	for _, endpoint := range i.SubdomainWebhooks.Endpoints {
+		statuses = append(statuses, CredentialStatus{
+			Name:    "subdomain-webhook/" + endpoint.Name,
+			Kind:    CredentialKindWebhookSecret,
+			Version: i.credentialVersion(map[string][]byte{"secret": []byte(endpoint.Secret)}),
+			DualKey: endpoint.PreviousSecret != "",
+		})
+	}
+
+	return statuses, nil
+}
+
+// AdminListCredentialsHandler reports the version and rotation status of each
+// credential app-exposer hands out. The credentials themselves aren't
+// included.
+func (i *Internal) AdminListCredentialsHandler(c echo.Context) error {
+	statuses, err := i.credentialStatuses()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string][]CredentialStatus{
+		"credentials": statuses,
+	})
+}
+
+// AdminRotatePorklockConfigHandler checks for new staged porklock credentials
+// right away instead of waiting for the next scheduled check.
+func (i *Internal) AdminRotatePorklockConfigHandler(c echo.Context) error {
+	if !i.CredentialRotation.enabled() {
+		return echo.NewHTTPError(http.StatusBadRequest, "credential rotation is not enabled")
+	}
+
+	rotation, err := i.rotatePorklockConfig()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, rotation)
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func porklockSecret(name, config string) *apiv1.Secret {
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "vice-apps"},
+		Data:       map[string][]byte{"irods-config.properties": []byte(config)},
+	}
+}
+
+func expectRotationRecord(mock sqlmock.Sqlmock, status string) {
+	mock.ExpectExec("INSERT INTO vice_credential_rotations").
+		WithArgs(porklockConfigSecretName, sqlmock.AnyArg(), status, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestCredentialVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{})
+	i.fingerprintKey = []byte("key")
+
+	v1 := i.credentialVersion(map[string][]byte{"a": []byte("1"), "b": []byte("2")})
+	assert.Len(v1, 12)
+	assert.Equal(v1, i.credentialVersion(map[string][]byte{"b": []byte("2"), "a": []byte("1")}))
+	assert.NotEqual(v1, i.credentialVersion(map[string][]byte{"a": []byte("12")}))
+
+	// The fingerprints depend on the key.
+	i.fingerprintKey = []byte("other-key")
+	assert.NotEqual(v1, i.credentialVersion(map[string][]byte{"a": []byte("1"), "b": []byte("2")}))
+}
+
+func TestRotatePorklockConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		porklockSecret("porklock-config-staged", "password=new"),
+		porklockSecret(porklockConfigSecretName, "password=old"),
+	})
+	i.CredentialRotation.StagedPorklockSecret = "porklock-config-staged"
+
+	expectRotationRecord(mock, RotationRotated)
+
+	rotation, err := i.rotatePorklockConfig()
+	assert.NoError(err)
+	assert.Equal(RotationRotated, rotation.Status)
+
+	live, err := i.clientset.CoreV1().Secrets("vice-apps").Get(porklockConfigSecretName, metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("password=new", string(live.Data["irods-config.properties"]))
+	assert.Equal(rotation.Version, live.Annotations[credentialVersionAnnotation])
+
+	// Nothing changes, or is recorded, until new credentials are staged.
+	rotation, err = i.rotatePorklockConfig()
+	assert.NoError(err)
+	assert.Equal(RotationUnchanged, rotation.Status)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRotatePorklockConfigMissingStaged(t *testing.T) {
+	i, mock := setupInternal(t, nil)
+	i.CredentialRotation.StagedPorklockSecret = "porklock-config-staged"
+
+	expectRotationRecord(mock, RotationFailed)
+
+	rotation, err := i.rotatePorklockConfig()
+	assert.Error(t, err)
+	assert.Equal(t, RotationFailed, rotation.Status)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCredentialStatuses(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{porklockSecret(porklockConfigSecretName, "password=old")})
+	i.SubdomainWebhooks.Endpoints = []SubdomainWebhookEndpoint{{Name: "waf", Secret: "new", PreviousSecret: "old"}}
+
+	mock.ExpectQuery("FROM vice_credential_rotations").
+		WithArgs(porklockConfigSecretName).
+		WillReturnRows(sqlmock.NewRows([]string{"credential", "version", "status", "message", "checked_at"}))
+
+	statuses, err := i.credentialStatuses()
+	assert.NoError(err)
+	assert.Len(statuses, 2)
+	assert.Equal(CredentialKindMountedSecret, statuses[0].Kind)
+	assert.False(statuses[0].Automatic)
+	assert.Nil(statuses[0].LastRotation)
+	assert.Equal("subdomain-webhook/waf", statuses[1].Name)
+	assert.True(statuses[1].DualKey)
+}
+
+func TestAttemptWebhookDeliveryPreviousSecret(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, nil)
+	i.SubdomainWebhooks.Endpoints = []SubdomainWebhookEndpoint{{Name: "waf", URL: server.URL, Secret: "new", PreviousSecret: "old"}}
+
+	mock.ExpectExec("UPDATE vice_subdomain_webhook_deliveries").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SET status = 'delivered'").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	delivery := testDelivery()
+	assert.NoError(t, i.attemptWebhookDelivery(server.Client(), delivery, time.Unix(1600000000, 0)))
+
+	expected := signWebhook("new", "1600000000", delivery.Payload) + "," + signWebhook("old", "1600000000", delivery.Payload)
+	assert.Equal(t, expected, received.Header.Get(webhookSignatureHeader))
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the values a field of a cron expression matches.
+type cronField map[int]bool
+
+// cronSchedule is a five-field cron expression: minute, hour, day of the
+// month, month and day of the week. Each field is *, a number, a range such
+// as 1-5, or a list of them, and any of those but a number can have a step
+// such as */15. Days of the week run from 0 for Sunday to 6, with 7 also
+// meaning Sunday. As in cron, a time matches on either day field when both
+// of them are restricted.
+type cronSchedule struct {
+	minutes  cronField
+	hours    cronField
+	days     cronField
+	months   cronField
+	weekdays cronField
+
+	anyDay     bool
+	anyWeekday bool
+}
+
+// parseCronField parses one field of a cron expression whose values run from
+// min to max.
+func parseCronField(field string, min, max int) (cronField, error) {
+	values := cronField{}
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			s, err := strconv.Atoi(part[idx+1:])
+			if err != nil || s < 1 {
+				return nil, fmt.Errorf("invalid step in %s", part)
+			}
+			rangePart, step = part[:idx], s
+		}
+
+		start, end := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid range %s", rangePart)
+			}
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid range %s", rangePart)
+			}
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", rangePart)
+			}
+			start = n
+			if step == 1 {
+				end = n
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%s is outside of %d-%d", part, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+
+	return values, nil
+}
+
+// parseCron parses a five-field cron expression.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q doesn't have 5 fields", expr)
+	}
+
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	parsed := make([]cronField, len(fields))
+	for idx, field := range fields {
+		values, err := parseCronField(field, bounds[idx][0], bounds[idx][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %s", expr, err)
+		}
+		parsed[idx] = values
+	}
+
+	if parsed[4][7] {
+		parsed[4][0] = true
+	}
+
+	return &cronSchedule{
+		minutes:    parsed[0],
+		hours:      parsed[1],
+		days:       parsed[2],
+		months:     parsed[3],
+		weekdays:   parsed[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}, nil
+}
+
+// matchesDay returns true if the date is one of the days in the schedule.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	day := s.days[t.Day()]
+	weekday := s.weekdays[int(t.Weekday())]
+
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// next returns the first time in the schedule after t, in t's location. It
+// returns the zero time if there isn't one in the next five years, which
+// happens for dates like February 30th.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !s.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !s.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		_, err := parseCron(expr)
+		assert.Errorf(t, err, "%q should be invalid", expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Friday.
+	start := time.Date(2026, time.October, 16, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		// Weekday mornings skip the weekend.
+		{"45 8 * * 1-5", start, time.Date(2026, time.October, 19, 8, 45, 0, 0, time.UTC)},
+		{"*/15 * * * *", start, time.Date(2026, time.October, 16, 9, 15, 0, 0, time.UTC)},
+		{"*/15 * * * *", start.Add(20 * time.Minute), time.Date(2026, time.October, 16, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1 1 *", start, time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 14 * * 1,3", start, time.Date(2026, time.October, 19, 14, 30, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted.
+		{"0 12 20 * 0", start, time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)},
+		{"0 12 17 * 0", start, time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)},
+		// 7 is Sunday too.
+		{"0 12 * * 7", start, time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)},
+		// Stepped values start from the value.
+		{"10/20 9 * * *", start, time.Date(2026, time.October, 16, 9, 10, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		cron, err := parseCron(test.expr)
+		if assert.NoErrorf(t, err, "%q should parse", test.expr) {
+			assert.Equalf(t, test.expected, cron.next(test.from), "next run of %q", test.expr)
+		}
+	}
+
+	cron, err := parseCron("0 0 30 2 *")
+	assert.NoError(t, err)
+	assert.True(t, cron.next(start).IsZero(), "February 30th never comes")
+}
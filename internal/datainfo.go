@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dataInfoTimeout is how long requests to the data-info service can take.
+const dataInfoTimeout = 30 * time.Second
+
+// pathAccess describes whether a path in the data store exists and whether
+// the user has permission to read it.
+type pathAccess struct {
+	Exists   bool
+	Readable bool
+}
+
+// postDataInfo posts the paths to the data-info endpoint on behalf of the
+// user and decodes the response into out.
+func (i *Internal) postDataInfo(endpoint, user string, paths []string, out interface{}) error {
+	u, err := url.Parse(strings.TrimSuffix(i.DataInfoBaseURL, "/") + endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing the data-info URL %s", i.DataInfoBaseURL)
+	}
+	q := u.Query()
+	q.Set("user", strings.TrimSuffix(user, i.UserSuffix))
+	u.RawQuery = q.Encode()
+
+	body, err := json.Marshal(map[string][]string{"paths": paths})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: dataInfoTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error contacting the data-info service")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the data-info service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	if err = json.Unmarshal(respBody, out); err != nil {
+		return errors.Wrap(err, "error parsing the response from the data-info service")
+	}
+
+	return nil
+}
+
+// pathAccess looks up whether each of the paths exists in the data store and
+// whether the user can read it.
+func (i *Internal) pathAccess(user string, paths []string) (map[string]pathAccess, error) {
+	access := map[string]pathAccess{}
+	if len(paths) == 0 {
+		return access, nil
+	}
+
+	existence := struct {
+		Paths map[string]bool `json:"paths"`
+	}{}
+	if err := i.postDataInfo("/existence-marker", user, paths, &existence); err != nil {
+		return nil, err
+	}
+
+	existing := []string{}
+	for _, p := range paths {
+		if existence.Paths[p] {
+			existing = append(existing, p)
+		}
+		access[p] = pathAccess{Exists: existence.Paths[p]}
+	}
+	if len(existing) == 0 {
+		return access, nil
+	}
+
+	// The permission is only reported for the paths the user can see at all.
+	info := struct {
+		Paths map[string]struct {
+			Permission string `json:"permission"`
+		} `json:"paths"`
+	}{}
+	if err := i.postDataInfo("/path-info", user, existing, &info); err != nil {
+		return nil, err
+	}
+
+	for _, p := range existing {
+		access[p] = pathAccess{Exists: true, Readable: info.Paths[p].Permission != ""}
+	}
+
+	return access, nil
+}
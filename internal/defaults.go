@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// reservedLabelKeys are the labels app-exposer sets on the resources it
+// creates. The configured default labels can't use them, since the rest of
+// app-exposer looks resources up by them.
+var reservedLabelKeys = []string{
+	"external-id",
+	"app-name",
+	"app-id",
+	"username",
+	"user-id",
+	"analysis-name",
+	"app-type",
+	"subdomain",
+	"login-ip",
+	"volume-name",
+	podGroupLabel,
+}
+
+// ValidateDefaultMetadata returns an error if any of the default labels or
+// annotations configured for VICE resources aren't allowed by k8s, or if a
+// default label would replace one of the labels app-exposer relies on.
+func ValidateDefaultMetadata(labels, annotations map[string]string) error {
+	problems := []string{}
+
+	for k, v := range labels {
+		for _, reserved := range reservedLabelKeys {
+			if k == reserved {
+				problems = append(problems, fmt.Sprintf("label %s is reserved", k))
+			}
+		}
+		for _, msg := range validation.IsQualifiedName(k) {
+			problems = append(problems, fmt.Sprintf("label key %s: %s", k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			problems = append(problems, fmt.Sprintf("label %s value %s: %s", k, v, msg))
+		}
+	}
+
+	for k := range annotations {
+		for _, msg := range validation.IsQualifiedName(strings.ToLower(k)) {
+			problems = append(problems, fmt.Sprintf("annotation key %s: %s", k, msg))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid default metadata: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// defaultAnnotations returns a copy of the annotations added to every resource
+// created for an analysis.
+func (i *Internal) defaultAnnotations() map[string]string {
+	annotations := map[string]string{}
+	for k, v := range i.DefaultAnnotations {
+		annotations[k] = v
+	}
+	return annotations
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDefaultMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateDefaultMetadata(nil, nil))
+	assert.NoError(ValidateDefaultMetadata(
+		map[string]string{"cost-center": "cyverse", "example.org/logging": "enabled"},
+		map[string]string{"fluentbit.io/parser": "json"},
+	))
+
+	assert.Error(ValidateDefaultMetadata(map[string]string{"external-id": "nope"}, nil))
+	assert.Error(ValidateDefaultMetadata(map[string]string{"bad key!": "value"}, nil))
+	assert.Error(ValidateDefaultMetadata(map[string]string{"cost-center": "not a valid value"}, nil))
+	assert.Error(ValidateDefaultMetadata(nil, map[string]string{"/empty-prefix": "value"}))
+}
+
+func TestDefaultLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	internal.DefaultLabels = map[string]string{
+		"cost-center": "cyverse",
+		"app-type":    "batch",
+	}
+
+	job := multiPortJob(8888)
+	job.Name = "test analysis"
+	registerUserIPQuery(mock, "127.0.0.1")
+	registerSubdomainQuery(mock, job.InvocationID, "")
+
+	labels, err := internal.labelsFromJob(job)
+	assert.NoError(err)
+	assert.Equal("cyverse", labels["cost-center"])
+	assert.Equal("interactive", labels["app-type"])
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMetaInfoPrefersAnnotations(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	job := multiPortJob(8888)
+	job.Name = "_My Analysis (v2)"
+	job.AppName = "JupyterLab Datascience"
+	job.Submitter = "first.last"
+
+	dep := appDeployment("e1", "app1")
+	dep.Labels["analysis-name"] = common.LabelValueString(job.Name)
+	dep.Labels["username"] = common.LabelValueString(job.Submitter)
+	dep.Annotations = internal.annotationsFromJob(job)
+
+	meta := internal.metaInfo(dep)
+	assert.Equal("_My Analysis (v2)", meta.AnalysisName)
+	assert.Equal("JupyterLab Datascience", meta.AppName)
+	assert.Equal("first.last", meta.Username)
+	assert.Equal("e1", meta.ExternalID)
+
+	// Resources created before the annotations were added fall back to the
+	// labels.
+	dep.Annotations = nil
+	meta = internal.metaInfo(dep)
+	assert.Equal(common.LabelValueString(job.Name), meta.AnalysisName)
+	assert.Equal(common.LabelValueString(job.Submitter), meta.Username)
+}
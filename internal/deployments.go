@@ -17,15 +17,35 @@ import (
 // One gibibyte.
 const gibibyte = 1024 * 1024 * 1024
 
+// portProtocol returns the protocol for a port declared by the app. Ports use
+// TCP unless another protocol is configured for the app. The job submission
+// doesn't say which protocol a port uses, so the configuration is the only
+// source for now.
+func (i *Internal) portProtocol(job *model.Job, port int) apiv1.Protocol {
+	protocol := strings.ToUpper(i.PortProtocols[job.AppID][strconv.Itoa(port)])
+
+	switch apiv1.Protocol(protocol) {
+	case apiv1.ProtocolUDP, apiv1.ProtocolSCTP:
+		return apiv1.Protocol(protocol)
+	case "", apiv1.ProtocolTCP:
+		return apiv1.ProtocolTCP
+	default:
+		log.Warnf("unsupported protocol %s for port %d of app %s, using TCP", protocol, port, job.AppID)
+		return apiv1.ProtocolTCP
+	}
+}
+
 // analysisPorts returns a list of container ports needed by the VICE analysis.
-func analysisPorts(step *model.Step) []apiv1.ContainerPort {
+// Port names are prefixed with the lowercased protocol.
+func (i *Internal) analysisPorts(job *model.Job) []apiv1.ContainerPort {
 	ports := []apiv1.ContainerPort{}
 
-	for i, p := range step.Component.Container.Ports {
+	for idx, p := range job.Steps[0].Component.Container.Ports {
+		protocol := i.portProtocol(job, p.ContainerPort)
 		ports = append(ports, apiv1.ContainerPort{
 			ContainerPort: int32(p.ContainerPort),
-			Name:          fmt.Sprintf("tcp-a-%d", i),
-			Protocol:      apiv1.ProtocolTCP,
+			Name:          fmt.Sprintf("%s-a-%d", strings.ToLower(string(protocol)), idx),
+			Protocol:      protocol,
 		})
 	}
 
@@ -94,13 +114,22 @@ func (i *Internal) deploymentVolumes(job *model.Job) []apiv1.Volume {
 		},
 	)
 
+	if len(auxiliarySteps(job)) > 0 {
+		output = append(output, apiv1.Volume{
+			Name: sharedVolumeName,
+			VolumeSource: apiv1.VolumeSource{
+				EmptyDir: &apiv1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+
 	return output
 }
 
 func (i *Internal) getFrontendURL(job *model.Job) *url.URL {
 	// This should be parsed in main(), so we shouldn't worry about it here.
 	frontURL, _ := url.Parse(i.FrontendBaseURL)
-	frontURL.Host = fmt.Sprintf("%s.%s", IngressName(job.UserID, job.InvocationID), frontURL.Host)
+	frontURL.Host = fmt.Sprintf("%s.%s", i.subdomain(job.UserID, job.InvocationID), frontURL.Host)
 	return frontURL
 }
 
@@ -127,6 +156,20 @@ func (i *Internal) viceProxyCommand(job *model.Job) []string {
 		"--keycloak-client-secret", i.KeycloakClientSecret,
 	}
 
+	if i.ProxyWatchdog.enabled() {
+		output = append(output, "--heartbeat-url", i.ProxyWatchdog.proxyHeartbeatURL(job.InvocationID))
+	}
+
+	if i.IdleShutdown.enabled() {
+		output = append(output, "--activity-url", i.IdleShutdown.proxyActivityURL(job.InvocationID))
+	}
+
+	if i.ExposeExtraPorts {
+		for _, route := range i.extraPortRoutes(job) {
+			output = append(output, "--port-route", route)
+		}
+	}
+
 	return output
 }
 
@@ -218,14 +261,25 @@ func (i *Internal) initContainers(job *model.Job) []apiv1.Container {
 	return output
 }
 
-func gpuEnabled(job *model.Job) bool {
-	gpuEnabled := false
-	for _, device := range job.Steps[0].Component.Container.Devices {
-		if strings.HasPrefix(strings.ToLower(device.HostPath), "/dev/nvidia") {
-			gpuEnabled = true
+// analysisVolumeMounts returns the VolumeMounts for the analysis container,
+// which give it access to the input and output files for the analysis.
+func (i *Internal) analysisVolumeMounts(job *model.Job) []apiv1.VolumeMount {
+	volumeMounts := []apiv1.VolumeMount{}
+	if i.UseCSIDriver {
+		persistentVolumeMount, err := i.getPersistentVolumeMount(job)
+		if err != nil {
+			log.Warn(err)
+		} else {
+			volumeMounts = append(volumeMounts, *persistentVolumeMount)
 		}
+	} else {
+		volumeMounts = append(volumeMounts, apiv1.VolumeMount{
+			Name:      fileTransfersVolumeName,
+			MountPath: fileTransfersMountPath(job),
+			ReadOnly:  false,
+		})
 	}
-	return gpuEnabled
+	return volumeMounts
 }
 
 func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
@@ -297,30 +351,9 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 		apiv1.ResourceMemory: memLimit, // job contains # bytes mem
 	}
 
-	// If a GPU device is configured, then add it to the resource limits.
-	if gpuEnabled(job) {
-		gpuLimit, err := resourcev1.ParseQuantity("1")
-		if err != nil {
-			log.Warn(err)
-		} else {
-			limits[apiv1.ResourceName("nvidia.com/gpu")] = gpuLimit
-		}
-	}
-
-	volumeMounts := []apiv1.VolumeMount{}
-	if i.UseCSIDriver {
-		persistentVolumeMount, err := i.getPersistentVolumeMount(job)
-		if err != nil {
-			log.Warn(err)
-		} else {
-			volumeMounts = append(volumeMounts, *persistentVolumeMount)
-		}
-	} else {
-		volumeMounts = append(volumeMounts, apiv1.VolumeMount{
-			Name:      fileTransfersVolumeName,
-			MountPath: fileTransfersMountPath(job),
-			ReadOnly:  false,
-		})
+	// If GPU devices are configured, then add them to the resource limits.
+	if gpuResource, gpuCount := gpuRequest(job); gpuCount > 0 {
+		limits[gpuResource] = *resourcev1.NewQuantity(gpuCount, resourcev1.DecimalSI)
 	}
 
 	analysisContainer := apiv1.Container{
@@ -336,8 +369,8 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 			Limits:   limits,
 			Requests: requests,
 		},
-		VolumeMounts: volumeMounts,
-		Ports:        analysisPorts(&job.Steps[0]),
+		VolumeMounts: i.analysisVolumeMounts(job),
+		Ports:        i.analysisPorts(job),
 		SecurityContext: &apiv1.SecurityContext{
 			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
 			RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
@@ -355,7 +388,11 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 			// 	},
 			// },
 		},
-		ReadinessProbe: &apiv1.Probe{
+	}
+
+	// Tools without ports are run as batch jobs, which nothing connects to.
+	if len(job.Steps[0].Component.Container.Ports) > 0 {
+		analysisContainer.ReadinessProbe = &apiv1.Probe{
 			InitialDelaySeconds: 0,
 			TimeoutSeconds:      30,
 			SuccessThreshold:    1,
@@ -368,7 +405,7 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 					Path:   "/",
 				},
 			},
-		},
+		}
 	}
 
 	if job.Steps[0].Component.Container.EntryPoint != "" {
@@ -386,6 +423,15 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 		analysisContainer.Args = append(analysisContainer.Args, job.Steps[0].Arguments()...)
 	}
 
+	// The auxiliary containers share a volume with the analysis container.
+	if len(auxiliarySteps(job)) > 0 {
+		analysisContainer.VolumeMounts = append(analysisContainer.VolumeMounts, sharedVolumeMount())
+		analysisContainer.Env = append(analysisContainer.Env, apiv1.EnvVar{
+			Name:  "VICE_SHARED_DIR",
+			Value: sharedVolumeMountPath,
+		})
+	}
+
 	return analysisContainer
 
 }
@@ -483,19 +529,13 @@ func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
 	}
 
 	output = append(output, i.defineAnalysisContainer(job))
+	output = append(output, i.auxiliaryContainers(job)...)
 	return output
 }
 
-// getDeployment assembles and returns the Deployment for the VICE analysis. It does
-// not call the k8s API.
-func (i *Internal) getDeployment(job *model.Job) (*appsv1.Deployment, error) {
-	labels, err := i.labelsFromJob(job)
-	if err != nil {
-		return nil, err
-	}
-
-	autoMount := false
-
+// analysisTolerations returns the tolerations that let the pods for the
+// analysis run on the VICE nodes, and on the GPU nodes if it needs GPUs.
+func (i *Internal) analysisTolerations(job *model.Job) []apiv1.Toleration {
 	tolerations := []apiv1.Toleration{
 		{
 			Key:      viceTolerationKey,
@@ -505,6 +545,21 @@ func (i *Internal) getDeployment(job *model.Job) (*appsv1.Deployment, error) {
 		},
 	}
 
+	if gpuEnabled(job) {
+		tolerations = append(tolerations, apiv1.Toleration{
+			Key:      gpuTolerationKey,
+			Operator: apiv1.TolerationOperator(gpuTolerationOperator),
+			Value:    gpuTolerationValue,
+			Effect:   apiv1.TaintEffect(gpuTolerationEffect),
+		})
+	}
+
+	return append(tolerations, i.DefaultTolerations...)
+}
+
+// analysisAffinity returns the node affinity that keeps the pods for the
+// analysis on the VICE nodes, and on the GPU nodes if it needs GPUs.
+func (i *Internal) analysisAffinity(job *model.Job) *apiv1.Affinity {
 	nodeSelectorRequirements := []apiv1.NodeSelectorRequirement{
 		{
 			Key:      viceAffinityKey,
@@ -516,13 +571,6 @@ func (i *Internal) getDeployment(job *model.Job) (*appsv1.Deployment, error) {
 	}
 
 	if gpuEnabled(job) {
-		tolerations = append(tolerations, apiv1.Toleration{
-			Key:      gpuTolerationKey,
-			Operator: apiv1.TolerationOperator(gpuTolerationOperator),
-			Value:    gpuTolerationValue,
-			Effect:   apiv1.TaintEffect(gpuTolerationEffect),
-		})
-
 		nodeSelectorRequirements = append(nodeSelectorRequirements, apiv1.NodeSelectorRequirement{
 			Key:      gpuAffinityKey,
 			Operator: apiv1.NodeSelectorOperator(gpuAffinityOperator),
@@ -532,50 +580,128 @@ func (i *Internal) getDeployment(job *model.Job) (*appsv1.Deployment, error) {
 		})
 	}
 
+	return &apiv1.Affinity{
+		NodeAffinity: &apiv1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
+				NodeSelectorTerms: []apiv1.NodeSelectorTerm{
+					{
+						MatchExpressions: nodeSelectorRequirements,
+					},
+				},
+			},
+		},
+	}
+}
+
+// pendingMounts holds the reference datasets and rendered config templates for
+// an analysis that hasn't been recorded or created yet.
+type pendingMounts struct {
+	referenceData   []ReferenceDataset
+	configTemplates []*apiv1.ConfigMap
+}
+
+// getDeployment assembles and returns the Deployment for the VICE analysis. It does
+// not call the k8s API.
+func (i *Internal) getDeployment(job *model.Job) (*appsv1.Deployment, error) {
+	return i.assembleDeployment(job, nil)
+}
+
+// assembleDeployment assembles the Deployment for the VICE analysis. The
+// reference datasets recorded for the analysis and its config template
+// ConfigMaps are mounted, unless pending is set, in which case its datasets
+// and config templates are mounted instead.
+func (i *Internal) assembleDeployment(job *model.Job, pending *pendingMounts) (*appsv1.Deployment, error) {
+	labels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	autoMount := false
+
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   job.InvocationID,
-			Labels: labels,
+			Name:        job.InvocationID,
+			Labels:      labels,
+			Annotations: i.annotationsFromJob(job),
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: int32Ptr(1),
 			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
+				MatchLabels: i.labelKeys.selector(map[string]string{
 					"external-id": job.InvocationID,
-				},
+				}),
 			},
 			Template: apiv1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: labels,
+					Labels:      labels,
+					Annotations: i.annotationsFromJob(job),
 				},
 				Spec: apiv1.PodSpec{
-					Hostname:                     IngressName(job.UserID, job.InvocationID),
+					Hostname:                     i.subdomain(job.UserID, job.InvocationID),
 					RestartPolicy:                apiv1.RestartPolicy("Always"),
 					Volumes:                      i.deploymentVolumes(job),
 					InitContainers:               i.initContainers(job),
 					Containers:                   i.deploymentContainers(job),
 					AutomountServiceAccountToken: &autoMount,
+					ImagePullSecrets:             i.imagePullSecrets(job),
 					SecurityContext: &apiv1.PodSecurityContext{
 						RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
 						RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
 						FSGroup:    int64Ptr(int64(job.Steps[0].Component.Container.UID)),
 					},
-					Tolerations: tolerations,
-					Affinity: &apiv1.Affinity{
-						NodeAffinity: &apiv1.NodeAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
-								NodeSelectorTerms: []apiv1.NodeSelectorTerm{
-									{
-										MatchExpressions: nodeSelectorRequirements,
-									},
-								},
-							},
-						},
-					},
+					Tolerations: i.analysisTolerations(job),
+					Affinity:    i.analysisAffinity(job),
 				},
 			},
 		},
 	}
 
+	sidecars, err := i.sidecarContainers(job)
+	if err != nil {
+		return nil, err
+	}
+	deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, sidecars...)
+
+	if i.tunnelEnabled() {
+		deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, i.tunnelContainer(job))
+	}
+
+	var datasets []ReferenceDataset
+	if pending == nil {
+		if datasets, err = i.addReferenceData(job, &deployment.Spec.Template.Spec); err != nil {
+			return nil, err
+		}
+
+		if err = i.addConfigTemplates(job, &deployment.Spec.Template.Spec); err != nil {
+			return nil, err
+		}
+	} else {
+		datasets = pending.referenceData
+		if err = mountReferenceData(job, datasets, &deployment.Spec.Template.Spec); err != nil {
+			return nil, err
+		}
+
+		mountConfigTemplates(pending.configTemplates, &deployment.Spec.Template.Spec)
+	}
+
+	appInitContainers, err := i.appInitContainers(job)
+	if err != nil {
+		return nil, err
+	}
+	deployment.Spec.Template.Spec.InitContainers = append(deployment.Spec.Template.Spec.InitContainers, appInitContainers...)
+
+	i.addPodGroup(job, deployment)
+	i.applyScheduling(job, &deployment.Spec.Template.Spec)
+
+	if err = i.applyPreemptible(job, &deployment.Spec.Template); err != nil {
+		return nil, err
+	}
+
+	if err = i.applyZones(job, &deployment.Spec.Template.Spec, datasets); err != nil {
+		return nil, err
+	}
+	deployment.Spec.Template.Spec.PriorityClassName = i.analysisPriorityClass(job)
+	i.hardenPodTemplate(job, &deployment.Spec.Template)
+
 	return deployment, nil
 }
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// mimeApplicationYAML is the content type of dry run manifests returned as
+// YAML.
+const mimeApplicationYAML = "application/yaml"
+
+// LaunchManifests contains the K8s objects that would be created to launch an
+// analysis. Objects that wouldn't be created for the analysis are omitted.
+type LaunchManifests struct {
+	ConfigMaps            []*apiv1.ConfigMap           `json:"configMaps"`
+	PersistentVolume      *apiv1.PersistentVolume      `json:"persistentVolume,omitempty"`
+	PersistentVolumeClaim *apiv1.PersistentVolumeClaim `json:"persistentVolumeClaim,omitempty"`
+	Deployment            *appsv1.Deployment           `json:"deployment"`
+	Service               *apiv1.Service               `json:"service"`
+	HeadlessService       *apiv1.Service               `json:"headlessService,omitempty"`
+	Ingress               *extv1beta1.Ingress          `json:"ingress,omitempty"`
+	NetworkPolicy         *netv1.NetworkPolicy         `json:"networkPolicy,omitempty"`
+}
+
+// objects returns the manifests in the order they're created in.
+func (m *LaunchManifests) objects() []interface{} {
+	objects := []interface{}{}
+	for _, cm := range m.ConfigMaps {
+		objects = append(objects, cm)
+	}
+	objects = append(objects, m.Deployment)
+	if m.PersistentVolume != nil {
+		objects = append(objects, m.PersistentVolume)
+	}
+	if m.PersistentVolumeClaim != nil {
+		objects = append(objects, m.PersistentVolumeClaim)
+	}
+	objects = append(objects, m.Service)
+	if m.HeadlessService != nil {
+		objects = append(objects, m.HeadlessService)
+	}
+	if m.Ingress != nil {
+		objects = append(objects, m.Ingress)
+	}
+	if m.NetworkPolicy != nil {
+		objects = append(objects, m.NetworkPolicy)
+	}
+	return objects
+}
+
+// yaml returns the manifests as a stream of YAML documents that can be fed to
+// kubectl.
+func (m *LaunchManifests) yaml() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, object := range m.objects() {
+		doc, err := yaml.Marshal(object)
+		if err != nil {
+			return nil, errors.Wrap(err, "error converting the manifests to YAML")
+		}
+		buf.WriteString("---\n")
+		buf.Write(doc)
+	}
+	return buf.Bytes(), nil
+}
+
+// placeManifest fills in the kind and namespace of a manifest, which the K8s
+// client normally fills in when the object is created. Cluster-scoped objects
+// are passed an empty namespace.
+func placeManifest(typeMeta *metav1.TypeMeta, objectMeta *metav1.ObjectMeta, apiVersion, kind, namespace string) {
+	typeMeta.APIVersion = apiVersion
+	typeMeta.Kind = kind
+	objectMeta.Namespace = namespace
+}
+
+// launchManifests assembles the objects that provisionAnalysis would create
+// for the job, without calling the k8s API to create them. The reference
+// datasets requested for the launch are mounted even though they haven't been
+// recorded for the analysis.
+func (i *Internal) launchManifests(job *model.Job, referenceData []ReferenceDataset) (*LaunchManifests, error) {
+	manifests := &LaunchManifests{ConfigMaps: []*apiv1.ConfigMap{}}
+	ns := i.ViceNamespace
+
+	excludesCM, err := i.excludesConfigMap(job)
+	if err != nil {
+		return nil, err
+	}
+
+	inputCM, err := i.inputPathListConfigMap(job)
+	if err != nil {
+		return nil, err
+	}
+
+	configTemplates, err := i.configTemplateConfigMaps(job)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests.ConfigMaps = append(manifests.ConfigMaps, excludesCM, inputCM)
+	manifests.ConfigMaps = append(manifests.ConfigMaps, configTemplates...)
+	for _, cm := range manifests.ConfigMaps {
+		placeManifest(&cm.TypeMeta, &cm.ObjectMeta, "v1", "ConfigMap", ns)
+	}
+
+	pending := &pendingMounts{referenceData: referenceData, configTemplates: configTemplates}
+	if manifests.Deployment, err = i.assembleDeployment(job, pending); err != nil {
+		return nil, err
+	}
+	placeManifest(&manifests.Deployment.TypeMeta, &manifests.Deployment.ObjectMeta, "apps/v1", "Deployment", ns)
+
+	if manifests.PersistentVolume, err = i.getPersistentVolume(job); err != nil {
+		return nil, err
+	}
+	if manifests.PersistentVolume != nil {
+		placeManifest(&manifests.PersistentVolume.TypeMeta, &manifests.PersistentVolume.ObjectMeta, "v1", "PersistentVolume", "")
+	}
+
+	if manifests.PersistentVolumeClaim, err = i.getPersistentVolumeClaim(job); err != nil {
+		return nil, err
+	}
+	if manifests.PersistentVolumeClaim != nil {
+		placeManifest(&manifests.PersistentVolumeClaim.TypeMeta, &manifests.PersistentVolumeClaim.ObjectMeta, "v1", "PersistentVolumeClaim", ns)
+	}
+
+	if manifests.Service, err = i.getService(job, manifests.Deployment); err != nil {
+		return nil, err
+	}
+	placeManifest(&manifests.Service.TypeMeta, &manifests.Service.ObjectMeta, "v1", "Service", ns)
+
+	if i.headlessServiceEnabled(job) {
+		if manifests.HeadlessService, err = i.getHeadlessService(job); err != nil {
+			return nil, err
+		}
+		placeManifest(&manifests.HeadlessService.TypeMeta, &manifests.HeadlessService.ObjectMeta, "v1", "Service", ns)
+	}
+
+	if !i.tunnelEnabled() {
+		if manifests.Ingress, err = i.getIngress(job, manifests.Service); err != nil {
+			return nil, err
+		}
+		placeManifest(&manifests.Ingress.TypeMeta, &manifests.Ingress.ObjectMeta, "extensions/v1beta1", "Ingress", ns)
+	}
+
+	if i.NetworkPolicyEnabled {
+		if manifests.NetworkPolicy, err = i.getNetworkPolicy(job); err != nil {
+			return nil, err
+		}
+		placeManifest(&manifests.NetworkPolicy.TypeMeta, &manifests.NetworkPolicy.ObjectMeta, "networking.k8s.io/v1", "NetworkPolicy", ns)
+	}
+
+	return manifests, nil
+}
+
+// dryRunLaunch responds with the manifests for the job instead of launching
+// it. They're returned as YAML if the request accepts it, or as JSON
+// otherwise.
+func (i *Internal) dryRunLaunch(c echo.Context, job *model.Job, referenceData []ReferenceDataset) error {
+	manifests, err := i.launchManifests(job, referenceData)
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "yaml") {
+		doc, err := manifests.yaml()
+		if err != nil {
+			return err
+		}
+		return c.Blob(http.StatusOK, mimeApplicationYAML, doc)
+	}
+
+	return c.JSON(http.StatusOK, manifests)
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// expectManifestQueries registers the queries made while assembling the
+// manifests for an analysis. Every object looks up the user's login IP and the
+// analysis subdomain for its labels, so they're registered generously.
+func expectManifestQueries(mock sqlmock.Sqlmock) {
+	mock.MatchExpectationsInOrder(false)
+	for n := 0; n < 20; n++ {
+		registerUserIPQuery(mock, "10.0.0.1")
+		mock.ExpectQuery("FROM vice_subdomains").WillReturnRows(sqlmock.NewRows([]string{"subdomain"}))
+	}
+
+	now := time.Now()
+	mock.ExpectQuery("FROM vice_app_config_templates").
+		WithArgs("app1").
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "name", "mount_path", "files", "created_at", "updated_at"}).
+			AddRow("app1", "rstudio", "/home/rstudio/.config/rstudio", []byte(`{"rstudio-prefs.json":"{}"}`), now, now))
+}
+
+func TestLaunchManifests(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	expectManifestQueries(mock)
+
+	job := multiPortJob(8888)
+	job.AppID = "app1"
+	datasets := []ReferenceDataset{
+		{ID: "d1", Name: "hg38", SourceType: ReferenceSourcePVC, Source: "hg38-genome", MountPath: "/reference/hg38"},
+	}
+
+	manifests, err := i.launchManifests(job, datasets)
+	assert.NoError(err)
+
+	names := []string{}
+	for _, cm := range manifests.ConfigMaps {
+		names = append(names, cm.Name)
+		assert.Equal("ConfigMap", cm.Kind)
+		assert.Equal("vice-apps", cm.Namespace)
+	}
+	assert.Equal([]string{excludesConfigMapName(job), inputPathListConfigMapName(job), "app-config-rstudio-e1"}, names)
+
+	// The pending reference data and config templates are mounted.
+	volumes := map[string]bool{}
+	for _, volume := range manifests.Deployment.Spec.Template.Spec.Volumes {
+		volumes[volume.Name] = true
+	}
+	assert.True(volumes["ref-hg38"])
+	assert.True(volumes["cfg-rstudio"])
+
+	assert.Equal("apps/v1", manifests.Deployment.APIVersion)
+	assert.Equal("Service", manifests.Service.Kind)
+	if assert.NotNil(manifests.Ingress) {
+		assert.Equal("vice-apps", manifests.Ingress.Namespace)
+	}
+	assert.Nil(manifests.NetworkPolicy)
+
+	// Nothing is created.
+	deployments, err := i.clientset.AppsV1().Deployments("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(deployments.Items)
+	configMaps, err := i.clientset.CoreV1().ConfigMaps("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(configMaps.Items)
+}
+
+func TestDryRunLaunchYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	expectManifestQueries(mock)
+
+	job := multiPortJob(8888)
+	job.AppID = "app1"
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch?dry-run=true", nil)
+	req.Header.Set(echo.HeaderAccept, mimeApplicationYAML)
+	rec := httptest.NewRecorder()
+
+	assert.NoError(i.dryRunLaunch(e.NewContext(req, rec), job, nil))
+	assert.Equal(mimeApplicationYAML, rec.Header().Get(echo.HeaderContentType))
+
+	body := rec.Body.String()
+	assert.True(strings.HasPrefix(body, "---\n"))
+	assert.Contains(body, "kind: Deployment")
+	assert.Contains(body, "kind: Ingress")
+	assert.Contains(body, "namespace: vice-apps")
+}
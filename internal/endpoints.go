@@ -0,0 +1,91 @@
+package internal
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ServiceEndpoint is a single address backing a Service.
+type ServiceEndpoint struct {
+	Address string `json:"address"`
+	Ready   bool   `json:"ready"`
+	PodName string `json:"podName"`
+}
+
+// endpointsFromSlices groups the endpoints in the EndpointSlices by the name
+// of the Service that they belong to.
+func endpointsFromSlices(slices []discoveryv1beta1.EndpointSlice) map[string][]ServiceEndpoint {
+	retval := map[string][]ServiceEndpoint{}
+
+	for _, slice := range slices {
+		svcName, ok := slice.Labels[discoveryv1beta1.LabelServiceName]
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// A nil ready condition means the state is unknown, which consumers
+			// are supposed to treat as ready.
+			ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+
+			var podName string
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				podName = endpoint.TargetRef.Name
+			}
+
+			for _, address := range endpoint.Addresses {
+				retval[svcName] = append(retval[svcName], ServiceEndpoint{
+					Address: address,
+					Ready:   ready,
+					PodName: podName,
+				})
+			}
+		}
+	}
+
+	return retval
+}
+
+// serviceEndpoints returns the endpoints for every Service in the VICE
+// namespace, keyed by Service name. Clusters that don't serve EndpointSlices
+// fall back to the older Endpoints objects.
+func (i *Internal) serviceEndpoints() (map[string][]ServiceEndpoint, error) {
+	slices, err := i.clientset.DiscoveryV1beta1().EndpointSlices(i.ViceNamespace).List(metav1.ListOptions{})
+	if err == nil {
+		return endpointsFromSlices(slices.Items), nil
+	}
+
+	log.Debugf("unable to list EndpointSlices, falling back to Endpoints: %s", err.Error())
+
+	endpoints, err := i.clientset.CoreV1().Endpoints(i.ViceNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	retval := map[string][]ServiceEndpoint{}
+	for _, ep := range endpoints.Items {
+		for _, subset := range ep.Subsets {
+			for _, address := range subset.Addresses {
+				retval[ep.Name] = append(retval[ep.Name], endpointFromAddress(address, true))
+			}
+			for _, address := range subset.NotReadyAddresses {
+				retval[ep.Name] = append(retval[ep.Name], endpointFromAddress(address, false))
+			}
+		}
+	}
+
+	return retval, nil
+}
+
+func endpointFromAddress(address apiv1.EndpointAddress, ready bool) ServiceEndpoint {
+	var podName string
+	if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+		podName = address.TargetRef.Name
+	}
+	return ServiceEndpoint{
+		Address: address.IP,
+		Ready:   ready,
+		PodName: podName,
+	}
+}
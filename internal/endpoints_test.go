@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	discoveryv1beta1 "k8s.io/api/discovery/v1beta1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func boolPointer(value bool) *bool {
+	return &value
+}
+
+func TestEndpointsFromSlices(t *testing.T) {
+	assert := assert.New(t)
+
+	slices := []discoveryv1beta1.EndpointSlice{
+		{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:   "vice-e1-abcde",
+				Labels: map[string]string{discoveryv1beta1.LabelServiceName: "vice-e1"},
+			},
+			Endpoints: []discoveryv1beta1.Endpoint{
+				{
+					Addresses:  []string{"10.0.0.1"},
+					Conditions: discoveryv1beta1.EndpointConditions{Ready: boolPointer(false)},
+					TargetRef:  &apiv1.ObjectReference{Kind: "Pod", Name: "pod-e1"},
+				},
+				{
+					Addresses: []string{"10.0.0.2"},
+				},
+			},
+		},
+		{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "unlabelled"},
+			Endpoints:  []discoveryv1beta1.Endpoint{{Addresses: []string{"10.0.0.3"}}},
+		},
+	}
+
+	endpoints := endpointsFromSlices(slices)
+	assert.Len(endpoints, 1)
+	assert.Equal([]ServiceEndpoint{
+		{Address: "10.0.0.1", Ready: false, PodName: "pod-e1"},
+		{Address: "10.0.0.2", Ready: true},
+	}, endpoints["vice-e1"])
+}
+
+func TestFilteredServicesEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	objs := []runtime.Object{
+		&apiv1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Namespace: testConfig.ViceNamespace,
+				Name:      "vice-e1",
+				Labels:    map[string]string{"app-type": "interactive"},
+			},
+		},
+		&discoveryv1beta1.EndpointSlice{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Namespace: testConfig.ViceNamespace,
+				Name:      "vice-e1-abcde",
+				Labels:    map[string]string{discoveryv1beta1.LabelServiceName: "vice-e1"},
+			},
+			Endpoints: []discoveryv1beta1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1beta1.EndpointConditions{Ready: boolPointer(true)}},
+			},
+		},
+	}
+
+	internal, _ := setupInternal(t, objs)
+
+	svcs, err := internal.getFilteredServices(map[string]string{})
+	assert.NoError(err)
+	assert.Len(svcs, 1)
+	assert.Equal(1, svcs[0].ReadyEndpoints)
+	assert.Len(svcs[0].Endpoints, 1)
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"github.com/cyverse-de/app-exposer/common"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// LaunchRequest is the request body for launching an analysis. It's the job
+// with extra settings that only apply to VICE.
+type LaunchRequest struct {
+	model.Job
+
+	// LaunchEnvironment is extra environment variables for the analysis
+	// container. They override variables of the same name from the tool.
+	LaunchEnvironment map[string]string `json:"launch_environment"`
+
+	// ReferenceData is the names of the reference datasets from the catalog
+	// to mount read-only into the analysis.
+	ReferenceData []string `json:"reference_data"`
+}
+
+// applyLaunchEnvironment checks the environment variables supplied with the
+// launch against the blocklist and adds them to the environment of the
+// analysis container.
+func (i *Internal) applyLaunchEnvironment(job *model.Job, env map[string]string) error {
+	if len(env) == 0 || len(job.Steps) == 0 {
+		return nil
+	}
+
+	if err := common.ValidateEnvironment(env, i.BlockedEnvironment); err != nil {
+		return err
+	}
+
+	if job.Steps[0].Environment == nil {
+		job.Steps[0].Environment = model.StepEnvironment{}
+	}
+	for name, value := range env {
+		job.Steps[0].Environment[name] = value
+	}
+
+	return nil
+}
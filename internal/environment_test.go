@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestLaunchRequestUnmarshal(t *testing.T) {
+	assert := assert.New(t)
+
+	request := &LaunchRequest{}
+	body := `{"uuid": "e1", "name": "analysis", "launch_environment": {"JUPYTER_ENABLE_LAB": "yes"}}`
+	assert.NoError(json.Unmarshal([]byte(body), request))
+	assert.Equal("e1", request.Job.InvocationID)
+	assert.Equal("analysis", request.Job.Name)
+	assert.Equal(map[string]string{"JUPYTER_ENABLE_LAB": "yes"}, request.LaunchEnvironment)
+}
+
+func TestApplyLaunchEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{})
+
+	job := multiPortJob(8888)
+	job.Steps[0].Environment = map[string]string{"FROM_TOOL": "tool", "OVERRIDDEN": "tool"}
+
+	assert.NoError(i.applyLaunchEnvironment(job, map[string]string{"OVERRIDDEN": "user", "NEW": "user"}))
+	assert.Equal("tool", job.Steps[0].Environment["FROM_TOOL"])
+	assert.Equal("user", job.Steps[0].Environment["OVERRIDDEN"])
+	assert.Equal("user", job.Steps[0].Environment["NEW"])
+
+	container := i.defineAnalysisContainer(job)
+	found := false
+	for _, env := range container.Env {
+		if env.Name == "NEW" && env.Value == "user" {
+			found = true
+		}
+	}
+	assert.True(found)
+}
+
+func TestApplyLaunchEnvironmentBlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{})
+	i.BlockedEnvironment = []string{"AWS_*"}
+
+	job := multiPortJob(8888)
+	assert.Error(i.applyLaunchEnvironment(job, map[string]string{"IPLANT_USER": "someone-else"}))
+	assert.Error(i.applyLaunchEnvironment(job, map[string]string{"AWS_SECRET_ACCESS_KEY": "x"}))
+	assert.Empty(job.Steps[0].Environment)
+}
@@ -0,0 +1,444 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// defaultExecCommand is run in exec sessions that don't ask for a command.
+var defaultExecCommand = []string{"/bin/sh"}
+
+const (
+	defaultExecMaxDuration = time.Hour
+	defaultExecIdleTimeout = 15 * time.Minute
+)
+
+// ExecConfig limits the exec sessions opened into analyses. Sessions are
+// closed after MaxDuration, or once the client hasn't sent anything for
+// IdleTimeout. Browsers can only open sessions from the origins listed in
+// AllowedOrigins; clients that don't send an Origin header aren't affected.
+type ExecConfig struct {
+	AllowedOrigins []string      `mapstructure:"allowed_origins"`
+	MaxDuration    time.Duration `mapstructure:"max_duration"`
+	IdleTimeout    time.Duration `mapstructure:"idle_timeout"`
+}
+
+func (e *ExecConfig) maxDuration() time.Duration {
+	if e.MaxDuration <= 0 {
+		return defaultExecMaxDuration
+	}
+	return e.MaxDuration
+}
+
+func (e *ExecConfig) idleTimeout() time.Duration {
+	if e.IdleTimeout <= 0 {
+		return defaultExecIdleTimeout
+	}
+	return e.IdleTimeout
+}
+
+// checkOrigin returns an error if the request comes from a web page on an
+// origin that isn't allowed to open exec sessions, which keeps other sites
+// from opening them with a staff member's browser.
+func (e *ExecConfig) checkOrigin(req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	for _, allowed := range e.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("exec sessions can't be opened from %s", origin))
+}
+
+// PodStreamer runs interactive commands inside of a container in a running
+// pod.
+type PodStreamer interface {
+	Stream(namespace, pod, container string, command []string, options remotecommand.StreamOptions) error
+}
+
+// Stream runs the command in the container with a terminal attached,
+// connecting it to the streams in the options until the command exits.
+func (s *SPDYExecutor) Stream(namespace, pod, container string, command []string, options remotecommand.StreamOptions) error {
+	req := s.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&apiv1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     options.Stdin != nil,
+			Stdout:    options.Stdout != nil,
+			Stderr:    options.Stderr != nil,
+			TTY:       options.Tty,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(s.config, http.MethodPost, req.URL())
+	if err != nil {
+		return errors.Wrapf(err, "error setting up exec for pod %s", pod)
+	}
+
+	return exec.Stream(options)
+}
+
+// ExecSession is the audit record of an exec session opened by a member of
+// the support staff. EndedAt is nil while the session is open.
+type ExecSession struct {
+	ID         string     `json:"id" db:"id"`
+	ExternalID string     `json:"externalID" db:"external_id"`
+	Pod        string     `json:"pod" db:"pod"`
+	Container  string     `json:"container" db:"container"`
+	Command    string     `json:"command" db:"command"`
+	Username   string     `json:"username" db:"username"`
+	RemoteAddr string     `json:"remoteAddr" db:"remote_addr"`
+	StartedAt  time.Time  `json:"startedAt" db:"started_at"`
+	EndedAt    *time.Time `json:"endedAt,omitempty" db:"ended_at"`
+	Error      string     `json:"error,omitempty" db:"error"`
+}
+
+const startExecSessionSQL = `
+	INSERT INTO vice_exec_sessions (external_id, pod, container, command, username, remote_addr, started_at)
+	VALUES ($1, $2, $3, $4, $5, $6, now())
+	RETURNING id
+`
+
+const endExecSessionSQL = `
+	UPDATE vice_exec_sessions
+	   SET ended_at = now(),
+	       error = $2
+	 WHERE id = $1
+`
+
+const listExecSessionsSQL = `
+	SELECT id, external_id, pod, container, command, username, remote_addr, started_at, ended_at, COALESCE(error, '') AS error
+	  FROM vice_exec_sessions
+	 WHERE ($1 = '' OR external_id = $1)
+	 ORDER BY started_at DESC
+	 LIMIT 100
+`
+
+// ExecMessage is a message sent by the client of an exec session. Stdin is
+// passed to the command, and Resize changes the size of its terminal.
+type ExecMessage struct {
+	Stdin  string                      `json:"stdin,omitempty"`
+	Resize *remotecommand.TerminalSize `json:"resize,omitempty"`
+}
+
+// execTerminal connects the WebSocket of an exec session to the streams of
+// the command. Messages from the client are split into the input and the
+// terminal size changes, and the output is sent back in binary frames.
+type execTerminal struct {
+	ws          *websocket.Conn
+	stdin       *io.PipeReader
+	stdinWriter *io.PipeWriter
+	resizes     chan remotecommand.TerminalSize
+	mu          sync.Mutex
+
+	activityMu   sync.Mutex
+	lastActivity time.Time
+}
+
+func newExecTerminal(ws *websocket.Conn) *execTerminal {
+	stdin, stdinWriter := io.Pipe()
+	t := &execTerminal{
+		ws:           ws,
+		stdin:        stdin,
+		stdinWriter:  stdinWriter,
+		resizes:      make(chan remotecommand.TerminalSize, 1),
+		lastActivity: time.Now(),
+	}
+
+	go func() {
+		defer close(t.resizes)
+		for {
+			msg := ExecMessage{}
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				stdinWriter.CloseWithError(err)
+				return
+			}
+			t.touch()
+			if msg.Resize != nil {
+				select {
+				case t.resizes <- *msg.Resize:
+				default:
+				}
+			}
+			if msg.Stdin != "" {
+				if _, err := stdinWriter.Write([]byte(msg.Stdin)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return t
+}
+
+func (t *execTerminal) Read(p []byte) (int, error) {
+	return t.stdin.Read(p)
+}
+
+func (t *execTerminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := websocket.Message.Send(t.ws, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// touch records that the client sent something.
+func (t *execTerminal) touch() {
+	t.activityMu.Lock()
+	defer t.activityMu.Unlock()
+	t.lastActivity = time.Now()
+}
+
+// idleFor returns how long it has been since the client sent anything.
+func (t *execTerminal) idleFor() time.Duration {
+	t.activityMu.Lock()
+	defer t.activityMu.Unlock()
+	return time.Since(t.lastActivity)
+}
+
+// end tells the client why the session is ending, then closes the command's
+// input and the connection so that the stream returns.
+func (t *execTerminal) end(reason string) {
+	t.Write([]byte("\r\n" + reason + "\r\n"))
+	t.stdinWriter.CloseWithError(io.EOF)
+	t.ws.Close()
+}
+
+// Next returns the next size of the terminal, or nil once the client is gone.
+func (t *execTerminal) Next() *remotecommand.TerminalSize {
+	size, ok := <-t.resizes
+	if !ok {
+		return nil
+	}
+	return &size
+}
+
+// execTarget returns the pod of the analysis an exec session connects to. The
+// first running pod is used if the pod isn't named, and the container has to
+// be one of the pod's.
+func (i *Internal) execTarget(externalID, podName, container string) (*apiv1.Pod, error) {
+	podList, err := i.podList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	var target *apiv1.Pod
+	for idx := range podList.Items {
+		pod := &podList.Items[idx]
+		if pod.Status.Phase != apiv1.PodRunning {
+			continue
+		}
+		if podName == "" || pod.Name == podName {
+			target = pod
+			break
+		}
+	}
+	if target == nil {
+		if podName != "" {
+			return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s has no running pod named %s", externalID, podName))
+		}
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s has no running pods", externalID))
+	}
+
+	containers := append([]apiv1.Container{}, target.Spec.InitContainers...)
+	containers = append(containers, target.Spec.Containers...)
+	for _, c := range containers {
+		if c.Name == container {
+			return target, nil
+		}
+	}
+
+	return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("pod %s has no container named %s", target.Name, container))
+}
+
+// limitExecSession ends the session once it reaches its maximum length or the
+// client goes idle, unless it's done first.
+func (i *Internal) limitExecSession(session *ExecSession, terminal *execTerminal, done <-chan struct{}) {
+	maxDuration := i.Exec.maxDuration()
+	idleTimeout := i.Exec.idleTimeout()
+
+	deadline := time.NewTimer(maxDuration)
+	defer deadline.Stop()
+	idleCheck := time.NewTicker(idleTimeout / 4)
+	defer idleCheck.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline.C:
+			log.Infof("ending exec session %s into analysis %s after %s", session.ID, session.ExternalID, maxDuration)
+			terminal.end(fmt.Sprintf("The session has reached its maximum length of %s.", maxDuration))
+			return
+		case <-idleCheck.C:
+			if terminal.idleFor() >= idleTimeout {
+				log.Infof("ending exec session %s into analysis %s after %s idle", session.ID, session.ExternalID, idleTimeout)
+				terminal.end(fmt.Sprintf("The session has been idle for %s.", idleTimeout))
+				return
+			}
+		}
+	}
+}
+
+// runExecSession streams the command over the WebSocket until either side
+// hangs up or the session reaches its limits, then records when the session
+// ended.
+func (i *Internal) runExecSession(streamer PodStreamer, session *ExecSession, command []string, ws *websocket.Conn) {
+	defer ws.Close()
+
+	log.Infof(
+		"%s opened an exec session into %s/%s of analysis %s from %s: %s",
+		session.Username, session.Pod, session.Container, session.ExternalID, session.RemoteAddr, session.Command,
+	)
+
+	terminal := newExecTerminal(ws)
+
+	done := make(chan struct{})
+	go i.limitExecSession(session, terminal, done)
+
+	err := streamer.Stream(i.ViceNamespace, session.Pod, session.Container, command, remotecommand.StreamOptions{
+		Stdin:             terminal,
+		Stdout:            terminal,
+		Tty:               true,
+		TerminalSizeQueue: terminal,
+	})
+	close(done)
+
+	var msg string
+	if err != nil {
+		msg = err.Error()
+		log.Error(errors.Wrapf(err, "exec session %s into analysis %s failed", session.ID, session.ExternalID))
+	}
+
+	if _, dbErr := i.db.Exec(endExecSessionSQL, session.ID, msg); dbErr != nil {
+		log.Error(errors.Wrapf(dbErr, "error recording the end of exec session %s", session.ID))
+	}
+
+	log.Infof("%s closed exec session %s into analysis %s", session.Username, session.ID, session.ExternalID)
+}
+
+// remoteHost returns the address of the peer that made the request. Headers
+// such as X-Forwarded-For aren't used, since the caller can set them.
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// AdminExecHandler opens an interactive session into a container of an
+// analysis pod over a WebSocket, so that support staff can debug it without
+// cluster credentials. The pod, container, and command can be chosen with
+// query parameters. The user has to be authenticated as someone allowed to
+// exec into analyses whether or not role-based access control is on, and
+// every session is recorded along with who opened it and from where.
+func (i *Internal) AdminExecHandler(c echo.Context) error {
+	streamer, ok := i.podExecutor.(PodStreamer)
+	if !ok {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "exec sessions are not enabled")
+	}
+
+	user, err := i.authenticate(c)
+	if err != nil {
+		return err
+	}
+	if role := i.roleFor(user); !role.Has(PermissionExecAnalyses) {
+		return echo.NewHTTPError(
+			http.StatusForbidden,
+			fmt.Sprintf("user %s has the %s role, which does not grant %s", user, role, PermissionExecAnalyses),
+		)
+	}
+
+	if err = i.Exec.checkOrigin(c.Request()); err != nil {
+		return err
+	}
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	container := c.QueryParam("container")
+	if container == "" {
+		container = analysisContainerName
+	}
+
+	command := c.QueryParams()["command"]
+	if len(command) == 0 {
+		command = defaultExecCommand
+	}
+
+	pod, err := i.execTarget(externalID, c.QueryParam("pod"), container)
+	if err != nil {
+		return err
+	}
+
+	session := &ExecSession{
+		ExternalID: externalID,
+		Pod:        pod.Name,
+		Container:  container,
+		Command:    strings.Join(command, " "),
+		Username:   user,
+		RemoteAddr: remoteHost(c.Request()),
+	}
+
+	err = i.db.QueryRow(
+		startExecSessionSQL,
+		session.ExternalID, session.Pod, session.Container, session.Command, session.Username, session.RemoteAddr,
+	).Scan(&session.ID)
+	if err != nil {
+		return errors.Wrapf(err, "error recording the exec session into analysis %s", externalID)
+	}
+
+	// The session runs until the connection closes, before the handler returns.
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return i.Exec.checkOrigin(req)
+		},
+		Handler: func(ws *websocket.Conn) {
+			i.runExecSession(streamer, session, command, ws)
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+// AdminListExecSessionsHandler lists the most recent exec sessions, limited to
+// a single analysis if the external-id query parameter is set.
+func (i *Internal) AdminListExecSessionsHandler(c echo.Context) error {
+	sessions := []ExecSession{}
+	if err := i.db.Select(&sessions, listExecSessionsSQL, c.QueryParam("external-id")); err != nil {
+		return errors.Wrap(err, "error listing the exec sessions")
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ExecSession{
+		"sessions": sessions,
+	})
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// echoStreamer is a PodStreamer that waits for a terminal size and a line of
+// input, then echoes the input back.
+type echoStreamer struct {
+	size *remotecommand.TerminalSize
+}
+
+func (e *echoStreamer) Stream(namespace, pod, container string, command []string, options remotecommand.StreamOptions) error {
+	e.size = options.TerminalSizeQueue.Next()
+
+	buf := make([]byte, 64)
+	n, err := options.Stdin.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	_, err = options.Stdout.Write(append([]byte("echo: "), buf[:n]...))
+	return err
+}
+
+func execPod(name string, phase apiv1.PodPhase) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "external-id": "e1"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{{Name: analysisContainerName}, {Name: "vice-proxy"}},
+		},
+		Status: apiv1.PodStatus{Phase: phase},
+	}
+}
+
+func TestExecTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{
+		execPod("pending", apiv1.PodPending),
+		execPod("running", apiv1.PodRunning),
+	})
+
+	pod, err := i.execTarget("e1", "", analysisContainerName)
+	assert.NoError(err)
+	assert.Equal("running", pod.Name)
+
+	pod, err = i.execTarget("e1", "running", "vice-proxy")
+	assert.NoError(err)
+	assert.Equal("running", pod.Name)
+
+	_, err = i.execTarget("e1", "pending", analysisContainerName)
+	assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+
+	_, err = i.execTarget("e1", "", "missing")
+	assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+
+	_, err = i.execTarget("e2", "", analysisContainerName)
+	assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+}
+
+func TestRunExecSession(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	streamer := &echoStreamer{}
+	session := &ExecSession{ID: "s1", ExternalID: "e1", Pod: "running", Container: analysisContainerName, Username: "admin"}
+
+	mock.ExpectExec("UPDATE vice_exec_sessions").WithArgs("s1", "").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	server := httptest.NewServer(websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			i.runExecSession(streamer, session, defaultExecCommand, ws)
+		},
+	})
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	defer ws.Close()
+
+	assert.NoError(websocket.JSON.Send(ws, map[string]interface{}{
+		"resize": map[string]int{"width": 80, "height": 24},
+	}))
+	assert.NoError(websocket.JSON.Send(ws, ExecMessage{Stdin: "ls\n"}))
+
+	var output []byte
+	assert.NoError(websocket.Message.Receive(ws, &output))
+	assert.Equal("echo: ls\n", string(output))
+
+	// The session is recorded as ended before the connection is closed.
+	assert.Equal(io.EOF, websocket.Message.Receive(ws, &output))
+	assert.Equal(&remotecommand.TerminalSize{Width: 80, Height: 24}, streamer.size)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+// waitingStreamer is a PodStreamer that reads input until there isn't any
+// more, like a shell waiting for commands.
+type waitingStreamer struct{}
+
+func (w *waitingStreamer) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	return "", "", nil
+}
+
+func (w *waitingStreamer) Stream(namespace, pod, container string, command []string, options remotecommand.StreamOptions) error {
+	_, err := io.Copy(ioutil.Discard, options.Stdin)
+	return err
+}
+
+func TestRunExecSessionIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	i.Exec.IdleTimeout = 50 * time.Millisecond
+	session := &ExecSession{ID: "s1", ExternalID: "e1", Pod: "running", Container: analysisContainerName, Username: "admin"}
+
+	mock.ExpectExec("UPDATE vice_exec_sessions").WithArgs("s1", "").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	server := httptest.NewServer(websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			i.runExecSession(&waitingStreamer{}, session, defaultExecCommand, ws)
+		},
+	})
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	defer ws.Close()
+
+	// The client never sends anything, so the session is ended.
+	var output []byte
+	assert.NoError(websocket.Message.Receive(ws, &output))
+	assert.Contains(string(output), "idle")
+	assert.Equal(io.EOF, websocket.Message.Receive(ws, &output))
+
+	// The end of the session is recorded after the connection is closed.
+	assert.Eventually(func() bool {
+		return mock.ExpectationsWereMet() == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestExecCheckOrigin(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &ExecConfig{AllowedOrigins: []string{"https://de.cyverse.org/"}}
+
+	req := httptest.NewRequest(http.MethodGet, "/vice/admin/analyses/a1/exec", nil)
+	assert.NoError(config.checkOrigin(req))
+
+	req.Header.Set("Origin", "https://de.cyverse.org")
+	assert.NoError(config.checkOrigin(req))
+
+	req.Header.Set("Origin", "https://evil.example.com")
+	assert.Error(config.checkOrigin(req))
+}
+
+func TestAdminExecHandlerAuthentication(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, nil)
+	i.podExecutor = &waitingStreamer{}
+	i.IdentityKey = testIdentityKey
+	i.RoleMembers = map[string][]string{"operator": {"olivia"}, "admin": {"alice"}}
+
+	call := func(token, origin string) error {
+		req := httptest.NewRequest(http.MethodGet, "/vice/admin/analyses/a1/exec?user=alice", nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		c.SetParamNames("analysis-id")
+		c.SetParamValues("a1")
+		return i.AdminExecHandler(c)
+	}
+
+	// The user parameter isn't enough on its own.
+	err := call("", "")
+	if assert.Error(err) {
+		assert.Equal(http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+	}
+
+	err = call(userToken(t, "olivia"), "")
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	err = call(userToken(t, "alice"), "https://evil.example.com")
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.5:43210"
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	req.Header.Set("X-Real-IP", "192.168.1.1")
+	assert.Equal(t, "10.0.0.5", remoteHost(req))
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// UserFreeze records that a user has been blocked from launching new VICE
+// analyses and why.
+type UserFreeze struct {
+	Username string    `json:"username" db:"username"`
+	Reason   string    `json:"reason" db:"reason"`
+	FrozenAt time.Time `json:"frozenAt" db:"frozen_at"`
+}
+
+const getUserFreezeSQL = `
+	SELECT username, reason, frozen_at
+	  FROM vice_user_freezes
+	 WHERE username = $1
+`
+
+const freezeUserSQL = `
+	INSERT INTO vice_user_freezes (username, reason, frozen_at)
+	VALUES ($1, $2, now())
+	ON CONFLICT (username) DO UPDATE
+	   SET reason = EXCLUDED.reason,
+	       frozen_at = EXCLUDED.frozen_at
+`
+
+const unfreezeUserSQL = `
+	DELETE FROM vice_user_freezes
+	 WHERE username = $1
+`
+
+// getUserFreeze returns the freeze for the user, or nil if the user isn't
+// frozen. The username is expected to include the user suffix.
+func (i *Internal) getUserFreeze(username string) (*UserFreeze, error) {
+	freeze := &UserFreeze{}
+	err := i.db.QueryRowx(getUserFreezeSQL, username).StructScan(freeze)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the launch freeze for %s", username)
+	}
+	return freeze, nil
+}
+
+// validateNotFrozen returns an error naming the reason if the user has been
+// frozen.
+func (i *Internal) validateNotFrozen(user string) (int, error) {
+	freeze, err := i.getUserFreeze(i.fixUsername(user))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if freeze != nil {
+		return http.StatusBadRequest, common.ErrorResponse{
+			ErrorCode: "ERR_USER_FROZEN",
+			Message:   fmt.Sprintf("%s is not currently permitted to launch analyses: %s", user, freeze.Reason),
+			Details: &map[string]interface{}{
+				"reason":   freeze.Reason,
+				"frozenAt": freeze.FrozenAt,
+			},
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// FreezeRequest is the request body for freezing a user.
+type FreezeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AdminFreezeUserHandler blocks new launches for a user. Analyses the user
+// already has running are left alone.
+func (i *Internal) AdminFreezeUserHandler(c echo.Context) error {
+	username := c.Param("username")
+	if username == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "username parameter is empty")
+	}
+	username = i.fixUsername(username)
+
+	request := &FreezeRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if request.Reason == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "a reason for the freeze is required")
+	}
+
+	if _, err := i.db.Exec(freezeUserSQL, username, request.Reason); err != nil {
+		return errors.Wrapf(err, "error freezing %s", username)
+	}
+
+	log.Infof("launches frozen for %s: %s", username, request.Reason)
+
+	freeze, err := i.getUserFreeze(username)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, freeze)
+}
+
+// AdminUnfreezeUserHandler allows a frozen user to launch analyses again.
+func (i *Internal) AdminUnfreezeUserHandler(c echo.Context) error {
+	username := c.Param("username")
+	if username == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "username parameter is empty")
+	}
+	username = i.fixUsername(username)
+
+	if _, err := i.db.Exec(unfreezeUserSQL, username); err != nil {
+		return errors.Wrapf(err, "error unfreezing %s", username)
+	}
+
+	log.Infof("launches unfrozen for %s", username)
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// GPUBudget is how many of the GPU-hours in their plan's monthly budget a user
+// has used. Time that analyses spend paused isn't counted. BudgetHours and
+// RemainingHours are nil if the user's plan doesn't have a budget.
+type GPUBudget struct {
+	Plan           string    `json:"plan,omitempty"`
+	PeriodStart    time.Time `json:"periodStart"`
+	PeriodEnd      time.Time `json:"periodEnd"`
+	UsedHours      float64   `json:"usedHours"`
+	BudgetHours    *float64  `json:"budgetHours"`
+	RemainingHours *float64  `json:"remainingHours"`
+}
+
+// gpuBudgetPeriod returns the start and end of the calendar month, in UTC,
+// that GPU-hours are budgeted over.
+func gpuBudgetPeriod(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// Analyses that are still running count up to now.
+const gpuHoursUsedSQL = `
+	SELECT COALESCE(sum(gpus * GREATEST(EXTRACT(EPOCH FROM COALESCE(stopped_at, now()) - GREATEST(started_at, $2)), 0)), 0) / 3600
+	  FROM vice_usage_records
+	 WHERE username = $1
+	   AND gpus > 0
+	   AND (stopped_at IS NULL OR stopped_at > $2)
+`
+
+// gpuBudget returns the user's GPU budget for the period containing now,
+// using the usage recorded by the accounting subsystem.
+func (i *Internal) gpuBudget(ctx context.Context, user string, now time.Time) (*GPUBudget, error) {
+	start, end := gpuBudgetPeriod(now)
+	budget := &GPUBudget{PeriodStart: start, PeriodEnd: end}
+
+	// Usage is recorded under the submitter's username, without the suffix.
+	username := strings.TrimSuffix(user, i.UserSuffix)
+	if err := i.db.QueryRowContext(ctx, gpuHoursUsedSQL, username, start).Scan(&budget.UsedHours); err != nil {
+		return nil, errors.Wrapf(err, "error adding up the GPU-hours used by %s", user)
+	}
+
+	plan, err := i.newApps().GetUserPlan(ctx, i.fixUsername(user))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the plan for %s", user)
+	}
+
+	if plan != nil {
+		budget.Plan = plan.Name
+		if plan.GPUHours != nil {
+			remaining := *plan.GPUHours - budget.UsedHours
+			if remaining < 0 {
+				remaining = 0
+			}
+			budget.BudgetHours = plan.GPUHours
+			budget.RemainingHours = &remaining
+		}
+	}
+
+	return budget, nil
+}
+
+// validateGPUBudget rejects launches that request GPUs once the submitter has
+// used up their plan's GPU-hours for the month, when quotas are enforced.
+func (i *Internal) validateGPUBudget(ctx context.Context, job *model.Job) (int, error) {
+	if !i.Quotas.Enabled || len(job.Steps) == 0 {
+		return http.StatusOK, nil
+	}
+
+	if _, gpus := gpuRequest(job); gpus == 0 {
+		return http.StatusOK, nil
+	}
+
+	return i.validateGPUHoursLeft(ctx, job.Submitter)
+}
+
+// validateGPUHoursLeft rejects the use of GPUs by a user who has used up their
+// plan's GPU-hours for the month.
+func (i *Internal) validateGPUHoursLeft(ctx context.Context, user string) (int, error) {
+	budget, err := i.gpuBudget(ctx, user, time.Now())
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if budget.RemainingHours == nil || *budget.RemainingHours > 0 {
+		return http.StatusOK, nil
+	}
+
+	return http.StatusBadRequest, common.ErrorResponse{
+		ErrorCode: "ERR_GPU_BUDGET_EXHAUSTED",
+		Message: fmt.Sprintf(
+			"%s has used all %v GPU-hours the %s plan allows until %s",
+			user, *budget.BudgetHours, budget.Plan, budget.PeriodEnd.Format("2006-01-02"),
+		),
+		Details: &map[string]interface{}{
+			"plan":        budget.Plan,
+			"usedHours":   budget.UsedHours,
+			"budgetHours": *budget.BudgetHours,
+			"periodEnd":   budget.PeriodEnd,
+		},
+	}
+}
+
+// analysisGPUs returns the number of GPUs requested by the analysis containers
+// of the analysis's deployments.
+func (i *Internal) analysisGPUs(externalID string) (int64, error) {
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return 0, errors.Wrapf(err, "error listing the deployments of analysis %s", externalID)
+	}
+
+	usage := &ResourceUsage{}
+	for idx := range deplist.Items {
+		usage.addRequests(&deplist.Items[idx].Spec.Template.Spec)
+	}
+
+	return usage.GPUs, nil
+}
+
+// GPUBudgetHandler returns how much of their plan's GPU-hours budget for the
+// month the user in the 'user' query parameter has left.
+func (i *Internal) GPUBudgetHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user is not set")
+	}
+
+	budget, err := i.gpuBudget(c.Request().Context(), user, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, budget)
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var gpuPlanColumns = []string{"name", "max_cpu_cores", "max_memory", "max_gpus", "max_concurrent_jobs", "total_cpu_cores", "total_memory", "gpu_hours"}
+
+func expectGPUBudget(mock sqlmock.Sqlmock, used float64, budget interface{}) {
+	mock.ExpectQuery("FROM vice_usage_records").
+		WithArgs("test-user", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"hours"}).AddRow(used))
+	mock.ExpectQuery("FROM user_plans").
+		WithArgs("test-user" + testConfig.UserSuffix).
+		WillReturnRows(sqlmock.NewRows(gpuPlanColumns).AddRow("GPU", nil, nil, nil, nil, nil, nil, budget))
+}
+
+func TestGPUBudgetPeriod(t *testing.T) {
+	start, end := gpuBudgetPeriod(time.Date(2020, 12, 15, 3, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), end)
+}
+
+func TestValidateGPUBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.Quotas.Enabled = true
+
+	job := deviceJob("/dev/nvidia0")
+	job.Submitter = "test-user"
+
+	expectGPUBudget(mock, 9.5, 10.0)
+	status, err := i.validateGPUBudget(context.Background(), job)
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	expectGPUBudget(mock, 10.25, 10.0)
+	status, err = i.validateGPUBudget(context.Background(), job)
+	assert.Equal(400, status)
+	if assert.Error(err) {
+		assert.Equal("ERR_GPU_BUDGET_EXHAUSTED", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	// Plans without a budget don't limit GPU time.
+	expectGPUBudget(mock, 500.0, nil)
+	status, err = i.validateGPUBudget(context.Background(), job)
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	// Launches without GPUs aren't checked.
+	job = multiPortJob(8888)
+	job.Submitter = "test-user"
+	status, err = i.validateGPUBudget(context.Background(), job)
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestGPUBudgetHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	expectGPUBudget(mock, 4.0, 10.0)
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/vice/my/gpu-budget?user=test-user", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(i.GPUBudgetHandler(e.NewContext(req, rec)))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	var budget GPUBudget
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &budget))
+	assert.Equal("GPU", budget.Plan)
+	assert.Equal(4.0, budget.UsedHours)
+	if assert.NotNil(budget.RemainingHours) {
+		assert.Equal(6.0, *budget.RemainingHours)
+	}
+}
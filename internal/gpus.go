@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	nvidiaGPUResource = apiv1.ResourceName("nvidia.com/gpu")
+	amdGPUResource    = apiv1.ResourceName("amd.com/gpu")
+)
+
+// gpuResources are the extended resources that VICE analyses can request GPUs
+// through.
+var gpuResources = []apiv1.ResourceName{nvidiaGPUResource, amdGPUResource}
+
+var (
+	// nvidiaDeviceRegexp matches the device files for individual NVIDIA GPUs,
+	// but not the control devices like /dev/nvidiactl and /dev/nvidia-uvm.
+	nvidiaDeviceRegexp = regexp.MustCompile(`^/dev/nvidia[0-9]+$`)
+
+	// amdRenderDeviceRegexp matches the render nodes for individual AMD GPUs.
+	// It's matched against lowercased paths.
+	amdRenderDeviceRegexp = regexp.MustCompile(`^/dev/dri/renderd[0-9]+$`)
+)
+
+// gpuRequest returns the extended resource and the number of GPUs requested by
+// the tool in the job. Tools ask for GPUs by mapping the vendor's device files
+// into the container. One GPU is requested for each device file for an
+// individual GPU, and at least one is requested if any of the vendor's device
+// files are mapped. An empty resource name means no GPUs were requested.
+func gpuRequest(job *model.Job) (apiv1.ResourceName, int64) {
+	var (
+		nvidia, amd           bool
+		nvidiaCount, amdCount int64
+	)
+
+	for _, device := range job.Steps[0].Component.Container.Devices {
+		hostPath := strings.ToLower(device.HostPath)
+
+		switch {
+		case strings.HasPrefix(hostPath, "/dev/nvidia"):
+			nvidia = true
+			if nvidiaDeviceRegexp.MatchString(hostPath) {
+				nvidiaCount++
+			}
+		case hostPath == "/dev/kfd":
+			amd = true
+		case amdRenderDeviceRegexp.MatchString(hostPath):
+			amdCount++
+		}
+	}
+
+	switch {
+	case nvidia:
+		if nvidiaCount == 0 {
+			nvidiaCount = 1
+		}
+		return nvidiaGPUResource, nvidiaCount
+	case amd:
+		if amdCount == 0 {
+			amdCount = 1
+		}
+		return amdGPUResource, amdCount
+	default:
+		return "", 0
+	}
+}
+
+func gpuEnabled(job *model.Job) bool {
+	_, count := gpuRequest(job)
+	return count > 0
+}
+
+// gpuAllocation returns the GPU resource and count from the limits of the
+// container. An empty resource name means the container has no GPUs.
+func gpuAllocation(container *apiv1.Container) (string, int64) {
+	for _, resource := range gpuResources {
+		if quantity, ok := container.Resources.Limits[resource]; ok {
+			return string(resource), quantity.Value()
+		}
+	}
+	return "", 0
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// deviceJob returns a job whose tool maps the given host devices.
+func deviceJob(hostPaths ...string) *model.Job {
+	job := multiPortJob(8888)
+	for _, p := range hostPaths {
+		job.Steps[0].Component.Container.Devices = append(
+			job.Steps[0].Component.Container.Devices,
+			model.Device{HostPath: p, ContainerPath: p},
+		)
+	}
+	return job
+}
+
+func TestGPURequest(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		devices  []string
+		resource apiv1.ResourceName
+		count    int64
+	}{
+		{nil, "", 0},
+		{[]string{"/dev/fuse"}, "", 0},
+		{[]string{"/dev/nvidiactl", "/dev/nvidia-uvm"}, nvidiaGPUResource, 1},
+		{[]string{"/dev/nvidia0", "/dev/nvidia1", "/dev/nvidiactl"}, nvidiaGPUResource, 2},
+		{[]string{"/dev/kfd"}, amdGPUResource, 1},
+		{[]string{"/dev/kfd", "/dev/dri/renderD128", "/dev/dri/renderD129"}, amdGPUResource, 2},
+	}
+
+	for _, test := range tests {
+		resource, count := gpuRequest(deviceJob(test.devices...))
+		assert.Equal(test.resource, resource, "%v", test.devices)
+		assert.Equal(test.count, count, "%v", test.devices)
+	}
+}
+
+func TestGPUAllocation(t *testing.T) {
+	assert := assert.New(t)
+
+	container := &apiv1.Container{}
+	resource, count := gpuAllocation(container)
+	assert.Empty(resource)
+	assert.Zero(count)
+
+	container.Resources.Limits = apiv1.ResourceList{
+		nvidiaGPUResource: *resourcev1.NewQuantity(2, resourcev1.DecimalSI),
+	}
+	resource, count = gpuAllocation(container)
+	assert.Equal("nvidia.com/gpu", resource)
+	assert.Equal(int64(2), count)
+}
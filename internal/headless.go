@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"fmt"
+
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// podGroupLabel is the label that the headless Service for an analysis selects
+// on. Helper pods started by the analysis should have it so that they can be
+// found through DNS. It's separate from the external-id label so that the
+// helper pods aren't adopted by the analysis Deployment.
+const podGroupLabel = "vice-pod-group"
+
+// headlessServiceEnabled returns true if a headless Service should be created
+// for the analysis.
+func (i *Internal) headlessServiceEnabled(job *model.Job) bool {
+	for _, appID := range i.HeadlessServiceApps {
+		if appID == job.AppID {
+			return true
+		}
+	}
+	return false
+}
+
+func headlessServiceName(job *model.Job) string {
+	return fmt.Sprintf("vice-%s-pods", job.InvocationID)
+}
+
+// addPodGroup sets up the analysis pods to be found through the headless
+// Service. The pods get the pod group label and use the Service as their DNS
+// subdomain, so they resolve as <hostname>.<service>.<namespace>.svc.
+func (i *Internal) addPodGroup(job *model.Job, deployment *appsv1.Deployment) {
+	if !i.headlessServiceEnabled(job) {
+		return
+	}
+
+	labels := map[string]string{}
+	for k, v := range deployment.Spec.Template.Labels {
+		labels[k] = v
+	}
+	labels[podGroupLabel] = job.InvocationID
+
+	deployment.Spec.Template.Labels = labels
+	deployment.Spec.Template.Spec.Subdomain = headlessServiceName(job)
+}
+
+// getHeadlessService assembles and returns the headless Service for the VICE
+// analysis. It does not call the k8s API.
+func (i *Internal) getHeadlessService(job *model.Job) (*apiv1.Service, error) {
+	labels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []apiv1.ServicePort{}
+	for _, port := range i.analysisPorts(job) {
+		ports = append(ports, apiv1.ServicePort{
+			Name:       port.Name,
+			Protocol:   port.Protocol,
+			Port:       port.ContainerPort,
+			TargetPort: intstr.FromInt(int(port.ContainerPort)),
+		})
+	}
+
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        headlessServiceName(job),
+			Labels:      labels,
+			Annotations: i.annotationsFromJob(job),
+		},
+		Spec: apiv1.ServiceSpec{
+			ClusterIP: apiv1.ClusterIPNone,
+			Selector: map[string]string{
+				podGroupLabel: job.InvocationID,
+			},
+			Ports: ports,
+
+			// Workers need to find each other while they're starting up.
+			PublishNotReadyAddresses: true,
+		},
+	}, nil
+}
+
+// UpsertHeadlessService creates the headless Service for the analysis if one
+// is enabled for the app. The Service has the external-id label, so it's
+// cleaned up along with the rest of the analysis Services.
+func (i *Internal) UpsertHeadlessService(job *model.Job) error {
+	if !i.headlessServiceEnabled(job) {
+		return nil
+	}
+
+	svc, err := i.getHeadlessService(job)
+	if err != nil {
+		return err
+	}
+
+	return i.applyObject(i.ViceNamespace, svc, func() error {
+		svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
+		_, err := svcclient.Get(svc.Name, metav1.GetOptions{})
+		if err != nil {
+			_, err = svcclient.Create(svc)
+		}
+		return err
+	})
+}
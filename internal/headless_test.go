@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpsertHeadlessService(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	job := multiPortJob(8888, 8786)
+	job.Name = "dask"
+	job.AppID = "app1"
+
+	// Nothing is created for apps that don't need it.
+	assert.NoError(internal.UpsertHeadlessService(job))
+
+	internal.HeadlessServiceApps = []string{"app1"}
+	registerUserIPQuery(mock, "127.0.0.1")
+	registerSubdomainQuery(mock, job.InvocationID, "")
+	assert.NoError(internal.UpsertHeadlessService(job))
+
+	svc, err := internal.clientset.CoreV1().Services(internal.ViceNamespace).Get(headlessServiceName(job), meta_v1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(apiv1.ClusterIPNone, svc.Spec.ClusterIP)
+	assert.Equal(map[string]string{podGroupLabel: job.InvocationID}, svc.Spec.Selector)
+	assert.Equal(job.InvocationID, svc.Labels["external-id"])
+	assert.Len(svc.Spec.Ports, 2)
+	assert.True(svc.Spec.PublishNotReadyAddresses)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAddPodGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	job := multiPortJob(8888)
+	job.AppID = "app1"
+
+	labels := map[string]string{"external-id": job.InvocationID}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: meta_v1.ObjectMeta{Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{ObjectMeta: meta_v1.ObjectMeta{Labels: labels}},
+		},
+	}
+
+	internal.addPodGroup(job, deployment)
+	assert.NotContains(deployment.Spec.Template.Labels, podGroupLabel)
+
+	internal.HeadlessServiceApps = []string{"app1"}
+	internal.addPodGroup(job, deployment)
+	assert.Equal(job.InvocationID, deployment.Spec.Template.Labels[podGroupLabel])
+	assert.Equal(headlessServiceName(job), deployment.Spec.Template.Spec.Subdomain)
+
+	// The Deployment's own labels are left alone.
+	assert.NotContains(deployment.Labels, podGroupLabel)
+}
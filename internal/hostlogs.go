@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// uuidPattern matches analysis IDs. Hosts share the logs route with analysis
+// IDs, and subdomains that look like UUIDs can't be requested.
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// allContainers is the container query parameter value that asks for the
+// logs of every container in the pod, including the init containers.
+const allContainers = "all"
+
+// The logs are read into memory before they're sent, so how much of them is
+// returned is capped. Requests that don't set tailLines get the last
+// defaultHostLogTailLines lines of each container, tailLines can't be more
+// than maxHostLogTailLines, and no more than maxHostLogBytes are returned for
+// all of the containers together.
+const (
+	defaultHostLogTailLines = 1000
+	maxHostLogTailLines     = 10000
+	maxHostLogBytes         = 10 * 1024 * 1024
+)
+
+// hostLogOptions returns the log options from the query parameters of the
+// request. The container is filled in for each container separately.
+func hostLogOptions(c echo.Context) (*apiv1.PodLogOptions, error) {
+	tailLines := int64(defaultHostLogTailLines)
+	opts := &apiv1.PodLogOptions{TailLines: &tailLines}
+
+	if value := c.QueryParam("tailLines"); value != "" {
+		tailLines, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || tailLines < 1 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tailLines must be a positive integer, not %s", value))
+		}
+		if tailLines > maxHostLogTailLines {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("tailLines can't be more than %d", maxHostLogTailLines))
+		}
+		opts.TailLines = &tailLines
+	}
+
+	if value := c.QueryParam("sinceTime"); value != "" {
+		sinceTime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("sinceTime must be an RFC 3339 timestamp, not %s", value))
+		}
+		since := metav1.NewTime(sinceTime)
+		opts.SinceTime = &since
+	}
+
+	if value := c.QueryParam("previous"); value != "" {
+		previous, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("previous must be true or false, not %s", value))
+		}
+		opts.Previous = previous
+	}
+
+	return opts, nil
+}
+
+// logContainers returns the containers of the pod whose logs were asked for,
+// in the order they're listed in the pod. The analysis container is used if
+// none were asked for.
+func logContainers(pod *apiv1.Pod, requested []string) ([]string, error) {
+	names := []string{}
+	for _, container := range pod.Spec.InitContainers {
+		names = append(names, container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+
+	if len(requested) == 0 {
+		requested = []string{analysisContainerName}
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range requested {
+		if name == allContainers {
+			return names, nil
+		}
+		wanted[name] = true
+	}
+
+	containers := []string{}
+	for _, name := range names {
+		if wanted[name] {
+			containers = append(containers, name)
+			delete(wanted, name)
+		}
+	}
+
+	if len(wanted) > 0 {
+		missing := []string{}
+		for name := range wanted {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("pod %s has no container named %s", pod.Name, strings.Join(missing, ", ")))
+	}
+
+	return containers, nil
+}
+
+// containerLogs returns the logs of a container in the pod. No more than
+// LimitBytes are read if it's set.
+func (i *Internal) containerLogs(pod, container string, opts apiv1.PodLogOptions) ([]byte, error) {
+	opts.Container = container
+	opts.Follow = false
+
+	stream, err := i.clientset.CoreV1().Pods(i.ViceNamespace).GetLogs(pod, &opts).Stream()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting the logs of container %s in pod %s", container, pod)
+	}
+	defer stream.Close()
+
+	var reader io.Reader = stream
+	if opts.LimitBytes != nil {
+		reader = io.LimitReader(stream, *opts.LimitBytes)
+	}
+
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, reader); err != nil {
+		return nil, errors.Wrapf(err, "error reading the logs of container %s in pod %s", container, pod)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// hostLogsResponse returns the container logs of the analysis served from the
+// host as a text file. When the logs of more than one container are asked for,
+// each is preceded by a header naming the container, and a container whose
+// logs can't be read gets the error instead. If user isn't empty, they have to
+// be allowed to access the analysis.
+//
+// The container query parameter names the container to return the logs of. It
+// can be repeated, and 'all' returns the logs of every container, including
+// the init containers. It defaults to the analysis container. The tailLines,
+// sinceTime (an RFC 3339 timestamp), and previous query parameters are passed
+// along to Kubernetes. Only the last defaultHostLogTailLines lines of each
+// container are returned unless tailLines says otherwise, and the response is
+// cut off at maxHostLogBytes, with any containers past that listed without
+// their logs.
+func (i *Internal) hostLogsResponse(c echo.Context, host, user string) error {
+	opts, err := hostLogOptions(c)
+	if err != nil {
+		return err
+	}
+
+	filter, err := i.hostFilter(host)
+	if err != nil {
+		return err
+	}
+
+	podList, err := i.podList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return err
+	}
+	if len(podList.Items) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no analysis found for host %s", host))
+	}
+
+	// Prefer a running pod, since the others may not have any logs yet.
+	pod := &podList.Items[0]
+	for idx := range podList.Items {
+		if podList.Items[idx].Status.Phase == apiv1.PodRunning {
+			pod = &podList.Items[idx]
+			break
+		}
+	}
+
+	if user != "" {
+		analysisID, err := i.newApps().GetAnalysisIDByExternalID(c.Request().Context(), i.labelKeys.get(pod.Labels, "external-id"))
+		if err != nil {
+			return errors.Wrapf(err, "error looking up the analysis ID for host %s", host)
+		}
+
+		allowed, err := i.permissions.IsAllowed(c.Request().Context(), user, analysisID)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
+		}
+	}
+
+	containers, err := logContainers(pod, c.QueryParams()["container"])
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	for _, container := range containers {
+		remaining := int64(maxHostLogBytes - body.Len())
+		if remaining <= 0 {
+			fmt.Fprintf(&body, "==> %s <==\nomitted, since the logs are limited to %d bytes\n", container, maxHostLogBytes)
+			continue
+		}
+		opts.LimitBytes = &remaining
+
+		logs, err := i.containerLogs(pod.Name, container, *opts)
+		if len(containers) == 1 {
+			if err != nil {
+				return err
+			}
+			body.Write(logs)
+			break
+		}
+
+		fmt.Fprintf(&body, "==> %s <==\n", container)
+		if err != nil {
+			fmt.Fprintf(&body, "%s\n", err.Error())
+		} else {
+			body.Write(logs)
+		}
+		if body.Len() > 0 && body.Bytes()[body.Len()-1] != '\n' {
+			body.WriteByte('\n')
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", host+"-logs.txt"))
+	return c.Blob(http.StatusOK, echo.MIMETextPlainCharsetUTF8, body.Bytes())
+}
+
+// AdminHostLogsHandler returns the container logs of the analysis served from
+// the host without requiring user information.
+func (i *Internal) AdminHostLogsHandler(c echo.Context) error {
+	return i.hostLogsResponse(c, c.Param("host"), "")
+}
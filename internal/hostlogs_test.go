@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func logsPod(name, host string, phase apiv1.PodPhase) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "subdomain": host, "external-id": "e1"},
+		},
+		Spec: apiv1.PodSpec{
+			InitContainers: []apiv1.Container{{Name: "input-files-init"}},
+			Containers: []apiv1.Container{
+				{Name: analysisContainerName},
+				{Name: "vice-proxy"},
+			},
+		},
+		Status: apiv1.PodStatus{Phase: phase},
+	}
+}
+
+func logsContext(target string) (echo.Context, *httptest.ResponseRecorder) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("host")
+	c.SetParamValues("my-notebook")
+	return c, rec
+}
+
+func TestHostLogOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	c, _ := logsContext("/vice/admin/my-notebook/logs?tailLines=10&sinceTime=2020-01-01T00:00:00Z&previous=true")
+	opts, err := hostLogOptions(c)
+	assert.NoError(err)
+	assert.Equal(int64(10), *opts.TailLines)
+	assert.Equal(2020, opts.SinceTime.Year())
+	assert.True(opts.Previous)
+
+	// The number of lines is capped whether or not it's asked for.
+	c, _ = logsContext("/vice/admin/my-notebook/logs")
+	opts, err = hostLogOptions(c)
+	assert.NoError(err)
+	assert.Equal(int64(defaultHostLogTailLines), *opts.TailLines)
+
+	for _, query := range []string{"tailLines=0", "tailLines=ten", "tailLines=10001", "sinceTime=yesterday", "previous=maybe"} {
+		c, _ = logsContext("/vice/admin/my-notebook/logs?" + query)
+		_, err = hostLogOptions(c)
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code, query)
+	}
+}
+
+func TestLogContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := logsPod("p1", "my-notebook", apiv1.PodRunning)
+
+	containers, err := logContainers(pod, nil)
+	assert.NoError(err)
+	assert.Equal([]string{analysisContainerName}, containers)
+
+	containers, err = logContainers(pod, []string{"vice-proxy", "input-files-init"})
+	assert.NoError(err)
+	assert.Equal([]string{"input-files-init", "vice-proxy"}, containers)
+
+	containers, err = logContainers(pod, []string{allContainers})
+	assert.NoError(err)
+	assert.Equal([]string{"input-files-init", analysisContainerName, "vice-proxy"}, containers)
+
+	_, err = logContainers(pod, []string{"vice-proxy", "sidecar"})
+	assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+}
+
+func TestAdminHostLogsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		logsPod("p1", "my-notebook", apiv1.PodRunning),
+	})
+
+	// The fake clientset can't stream logs, so only the lookups are exercised.
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("my-notebook").
+		WillReturnError(sql.ErrNoRows)
+
+	c, _ := logsContext("/vice/admin/my-notebook/logs?container=sidecar")
+	err := i.AdminHostLogsHandler(c)
+	assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	assert.Equal("pod p1 has no container named sidecar", err.(*echo.HTTPError).Message)
+
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("other").
+		WillReturnError(sql.ErrNoRows)
+
+	c, _ = logsContext("/vice/admin/other/logs")
+	c.SetParamValues("other")
+	err = i.AdminHostLogsHandler(c)
+	assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+
+	c, _ = logsContext("/vice/admin/my-notebook/logs?tailLines=-1")
+	err = i.AdminHostLogsHandler(c)
+	assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
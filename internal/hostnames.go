@@ -0,0 +1,541 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+const defaultHostnameCheckInterval = time.Hour
+
+// PersistentHostnameConfig lets users on the listed plans claim a hostname
+// for an app. The claimed hostname is moved to each new analysis of the app
+// the user launches, so it always reaches the most recent one. Every
+// CheckInterval, the claims of users who are no longer on one of the plans are
+// released.
+type PersistentHostnameConfig struct {
+	Plans         []string      `mapstructure:"plans"`
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+}
+
+func (p *PersistentHostnameConfig) enabled() bool {
+	return len(p.Plans) > 0
+}
+
+func (p *PersistentHostnameConfig) checkInterval() time.Duration {
+	if p.CheckInterval <= 0 {
+		return defaultHostnameCheckInterval
+	}
+	return p.CheckInterval
+}
+
+// HostnameClaim is a hostname a user has claimed for an app. ExternalID is
+// the analysis the hostname was last routed to, which is empty until the user
+// runs the app.
+type HostnameClaim struct {
+	Hostname   string    `json:"hostname" db:"hostname"`
+	Username   string    `json:"username" db:"username"`
+	AppID      string    `json:"appID" db:"app_id"`
+	ExternalID string    `json:"externalID,omitempty" db:"external_id"`
+	ClaimedAt  time.Time `json:"claimedAt" db:"claimed_at"`
+}
+
+// HostnameClaimRequest is the request body for claiming a hostname.
+type HostnameClaimRequest struct {
+	AppID string `json:"appID"`
+}
+
+const hostnameClaimColumns = `
+	SELECT hostname, username, app_id, COALESCE(external_id, '') AS external_id, claimed_at
+	  FROM vice_hostname_claims
+`
+
+const getHostnameClaimSQL = hostnameClaimColumns + `
+	 WHERE hostname = $1
+`
+
+const getAppHostnameClaimSQL = hostnameClaimColumns + `
+	 WHERE username = $1
+	   AND app_id = $2
+`
+
+const listUserHostnameClaimsSQL = hostnameClaimColumns + `
+	 WHERE username = $1
+	 ORDER BY hostname
+`
+
+const listHostnameClaimsSQL = hostnameClaimColumns + `
+	 ORDER BY hostname
+`
+
+const insertHostnameClaimSQL = `
+	INSERT INTO vice_hostname_claims (hostname, username, app_id, claimed_at)
+	VALUES ($1, $2, $3, now())
+	RETURNING hostname, username, app_id, COALESCE(external_id, '') AS external_id, claimed_at
+`
+
+const routeHostnameClaimSQL = `
+	UPDATE vice_hostname_claims
+	   SET external_id = $2
+	 WHERE hostname = $1
+`
+
+const unrouteHostnameClaimsSQL = `
+	UPDATE vice_hostname_claims
+	   SET external_id = NULL
+	 WHERE external_id = $1
+`
+
+const deleteHostnameClaimSQL = `
+	DELETE FROM vice_hostname_claims
+	 WHERE hostname = $1
+`
+
+// queryHostnameClaim returns the claim found by the query, or nil if there
+// isn't one.
+func (i *Internal) queryHostnameClaim(query string, args ...interface{}) (*HostnameClaim, error) {
+	claim := &HostnameClaim{}
+	err := i.db.QueryRowx(query, args...).StructScan(claim)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// hostnameClaim returns the claim on the hostname, or nil if it's unclaimed.
+func (i *Internal) hostnameClaim(hostname string) (*HostnameClaim, error) {
+	claim, err := i.queryHostnameClaim(getHostnameClaimSQL, hostname)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the claim on hostname %s", hostname)
+	}
+	return claim, nil
+}
+
+// appHostnameClaim returns the hostname the user has claimed for the app, or
+// nil if they haven't claimed one.
+func (i *Internal) appHostnameClaim(username, appID string) (*HostnameClaim, error) {
+	claim, err := i.queryHostnameClaim(getAppHostnameClaimSQL, username, appID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the hostname %s claimed for app %s", username, appID)
+	}
+	return claim, nil
+}
+
+// hostnamesAllowed returns true if the user's plan lets them claim hostnames.
+// The username should include the domain suffix.
+func (i *Internal) hostnamesAllowed(ctx context.Context, username string) (bool, error) {
+	plan, err := i.newApps().GetUserPlan(ctx, username)
+	if err != nil {
+		return false, errors.Wrapf(err, "error looking up the plan for %s", username)
+	}
+	if plan == nil {
+		return false, nil
+	}
+
+	for _, name := range i.PersistentHostnames.Plans {
+		if plan.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// detachHostname stops routing the claimed hostname to the analysis it was
+// last routed to. That analysis keeps its generated subdomain. Nothing is
+// done if the analysis has since been given a different subdomain.
+func (i *Internal) detachHostname(claim *HostnameClaim, userID string) error {
+	if claim.ExternalID == "" {
+		return nil
+	}
+
+	current, err := i.vanitySubdomain(claim.ExternalID)
+	if err != nil {
+		return err
+	}
+	if current != claim.Hostname {
+		return nil
+	}
+
+	if err = i.releaseSubdomain(claim.ExternalID); err != nil {
+		return err
+	}
+
+	if err = i.applySubdomain(claim.ExternalID, IngressName(userID, claim.ExternalID)); err != nil {
+		return errors.Wrapf(err, "error removing hostname %s from analysis %s", claim.Hostname, claim.ExternalID)
+	}
+
+	i.publishSubdomainEvent(SubdomainReleased, claim.ExternalID, claim.Hostname)
+
+	return nil
+}
+
+// attachHostname records the claimed hostname as the subdomain of the
+// analysis. The resources of the analysis aren't updated, so the caller has
+// to do that if they already exist.
+func (i *Internal) attachHostname(claim *HostnameClaim, externalID string) error {
+	if _, err := i.db.Exec(setVanitySubdomainSQL, externalID, claim.Hostname); err != nil {
+		if isUniqueViolation(err) {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("hostname %s is in use by another analysis", claim.Hostname))
+		}
+		return errors.Wrapf(err, "error setting the subdomain for %s to %s", externalID, claim.Hostname)
+	}
+
+	if _, err := i.db.Exec(routeHostnameClaimSQL, claim.Hostname, externalID); err != nil {
+		return errors.Wrapf(err, "error routing hostname %s to %s", claim.Hostname, externalID)
+	}
+
+	claim.ExternalID = externalID
+	return nil
+}
+
+// unrouteHostnameClaims clears the routing of any hostnames claimed for the
+// analysis without giving up the claims themselves.
+func (i *Internal) unrouteHostnameClaims(externalID string) error {
+	if _, err := i.db.Exec(unrouteHostnameClaimsSQL, externalID); err != nil {
+		return errors.Wrapf(err, "error clearing the hostnames routed to %s", externalID)
+	}
+	return nil
+}
+
+// releaseHostnameClaim removes the claim and the hostname from the analysis it
+// was routed to.
+func (i *Internal) releaseHostnameClaim(claim *HostnameClaim, userID string) error {
+	if err := i.detachHostname(claim, userID); err != nil {
+		return err
+	}
+
+	if _, err := i.db.Exec(deleteHostnameClaimSQL, claim.Hostname); err != nil {
+		return errors.Wrapf(err, "error releasing hostname %s", claim.Hostname)
+	}
+
+	log.Infof("released hostname %s claimed by %s", claim.Hostname, claim.Username)
+	return nil
+}
+
+// routeClaimedHostname moves the hostname the submitter has claimed for the
+// app to the analysis being launched, before any of its resources are
+// created. A claim the submitter's plan no longer allows is released instead.
+func (i *Internal) routeClaimedHostname(ctx context.Context, job *model.Job) error {
+	if !i.PersistentHostnames.enabled() || job.AppID == "" {
+		return nil
+	}
+
+	username := i.fixUsername(job.Submitter)
+	claim, err := i.appHostnameClaim(username, job.AppID)
+	if err != nil || claim == nil {
+		return err
+	}
+
+	allowed, err := i.hostnamesAllowed(ctx, username)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return i.releaseHostnameClaim(claim, job.UserID)
+	}
+
+	if err = i.detachHostname(claim, job.UserID); err != nil {
+		return err
+	}
+
+	return i.attachHostname(claim, job.InvocationID)
+}
+
+// latestAppAnalysis returns the external ID of the user's most recently
+// launched analysis of the app that's still running, or an empty string if
+// there isn't one.
+func (i *Internal) latestAppAnalysis(userID, appID string) (string, error) {
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{"user-id": userID, "app-id": appID}, []string{})
+	if err != nil {
+		return "", err
+	}
+
+	var latest string
+	var launched time.Time
+	for _, dep := range deplist.Items {
+		if latest == "" || dep.CreationTimestamp.Time.After(launched) {
+			latest = i.labelKeys.get(dep.Labels, "external-id")
+			launched = dep.CreationTimestamp.Time
+		}
+	}
+
+	return latest, nil
+}
+
+// claimHostname claims the hostname for the user and app and routes it to the
+// user's most recent running analysis of the app, if there is one.
+func (i *Internal) claimHostname(username, userID, appID, hostname string) (*HostnameClaim, error) {
+	if err := validateSubdomain(hostname); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	existing, err := i.hostnameClaim(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.Username == username && existing.AppID == appID {
+			return existing, nil
+		}
+		return nil, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("hostname %s is already claimed", hostname))
+	}
+
+	existing, err = i.appHostnameClaim(username, appID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, echo.NewHTTPError(
+			http.StatusConflict,
+			fmt.Sprintf("hostname %s is already claimed for app %s; release it first", existing.Hostname, appID),
+		)
+	}
+
+	var owner string
+	err = i.db.QueryRow(getExternalIDBySubdomainSQL, hostname).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrapf(err, "error looking up the analysis for subdomain %s", hostname)
+	}
+	if err == nil {
+		return nil, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("hostname %s is in use by another analysis", hostname))
+	}
+
+	// The checks above are only there for the error messages. Claims made at
+	// the same time are settled by the unique constraints on the table.
+	claim := &HostnameClaim{}
+	if err = i.db.QueryRowx(insertHostnameClaimSQL, hostname, username, appID).StructScan(claim); err != nil {
+		if isUniqueViolation(err) {
+			return nil, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("hostname %s or app %s is already claimed", hostname, appID))
+		}
+		return nil, errors.Wrapf(err, "error claiming hostname %s", hostname)
+	}
+
+	externalID, err := i.latestAppAnalysis(userID, appID)
+	if err != nil || externalID == "" {
+		return claim, err
+	}
+
+	previous, err := i.vanitySubdomain(externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another analysis may have been given the hostname as its subdomain
+	// since it was checked, in which case the claim is given up again.
+	if err = i.attachHostname(claim, externalID); err != nil {
+		if _, deleteErr := i.db.Exec(deleteHostnameClaimSQL, hostname); deleteErr != nil {
+			log.Error(errors.Wrapf(deleteErr, "error removing the claim on hostname %s", hostname))
+		}
+		return nil, err
+	}
+
+	if err = i.applySubdomain(externalID, hostname); err != nil {
+		return nil, errors.Wrapf(err, "error routing hostname %s to analysis %s", hostname, externalID)
+	}
+
+	if previous != "" {
+		i.publishSubdomainEvent(SubdomainReleased, externalID, previous)
+	}
+	i.publishSubdomainEvent(SubdomainAllocated, externalID, hostname)
+
+	return claim, nil
+}
+
+// releaseUnentitledHostnames releases the hostnames claimed by users whose
+// plans no longer allow them.
+func (i *Internal) releaseUnentitledHostnames() error {
+	claims := []HostnameClaim{}
+	if err := i.db.Select(&claims, listHostnameClaimsSQL); err != nil {
+		return errors.Wrap(err, "error listing the hostname claims")
+	}
+
+	allowed := map[string]bool{}
+	unentitled := []*HostnameClaim{}
+	usernames := []string{}
+	for idx := range claims {
+		claim := &claims[idx]
+
+		ok, checked := allowed[claim.Username]
+		if !checked {
+			var err error
+			if ok, err = i.hostnamesAllowed(context.Background(), claim.Username); err != nil {
+				log.Error(err)
+				continue
+			}
+			allowed[claim.Username] = ok
+			if !ok {
+				usernames = append(usernames, claim.Username)
+			}
+		}
+		if !ok {
+			unentitled = append(unentitled, claim)
+		}
+	}
+
+	if len(unentitled) == 0 {
+		return nil
+	}
+
+	a := i.newApps()
+	userIDs, err := a.GetUserIDs(context.Background(), usernames)
+	if err != nil {
+		return errors.Wrap(err, "error looking up the user IDs of the hostname claims")
+	}
+
+	for _, claim := range unentitled {
+		userID, ok := userIDs[claim.Username]
+		if !ok {
+			log.Errorf("user ID for %s not found", claim.Username)
+			continue
+		}
+
+		if err = i.releaseHostnameClaim(claim, userID); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// StartHostnameReleases periodically releases the hostnames claimed by users
+// who have left the plans that allow them. It does nothing unless persistent
+// hostnames are turned on.
+func (i *Internal) StartHostnameReleases() {
+	if !i.PersistentHostnames.enabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(i.PersistentHostnames.checkInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := i.releaseUnentitledHostnames(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// queryUser returns the username and user ID of the user in the 'user'
+// query parameter.
+func (i *Internal) queryUser(c echo.Context) (string, string, error) {
+	user := c.QueryParam("user")
+	if user == "" {
+		return "", "", echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	username := i.fixUsername(user)
+	userID, err := i.newApps().GetUserID(c.Request().Context(), username)
+	if err == sql.ErrNoRows {
+		return "", "", echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", username))
+	}
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error looking up the user ID for %s", username)
+	}
+
+	return username, userID, nil
+}
+
+// ListHostnamesHandler lists the hostnames claimed by the user in the 'user'
+// query parameter.
+func (i *Internal) ListHostnamesHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	claims := []HostnameClaim{}
+	if err := i.db.Select(&claims, listUserHostnameClaimsSQL, i.fixUsername(user)); err != nil {
+		return errors.Wrapf(err, "error listing the hostnames claimed by %s", user)
+	}
+
+	return c.JSON(http.StatusOK, map[string][]HostnameClaim{
+		"hostnames": claims,
+	})
+}
+
+// ClaimHostnameHandler claims the hostname in the URL for the app in the body
+// of the request on behalf of the user in the 'user' query parameter. The
+// user's plan has to allow persistent hostnames.
+func (i *Internal) ClaimHostnameHandler(c echo.Context) error {
+	if !i.PersistentHostnames.enabled() {
+		return echo.NewHTTPError(http.StatusBadRequest, "persistent hostnames are not enabled")
+	}
+
+	hostname := c.Param("hostname")
+
+	request := &HostnameClaimRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if request.AppID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "appID is required")
+	}
+
+	username, userID, err := i.queryUser(c)
+	if err != nil {
+		return err
+	}
+
+	allowed, err := i.hostnamesAllowed(c.Request().Context(), username)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("the plan for %s does not include persistent hostnames", username))
+	}
+
+	claim, err := i.claimHostname(username, userID, request.AppID, hostname)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, claim)
+}
+
+// ReleaseHostnameHandler releases a hostname claimed by the user in the
+// 'user' query parameter.
+func (i *Internal) ReleaseHostnameHandler(c echo.Context) error {
+	hostname := c.Param("hostname")
+
+	username, userID, err := i.queryUser(c)
+	if err != nil {
+		return err
+	}
+
+	claim, err := i.hostnameClaim(hostname)
+	if err != nil {
+		return err
+	}
+	if claim == nil || claim.Username != username {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%s has not claimed hostname %s", username, hostname))
+	}
+
+	if err = i.releaseHostnameClaim(claim, userID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminListHostnamesHandler lists every claimed hostname.
+func (i *Internal) AdminListHostnamesHandler(c echo.Context) error {
+	claims := []HostnameClaim{}
+	if err := i.db.Select(&claims, listHostnameClaimsSQL); err != nil {
+		return errors.Wrap(err, "error listing the hostname claims")
+	}
+
+	return c.JSON(http.StatusOK, map[string][]HostnameClaim{
+		"hostnames": claims,
+	})
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var hostnameClaimRows = []string{"hostname", "username", "app_id", "external_id", "claimed_at"}
+
+// userAppDeployment returns the Deployment for an analysis of the app run by
+// user u1, launched at the given time.
+func userAppDeployment(externalID, appID string, launched time.Time) *appsv1.Deployment {
+	dep := appDeployment(externalID, appID)
+	dep.Labels["user-id"] = "u1"
+	dep.CreationTimestamp = metav1.NewTime(launched)
+	return dep
+}
+
+func registerPlanQuery(mock sqlmock.Sqlmock, username, plan string) {
+	mock.ExpectQuery("FROM user_plans").
+		WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "max_cpu_cores", "max_memory", "max_gpus"}).
+			AddRow(plan, nil, nil, nil))
+}
+
+func TestRouteClaimedHostname(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.PersistentHostnames.Plans = []string{"Pro"}
+
+	username := "alice" + testConfig.UserSuffix
+	job := &model.Job{InvocationID: "e1", AppID: "app1", Submitter: "alice", UserID: "u1"}
+
+	mock.ExpectQuery("FROM vice_hostname_claims").
+		WithArgs(username, "app1").
+		WillReturnRows(sqlmock.NewRows(hostnameClaimRows).AddRow("mylab", username, "app1", "e0", time.Now()))
+	registerPlanQuery(mock, username, "Pro")
+
+	// The hostname moves from the previous analysis to the new one.
+	registerSubdomainQuery(mock, "e0", "mylab")
+	mock.ExpectExec("DELETE FROM vice_subdomains").WithArgs("e0").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO vice_subdomains").WithArgs("e1", "mylab").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE vice_hostname_claims").WithArgs("mylab", "e1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.routeClaimedHostname(context.Background(), job))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRouteClaimedHostnameDowngraded(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.PersistentHostnames.Plans = []string{"Pro"}
+
+	username := "alice" + testConfig.UserSuffix
+	job := &model.Job{InvocationID: "e1", AppID: "app1", Submitter: "alice", UserID: "u1"}
+
+	mock.ExpectQuery("FROM vice_hostname_claims").
+		WithArgs(username, "app1").
+		WillReturnRows(sqlmock.NewRows(hostnameClaimRows).AddRow("mylab", username, "app1", "e0", time.Now()))
+	registerPlanQuery(mock, username, "Basic")
+
+	// The previous analysis has since been given a different subdomain, so
+	// only the claim is released.
+	registerSubdomainQuery(mock, "e0", "other")
+	mock.ExpectExec("DELETE FROM vice_hostname_claims").WithArgs("mylab").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.routeClaimedHostname(context.Background(), job))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestClaimHostname(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	i, mock := setupInternal(t, []runtime.Object{
+		userAppDeployment("e0", "app1", now.Add(-2*time.Hour)),
+		userAppDeployment("e2", "app1", now.Add(-time.Hour)),
+	})
+	i.PersistentHostnames.Plans = []string{"Pro"}
+
+	username := "alice" + testConfig.UserSuffix
+
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs(username, "app1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO vice_hostname_claims").
+		WithArgs("mylab", username, "app1").
+		WillReturnRows(sqlmock.NewRows(hostnameClaimRows).AddRow("mylab", username, "app1", "", now))
+
+	// The hostname is routed to the most recent analysis of the app.
+	registerSubdomainQuery(mock, "e2", "")
+	mock.ExpectExec("INSERT INTO vice_subdomains").WithArgs("e2", "mylab").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE vice_hostname_claims").WithArgs("mylab", "e2").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	claim, err := i.claimHostname(username, "u1", "app1", "mylab")
+	assert.NoError(err)
+	assert.Equal("e2", claim.ExternalID)
+
+	dep, err := i.clientset.AppsV1().Deployments("vice-apps").Get("e2", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("mylab", dep.Labels["subdomain"])
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestClaimHostnameConflict(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.PersistentHostnames.Plans = []string{"Pro"}
+
+	username := "alice" + testConfig.UserSuffix
+
+	// Claimed by someone else.
+	mock.ExpectQuery("FROM vice_hostname_claims").
+		WithArgs("mylab").
+		WillReturnRows(sqlmock.NewRows(hostnameClaimRows).AddRow("mylab", "bob"+testConfig.UserSuffix, "app1", "", time.Now()))
+
+	_, err := i.claimHostname(username, "u1", "app1", "mylab")
+	assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	// In use as the subdomain of an analysis.
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs(username, "app1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("mylab").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e9"))
+
+	_, err = i.claimHostname(username, "u1", "app1", "mylab")
+	assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	// Not a valid subdomain.
+	_, err = i.claimHostname(username, "u1", "app1", "My.Lab")
+	assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestClaimHostnameRace(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	i, mock := setupInternal(t, []runtime.Object{userAppDeployment("e2", "app1", now)})
+	i.PersistentHostnames.Plans = []string{"Pro"}
+
+	username := "alice" + testConfig.UserSuffix
+
+	// Claimed by someone else after the checks.
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs(username, "app1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO vice_hostname_claims").
+		WithArgs("mylab", username, "app1").
+		WillReturnError(&pq.Error{Code: uniqueViolation})
+
+	_, err := i.claimHostname(username, "u1", "app1", "mylab")
+	assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	// Given to another analysis as its subdomain after the checks, so the
+	// claim is removed again.
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_hostname_claims").WithArgs(username, "app1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO vice_hostname_claims").
+		WithArgs("mylab", username, "app1").
+		WillReturnRows(sqlmock.NewRows(hostnameClaimRows).AddRow("mylab", username, "app1", "", now))
+	registerSubdomainQuery(mock, "e2", "")
+	mock.ExpectExec("INSERT INTO vice_subdomains").
+		WithArgs("e2", "mylab").
+		WillReturnError(&pq.Error{Code: uniqueViolation})
+	mock.ExpectExec("DELETE FROM vice_hostname_claims").WithArgs("mylab").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	_, err = i.claimHostname(username, "u1", "app1", "mylab")
+	assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestReleaseUnentitledHostnames(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.PersistentHostnames.Plans = []string{"Pro"}
+
+	alice := "alice" + testConfig.UserSuffix
+	bob := "bob" + testConfig.UserSuffix
+
+	mock.ExpectQuery("FROM vice_hostname_claims").
+		WillReturnRows(sqlmock.NewRows(hostnameClaimRows).
+			AddRow("alicelab", alice, "app1", "", time.Now()).
+			AddRow("boblab", bob, "app1", "", time.Now()))
+	registerPlanQuery(mock, alice, "Pro")
+	registerPlanQuery(mock, bob, "Basic")
+	mock.ExpectQuery("SELECT u.username, u.id FROM users u").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow(bob, "u2"))
+	mock.ExpectExec("DELETE FROM vice_hostname_claims").WithArgs("boblab").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.releaseUnentitledHostnames())
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestSetSubdomainClaimed(t *testing.T) {
+	i, mock := setupInternal(t, nil)
+	i.PersistentHostnames.Plans = []string{"Pro"}
+
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").WithArgs("mylab").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_hostname_claims").
+		WithArgs("mylab").
+		WillReturnRows(sqlmock.NewRows(hostnameClaimRows).AddRow("mylab", "bob", "app1", "e0", time.Now()))
+
+	assert.Error(t, i.setSubdomain("e1", "mylab"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// launchRequestTimeout is how long a launch request is considered to be in
+// progress. Requests older than that are assumed to have died along with the
+// replica handling them, so a retry is allowed to take over.
+const launchRequestTimeout = 30 * time.Minute
+
+const beginLaunchRequestSQL = `
+	INSERT INTO vice_launch_requests (external_id, started_at)
+	VALUES ($1, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET started_at = EXCLUDED.started_at
+	 WHERE vice_launch_requests.started_at < now() - $2 * interval '1 second'
+`
+
+const endLaunchRequestSQL = `
+	DELETE FROM vice_launch_requests
+	 WHERE external_id = $1
+`
+
+// launchesInProgress keeps track of the analyses whose launch requests are
+// being handled, keyed by external ID, so that a request that's retried while
+// the first one is still provisioning doesn't provision the analysis again.
+// The keys are kept in the database so that they're seen by every replica and
+// survive restarts.
+type launchesInProgress struct {
+	db *sqlx.DB
+}
+
+func newLaunchesInProgress(db *sqlx.DB) *launchesInProgress {
+	return &launchesInProgress{db: db}
+}
+
+// begin records that the analysis is being launched. It returns false if
+// another request is already launching it.
+func (l *launchesInProgress) begin(externalID string) (bool, error) {
+	result, err := l.db.Exec(beginLaunchRequestSQL, externalID, launchRequestTimeout.Seconds())
+	if err != nil {
+		return false, errors.Wrapf(err, "error recording the launch request for analysis %s", externalID)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "error recording the launch request for analysis %s", externalID)
+	}
+
+	return rows > 0, nil
+}
+
+// end records that the request launching the analysis has finished.
+func (l *launchesInProgress) end(externalID string) {
+	if _, err := l.db.Exec(endLaunchRequestSQL, externalID); err != nil {
+		log.Error(errors.Wrapf(err, "error removing the launch request for analysis %s", externalID))
+	}
+}
+
+// ExistingLaunch describes an analysis that a launch request was already
+// received for. Queued is set if it's waiting in the launch queue, and
+// Deployment is set if its resources have been created. Neither is set if
+// another request is still provisioning it.
+type ExistingLaunch struct {
+	ExternalID string          `json:"externalID"`
+	Queued     *QueuePosition  `json:"queued,omitempty"`
+	Deployment *DeploymentInfo `json:"deployment,omitempty"`
+}
+
+// queuedPosition returns the position of the analysis in the launch queue, or
+// nil if it isn't queued.
+func (i *Internal) queuedPosition(externalID string) (*QueuePosition, error) {
+	positions, err := i.positionsFor("")
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range positions {
+		if positions[idx].ExternalID == externalID {
+			return &positions[idx], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// existingLaunch returns the analysis if it's already queued or its
+// Deployment already exists, or nil if it hasn't been launched. The state of
+// the analysis is checked first, since an analysis that's been shut down or
+// is on its way out isn't something a retry should be handed back, and it
+// can't be launched again either.
+func (i *Internal) existingLaunch(externalID string) (*ExistingLaunch, error) {
+	record, err := i.getAnalysisState(externalID)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil && (record.State.IsTerminal() || record.State == TerminatingState) {
+		return nil, echo.NewHTTPError(
+			http.StatusConflict,
+			fmt.Sprintf("analysis %s has already been launched and is %s", externalID, record.State),
+		)
+	}
+
+	position, err := i.queuedPosition(externalID)
+	if err != nil {
+		return nil, err
+	}
+	if position != nil {
+		return &ExistingLaunch{ExternalID: externalID, Queued: position}, nil
+	}
+
+	depList, err := i.deploymentList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if len(depList.Items) > 0 {
+		return &ExistingLaunch{ExternalID: externalID, Deployment: i.deploymentInfo(&depList.Items[0])}, nil
+	}
+
+	return nil, nil
+}
+
+// respond sends the existing analysis in response to a retried launch. Launches
+// that haven't been provisioned yet get the same 202 Accepted response they
+// got the first time.
+func (e *ExistingLaunch) respond(c echo.Context) error {
+	if e.Deployment == nil {
+		return c.JSON(http.StatusAccepted, launchAccepted(e.ExternalID, e.Queued))
+	}
+	return c.JSON(http.StatusOK, e)
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// retryLaunch sends a launch request for the analysis and returns the
+// response along with the handler's error.
+func retryLaunch(t *testing.T, i *Internal, externalID string) (*httptest.ResponseRecorder, error) {
+	e := echo.New()
+	body := `{"uuid": "` + externalID + `", "username": "alice"}`
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	err := i.LaunchAppHandler(e.NewContext(req, rec))
+	return rec, err
+}
+
+// expectLaunchRequest registers the recording of a launch request for the
+// analysis. The request is already in progress if begun is false.
+func expectLaunchRequest(mock sqlmock.Sqlmock, externalID string, begun bool) {
+	var rows int64
+	if begun {
+		rows = 1
+	}
+	mock.ExpectExec("INSERT INTO vice_launch_requests").
+		WithArgs(externalID, launchRequestTimeout.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, rows))
+}
+
+// expectLaunchRequestEnd registers the removal of the launch request for the
+// analysis once it's been handled.
+func expectLaunchRequestEnd(mock sqlmock.Sqlmock, externalID string) {
+	mock.ExpectExec("DELETE FROM vice_launch_requests").
+		WithArgs(externalID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestLaunchAlreadyDeployed(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{appDeployment("e1", "app1")})
+
+	expectLaunchRequest(mock, "e1", true)
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	expectLaunchRequestEnd(mock, "e1")
+
+	rec, err := retryLaunch(t, i, "e1")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	var existing ExistingLaunch
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &existing))
+	assert.Equal("e1", existing.ExternalID)
+	if assert.NotNil(existing.Deployment) {
+		assert.Equal("e1", existing.Deployment.ExternalID)
+	}
+}
+
+func TestLaunchAlreadyFinished(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{appDeployment("e1", "app1")})
+
+	// The Deployment of an analysis that's shutting down isn't handed back.
+	expectLaunchRequest(mock, "e1", true)
+	terminating := TerminatingState
+	registerStateQuery(mock, "e1", &terminating)
+	expectLaunchRequestEnd(mock, "e1")
+
+	_, err := retryLaunch(t, i, "e1")
+	if assert.Error(err) {
+		assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchAlreadyQueued(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.launchQueue.launches = append(i.launchQueue.launches, queued("e1", "alice", time.Now()))
+
+	expectLaunchRequest(mock, "e1", true)
+	requested := RequestedState
+	registerStateQuery(mock, "e1", &requested)
+	expectLaunchRequestEnd(mock, "e1")
+
+	rec, err := retryLaunch(t, i, "e1")
+	assert.NoError(err)
+	assert.Equal(http.StatusAccepted, rec.Code)
+
+	var accepted LaunchAccepted
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &accepted))
+	assert.Equal("/vice/launches/e1", accepted.StatusURL)
+	if assert.NotNil(accepted.Queued) {
+		assert.Equal(1, accepted.Queued.Position)
+	}
+
+	// The retry doesn't queue the launch a second time.
+	assert.Len(i.launchQueue.launches, 1)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchAlreadyInProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+
+	// Another request, possibly on another replica, holds the launch.
+	expectLaunchRequest(mock, "e1", false)
+
+	rec, err := retryLaunch(t, i, "e1")
+	assert.NoError(err)
+	assert.Equal(http.StatusAccepted, rec.Code)
+
+	// The retry gets the same response as the request that's provisioning it.
+	var accepted LaunchAccepted
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &accepted))
+	assert.Equal(LaunchAccepted{LaunchID: "e1", StatusURL: "/vice/launches/e1"}, accepted)
+	assert.NoError(mock.ExpectationsWereMet())
+}
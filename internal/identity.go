@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// identityClockSkew is how far the expiration and not-before times of an
+// identity token can be off from the local clock.
+const identityClockSkew = time.Minute
+
+// identityClaims are the claims of an identity token that are checked.
+type identityClaims struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	ExpiresAt         int64  `json:"exp"`
+	NotBefore         int64  `json:"nbf"`
+}
+
+// username returns the user the token was issued for.
+func (c *identityClaims) username() string {
+	if c.PreferredUsername != "" {
+		return c.PreferredUsername
+	}
+	return c.Subject
+}
+
+// verifyIdentityToken checks the signature and lifetime of a JWT signed with
+// HS256 using the key, and returns the user it was issued for.
+func verifyIdentityToken(token string, key []byte, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("the identity token is malformed")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding the header of the identity token")
+	}
+	header := struct {
+		Algorithm string `json:"alg"`
+	}{}
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		return "", errors.Wrap(err, "error parsing the header of the identity token")
+	}
+	if header.Algorithm != "HS256" {
+		return "", fmt.Errorf("identity tokens signed with %q are not accepted", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding the signature of the identity token")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("the signature of the identity token is invalid")
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding the claims of the identity token")
+	}
+	claims := &identityClaims{}
+	if err = json.Unmarshal(claimsJSON, claims); err != nil {
+		return "", errors.Wrap(err, "error parsing the claims of the identity token")
+	}
+
+	if claims.ExpiresAt == 0 {
+		return "", errors.New("the identity token has no expiration time")
+	}
+	if now.Add(-identityClockSkew).After(time.Unix(claims.ExpiresAt, 0)) {
+		return "", errors.New("the identity token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(identityClockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return "", errors.New("the identity token is not valid yet")
+	}
+	if claims.username() == "" {
+		return "", errors.New("the identity token does not name a user")
+	}
+
+	return claims.username(), nil
+}
+
+// SignIdentityToken returns an identity token for the user that expires at
+// the given time, signed with the configured identity key. It's for tools
+// such as the load tester that call the routes as a user.
+func (i *Internal) SignIdentityToken(user string, expires time.Time) (string, error) {
+	if i.IdentityKey == "" {
+		return "", errors.New("no identity key is configured")
+	}
+
+	headerJSON, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(map[string]interface{}{
+		"preferred_username": user,
+		"exp":                expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	mac := hmac.New(sha256.New, []byte(i.IdentityKey))
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// authenticatedUser returns the user named in the identity token in the
+// Authorization header. The token is a JWT signed with HS256 using the
+// configured identity key by the service that authenticated the user. The
+// user in the 'user' query parameter isn't trusted, since the caller sets it.
+func (i *Internal) authenticatedUser(c echo.Context) (string, error) {
+	if i.IdentityKey == "" {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, "no identity key is configured, so users can't be authenticated")
+	}
+
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, "an identity token is required")
+	}
+
+	user, err := verifyIdentityToken(strings.TrimPrefix(auth, "Bearer "), []byte(i.IdentityKey), time.Now())
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+
+	return i.fixUsername(user), nil
+}
+
+// identifiedUser returns the user named in the identity token of the request,
+// or an empty string if it doesn't have a valid one. It's for recording who
+// did something on routes that don't require a token.
+func (i *Internal) identifiedUser(c echo.Context) string {
+	user, err := i.authenticatedUser(c)
+	if err != nil {
+		return ""
+	}
+	return user
+}
+
+// authenticate checks that the user in the 'user' query parameter, if there
+// is one, is the authenticated user, then sets the parameter to the
+// authenticated user so the handler acts on their behalf.
+func (i *Internal) authenticate(c echo.Context) (string, error) {
+	user, err := i.authenticatedUser(c)
+	if err != nil {
+		return "", err
+	}
+
+	if claimed := c.QueryParam("user"); claimed != "" && i.fixUsername(claimed) != user {
+		return "", echo.NewHTTPError(
+			http.StatusForbidden,
+			fmt.Sprintf("the user parameter %s is not the authenticated user %s", claimed, user),
+		)
+	}
+
+	c.QueryParams().Set("user", user)
+	return user, nil
+}
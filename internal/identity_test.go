@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const testIdentityKey = "test-identity-key"
+
+// identityToken returns an identity token with the claims, signed with the
+// key using the algorithm named in alg.
+func identityToken(t *testing.T, key, alg string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// userToken returns a valid identity token for the user.
+func userToken(t *testing.T, user string) string {
+	return identityToken(t, testIdentityKey, "HS256", map[string]interface{}{
+		"preferred_username": user,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+func TestVerifyIdentityToken(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	key := []byte(testIdentityKey)
+
+	user, err := verifyIdentityToken(identityToken(t, testIdentityKey, "HS256", map[string]interface{}{"preferred_username": "alice", "sub": "1234", "exp": exp}), key, now)
+	assert.NoError(err)
+	assert.Equal("alice", user)
+
+	user, err = verifyIdentityToken(identityToken(t, testIdentityKey, "HS256", map[string]interface{}{"sub": "bob", "exp": exp}), key, now)
+	assert.NoError(err)
+	assert.Equal("bob", user)
+
+	bad := []string{
+		"not-a-token",
+		identityToken(t, "some-other-key", "HS256", map[string]interface{}{"sub": "alice", "exp": exp}),
+		identityToken(t, testIdentityKey, "none", map[string]interface{}{"sub": "alice", "exp": exp}),
+		identityToken(t, testIdentityKey, "HS256", map[string]interface{}{"sub": "alice"}),
+		identityToken(t, testIdentityKey, "HS256", map[string]interface{}{"sub": "alice", "exp": now.Add(-time.Hour).Unix()}),
+		identityToken(t, testIdentityKey, "HS256", map[string]interface{}{"sub": "alice", "exp": exp, "nbf": now.Add(time.Hour).Unix()}),
+		identityToken(t, testIdentityKey, "HS256", map[string]interface{}{"exp": exp}),
+	}
+	for _, token := range bad {
+		_, err = verifyIdentityToken(token, key, now)
+		assert.Error(err, token)
+	}
+}
+
+func TestSignIdentityToken(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+
+	_, err := internal.SignIdentityToken("alice", time.Now().Add(time.Hour))
+	assert.Error(err)
+
+	internal.IdentityKey = testIdentityKey
+
+	token, err := internal.SignIdentityToken("alice", time.Now().Add(time.Hour))
+	if assert.NoError(err) {
+		user, err := verifyIdentityToken(token, []byte(testIdentityKey), time.Now())
+		assert.NoError(err)
+		assert.Equal("alice", user)
+	}
+
+	token, err = internal.SignIdentityToken("alice", time.Now().Add(-time.Hour))
+	if assert.NoError(err) {
+		_, err = verifyIdentityToken(token, []byte(testIdentityKey), time.Now())
+		assert.Error(err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+
+	call := func(query, token string) (string, error) {
+		req := httptest.NewRequest(http.MethodGet, "/vice/admin/listing"+query, nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		user, err := internal.authenticate(c)
+		if err == nil {
+			assert.Equal(user, c.QueryParam("user"))
+		}
+		return user, err
+	}
+
+	// Nobody can be authenticated without a key.
+	_, err := call("", userToken(t, "alice"))
+	if assert.Error(err) {
+		assert.Equal(http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+	}
+
+	internal.IdentityKey = testIdentityKey
+
+	user, err := call("", userToken(t, "alice"))
+	assert.NoError(err)
+	assert.Equal("alice"+testConfig.UserSuffix, user)
+
+	_, err = call("?user=alice", userToken(t, "alice"))
+	assert.NoError(err)
+
+	_, err = call("?user=alice", "")
+	if assert.Error(err) {
+		assert.Equal(http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+	}
+
+	// The user parameter can't name someone else.
+	_, err = call("?user=bob", userToken(t, "alice"))
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+}
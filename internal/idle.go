@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultIdleCheckInterval = 5 * time.Minute
+	defaultIdleWarnBefore    = 30 * time.Minute
+)
+
+// IdleShutdownConfig turns on the shutdown of idle analyses. The VICE proxy
+// in each analysis reports user activity to ActivityURL, the base URL of
+// app-exposer as seen from the analysis pods. An analysis nobody has used for
+// Timeout is saved and shut down, and its user is warned WarnBefore that. An
+// analysis that has never been used is idle from when it was launched.
+type IdleShutdownConfig struct {
+	ActivityURL   string        `mapstructure:"activity_url"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	WarnBefore    time.Duration `mapstructure:"warn_before"`
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+}
+
+func (c *IdleShutdownConfig) enabled() bool {
+	return c.ActivityURL != "" && c.Timeout > 0
+}
+
+func (c *IdleShutdownConfig) warnBefore() time.Duration {
+	if c.WarnBefore <= 0 {
+		return defaultIdleWarnBefore
+	}
+	return c.WarnBefore
+}
+
+func (c *IdleShutdownConfig) checkInterval() time.Duration {
+	if c.CheckInterval <= 0 {
+		return defaultIdleCheckInterval
+	}
+	return c.CheckInterval
+}
+
+// proxyActivityURL returns the URL the proxy for the analysis reports user
+// activity to.
+func (c *IdleShutdownConfig) proxyActivityURL(externalID string) string {
+	return fmt.Sprintf("%s/vice/proxies/%s/activity", strings.TrimSuffix(c.ActivityURL, "/"), externalID)
+}
+
+// analysisActivity is when an analysis was last used and when its user was
+// warned that it's idle.
+type analysisActivity struct {
+	ExternalID     string     `db:"external_id"`
+	LastActivityAt time.Time  `db:"last_activity_at"`
+	IdleWarnedAt   *time.Time `db:"idle_warned_at"`
+}
+
+const recordActivitySQL = `
+	INSERT INTO vice_analysis_activity (external_id, last_activity_at, idle_warned_at)
+	VALUES ($1, now(), NULL)
+	ON CONFLICT (external_id) DO UPDATE
+	   SET last_activity_at = EXCLUDED.last_activity_at,
+	       idle_warned_at = NULL
+`
+
+const getActivitySQL = `
+	SELECT external_id, last_activity_at, idle_warned_at
+	  FROM vice_analysis_activity
+	 WHERE external_id = ANY($1)
+`
+
+// The last activity is only set for analyses that have never been used, for
+// which it's the time they were launched.
+const recordIdleWarningSQL = `
+	INSERT INTO vice_analysis_activity (external_id, last_activity_at, idle_warned_at)
+	VALUES ($1, $2, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET idle_warned_at = EXCLUDED.idle_warned_at
+`
+
+// analysisActivities returns the recorded activity of the analyses, keyed by
+// external ID.
+func (i *Internal) analysisActivities(externalIDs []string) (map[string]*analysisActivity, error) {
+	rows := []analysisActivity{}
+	if err := i.db.Select(&rows, getActivitySQL, pq.Array(externalIDs)); err != nil {
+		return nil, errors.Wrap(err, "error looking up analysis activity")
+	}
+
+	activities := map[string]*analysisActivity{}
+	for idx := range rows {
+		activities[rows[idx].ExternalID] = &rows[idx]
+	}
+	return activities, nil
+}
+
+// shutDownIdleAnalyses warns the users of analyses that are about to be
+// considered idle and starts shutting down the ones that are, leaving out the
+// paused analyses and the ones protected from deletion. Analyses in
+// shuttingDown are already being shut down; the ones started by this check are
+// added to it, and the ones no longer running are removed.
+func (i *Internal) shutDownIdleAnalyses(now time.Time, shuttingDown map[string]bool) error {
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{}, []string{})
+	if err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	launched := map[string]time.Time{}
+	externalIDs := []string{}
+	for _, dep := range deplist.Items {
+		// Paused analyses can't be used, so they're not idle either.
+		if isProtected(dep.Labels) || isPaused(&dep) {
+			continue
+		}
+		if id := i.labelKeys.get(dep.Labels, "external-id"); id != "" {
+			names[id] = i.labelKeys.get(dep.Labels, "analysis-name")
+			launched[id] = dep.CreationTimestamp.Time
+			externalIDs = append(externalIDs, id)
+		}
+	}
+
+	for id := range shuttingDown {
+		if _, ok := names[id]; !ok {
+			delete(shuttingDown, id)
+		}
+	}
+
+	if len(externalIDs) == 0 {
+		return nil
+	}
+
+	activities, err := i.analysisActivities(externalIDs)
+	if err != nil {
+		return err
+	}
+
+	timeout := i.IdleShutdown.Timeout
+	for _, externalID := range externalIDs {
+		if shuttingDown[externalID] {
+			continue
+		}
+
+		lastActivity := launched[externalID]
+		warned := false
+		if activity, ok := activities[externalID]; ok {
+			lastActivity = activity.LastActivityAt
+			warned = activity.IdleWarnedAt != nil
+		}
+
+		idle := now.Sub(lastActivity)
+		switch {
+		case idle >= timeout:
+			shuttingDown[externalID] = true
+			go i.saveAndShutDown(externalID, fmt.Sprintf(
+				"analysis %s hasn't been used for %s, so its outputs are being saved and it's being shut down",
+				names[externalID], idle.Round(time.Minute),
+			))
+		case !warned && idle >= timeout-i.IdleShutdown.warnBefore():
+			if _, err = i.db.Exec(recordIdleWarningSQL, externalID, lastActivity); err != nil {
+				log.Error(errors.Wrapf(err, "error recording the idle warning for analysis %s", externalID))
+				continue
+			}
+			msg := fmt.Sprintf(
+				"analysis %s hasn't been used for %s and will be saved and shut down in %s unless it's used",
+				names[externalID], idle.Round(time.Minute), (timeout - idle).Round(time.Minute),
+			)
+			if err = i.statusPublisher.Running(externalID, msg); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StartIdleShutdown periodically checks for idle analyses. It does nothing
+// unless the activity URL and idle timeout are configured.
+func (i *Internal) StartIdleShutdown() {
+	if !i.IdleShutdown.enabled() {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(i.IdleShutdown.checkInterval())
+		defer ticker.Stop()
+
+		shuttingDown := map[string]bool{}
+		for range ticker.C {
+			if err := i.shutDownIdleAnalyses(time.Now(), shuttingDown); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// ProxyActivityHandler records that someone is using an analysis, which
+// resets its idle timer. Only the pods of the analysis can report its
+// activity.
+func (i *Internal) ProxyActivityHandler(c echo.Context) error {
+	externalID := c.Param("external-id")
+	if externalID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "external-id parameter is empty")
+	}
+
+	if _, err := i.verifyTunnelClient(externalID, remoteHost(c.Request())); err != nil {
+		return err
+	}
+
+	if _, err := i.db.Exec(recordActivitySQL, externalID); err != nil {
+		return errors.Wrapf(err, "error recording activity for %s", externalID)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func idleDeployment(externalID string, created time.Time) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              externalID,
+			Namespace:         "vice-apps",
+			CreationTimestamp: metav1.NewTime(created),
+			Labels:            map[string]string{"app-type": "interactive", "external-id": externalID, "analysis-name": "notebook"},
+		},
+	}
+}
+
+func TestShutDownIdleAnalysesWarning(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	i, mock := setupInternal(t, []runtime.Object{
+		idleDeployment("e1", now.Add(-2*time.Hour)),
+		idleDeployment("e2", now.Add(-40*time.Minute)),
+		idleDeployment("e3", now.Add(-3*time.Hour)),
+	})
+	i.IdleShutdown = IdleShutdownConfig{ActivityURL: "http://app-exposer", Timeout: time.Hour, WarnBefore: 30 * time.Minute}
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+
+	warnedAt := now.Add(-5 * time.Minute)
+	mock.ExpectQuery("FROM vice_analysis_activity").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "last_activity_at", "idle_warned_at"}).
+			AddRow("e1", now.Add(-10*time.Minute), nil).
+			AddRow("e3", now.Add(-45*time.Minute), warnedAt))
+
+	// e1 was used recently and e3 has already been warned. e2 has never been
+	// used since it was launched 40 minutes ago.
+	mock.ExpectExec("INSERT INTO vice_analysis_activity").
+		WithArgs("e2", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	shuttingDown := map[string]bool{}
+	assert.NoError(i.shutDownIdleAnalyses(now, shuttingDown))
+	assert.Equal([]string{"Running"}, publisher.published)
+	assert.Empty(shuttingDown)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestProxyActivityHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "p1", Namespace: "vice-apps", Labels: map[string]string{"external-id": "e1"}},
+			Status:     apiv1.PodStatus{PodIP: "10.0.0.5"},
+		},
+	})
+
+	mock.ExpectExec("INSERT INTO vice_analysis_activity").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/vice/proxies/e1/activity", nil)
+	req.RemoteAddr = "10.0.0.5:5000"
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("external-id")
+	c.SetParamValues("e1")
+
+	assert.NoError(i.ProxyActivityHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	// Other analyses can't reset the idle timer.
+	req = httptest.NewRequest(http.MethodPost, "/vice/proxies/e1/activity", nil)
+	req.RemoteAddr = "10.0.0.6:5000"
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("external-id")
+	c.SetParamValues("e1")
+	assert.Error(i.ProxyActivityHandler(c))
+
+	// Neither can callers who name the pod in a forwarding header.
+	req = httptest.NewRequest(http.MethodPost, "/vice/proxies/e1/activity", nil)
+	req.RemoteAddr = "192.168.1.1:5000"
+	req.Header.Set(echo.HeaderXRealIP, "10.0.0.5")
+	req.Header.Set(echo.HeaderXForwardedFor, "10.0.0.5")
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("external-id")
+	c.SetParamValues("e1")
+	assert.Error(i.ProxyActivityHandler(c))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestViceProxyCommandActivityURL(t *testing.T) {
+	i, _ := setupInternal(t, nil)
+	i.IdleShutdown = IdleShutdownConfig{ActivityURL: "http://app-exposer/", Timeout: time.Hour}
+
+	command := i.viceProxyCommand(multiPortJob(8888))
+	assert.Equal(t, []string{"--activity-url", "http://app-exposer/vice/proxies/e1/activity"}, command[len(command)-2:])
+}
@@ -0,0 +1,488 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// prepullDaemonSetName is the label that marks the DaemonSets that keep images
+// pulled on the VICE nodes, and the prefix of their names.
+const prepullDaemonSetName = "vice-image-prepull"
+
+// prepullImageAnnotation records the image a pre-pull DaemonSet pulls.
+const prepullImageAnnotation = "vice-image-prepull/image"
+
+// prepullBinaryPath is where the helper image's statically linked busybox is
+// copied to, so that it can be run in place of anything in the pulled image.
+const prepullBinaryPath = "/prepull/busybox"
+
+const (
+	defaultPrepullPauseImage    = "registry.k8s.io/pause:3.9"
+	defaultPrepullHelperImage   = "busybox:1.36"
+	defaultPrepullCheckInterval = time.Hour
+	defaultPrepullDuration      = 72 * time.Hour
+)
+
+var (
+	// imageNamePattern matches image names: an optional registry host and
+	// port followed by lowercase path components.
+	imageNamePattern = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+
+	// imageTagPattern matches image tags.
+	imageTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// ImagePrepullConfig configures the pre-pulling of tool images onto the VICE
+// nodes, so that analyses using them don't wait on a cold pull. Images are
+// given as name:tag. Each one gets a DaemonSet whose pods pull it in an init
+// container that runs a copy of busybox from HelperImage rather than
+// anything in the image itself, then sit idle in PauseImage. The images
+// requested for workshops are dropped once they expire, checked every
+// CheckInterval.
+type ImagePrepullConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	Images        []string      `mapstructure:"images"`
+	PauseImage    string        `mapstructure:"pause_image"`
+	HelperImage   string        `mapstructure:"helper_image"`
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+}
+
+func (p *ImagePrepullConfig) pauseImage() string {
+	if p.PauseImage == "" {
+		return defaultPrepullPauseImage
+	}
+	return p.PauseImage
+}
+
+func (p *ImagePrepullConfig) helperImage() string {
+	if p.HelperImage == "" {
+		return defaultPrepullHelperImage
+	}
+	return p.HelperImage
+}
+
+func (p *ImagePrepullConfig) checkInterval() time.Duration {
+	if p.CheckInterval <= 0 {
+		return defaultPrepullCheckInterval
+	}
+	return p.CheckInterval
+}
+
+// PrepulledImage is an image kept pulled on the VICE nodes. Images requested
+// for a workshop have the user who requested them and when they stop being
+// pre-pulled. Configured images have neither. In the status, Nodes is the
+// number of nodes the image's DaemonSet runs on and NodesPulled is the number
+// that have pulled it.
+type PrepulledImage struct {
+	Image       string     `json:"image" db:"image"`
+	Tag         string     `json:"tag" db:"tag"`
+	RequestedBy string     `json:"requestedBy,omitempty" db:"requested_by"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty" db:"expires_at"`
+	Nodes       int32      `json:"nodes" db:"-"`
+	NodesPulled int32      `json:"nodesPulled" db:"-"`
+}
+
+// PrepullRequest is the request body for pre-pulling an image for a
+// workshop. The image is pre-pulled for three days if ExpiresAt isn't set.
+type PrepullRequest struct {
+	Image     string     `json:"image"`
+	Tag       string     `json:"tag"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// PrepullStatus lists the images being pre-pulled and how far each one has
+// gotten.
+type PrepullStatus struct {
+	Images []PrepulledImage `json:"images"`
+}
+
+const upsertImagePrepullSQL = `
+	INSERT INTO vice_image_prepulls (image, tag, requested_by, expires_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (image, tag) DO UPDATE
+	   SET requested_by = EXCLUDED.requested_by,
+	       expires_at = GREATEST(vice_image_prepulls.expires_at, EXCLUDED.expires_at)
+`
+
+const listImagePrepullsSQL = `
+	SELECT image, tag, requested_by, expires_at
+	  FROM vice_image_prepulls
+	 WHERE expires_at > now()
+	 ORDER BY image, tag
+`
+
+const deleteExpiredImagePrepullsSQL = `
+	DELETE FROM vice_image_prepulls
+	 WHERE expires_at <= now()
+`
+
+// splitImageTag splits an image given as name:tag. The tag is empty if there
+// isn't one. Colons in the registry host aren't mistaken for the tag.
+func splitImageTag(image string) (string, string) {
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		return image[:idx], image[idx+1:]
+	}
+	return image, ""
+}
+
+// validateImageReference returns an error if the image name and tag can't be
+// pulled as given.
+func validateImageReference(name, tag string) error {
+	if !imageNamePattern.MatchString(name) {
+		return fmt.Errorf("%s is not a valid image name", name)
+	}
+	if !imageTagPattern.MatchString(tag) {
+		return fmt.Errorf("%s is not a valid image tag", tag)
+	}
+	return nil
+}
+
+// prepulledImages returns the configured images followed by the ones
+// requested for workshops that haven't expired, without duplicates.
+// Configured images that aren't valid are left out.
+func (i *Internal) prepulledImages() ([]PrepulledImage, error) {
+	images := []PrepulledImage{}
+	seen := map[string]bool{}
+
+	for _, configured := range i.ImagePrepull.Images {
+		name, tag := splitImageTag(configured)
+		if tag == "" {
+			tag = "latest"
+		}
+		if err := validateImageReference(name, tag); err != nil {
+			log.Errorf("not pre-pulling %s: %s", configured, err)
+			continue
+		}
+		if !seen[name+":"+tag] {
+			seen[name+":"+tag] = true
+			images = append(images, PrepulledImage{Image: name, Tag: tag})
+		}
+	}
+
+	requested := []PrepulledImage{}
+	if err := i.db.Select(&requested, listImagePrepullsSQL); err != nil {
+		return nil, errors.Wrap(err, "error listing the images requested for pre-pulling")
+	}
+	for _, image := range requested {
+		if !seen[image.Image+":"+image.Tag] {
+			seen[image.Image+":"+image.Tag] = true
+			images = append(images, image)
+		}
+	}
+
+	return images, nil
+}
+
+// prepullDaemonSetNameFor returns the name of the DaemonSet that pulls the
+// image. Image references can't be used in names, so a hash of it is used.
+func prepullDaemonSetNameFor(image PrepulledImage) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s", image.Image, image.Tag)))
+	return fmt.Sprintf("%s-%x", prepullDaemonSetName, sum[:6])
+}
+
+// imagePrepullDaemonSet returns the DaemonSet that pulls the image on every
+// VICE node, GPU nodes included. The image is pulled by an init container
+// whose command is a copy of busybox from the helper image, so nothing in the
+// pulled image is run. A node has the image once its pod is ready.
+func (i *Internal) imagePrepullDaemonSet(image PrepulledImage) *appsv1.DaemonSet {
+	name := prepullDaemonSetNameFor(image)
+	selector := map[string]string{"app": name}
+
+	dsLabels := map[string]string{"app": prepullDaemonSetName}
+	for k, v := range managedByLabels {
+		dsLabels[k] = v
+	}
+
+	podLabels := map[string]string{}
+	for k, v := range managedByLabels {
+		podLabels[k] = v
+	}
+	for k, v := range selector {
+		podLabels[k] = v
+	}
+
+	// The pods do nothing, but the namespace may require requests and limits.
+	resources := apiv1.ResourceRequirements{
+		Requests: apiv1.ResourceList{
+			apiv1.ResourceCPU:    resource.MustParse("10m"),
+			apiv1.ResourceMemory: resource.MustParse("16Mi"),
+		},
+		Limits: apiv1.ResourceList{
+			apiv1.ResourceCPU:    resource.MustParse("10m"),
+			apiv1.ResourceMemory: resource.MustParse("16Mi"),
+		},
+	}
+
+	binMount := apiv1.VolumeMount{Name: "prepull-bin", MountPath: path.Dir(prepullBinaryPath)}
+
+	pullSecrets := []apiv1.LocalObjectReference{}
+	for _, secret := range i.imagePullSecretNames(image.Image) {
+		pullSecrets = append(pullSecrets, apiv1.LocalObjectReference{Name: secret})
+	}
+
+	tolerations := []apiv1.Toleration{
+		{
+			Key:      viceTolerationKey,
+			Operator: apiv1.TolerationOperator(viceTolerationOperator),
+			Value:    viceTolerationValue,
+			Effect:   apiv1.TaintEffect(viceTolerationEffect),
+		},
+		{
+			Key:      gpuTolerationKey,
+			Operator: apiv1.TolerationOperator(gpuTolerationOperator),
+			Value:    gpuTolerationValue,
+			Effect:   apiv1.TaintEffect(gpuTolerationEffect),
+		},
+	}
+	tolerations = append(tolerations, i.DefaultTolerations...)
+
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      dsLabels,
+			Annotations: map[string]string{prepullImageAnnotation: fmt.Sprintf("%s:%s", image.Image, image.Tag)},
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: podLabels},
+				Spec: apiv1.PodSpec{
+					InitContainers: []apiv1.Container{
+						{
+							Name:            "copy-busybox",
+							Image:           i.ImagePrepull.helperImage(),
+							Command:         []string{"cp", "/bin/busybox", prepullBinaryPath},
+							ImagePullPolicy: apiv1.PullIfNotPresent,
+							Resources:       resources,
+							VolumeMounts:    []apiv1.VolumeMount{binMount},
+						},
+						{
+							Name:            "pull",
+							Image:           fmt.Sprintf("%s:%s", image.Image, image.Tag),
+							Command:         []string{prepullBinaryPath, "true"},
+							ImagePullPolicy: apiv1.PullIfNotPresent,
+							Resources:       resources,
+							VolumeMounts:    []apiv1.VolumeMount{binMount},
+						},
+					},
+					ImagePullSecrets: pullSecrets,
+					Containers: []apiv1.Container{
+						{
+							Name:      "pause",
+							Image:     i.ImagePrepull.pauseImage(),
+							Resources: resources,
+						},
+					},
+					Volumes: []apiv1.Volume{
+						{
+							Name:         binMount.Name,
+							VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}},
+						},
+					},
+					Tolerations: tolerations,
+					Affinity: &apiv1.Affinity{
+						NodeAffinity: &apiv1.NodeAffinity{
+							RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
+								NodeSelectorTerms: []apiv1.NodeSelectorTerm{
+									{
+										MatchExpressions: []apiv1.NodeSelectorRequirement{
+											{
+												Key:      viceAffinityKey,
+												Operator: apiv1.NodeSelectorOperator(viceAffinityOperator),
+												Values:   []string{viceAffinityValue},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// prepullDaemonSets returns the existing pre-pull DaemonSets keyed by name.
+func (i *Internal) prepullDaemonSets() (map[string]*appsv1.DaemonSet, error) {
+	list, err := i.clientset.AppsV1().DaemonSets(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{"app": prepullDaemonSetName}).String(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing the image pre-pull daemon sets")
+	}
+
+	existing := map[string]*appsv1.DaemonSet{}
+	for idx := range list.Items {
+		existing[list.Items[idx].Name] = &list.Items[idx]
+	}
+	return existing, nil
+}
+
+// applyImagePrepulls drops the expired workshop images, then creates or
+// updates a pre-pull DaemonSet for each of the images that are left. The
+// DaemonSets for images that aren't pre-pulled anymore are deleted. Since
+// each image has its own DaemonSet, adding or dropping one image doesn't
+// restart the pulls of the others.
+func (i *Internal) applyImagePrepulls() error {
+	if _, err := i.db.Exec(deleteExpiredImagePrepullsSQL); err != nil {
+		return errors.Wrap(err, "error deleting the expired image pre-pulls")
+	}
+
+	images, err := i.prepulledImages()
+	if err != nil {
+		return err
+	}
+
+	existing, err := i.prepullDaemonSets()
+	if err != nil {
+		return err
+	}
+
+	client := i.clientset.AppsV1().DaemonSets(i.ViceNamespace)
+
+	for _, image := range images {
+		daemonSet := i.imagePrepullDaemonSet(image)
+
+		current, found := existing[daemonSet.Name]
+		delete(existing, daemonSet.Name)
+
+		if !found {
+			if _, err = client.Create(daemonSet); err != nil {
+				return errors.Wrapf(err, "error creating the pre-pull daemon set for %s:%s", image.Image, image.Tag)
+			}
+			continue
+		}
+
+		current.Labels = daemonSet.Labels
+		current.Annotations = daemonSet.Annotations
+		current.Spec = daemonSet.Spec
+		if _, err = client.Update(current); err != nil {
+			return errors.Wrapf(err, "error updating the pre-pull daemon set for %s:%s", image.Image, image.Tag)
+		}
+	}
+
+	for name := range existing {
+		if err = client.Delete(name, &metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting the pre-pull daemon set %s", name)
+		}
+	}
+
+	return nil
+}
+
+// StartImagePrepulls keeps the pre-pull DaemonSet in line with the configured
+// and requested images, starting right away.
+func (i *Internal) StartImagePrepulls() {
+	if !i.ImagePrepull.Enabled {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(i.ImagePrepull.checkInterval())
+		defer ticker.Stop()
+
+		for {
+			if err := i.applyImagePrepulls(); err != nil {
+				log.Error(err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// prepullStatus returns the images being pre-pulled and how far their
+// DaemonSets have gotten with them.
+func (i *Internal) prepullStatus() (*PrepullStatus, error) {
+	images, err := i.prepulledImages()
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := i.prepullDaemonSets()
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range images {
+		if daemonSet, ok := existing[prepullDaemonSetNameFor(images[idx])]; ok {
+			images[idx].Nodes = daemonSet.Status.DesiredNumberScheduled
+			images[idx].NodesPulled = daemonSet.Status.NumberReady
+		}
+	}
+
+	return &PrepullStatus{Images: images}, nil
+}
+
+// AdminPrepullStatusHandler lists the images being pre-pulled on the VICE
+// nodes and how many nodes have pulled them.
+func (i *Internal) AdminPrepullStatusHandler(c echo.Context) error {
+	status, err := i.prepullStatus()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// AdminPrepullImageHandler starts pre-pulling an image on the VICE nodes, such
+// as the image for an upcoming workshop, until the time in the request. The
+// pulls happen in the background; the response has the same status the
+// status endpoint returns.
+func (i *Internal) AdminPrepullImageHandler(c echo.Context) error {
+	if !i.ImagePrepull.Enabled {
+		return echo.NewHTTPError(http.StatusBadRequest, "image pre-pulling is not enabled")
+	}
+
+	request := &PrepullRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if request.Image == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "image is required")
+	}
+
+	if request.Tag == "" {
+		request.Tag = "latest"
+	}
+
+	if err := validateImageReference(request.Image, request.Tag); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	expiresAt := time.Now().Add(defaultPrepullDuration)
+	if request.ExpiresAt != nil {
+		if !request.ExpiresAt.After(time.Now()) {
+			return echo.NewHTTPError(http.StatusBadRequest, "expiresAt must be in the future")
+		}
+		expiresAt = *request.ExpiresAt
+	}
+
+	// The requester is taken from the identity token rather than the 'user'
+	// query parameter, which the caller sets.
+	requestedBy := i.identifiedUser(c)
+
+	if _, err := i.db.Exec(upsertImagePrepullSQL, request.Image, request.Tag, requestedBy, expiresAt); err != nil {
+		return errors.Wrapf(err, "error recording the pre-pull of %s:%s", request.Image, request.Tag)
+	}
+
+	if err := i.applyImagePrepulls(); err != nil {
+		return err
+	}
+
+	return i.AdminPrepullStatusHandler(c)
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSplitImageTag(t *testing.T) {
+	tests := []struct {
+		image, name, tag string
+	}{
+		{"jupyter-lab:latest", "jupyter-lab", "latest"},
+		{"harbor.cyverse.org/de/rstudio:4.0", "harbor.cyverse.org/de/rstudio", "4.0"},
+		{"localhost:5000/tools/app", "localhost:5000/tools/app", ""},
+		{"localhost:5000/tools/app:1.0", "localhost:5000/tools/app", "1.0"},
+	}
+
+	for _, test := range tests {
+		name, tag := splitImageTag(test.image)
+		assert.Equal(t, test.name, name, test.image)
+		assert.Equal(t, test.tag, tag, test.image)
+	}
+}
+
+// registerPrepullQueries registers the cleanup of expired pre-pulls and the
+// listing of the requested ones.
+func registerPrepullQueries(mock sqlmock.Sqlmock, requested ...PrepulledImage) {
+	mock.ExpectExec("DELETE FROM vice_image_prepulls").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rows := sqlmock.NewRows([]string{"image", "tag", "requested_by", "expires_at"})
+	for _, image := range requested {
+		rows.AddRow(image.Image, image.Tag, image.RequestedBy, image.ExpiresAt)
+	}
+	mock.ExpectQuery("SELECT image, tag, requested_by, expires_at FROM vice_image_prepulls").WillReturnRows(rows)
+}
+
+func TestValidateImageReference(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateImageReference("jupyter-lab", "latest"))
+	assert.NoError(validateImageReference("harbor.cyverse.org/de/rstudio", "4.0"))
+	assert.NoError(validateImageReference("localhost:5000/tools/app_name", "1.0-rc.1"))
+
+	assert.Error(validateImageReference("", "latest"))
+	assert.Error(validateImageReference("Harbor/Tools", "latest"))
+	assert.Error(validateImageReference("tools/app --privileged", "latest"))
+	assert.Error(validateImageReference("tools/app", ""))
+	assert.Error(validateImageReference("tools/app", "1.0;rm"))
+	assert.Error(validateImageReference("tools/app", ".hidden"))
+}
+
+// prepullImages returns the images the pre-pull DaemonSets pull, keyed by the
+// names of the DaemonSets.
+func prepullImages(t *testing.T, internal *Internal) map[string]string {
+	list, err := internal.clientset.AppsV1().DaemonSets("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(t, err)
+
+	images := map[string]string{}
+	for _, daemonSet := range list.Items {
+		images[daemonSet.Name] = daemonSet.Spec.Template.Spec.InitContainers[1].Image
+	}
+	return images
+}
+
+func TestApplyImagePrepulls(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	internal.ImagePrepull = ImagePrepullConfig{
+		Enabled: true,
+		Images: []string{
+			"harbor.cyverse.org/de/jupyter-lab:latest",
+			"harbor.cyverse.org/de/rstudio",
+			"harbor.cyverse.org/de/Invalid:latest",
+		},
+	}
+	internal.ImagePullSecrets = []string{"harbor"}
+
+	expiresAt := time.Now().Add(time.Hour)
+	workshop := PrepulledImage{Image: "harbor.cyverse.org/de/workshop", Tag: "2.0", RequestedBy: "ipcdev", ExpiresAt: &expiresAt}
+	registerPrepullQueries(mock,
+		workshop,
+		PrepulledImage{Image: "harbor.cyverse.org/de/jupyter-lab", Tag: "latest", RequestedBy: "ipcdev", ExpiresAt: &expiresAt},
+	)
+	assert.NoError(internal.applyImagePrepulls())
+
+	// Each valid image gets a DaemonSet of its own.
+	jupyter := PrepulledImage{Image: "harbor.cyverse.org/de/jupyter-lab", Tag: "latest"}
+	rstudio := PrepulledImage{Image: "harbor.cyverse.org/de/rstudio", Tag: "latest"}
+	assert.Equal(map[string]string{
+		prepullDaemonSetNameFor(jupyter):  "harbor.cyverse.org/de/jupyter-lab:latest",
+		prepullDaemonSetNameFor(rstudio):  "harbor.cyverse.org/de/rstudio:latest",
+		prepullDaemonSetNameFor(workshop): "harbor.cyverse.org/de/workshop:2.0",
+	}, prepullImages(t, internal))
+
+	daemonSet, err := internal.clientset.AppsV1().DaemonSets("vice-apps").Get(prepullDaemonSetNameFor(workshop), metav1.GetOptions{})
+	if assert.NoError(err) {
+		spec := daemonSet.Spec.Template.Spec
+
+		// Nothing in the pulled image is run.
+		assert.Equal(defaultPrepullHelperImage, spec.InitContainers[0].Image)
+		assert.Equal([]string{prepullBinaryPath, "true"}, spec.InitContainers[1].Command)
+		assert.Equal("harbor", spec.ImagePullSecrets[0].Name)
+		assert.Equal(defaultPrepullPauseImage, spec.Containers[0].Image)
+		assert.Equal("harbor.cyverse.org/de/workshop:2.0", daemonSet.Annotations[prepullImageAnnotation])
+	}
+
+	// Once the configured images are removed, only the workshop image is
+	// left, and once it expires, nothing is.
+	internal.ImagePrepull.Images = nil
+	registerPrepullQueries(mock, workshop)
+	assert.NoError(internal.applyImagePrepulls())
+	assert.Equal(map[string]string{
+		prepullDaemonSetNameFor(workshop): "harbor.cyverse.org/de/workshop:2.0",
+	}, prepullImages(t, internal))
+
+	registerPrepullQueries(mock)
+	assert.NoError(internal.applyImagePrepulls())
+	assert.Empty(prepullImages(t, internal))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminPrepullImageHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	internal.ImagePrepull = ImagePrepullConfig{Enabled: true}
+	internal.IdentityKey = testIdentityKey
+
+	// Invalid images are refused before anything is recorded.
+	req := httptest.NewRequest(http.MethodPost, "/vice/admin/images/prepull", strings.NewReader(`{"image":"tools/app; rm -rf /"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	err := internal.AdminPrepullImageHandler(echo.New().NewContext(req, httptest.NewRecorder()))
+	if httpErr, ok := err.(*echo.HTTPError); assert.True(ok) {
+		assert.Equal(http.StatusBadRequest, httpErr.Code)
+	}
+
+	// The requester is the authenticated user, not the user parameter.
+	mock.ExpectExec("INSERT INTO vice_image_prepulls").
+		WithArgs("harbor.cyverse.org/de/workshop", "2.0", internal.fixUsername("alice"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	registerPrepullQueries(mock)
+	mock.ExpectQuery("SELECT image, tag, requested_by, expires_at FROM vice_image_prepulls").
+		WillReturnRows(sqlmock.NewRows([]string{"image", "tag", "requested_by", "expires_at"}))
+
+	req = httptest.NewRequest(http.MethodPost, "/vice/admin/images/prepull?user=mallory", strings.NewReader(`{"image":"harbor.cyverse.org/de/workshop","tag":"2.0"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+userToken(t, "alice"))
+	rec := httptest.NewRecorder()
+	assert.NoError(internal.AdminPrepullImageHandler(echo.New().NewContext(req, rec)))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
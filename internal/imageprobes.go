@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Image probe verdicts.
+const (
+	ProbePending      = "pending"
+	ProbeCompatible   = "compatible"
+	ProbeIncompatible = "incompatible"
+)
+
+// imageProbePollInterval is how often the probe pod is checked.
+const imageProbePollInterval = 5 * time.Second
+
+// defaultImageProbeTimeout is how long an image has to become ready if the
+// timeout isn't configured.
+const defaultImageProbeTimeout = 5 * time.Minute
+
+// ImageProbeRequest is the request body for starting an image compatibility
+// probe.
+type ImageProbeRequest struct {
+	Image         string `json:"image"`
+	Tag           string `json:"tag"`
+	Port          int    `json:"port"`
+	ReadinessPath string `json:"readinessPath"`
+}
+
+// ImageProbe is the recorded outcome of an image compatibility probe.
+type ImageProbe struct {
+	Image    string    `json:"image" db:"image"`
+	Tag      string    `json:"tag" db:"tag"`
+	Verdict  string    `json:"verdict" db:"verdict"`
+	Details  string    `json:"details" db:"details"`
+	ProbedAt time.Time `json:"probedAt" db:"probed_at"`
+}
+
+const upsertImageProbeSQL = `
+	INSERT INTO vice_image_probes (image, tag, verdict, details, probed_at)
+	VALUES ($1, $2, $3, $4, now())
+	ON CONFLICT (image, tag) DO UPDATE
+	   SET verdict = EXCLUDED.verdict,
+	       details = EXCLUDED.details,
+	       probed_at = EXCLUDED.probed_at
+`
+
+const getImageProbeSQL = `
+	SELECT image, tag, verdict, details, probed_at
+	  FROM vice_image_probes
+	 WHERE image = $1
+	   AND tag = $2
+`
+
+func (i *Internal) recordImageProbe(image, tag, verdict, details string) error {
+	if _, err := i.db.Exec(upsertImageProbeSQL, image, tag, verdict, details); err != nil {
+		return errors.Wrapf(err, "error recording the probe of %s:%s", image, tag)
+	}
+	return nil
+}
+
+// getImageProbe returns the outcome of the last probe of the image, or nil if
+// it has never been probed.
+func (i *Internal) getImageProbe(image, tag string) (*ImageProbe, error) {
+	probe := &ImageProbe{}
+	err := i.db.QueryRowx(getImageProbeSQL, image, tag).StructScan(probe)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the probe of %s:%s", image, tag)
+	}
+	return probe, nil
+}
+
+// validateImage rejects launches of images that failed their last probe.
+// Images that haven't been probed are allowed.
+func (i *Internal) validateImage(job *model.Job) (int, error) {
+	if !i.ImageProbeEnforced || len(job.Steps) == 0 {
+		return http.StatusOK, nil
+	}
+
+	image := job.Steps[0].Component.Container.Image
+	probe, err := i.getImageProbe(image.Name, image.Tag)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if probe != nil && probe.Verdict == ProbeIncompatible {
+		return http.StatusBadRequest, common.ErrorResponse{
+			ErrorCode: "ERR_IMAGE_INCOMPATIBLE",
+			Message:   fmt.Sprintf("image %s:%s failed its compatibility check: %s", image.Name, image.Tag, probe.Details),
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// imageProbePod returns the pod that checks the image. The readiness probe
+// checks that the image listens on the port, and that it answers on the
+// readiness path if one was given.
+func imageProbePod(request *ImageProbeRequest) *apiv1.Pod {
+	port := intstr.FromInt(request.Port)
+
+	handler := apiv1.Handler{
+		TCPSocket: &apiv1.TCPSocketAction{Port: port},
+	}
+	if request.ReadinessPath != "" {
+		handler = apiv1.Handler{
+			HTTPGet: &apiv1.HTTPGetAction{Path: request.ReadinessPath, Port: port},
+		}
+	}
+
+	autoMount := false
+
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "vice-image-probe-",
+			Labels: map[string]string{
+				"app-type": "image-probe",
+			},
+		},
+		Spec: apiv1.PodSpec{
+			RestartPolicy:                apiv1.RestartPolicyNever,
+			AutomountServiceAccountToken: &autoMount,
+			Containers: []apiv1.Container{
+				{
+					Name:  analysisContainerName,
+					Image: fmt.Sprintf("%s:%s", request.Image, request.Tag),
+					Ports: []apiv1.ContainerPort{
+						{ContainerPort: int32(request.Port), Protocol: apiv1.ProtocolTCP},
+					},
+					ReadinessProbe: &apiv1.Probe{
+						Handler:       handler,
+						PeriodSeconds: 5,
+					},
+				},
+			},
+		},
+	}
+}
+
+// imageProbeVerdict looks at the probe pod and returns whether the probe is
+// finished, along with the verdict and an explanation if it is.
+func imageProbeVerdict(pod *apiv1.Pod) (bool, string, string) {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == apiv1.PodReady && cond.Status == apiv1.ConditionTrue {
+			return true, ProbeCompatible, "the image became ready"
+		}
+	}
+
+	if pod.Status.Phase == apiv1.PodFailed || pod.Status.Phase == apiv1.PodSucceeded {
+		return true, ProbeIncompatible, fmt.Sprintf("the container exited before becoming ready (%s)", pod.Status.Phase)
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil {
+			switch status.State.Waiting.Reason {
+			case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CrashLoopBackOff":
+				return true, ProbeIncompatible, strings.TrimSpace(fmt.Sprintf("%s: %s", status.State.Waiting.Reason, status.State.Waiting.Message))
+			}
+		}
+	}
+
+	return false, ProbePending, ""
+}
+
+// runImageProbe starts the probe pod, waits for a verdict, records it, and
+// cleans up the pod.
+func (i *Internal) runImageProbe(request *ImageProbeRequest) (string, string, error) {
+	podclient := i.clientset.CoreV1().Pods(i.ImageProbeNamespace)
+
+	probePod := imageProbePod(request)
+	probePod.Spec.PriorityClassName = i.PriorityClasses.System
+
+	pod, err := podclient.Create(probePod)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error creating the probe pod for %s:%s", request.Image, request.Tag)
+	}
+
+	defer func() {
+		if err := podclient.Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+			log.Error(errors.Wrapf(err, "error deleting image probe pod %s", pod.Name))
+		}
+	}()
+
+	timeout := i.ImageProbeTimeout
+	if timeout <= 0 {
+		timeout = defaultImageProbeTimeout
+	}
+
+	verdict, details := ProbeIncompatible, fmt.Sprintf("the image did not become ready within %s", timeout)
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		current, err := podclient.Get(pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", "", errors.Wrapf(err, "error checking image probe pod %s", pod.Name)
+		}
+
+		if done, v, d := imageProbeVerdict(current); done {
+			verdict, details = v, d
+			break
+		}
+
+		time.Sleep(imageProbePollInterval)
+	}
+
+	if err = i.recordImageProbe(request.Image, request.Tag, verdict, details); err != nil {
+		return "", "", err
+	}
+
+	log.Infof("image %s:%s is %s: %s", request.Image, request.Tag, verdict, details)
+
+	return verdict, details, nil
+}
+
+// AdminStartImageProbeHandler starts a compatibility probe of an image in the
+// sandbox namespace. The probe runs in the background; its verdict can be
+// looked up with AdminGetImageProbeHandler.
+func (i *Internal) AdminStartImageProbeHandler(c echo.Context) error {
+	if i.ImageProbeNamespace == "" {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "no namespace is configured for image probes")
+	}
+
+	request := &ImageProbeRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if request.Image == "" || request.Tag == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "image and tag are required")
+	}
+
+	if request.Port <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "port must be set to the port the image listens on")
+	}
+
+	if err := i.recordImageProbe(request.Image, request.Tag, ProbePending, "the probe is running"); err != nil {
+		return err
+	}
+
+	go func() {
+		if _, _, err := i.runImageProbe(request); err != nil {
+			log.Error(err)
+			if err = i.recordImageProbe(request.Image, request.Tag, ProbeIncompatible, err.Error()); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// AdminGetImageProbeHandler returns the outcome of the last probe of the
+// image in the 'image' and 'tag' query parameters.
+func (i *Internal) AdminGetImageProbeHandler(c echo.Context) error {
+	image := c.QueryParam("image")
+	tag := c.QueryParam("tag")
+	if image == "" || tag == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "image and tag query parameters must be set")
+	}
+
+	probe, err := i.getImageProbe(image, tag)
+	if err != nil {
+		return err
+	}
+
+	if probe == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%s:%s has not been probed", image, tag))
+	}
+
+	return c.JSON(http.StatusOK, probe)
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestImageProbePod(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := imageProbePod(&ImageProbeRequest{Image: "discoenv/jupyter", Tag: "1.0", Port: 8888})
+	container := pod.Spec.Containers[0]
+	assert.Equal("discoenv/jupyter:1.0", container.Image)
+	assert.Equal(int32(8888), container.Ports[0].ContainerPort)
+	assert.NotNil(container.ReadinessProbe.TCPSocket)
+	assert.Nil(container.ReadinessProbe.HTTPGet)
+
+	pod = imageProbePod(&ImageProbeRequest{Image: "discoenv/jupyter", Tag: "1.0", Port: 8888, ReadinessPath: "/lab"})
+	container = pod.Spec.Containers[0]
+	assert.Nil(container.ReadinessProbe.TCPSocket)
+	assert.Equal("/lab", container.ReadinessProbe.HTTPGet.Path)
+	assert.Equal(8888, container.ReadinessProbe.HTTPGet.Port.IntValue())
+}
+
+func TestImageProbeVerdict(t *testing.T) {
+	assert := assert.New(t)
+
+	waiting := func(reason string) apiv1.PodStatus {
+		return apiv1.PodStatus{
+			Phase: apiv1.PodPending,
+			ContainerStatuses: []apiv1.ContainerStatus{
+				{State: apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: reason}}},
+			},
+		}
+	}
+
+	tests := []struct {
+		status  apiv1.PodStatus
+		done    bool
+		verdict string
+	}{
+		{apiv1.PodStatus{Phase: apiv1.PodPending}, false, ProbePending},
+		{waiting("ContainerCreating"), false, ProbePending},
+		{waiting("ImagePullBackOff"), true, ProbeIncompatible},
+		{waiting("CrashLoopBackOff"), true, ProbeIncompatible},
+		{apiv1.PodStatus{Phase: apiv1.PodSucceeded}, true, ProbeIncompatible},
+		{apiv1.PodStatus{
+			Phase:      apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionFalse}},
+		}, false, ProbePending},
+		{apiv1.PodStatus{
+			Phase:      apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionTrue}},
+		}, true, ProbeCompatible},
+	}
+
+	for _, test := range tests {
+		done, verdict, _ := imageProbeVerdict(&apiv1.Pod{Status: test.status})
+		assert.Equal(test.done, done, "%+v", test.status)
+		assert.Equal(test.verdict, verdict, "%+v", test.status)
+	}
+}
+
+func registerImageProbeQuery(mock sqlmock.Sqlmock, image, tag, verdict string) {
+	query := mock.ExpectQuery("SELECT image, tag, verdict, details, probed_at FROM vice_image_probes").
+		WithArgs(image, tag)
+	if verdict == "" {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	query.WillReturnRows(sqlmock.NewRows([]string{"image", "tag", "verdict", "details", "probed_at"}).
+		AddRow(image, tag, verdict, "the container exited before becoming ready (Succeeded)", time.Now()))
+}
+
+func TestValidateImage(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	defer internal.db.Close()
+
+	job := multiPortJob(8888)
+	job.Steps[0].Component.Container.Image.Name = "discoenv/jupyter"
+	job.Steps[0].Component.Container.Image.Tag = "1.0"
+
+	// Nothing is looked up unless probe results are enforced.
+	status, err := internal.validateImage(job)
+	assert.Equal(http.StatusOK, status)
+	assert.NoError(err)
+
+	internal.ImageProbeEnforced = true
+
+	registerImageProbeQuery(mock, "discoenv/jupyter", "1.0", "")
+	status, err = internal.validateImage(job)
+	assert.Equal(http.StatusOK, status)
+	assert.NoError(err)
+
+	registerImageProbeQuery(mock, "discoenv/jupyter", "1.0", ProbeCompatible)
+	status, err = internal.validateImage(job)
+	assert.Equal(http.StatusOK, status)
+	assert.NoError(err)
+
+	registerImageProbeQuery(mock, "discoenv/jupyter", "1.0", ProbeIncompatible)
+	status, err = internal.validateImage(job)
+	assert.Equal(http.StatusBadRequest, status)
+	assert.Error(err)
+	assert.Contains(err.Error(), "discoenv/jupyter:1.0")
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -3,7 +3,10 @@ package internal
 import (
 	"crypto/sha256"
 	"fmt"
+	"net/url"
+	"strconv"
 
+	"github.com/pkg/errors"
 	"gopkg.in/cyverse-de/model.v5"
 	apiv1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
@@ -11,12 +14,42 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+const (
+	proxyReadTimeoutAnnotation  = "nginx.ingress.kubernetes.io/proxy-read-timeout"
+	proxySendTimeoutAnnotation  = "nginx.ingress.kubernetes.io/proxy-send-timeout"
+	websocketServicesAnnotation = "nginx.org/websocket-services"
+)
+
 // IngressName returns the name of the ingress created for the running VICE
 // analysis. This should match the name created in the apps service.
 func IngressName(userID, invocationID string) string {
 	return fmt.Sprintf("a%x", sha256.Sum256([]byte(fmt.Sprintf("%s%s", userID, invocationID))))[0:9]
 }
 
+// extraPortPath returns the path that requests for an extra port are routed
+// under.
+func extraPortPath(port int32) string {
+	return fmt.Sprintf("/port-%d", port)
+}
+
+// extraPortRoutes returns the routes the VICE proxy is given for the extra
+// ports the app declares, so that requests under /port-<number> reach the port
+// after going through the same checks as the rest of the requests for the
+// analysis. Only TCP ports can be proxied.
+func (i *Internal) extraPortRoutes(job *model.Job) []string {
+	retval := []string{}
+
+	for _, port := range i.extraServicePorts(job) {
+		if port.Protocol != apiv1.ProtocolTCP {
+			continue
+		}
+
+		retval = append(retval, fmt.Sprintf("%s=http://localhost:%d", extraPortPath(port.Port), port.Port))
+	}
+
+	return retval
+}
+
 // getIngress assembles and returns the Ingress needed for the VICE analysis.
 // It does not call the k8s API.
 func (i *Internal) getIngress(job *model.Job, svc *apiv1.Service) (*extv1beta1.Ingress, error) {
@@ -56,31 +89,125 @@ func (i *Internal) getIngress(job *model.Job, svc *apiv1.Service) (*extv1beta1.I
 		ServicePort: intstr.FromInt(int(defaultPort)),
 	}
 
-	// Add the rule to pass along requests to the Service's proxy port.
-	rules = append(rules, extv1beta1.IngressRule{
-		Host: ingressName,
-		IngressRuleValue: extv1beta1.IngressRuleValue{
-			HTTP: &extv1beta1.HTTPIngressRuleValue{
-				Paths: []extv1beta1.HTTPIngressPath{
-					{
-						Backend: *backend, // service backend, not the default backend
-					},
+	// Passed-through TLS connections skip the VICE proxy and go straight to
+	// the app, and the ingress controller can't route them by path.
+	passthroughPort, passthrough := i.tlsPassthroughPort(job)
+	if passthrough {
+		backend.ServicePort = intstr.FromInt(int(passthroughPort.Port))
+	}
+
+	paths := []extv1beta1.HTTPIngressPath{
+		{
+			Backend: *backend, // service backend, not the default backend
+		},
+	}
+
+	// Add the rules to pass along requests to the Service's proxy port, one for
+	// each host the analysis is served from.
+	hosts := i.ingressHosts(job.UserID, job.InvocationID)
+	for _, host := range hosts {
+		rules = append(rules, extv1beta1.IngressRule{
+			Host: host,
+			IngressRuleValue: extv1beta1.IngressRuleValue{
+				HTTP: &extv1beta1.HTTPIngressRuleValue{
+					Paths: paths,
 				},
 			},
-		},
-	})
+		})
+	}
 
-	return &extv1beta1.Ingress{
+	ingress := &extv1beta1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: job.InvocationID,
-			Annotations: map[string]string{
-				"kubernetes.io/ingress.class": "nginx",
-			},
-			Labels: labels,
+			Name:        job.InvocationID,
+			Annotations: i.ingressAnnotations(job, svc),
+			Labels:      labels,
 		},
 		Spec: extv1beta1.IngressSpec{
 			Backend: defaultBackend, // default backend, not the service backend
 			Rules:   rules,
 		},
-	}, nil
+	}
+
+	if i.IngressTLS && !passthrough {
+		ingress.Spec.TLS = i.ingressTLS(ingressName, hosts)
+	}
+
+	return ingress, nil
+}
+
+// ingressAnnotations returns the annotations for the Ingress created for a VICE
+// analysis, starting with the annotations shared by all of the analysis's
+// resources. The ingress class defaults to nginx. If a cert-manager issuer is
+// configured, the annotation telling cert-manager to issue a certificate for
+// the Ingress is added as well. Proxy timeouts, WebSocket support, and the
+// app's TLS mode are added when they're configured, and the annotations
+// configured for the app are applied last so that they can override any of the
+// others.
+func (i *Internal) ingressAnnotations(job *model.Job, svc *apiv1.Service) map[string]string {
+	annotations := i.annotationsFromJob(job)
+
+	for k, v := range i.IngressAnnotations {
+		annotations[k] = v
+	}
+
+	class := i.IngressClass
+	if class == "" {
+		class = "nginx"
+	}
+	annotations["kubernetes.io/ingress.class"] = class
+
+	if i.CertManagerIssuer != "" {
+		if i.CertManagerIssuerKind == "Issuer" {
+			annotations["cert-manager.io/issuer"] = i.CertManagerIssuer
+		} else {
+			annotations["cert-manager.io/cluster-issuer"] = i.CertManagerIssuer
+		}
+	}
+
+	if i.IngressProxyReadTimeout > 0 {
+		annotations[proxyReadTimeoutAnnotation] = strconv.Itoa(i.IngressProxyReadTimeout)
+	}
+
+	if i.IngressProxySendTimeout > 0 {
+		annotations[proxySendTimeoutAnnotation] = strconv.Itoa(i.IngressProxySendTimeout)
+	}
+
+	if i.IngressWebSockets {
+		annotations[websocketServicesAnnotation] = svc.Name
+	}
+
+	i.addTLSModeAnnotations(job, annotations)
+
+	for k, v := range i.AppIngressAnnotations[job.AppID] {
+		annotations[k] = v
+	}
+
+	return annotations
+}
+
+// ingressTLSHost returns the fully qualified host name for the analysis, which
+// is the subdomain under the host in the frontend base URL.
+func (i *Internal) ingressTLSHost(ingressName string) (string, error) {
+	u, err := url.Parse(i.FrontendBaseURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing frontend base URL %s", i.FrontendBaseURL)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("frontend base URL %s has no host", i.FrontendBaseURL)
+	}
+	return fmt.Sprintf("%s.%s", ingressName, u.Hostname()), nil
+}
+
+// ingressTLS returns the TLS section for the Ingress. The certificate covers the
+// same hosts as the Ingress's rules, so that the ingress controller uses it
+// for every host the analysis is served from, and is stored in a secret named
+// after the generated subdomain, which cert-manager creates if an issuer is
+// configured.
+func (i *Internal) ingressTLS(ingressName string, hosts []string) []extv1beta1.IngressTLS {
+	return []extv1beta1.IngressTLS{
+		{
+			Hosts:      hosts,
+			SecretName: fmt.Sprintf("%s-tls", ingressName),
+		},
+	}
 }
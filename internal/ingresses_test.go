@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIngressAnnotations(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	job := multiPortJob(8888)
+	svc := &apiv1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "vice-e1"}}
+
+	annotations := internal.ingressAnnotations(job, svc)
+	assert.Equal("nginx", annotations["kubernetes.io/ingress.class"])
+	assert.Equal(job.Name, annotations[analysisNameAnnotation])
+
+	internal.IngressClass = "vice-nginx"
+	internal.IngressAnnotations = map[string]string{"nginx.ingress.kubernetes.io/ssl-redirect": "true"}
+	internal.CertManagerIssuer = "letsencrypt"
+	annotations = internal.ingressAnnotations(job, svc)
+	assert.Equal("vice-nginx", annotations["kubernetes.io/ingress.class"])
+	assert.Equal("true", annotations["nginx.ingress.kubernetes.io/ssl-redirect"])
+	assert.Equal("letsencrypt", annotations["cert-manager.io/cluster-issuer"])
+
+	internal.CertManagerIssuerKind = "Issuer"
+	annotations = internal.ingressAnnotations(job, svc)
+	assert.Equal("letsencrypt", annotations["cert-manager.io/issuer"])
+	assert.NotContains(annotations, "cert-manager.io/cluster-issuer")
+}
+
+func TestIngressTimeoutAnnotations(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	job := multiPortJob(8888)
+	job.AppID = "app1"
+	svc := &apiv1.Service{ObjectMeta: meta_v1.ObjectMeta{Name: "vice-e1"}}
+
+	internal.IngressProxyReadTimeout = 3600
+	internal.IngressWebSockets = true
+	internal.AppIngressAnnotations = map[string]map[string]string{
+		"app1": {proxySendTimeoutAnnotation: "600"},
+		"app2": {proxyReadTimeoutAnnotation: "60"},
+	}
+
+	annotations := internal.ingressAnnotations(job, svc)
+	assert.Equal("3600", annotations[proxyReadTimeoutAnnotation])
+	assert.Equal("600", annotations[proxySendTimeoutAnnotation])
+	assert.Equal("vice-e1", annotations[websocketServicesAnnotation])
+
+	// Per-app annotations override the global ones.
+	job.AppID = "app2"
+	annotations = internal.ingressAnnotations(job, svc)
+	assert.Equal("60", annotations[proxyReadTimeoutAnnotation])
+	assert.NotContains(annotations, proxySendTimeoutAnnotation)
+}
+
+func TestIngressTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+
+	tls := internal.ingressTLS("a1234abcd", []string{"a1234abcd", "my-notebook"})
+	assert.Len(tls, 1)
+	assert.Equal([]string{"a1234abcd", "my-notebook"}, tls[0].Hosts)
+	assert.Equal("a1234abcd-tls", tls[0].SecretName)
+}
@@ -1,22 +1,23 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 
 	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/app-exposer/permissions"
-	"github.com/gosimple/slug"
+	"github.com/cyverse-de/app-exposer/tracing"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
 
 	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
@@ -26,46 +27,12 @@ import (
 
 var log = common.Log
 
-var leadingLabelReplacerRegexp = regexp.MustCompile("^[^0-9A-Za-z]+")
-var trailingLabelReplacerRegexp = regexp.MustCompile("[^0-9A-Za-z]+$")
-
-// labelReplacerFn returns a function that can be used to replace invalid leading and trailing characters
-// in label values. Hyphens are replaced by the letter "h". Underscores are replaced by the letter "u".
-// Other characters in the match are replaced by the empty string. The prefix and suffix are placed before
-// and after the replacement, respectively.
-func labelReplacerFn(prefix, suffix string) func(string) string {
-	replacementFor := map[rune]string{
-		'-': "h",
-		'_': "u",
-	}
-
-	return func(match string) string {
-		runes := []rune(match)
-		elems := make([]string, len(runes))
-		for i, c := range runes {
-			elems[i] = replacementFor[c]
-		}
-		return prefix + strings.Join(elems, "-") + suffix
-	}
-}
-
-// labelValueString returns a version of the given string that may be used as a value in a Kubernetes
-// label. See: https://kubernetes.io/docs/concepts/overview/working-with-objects/labels/. Leading and
-// trailing underscores and hyphens are replaced by sequences of `u` and `h`, separated by hyphens.
-// These sequences are separated from the main part of the label value by `-xxx-`. This is kind of
-// hokey, but it makes it at least fairly unlikely that we'll encounter collisions.
-func labelValueString(str string) string {
-	slug.MaxLength = 63
-	str = leadingLabelReplacerRegexp.ReplaceAllStringFunc(str, labelReplacerFn("", "-xxx-"))
-	str = trailingLabelReplacerRegexp.ReplaceAllStringFunc(str, labelReplacerFn("-xxx-", ""))
-	return slug.Make(str)
-}
-
 // Init contains configuration for configuring an *Internal.
 type Init struct {
 	PorklockImage                 string
 	PorklockTag                   string
 	UseCSIDriver                  bool
+	ExposeExtraPorts              bool
 	InputPathListIdentifier       string
 	TicketInputPathListIdentifier string
 	ViceProxyImage                string
@@ -81,10 +48,78 @@ type Init struct {
 	JobStatusURL                  string
 	UserSuffix                    string
 	PermissionsURL                string
+	PermissionsCacheTTL           time.Duration
+	PermissionsCacheMaxEntries    int
+	PermissionsInvalidationToken  string
+	LookupCache                   apps.LookupCacheConfig
+	NotificationAgentURL          string
 	KeycloakBaseURL               string
 	KeycloakRealm                 string
 	KeycloakClientID              string
 	KeycloakClientSecret          string
+	ListingCacheTTL               time.Duration
+	IngressClass                  string
+	ExposureBackend               string
+	TunnelClientImage             string
+	TunnelGatewayURL              string
+	IngressAnnotations            map[string]string
+	IngressTLS                    bool
+	CertManagerIssuer             string
+	CertManagerIssuerKind         string
+	IngressProxyReadTimeout       int
+	IngressProxySendTimeout       int
+	IngressWebSockets             bool
+	AppIngressAnnotations         map[string]map[string]string
+	AppTLSModes                   map[string]string
+	IngressClientCertSecret       string
+	PortProtocols                 map[string]map[string]string
+	DefaultLabels                 map[string]string
+	DefaultAnnotations            map[string]string
+	LabelPrefix                   string
+	MigrateLabelKeys              bool
+	DefaultTolerations            []apiv1.Toleration
+	HeadlessServiceApps           []string
+	Scheduling                    SchedulingConfig
+	AppScheduling                 AppSchedulingConfig
+	Sidecars                      []SidecarConfig
+	ImagePullSecrets              []string
+	ToolImagePullSecrets          map[string][]string
+	UsageReportGroups             []UsageReportGroup
+	LaunchShaping                 LaunchShapingConfig
+	PlanEnforcement               bool
+	BlockedEnvironment            []string
+	SubdomainWebhooks             SubdomainWebhookConfig
+	PriorityClasses               PriorityClassConfig
+	ResultManifests               map[string][]string
+	PodSecurity                   PodSecurityConfig
+	Zones                         ZoneConfig
+	Preemptible                   PreemptibleConfig
+	ProxyWatchdog                 ProxyWatchdogConfig
+	CredentialRotation            CredentialRotationConfig
+	TimeLimits                    TimeLimitConfig
+	IdleShutdown                  IdleShutdownConfig
+	PersistentHostnames           PersistentHostnameConfig
+	Publication                   PublicationConfig
+	RBACEnabled                   bool
+	RoleMembers                   map[string][]string
+	IdentityKey                   string
+	Exec                          ExecConfig
+	AppInitContainers             AppInitContainersConfig
+	ImageProbeNamespace           string
+	ImageProbeTimeout             time.Duration
+	ImageProbeEnforced            bool
+	SaveAndExitTimeout            time.Duration
+	NetworkPolicyEnabled          bool
+	NetworkPolicyFromNamespaces   []string
+	NetworkPolicyEgress           []NetworkPolicyEgressRule
+	AuditLog                      AuditConfig
+	LifecycleEvents               bool
+	Quotas                        QuotaConfig
+	NamespaceQuotas               NamespaceQuotaConfig
+	AsyncLaunches                 bool
+	DataInfoBaseURL               string
+	ImagePrepull                  ImagePrepullConfig
+	LaunchSchedules               LaunchScheduleConfig
 }
 
 // Internal contains information and operations for launching VICE apps inside the
@@ -94,130 +129,239 @@ type Internal struct {
 	clientset       kubernetes.Interface
 	db              *sqlx.DB
 	statusPublisher AnalysisStatusPublisher
+	podExecutor     PodExecutor
+	objectApplier   ObjectApplier
+	metaCache       *metaInfoCache
+	listingCache    *listingCache
+	launchQueue     *launchQueue
+	launching       *launchesInProgress
+	launchResources *launchResourcesCache
+	permissions     *permissions.Permissions
+	lookupCache     *apps.LookupCache
+	nodeDrains      *nodeDrains
+	labelKeys       *labelKeys
+	webhookWake     chan struct{}
+	auditSinks      []AuditSink
+	stateLocks      analysisLocks
+	shutdowns       analysisClaims
+	fingerprintKey  []byte
 }
 
 // New creates a new *Internal.
 func New(init *Init, db *sqlx.DB, clientset kubernetes.Interface) *Internal {
+	// Permission checks are only cached if a TTL is configured.
+	perms := &permissions.Permissions{BaseURL: init.PermissionsURL}
+	if init.PermissionsCacheTTL > 0 {
+		perms.Cache = permissions.NewCache(init.PermissionsCacheTTL, init.PermissionsCacheMaxEntries)
+	}
+
+	// ID lookups are only cached if a TTL is configured.
+	var lookupCache *apps.LookupCache
+	if init.LookupCache.TTL > 0 {
+		lookupCache = apps.NewLookupCache(init.LookupCache.TTL, init.LookupCache.MaxEntries)
+	}
+
 	return &Internal{
-		Init:      *init,
-		db:        db,
-		clientset: clientset,
+		Init:            *init,
+		db:              db,
+		clientset:       clientset,
+		metaCache:       newMetaInfoCache(),
+		listingCache:    newListingCache(init.ListingCacheTTL),
+		launchQueue:     newLaunchQueue(),
+		launching:       newLaunchesInProgress(db),
+		launchResources: newLaunchResourcesCache(launchResourcesTTL),
+		permissions:     perms,
+		lookupCache:     lookupCache,
+		nodeDrains:      newNodeDrains(),
+		labelKeys:       newLabelKeys(init.LabelPrefix, init.MigrateLabelKeys),
+		webhookWake:     make(chan struct{}, 1),
+		auditSinks:      newAuditSinks(&init.AuditLog, db),
+		fingerprintKey:  init.CredentialRotation.fingerprintKey(),
 		statusPublisher: &JSLPublisher{
-			statusURL: init.JobStatusURL,
+			transport: NewHTTPStatusTransport(init.JobStatusURL),
 		},
 	}
 }
 
+// newApps returns an *apps.Apps that shares the ID lookup cache.
+func (i *Internal) newApps() *apps.Apps {
+	return apps.NewCachedApps(i.db, i.UserSuffix, i.lookupCache)
+}
+
 // labelsFromJob returns a map[string]string that can be used as labels for K8s resources.
+// The keys of the labels describing the analysis get the configured prefix.
 func (i *Internal) labelsFromJob(job *model.Job) (map[string]string, error) {
-	name := []rune(job.Name)
-
-	var stringmax int
-	if len(name) >= 63 {
-		stringmax = 62
-	} else {
-		stringmax = len(name) - 1
-	}
-
-	a := apps.NewApps(i.db, i.UserSuffix)
-	ipAddr, err := a.GetUserIP(job.UserID)
+	a := i.newApps()
+	ipAddr, err := a.GetUserIP(context.Background(), job.UserID)
 	if err != nil {
 		return nil, err
 	}
 
-	return map[string]string{
+	labels := i.labelKeys.labels(map[string]string{
 		"external-id":   job.InvocationID,
-		"app-name":      labelValueString(job.AppName),
+		"app-name":      common.LabelValueString(job.AppName),
 		"app-id":        job.AppID,
-		"username":      labelValueString(job.Submitter),
+		"username":      common.LabelValueString(job.Submitter),
 		"user-id":       job.UserID,
-		"analysis-name": labelValueString(string(name[:stringmax])),
+		"analysis-name": common.LabelValueString(job.Name),
 		"app-type":      "interactive",
-		"subdomain":     IngressName(job.UserID, job.InvocationID),
+		"subdomain":     i.subdomain(job.UserID, job.InvocationID),
 		"login-ip":      ipAddr,
-	}, nil
+	})
+
+	// The configured defaults can't use any of the labels above, but make sure
+	// they don't replace them anyway.
+	for k, v := range i.DefaultLabels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+
+	return labels, nil
+}
+
+// Annotations recording the values of the name labels before they were made
+// safe to use as label values.
+const (
+	analysisNameAnnotation = "vice.cyverse.org/analysis-name"
+	appNameAnnotation      = "vice.cyverse.org/app-name"
+	usernameAnnotation     = "vice.cyverse.org/username"
+)
+
+// annotationsFromJob returns the annotations for the K8s resources created for
+// the job, which are the default annotations along with the original analysis
+// name, app name, and username. Annotation values aren't restricted the way
+// label values are, so they're kept as is.
+func (i *Internal) annotationsFromJob(job *model.Job) map[string]string {
+	annotations := i.defaultAnnotations()
+	annotations[analysisNameAnnotation] = job.Name
+	annotations[appNameAnnotation] = job.AppName
+	annotations[usernameAnnotation] = job.Submitter
+	return annotations
 }
 
 // UpsertExcludesConfigMap uses the Job passed in to assemble the ConfigMap
 // containing the files that should not be uploaded to iRODS. It then calls
-// the k8s API to create the ConfigMap if it does not already exist or to
-// update it if it does.
+// the k8s API to apply the ConfigMap, creating it if it does not already exist
+// or updating it if it does.
 func (i *Internal) UpsertExcludesConfigMap(job *model.Job) error {
 	excludesCM, err := i.excludesConfigMap(job)
 	if err != nil {
 		return err
 	}
 
-	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+	return i.applyObject(i.ViceNamespace, excludesCM, func() error {
+		cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
 
-	_, err = cmclient.Get(excludesConfigMapName(job), metav1.GetOptions{})
-	if err != nil {
-		log.Info(err)
-		_, err = cmclient.Create(excludesCM)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err = cmclient.Update(excludesCM)
+		_, err := cmclient.Get(excludesConfigMapName(job), metav1.GetOptions{})
 		if err != nil {
-			return err
+			log.Info(err)
+			_, err = cmclient.Create(excludesCM)
+		} else {
+			_, err = cmclient.Update(excludesCM)
 		}
-	}
-	return nil
+		return err
+	})
 }
 
 // UpsertInputPathListConfigMap uses the Job passed in to assemble the ConfigMap
 // containing the path list of files to download from iRODS for the VICE analysis.
-// It then uses the k8s API to create the ConfigMap if it does not already exist or to
-// update it if it does.
+// It then uses the k8s API to apply the ConfigMap, creating it if it does not already
+// exist or updating it if it does.
 func (i *Internal) UpsertInputPathListConfigMap(job *model.Job) error {
 	inputCM, err := i.inputPathListConfigMap(job)
 	if err != nil {
 		return err
 	}
 
-	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+	return i.applyObject(i.ViceNamespace, inputCM, func() error {
+		cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
 
-	_, err = cmclient.Get(inputPathListConfigMapName(job), metav1.GetOptions{})
-	if err != nil {
-		_, err = cmclient.Create(inputCM)
+		_, err := cmclient.Get(inputPathListConfigMapName(job), metav1.GetOptions{})
 		if err != nil {
-			return err
-		}
-	} else {
-		_, err = cmclient.Update(inputCM)
-		if err != nil {
-			return err
+			_, err = cmclient.Create(inputCM)
+		} else {
+			_, err = cmclient.Update(inputCM)
 		}
-	}
-
-	return nil
+		return err
+	})
 }
 
 // UpsertDeployment uses the Job passed in to assemble a Deployment for the
-// VICE analysis. If then uses the k8s API to create the Deployment if it does
-// not already exist or to update it if it does.
+// VICE analysis. If then uses the k8s API to apply the Deployment, creating it
+// if it does not already exist or updating it if it does. The rest of the
+// resources the analysis needs are applied the same way.
 func (i *Internal) UpsertDeployment(job *model.Job) error {
 	deployment, err := i.getDeployment(job)
 	if err != nil {
 		return err
 	}
 
-	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
-	_, err = depclient.Get(job.InvocationID, metav1.GetOptions{})
-	if err != nil {
-		_, err = depclient.Create(deployment)
+	err = i.applyObject(i.ViceNamespace, deployment, func() error {
+		depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+		_, err := depclient.Get(job.InvocationID, metav1.GetOptions{})
 		if err != nil {
-			return err
+			_, err = depclient.Create(deployment)
+		} else {
+			_, err = depclient.Update(deployment)
 		}
-	} else {
-		_, err = depclient.Update(deployment)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = i.upsertAnalysisVolumes(job); err != nil {
+		return err
+	}
+
+	// Create the service for the job. Without server-side apply, an existing
+	// Service is left alone, since updating it would need its cluster IP.
+	svc, err := i.getService(job, deployment)
+	if err != nil {
+		return err
+	}
+	err = i.applyObject(i.ViceNamespace, svc, func() error {
+		svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
+		_, err := svcclient.Get(job.InvocationID, metav1.GetOptions{})
 		if err != nil {
-			return err
+			_, err = svcclient.Create(svc)
 		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Create the headless service for the job, if it needs one.
+	if err = i.UpsertHeadlessService(job); err != nil {
+		return err
+	}
+
+	// Analyses served through tunnels don't get an Ingress.
+	if i.tunnelEnabled() {
+		return nil
+	}
+
+	// Create the ingress for the job
+	ingress, err := i.getIngress(job, svc)
+	if err != nil {
+		return err
 	}
 
-	// Create the persistent volume and persistent volume claim for the job.
+	return i.applyObject(i.ViceNamespace, ingress, func() error {
+		ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
+		_, err := ingressclient.Get(ingress.Name, metav1.GetOptions{})
+		if err != nil {
+			_, err = ingressclient.Create(ingress)
+		}
+		return err
+	})
+}
+
+// upsertAnalysisVolumes applies the persistent volume and persistent volume
+// claim for the job's CSI data mount, if it uses one.
+func (i *Internal) upsertAnalysisVolumes(job *model.Job) error {
 	volume, err := i.getPersistentVolume(job)
 	if err != nil {
 		return err
@@ -229,112 +373,248 @@ func (i *Internal) UpsertDeployment(job *model.Job) error {
 	}
 
 	if volume != nil {
-		pvclient := i.clientset.CoreV1().PersistentVolumes()
-		_, err = pvclient.Get(volume.GetName(), metav1.GetOptions{})
-		if err != nil {
-			_, err = pvclient.Create(volume)
+		err = i.applyObject("", volume, func() error {
+			pvclient := i.clientset.CoreV1().PersistentVolumes()
+			_, err := pvclient.Get(volume.GetName(), metav1.GetOptions{})
 			if err != nil {
-				return err
-			}
-		} else {
-			_, err = pvclient.Update(volume)
-			if err != nil {
-				return err
+				_, err = pvclient.Create(volume)
+			} else {
+				_, err = pvclient.Update(volume)
 			}
+			return err
+		})
+		if err != nil {
+			return err
 		}
 	}
 
 	if volumeclaim != nil {
-		pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
-		_, err = pvcclient.Get(volumeclaim.GetName(), metav1.GetOptions{})
-		if err != nil {
-			_, err = pvcclient.Create(volumeclaim)
-			if err != nil {
-				return err
-			}
-		} else {
-			_, err = pvcclient.Update(volumeclaim)
+		err = i.applyObject(i.ViceNamespace, volumeclaim, func() error {
+			pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
+			_, err := pvcclient.Get(volumeclaim.GetName(), metav1.GetOptions{})
 			if err != nil {
-				return err
+				_, err = pvcclient.Create(volumeclaim)
+			} else {
+				_, err = pvcclient.Update(volumeclaim)
 			}
+			return err
+		})
+		if err != nil {
+			return err
 		}
 	}
 
-	// Create the service for the job.
-	svc, err := i.getService(job, deployment)
-	if err != nil {
+	return nil
+}
+
+// LaunchAppHandler is the HTTP handler that orchestrates the launching of a VICE analysis inside
+// the k8s cluster. This get passed to the router to be associated with a route. The Job
+// is passed in as the body of the request.
+func (i *Internal) LaunchAppHandler(c echo.Context) error {
+	request := &LaunchRequest{}
+
+	if err := c.Bind(request); err != nil {
 		return err
 	}
-	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
-	_, err = svcclient.Get(job.InvocationID, metav1.GetOptions{})
-	if err != nil {
-		_, err = svcclient.Create(svc)
+
+	return i.launch(c, request)
+}
+
+// launch launches the analysis in the request and responds the way the launch
+// endpoint does. The dry-run and subdomain query parameters are honored.
+func (i *Internal) launch(c echo.Context, request *LaunchRequest) error {
+	var err error
+
+	job := &request.Job
+
+	// Retried launch requests get the analysis that's already been launched
+	// instead of launching it again. Dry runs don't launch anything, so they
+	// aren't checked.
+	inBackground := false
+	if c.QueryParam("dry-run") != "true" {
+		begun, err := i.launching.begin(job.InvocationID)
+		if err != nil {
+			return err
+		}
+		if !begun {
+			return (&ExistingLaunch{ExternalID: job.InvocationID}).respond(c)
+		}
+
+		// Launches provisioned in the background stay in progress until
+		// provisioning finishes.
+		defer func() {
+			if !inBackground {
+				i.launching.end(job.InvocationID)
+			}
+		}()
+
+		existing, err := i.existingLaunch(job.InvocationID)
 		if err != nil {
 			return err
 		}
+		if existing != nil {
+			log.Infof("launch of analysis %s was already requested", job.InvocationID)
+			return existing.respond(c)
+		}
 	}
 
-	// Create the ingress for the job
-	ingress, err := i.getIngress(job, svc)
-	if err != nil {
+	if err = validateExecutionTarget(job); err != nil {
 		return err
 	}
 
-	ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
-	_, err = ingressclient.Get(ingress.Name, metav1.GetOptions{})
+	referenceData, err := i.checkLaunch(c.Request().Context(), request, 1)
 	if err != nil {
-		_, err = ingressclient.Create(ingress)
-		if err != nil {
+		return err
+	}
+
+	// Dry runs stop short of recording or creating anything.
+	if c.QueryParam("dry-run") == "true" {
+		return i.dryRunLaunch(c, job, referenceData)
+	}
+
+	// Record the subdomain requested for the analysis, if any, before any of
+	// the resources that use it are created. Otherwise the hostname the user
+	// has claimed for the app moves to the new analysis.
+	if subdomain := c.QueryParam("subdomain"); subdomain != "" {
+		if err = i.setSubdomain(job.InvocationID, subdomain); err != nil {
 			return err
 		}
+	} else if err = i.routeClaimedHostname(c.Request().Context(), job); err != nil {
+		return err
 	}
 
-	return nil
-}
+	position, err := i.submitLaunch(job, referenceData)
+	if err != nil {
+		return err
+	}
+	if position != nil {
+		return c.JSON(http.StatusAccepted, launchAccepted(job.InvocationID, position))
+	}
 
-// LaunchAppHandler is the HTTP handler that orchestrates the launching of a VICE analysis inside
-// the k8s cluster. This get passed to the router to be associated with a route. The Job
-// is passed in as the body of the request.
-func (i *Internal) LaunchAppHandler(c echo.Context) error {
-	var (
-		job *model.Job
-		err error
-	)
+	if i.AsyncLaunches {
+		inBackground = true
+		i.provisionInBackground(job.InvocationID, func(ctx context.Context) error {
+			return i.provisionAnalysis(ctx, job)
+		})
+		return c.JSON(http.StatusAccepted, launchAccepted(job.InvocationID, nil))
+	}
 
-	job = &model.Job{}
+	return i.provisionAnalysis(c.Request().Context(), job)
+}
 
-	if err = c.Bind(job); err != nil {
-		return err
+// checkLaunch adds the environment variables in the launch request to the job
+// and validates it, then looks up the reference data it asks for. Replicas is
+// the number of copies of the job that are run, which is more than one for
+// array jobs.
+func (i *Internal) checkLaunch(ctx context.Context, request *LaunchRequest, replicas int) ([]ReferenceDataset, error) {
+	job := &request.Job
+
+	if err := i.applyLaunchEnvironment(job, request.LaunchEnvironment); err != nil {
+		return nil, err
 	}
 
-	if status, err := i.validateJob(job); err != nil {
+	if status, err := i.validateJob(ctx, job, replicas); err != nil {
 		if validationErr, ok := err.(common.ErrorResponse); ok {
-			return validationErr
+			return nil, validationErr
 		}
-		return echo.NewHTTPError(status, err.Error())
+		return nil, echo.NewHTTPError(status, err.Error())
+	}
+
+	return i.lookupReferenceData(request.ReferenceData)
+}
+
+// submitLaunch records that the launch of the job was requested and queues it
+// if the cluster is busy, returning its position in the queue. Jobs that
+// aren't queued are ready to be provisioned.
+func (i *Internal) submitLaunch(job *model.Job, referenceData []ReferenceDataset) (*QueuePosition, error) {
+	if err := i.recordReferenceData(job.InvocationID, referenceData); err != nil {
+		return nil, err
+	}
+
+	i.transitionAndLog(job.InvocationID, RequestedState, fmt.Sprintf("launch requested for analysis %s", job.Name))
+
+	// Wait for capacity if the cluster is busy.
+	position, err := i.queueLaunchIfBusy(job)
+	if err != nil {
+		return nil, err
+	}
+	if position != nil {
+		msg := fmt.Sprintf("analysis %s is queued at position %d", job.Name, position.Position)
+		if err = i.statusPublisher.Queued(job.InvocationID, msg); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return position, nil
+}
+
+// provisionStep runs a step of provisioning an analysis in a span of its own,
+// so that slow launches can be broken down by step.
+func provisionStep(ctx context.Context, name string, step func() error) error {
+	_, span := tracing.StartSpan(ctx, name)
+	defer span.End()
+
+	err := step()
+	tracing.RecordError(span, err)
+	return err
+}
+
+// provisionAnalysis creates the k8s resources for the analysis. If a step
+// fails, the resources created by the earlier steps are removed again.
+func (i *Internal) provisionAnalysis(ctx context.Context, job *model.Job) error {
+	var err error
+
+	// The capacity set aside by the launch queue is counted by way of the
+	// deployment once provisioning is done.
+	defer i.launchQueue.release(job.InvocationID)
+
+	i.transitionAndLog(job.InvocationID, ProvisioningState, fmt.Sprintf("creating resources for analysis %s", job.Name))
+
+	// Note what already exists so that a failed launch only removes what it
+	// created.
+	existing, err := i.analysisResources(job.InvocationID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "unable to list the existing resources for analysis %s; it won't be rolled back if the launch fails", job.InvocationID))
 	}
 
 	// Create the excludes file ConfigMap for the job.
-	if err = i.UpsertExcludesConfigMap(job); err != nil {
-		return err
+	if err = provisionStep(ctx, "UpsertExcludesConfigMap", func() error { return i.UpsertExcludesConfigMap(job) }); err != nil {
+		return i.failLaunch(job, existing, "create the excludes file", err)
 	}
 
 	// Create the input path list config map
-	if err = i.UpsertInputPathListConfigMap(job); err != nil {
-		return err
+	if err = provisionStep(ctx, "UpsertInputPathListConfigMap", func() error { return i.UpsertInputPathListConfigMap(job) }); err != nil {
+		return i.failLaunch(job, existing, "create the input path list", err)
+	}
+
+	// Render the app's config templates before the deployment mounts them.
+	if err = provisionStep(ctx, "UpsertConfigTemplateConfigMaps", func() error { return i.UpsertConfigTemplateConfigMaps(job) }); err != nil {
+		return i.failLaunch(job, existing, "render the config templates", err)
 	}
 
 	// Create the deployment for the job.
-	if err = i.UpsertDeployment(job); err != nil {
-		return err
+	if err = provisionStep(ctx, "UpsertDeployment", func() error { return i.UpsertDeployment(job) }); err != nil {
+		return i.failLaunch(job, existing, "create the deployment", err)
 	}
 
+	if err = provisionStep(ctx, "UpsertNetworkPolicy", func() error { return i.UpsertNetworkPolicy(job) }); err != nil {
+		return i.failLaunch(job, existing, "create the network policy", err)
+	}
+
+	i.recordLaunch(ctx, job)
+
+	i.publishSubdomainEvents(SubdomainAllocated, job.UserID, job.InvocationID)
+
+	i.recordUsageStart(job, 1)
+
+	i.recordAnalysisEvent(job.InvocationID, apiv1.EventTypeNormal, EventLaunched, fmt.Sprintf("launched analysis %s for %s", job.Name, job.Submitter), true)
+
 	return nil
 }
 
 // TriggerDownloadsHandler handles requests to trigger file downloads.
 func (i *Internal) TriggerDownloadsHandler(c echo.Context) error {
-	return i.doFileTransfer(c.Param("id"), downloadBasePath, downloadKind, true)
+	return i.doFileTransfer(context.Background(), c.Param("id"), downloadBasePath, downloadKind, true)
 }
 
 // AdminTriggerDownloadsHandler handles requests to trigger file downloads
@@ -346,17 +626,17 @@ func (i *Internal) AdminTriggerDownloadsHandler(c echo.Context) error {
 
 	analysisID := c.Param("analysis-id")
 
-	externalID, err := i.getExternalIDByAnalysisID(analysisID)
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
 	}
 
-	return i.doFileTransfer(externalID, downloadBasePath, downloadKind, true)
+	return i.doFileTransfer(context.Background(), externalID, downloadBasePath, downloadKind, true)
 }
 
 // TriggerUploadsHandler handles requests to trigger file uploads.
 func (i *Internal) TriggerUploadsHandler(c echo.Context) error {
-	return i.doFileTransfer(c.Param("id"), uploadBasePath, uploadKind, true)
+	return i.doFileTransfer(context.Background(), c.Param("id"), uploadBasePath, uploadKind, true)
 }
 
 // AdminTriggerUploadsHandler handles requests to trigger file uploads without
@@ -368,93 +648,227 @@ func (i *Internal) AdminTriggerUploadsHandler(c echo.Context) error {
 
 	analysisID := c.Param("analysis-id")
 
-	externalID, err := i.getExternalIDByAnalysisID(analysisID)
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
 	}
 
-	return i.doFileTransfer(externalID, uploadBasePath, uploadKind, true)
+	return i.doFileTransfer(context.Background(), externalID, uploadBasePath, uploadKind, true)
 }
 
 func (i *Internal) doExit(externalID string) error {
-	set := labels.Set(map[string]string{
+	return i.teardown(externalID, false)
+}
+
+// teardown deletes the resources for the analysis in stages, recording the
+// progress of each one. If upload is true, the output files are saved first
+// and the final status of the analysis is published before anything is
+// deleted. Otherwise only the CSI data mount is flushed, since it's backed by
+// a persistent volume that's about to go away. A failure to save the outputs
+// doesn't stop the teardown.
+func (i *Internal) teardown(externalID string, upload bool) error {
+	// Nothing has been created for launches that are still queued.
+	if i.cancelQueuedLaunch(externalID) {
+		i.transitionAndLog(externalID, FailedState, fmt.Sprintf("launch of analysis %s was canceled while queued", externalID))
+		return nil
+	}
+
+	t := i.startTeardown(externalID)
+	defer t.finish()
+
+	i.saveOutputsBeforeExit(t, externalID, upload)
+
+	if upload {
+		i.finishSaveAndExit(t, externalID)
+	} else {
+		i.transitionAndLog(externalID, TerminatingState, fmt.Sprintf("termination requested for analysis %s", externalID))
+	}
+
+	i.publishSavedOutputs(externalID, t.progress.OutputsSaved)
+
+	set := labels.Set(i.labelKeys.selector(map[string]string{
 		"external-id": externalID,
-	})
+	}))
 
 	listoptions := metav1.ListOptions{
 		LabelSelector: set.AsSelector().String(),
 	}
 
-	// Delete the ingress
-	ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
-	ingresslist, err := ingressclient.List(listoptions)
-	if err != nil {
-		return err
+	// Objects whose labels went missing are found by the names they were
+	// created with.
+	record := i.launchRecord(externalID)
+	if record == nil {
+		record = &apps.LaunchRecord{}
 	}
 
-	for _, ingress := range ingresslist.Items {
-		if err = ingressclient.Delete(ingress.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+	err := t.run(TeardownRemovingRouting, func() error {
+		// Delete the ingress
+		ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
+		ingresslist, err := ingressclient.List(listoptions)
+		if err != nil {
+			return err
 		}
-	}
 
-	// Delete the service
-	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
-	svclist, err := svcclient.List(listoptions)
-	if err != nil {
-		return err
-	}
+		found := map[string]bool{}
+		for _, ingress := range ingresslist.Items {
+			found[ingress.Name] = true
+			if err = ingressclient.Delete(ingress.Name, &metav1.DeleteOptions{}); err != nil {
+				log.Error(err)
+			}
+		}
+		deleteRecordedObjects("ingress", []string{record.IngressName}, found, func(name string) error {
+			return ingressclient.Delete(name, &metav1.DeleteOptions{})
+		})
+
+		// Delete the service
+		svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
+		svclist, err := svcclient.List(listoptions)
+		if err != nil {
+			return err
+		}
+
+		found = map[string]bool{}
+		for _, svc := range svclist.Items {
+			found[svc.Name] = true
+			if err = svcclient.Delete(svc.Name, &metav1.DeleteOptions{}); err != nil {
+				log.Error(err)
+			}
+		}
+		deleteRecordedObjects("service", []string{record.ServiceName}, found, func(name string) error {
+			return svcclient.Delete(name, &metav1.DeleteOptions{})
+		})
+
+		// Delete the network policy
+		npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+		nplist, err := npclient.List(listoptions)
+		if err != nil {
+			return err
+		}
+
+		for _, np := range nplist.Items {
+			if err = npclient.Delete(np.Name, &metav1.DeleteOptions{}); err != nil {
+				log.Error(err)
+			}
+		}
 
-	for _, svc := range svclist.Items {
-		if err = svcclient.Delete(svc.Name, &metav1.DeleteOptions{}); err != nil {
+		// Free up the requested subdomain so that it can be used again, then
+		// tell the systems watching the subdomains that they're gone.
+		subdomains := i.analysisSubdomains(externalID)
+		if err = i.releaseSubdomain(externalID); err != nil {
 			log.Error(err)
 		}
-	}
+		for _, subdomain := range subdomains {
+			i.publishSubdomainEvent(SubdomainReleased, externalID, subdomain)
+		}
 
-	// Delete the deployment
-	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
-	deplist, err := depclient.List(listoptions)
-	if err != nil {
-		return err
-	}
+		if i.tunnelEnabled() {
+			if err = i.deleteTunnel(externalID); err != nil {
+				log.Error(err)
+			}
+		}
 
-	for _, dep := range deplist.Items {
-		if err = depclient.Delete(dep.Name, &metav1.DeleteOptions{}); err != nil {
+		// The alias Service went with the others, but the rest of the network
+		// group needs its policy updated.
+		if err = i.leaveNetworkGroup(externalID); err != nil {
 			log.Error(err)
 		}
-	}
 
-	// Delete volumes used by the deployment
-	// Delete persistent volume claims.
-	// This will automatically delete persistent volumes associated with them.
-	pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
-	pvclist, err := pvcclient.List(listoptions)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, pvc := range pvclist.Items {
-		if err = pvcclient.Delete(pvc.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+	err = t.run(TeardownStoppingApp, func() error {
+		// Delete the deployment
+		depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+		deplist, err := depclient.List(listoptions)
+		if err != nil {
+			return err
 		}
-	}
 
-	// Delete the input files list and the excludes list config maps
-	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
-	cmlist, err := cmclient.List(listoptions)
+		// The pods are about to go away along with the nodes they ran on.
+		i.recordUsageStop(externalID)
+
+		found := map[string]bool{}
+		for idx, dep := range deplist.Items {
+			// The Event outlives the Deployment, so it's still there for
+			// anyone looking into why the analysis went away.
+			i.recordDeploymentEvent(&deplist.Items[idx], apiv1.EventTypeNormal, EventTerminated, fmt.Sprintf("terminating analysis %s", externalID))
+
+			found[dep.Name] = true
+			if err = depclient.Delete(dep.Name, &metav1.DeleteOptions{}); err != nil {
+				log.Error(err)
+			}
+		}
+		deleteRecordedObjects("deployment", []string{record.DeploymentName}, found, func(name string) error {
+			return depclient.Delete(name, &metav1.DeleteOptions{})
+		})
+
+		// Delete the job, for batch analyses
+		jobclient := i.clientset.BatchV1().Jobs(i.ViceNamespace)
+		joblist, err := jobclient.List(listoptions)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range joblist.Items {
+			if err = jobclient.Delete(job.Name, jobDeleteOptions()); err != nil {
+				log.Error(err)
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	log.Infof("number of configmaps to be deleted for %s: %d", externalID, len(cmlist.Items))
+	err = t.run(TeardownReleasingStorage, func() error {
+		// Delete volumes used by the deployment
+		// Delete persistent volume claims.
+		// This will automatically delete persistent volumes associated with them.
+		pvcclient := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
+		pvclist, err := pvcclient.List(listoptions)
+		if err != nil {
+			return err
+		}
 
-	for _, cm := range cmlist.Items {
-		log.Infof("deleting configmap %s for %s", cm.Name, externalID)
-		if err = cmclient.Delete(cm.Name, &metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+		found := map[string]bool{}
+		for _, pvc := range pvclist.Items {
+			found[pvc.Name] = true
+			if err = pvcclient.Delete(pvc.Name, &metav1.DeleteOptions{}); err != nil {
+				log.Error(err)
+			}
+		}
+		deleteRecordedObjects("persistent volume claim", record.PVCNames, found, func(name string) error {
+			return pvcclient.Delete(name, &metav1.DeleteOptions{})
+		})
+
+		// Delete the input files list and the excludes list config maps
+		cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+		cmlist, err := cmclient.List(listoptions)
+		if err != nil {
+			return err
 		}
+
+		log.Infof("number of configmaps to be deleted for %s: %d", externalID, len(cmlist.Items))
+
+		for _, cm := range cmlist.Items {
+			log.Infof("deleting configmap %s for %s", cm.Name, externalID)
+			if err = cmclient.Delete(cm.Name, &metav1.DeleteOptions{}); err != nil {
+				log.Error(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
+	i.markLaunchTerminated(externalID)
+
 	return nil
 }
 
@@ -462,9 +876,21 @@ func (i *Internal) doExit(externalID string) error {
 // resources asscociated with it. Does not save outputs first. Uses
 // the external-id label to find all of the objects in the configured
 // namespace associated with the job. Deletes the following objects:
-// ingresses, services, deployments, and configmaps.
+// ingresses, services, deployments, and configmaps. Analyses protected from
+// deletion are only terminated if the force query parameter is true. If the
+// user query parameter is set, the user needs write access to the analysis.
 func (i *Internal) ExitHandler(c echo.Context) error {
-	return i.doExit(c.Param("id"))
+	externalID := c.Param("id")
+
+	if err := i.checkControlAccess(c, externalID); err != nil {
+		return err
+	}
+
+	if err := i.checkDeletionProtection(c, externalID); err != nil {
+		return err
+	}
+
+	return i.doExit(externalID)
 }
 
 // AdminExitHandler terminates the VICE analysis based on the analysisID and
@@ -475,9 +901,13 @@ func (i *Internal) AdminExitHandler(c echo.Context) error {
 
 	analysisID := c.Param("analysis-id")
 
-	externalID, err := i.getExternalIDByAnalysisID(analysisID)
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	if err = i.checkDeletionProtection(c, externalID); err != nil {
+		return err
 	}
 
 	return i.doExit(externalID)
@@ -508,7 +938,6 @@ func (i *Internal) getIDFromHost(host string) (string, error) {
 // and return an error if they aren't allowed to access the running app.
 func (i *Internal) URLReadyHandler(c echo.Context) error {
 	var (
-		ingressExists bool
 		serviceExists bool
 		podReady      bool
 	)
@@ -521,8 +950,8 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 	// Since some usernames don't come through the labelling process unscathed, we have to use
 	// the user ID.
 	fixedUser := i.fixUsername(user)
-	a := apps.NewApps(i.db, i.UserSuffix)
-	_, err := a.GetUserID(fixedUser)
+	a := i.newApps()
+	_, err := a.GetUserID(c.Request().Context(), fixedUser)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", fixedUser))
@@ -532,19 +961,15 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 
 	host := c.Param("host")
 
-	// Use the name of the ingress to retrieve the externalID
-	id, err := i.getIDFromHost(host)
+	// Look up the externalID through the Ingress or tunnel serving the host.
+	id, ingressExists, err := i.exposedID(host)
 	if err != nil {
 		return err
 	}
 
-	// If getIDFromHost returns without an error, then the ingress exists
-	// since the ingresses are looked at for the host.
-	ingressExists = true
-
-	set := labels.Set(map[string]string{
+	set := labels.Set(i.labelKeys.selector(map[string]string{
 		"external-id": id,
-	})
+	}))
 
 	listoptions := metav1.ListOptions{
 		LabelSelector: set.AsSelector().String(),
@@ -576,17 +1001,17 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 		"ready": ingressExists && serviceExists && podReady,
 	}
 
-	analysisID, err := a.GetAnalysisIDByExternalID(id)
+	if data["ready"] {
+		i.recordURLReady(deplist.Items, host)
+	}
+
+	analysisID, err := a.GetAnalysisIDByExternalID(c.Request().Context(), id)
 	if err != nil {
 		return err
 	}
 
 	// Make sure the user has permissions to look up info about this analysis.
-	p := &permissions.Permissions{
-		BaseURL: i.PermissionsURL,
-	}
-
-	allowed, err := p.IsAllowed(user, analysisID)
+	allowed, err := i.permissions.IsAllowed(c.Request().Context(), user, analysisID)
 	if err != nil {
 		return err
 	}
@@ -604,26 +1029,21 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 // existence of the various resources created for the app.
 func (i *Internal) AdminURLReadyHandler(c echo.Context) error {
 	var (
-		ingressExists bool
 		serviceExists bool
 		podReady      bool
 	)
 
 	host := c.Param("host")
 
-	// Use the name of the ingress to retrieve the externalID
-	id, err := i.getIDFromHost(host)
+	// Look up the externalID through the Ingress or tunnel serving the host.
+	id, ingressExists, err := i.exposedID(host)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
 	}
 
-	// If getIDFromHost returns without an error, then the ingress exists
-	// since the ingresses are looked at for the host.
-	ingressExists = true
-
-	set := labels.Set(map[string]string{
+	set := labels.Set(i.labelKeys.selector(map[string]string{
 		"external-id": id,
-	})
+	}))
 
 	listoptions := metav1.ListOptions{
 		LabelSelector: set.AsSelector().String(),
@@ -655,37 +1075,51 @@ func (i *Internal) AdminURLReadyHandler(c echo.Context) error {
 		"ready": ingressExists && serviceExists && podReady,
 	}
 
+	if data["ready"] {
+		i.recordURLReady(deplist.Items, host)
+	}
+
 	return c.JSON(http.StatusOK, data)
 }
 
 // SaveAndExitHandler handles requests to save the output files in iRODS and then exit.
-// The exit portion will only occur if the save operation succeeds. The operation is
+// The save waits up to the save-and-exit timeout, then the final status of the
+// analysis is published and its resources are deleted. The operation is
 // performed inside of a goroutine so that the caller isn't waiting for hours/days for
-// output file transfers to complete.
+// output file transfers to complete. Analyses protected from deletion are only
+// shut down if the force query parameter is true. If the user query parameter
+// is set, the user needs write access to the analysis.
 func (i *Internal) SaveAndExitHandler(c echo.Context) error {
 	log.Info("save and exit called")
 
+	// The context is reused once the handler returns, so read the parameter first.
+	externalID := c.Param("id")
+
+	if err := i.checkControlAccess(c, externalID); err != nil {
+		return err
+	}
+
+	if err := i.checkDeletionProtection(c, externalID); err != nil {
+		return err
+	}
+
 	// Since file transfers can take a while, we should do this asynchronously by default.
-	go func(c echo.Context) {
+	go func() {
 		var err error
 
-		externalID := c.Param("id")
-
 		log.Infof("calling doFileTransfer for %s", externalID)
 
-		// Trigger a blocking output file transfer request.
-		if err = i.doFileTransfer(externalID, uploadBasePath, uploadKind, false); err != nil {
-			log.Error(errors.Wrap(err, "error doing file transfer")) // Log but don't exit. Possible to cancel a job that hasn't started yet
-		}
-
-		log.Infof("calling VICEExit for %s", externalID)
+		// Upload the output files, then tear down the analysis. The teardown
+		// goes ahead even if the upload fails, since it's possible to cancel
+		// a job that hasn't started yet.
+		log.Infof("calling teardown for %s", externalID)
 
-		if err = i.doExit(externalID); err != nil {
+		if err = i.teardown(externalID, true); err != nil {
 			log.Error(errors.Wrapf(err, "error triggering analysis exit for %s", externalID))
 		}
 
 		log.Infof("after VICEExit for %s", externalID)
-	}(c)
+	}()
 
 	log.Info("leaving save and exit")
 
@@ -699,35 +1133,30 @@ func (i *Internal) SaveAndExitHandler(c echo.Context) error {
 func (i *Internal) AdminSaveAndExitHandler(c echo.Context) error {
 	log.Info("admin save and exit called")
 
-	// Since file transfers can take a while, we should do this asynchronously by default.
-	go func(c echo.Context) {
-		var (
-			err        error
-			externalID string
-		)
-
-		log.Debug("calling doFileTransfer")
+	analysisID := c.Param("analysis-id")
 
-		analysisID := c.Param("analysis-id")
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
 
-		if externalID, err = i.getExternalIDByAnalysisID(analysisID); err != nil {
-			log.Error(err)
-			return
-		}
+	if err = i.checkDeletionProtection(c, externalID); err != nil {
+		return err
+	}
 
-		// Trigger a blocking output file transfer request.
-		if err = i.doFileTransfer(externalID, uploadBasePath, uploadKind, false); err != nil {
-			log.Error(errors.Wrap(err, "error doing file transfer")) // Log but don't exit. Possible to cancel a job that hasn't started yet
-		}
+	// Since file transfers can take a while, we should do this asynchronously by default.
+	go func() {
+		log.Debug("calling doFileTransfer")
 
-		log.Debug("calling VICEExit")
+		// Upload the output files, then tear down the analysis.
+		log.Debug("calling teardown")
 
-		if err = i.doExit(externalID); err != nil {
+		if err := i.teardown(externalID, true); err != nil {
 			log.Error(err)
 		}
 
 		log.Debug("after VICEExit")
-	}(c)
+	}()
 
 	log.Info("admin leaving save and exit")
 	return nil
@@ -756,6 +1185,7 @@ const getUserIDSQL = `
 `
 
 // TimeLimitUpdateHandler handles requests to update the time limit on an already running VICE app.
+// Users need write access to the analysis, and the limit is extended on behalf of the owner.
 func (i *Internal) TimeLimitUpdateHandler(c echo.Context) error {
 	log.Info("update time limit called")
 
@@ -779,7 +1209,14 @@ func (i *Internal) TimeLimitUpdateHandler(c echo.Context) error {
 		return idErr
 	}
 
-	outputMap, err := i.updateTimeLimit(user, id)
+	// Users with write access can extend an analysis shared with them, but
+	// the time limit is tracked for the owner.
+	owner, err := i.checkAnalysisAccess(c.Request().Context(), user, id, permissions.LevelWrite)
+	if err != nil {
+		return err
+	}
+
+	outputMap, err := i.updateTimeLimit(owner, id)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -803,9 +1240,9 @@ func (i *Internal) AdminTimeLimitUpdateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
 	}
 
-	apps := apps.NewApps(i.db, i.UserSuffix)
+	apps := i.newApps()
 
-	user, _, err = apps.GetUserByAnalysisID(id)
+	user, _, err = apps.GetUserByAnalysisID(c.Request().Context(), id)
 	if err != nil {
 		return err
 	}
@@ -845,10 +1282,10 @@ func (i *Internal) GetTimeLimitHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
 	}
 
-	apps := apps.NewApps(i.db, i.UserSuffix)
+	apps := i.newApps()
 
 	// Could use this to get the username, but we need to not break other services.
-	_, userID, err = apps.GetUserByAnalysisID(analysisID)
+	_, userID, err = apps.GetUserByAnalysisID(c.Request().Context(), analysisID)
 	if err != nil {
 		return err
 	}
@@ -875,10 +1312,10 @@ func (i *Internal) AdminGetTimeLimitHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
 	}
 
-	apps := apps.NewApps(i.db, i.UserSuffix)
+	apps := i.newApps()
 
 	// Could use this to get the username, but we need to not break other services.
-	_, userID, err = apps.GetUserByAnalysisID(analysisID)
+	_, userID, err = apps.GetUserByAnalysisID(c.Request().Context(), analysisID)
 	if err != nil {
 		return err
 	}
@@ -961,7 +1398,7 @@ func (i *Internal) AdminGetExternalIDHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
 	}
 
-	externalID, err = i.getExternalIDByAnalysisID(analysisID)
+	externalID, err = i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
 	if err != nil {
 		return err
 	}
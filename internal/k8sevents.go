@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Reasons for the Events recorded on the Deployments of analyses as they reach
+// lifecycle milestones.
+const (
+	EventLaunched         = "Launched"
+	EventURLReady         = "URLReady"
+	EventTransferStarted  = "TransferStarted"
+	EventTransferFailed   = "TransferFailed"
+	EventTimeLimitWarning = "TimeLimitWarning"
+	EventTerminated       = "Terminated"
+)
+
+// eventSourceComponent is the component Events are reported by.
+const eventSourceComponent = "app-exposer"
+
+// newDeploymentEvent returns an Event about the Deployment with the name.
+func newDeploymentEvent(dep *appsv1.Deployment, name, eventType, reason, message string) *apiv1.Event {
+	now := metav1.NewTime(time.Now())
+
+	return &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: dep.Namespace,
+		},
+		InvolvedObject: apiv1.ObjectReference{
+			Kind:            "Deployment",
+			APIVersion:      "apps/v1",
+			Name:            dep.Name,
+			Namespace:       dep.Namespace,
+			UID:             dep.UID,
+			ResourceVersion: dep.ResourceVersion,
+		},
+		Reason:  reason,
+		Message: message,
+		Type:    eventType,
+		Source: apiv1.EventSource{
+			Component: eventSourceComponent,
+			Host:      hostname(),
+		},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+}
+
+// recordDeploymentEvent records an Event on the Deployment. Failures are
+// logged, since Events are informational.
+func (i *Internal) recordDeploymentEvent(dep *appsv1.Deployment, eventType, reason, message string) {
+	if !i.LifecycleEvents {
+		return
+	}
+
+	name := fmt.Sprintf("%s.%x", dep.Name, time.Now().UnixNano())
+	event := newDeploymentEvent(dep, name, eventType, reason, message)
+
+	if _, err := i.clientset.CoreV1().Events(dep.Namespace).Create(event); err != nil {
+		log.Error(errors.Wrapf(err, "error recording the %s event for deployment %s", reason, dep.Name))
+	}
+}
+
+// recordDeploymentEventOnce records an Event on the Deployment unless one with
+// the same reason has already been recorded on it. It's used for milestones
+// that are noticed over and over again, such as the analysis becoming ready.
+func (i *Internal) recordDeploymentEventOnce(dep *appsv1.Deployment, eventType, reason, message string) {
+	if !i.LifecycleEvents {
+		return
+	}
+
+	name := fmt.Sprintf("%s.%s", dep.Name, strings.ToLower(reason))
+	if dep.UID != "" {
+		name = fmt.Sprintf("%s.%s", name, dep.UID)
+	}
+	event := newDeploymentEvent(dep, name, eventType, reason, message)
+
+	_, err := i.clientset.CoreV1().Events(dep.Namespace).Create(event)
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		log.Error(errors.Wrapf(err, "error recording the %s event for deployment %s", reason, dep.Name))
+	}
+}
+
+// analysisDeployments returns the Deployments of the analysis.
+func (i *Internal) analysisDeployments(externalID string) ([]appsv1.Deployment, error) {
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return nil, err
+	}
+	return deplist.Items, nil
+}
+
+// recordAnalysisEvent records an Event on each of the Deployments of the
+// analysis. If once is true, it's only recorded on the Deployments that don't
+// have an Event with the same reason yet.
+func (i *Internal) recordAnalysisEvent(externalID, eventType, reason, message string, once bool) {
+	if !i.LifecycleEvents {
+		return
+	}
+
+	deployments, err := i.analysisDeployments(externalID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up the deployments of analysis %s to record the %s event", externalID, reason))
+		return
+	}
+
+	for idx := range deployments {
+		if once {
+			i.recordDeploymentEventOnce(&deployments[idx], eventType, reason, message)
+		} else {
+			i.recordDeploymentEvent(&deployments[idx], eventType, reason, message)
+		}
+	}
+}
+
+// recordURLReady records that the analysis served by the Deployments became
+// reachable at the host. It's only recorded the first time the readiness
+// check passes.
+func (i *Internal) recordURLReady(deployments []appsv1.Deployment, host string) {
+	for idx := range deployments {
+		i.recordDeploymentEventOnce(&deployments[idx], apiv1.EventTypeNormal, EventURLReady, fmt.Sprintf("analysis is ready at %s", host))
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRecordAnalysisEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{
+		appDeployment("e1", "app1"),
+		appDeployment("e2", "app1"),
+	})
+	i.LifecycleEvents = true
+
+	i.recordAnalysisEvent("e1", apiv1.EventTypeWarning, EventTransferFailed, "file downloads failed", false)
+
+	events, err := i.clientset.CoreV1().Events("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	if assert.Len(events.Items, 1) {
+		event := events.Items[0]
+		assert.Equal(EventTransferFailed, event.Reason)
+		assert.Equal(apiv1.EventTypeWarning, event.Type)
+		assert.Equal("file downloads failed", event.Message)
+		assert.Equal("Deployment", event.InvolvedObject.Kind)
+		assert.Equal("e1", event.InvolvedObject.Name)
+		assert.Equal("vice-apps", event.InvolvedObject.Namespace)
+		assert.Equal(eventSourceComponent, event.Source.Component)
+	}
+}
+
+func TestRecordAnalysisEventOnce(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{appDeployment("e1", "app1")})
+	i.LifecycleEvents = true
+
+	i.recordAnalysisEvent("e1", apiv1.EventTypeNormal, EventURLReady, "analysis is ready", true)
+	i.recordAnalysisEvent("e1", apiv1.EventTypeNormal, EventURLReady, "analysis is ready", true)
+	i.recordAnalysisEvent("e1", apiv1.EventTypeNormal, EventTransferStarted, "file downloads started", false)
+	i.recordAnalysisEvent("e1", apiv1.EventTypeNormal, EventTransferStarted, "file downloads started", false)
+
+	events, err := i.clientset.CoreV1().Events("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+
+	reasons := map[string]int{}
+	for _, event := range events.Items {
+		reasons[event.Reason]++
+	}
+	assert.Equal(map[string]int{EventURLReady: 1, EventTransferStarted: 2}, reasons)
+}
+
+func TestRecordAnalysisEventDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{appDeployment("e1", "app1")})
+	i.LifecycleEvents = false
+
+	i.recordAnalysisEvent("e1", apiv1.EventTypeNormal, EventLaunched, "launched", true)
+
+	events, err := i.clientset.CoreV1().Events("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(events.Items)
+}
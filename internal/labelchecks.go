@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+)
+
+// LabelCheckRequest contains prospective values for the labels of an analysis
+// that are derived from user-supplied names. Values that aren't set aren't
+// checked.
+type LabelCheckRequest struct {
+	AnalysisName string `json:"analysisName"`
+	Username     string `json:"username"`
+	AppName      string `json:"appName"`
+}
+
+// LabelValueCheck describes how a value is changed to make it a valid label
+// value. TooLong is true if the value didn't fit in the 63 characters allowed
+// in a label value, in which case the label contains the start of it followed
+// by a hash of the original value.
+type LabelValueCheck struct {
+	Original string `json:"original"`
+	Value    string `json:"value"`
+	Changed  bool   `json:"changed"`
+	TooLong  bool   `json:"tooLong"`
+}
+
+// LabelCheckResult contains the checks of the values in a LabelCheckRequest.
+type LabelCheckResult struct {
+	AnalysisName *LabelValueCheck `json:"analysisName,omitempty"`
+	Username     *LabelValueCheck `json:"username,omitempty"`
+	AppName      *LabelValueCheck `json:"appName,omitempty"`
+}
+
+// checkLabelValue returns the check of the original value.
+func checkLabelValue(original string) *LabelValueCheck {
+	value := common.LabelValueString(original)
+	hash, truncated := common.LabelValueHashSuffix(value)
+
+	return &LabelValueCheck{
+		Original: original,
+		Value:    value,
+		Changed:  original != value,
+		TooLong:  truncated && hash == common.LabelValueHash(original),
+	}
+}
+
+// CheckLabelValues returns how each of the values in the request would be
+// changed if it were used in the labels of an analysis at launch.
+func CheckLabelValues(request *LabelCheckRequest) *LabelCheckResult {
+	result := &LabelCheckResult{}
+
+	if request.AnalysisName != "" {
+		result.AnalysisName = checkLabelValue(request.AnalysisName)
+	}
+	if request.Username != "" {
+		result.Username = checkLabelValue(request.Username)
+	}
+	if request.AppName != "" {
+		result.AppName = checkLabelValue(request.AppName)
+	}
+
+	return result
+}
+
+// CheckLabelsHandler tells upstream services how the analysis name, username,
+// and app name in the request body would be changed to fit in the labels of
+// an analysis, so that users can be warned before they launch it.
+func (i *Internal) CheckLabelsHandler(c echo.Context) error {
+	request := &LabelCheckRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if request.AnalysisName == "" && request.Username == "" && request.AppName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one of analysisName, username, or appName must be set")
+	}
+
+	return c.JSON(http.StatusOK, CheckLabelValues(request))
+}
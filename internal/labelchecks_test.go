@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLabelValues(t *testing.T) {
+	assert := assert.New(t)
+
+	longName := strings.Repeat("a", 70)
+	result := CheckLabelValues(&LabelCheckRequest{
+		AnalysisName: longName,
+		Username:     "first.last",
+		AppName:      "jupyter-lab",
+	})
+
+	assert.True(result.AnalysisName.TooLong)
+	assert.True(result.AnalysisName.Changed)
+	assert.Equal(strings.Repeat("a", 54)+"-"+common.LabelValueHash(longName), result.AnalysisName.Value)
+
+	assert.False(result.Username.TooLong)
+	assert.True(result.Username.Changed)
+	assert.Equal(common.LabelValueString("first.last"), result.Username.Value)
+
+	assert.False(result.AppName.Changed)
+	assert.Equal("jupyter-lab", result.AppName.Value)
+
+	assert.Nil(CheckLabelValues(&LabelCheckRequest{Username: "someone"}).AnalysisName)
+}
+
+func TestCheckLabelsHandler(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/labels/check", strings.NewReader(`{}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	err := internal.CheckLabelsHandler(echo.New().NewContext(req, rec))
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/vice/labels/check", strings.NewReader(`{"appName":"My App"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	assert.NoError(t, internal.CheckLabelsHandler(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"value":"my-app"`)
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// analysisLabelKeys are the labels app-exposer uses to describe the analysis a
+// resource belongs to. They're the ones that get the configured label prefix.
+var analysisLabelKeys = map[string]bool{
+	"external-id":   true,
+	"analysis-id":   true,
+	"analysis-name": true,
+	"app-id":        true,
+	"app-name":      true,
+	"app-type":      true,
+	"username":      true,
+	"user-id":       true,
+	"subdomain":     true,
+	"login-ip":      true,
+}
+
+// labelKeys maps the bare names of the analysis labels to the keys used in the
+// cluster. With a prefix such as vice.cyverse.org/, the external-id label
+// becomes vice.cyverse.org/external-id, which keeps it from colliding with the
+// labels of other controllers.
+//
+// While migrating, new resources get both the prefixed and the bare keys and
+// resources are selected by the bare keys, so that resources created before
+// the prefix was configured are still found. Values are read from the
+// prefixed keys first.
+type labelKeys struct {
+	prefix  string
+	migrate bool
+}
+
+// newLabelKeys returns a *labelKeys for the prefix. A slash is added to the
+// prefix if it doesn't end with one.
+func newLabelKeys(prefix string, migrate bool) *labelKeys {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return &labelKeys{prefix: prefix, migrate: migrate && prefix != ""}
+}
+
+// key returns the key of the label in new resources.
+func (k *labelKeys) key(name string) string {
+	if !analysisLabelKeys[name] {
+		return name
+	}
+	return k.prefix + name
+}
+
+// selectorKey returns the key to select resources by.
+func (k *labelKeys) selectorKey(name string) string {
+	if k.migrate {
+		return name
+	}
+	return k.key(name)
+}
+
+// isAnalysisKey returns true if the key is one of the keys of the analysis
+// labels, either prefixed or, while migrating, bare.
+func (k *labelKeys) isAnalysisKey(key string) bool {
+	for name := range analysisLabelKeys {
+		if key == k.key(name) || (k.migrate && key == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the value of the label from the labels of a resource.
+func (k *labelKeys) get(labels map[string]string, name string) string {
+	if value, ok := labels[k.key(name)]; ok {
+		return value
+	}
+	if k.migrate {
+		return labels[name]
+	}
+	return ""
+}
+
+// set sets the value of the label in the labels of a resource.
+func (k *labelKeys) set(labels map[string]string, name, value string) {
+	labels[k.key(name)] = value
+	if k.migrate {
+		labels[name] = value
+	}
+}
+
+// has returns true if the resource has the label.
+func (k *labelKeys) has(labels map[string]string, name string) bool {
+	if _, ok := labels[k.key(name)]; ok {
+		return true
+	}
+	if k.migrate {
+		_, ok := labels[name]
+		return ok
+	}
+	return false
+}
+
+// labels returns the labels for a new resource given the labels keyed by their
+// bare names.
+func (k *labelKeys) labels(bare map[string]string) map[string]string {
+	retval := map[string]string{}
+	for name, value := range bare {
+		k.set(retval, name, value)
+	}
+	return retval
+}
+
+// selector returns the labels to select resources by given the labels keyed by
+// their bare names.
+func (k *labelKeys) selector(bare map[string]string) map[string]string {
+	retval := map[string]string{}
+	for name, value := range bare {
+		retval[k.selectorKey(name)] = value
+	}
+	return retval
+}
+
+// selectorKeys returns the keys to select resources by given their bare
+// names.
+func (k *labelKeys) selectorKeys(names []string) []string {
+	retval := []string{}
+	for _, name := range names {
+		retval = append(retval, k.selectorKey(name))
+	}
+	return retval
+}
+
+// migrateLabels copies the values of the bare analysis labels to the prefixed
+// keys if they aren't already set. It does nothing unless the label keys are
+// being migrated.
+func (k *labelKeys) migrateLabels(labels map[string]string) {
+	if !k.migrate {
+		return
+	}
+
+	for name := range analysisLabelKeys {
+		value, ok := labels[name]
+		if !ok {
+			continue
+		}
+		if _, ok = labels[k.key(name)]; !ok {
+			labels[k.key(name)] = value
+		}
+	}
+}
+
+// ValidateLabelPrefix returns an error if label keys with the prefix wouldn't
+// be valid.
+func ValidateLabelPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+
+	key := newLabelKeys(prefix, false).key("analysis-name")
+	if problems := validation.IsQualifiedName(key); len(problems) > 0 {
+		return fmt.Errorf("invalid label prefix %s: %s", prefix, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
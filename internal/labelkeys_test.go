@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestLabelKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	bare := newLabelKeys("", true)
+	assert.False(bare.migrate)
+	assert.Equal("external-id", bare.key("external-id"))
+
+	keys := newLabelKeys("vice.cyverse.org", false)
+	assert.Equal("vice.cyverse.org/external-id", keys.key("external-id"))
+	assert.Equal("vice.cyverse.org/external-id", keys.selectorKey("external-id"))
+	assert.Equal("volume-name", keys.key("volume-name"))
+	assert.Equal(
+		map[string]string{"vice.cyverse.org/external-id": "e1", "config-template": "t1"},
+		keys.labels(map[string]string{"external-id": "e1", "config-template": "t1"}),
+	)
+
+	// Bare keys might belong to another controller, so they're ignored.
+	assert.Equal("", keys.get(map[string]string{"external-id": "e1"}, "external-id"))
+
+	migrating := newLabelKeys("vice.cyverse.org/", true)
+	assert.Equal("external-id", migrating.selectorKey("external-id"))
+	assert.Equal(
+		map[string]string{"vice.cyverse.org/external-id": "e1", "external-id": "e1"},
+		migrating.labels(map[string]string{"external-id": "e1"}),
+	)
+	assert.Equal("e1", migrating.get(map[string]string{"external-id": "e1"}, "external-id"))
+	assert.Equal("e2", migrating.get(map[string]string{"external-id": "e1", "vice.cyverse.org/external-id": "e2"}, "external-id"))
+
+	existing := map[string]string{"external-id": "e1", "user-id": "u1", "volume-name": "v1"}
+	migrating.migrateLabels(existing)
+	assert.Equal("e1", existing["vice.cyverse.org/external-id"])
+	assert.Equal("u1", existing["vice.cyverse.org/user-id"])
+	assert.NotContains(existing, "vice.cyverse.org/volume-name")
+
+	assert.True(keys.isAnalysisKey("vice.cyverse.org/subdomain"))
+	assert.False(keys.isAnalysisKey("subdomain"))
+	assert.False(keys.isAnalysisKey("app"))
+	assert.True(migrating.isAnalysisKey("subdomain"))
+	assert.True(migrating.isAnalysisKey("vice.cyverse.org/subdomain"))
+}
+
+func TestValidateLabelPrefix(t *testing.T) {
+	assert.NoError(t, ValidateLabelPrefix(""))
+	assert.NoError(t, ValidateLabelPrefix("vice.cyverse.org/"))
+	assert.Error(t, ValidateLabelPrefix("not a prefix/"))
+}
+
+func TestPrefixedLabelsFromJob(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	internal.labelKeys = newLabelKeys("vice.cyverse.org/", false)
+
+	job := multiPortJob(8888)
+	job.Name = "test analysis"
+	registerUserIPQuery(mock, "127.0.0.1")
+	registerSubdomainQuery(mock, job.InvocationID, "")
+
+	labels, err := internal.labelsFromJob(job)
+	assert.NoError(err)
+	assert.Equal("e1", labels["vice.cyverse.org/external-id"])
+	assert.Equal("interactive", labels["vice.cyverse.org/app-type"])
+	assert.NotContains(labels, "external-id")
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMigratingListsFindOldResources(t *testing.T) {
+	assert := assert.New(t)
+
+	// e1 was created before the prefix was configured and e2 was created
+	// while migrating.
+	old := appDeployment("e1", "app1")
+	migrated := appDeployment("e2", "app1")
+	migrated.Labels["vice.cyverse.org/external-id"] = "e2"
+	migrated.Labels["vice.cyverse.org/app-type"] = "interactive"
+
+	internal, _ := setupInternal(t, []runtime.Object{old, migrated})
+	internal.labelKeys = newLabelKeys("vice.cyverse.org/", true)
+
+	deplist, err := internal.deploymentList("vice-apps", map[string]string{}, []string{})
+	assert.NoError(err)
+	assert.Len(deplist.Items, 2)
+
+	ids, err := internal.filterExternalIDs(map[string]string{})
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"e1", "e2"}, ids)
+
+	// Once the migration is over, only the prefixed keys are used.
+	internal.labelKeys = newLabelKeys("vice.cyverse.org/", false)
+	ids, err = internal.filterExternalIDs(map[string]string{})
+	assert.NoError(err)
+	assert.Equal([]string{"e2"}, ids)
+}
@@ -0,0 +1,389 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The phases a launch goes through, in order.
+const (
+	LaunchPhaseVolumesCreated    = "volumes-created"
+	LaunchPhaseDeploymentCreated = "deployment-created"
+	LaunchPhasePodScheduled      = "pod-scheduled"
+	LaunchPhaseReady             = "ready"
+	LaunchPhaseURLReady          = "url-ready"
+)
+
+// LaunchAccepted is the response to a launch that hasn't been provisioned
+// yet, either because it's provisioned in the background or because it's
+// waiting in the launch queue. Queued is set in the latter case. Progress can
+// be polled at StatusURL.
+type LaunchAccepted struct {
+	LaunchID  string         `json:"launchID"`
+	StatusURL string         `json:"statusURL"`
+	Queued    *QueuePosition `json:"queued,omitempty"`
+}
+
+// launchAccepted returns the response to a launch of the analysis that
+// hasn't been provisioned yet.
+func launchAccepted(externalID string, queued *QueuePosition) *LaunchAccepted {
+	return &LaunchAccepted{
+		LaunchID:  externalID,
+		StatusURL: fmt.Sprintf("/vice/launches/%s", externalID),
+		Queued:    queued,
+	}
+}
+
+// LaunchPhase is one of the phases of a launch and whether it has been
+// reached.
+type LaunchPhase struct {
+	Name string `json:"name"`
+	Done bool   `json:"done"`
+}
+
+// LaunchProgress is how far a launch has gotten. The phases and the error come
+// from the analysis's state and its K8s resources, so they're accurate
+// whichever app-exposer replica handled the launch.
+type LaunchProgress struct {
+	LaunchID string         `json:"launchID"`
+	State    AnalysisState  `json:"state,omitempty"`
+	Queued   *QueuePosition `json:"queued,omitempty"`
+	Phases   []LaunchPhase  `json:"phases"`
+	Complete bool           `json:"complete"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// launchResourcesTTL is how long the resources listed for a launch are reused
+// for other requests polling its progress.
+const launchResourcesTTL = 2 * time.Second
+
+// launchResources are the K8s resources of an analysis that the progress of
+// its launch is worked out from. Events holds the events recorded for each of
+// the pods, keyed by pod name.
+type launchResources struct {
+	configMaps  []apiv1.ConfigMap
+	claims      []apiv1.PersistentVolumeClaim
+	deployments []appsv1.Deployment
+	pods        []apiv1.Pod
+	services    []apiv1.Service
+	exposed     bool
+	events      map[string][]apiv1.Event
+}
+
+type launchResourcesEntry struct {
+	resources *launchResources
+	expires   time.Time
+}
+
+// launchResourcesCache is a short-lived cache of the resources listed for each
+// launch, keyed by launch ID. It keeps clients polling the same launch from
+// causing a round of listings on every poll.
+type launchResourcesCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]launchResourcesEntry
+}
+
+func newLaunchResourcesCache(ttl time.Duration) *launchResourcesCache {
+	return &launchResourcesCache{
+		ttl:     ttl,
+		entries: map[string]launchResourcesEntry{},
+	}
+}
+
+func (l *launchResourcesCache) get(launchID string) (*launchResources, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[launchID]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(l.entries, launchID)
+		return nil, false
+	}
+
+	return entry.resources, true
+}
+
+// set caches the resources for the launch, dropping expired entries.
+func (l *launchResourcesCache) set(launchID string, resources *launchResources) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for id, entry := range l.entries {
+		if now.After(entry.expires) {
+			delete(l.entries, id)
+		}
+	}
+
+	l.entries[launchID] = launchResourcesEntry{
+		resources: resources,
+		expires:   now.Add(l.ttl),
+	}
+}
+
+// provisionInBackground provisions the analysis without holding up the
+// request that launched it. The launch stays in progress until provisioning
+// finishes. Provisioning failures that happen before the analysis is marked
+// as failed, such as ones that happen before any resources are created, mark
+// it as failed here so that every replica reports the failure.
+func (i *Internal) provisionInBackground(externalID string, provision func(ctx context.Context) error) {
+	go func() {
+		defer i.launching.end(externalID)
+
+		err := provision(context.Background())
+		if err == nil {
+			return
+		}
+		log.Error(errors.Wrapf(err, "error provisioning analysis %s", externalID))
+
+		record, stateErr := i.getAnalysisState(externalID)
+		if stateErr != nil {
+			log.Error(stateErr)
+			return
+		}
+		if record == nil || !record.State.IsTerminal() {
+			i.transitionAndLog(externalID, FailedState, fmt.Sprintf("unable to launch analysis %s: %s", externalID, launchFailureMessage(err)))
+		}
+	}()
+}
+
+// listLaunchResources lists the K8s resources of the analysis, reusing the
+// ones listed for another poll of the same launch if they're recent enough.
+func (i *Internal) listLaunchResources(externalID string) (*launchResources, error) {
+	if resources, ok := i.launchResources.get(externalID); ok {
+		return resources, nil
+	}
+
+	listOptions := metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID})).AsSelector().String(),
+	}
+	resources := &launchResources{events: map[string][]apiv1.Event{}}
+
+	configMaps, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).List(listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the config maps for analysis %s", externalID)
+	}
+	resources.configMaps = configMaps.Items
+
+	if i.UseCSIDriver {
+		claims, err := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).List(listOptions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing the volume claims for analysis %s", externalID)
+		}
+		resources.claims = claims.Items
+	}
+
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the deployments for analysis %s", externalID)
+	}
+	resources.deployments = deployments.Items
+
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the pods for analysis %s", externalID)
+	}
+	resources.pods = pods.Items
+
+	// The events only explain why a pod hasn't started, so they aren't looked
+	// up for pods that are ready.
+	for _, pod := range resources.pods {
+		if podReady(&pod) {
+			continue
+		}
+		events, err := i.podEvents(i.ViceNamespace, pod.Name)
+		if err != nil {
+			return nil, err
+		}
+		resources.events[pod.Name] = events
+	}
+
+	services, err := i.clientset.CoreV1().Services(i.ViceNamespace).List(listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the services for analysis %s", externalID)
+	}
+	resources.services = services.Items
+
+	// The URL is ready once the analysis is reachable the same way the
+	// url-ready endpoint checks it.
+	if i.tunnelEnabled() {
+		tunnel, err := i.getTunnel(externalID)
+		if err != nil {
+			return nil, err
+		}
+		resources.exposed = tunnel != nil && tunnel.Connected
+	} else {
+		ingresses, err := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace).List(listOptions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing the ingresses for analysis %s", externalID)
+		}
+		resources.exposed = len(ingresses.Items) > 0
+	}
+
+	i.launchResources.set(externalID, resources)
+
+	return resources, nil
+}
+
+// launchPhases works out which phases of the launch have been reached from
+// the analysis's K8s resources.
+func (i *Internal) launchPhases(resources *launchResources) []LaunchPhase {
+	volumesCreated := len(resources.configMaps) > 0
+	if volumesCreated && i.UseCSIDriver {
+		volumesCreated = len(resources.claims) > 0
+	}
+
+	ready := false
+	for _, dep := range resources.deployments {
+		if dep.Status.ReadyReplicas > 0 {
+			ready = true
+		}
+	}
+
+	scheduled := false
+	for _, pod := range resources.pods {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == apiv1.PodScheduled && condition.Status == apiv1.ConditionTrue {
+				scheduled = true
+			}
+		}
+	}
+
+	return []LaunchPhase{
+		{Name: LaunchPhaseVolumesCreated, Done: volumesCreated},
+		{Name: LaunchPhaseDeploymentCreated, Done: len(resources.deployments) > 0},
+		{Name: LaunchPhasePodScheduled, Done: scheduled || ready},
+		{Name: LaunchPhaseReady, Done: ready},
+		{Name: LaunchPhaseURLReady, Done: ready && resources.exposed && len(resources.services) > 0},
+	}
+}
+
+// Event reasons for pod problems that keep the launch from finishing.
+var launchFailureEventReasons = map[string]bool{
+	"Failed":                 true,
+	"FailedCreatePodSandBox": true,
+	"FailedAttachVolume":     true,
+	"FailedMount":            true,
+}
+
+// launchError explains why the launch failed or is stuck, using the state of
+// the analysis, the conditions of its Deployment, and the statuses and events
+// of its pods. An empty string is returned if nothing is wrong.
+func launchError(launchID string, state AnalysisState, resources *launchResources) string {
+	for _, dep := range resources.deployments {
+		for _, condition := range dep.Status.Conditions {
+			if condition.Type == appsv1.DeploymentReplicaFailure && condition.Status == apiv1.ConditionTrue {
+				return condition.Message
+			}
+		}
+	}
+
+	for idx := range resources.pods {
+		pod := &resources.pods[idx]
+
+		if pod.Status.Phase == apiv1.PodFailed {
+			return fmt.Sprintf("pod %s failed: %s: %s", pod.Name, pod.Status.Reason, pod.Status.Message)
+		}
+
+		statuses := append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+		statuses = append(statuses, pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			waiting := status.State.Waiting
+			if waiting != nil && (stuckContainerReasons[waiting.Reason] || waiting.Reason == "CrashLoopBackOff") {
+				return fmt.Sprintf("container %s: %s: %s", status.Name, waiting.Reason, waiting.Message)
+			}
+		}
+
+		var latest *apiv1.Event
+		events := resources.events[pod.Name]
+		for idx := range events {
+			event := &events[idx]
+			if event.Type != apiv1.EventTypeWarning || !launchFailureEventReasons[event.Reason] {
+				continue
+			}
+			if latest == nil || eventTime(event).After(eventTime(latest)) {
+				latest = event
+			}
+		}
+		if latest != nil {
+			return fmt.Sprintf("pod %s: %s: %s", pod.Name, latest.Reason, latest.Message)
+		}
+	}
+
+	if state == FailedState {
+		return fmt.Sprintf("the launch of analysis %s failed", launchID)
+	}
+
+	return ""
+}
+
+// launchProgress returns how far the launch has gotten, or nil if nothing is
+// known about it.
+func (i *Internal) launchProgress(launchID string) (*LaunchProgress, error) {
+	progress := &LaunchProgress{LaunchID: launchID}
+
+	record, err := i.getAnalysisState(launchID)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		progress.State = record.State
+	}
+
+	if progress.Queued, err = i.queuedPosition(launchID); err != nil {
+		return nil, err
+	}
+
+	resources, err := i.listLaunchResources(launchID)
+	if err != nil {
+		return nil, err
+	}
+	progress.Phases = i.launchPhases(resources)
+	progress.Error = launchError(launchID, progress.State, resources)
+
+	started := false
+	progress.Complete = true
+	for _, phase := range progress.Phases {
+		started = started || phase.Done
+		progress.Complete = progress.Complete && phase.Done
+	}
+
+	if record == nil && progress.Queued == nil && !started {
+		return nil, nil
+	}
+
+	return progress, nil
+}
+
+// LaunchProgressHandler reports how far the launch in the id path parameter
+// has gotten, phase by phase. The launch ID is the external ID of the
+// analysis, so launches that were provisioned synchronously can be checked
+// too.
+func (i *Internal) LaunchProgressHandler(c echo.Context) error {
+	launchID := c.Param("id")
+
+	progress, err := i.launchProgress(launchID)
+	if err != nil {
+		return err
+	}
+	if progress == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("launch %s not found", launchID))
+	}
+
+	return c.JSON(http.StatusOK, progress)
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func launchedObjectMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: "vice-apps",
+		Labels:    map[string]string{"app-type": "interactive", "external-id": "e1"},
+	}
+}
+
+func TestLaunchProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		&apiv1.ConfigMap{ObjectMeta: launchedObjectMeta("excludes-file-e1")},
+		&appsv1.Deployment{ObjectMeta: launchedObjectMeta("e1")},
+		&apiv1.Pod{
+			ObjectMeta: launchedObjectMeta("e1-pod"),
+			Status: apiv1.PodStatus{
+				Conditions: []apiv1.PodCondition{{Type: apiv1.PodScheduled, Status: apiv1.ConditionTrue}},
+			},
+		},
+		&apiv1.Service{ObjectMeta: launchedObjectMeta("vice-e1")},
+	})
+
+	state := ProvisioningState
+	registerStateQuery(mock, "e1", &state)
+
+	progress, err := i.launchProgress("e1")
+	assert.NoError(err)
+	if assert.NotNil(progress) {
+		assert.Equal(ProvisioningState, progress.State)
+		assert.Equal([]LaunchPhase{
+			{Name: LaunchPhaseVolumesCreated, Done: true},
+			{Name: LaunchPhaseDeploymentCreated, Done: true},
+			{Name: LaunchPhasePodScheduled, Done: true},
+			{Name: LaunchPhaseReady, Done: false},
+			{Name: LaunchPhaseURLReady, Done: false},
+		}, progress.Phases)
+		assert.False(progress.Complete)
+	}
+
+	// Once the pod is ready and the ingress exists, the URL is ready.
+	dep := &appsv1.Deployment{ObjectMeta: launchedObjectMeta("e1"), Status: appsv1.DeploymentStatus{ReadyReplicas: 1}}
+	_, err = i.clientset.AppsV1().Deployments("vice-apps").Update(dep)
+	assert.NoError(err)
+	_, err = i.clientset.ExtensionsV1beta1().Ingresses("vice-apps").Create(&extv1beta1.Ingress{ObjectMeta: launchedObjectMeta("e1")})
+	assert.NoError(err)
+
+	state = RunningState
+	registerStateQuery(mock, "e1", &state)
+
+	// The resources listed for the last poll are reused until they expire.
+	i.launchResources = newLaunchResourcesCache(launchResourcesTTL)
+
+	progress, err = i.launchProgress("e1")
+	assert.NoError(err)
+	if assert.NotNil(progress) {
+		assert.True(progress.Complete)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchProgressHandlerNotFound(t *testing.T) {
+	i, mock := setupInternal(t, []runtime.Object{})
+	registerStateQuery(mock, "e1", nil)
+
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/vice/launches/e1", nil), httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("e1")
+
+	err := i.LaunchProgressHandler(c)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestProvisionInBackground(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+
+	// The analysis is marked as failed, then the launch stays in progress
+	// until provisioning finishes.
+	requested := RequestedState
+	registerStateQuery(mock, "e1", &requested)
+	expectStateChange(mock, "e1", RequestedState, FailedState)
+	mock.ExpectExec("DELETE FROM vice_launch_requests").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	i.provisionInBackground("e1", func(ctx context.Context) error {
+		return fmt.Errorf("connection refused")
+	})
+
+	assert.Eventually(func() bool { return mock.ExpectationsWereMet() == nil }, time.Second, 10*time.Millisecond)
+
+	// The failure is reported from the state of the analysis even though
+	// nothing was created, so any replica can report it.
+	failed := FailedState
+	registerStateQuery(mock, "e1", &failed)
+	progress, err := i.launchProgress("e1")
+	assert.NoError(err)
+	if assert.NotNil(progress) {
+		assert.Equal(FailedState, progress.State)
+		assert.Equal("the launch of analysis e1 failed", progress.Error)
+		assert.False(progress.Complete)
+	}
+}
+
+func TestLaunchError(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := apiv1.Pod{ObjectMeta: launchedObjectMeta("e1-pod")}
+	assert.Equal("", launchError("e1", ProvisioningState, &launchResources{pods: []apiv1.Pod{pod}}))
+
+	stuck := pod
+	stuck.Status.ContainerStatuses = []apiv1.ContainerStatus{{
+		Name:  "analysis",
+		State: apiv1.ContainerState{Waiting: &apiv1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "no such image"}},
+	}}
+	assert.Equal(
+		"container analysis: ImagePullBackOff: no such image",
+		launchError("e1", ProvisioningState, &launchResources{pods: []apiv1.Pod{stuck}}),
+	)
+
+	// Only warnings that keep the pod from starting are reported, latest
+	// first.
+	now := time.Now()
+	events := map[string][]apiv1.Event{"e1-pod": {
+		{Type: apiv1.EventTypeNormal, Reason: "Pulling", Message: "pulling image", LastTimestamp: metav1.NewTime(now)},
+		{Type: apiv1.EventTypeWarning, Reason: "FailedMount", Message: "old", LastTimestamp: metav1.NewTime(now.Add(-time.Minute))},
+		{Type: apiv1.EventTypeWarning, Reason: "FailedMount", Message: "new", LastTimestamp: metav1.NewTime(now)},
+	}}
+	assert.Equal(
+		"pod e1-pod: FailedMount: new",
+		launchError("e1", ProvisioningState, &launchResources{pods: []apiv1.Pod{pod}, events: events}),
+	)
+
+	dep := appsv1.Deployment{ObjectMeta: launchedObjectMeta("e1")}
+	dep.Status.Conditions = []appsv1.DeploymentCondition{{
+		Type:    appsv1.DeploymentReplicaFailure,
+		Status:  apiv1.ConditionTrue,
+		Message: "exceeded quota",
+	}}
+	assert.Equal("exceeded quota", launchError("e1", ProvisioningState, &launchResources{deployments: []appsv1.Deployment{dep}}))
+}
+
+// launchListings returns the number of listings of the resources of the
+// launch that have been made, leaving out the ones made for the launch queue.
+func launchListings(clientset *fake.Clientset, externalID string) int {
+	count := 0
+	for _, action := range clientset.Actions() {
+		list, ok := action.(k8stesting.ListAction)
+		if !ok {
+			continue
+		}
+		restrictions := list.GetListRestrictions()
+		if restrictions.Labels.Matches(labels.Set{"external-id": externalID}) || !restrictions.Fields.Empty() {
+			count++
+		}
+	}
+	return count
+}
+
+func TestLaunchResourcesShared(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		&appsv1.Deployment{ObjectMeta: launchedObjectMeta("e1")},
+		&apiv1.Pod{ObjectMeta: launchedObjectMeta("e1-pod")},
+	})
+	clientset := i.clientset.(*fake.Clientset)
+
+	state := ProvisioningState
+	registerStateQuery(mock, "e1", &state)
+	_, err := i.launchProgress("e1")
+	assert.NoError(err)
+	listed := launchListings(clientset, "e1")
+	assert.NotZero(listed)
+
+	// A second poll right after the first doesn't list them again.
+	registerStateQuery(mock, "e1", &state)
+	_, err = i.launchProgress("e1")
+	assert.NoError(err)
+	assert.Equal(listed, launchListings(clientset, "e1"))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,767 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultShapingCheckInterval = 15 * time.Second
+	defaultShapingAdmitPerCheck = 1
+
+	// reservationRetention is how long a released reservation is kept around
+	// for checks whose counts were taken before it was released.
+	reservationRetention = time.Minute
+)
+
+// LaunchShapingConfig controls the queueing of launches while the cluster is
+// busy. Once the share of the cluster's CPU or memory requested by analysis
+// pods reaches the threshold, new launches wait in a queue. Every check
+// interval, up to AdmitPerCheck of them are launched if utilization has
+// dropped below the threshold again. MaxStarting and MaxStartingPerUser limit
+// the number of analyses, in total and for each user, that can be starting up
+// at once; zero means no limit.
+type LaunchShapingConfig struct {
+	Enabled              bool          `mapstructure:"enabled"`
+	UtilizationThreshold float64       `mapstructure:"utilization_threshold"`
+	CheckInterval        time.Duration `mapstructure:"check_interval"`
+	AdmitPerCheck        int           `mapstructure:"admit_per_check"`
+	MaxStarting          int           `mapstructure:"max_starting"`
+	MaxStartingPerUser   int           `mapstructure:"max_starting_per_user"`
+}
+
+// ValidateLaunchShaping returns an error if launch shaping is turned on with
+// settings that would never admit anything.
+func ValidateLaunchShaping(cfg *LaunchShapingConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.UtilizationThreshold <= 0 || cfg.UtilizationThreshold > 1 {
+		return fmt.Errorf("launch shaping utilization_threshold must be greater than 0 and at most 1, not %g", cfg.UtilizationThreshold)
+	}
+	if cfg.CheckInterval < 0 || cfg.AdmitPerCheck < 0 {
+		return fmt.Errorf("launch shaping check_interval and admit_per_check can't be negative")
+	}
+	if cfg.MaxStarting < 0 || cfg.MaxStartingPerUser < 0 {
+		return fmt.Errorf("launch shaping max_starting and max_starting_per_user can't be negative")
+	}
+	return nil
+}
+
+func (l *LaunchShapingConfig) checkInterval() time.Duration {
+	if l.CheckInterval == 0 {
+		return defaultShapingCheckInterval
+	}
+	return l.CheckInterval
+}
+
+func (l *LaunchShapingConfig) admitPerCheck() int {
+	if l.AdmitPerCheck == 0 {
+		return defaultShapingAdmitPerCheck
+	}
+	return l.AdmitPerCheck
+}
+
+// queuedLaunch is a launch waiting for capacity. Pinned is the position an
+// administrator moved the launch to, or zero if it's in fair-share order.
+// ReportedPosition is the position last published in a status update.
+type queuedLaunch struct {
+	job              *model.Job
+	user             string
+	queuedAt         time.Time
+	pinned           int
+	reportedPosition int
+}
+
+// launchReservation is the capacity set aside for a launch that's been let
+// through the queue, from the moment it's let through until it's done
+// provisioning and its deployment shows up in the counts. Released is when
+// provisioning finished, or zero if it hasn't yet.
+type launchReservation struct {
+	job      *model.Job
+	user     string
+	released time.Time
+}
+
+// launchQueue holds launches in the order they arrived. The order they're
+// admitted in comes from fairShareOrder. The queue only lives in the memory of
+// this process, so launches can only be queued when app-exposer runs as a
+// single replica, and queued launches are lost when it restarts. The lock is
+// only held while the queue is read or changed, never across calls to the k8s
+// API or the database.
+//
+// The counts the queue's checks go by are taken before the lock, so launches
+// that are let through reserve their capacity while the lock is still held.
+// Launches checked at the same time see the reservation even though the
+// deployment doesn't exist yet, so they can't all take the last of the room.
+type launchQueue struct {
+	mu       sync.Mutex
+	launches []*queuedLaunch
+	reserved map[string]*launchReservation
+}
+
+func newLaunchQueue() *launchQueue {
+	return &launchQueue{
+		launches: []*queuedLaunch{},
+		reserved: map[string]*launchReservation{},
+	}
+}
+
+// reserve sets capacity aside for the job. The caller must hold the lock.
+func (q *launchQueue) reserve(job *model.Job) {
+	q.reserved[job.InvocationID] = &launchReservation{
+		job:  job,
+		user: common.LabelValueString(job.Submitter),
+	}
+}
+
+// release marks the capacity set aside for the launch of the analysis as
+// released once it's done provisioning, whether or not that worked.
+func (q *launchQueue) release(externalID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if reservation, ok := q.reserved[externalID]; ok && reservation.released.IsZero() {
+		reservation.released = time.Now()
+	}
+}
+
+// reservations returns the reservations that a check whose counts were taken
+// at the given time has to add to them: the ones that haven't been released,
+// and the ones released since then, whose deployments might not have been
+// counted. Reservations released long enough ago are forgotten. The caller
+// must hold the lock.
+func (q *launchQueue) reservations(countedAt time.Time) []*launchReservation {
+	reservations := []*launchReservation{}
+	for externalID, reservation := range q.reserved {
+		if !reservation.released.IsZero() && time.Since(reservation.released) > reservationRetention {
+			delete(q.reserved, externalID)
+			continue
+		}
+		if reservation.released.IsZero() || reservation.released.After(countedAt) {
+			reservations = append(reservations, reservation)
+		}
+	}
+	return reservations
+}
+
+// countReservations adds the reserved launches to the counts as starting
+// analyses, and their requests to their submitters' quotas. Launches that are
+// already in counted are skipped, and the rest are added to it.
+func countReservations(reservations []*launchReservation, counts *analysisCounts, quotas map[string]*userQuotaState, counted map[string]bool) {
+	for _, reservation := range reservations {
+		if counted[reservation.job.InvocationID] {
+			continue
+		}
+		counted[reservation.job.InvocationID] = true
+
+		counts.byUser[reservation.user]++
+		counts.byApp[reservation.job.AppID]++
+		counts.starting++
+		counts.startingByUser[reservation.user]++
+		if quota, ok := quotas[reservation.job.Submitter]; ok {
+			quota.add(reservation.job, 1)
+		}
+	}
+}
+
+// remove takes the launch for the analysis out of the queue. It returns false
+// if the analysis wasn't queued. The caller must hold the lock.
+func (q *launchQueue) remove(externalID string) bool {
+	for idx, launch := range q.launches {
+		if launch.job.InvocationID == externalID {
+			q.launches = append(q.launches[:idx], q.launches[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fairShareOrder returns the queued launches in the order they'll be admitted.
+// Each launch goes to the user with the fewest running analyses, counting the
+// ones admitted ahead of it, so that a user with many launches queued can't
+// take all of the capacity that frees up. Ties go to the user who has been
+// waiting the longest. Each user's launches stay in the order they arrived.
+func fairShareOrder(launches []*queuedLaunch, running map[string]int) []*queuedLaunch {
+	pending := map[string][]*queuedLaunch{}
+	users := []string{}
+	for _, launch := range launches {
+		if _, ok := pending[launch.user]; !ok {
+			users = append(users, launch.user)
+		}
+		pending[launch.user] = append(pending[launch.user], launch)
+	}
+
+	counts := map[string]int{}
+	for _, user := range users {
+		counts[user] = userCount(running, pending[user][0].job.Submitter)
+	}
+
+	ordered := []*queuedLaunch{}
+	for len(ordered) < len(launches) {
+		var next string
+		for _, user := range users {
+			if len(pending[user]) == 0 {
+				continue
+			}
+			if next == "" ||
+				counts[user] < counts[next] ||
+				(counts[user] == counts[next] && pending[user][0].queuedAt.Before(pending[next][0].queuedAt)) {
+				next = user
+			}
+		}
+
+		ordered = append(ordered, pending[next][0])
+		pending[next] = pending[next][1:]
+		counts[next]++
+	}
+
+	return ordered
+}
+
+// applyPins moves the pinned launches to the positions they were pinned at,
+// leaving the rest in the order they were in. Launches pinned past the end of
+// the queue go last, and launches pinned at the same position keep the order
+// they arrived in.
+func applyPins(ordered []*queuedLaunch) []*queuedLaunch {
+	pinned := []*queuedLaunch{}
+	result := []*queuedLaunch{}
+	for _, launch := range ordered {
+		if launch.pinned > 0 {
+			pinned = append(pinned, launch)
+		} else {
+			result = append(result, launch)
+		}
+	}
+
+	sort.SliceStable(pinned, func(a, b int) bool {
+		if pinned[a].pinned != pinned[b].pinned {
+			return pinned[a].pinned < pinned[b].pinned
+		}
+		return pinned[a].queuedAt.Before(pinned[b].queuedAt)
+	})
+
+	for _, launch := range pinned {
+		idx := launch.pinned - 1
+		if idx > len(result) {
+			idx = len(result)
+		}
+		result = append(result, nil)
+		copy(result[idx+1:], result[idx:])
+		result[idx] = launch
+	}
+
+	return result
+}
+
+// QueuePosition is where a launch is in the queue. Pinned is true if an
+// administrator moved the launch out of fair-share order.
+type QueuePosition struct {
+	ExternalID          string    `json:"externalID"`
+	AnalysisName        string    `json:"analysisName"`
+	Username            string    `json:"username"`
+	Position            int       `json:"position"`
+	Pinned              bool      `json:"pinned"`
+	QueuedAt            time.Time `json:"queuedAt"`
+	ExpectedWaitSeconds int64     `json:"expectedWaitSeconds"`
+}
+
+// queuePositions returns the positions of the ordered launches. The expected
+// wait is how long it takes to admit everything ahead of the launch if
+// capacity is available at every check, so it's a lower bound.
+func (i *Internal) queuePositions(ordered []*queuedLaunch) []QueuePosition {
+	positions := []QueuePosition{}
+	perCheck := i.LaunchShaping.admitPerCheck()
+	interval := i.LaunchShaping.checkInterval()
+
+	for idx, launch := range ordered {
+		checks := int64(math.Ceil(float64(idx+1) / float64(perCheck)))
+		positions = append(positions, QueuePosition{
+			ExternalID:          launch.job.InvocationID,
+			AnalysisName:        launch.job.Name,
+			Username:            launch.job.Submitter,
+			Position:            idx + 1,
+			Pinned:              launch.pinned > 0,
+			QueuedAt:            launch.queuedAt,
+			ExpectedWaitSeconds: checks * int64(interval/time.Second),
+		})
+	}
+
+	return positions
+}
+
+// analysisCounts is what the launch queue needs to know about the analyses
+// that already exist. ByUser counts each user's analyses and ByApp counts the
+// analyses of each app that aren't paused. Starting and StartingByUser count
+// the analyses that haven't become ready yet; paused analyses aren't starting.
+// Users and apps are keyed by the username and app-id labels.
+type analysisCounts struct {
+	byUser         map[string]int
+	byApp          map[string]int
+	starting       int
+	startingByUser map[string]int
+}
+
+// countAnalyses counts the analyses from a single listing of their
+// deployments.
+func (i *Internal) countAnalyses() (*analysisCounts, error) {
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{}, []string{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing analysis deployments")
+	}
+
+	counts := &analysisCounts{
+		byUser:         map[string]int{},
+		byApp:          map[string]int{},
+		startingByUser: map[string]int{},
+	}
+	for idx := range deplist.Items {
+		dep := &deplist.Items[idx]
+		user := i.labelKeys.get(dep.Labels, "username")
+
+		counts.byUser[user]++
+		if isPaused(dep) {
+			continue
+		}
+		counts.byApp[i.labelKeys.get(dep.Labels, "app-id")]++
+
+		replicas := int32(1)
+		if dep.Spec.Replicas != nil {
+			replicas = *dep.Spec.Replicas
+		}
+		if dep.Status.ReadyReplicas < replicas {
+			counts.starting++
+			counts.startingByUser[user]++
+		}
+	}
+
+	return counts, nil
+}
+
+// userCount returns the count for the user from counts keyed by the username
+// label, including the analyses labeled with the legacy value of the label.
+func userCount(byUser map[string]int, user string) int {
+	count := 0
+	for _, value := range common.LabelValues(user) {
+		count += byUser[value]
+	}
+	return count
+}
+
+// startLimited returns true if launching an analysis for the user, given the
+// analyses that are already starting, would go over the limits on starting
+// analyses.
+func (l *LaunchShapingConfig) startLimited(user string, total int, byUser map[string]int) bool {
+	if l.MaxStarting > 0 && total >= l.MaxStarting {
+		return true
+	}
+	return l.MaxStartingPerUser > 0 && userCount(byUser, user) >= l.MaxStartingPerUser
+}
+
+// orderedQueue returns the queued launches in the order they'll be admitted,
+// given the number of analyses each user has running. The caller must hold
+// the queue lock.
+func (i *Internal) orderedQueue(running map[string]int) []*queuedLaunch {
+	return applyPins(fairShareOrder(i.launchQueue.launches, running))
+}
+
+// clusterUtilization returns the larger of the shares of CPU and memory on
+// the nodes analyses are scheduled on that's requested by analysis pods.
+func (i *Internal) clusterUtilization() (float64, error) {
+	nodes, err := i.clientset.CoreV1().Nodes().List(metav1.ListOptions{
+		LabelSelector: labels.Set(i.Scheduling.NodeSelector).AsSelector().String(),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing nodes")
+	}
+
+	var allocatableCPU, allocatableMemory int64
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		allocatableCPU += node.Status.Allocatable.Cpu().MilliValue()
+		allocatableMemory += node.Status.Allocatable.Memory().Value()
+	}
+
+	if allocatableCPU == 0 || allocatableMemory == 0 {
+		return 0, nil
+	}
+
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing analysis pods")
+	}
+
+	var requestedCPU, requestedMemory int64
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			requestedCPU += container.Resources.Requests.Cpu().MilliValue()
+			requestedMemory += container.Resources.Requests.Memory().Value()
+		}
+	}
+
+	return math.Max(
+		float64(requestedCPU)/float64(allocatableCPU),
+		float64(requestedMemory)/float64(allocatableMemory),
+	), nil
+}
+
+// overThreshold returns true if the cluster is too busy to launch anything
+// else right now. Errors are logged and treated as not busy, so that a problem
+// with the k8s API doesn't hold up every launch.
+func (i *Internal) overThreshold() bool {
+	utilization, err := i.clusterUtilization()
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return utilization >= i.LaunchShaping.UtilizationThreshold
+}
+
+// queueLaunchIfBusy puts the launch in the queue if launch shaping is turned
+// on and either the cluster is busy, other launches are already waiting, or
+// too many analyses are starting up, if the app has as many analyses running
+// as its concurrency limit allows, or if the launch doesn't fit in the
+// submitter's quota and over-quota launches are queued. Launches that don't
+// fit in the quota are rejected if they aren't queued. It returns nil if the
+// launch should go ahead now, in which case its capacity is reserved until
+// provisionAnalysis finishes.
+func (i *Internal) queueLaunchIfBusy(job *model.Job) (*QueuePosition, error) {
+	limit, err := i.appConcurrencyLimit(job.AppID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !i.LaunchShaping.Enabled && limit == nil && !i.Quotas.Enabled {
+		return nil, nil
+	}
+
+	// Everything the decision needs from the cluster and the database is
+	// looked up before the queue is locked.
+	countedAt := time.Now()
+	counts, err := i.countAnalyses()
+	if err != nil {
+		return nil, err
+	}
+	overThreshold := i.LaunchShaping.Enabled && i.overThreshold()
+	quotas := map[string]*userQuotaState{}
+	if i.Quotas.Enabled {
+		quotas = i.userQuotas([]*model.Job{job})
+	}
+
+	i.launchQueue.mu.Lock()
+	defer i.launchQueue.mu.Unlock()
+
+	countReservations(i.launchQueue.reservations(countedAt), counts, quotas, map[string]bool{})
+
+	busy := i.LaunchShaping.Enabled && (len(i.launchQueue.launches) > 0 || overThreshold)
+	if !busy && i.LaunchShaping.Enabled {
+		busy = i.LaunchShaping.startLimited(job.Submitter, counts.starting, counts.startingByUser)
+	}
+	if !busy && limit != nil {
+		busy = i.appAtLimit(limit, counts.byApp)
+	}
+	if !busy && i.Quotas.Enabled {
+		if err = quotas[job.Submitter].check(job); err != nil {
+			if !i.Quotas.Queue {
+				return nil, err
+			}
+			busy = true
+		}
+	}
+	if !busy {
+		i.launchQueue.reserve(job)
+		return nil, nil
+	}
+
+	i.launchQueue.launches = append(i.launchQueue.launches, &queuedLaunch{
+		job:      job,
+		user:     common.LabelValueString(job.Submitter),
+		queuedAt: time.Now(),
+	})
+
+	ordered := i.orderedQueue(counts.byUser)
+	for idx, position := range i.queuePositions(ordered) {
+		if position.ExternalID == job.InvocationID {
+			ordered[idx].reportedPosition = position.Position
+			return &position, nil
+		}
+	}
+
+	return nil, fmt.Errorf("analysis %s is missing from the launch queue", job.InvocationID)
+}
+
+// cancelQueuedLaunch takes the analysis out of the launch queue. It returns
+// false if the analysis wasn't queued.
+func (i *Internal) cancelQueuedLaunch(externalID string) bool {
+	i.launchQueue.mu.Lock()
+	defer i.launchQueue.mu.Unlock()
+	return i.launchQueue.remove(externalID)
+}
+
+// nextAdmissible returns the first of the ordered launches whose app is below
+// its concurrency limit and that isn't held back by its submitter's quota or
+// starting analyses, or nil if they're all waiting. Launches for which held
+// returns true are passed over.
+func nextAdmissible(ordered []*queuedLaunch, limits map[string]*AppConcurrencyLimit, running map[string]int, held func(*model.Job) bool) *queuedLaunch {
+	for _, launch := range ordered {
+		limit, ok := limits[launch.job.AppID]
+		if ok && running[launch.job.AppID] >= limit.MaxRunning {
+			continue
+		}
+		if held(launch.job) {
+			continue
+		}
+		return launch
+	}
+	return nil
+}
+
+// admitQueuedLaunches launches queued analyses in fair-share order while the
+// cluster has room, up to the number allowed per check. Launches of apps at
+// their concurrency limit, or by users who are over quota, are passed over
+// until one of their analyses ends, and launches by users with too many
+// analyses starting are passed over until they're ready. Launches that are
+// still waiting afterwards are told if their position in the queue changed.
+// The queue is only locked to pick the next launch and take it out of the
+// queue; the lookups and the launches themselves happen without the lock.
+func (i *Internal) admitQueuedLaunches() {
+	countedAt := time.Now()
+
+	i.launchQueue.mu.Lock()
+	jobs := []*model.Job{}
+	for _, launch := range i.launchQueue.launches {
+		jobs = append(jobs, launch.job)
+	}
+	i.launchQueue.mu.Unlock()
+
+	if len(jobs) == 0 {
+		return
+	}
+
+	limits, err := i.appConcurrencyLimits()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	// The counts are kept up to date as launches are admitted, so the
+	// deployments only have to be listed once.
+	counts, err := i.countAnalyses()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer i.reportQueuePositions(counts.byUser)
+
+	// Launches queued after the quotas were looked up are held until the
+	// next check.
+	queueOverQuota := i.Quotas.Enabled && i.Quotas.Queue
+	quotas := map[string]*userQuotaState{}
+	if queueOverQuota {
+		quotas = i.userQuotas(jobs)
+	}
+
+	held := func(job *model.Job) bool {
+		if i.LaunchShaping.Enabled && i.LaunchShaping.startLimited(job.Submitter, counts.starting, counts.startingByUser) {
+			return true
+		}
+		if !queueOverQuota {
+			return false
+		}
+		quota, ok := quotas[job.Submitter]
+		return !ok || quota.held(job)
+	}
+
+	// Launches let through since the counts were taken, including the ones
+	// admitted here, are added to the counts as they're reserved.
+	counted := map[string]bool{}
+
+	for admitted := 0; admitted < i.LaunchShaping.admitPerCheck(); admitted++ {
+		if i.LaunchShaping.Enabled && i.overThreshold() {
+			return
+		}
+
+		i.launchQueue.mu.Lock()
+		countReservations(i.launchQueue.reservations(countedAt), counts, quotas, counted)
+		next := nextAdmissible(i.orderedQueue(counts.byUser), limits, counts.byApp, held)
+		if next != nil {
+			i.launchQueue.remove(next.job.InvocationID)
+			i.launchQueue.reserve(next.job)
+		}
+		i.launchQueue.mu.Unlock()
+
+		if next == nil {
+			return
+		}
+
+		log.Infof("admitting queued launch of analysis %s for %s after %s", next.job.InvocationID, next.job.Submitter, time.Since(next.queuedAt))
+
+		if err = i.provisionAnalysis(context.Background(), next.job); err != nil {
+			log.Error(errors.Wrapf(err, "error launching queued analysis %s", next.job.InvocationID))
+		}
+	}
+}
+
+// reportQueuePositions publishes a status update for each queued launch whose
+// position has changed since it was last reported, given the number of
+// analyses each user has running. The caller must not hold the queue lock;
+// the updates are published without it.
+func (i *Internal) reportQueuePositions(running map[string]int) {
+	i.launchQueue.mu.Lock()
+	ordered := i.orderedQueue(running)
+	moved := []*queuedLaunch{}
+	positions := []QueuePosition{}
+	for idx, position := range i.queuePositions(ordered) {
+		if ordered[idx].reportedPosition != position.Position {
+			moved = append(moved, ordered[idx])
+			positions = append(positions, position)
+		}
+	}
+	i.launchQueue.mu.Unlock()
+
+	for idx, position := range positions {
+		msg := fmt.Sprintf("analysis %s is queued at position %d", position.AnalysisName, position.Position)
+		if err := i.statusPublisher.Queued(position.ExternalID, msg); err != nil {
+			log.Error(errors.Wrapf(err, "error reporting the queue position of analysis %s", position.ExternalID))
+			continue
+		}
+
+		i.launchQueue.mu.Lock()
+		moved[idx].reportedPosition = position.Position
+		i.launchQueue.mu.Unlock()
+	}
+}
+
+// StartLaunchShaping fires up a goroutine that admits queued launches as
+// capacity frees up. It runs even if launch shaping is turned off, since
+// launches also wait on app concurrency limits.
+func (i *Internal) StartLaunchShaping() {
+	go func() {
+		ticker := time.NewTicker(i.LaunchShaping.checkInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			i.admitQueuedLaunches()
+		}
+	}()
+}
+
+// positionsFor returns the positions of the queued launches belonging to the
+// user, or all of them if the user is empty.
+func (i *Internal) positionsFor(user string) ([]QueuePosition, error) {
+	counts, err := i.countAnalyses()
+	if err != nil {
+		return nil, err
+	}
+
+	i.launchQueue.mu.Lock()
+	defer i.launchQueue.mu.Unlock()
+
+	positions := []QueuePosition{}
+	for _, position := range i.queuePositions(i.orderedQueue(counts.byUser)) {
+		if user == "" || i.fixUsername(position.Username) == i.fixUsername(user) {
+			positions = append(positions, position)
+		}
+	}
+
+	return positions, nil
+}
+
+// LaunchQueueHandler returns the queue positions and expected waits of the
+// launches queued by the user in the 'user' query parameter.
+func (i *Internal) LaunchQueueHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user is not set")
+	}
+
+	positions, err := i.positionsFor(user)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"launches": positions,
+	})
+}
+
+// AdminLaunchQueueHandler returns every queued launch in the order they'll be
+// admitted.
+func (i *Internal) AdminLaunchQueueHandler(c echo.Context) error {
+	positions, err := i.positionsFor("")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"launches": positions,
+	})
+}
+
+// QueueMove is the position to move a queued launch to. Position 1 is the
+// front of the queue, and zero puts the launch back in fair-share order.
+type QueueMove struct {
+	Position int `json:"position"`
+}
+
+// AdminMoveQueuedLaunchHandler moves the queued launch of the analysis in the
+// external-id path parameter to the position in the request body and returns
+// every queued launch in their new order. The launch stays at that position
+// until it's admitted or moved again, and the launches whose positions changed
+// are told about it.
+func (i *Internal) AdminMoveQueuedLaunchHandler(c echo.Context) error {
+	externalID := c.Param("external-id")
+
+	move := &QueueMove{}
+	if err := c.Bind(move); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if move.Position < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "position can't be negative")
+	}
+
+	counts, err := i.countAnalyses()
+	if err != nil {
+		return err
+	}
+
+	i.launchQueue.mu.Lock()
+	var launch *queuedLaunch
+	for _, queued := range i.launchQueue.launches {
+		if queued.job.InvocationID == externalID {
+			launch = queued
+			break
+		}
+	}
+	if launch == nil {
+		i.launchQueue.mu.Unlock()
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s isn't queued", externalID))
+	}
+	launch.pinned = move.Position
+	positions := i.queuePositions(i.orderedQueue(counts.byUser))
+	i.launchQueue.mu.Unlock()
+
+	i.reportQueuePositions(counts.byUser)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"launches": positions,
+	})
+}
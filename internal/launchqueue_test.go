@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func queued(externalID, user string, queuedAt time.Time) *queuedLaunch {
+	return &queuedLaunch{
+		job:      &model.Job{InvocationID: externalID, Submitter: user},
+		user:     user,
+		queuedAt: queuedAt,
+	}
+}
+
+func externalIDs(launches []*queuedLaunch) []string {
+	ids := []string{}
+	for _, launch := range launches {
+		ids = append(ids, launch.job.InvocationID)
+	}
+	return ids
+}
+
+func TestFairShareOrder(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	// Bulk launches from one user don't hold up everyone else.
+	launches := []*queuedLaunch{
+		queued("b1", "bulk", now),
+		queued("b2", "bulk", now.Add(time.Second)),
+		queued("b3", "bulk", now.Add(2*time.Second)),
+		queued("a1", "alice", now.Add(3*time.Second)),
+		queued("c1", "carol", now.Add(4*time.Second)),
+	}
+	assert.Equal([]string{"b1", "a1", "c1", "b2", "b3"}, externalIDs(fairShareOrder(launches, map[string]int{})))
+
+	// Users with fewer running analyses go first.
+	running := map[string]int{"bulk": 0, "alice": 2}
+	assert.Equal([]string{"b1", "c1", "b2", "b3", "a1"}, externalIDs(fairShareOrder(launches, running)))
+
+	assert.Empty(fairShareOrder([]*queuedLaunch{}, running))
+}
+
+func analysisNode(name, cpu, memory string) *apiv1.Node {
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: apiv1.NodeStatus{
+			Allocatable: apiv1.ResourceList{
+				apiv1.ResourceCPU:    resourcev1.MustParse(cpu),
+				apiv1.ResourceMemory: resourcev1.MustParse(memory),
+			},
+		},
+	}
+}
+
+func analysisPod(name, cpu, memory string, phase apiv1.PodPhase) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "vice-apps"},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name: "analysis",
+					Resources: apiv1.ResourceRequirements{
+						Requests: apiv1.ResourceList{
+							apiv1.ResourceCPU:    resourcev1.MustParse(cpu),
+							apiv1.ResourceMemory: resourcev1.MustParse(memory),
+						},
+					},
+				},
+			},
+		},
+		Status: apiv1.PodStatus{Phase: phase},
+	}
+}
+
+func TestClusterUtilization(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{
+		analysisNode("n1", "4", "16Gi"),
+		analysisNode("n2", "4", "16Gi"),
+		analysisPod("p1", "2", "24Gi", apiv1.PodRunning),
+		analysisPod("p2", "4", "1Gi", apiv1.PodSucceeded),
+	})
+
+	utilization, err := i.clusterUtilization()
+	assert.NoError(err)
+	assert.Equal(0.75, utilization)
+}
+
+func TestQueueLaunchIfBusy(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{
+		analysisNode("n1", "4", "16Gi"),
+		analysisPod("p1", "2", "1Gi", apiv1.PodRunning),
+	})
+	i.LaunchShaping = LaunchShapingConfig{Enabled: true, UtilizationThreshold: 0.9, CheckInterval: 10 * time.Second, AdmitPerCheck: 2}
+
+	// There's room, so the launch goes ahead. Provisioning it fails, so
+	// Alice doesn't have anything running afterwards.
+	position, err := i.queueLaunchIfBusy(&model.Job{InvocationID: "a1", Submitter: "alice"})
+	assert.NoError(err)
+	assert.Nil(position)
+	i.launchQueue.release("a1")
+
+	// There isn't room, so it waits.
+	i.LaunchShaping.UtilizationThreshold = 0.5
+	for idx, id := range []string{"b1", "b2", "b3"} {
+		position, err = i.queueLaunchIfBusy(&model.Job{InvocationID: id, Submitter: "bob"})
+		assert.NoError(err)
+		assert.Equal(idx+1, position.Position)
+	}
+	assert.Equal(int64(20), position.ExpectedWaitSeconds)
+
+	// Others are already waiting, so it waits even with room.
+	i.LaunchShaping.UtilizationThreshold = 0.9
+	position, err = i.queueLaunchIfBusy(&model.Job{InvocationID: "a2", Submitter: "alice"})
+	assert.NoError(err)
+	assert.Equal(2, position.Position)
+
+	positions, err := i.positionsFor("bob")
+	assert.NoError(err)
+	assert.Len(positions, 3)
+	assert.Equal(3, positions[1].Position)
+
+	assert.True(i.cancelQueuedLaunch("b2"))
+	assert.False(i.cancelQueuedLaunch("b2"))
+
+	positions, err = i.positionsFor("")
+	assert.NoError(err)
+	assert.Len(positions, 3)
+}
+
+func TestQueueLaunchReservesCapacity(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+
+	// The first launch takes the app's only slot before its deployment
+	// exists, so the second one waits for it.
+	registerAppLimitQuery(mock, "license-app", 1)
+	position, err := i.queueLaunchIfBusy(&model.Job{InvocationID: "e1", AppID: "license-app", Submitter: "alice"})
+	assert.NoError(err)
+	assert.Nil(position)
+
+	registerAppLimitQuery(mock, "license-app", 1)
+	position, err = i.queueLaunchIfBusy(&model.Job{InvocationID: "e2", AppID: "license-app", Submitter: "bob"})
+	assert.NoError(err)
+	if assert.NotNil(position) {
+		assert.Equal(1, position.Position)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchReservations(t *testing.T) {
+	assert := assert.New(t)
+
+	q := newLaunchQueue()
+	before := time.Now().Add(-time.Second)
+	q.reserve(&model.Job{InvocationID: "e1", Submitter: "alice"})
+	assert.Len(q.reservations(time.Now()), 1)
+
+	// Once the launch is provisioned, only checks whose counts were taken
+	// before then still need the reservation.
+	q.release("e1")
+	assert.Len(q.reservations(before), 1)
+	assert.Empty(q.reservations(time.Now()))
+
+	// Old releases are forgotten.
+	q.reserved["e1"].released = time.Now().Add(-2 * reservationRetention)
+	assert.Empty(q.reservations(before))
+	assert.Empty(q.reserved)
+
+	counts := &analysisCounts{byUser: map[string]int{}, byApp: map[string]int{}, startingByUser: map[string]int{}}
+	counted := map[string]bool{}
+	q.reserve(&model.Job{InvocationID: "e2", AppID: "app", Submitter: "bob"})
+	countReservations(q.reservations(before), counts, map[string]*userQuotaState{}, counted)
+	countReservations(q.reservations(before), counts, map[string]*userQuotaState{}, counted)
+	assert.Equal(1, counts.byApp["app"])
+	assert.Equal(1, counts.startingByUser["bob"])
+}
+
+func TestQueueLaunchIfBusyDisabled(t *testing.T) {
+	i, _ := setupInternal(t, []runtime.Object{})
+
+	position, err := i.queueLaunchIfBusy(&model.Job{InvocationID: "a1", Submitter: "alice"})
+	assert.NoError(t, err)
+	assert.Nil(t, position)
+}
+
+func TestValidateLaunchShaping(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateLaunchShaping(&LaunchShapingConfig{}))
+	assert.NoError(ValidateLaunchShaping(&LaunchShapingConfig{Enabled: true, UtilizationThreshold: 0.8}))
+	assert.Error(ValidateLaunchShaping(&LaunchShapingConfig{Enabled: true}))
+	assert.Error(ValidateLaunchShaping(&LaunchShapingConfig{Enabled: true, UtilizationThreshold: 1.5}))
+	assert.Error(ValidateLaunchShaping(&LaunchShapingConfig{Enabled: true, UtilizationThreshold: 0.8, MaxStarting: -1}))
+}
+
+func TestApplyPins(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	launches := []*queuedLaunch{
+		queued("a1", "alice", now),
+		queued("b1", "bob", now.Add(time.Second)),
+		queued("c1", "carol", now.Add(2*time.Second)),
+		queued("d1", "dave", now.Add(3*time.Second)),
+	}
+	assert.Equal([]string{"a1", "b1", "c1", "d1"}, externalIDs(applyPins(launches)))
+
+	launches[3].pinned = 1
+	launches[0].pinned = 10
+	assert.Equal([]string{"d1", "b1", "c1", "a1"}, externalIDs(applyPins(launches)))
+}
+
+// startingDeployment returns an analysis Deployment for the user with the
+// number of ready replicas.
+func startingDeployment(name, user string, ready int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "username": user},
+		},
+		Status: appsv1.DeploymentStatus{ReadyReplicas: ready},
+	}
+}
+
+func TestQueueLaunchIfStartLimited(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		startingDeployment("a1", "alice", 0),
+		startingDeployment("b1", "bob", 1),
+	})
+	i.LaunchShaping = LaunchShapingConfig{Enabled: true, UtilizationThreshold: 0.9, MaxStartingPerUser: 1}
+
+	counts, err := i.countAnalyses()
+	assert.NoError(err)
+	assert.Equal(1, counts.starting)
+	assert.Equal(map[string]int{"alice": 1}, counts.startingByUser)
+	assert.Equal(map[string]int{"alice": 1, "bob": 1}, counts.byUser)
+
+	// Bob's analysis is ready, so his launch goes ahead.
+	position, err := i.queueLaunchIfBusy(&model.Job{InvocationID: "b2", Submitter: "bob"})
+	assert.NoError(err)
+	assert.Nil(position)
+
+	// Alice already has an analysis starting.
+	position, err = i.queueLaunchIfBusy(&model.Job{InvocationID: "a2", Submitter: "alice"})
+	assert.NoError(err)
+	if assert.NotNil(position) {
+		assert.Equal(1, position.Position)
+	}
+
+	// She's passed over until it's ready.
+	client := i.clientset.(*fake.Clientset)
+	client.ClearActions()
+	mock.ExpectQuery("FROM vice_app_concurrency_limits").
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_running", "updated_at"}))
+	i.admitQueuedLaunches()
+	assert.Len(i.launchQueue.launches, 1)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// The deployments are only listed once for all of the checks.
+	deploymentLists := 0
+	for _, action := range client.Actions() {
+		if action.Matches("list", "deployments") {
+			deploymentLists++
+		}
+	}
+	assert.Equal(1, deploymentLists)
+}
+
+func TestReportQueuePositions(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{})
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+
+	now := time.Now()
+	first := queued("a1", "alice", now)
+	first.reportedPosition = 1
+	second := queued("b1", "bob", now.Add(time.Second))
+	second.reportedPosition = 2
+	i.launchQueue.launches = []*queuedLaunch{first, second}
+
+	// Nothing has moved.
+	i.reportQueuePositions(map[string]int{})
+	assert.Empty(publisher.published)
+
+	// Alice's launch is admitted and Carol's is pinned at the front, so only
+	// Carol's position is new.
+	third := queued("c1", "carol", now.Add(2*time.Second))
+	third.pinned = 1
+	i.launchQueue.launches = []*queuedLaunch{second, third}
+	i.reportQueuePositions(map[string]int{})
+	assert.Equal([]string{"Queued"}, publisher.published)
+	assert.Equal(1, third.reportedPosition)
+	assert.Equal(2, second.reportedPosition)
+}
+
+func TestAdminMoveQueuedLaunchHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{})
+	i.statusPublisher = &recordingPublisher{}
+
+	now := time.Now()
+	i.launchQueue.launches = []*queuedLaunch{
+		queued("a1", "alice", now),
+		queued("b1", "bob", now.Add(time.Second)),
+		queued("c1", "carol", now.Add(2*time.Second)),
+	}
+
+	move := func(externalID, body string) (*httptest.ResponseRecorder, error) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/vice/admin/queue/"+externalID+"/position", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("external-id")
+		c.SetParamValues(externalID)
+		return rec, i.AdminMoveQueuedLaunchHandler(c)
+	}
+
+	rec, err := move("c1", `{"position": 1}`)
+	assert.NoError(err)
+
+	result := map[string][]QueuePosition{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &result))
+	if assert.Len(result["launches"], 3) {
+		assert.Equal("c1", result["launches"][0].ExternalID)
+		assert.True(result["launches"][0].Pinned)
+		assert.Equal("a1", result["launches"][1].ExternalID)
+	}
+
+	// Position zero puts the launch back in fair-share order.
+	_, err = move("c1", `{"position": 0}`)
+	assert.NoError(err)
+	positions, err := i.positionsFor("")
+	assert.NoError(err)
+	assert.Equal("c1", positions[2].ExternalID)
+
+	_, err = move("z1", `{"position": 1}`)
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	_, err = move("c1", `{"position": "first"}`)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestFairShareOrderLegacyLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	// The running analyses labeled with the legacy username label value count
+	// toward the user's share.
+	long := strings.Repeat("longname", 10)
+	now := time.Now()
+	launches := []*queuedLaunch{
+		queued("a1", long, now),
+		queued("b1", "bob", now.Add(time.Second)),
+	}
+	running := map[string]int{common.LegacyLabelValueString(long): 2, "bob": 1}
+	assert.Equal([]string{"b1", "a1"}, externalIDs(fairShareOrder(launches, running)))
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// launchParams returns the job with the values of its environment variables
+// removed, for storing in the launch record. The variables supplied with the
+// launch can hold credentials, so only their names are kept.
+func launchParams(job *model.Job) *model.Job {
+	params := *job
+	params.Steps = make([]model.Step, len(job.Steps))
+	for idx, step := range job.Steps {
+		if step.Environment != nil {
+			env := model.StepEnvironment{}
+			for name := range step.Environment {
+				env[name] = ""
+			}
+			step.Environment = env
+		}
+		params.Steps[idx] = step
+	}
+	return &params
+}
+
+// getLaunchRecord assembles the launch record for the analysis from the names
+// the k8s objects are created with. It does not call the k8s API.
+func (i *Internal) getLaunchRecord(job *model.Job) (*apps.LaunchRecord, error) {
+	params, err := json.Marshal(launchParams(job))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error encoding the launch parameters for %s", job.InvocationID)
+	}
+
+	record := &apps.LaunchRecord{
+		ExternalID:     job.InvocationID,
+		DeploymentName: job.InvocationID,
+		ServiceName:    serviceName(job),
+		PVCNames:       []string{},
+		Subdomain:      i.subdomain(job.UserID, job.InvocationID),
+		Params:         types.JSONText(params),
+	}
+
+	// Analyses served through tunnels don't get an Ingress.
+	if !i.tunnelEnabled() {
+		record.IngressName = IngressName(job.UserID, job.InvocationID)
+	}
+
+	if i.UseCSIDriver {
+		record.PVCNames = append(record.PVCNames, i.getCSIVolumeClaimName(job))
+	}
+
+	return record, nil
+}
+
+// recordLaunch saves the names of the k8s objects created for the analysis.
+// Failures are logged rather than returned, since the analysis is running
+// either way.
+func (i *Internal) recordLaunch(ctx context.Context, job *model.Job) {
+	record, err := i.getLaunchRecord(job)
+	if err == nil {
+		err = i.newApps().RecordLaunch(ctx, record)
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error recording the launch of analysis %s", job.InvocationID))
+	}
+}
+
+// launchRecord returns the launch record for the analysis, or nil if there
+// isn't one or it can't be looked up.
+func (i *Internal) launchRecord(externalID string) *apps.LaunchRecord {
+	record, err := i.newApps().GetLaunchRecord(context.Background(), externalID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up the launch record for %s", externalID))
+		return nil
+	}
+	return record
+}
+
+// markLaunchTerminated records that the objects for the analysis are gone.
+func (i *Internal) markLaunchTerminated(externalID string) {
+	if err := i.newApps().SetLaunchTerminated(context.Background(), externalID); err != nil {
+		log.Error(errors.Wrapf(err, "error marking the launch of %s as terminated", externalID))
+	}
+}
+
+// deleteRecordedObjects deletes the objects named in the launch record that a
+// label selector didn't find, such as ones whose labels were removed or
+// changed by hand. Objects that are already gone are skipped.
+func deleteRecordedObjects(kind string, names []string, found map[string]bool, del func(name string) error) {
+	for _, name := range names {
+		if name == "" || found[name] {
+			continue
+		}
+		if err := del(name); err != nil && !k8serrors.IsNotFound(err) {
+			log.Error(errors.Wrapf(err, "error deleting %s %s", kind, name))
+		}
+	}
+}
+
+// AdminGetLaunchRecordHandler returns the names of the k8s objects created for
+// the analysis and the parameters it was launched with.
+func (i *Internal) AdminGetLaunchRecordHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	record, err := i.newApps().GetLaunchRecord(c.Request().Context(), externalID)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no launch record found for analysis "+analysisID)
+	}
+
+	return c.JSON(http.StatusOK, record)
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var launchRecordRowColumns = []string{
+	"external_id",
+	"deployment_name",
+	"service_name",
+	"ingress_name",
+	"pvc_names",
+	"subdomain",
+	"params",
+	"launched_at",
+	"terminated_at",
+}
+
+func TestGetLaunchRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	i.UseCSIDriver = true
+	registerSubdomainQuery(mock, "e1", "mylab")
+
+	job := multiPortJob(8888)
+	job.UserID = "u1"
+	job.Steps[0].Environment = model.StepEnvironment{"API_TOKEN": "s3cret"}
+	record, err := i.getLaunchRecord(job)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal("e1", record.ExternalID)
+	assert.Equal("e1", record.DeploymentName)
+	assert.Equal("vice-e1", record.ServiceName)
+	assert.Equal(IngressName("u1", "e1"), record.IngressName)
+	assert.Equal([]string{i.getCSIVolumeClaimName(job)}, []string(record.PVCNames))
+	assert.Equal("mylab", record.Subdomain)
+	assert.Contains(string(record.Params), `"uuid":"e1"`)
+
+	// Only the names of the environment variables are stored, and the job
+	// itself is left alone.
+	assert.Contains(string(record.Params), `"API_TOKEN":""`)
+	assert.NotContains(string(record.Params), "s3cret")
+	assert.Equal("s3cret", job.Steps[0].Environment["API_TOKEN"])
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestTeardownRecordedObjects(t *testing.T) {
+	assert := assert.New(t)
+
+	// Neither object has the labels teardown looks for.
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps"}}
+	service := &apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: "vice-e1", Namespace: "vice-apps"}}
+
+	i, mock := setupInternal(t, []runtime.Object{deployment, service})
+	i.statusPublisher = &recordingPublisher{}
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery("FROM vice_launch_records").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(launchRecordRowColumns).
+			AddRow("e1", "e1", "vice-e1", "a1234abcd", "{}", "a1234abcd", "{}", time.Now(), nil))
+	mock.ExpectExec("UPDATE vice_launch_records").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.doExit("e1"))
+
+	deps, err := i.clientset.AppsV1().Deployments("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(deps.Items)
+
+	svcs, err := i.clientset.CoreV1().Services("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(svcs.Items)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// AnalysisState is the lifecycle state of a VICE analysis as tracked by
+// app-exposer.
+type AnalysisState string
+
+const (
+	// RequestedState means the launch request was received but nothing has
+	// been created in the cluster yet.
+	RequestedState AnalysisState = "Requested"
+
+	// ProvisioningState means the k8s resources for the analysis are being
+	// created and the pod hasn't become ready yet.
+	ProvisioningState AnalysisState = "Provisioning"
+
+	// StagingState means the input files are being transferred into the
+	// analysis.
+	StagingState AnalysisState = "Staging"
+
+	// RunningState means the analysis is up and available to the user.
+	RunningState AnalysisState = "Running"
+
+	// SavingState means the output files are being transferred out of the
+	// analysis.
+	SavingState AnalysisState = "Saving"
+
+	// TerminatingState means the k8s resources for the analysis are being
+	// removed.
+	TerminatingState AnalysisState = "Terminating"
+
+	// CompletedState means the analysis has been shut down normally.
+	CompletedState AnalysisState = "Completed"
+
+	// FailedState means the analysis could not be launched or died.
+	FailedState AnalysisState = "Failed"
+
+	// QuarantinedState means the analysis has been isolated by an administrator
+	// and should not be acted on automatically.
+	QuarantinedState AnalysisState = "Quarantined"
+
+	// PausedState means the analysis is not running, but its resources have
+	// been kept around so that it can be resumed.
+	PausedState AnalysisState = "Paused"
+)
+
+// allowedTransitions maps each state to the states it's allowed to move to.
+// Completed and Failed are terminal.
+var allowedTransitions = map[AnalysisState][]AnalysisState{
+	RequestedState:    {ProvisioningState, FailedState},
+	ProvisioningState: {StagingState, RunningState, TerminatingState, FailedState},
+	StagingState:      {RunningState, TerminatingState, FailedState},
+	RunningState:      {StagingState, SavingState, TerminatingState, PausedState, QuarantinedState, FailedState},
+	SavingState:       {RunningState, TerminatingState, FailedState},
+	PausedState:       {ProvisioningState, RunningState, TerminatingState, QuarantinedState},
+	QuarantinedState:  {RunningState, TerminatingState},
+	TerminatingState:  {CompletedState, FailedState},
+	CompletedState:    {},
+	FailedState:       {},
+}
+
+// IsTerminal returns true if no further transitions are possible from the state.
+func (s AnalysisState) IsTerminal() bool {
+	return s == CompletedState || s == FailedState
+}
+
+// canTransition returns true if an analysis in the from state is allowed to
+// move to the to state. Staying in the same state is always allowed so that
+// progress messages can still be published. An empty from state means the
+// analysis predates state tracking, so any transition is allowed.
+func canTransition(from, to AnalysisState) bool {
+	if from == "" || from == to {
+		return true
+	}
+	for _, s := range allowedTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// AnalysisStateRecord is the persisted state of an analysis.
+type AnalysisStateRecord struct {
+	ExternalID string        `json:"externalID" db:"external_id"`
+	State      AnalysisState `json:"state" db:"state"`
+	UpdatedAt  time.Time     `json:"updatedAt" db:"updated_at"`
+}
+
+// AnalysisStateResponse is the lifecycle state of an analysis returned by the
+// state endpoints.
+type AnalysisStateResponse struct {
+	AnalysisID string `json:"analysisID"`
+	AnalysisStateRecord
+}
+
+const getAnalysisStateSQL = `
+	SELECT external_id, state, updated_at
+	  FROM vice_analysis_states
+	 WHERE external_id = $1
+`
+
+const upsertAnalysisStateSQL = `
+	INSERT INTO vice_analysis_states (external_id, state, updated_at)
+	VALUES ($1, $2, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET state = EXCLUDED.state,
+	       updated_at = EXCLUDED.updated_at
+`
+
+// analysisLocks serializes the state changes of each analysis without making
+// the changes to different analyses wait on each other. A lock is dropped once
+// nothing holds or waits on it.
+type analysisLocks struct {
+	mu    sync.Mutex
+	locks map[string]*analysisLock
+}
+
+type analysisLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the analysis and returns the function that unlocks it.
+func (l *analysisLocks) lock(externalID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*analysisLock{}
+	}
+	lock, ok := l.locks[externalID]
+	if !ok {
+		lock = &analysisLock{}
+		l.locks[externalID] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, externalID)
+		}
+	}
+}
+
+// getAnalysisState returns the persisted state record for the analysis. A
+// nil record is returned if the analysis has no state recorded.
+func (i *Internal) getAnalysisState(externalID string) (*AnalysisStateRecord, error) {
+	record := &AnalysisStateRecord{}
+	err := i.db.QueryRowx(getAnalysisStateSQL, externalID).StructScan(record)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the state of analysis %s", externalID)
+	}
+	return record, nil
+}
+
+// currentState returns the state the analysis is in, or the fallback state if
+// nothing has been recorded for it yet.
+func (i *Internal) currentState(externalID string, fallback AnalysisState) (AnalysisState, error) {
+	record, err := i.getAnalysisState(externalID)
+	if err != nil {
+		return "", err
+	}
+	if record == nil {
+		return fallback, nil
+	}
+	return record.State, nil
+}
+
+// publishState sends the status update that corresponds to the state. The
+// job-status-listener only knows about running, failed, and succeeded jobs,
+// so every non-terminal state is published as running.
+func (i *Internal) publishState(externalID string, state AnalysisState, msg string) error {
+	switch state {
+	case FailedState:
+		return i.statusPublisher.Fail(externalID, msg)
+	case CompletedState:
+		return i.statusPublisher.Success(externalID, msg)
+	default:
+		return i.statusPublisher.Running(externalID, msg)
+	}
+}
+
+// transition moves the analysis into a new state, persists it, and publishes
+// the corresponding status update with the message. An error is returned
+// without persisting or publishing anything if the transition isn't allowed.
+// Nothing is persisted if the analysis is already in the state, but the
+// message is still published. The status update is published even if the
+// state couldn't be persisted, since the systems listening for it are the
+// ones users see.
+func (i *Internal) transition(externalID string, to AnalysisState, msg string) error {
+	unlock := i.stateLocks.lock(externalID)
+	defer unlock()
+
+	var from AnalysisState
+
+	current, err := i.getAnalysisState(externalID)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		from = current.State
+	}
+
+	if !canTransition(from, to) {
+		return fmt.Errorf("analysis %s cannot move from %s to %s", externalID, from, to)
+	}
+
+	var recordErr error
+	if from != to {
+		if _, err = i.db.Exec(upsertAnalysisStateSQL, externalID, string(to)); err != nil {
+			recordErr = errors.Wrapf(err, "error recording state %s for analysis %s", to, externalID)
+		} else {
+			// The state change has already happened, so a missed uptime update
+			// is only logged.
+			if err = i.recordUptime(externalID, from, to); err != nil {
+				log.Error(err)
+			}
+			log.Infof("analysis %s moved from %s to %s", externalID, from, to)
+		}
+	}
+
+	if err = i.publishState(externalID, to, msg); err != nil {
+		if recordErr != nil {
+			log.Error(recordErr)
+		}
+		return err
+	}
+
+	return recordErr
+}
+
+// transitionAndLog calls transition and logs any error. Used in places where a
+// failure to record the state shouldn't interrupt the operation in progress.
+func (i *Internal) transitionAndLog(externalID string, to AnalysisState, msg string) {
+	if err := i.transition(externalID, to, msg); err != nil {
+		log.Error(err)
+	}
+}
+
+func (i *Internal) stateResponse(c echo.Context, analysisID, externalID string) error {
+	record, err := i.getAnalysisState(externalID)
+	if err != nil {
+		return err
+	}
+
+	if record == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no state recorded for analysis %s", analysisID))
+	}
+
+	return c.JSON(http.StatusOK, &AnalysisStateResponse{
+		AnalysisID:          analysisID,
+		AnalysisStateRecord: *record,
+	})
+}
+
+// GetStateHandler returns the lifecycle state of the analysis for the user.
+func (i *Internal) GetStateHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if len(externalIDs) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
+	}
+
+	return i.stateResponse(c, analysisID, externalIDs[0])
+}
+
+// AdminGetStateHandler returns the lifecycle state of the analysis without
+// requiring user information.
+func (i *Internal) AdminGetStateHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	return i.stateResponse(c, analysisID, externalID)
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingPublisher is an AnalysisStatusPublisher that remembers what it was
+// asked to publish.
+type recordingPublisher struct {
+	published []string
+}
+
+func (r *recordingPublisher) Fail(jobID, msg string) error {
+	r.published = append(r.published, "Failed")
+	return nil
+}
+
+func (r *recordingPublisher) Success(jobID, msg string) error {
+	r.published = append(r.published, "Completed")
+	return nil
+}
+
+func (r *recordingPublisher) Running(jobID, msg string) error {
+	r.published = append(r.published, "Running")
+	return nil
+}
+
+func (r *recordingPublisher) Queued(jobID, msg string) error {
+	r.published = append(r.published, "Queued")
+	return nil
+}
+
+func (r *recordingPublisher) ImpendingCancellation(jobID, msg string) error {
+	r.published = append(r.published, "ImpendingCancellation")
+	return nil
+}
+
+// registerStateQuery registers a state lookup for an analysis. A nil state
+// means that no state has been recorded.
+func registerStateQuery(mock sqlmock.Sqlmock, externalID string, state *AnalysisState) {
+	query := mock.ExpectQuery("SELECT external_id, state, updated_at FROM vice_analysis_states").
+		WithArgs(externalID)
+	if state == nil {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	rows := sqlmock.NewRows([]string{"external_id", "state", "updated_at"}).
+		AddRow(externalID, string(*state), time.Now())
+	query.WillReturnRows(rows)
+}
+
+func TestCanTransition(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		from     AnalysisState
+		to       AnalysisState
+		expected bool
+	}{
+		{"", RunningState, true},
+		{RequestedState, ProvisioningState, true},
+		{RequestedState, RunningState, false},
+		{ProvisioningState, RunningState, true},
+		{RunningState, RunningState, true},
+		{RunningState, SavingState, true},
+		{RunningState, CompletedState, false},
+		{TerminatingState, CompletedState, true},
+		{CompletedState, RunningState, false},
+		{FailedState, ProvisioningState, false},
+		{QuarantinedState, PausedState, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.expected, canTransition(test.from, test.to), "%s -> %s", test.from, test.to)
+	}
+}
+
+func TestTransition(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	// Moving from a non-terminal state to an allowed state.
+	provisioning := ProvisioningState
+	registerStateQuery(mock, "a", &provisioning)
+	mock.ExpectExec("INSERT INTO vice_analysis_states").
+		WithArgs("a", "Running").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO vice_analysis_uptime").
+		WithArgs("a").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(internal.transition("a", RunningState, "running"))
+
+	// Moving out of a terminal state isn't allowed.
+	completed := CompletedState
+	registerStateQuery(mock, "b", &completed)
+	assert.Error(internal.transition("b", RunningState, "running"))
+
+	// Analyses without a recorded state can move anywhere.
+	registerStateQuery(mock, "c", nil)
+	mock.ExpectExec("INSERT INTO vice_analysis_states").
+		WithArgs("c", "Failed").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(internal.transition("c", FailedState, "failed"))
+
+	// Staying in the same state only publishes the message.
+	running := RunningState
+	registerStateQuery(mock, "d", &running)
+	assert.NoError(internal.transition("d", RunningState, "still running"))
+
+	// The status is published even if the state can't be recorded.
+	registerStateQuery(mock, "e", &running)
+	mock.ExpectExec("INSERT INTO vice_analysis_states").
+		WithArgs("e", "Failed").
+		WillReturnError(errors.New("connection reset"))
+	assert.Error(internal.transition("e", FailedState, "failed"))
+
+	assert.Equal([]string{"Running", "Failed", "Running", "Failed"}, publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAnalysisLocks(t *testing.T) {
+	assert := assert.New(t)
+
+	locks := &analysisLocks{}
+
+	// Different analyses don't wait on each other.
+	unlockA := locks.lock("a")
+	unlockB := locks.lock("b")
+	unlockB()
+
+	// The same analysis waits until the lock is released.
+	locked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		unlock := locks.lock("a")
+		close(locked)
+		unlock()
+		close(done)
+	}()
+
+	select {
+	case <-locked:
+		assert.Fail("the analysis was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlockA()
+	<-locked
+	<-done
+
+	// Nothing is kept around once the locks are released.
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	assert.Empty(locks.locks)
+}
+
+func TestAdminGetStateLookupErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	getState := func() error {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/vice/admin/analyses/a1/state", nil), httptest.NewRecorder())
+		c.SetParamNames("analysis-id")
+		c.SetParamValues("a1")
+		return i.AdminGetStateHandler(c)
+	}
+
+	// Analyses that don't exist are reported as not found.
+	mock.ExpectQuery("JOIN jobs").WithArgs("a1").WillReturnError(sql.ErrNoRows)
+	err := getState()
+	if assert.IsType(&echo.HTTPError{}, err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	// Anything else is an internal error rather than a bad request.
+	mock.ExpectQuery("JOIN jobs").WithArgs("a1").WillReturnError(errors.New("connection refused"))
+	err = getState()
+	if assert.Error(err) {
+		_, isHTTPError := err.(*echo.HTTPError)
+		assert.False(isHTTPError)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -1,16 +1,18 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"strings"
 
-	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	"gopkg.in/cyverse-de/model.v5"
-	v1 "k8s.io/api/apps/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 )
@@ -33,52 +35,86 @@ func shouldCountStatus(status string) bool {
 	return countIt
 }
 
-func (i *Internal) countJobsForUser(username string) (int, error) {
-	set := labels.Set(map[string]string{
-		"username": username,
-	})
+// countJobsForUser counts the analyses the user is running: their VICE
+// analyses that aren't paused, and their batch analyses that haven't finished.
+// The Jobs of an array job are counted as one analysis. Analyses labeled with
+// the legacy value of the username label are counted too.
+func (i *Internal) countJobsForUser(ctx context.Context, user string) (int, error) {
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+
+	deployments := []appsv1.Deployment{}
+	batchJobs := []batchv1.Job{}
+	for _, username := range common.LabelValues(user) {
+		set := labels.Set(i.labelKeys.selector(map[string]string{
+			"username": username,
+		}))
+
+		listoptions := metav1.ListOptions{
+			LabelSelector: set.AsSelector().String(),
+		}
+
+		deplist, err := depclient.List(listoptions)
+		if err != nil {
+			return 0, err
+		}
+		deployments = append(deployments, deplist.Items...)
 
-	listoptions := metav1.ListOptions{
-		LabelSelector: set.AsSelector().String(),
+		jobs, err := i.runningBatchJobs(username)
+		if err != nil {
+			return 0, err
+		}
+		batchJobs = append(batchJobs, jobs...)
 	}
 
-	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
-	deplist, err := depclient.List(listoptions)
-	if err != nil {
-		return 0, err
+	// The labels of each analysis that might count against the limit.
+	analyses := []map[string]string{}
+	for idx := range deployments {
+		// Paused analyses don't count, since they aren't using any resources.
+		if isPaused(&deployments[idx]) {
+			continue
+		}
+		analyses = append(analyses, deployments[idx].GetLabels())
+	}
+	seen := map[string]bool{}
+	for idx := range batchJobs {
+		jobLabels := batchJobs[idx].GetLabels()
+		if externalID := i.labelKeys.get(jobLabels, "external-id"); externalID != "" {
+			if seen[externalID] {
+				continue
+			}
+			seen[externalID] = true
+		}
+		analyses = append(analyses, jobLabels)
 	}
 
-	countedDeployments := []v1.Deployment{}
-	a := apps.NewApps(i.db, i.UserSuffix)
+	counted := 0
+	a := i.newApps()
 
-	for _, deployment := range deplist.Items {
-		var (
-			externalID, analysisID, analysisStatus string
-			ok                                     bool
-		)
+	var err error
 
-		labels := deployment.GetLabels()
+	for _, analysisLabels := range analyses {
+		var externalID, analysisID, analysisStatus string
 
-		// If we don't have the external-id on the deployment, count it.
-		if externalID, ok = labels["external-id"]; !ok {
-			countedDeployments = append(countedDeployments, deployment)
+		// If we don't have the external-id on the analysis, count it.
+		if externalID = i.labelKeys.get(analysisLabels, "external-id"); externalID == "" {
+			counted++
 			continue
 		}
 
-		if analysisID, err = a.GetAnalysisIDByExternalID(externalID); err != nil {
+		if analysisID, err = a.GetAnalysisIDByExternalID(ctx, externalID); err != nil {
 			// If we failed to get it from the database, count it because it
 			// shouldn't be running.
 			log.Error(err)
-			countedDeployments = append(countedDeployments, deployment)
+			counted++
 			continue
 		}
 
-		analysisStatus, err = a.GetAnalysisStatus(analysisID)
+		analysisStatus, err = a.GetAnalysisStatus(ctx, analysisID)
 		if err != nil {
 			// If we failed to get the status, then something is horribly wrong.
 			// Count the analysis.
 			log.Error(err)
-			countedDeployments = append(countedDeployments, deployment)
+			counted++
 			continue
 		}
 
@@ -87,11 +123,11 @@ func (i *Internal) countJobsForUser(username string) (int, error) {
 		// or the database and the cluster are out of sync which is not
 		// the user's fault.
 		if shouldCountStatus(analysisStatus) {
-			countedDeployments = append(countedDeployments, deployment)
+			counted++
 		}
 	}
 
-	return len(countedDeployments), nil
+	return counted, nil
 }
 
 const getJobLimitForUserSQL = `
@@ -169,19 +205,119 @@ func validateJobLimits(user string, defaultJobLimit, jobCount int, jobLimit *int
 	}
 }
 
-func (i *Internal) validateJob(job *model.Job) (int, error) {
+// jobCheck is one of the checks a job goes through before it's launched.
+// Skipped returns the reason the check isn't enforced, if it isn't.
+type jobCheck struct {
+	name     string
+	skipped  func(i *Internal) string
+	validate func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error)
+}
 
-	// Verify that the job type is supported by this service
-	if strings.ToLower(job.ExecutionTarget) != "interapps" {
-		return http.StatusInternalServerError, fmt.Errorf("job type %s is not supported by this service", job.Type)
+// jobChecks are the checks a job goes through before it's launched, in the
+// order they're run. Launches stop at the first check that fails, while launch
+// validation and simulation run all of them so every problem is reported.
+var jobChecks = []jobCheck{
+	{
+		// Make sure the user hasn't been blocked from launching analyses.
+		name: "frozen",
+		validate: func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error) {
+			return i.validateNotFrozen(job.Submitter)
+		},
+	},
+	{
+		// Make sure the image hasn't failed its compatibility probe.
+		name: "image",
+		skipped: func(i *Internal) string {
+			if !i.ImageProbeEnforced {
+				return "image compatibility is not enforced"
+			}
+			return ""
+		},
+		validate: func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error) {
+			return i.validateImage(job)
+		},
+	},
+	{
+		// Make sure the auxiliary containers can run next to the analysis.
+		name: "auxiliary",
+		validate: func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error) {
+			return i.validateAuxiliaryContainers(job)
+		},
+	},
+	{
+		// Make sure the resources fit within the user's plan.
+		name: "plan",
+		skipped: func(i *Internal) string {
+			if !i.PlanEnforcement {
+				return "plans are not enforced"
+			}
+			return ""
+		},
+		validate: func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error) {
+			return i.validatePlan(ctx, job)
+		},
+	},
+	{
+		// Make sure the user's running analyses leave room for this one.
+		name:    "quota",
+		skipped: quotasSkipped,
+		validate: func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error) {
+			return i.validateQuota(ctx, job, replicas)
+		},
+	},
+	{
+		// Make sure the user has GPU-hours left if the analysis needs GPUs.
+		name:    "gpu-budget",
+		skipped: quotasSkipped,
+		validate: func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error) {
+			return i.validateGPUBudget(ctx, job)
+		},
+	},
+	{
+		// Validate the number of concurrent jobs for the user.
+		name: "job-limit",
+		validate: func(i *Internal, ctx context.Context, job *model.Job, replicas int) (int, error) {
+			return i.validateConcurrentJobs(ctx, job.Submitter)
+		},
+	},
+}
+
+// quotasSkipped is the reason the quota checks are skipped, if they are.
+func quotasSkipped(i *Internal) string {
+	if !i.Quotas.Enabled {
+		return "quotas are not enforced"
+	}
+	return ""
+}
+
+// validateJob runs the checks in jobChecks, stopping at the first one that
+// fails. Replicas is the number of copies of the job that are run.
+func (i *Internal) validateJob(ctx context.Context, job *model.Job, replicas int) (int, error) {
+	for _, check := range jobChecks {
+		if status, err := check.validate(i, ctx, job, replicas); err != nil {
+			return status, err
+		}
 	}
+	return http.StatusOK, nil
+}
 
-	// Get the username
-	usernameLabelValue := labelValueString(job.Submitter)
-	user := job.Submitter
+// validateExecutionTarget makes sure the job is meant to run as a VICE
+// analysis. Batch jobs are launched through their own endpoint and don't have
+// to be.
+func validateExecutionTarget(job *model.Job) error {
+	if strings.ToLower(job.ExecutionTarget) != "interapps" {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("execution target %s is not supported by this service", job.ExecutionTarget),
+		)
+	}
+	return nil
+}
 
-	// Validate the number of concurrent jobs for the user.
-	jobCount, err := i.countJobsForUser(usernameLabelValue)
+// validateConcurrentJobs makes sure the user can start running another
+// analysis without going over their concurrent job limit.
+func (i *Internal) validateConcurrentJobs(ctx context.Context, user string) (int, error) {
+	jobCount, err := i.countJobsForUser(ctx, user)
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the number of jobs that %s is currently running", user)
 	}
@@ -193,5 +329,18 @@ func (i *Internal) validateJob(job *model.Job) (int, error) {
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the default concurrent job limit")
 	}
+
+	// Users without a limit of their own are held to the limit of their plan,
+	// if it has one, instead of the default.
+	if jobLimit == nil && i.PlanEnforcement {
+		plan, err := i.newApps().GetUserPlan(ctx, i.fixUsername(user))
+		if err != nil {
+			return http.StatusInternalServerError, errors.Wrapf(err, "error looking up the plan for %s", user)
+		}
+		if plan != nil && plan.MaxConcurrentJobs != nil {
+			return validatePlanJobLimit(user, plan, jobCount)
+		}
+	}
+
 	return validateJobLimits(user, defaultJobLimit, jobCount, jobLimit)
 }
@@ -1,12 +1,18 @@
 package internal
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/cyverse-de/model.v5"
 	v1 "k8s.io/api/apps/v1"
@@ -38,7 +44,7 @@ var testConfig = &Init{
 
 // viceDeployment creates a fake VICE deployment to use for testing.
 func viceDeployment(n int, namespace, username string, externalID *string) *v1.Deployment {
-	labels := map[string]string{"username": labelValueString(username)}
+	labels := map[string]string{"username": common.LabelValueString(username)}
 	if externalID != nil {
 		labels["external-id"] = *externalID
 	}
@@ -75,6 +81,19 @@ func stringPointer(value string) *string {
 	return &value
 }
 
+// registerFreezeQuery registers a launch freeze query for a user. A nil reason
+// means the user isn't frozen.
+func registerFreezeQuery(mock sqlmock.Sqlmock, username string, reason *string) {
+	query := mock.ExpectQuery("SELECT username, reason, frozen_at FROM vice_user_freezes").
+		WithArgs(username + testConfig.UserSuffix)
+	if reason == nil {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	query.WillReturnRows(sqlmock.NewRows([]string{"username", "reason", "frozen_at"}).
+		AddRow(username+testConfig.UserSuffix, *reason, time.Now()))
+}
+
 // registerLimitQuery registers a job limit query for a user.
 func registerLimitQuery(mock sqlmock.Sqlmock, username string, limit *int) {
 	rows := mock.NewRows([]string{"concurrent_jobs"})
@@ -287,6 +306,7 @@ func TestLimitChecks(t *testing.T) {
 			defer internal.db.Close()
 
 			// Add the database expectations.
+			registerFreezeQuery(mock, test.username, nil)
 			for _, analysis := range test.analyses {
 				registerAnalysisIDQuery(mock, analysis.externalID, analysis.analysisID)
 				registerAnalysisStatusQuery(mock, analysis.analysisID, analysis.status)
@@ -295,7 +315,7 @@ func TestLimitChecks(t *testing.T) {
 			registerDefaultLimitQuery(mock, test.defaultLimit)
 
 			// Run the limit check.
-			status, err := internal.validateJob(createTestSubmission(test.username))
+			status, err := internal.validateJob(context.Background(), createTestSubmission(test.username), 1)
 			expectedError := expectedLimitError(test.username, test.defaultLimit, len(test.analyses), test.limit)
 			if expectedError == nil {
 				assert.Equalf(http.StatusOK, status, "the status code should be %d", http.StatusOK)
@@ -309,15 +329,77 @@ func TestLimitChecks(t *testing.T) {
 	}
 }
 
-func TestLabelValueReplacement(t *testing.T) {
+func TestCountJobsForUserBatchJobs(t *testing.T) {
 	assert := assert.New(t)
 
-	assert.Equal("foo-xxx-u", labelValueString("foo_"))
-	assert.Equal("foo-xxx-u-u", labelValueString("foo__"))
-	assert.Equal("foo-xxx-u-h-u", labelValueString("foo_-_"))
-	assert.Equal("h-xxx-foo", labelValueString("-foo"))
-	assert.Equal("h-u-h-xxx-foo", labelValueString("-_-foo"))
-	assert.Equal("h-u-h-xxx-foo-bar-xxx-h-u-h", labelValueString("-_-foo-bar-_-"))
-	assert.Equal("u-u-u-xxx-foo_bar-xxx-u-u-u", labelValueString("___foo_bar___"))
-	assert.Equal("u-u-u-u-xxx-foo__bar-baz__quux-xxx-u-u-u-u", labelValueString("____foo__bar--baz__quux____"))
+	// Unfinished batch analyses count, with array jobs counted once.
+	i, mock := setupInternal(t, []runtime.Object{
+		requestingBatchJob("count-b1-0", "count-b1", "alice", "1", "2Gi", false),
+		requestingBatchJob("count-b1-1", "count-b1", "alice", "1", "2Gi", false),
+		requestingBatchJob("count-b2", "count-b2", "alice", "1", "2Gi", true),
+	})
+
+	externalID, analysisID, status := "count-b1", "count-a1", "Running"
+	registerAnalysisIDQuery(mock, &externalID, &analysisID)
+	registerAnalysisStatusQuery(mock, &analysisID, &status)
+
+	count, err := i.countJobsForUser(context.Background(), "alice")
+	assert.NoError(err)
+	assert.Equal(1, count)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCountJobsForUserLegacyLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	// Analyses launched before long label values got a hash suffix are still
+	// labeled with the legacy value, and they count too.
+	user := strings.Repeat("longname", 10)
+	e1, e2 := "legacy-e1", "legacy-e2"
+	current := viceDeployment(0, "vice-apps", user, &e1)
+	legacy := viceDeployment(1, "vice-apps", user, &e2)
+	legacy.Labels["username"] = common.LegacyLabelValueString(user)
+	assert.NotEqual(current.Labels["username"], legacy.Labels["username"])
+
+	i, mock := setupInternal(t, []runtime.Object{current, legacy})
+
+	status := "Running"
+	for _, externalID := range []string{"legacy-e1", "legacy-e2"} {
+		externalID := externalID
+		analysisID := "a-" + externalID
+		registerAnalysisIDQuery(mock, &externalID, &analysisID)
+		registerAnalysisStatusQuery(mock, &analysisID, &status)
+	}
+
+	count, err := i.countJobsForUser(context.Background(), user)
+	assert.NoError(err)
+	assert.Equal(2, count)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestValidateExecutionTarget(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateExecutionTarget(&model.Job{ExecutionTarget: "interapps"}))
+
+	err := validateExecutionTarget(&model.Job{ExecutionTarget: "condor"})
+	if assert.IsType(&echo.HTTPError{}, err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestFrozenUser(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	defer internal.db.Close()
+
+	reason := "billing hold"
+	registerFreezeQuery(mock, "test", &reason)
+
+	status, err := internal.validateJob(context.Background(), createTestSubmission("test"), 1)
+	assert.Equal(http.StatusBadRequest, status)
+	assert.Error(err)
+	assert.Contains(err.Error(), reason)
+	assert.NoError(mock.ExpectationsWereMet())
 }
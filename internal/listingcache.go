@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+type listingCacheEntry struct {
+	listing *ResourceInfo
+	expires time.Time
+}
+
+// listingCache is a short-lived cache of resource listings keyed by the filter
+// used to generate them. It keeps dashboards that refresh every few seconds
+// from causing a full listing on every refresh.
+type listingCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]listingCacheEntry
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	return &listingCache{
+		ttl:     ttl,
+		entries: map[string]listingCacheEntry{},
+	}
+}
+
+// enabled returns true if listings should be cached at all.
+func (l *listingCache) enabled() bool {
+	return l.ttl > 0
+}
+
+// listingCacheKey returns a cache key for the filter that doesn't depend on
+// map ordering.
+func listingCacheKey(filter map[string]string) string {
+	keys := []string{}
+	for k := range filter {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, filter[k]))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (l *listingCache) get(filter map[string]string) (*ResourceInfo, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := listingCacheKey(filter)
+
+	entry, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(l.entries, key)
+		return nil, false
+	}
+
+	return entry.listing, true
+}
+
+func (l *listingCache) set(filter map[string]string, listing *ResourceInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[listingCacheKey(filter)] = listingCacheEntry{
+		listing: listing,
+		expires: time.Now().Add(l.ttl),
+	}
+}
+
+// invalidate drops all of the cached listings.
+func (l *listingCache) invalidate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = map[string]listingCacheEntry{}
+}
+
+// invalidationHandler returns informer event handlers that drop the cached
+// listings whenever a VICE resource is added, changed, or removed.
+func (l *listingCache) invalidationHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { l.invalidate() },
+		UpdateFunc: func(oldObj, newObj interface{}) { l.invalidate() },
+		DeleteFunc: func(obj interface{}) { l.invalidate() },
+	}
+}
+
+// cachedResourceListing returns the resource listing for the filter, using a
+// cached copy if one is available and bypass is false.
+func (i *Internal) cachedResourceListing(filter map[string]string, bypass bool) (*ResourceInfo, error) {
+	if !i.listingCache.enabled() {
+		return i.doResourceListing(filter)
+	}
+
+	if !bypass {
+		if listing, ok := i.listingCache.get(filter); ok {
+			return listing, nil
+		}
+	}
+
+	listing, err := i.doResourceListing(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	i.listingCache.set(filter, listing)
+
+	return listing, nil
+}
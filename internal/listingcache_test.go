@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListingCacheKey(t *testing.T) {
+	assert.Equal(t, "a=1,b=2", listingCacheKey(map[string]string{"b": "2", "a": "1"}))
+	assert.Equal(t, "", listingCacheKey(map[string]string{}))
+}
+
+func TestListingCache(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newListingCache(time.Minute)
+	assert.True(l.enabled())
+
+	listing := &ResourceInfo{}
+	l.set(map[string]string{"user-id": "u1"}, listing)
+
+	cached, ok := l.get(map[string]string{"user-id": "u1"})
+	assert.True(ok)
+	assert.Same(listing, cached)
+
+	_, ok = l.get(map[string]string{"user-id": "u2"})
+	assert.False(ok)
+
+	l.invalidationHandler().OnUpdate(nil, nil)
+	_, ok = l.get(map[string]string{"user-id": "u1"})
+	assert.False(ok)
+
+	expired := newListingCache(time.Nanosecond)
+	expired.set(map[string]string{}, listing)
+	time.Sleep(time.Millisecond)
+	_, ok = expired.get(map[string]string{})
+	assert.False(ok)
+
+	assert.False(newListingCache(0).enabled())
+}
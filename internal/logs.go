@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cyverse-de/app-exposer/permissions"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	apiv1 "k8s.io/api/core/v1"
@@ -88,7 +89,8 @@ type VICELogEntry struct {
 }
 
 // LogsHandler handles requests to access the analysis container logs for a pod in a running
-// VICE app. Needs the 'id' and 'pod-name' mux Vars.
+// VICE app. Needs the 'id' and 'pod-name' mux Vars. Requests for a host rather than an
+// analysis ID are handled by hostLogsResponse.
 //
 // Query Parameters:
 //   previous - Converted to a boolean, should be either true or false. Return previously
@@ -129,17 +131,20 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
 	}
 
-	externalIDs, err := i.getExternalIDs(user, id)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	// Hosts share this route with analysis IDs, which are UUIDs.
+	if !uuidPattern.MatchString(id) {
+		return i.hostLogsResponse(c, id, user)
 	}
 
-	if len(externalIDs) < 1 {
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("no external-ids found for analysis-id %s", id))
+	// Users the analysis has been shared with can read its logs too.
+	if _, err = i.checkAnalysisAccess(c.Request().Context(), user, id, permissions.LevelRead); err != nil {
+		return err
 	}
 
-	//Just use the first external-id for now.
-	externalID := externalIDs[0]
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
 
 	logOpts = &apiv1.PodLogOptions{}
 
@@ -247,9 +252,9 @@ type retPod struct {
 }
 
 func (i *Internal) getPods(externalID string) ([]retPod, error) {
-	set := labels.Set(map[string]string{
+	set := labels.Set(i.labelKeys.selector(map[string]string{
 		"external-id": externalID,
-	})
+	}))
 
 	listoptions := metav1.ListOptions{
 		LabelSelector: set.AsSelector().String(),
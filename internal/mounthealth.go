@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// mountHealthTimeout is how long a mount probe is allowed to take before the
+// mount is considered unresponsive. A wedged FUSE mount will usually block a
+// stat forever rather than return an error.
+const mountHealthTimeout = 10 * time.Second
+
+// PodExecutor runs commands inside of a container in a running pod. Commands
+// are abandoned once the context is done.
+type PodExecutor interface {
+	Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error)
+}
+
+// SPDYExecutor is a PodExecutor that uses the exec subresource of the k8s API.
+type SPDYExecutor struct {
+	config    *rest.Config
+	clientset kubernetes.Interface
+}
+
+// NewSPDYExecutor returns a new *SPDYExecutor.
+func NewSPDYExecutor(config *rest.Config, clientset kubernetes.Interface) *SPDYExecutor {
+	return &SPDYExecutor{
+		config:    config,
+		clientset: clientset,
+	}
+}
+
+// closingUpgrader is a spdy.Upgrader that closes the connections it creates
+// once the context is done. Closing the connection is the only way to end a
+// stream that's blocked on a command that never finishes.
+type closingUpgrader struct {
+	spdy.Upgrader
+	ctx context.Context
+}
+
+// NewConnection creates the connection, closing it when the context is done.
+func (u *closingUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.Upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-u.ctx.Done():
+			conn.Close()
+		case <-conn.CloseChan():
+		}
+	}()
+
+	return conn, nil
+}
+
+// Exec runs the command in the container and returns its stdout and stderr.
+// The connection is closed if the context is done before the command
+// finishes.
+func (s *SPDYExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	req := s.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&apiv1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	transport, upgrader, err := spdy.RoundTripperFor(s.config)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error setting up exec for pod %s", pod)
+	}
+
+	exec, err := remotecommand.NewSPDYExecutorForTransports(transport, &closingUpgrader{Upgrader: upgrader, ctx: ctx}, http.MethodPost, req.URL())
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error setting up exec for pod %s", pod)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+
+	if ctx.Err() != nil {
+		return stdout.String(), stderr.String(), ctx.Err()
+	}
+	return stdout.String(), stderr.String(), err
+}
+
+// execWithTimeout runs the command in the container using the PodExecutor,
+// giving up if it doesn't finish before the timeout. The command is abandoned
+// when the timeout is reached, so that a hung mount doesn't hang the caller
+// along with it.
+func (i *Internal) execWithTimeout(namespace, pod, container string, command []string, timeout time.Duration) (string, string, error) {
+	return i.execWithContext(context.Background(), namespace, pod, container, command, timeout)
+}
+
+// execWithContext is execWithTimeout, but the command is also abandoned if the
+// context is done first.
+func (i *Internal) execWithContext(parent context.Context, namespace, pod, container string, command []string, timeout time.Duration) (string, string, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	stdout, stderr, err := i.podExecutor.Exec(ctx, namespace, pod, container, command)
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", "", fmt.Errorf("%s did not finish within %s", strings.Join(command, " "), timeout)
+	}
+	return stdout, stderr, err
+}
+
+// SetPodExecutor sets the PodExecutor used to probe the data mounts inside of
+// running analyses. Mount health isn't checked if it's never set.
+func (i *Internal) SetPodExecutor(executor PodExecutor) {
+	i.podExecutor = executor
+}
+
+// MountHealth describes whether the iRODS CSI data mount inside of an analysis
+// pod is responding.
+type MountHealth struct {
+	Pod       string `json:"pod"`
+	Healthy   bool   `json:"healthy"`
+	Message   string `json:"message"`
+	CheckedAt string `json:"checkedAt"`
+}
+
+// mountProbeCommand returns the command run inside of the analysis container
+// to check the data mount. Listing the output directory forces a round trip
+// through irodsfuse without reading any file contents.
+func mountProbeCommand() []string {
+	return []string{"ls", "-d", path.Join(csiDriverLocalMountPath, csiDriverOutputVolumeMountPath)}
+}
+
+// mountHealth probes the data mount in the analysis container of the pod. A
+// nil value is returned if the analysis doesn't use the CSI driver or no
+// PodExecutor is available.
+func (i *Internal) mountHealth(namespace, pod string, phase apiv1.PodPhase) *MountHealth {
+	if !i.UseCSIDriver || i.podExecutor == nil {
+		return nil
+	}
+
+	health := &MountHealth{
+		Pod:       pod,
+		CheckedAt: time.Now().Format(time.RFC3339),
+	}
+
+	if phase != apiv1.PodRunning {
+		health.Message = fmt.Sprintf("pod is %s, the mount can't be checked", phase)
+		return health
+	}
+
+	_, stderr, err := i.execWithTimeout(namespace, pod, analysisContainerName, mountProbeCommand(), mountHealthTimeout)
+	if err != nil {
+		health.Message = fmt.Sprintf("the data mount returned an error: %s %s", err.Error(), stderr)
+		return health
+	}
+
+	health.Healthy = true
+	health.Message = "the data mount is responding"
+
+	return health
+}
+
+// addMountHealth fills in the mount health for each of the pods in the listing.
+func (i *Internal) addMountHealth(listing *ResourceInfo) {
+	for idx := range listing.Pods {
+		pod := &listing.Pods[idx]
+		pod.MountHealth = i.mountHealth(pod.Namespace, pod.Name, apiv1.PodPhase(pod.Phase))
+	}
+}
+
+func (i *Internal) mountHealthResponse(c echo.Context, externalID string) error {
+	if !i.UseCSIDriver {
+		return echo.NewHTTPError(http.StatusBadRequest, "analyses are not using the CSI driver for data access")
+	}
+
+	if i.podExecutor == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "mount health checks are not enabled")
+	}
+
+	podList, err := i.podList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return err
+	}
+
+	checks := []MountHealth{}
+	for _, pod := range podList.Items {
+		if health := i.mountHealth(pod.Namespace, pod.Name, pod.Status.Phase); health != nil {
+			checks = append(checks, *health)
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string][]MountHealth{
+		"mounts": checks,
+	})
+}
+
+// MountHealthHandler reports whether the data mounts inside of the pods for
+// the analysis are responding.
+func (i *Internal) MountHealthHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if len(externalIDs) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
+	}
+
+	return i.mountHealthResponse(c, externalIDs[0])
+}
+
+// AdminMountHealthHandler reports whether the data mounts inside of the pods
+// for the analysis are responding without requiring user information.
+func (i *Internal) AdminMountHealthHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	return i.mountHealthResponse(c, externalID)
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// stubExecutor is a PodExecutor that returns canned results.
+type stubExecutor struct {
+	err      error
+	commands [][]string
+}
+
+func (s *stubExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	s.commands = append(s.commands, command)
+	return "", "", s.err
+}
+
+func TestMountHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+
+	// Nothing is reported when the CSI driver isn't in use.
+	internal.SetPodExecutor(&stubExecutor{})
+	assert.Nil(internal.mountHealth("vice-apps", "pod", apiv1.PodRunning))
+
+	internal.UseCSIDriver = true
+
+	executor := &stubExecutor{}
+	internal.SetPodExecutor(executor)
+	health := internal.mountHealth("vice-apps", "pod", apiv1.PodRunning)
+	assert.True(health.Healthy)
+	assert.Equal([][]string{{"ls", "-d", "/data/output"}}, executor.commands)
+
+	// Pods that aren't running don't get probed.
+	health = internal.mountHealth("vice-apps", "pod", apiv1.PodPending)
+	assert.False(health.Healthy)
+	assert.Len(executor.commands, 1)
+
+	internal.SetPodExecutor(&stubExecutor{err: errors.New("transport endpoint is not connected")})
+	health = internal.mountHealth("vice-apps", "pod", apiv1.PodRunning)
+	assert.False(health.Healthy)
+	assert.Contains(health.Message, "transport endpoint is not connected")
+}
+
+func TestExecWithTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	executor := &blockingExecutor{release: make(chan struct{})}
+	internal.SetPodExecutor(executor)
+
+	// The command is abandoned once it's taken too long, rather than left
+	// running in the background.
+	_, _, err := internal.execWithTimeout("vice-apps", "pod", analysisContainerName, []string{"sync"}, time.Millisecond)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "sync did not finish within 1ms")
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&executor.abandoned))
+}
@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// managedQuotaName is the name of the ResourceQuota and LimitRange that
+// app-exposer manages in the VICE namespace.
+const managedQuotaName = "vice-analyses"
+
+// managedByLabels mark the objects app-exposer manages.
+var managedByLabels = map[string]string{"app.kubernetes.io/managed-by": "app-exposer"}
+
+// LimitRangeConfig contains the per-container defaults and bounds of the
+// managed LimitRange, keyed by resource name.
+type LimitRangeConfig struct {
+	Default        map[string]string `mapstructure:"default"`
+	DefaultRequest map[string]string `mapstructure:"default_request"`
+	Min            map[string]string `mapstructure:"min"`
+	Max            map[string]string `mapstructure:"max"`
+}
+
+// empty returns true if the LimitRange wouldn't contain anything.
+func (l *LimitRangeConfig) empty() bool {
+	return len(l.Default) == 0 && len(l.DefaultRequest) == 0 && len(l.Min) == 0 && len(l.Max) == 0
+}
+
+// NamespaceQuotaConfig contains the ResourceQuota and LimitRange app-exposer
+// maintains in the VICE namespace. ResourceQuota holds the hard limits, keyed
+// by the quota's resource names, such as requests.cpu or pods.
+type NamespaceQuotaConfig struct {
+	ResourceQuota map[string]string `mapstructure:"resource_quota"`
+	LimitRange    LimitRangeConfig  `mapstructure:"limit_range"`
+}
+
+// resourceList parses the quantities, keyed by resource name.
+func resourceList(quantities map[string]string) (apiv1.ResourceList, error) {
+	list := apiv1.ResourceList{}
+	for name, value := range quantities {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s has an invalid quantity %q", name, value)
+		}
+		list[apiv1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
+
+// ValidateNamespaceQuotas returns an error if any of the quantities can't be
+// parsed.
+func ValidateNamespaceQuotas(cfg *NamespaceQuotaConfig) error {
+	problems := []string{}
+
+	sections := map[string]map[string]string{
+		"resource_quota":              cfg.ResourceQuota,
+		"limit_range.default":         cfg.LimitRange.Default,
+		"limit_range.default_request": cfg.LimitRange.DefaultRequest,
+		"limit_range.min":             cfg.LimitRange.Min,
+		"limit_range.max":             cfg.LimitRange.Max,
+	}
+	for section, quantities := range sections {
+		if _, err := resourceList(quantities); err != nil {
+			problems = append(problems, fmt.Sprintf("namespace quota %s: %s", section, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// managedResourceQuota returns the ResourceQuota described by the config.
+func (i *Internal) managedResourceQuota() (*apiv1.ResourceQuota, error) {
+	hard, err := resourceList(i.NamespaceQuotas.ResourceQuota)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedQuotaName,
+			Namespace: i.ViceNamespace,
+			Labels:    managedByLabels,
+		},
+		Spec: apiv1.ResourceQuotaSpec{Hard: hard},
+	}, nil
+}
+
+// managedLimitRange returns the LimitRange described by the config.
+func (i *Internal) managedLimitRange() (*apiv1.LimitRange, error) {
+	cfg := &i.NamespaceQuotas.LimitRange
+	item := apiv1.LimitRangeItem{Type: apiv1.LimitTypeContainer}
+
+	var err error
+	if item.Default, err = resourceList(cfg.Default); err != nil {
+		return nil, err
+	}
+	if item.DefaultRequest, err = resourceList(cfg.DefaultRequest); err != nil {
+		return nil, err
+	}
+	if item.Min, err = resourceList(cfg.Min); err != nil {
+		return nil, err
+	}
+	if item.Max, err = resourceList(cfg.Max); err != nil {
+		return nil, err
+	}
+
+	return &apiv1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      managedQuotaName,
+			Namespace: i.ViceNamespace,
+			Labels:    managedByLabels,
+		},
+		Spec: apiv1.LimitRangeSpec{Limits: []apiv1.LimitRangeItem{item}},
+	}, nil
+}
+
+// applyResourceQuota creates or updates the managed ResourceQuota, or deletes
+// it if no hard limits are configured.
+func (i *Internal) applyResourceQuota() error {
+	client := i.clientset.CoreV1().ResourceQuotas(i.ViceNamespace)
+
+	existing, err := client.Get(managedQuotaName, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrap(err, "error looking up the managed resource quota")
+	}
+	found := err == nil
+
+	if len(i.NamespaceQuotas.ResourceQuota) == 0 {
+		if found {
+			if err = client.Delete(managedQuotaName, &metav1.DeleteOptions{}); err != nil {
+				return errors.Wrap(err, "error deleting the managed resource quota")
+			}
+		}
+		return nil
+	}
+
+	quota, err := i.managedResourceQuota()
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		_, err = client.Create(quota)
+		return errors.Wrap(err, "error creating the managed resource quota")
+	}
+
+	existing.Labels = quota.Labels
+	existing.Spec = quota.Spec
+	_, err = client.Update(existing)
+	return errors.Wrap(err, "error updating the managed resource quota")
+}
+
+// applyLimitRange creates or updates the managed LimitRange, or deletes it if
+// no limits are configured.
+func (i *Internal) applyLimitRange() error {
+	client := i.clientset.CoreV1().LimitRanges(i.ViceNamespace)
+
+	existing, err := client.Get(managedQuotaName, metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrap(err, "error looking up the managed limit range")
+	}
+	found := err == nil
+
+	if i.NamespaceQuotas.LimitRange.empty() {
+		if found {
+			if err = client.Delete(managedQuotaName, &metav1.DeleteOptions{}); err != nil {
+				return errors.Wrap(err, "error deleting the managed limit range")
+			}
+		}
+		return nil
+	}
+
+	limitRange, err := i.managedLimitRange()
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		_, err = client.Create(limitRange)
+		return errors.Wrap(err, "error creating the managed limit range")
+	}
+
+	existing.Labels = limitRange.Labels
+	existing.Spec = limitRange.Spec
+	_, err = client.Update(existing)
+	return errors.Wrap(err, "error updating the managed limit range")
+}
+
+// NamespaceQuotas contains the managed ResourceQuota, with its current usage,
+// and LimitRange. Either is nil if it doesn't exist.
+type NamespaceQuotas struct {
+	ResourceQuota *apiv1.ResourceQuota `json:"resourceQuota"`
+	LimitRange    *apiv1.LimitRange    `json:"limitRange"`
+}
+
+// namespaceQuotas returns the managed ResourceQuota and LimitRange.
+func (i *Internal) namespaceQuotas() (*NamespaceQuotas, error) {
+	quotas := &NamespaceQuotas{}
+
+	quota, err := i.clientset.CoreV1().ResourceQuotas(i.ViceNamespace).Get(managedQuotaName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		quotas.ResourceQuota = quota
+	case !k8serrors.IsNotFound(err):
+		return nil, errors.Wrap(err, "error looking up the managed resource quota")
+	}
+
+	limitRange, err := i.clientset.CoreV1().LimitRanges(i.ViceNamespace).Get(managedQuotaName, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		quotas.LimitRange = limitRange
+	case !k8serrors.IsNotFound(err):
+		return nil, errors.Wrap(err, "error looking up the managed limit range")
+	}
+
+	return quotas, nil
+}
+
+// AdminNamespaceQuotasHandler returns the ResourceQuota and LimitRange that
+// app-exposer manages in the VICE namespace.
+func (i *Internal) AdminNamespaceQuotasHandler(c echo.Context) error {
+	quotas, err := i.namespaceQuotas()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, quotas)
+}
+
+// AdminApplyNamespaceQuotasHandler creates or updates the ResourceQuota and
+// LimitRange in the VICE namespace from the configuration, deleting the ones
+// that aren't configured, and returns them.
+func (i *Internal) AdminApplyNamespaceQuotasHandler(c echo.Context) error {
+	if err := i.applyResourceQuota(); err != nil {
+		return err
+	}
+
+	if err := i.applyLimitRange(); err != nil {
+		return err
+	}
+
+	return i.AdminNamespaceQuotasHandler(c)
+}
+
+// exceededQuotaRegexp picks the resources out of the message of an admission
+// error for a request that would exceed a ResourceQuota, such as
+// "exceeded quota: vice-analyses, requested: requests.cpu=2,requests.memory=4Gi, used: ...".
+var exceededQuotaRegexp = regexp.MustCompile(`exceeded quota: [^,]+, requested: ([^ ]+),`)
+
+// launchFailureMessage describes why creating the resources for an analysis
+// failed. Rejections by the namespace's ResourceQuota or LimitRange are
+// explained in terms users can act on; other errors are passed through.
+func launchFailureMessage(err error) string {
+	if !k8serrors.IsForbidden(err) {
+		return err.Error()
+	}
+
+	msg := err.Error()
+
+	if match := exceededQuotaRegexp.FindStringSubmatch(msg); match != nil {
+		resources := []string{}
+		for _, requested := range strings.Split(match[1], ",") {
+			resources = append(resources, strings.SplitN(requested, "=", 2)[0])
+		}
+		return fmt.Sprintf(
+			"the VICE cluster has reached its limit on %s, so the analysis can't start until other analyses finish",
+			strings.Join(resources, ", "),
+		)
+	}
+
+	if strings.Contains(msg, "usage per Container") || strings.Contains(msg, "usage per Pod") {
+		return fmt.Sprintf("the analysis asks for resources outside the bounds allowed in the VICE cluster: %s", msg)
+	}
+
+	return msg
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestValidateNamespaceQuotas(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateNamespaceQuotas(&NamespaceQuotaConfig{}))
+	assert.NoError(ValidateNamespaceQuotas(&NamespaceQuotaConfig{
+		ResourceQuota: map[string]string{"requests.cpu": "200", "pods": "100"},
+		LimitRange:    LimitRangeConfig{Max: map[string]string{"memory": "64Gi"}},
+	}))
+
+	err := ValidateNamespaceQuotas(&NamespaceQuotaConfig{
+		ResourceQuota: map[string]string{"requests.cpu": "lots"},
+		LimitRange:    LimitRangeConfig{Min: map[string]string{"cpu": "tiny"}},
+	})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "resource_quota")
+		assert.Contains(err.Error(), "limit_range.min")
+	}
+}
+
+func TestApplyNamespaceQuotas(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{})
+	quotas := i.clientset.CoreV1().ResourceQuotas("vice-apps")
+	limitRanges := i.clientset.CoreV1().LimitRanges("vice-apps")
+
+	i.NamespaceQuotas = NamespaceQuotaConfig{
+		ResourceQuota: map[string]string{"requests.cpu": "200"},
+		LimitRange:    LimitRangeConfig{DefaultRequest: map[string]string{"cpu": "500m"}},
+	}
+	assert.NoError(i.applyResourceQuota())
+	assert.NoError(i.applyLimitRange())
+
+	quota, err := quotas.Get(managedQuotaName, metav1.GetOptions{})
+	if assert.NoError(err) {
+		hard := quota.Spec.Hard[apiv1.ResourceName("requests.cpu")]
+		assert.Equal(resource.MustParse("200"), hard)
+		assert.Equal("app-exposer", quota.Labels["app.kubernetes.io/managed-by"])
+	}
+
+	limitRange, err := limitRanges.Get(managedQuotaName, metav1.GetOptions{})
+	if assert.NoError(err) && assert.Len(limitRange.Spec.Limits, 1) {
+		assert.Equal(apiv1.LimitTypeContainer, limitRange.Spec.Limits[0].Type)
+		assert.Equal(resource.MustParse("500m"), limitRange.Spec.Limits[0].DefaultRequest[apiv1.ResourceCPU])
+	}
+
+	// Changing the config updates the existing objects.
+	i.NamespaceQuotas.ResourceQuota["requests.cpu"] = "300"
+	assert.NoError(i.applyResourceQuota())
+	quota, err = quotas.Get(managedQuotaName, metav1.GetOptions{})
+	if assert.NoError(err) {
+		assert.Equal(resource.MustParse("300"), quota.Spec.Hard[apiv1.ResourceName("requests.cpu")])
+	}
+
+	// Removing a section from the config deletes its object.
+	i.NamespaceQuotas = NamespaceQuotaConfig{}
+	assert.NoError(i.applyResourceQuota())
+	assert.NoError(i.applyLimitRange())
+
+	current, err := i.namespaceQuotas()
+	assert.NoError(err)
+	assert.Nil(current.ResourceQuota)
+	assert.Nil(current.LimitRange)
+}
+
+func TestLaunchFailureMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	pvcs := schema.GroupResource{Resource: "persistentvolumeclaims"}
+
+	quotaErr := k8serrors.NewForbidden(pvcs, "e1-data", fmt.Errorf(
+		"exceeded quota: vice-analyses, requested: requests.storage=10Gi,persistentvolumeclaims=1, used: requests.storage=995Gi,persistentvolumeclaims=40, limited: requests.storage=1000Gi,persistentvolumeclaims=50",
+	))
+	msg := launchFailureMessage(quotaErr)
+	assert.Contains(msg, "limit on requests.storage, persistentvolumeclaims")
+	assert.NotContains(msg, "995Gi")
+
+	limitErr := k8serrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "e1", fmt.Errorf("maximum cpu usage per Container is 16, but limit is 32"))
+	assert.Contains(launchFailureMessage(limitErr), "outside the bounds allowed")
+
+	other := fmt.Errorf("connection refused")
+	assert.Equal("connection refused", launchFailureMessage(other))
+}
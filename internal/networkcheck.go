@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// NetworkCheck is the result of checking a single hop on the path from the
+// Ingress to the analysis pod.
+type NetworkCheck struct {
+	Hop     string `json:"hop"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// NetworkCheckResult contains the results of tracing the path from the
+// Ingress to the analysis pod. BrokenHop is the first hop that failed, if any.
+type NetworkCheckResult struct {
+	AnalysisID string         `json:"analysisID"`
+	ExternalID string         `json:"externalID"`
+	Healthy    bool           `json:"healthy"`
+	BrokenHop  string         `json:"brokenHop,omitempty"`
+	Checks     []NetworkCheck `json:"checks"`
+}
+
+func (r *NetworkCheckResult) add(hop string, ok bool, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, NetworkCheck{
+		Hop:     hop,
+		OK:      ok,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if !ok && r.BrokenHop == "" {
+		r.BrokenHop = hop
+	}
+}
+
+// podHasPort returns true if one of the containers in the pod exposes the
+// target port of the service port.
+func podHasPort(pod *apiv1.Pod, svcPort apiv1.ServicePort) bool {
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if svcPort.TargetPort.Type == intstr.String {
+				if port.Name == svcPort.TargetPort.StrVal {
+					return true
+				}
+			} else if port.ContainerPort == svcPort.TargetPort.IntVal {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// podReadiness returns whether the pod is ready and, if it isn't, why.
+func podReadiness(pod *apiv1.Pod) (bool, string) {
+	conditions := map[apiv1.PodConditionType]apiv1.PodCondition{}
+	for _, condition := range pod.Status.Conditions {
+		conditions[condition.Type] = condition
+	}
+
+	for _, gate := range pod.Spec.ReadinessGates {
+		condition, ok := conditions[gate.ConditionType]
+		if !ok || condition.Status != apiv1.ConditionTrue {
+			return false, fmt.Sprintf("readiness gate %s is not satisfied", gate.ConditionType)
+		}
+	}
+
+	ready, ok := conditions[apiv1.PodReady]
+	if !ok || ready.Status != apiv1.ConditionTrue {
+		if ok && ready.Message != "" {
+			return false, ready.Message
+		}
+		return false, fmt.Sprintf("pod is %s and not ready", pod.Status.Phase)
+	}
+
+	return true, ""
+}
+
+// checkNetwork traces the path from the Ingress for the analysis to its pods,
+// stopping at the first hop that can't be followed any farther.
+func (i *Internal) checkNetwork(analysisID, externalID string) (*NetworkCheckResult, error) {
+	result := &NetworkCheckResult{
+		AnalysisID: analysisID,
+		ExternalID: externalID,
+		Checks:     []NetworkCheck{},
+	}
+
+	listoptions := metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID})).AsSelector().String(),
+	}
+
+	// Analyses served through tunnels connect out to the gateway from the pod,
+	// so the tunnel is the only hop to check.
+	if i.tunnelEnabled() {
+		tunnel, err := i.getTunnel(externalID)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case tunnel == nil:
+			result.add("tunnel", false, "no tunnel has been registered for external-id %s", externalID)
+		case !tunnel.Connected:
+			result.add("tunnel", false, "tunnel for %s was last seen at %s", externalID, tunnel.LastSeen)
+		default:
+			result.add("tunnel", true, "tunnel for %s is connected to %s", externalID, tunnel.Endpoint)
+		}
+		return result, nil
+	}
+
+	// Ingress -> Service
+	ingresses, err := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace).List(listoptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(ingresses.Items) == 0 {
+		result.add("ingress", false, "no ingress found for external-id %s", externalID)
+		return result, nil
+	}
+
+	ingress := ingresses.Items[0]
+	var (
+		svcName string
+		svcPort int
+	)
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if p.Path == "" || p.Path == "/" {
+				svcName = p.Backend.ServiceName
+				svcPort = p.Backend.ServicePort.IntValue()
+			}
+		}
+	}
+	if svcName == "" {
+		result.add("ingress", false, "ingress %s has no rule routing to a service", ingress.Name)
+		return result, nil
+	}
+	result.add("ingress", true, "ingress %s routes to %s:%d", ingress.Name, svcName, svcPort)
+
+	// Service -> port
+	svc, err := i.clientset.CoreV1().Services(i.ViceNamespace).Get(svcName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		result.add("service", false, "service %s referenced by ingress %s does not exist", svcName, ingress.Name)
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var targetPort *apiv1.ServicePort
+	for idx := range svc.Spec.Ports {
+		if int(svc.Spec.Ports[idx].Port) == svcPort {
+			targetPort = &svc.Spec.Ports[idx]
+		}
+	}
+	if targetPort == nil {
+		result.add("service", false, "service %s does not expose port %d", svc.Name, svcPort)
+		return result, nil
+	}
+	result.add("service", true, "service %s port %d targets %s", svc.Name, svcPort, targetPort.TargetPort.String())
+
+	// Service selector -> pods
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: labels.Set(svc.Spec.Selector).AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(svc.Spec.Selector) == 0 || len(pods.Items) == 0 {
+		result.add("selector", false, "selector %s on service %s does not match any pods", labels.Set(svc.Spec.Selector).String(), svc.Name)
+		return result, nil
+	}
+	result.add("selector", true, "selector on service %s matches %d pod(s)", svc.Name, len(pods.Items))
+
+	// Pod -> target port
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		if !podHasPort(pod, *targetPort) {
+			result.add("target-port", false, "pod %s has no container port matching %s", pod.Name, targetPort.TargetPort.String())
+			return result, nil
+		}
+	}
+	result.add("target-port", true, "all matching pods expose %s", targetPort.TargetPort.String())
+
+	// Pod readiness
+	podsReady := true
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		if ready, reason := podReadiness(pod); !ready {
+			podsReady = false
+			result.add("pod", false, "pod %s: %s", pod.Name, reason)
+		}
+	}
+	if podsReady {
+		result.add("pod", true, "all matching pods are ready")
+	}
+
+	// Endpoints
+	endpoints, err := i.clientset.CoreV1().Endpoints(i.ViceNamespace).Get(svc.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		result.add("endpoints", false, "no endpoints exist for service %s", svc.Name)
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ready, notReady int
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
+		notReady += len(subset.NotReadyAddresses)
+	}
+	result.add("endpoints", ready > 0, "service %s has %d ready and %d not ready endpoint address(es)", svc.Name, ready, notReady)
+
+	result.Healthy = result.BrokenHop == ""
+
+	return result, nil
+}
+
+// AdminNetworkCheckHandler verifies the ingress -> service -> endpoints -> pod
+// wiring for an analysis and reports which hop is broken, if any.
+func (i *Internal) AdminNetworkCheckHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	result, err := i.checkNetwork(analysisID, externalID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// networkObjects returns the ingress, service, and pod for an analysis that's
+// wired up correctly.
+func networkObjects(externalID string) []runtime.Object {
+	ns := testConfig.ViceNamespace
+	labels := map[string]string{"app-type": "interactive", "external-id": externalID}
+
+	ingress := &extv1beta1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: ns, Name: externalID, Labels: labels},
+		Spec: extv1beta1.IngressSpec{
+			Rules: []extv1beta1.IngressRule{
+				{
+					Host: "a1234",
+					IngressRuleValue: extv1beta1.IngressRuleValue{
+						HTTP: &extv1beta1.HTTPIngressRuleValue{
+							Paths: []extv1beta1.HTTPIngressPath{
+								{
+									Backend: extv1beta1.IngressBackend{
+										ServiceName: "vice-" + externalID,
+										ServicePort: intstr.FromInt(int(viceProxyServicePort)),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	svc := &apiv1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: ns, Name: "vice-" + externalID, Labels: labels},
+		Spec: apiv1.ServiceSpec{
+			Selector: map[string]string{"external-id": externalID},
+			Ports: []apiv1.ServicePort{
+				{
+					Name:       viceProxyPortName,
+					Port:       viceProxyServicePort,
+					TargetPort: intstr.FromString(viceProxyPortName),
+				},
+			},
+		},
+	}
+
+	pod := runningPod(externalID)
+	pod.Spec.Containers = []apiv1.Container{
+		{
+			Name:  viceProxyContainerName,
+			Ports: []apiv1.ContainerPort{{Name: viceProxyPortName, ContainerPort: viceProxyPort}},
+		},
+	}
+	pod.Status.Conditions = []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionTrue}}
+
+	return []runtime.Object{ingress, svc, pod}
+}
+
+func TestCheckNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	endpoints := &apiv1.Endpoints{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: testConfig.ViceNamespace, Name: "vice-e1"},
+		Subsets: []apiv1.EndpointSubset{
+			{Addresses: []apiv1.EndpointAddress{{IP: "10.0.0.1"}}},
+		},
+	}
+
+	internal, _ := setupInternal(t, append(networkObjects("e1"), endpoints))
+
+	result, err := internal.checkNetwork("a1", "e1")
+	assert.NoError(err)
+	assert.True(result.Healthy)
+	assert.Equal("", result.BrokenHop)
+	assert.Len(result.Checks, 6)
+}
+
+func TestCheckNetworkMissingEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, networkObjects("e1"))
+
+	result, err := internal.checkNetwork("a1", "e1")
+	assert.NoError(err)
+	assert.False(result.Healthy)
+	assert.Equal("endpoints", result.BrokenHop)
+}
+
+func TestCheckNetworkMissingIngress(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+
+	result, err := internal.checkNetwork("a1", "e1")
+	assert.NoError(err)
+	assert.False(result.Healthy)
+	assert.Equal("ingress", result.BrokenHop)
+}
@@ -0,0 +1,444 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// networkGroupLabel is set on the NetworkPolicy and Services of a network
+// group to the group's ID.
+const networkGroupLabel = "network-group"
+
+// networkGroupIDLength is the number of hex digits in a network group ID.
+const networkGroupIDLength = 8
+
+// maxNetworkAliasLength leaves room for the network group ID in the name of
+// the alias Service, which has to be a DNS label.
+const maxNetworkAliasLength = maxSubdomainLength - networkGroupIDLength - 1
+
+// NetworkGroupMember is an analysis in a network group. The other analyses in
+// the group reach it at Hostname.
+type NetworkGroupMember struct {
+	Username   string    `json:"username" db:"username"`
+	GroupName  string    `json:"groupName" db:"group_name"`
+	ExternalID string    `json:"externalID" db:"external_id"`
+	Alias      string    `json:"alias" db:"alias"`
+	AddedAt    time.Time `json:"addedAt" db:"added_at"`
+	Hostname   string    `json:"hostname" db:"-"`
+}
+
+// NetworkGroupMemberRequest is the request body for adding an analysis to a
+// network group.
+type NetworkGroupMemberRequest struct {
+	Alias string `json:"alias"`
+}
+
+const networkGroupMemberColumns = `username, group_name, external_id, alias, added_at`
+
+const getNetworkGroupMemberSQL = `
+	SELECT ` + networkGroupMemberColumns + `
+	  FROM vice_network_group_members
+	 WHERE external_id = $1
+`
+
+const listNetworkGroupMembersSQL = `
+	SELECT ` + networkGroupMemberColumns + `
+	  FROM vice_network_group_members
+	 WHERE username = $1
+	   AND group_name = $2
+	 ORDER BY alias
+`
+
+const listUserNetworkGroupMembersSQL = `
+	SELECT ` + networkGroupMemberColumns + `
+	  FROM vice_network_group_members
+	 WHERE username = $1
+	 ORDER BY group_name, alias
+`
+
+const addNetworkGroupMemberSQL = `
+	INSERT INTO vice_network_group_members (username, group_name, external_id, alias, added_at)
+	VALUES ($1, $2, $3, $4, now())
+`
+
+const removeNetworkGroupMemberSQL = `
+	DELETE FROM vice_network_group_members
+	 WHERE external_id = $1
+`
+
+// networkGroupID returns the ID used to name the Kubernetes resources of the
+// user's network group.
+func networkGroupID(username, group string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", username, group)))
+	return fmt.Sprintf("%x", sum)[:networkGroupIDLength]
+}
+
+func networkGroupPolicyName(groupID string) string {
+	return fmt.Sprintf("vice-group-%s", groupID)
+}
+
+// networkAliasName returns the name of the Service the other analyses in the
+// group reach the member through.
+func networkAliasName(alias, groupID string) string {
+	return fmt.Sprintf("%s-%s", alias, groupID)
+}
+
+// validateNetworkGroupMember returns an error if the group name or alias
+// can't be used.
+func validateNetworkGroupMember(group, alias string) error {
+	if !subdomainPattern.MatchString(group) || len(group) > maxSubdomainLength {
+		return fmt.Errorf("network group %s must start with a lowercase letter and contain only lowercase letters, digits, and hyphens", group)
+	}
+	if !subdomainPattern.MatchString(alias) {
+		return fmt.Errorf("alias %s must start with a lowercase letter and contain only lowercase letters, digits, and hyphens", alias)
+	}
+	if len(alias) > maxNetworkAliasLength {
+		return fmt.Errorf("alias %s is longer than %d characters", alias, maxNetworkAliasLength)
+	}
+	return nil
+}
+
+// getNetworkGroupMember returns the membership of the analysis, or nil if it
+// isn't in a network group.
+func (i *Internal) getNetworkGroupMember(externalID string) (*NetworkGroupMember, error) {
+	member := &NetworkGroupMember{}
+	err := i.db.QueryRowx(getNetworkGroupMemberSQL, externalID).StructScan(member)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the network group of analysis %s", externalID)
+	}
+	member.Hostname = networkAliasName(member.Alias, networkGroupID(member.Username, member.GroupName))
+	return member, nil
+}
+
+// networkGroupMembers returns the analyses in the user's network group.
+func (i *Internal) networkGroupMembers(username, group string) ([]NetworkGroupMember, error) {
+	members := []NetworkGroupMember{}
+	if err := i.db.Select(&members, listNetworkGroupMembersSQL, username, group); err != nil {
+		return nil, errors.Wrapf(err, "error listing the members of network group %s of %s", group, username)
+	}
+
+	groupID := networkGroupID(username, group)
+	for idx := range members {
+		members[idx].Hostname = networkAliasName(members[idx].Alias, groupID)
+	}
+
+	return members, nil
+}
+
+// getNetworkGroupPolicy returns the NetworkPolicy that lets the members of the
+// group reach each other on any port. It's added to the policies of the
+// members, which still keep everyone else out. It does not call the k8s API.
+func (i *Internal) getNetworkGroupPolicy(groupID string, members []NetworkGroupMember) *netv1.NetworkPolicy {
+	externalIDs := []string{}
+	for _, member := range members {
+		externalIDs = append(externalIDs, member.ExternalID)
+	}
+
+	selector := metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      i.labelKeys.selectorKey("external-id"),
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   externalIDs,
+			},
+		},
+	}
+
+	return &netv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        networkGroupPolicyName(groupID),
+			Labels:      map[string]string{networkGroupLabel: groupID},
+			Annotations: i.defaultAnnotations(),
+		},
+		Spec: netv1.NetworkPolicySpec{
+			PodSelector: selector,
+			PolicyTypes: []netv1.PolicyType{
+				netv1.PolicyTypeIngress,
+				netv1.PolicyTypeEgress,
+			},
+			Ingress: []netv1.NetworkPolicyIngressRule{
+				{From: []netv1.NetworkPolicyPeer{{PodSelector: selector.DeepCopy()}}},
+			},
+			Egress: []netv1.NetworkPolicyEgressRule{
+				{To: []netv1.NetworkPolicyPeer{{PodSelector: selector.DeepCopy()}}},
+			},
+		},
+	}
+}
+
+// syncNetworkGroup brings the NetworkPolicy of the user's network group in
+// line with its members, deleting it once the group is empty. The policy is
+// only needed if network policies are enabled, since the analyses can reach
+// each other anyway otherwise.
+func (i *Internal) syncNetworkGroup(username, group string) error {
+	if !i.NetworkPolicyEnabled {
+		return nil
+	}
+
+	members, err := i.networkGroupMembers(username, group)
+	if err != nil {
+		return err
+	}
+
+	groupID := networkGroupID(username, group)
+	npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+
+	if len(members) == 0 {
+		err = npclient.Delete(networkGroupPolicyName(groupID), &metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting the network policy of network group %s", group)
+		}
+		return nil
+	}
+
+	policy := i.getNetworkGroupPolicy(groupID, members)
+	if _, err = npclient.Get(policy.Name, metav1.GetOptions{}); err != nil {
+		_, err = npclient.Create(policy)
+	} else {
+		_, err = npclient.Update(policy)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error updating the network policy of network group %s", group)
+	}
+
+	return nil
+}
+
+// getNetworkAliasService returns the Service the other analyses in the group
+// reach the member through, with the ports of the analysis container. It's
+// labeled with the external ID of the member so that it goes away with the
+// analysis. It does not call the k8s API.
+func (i *Internal) getNetworkAliasService(member *NetworkGroupMember) (*apiv1.Service, error) {
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{"external-id": member.ExternalID}, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if len(deplist.Items) == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s is not running", member.ExternalID))
+	}
+	dep := deplist.Items[0]
+
+	ports := []apiv1.ServicePort{}
+	for _, container := range dep.Spec.Template.Spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+		for _, port := range container.Ports {
+			ports = append(ports, apiv1.ServicePort{
+				Name:       port.Name,
+				Protocol:   port.Protocol,
+				Port:       port.ContainerPort,
+				TargetPort: intstr.FromInt(int(port.ContainerPort)),
+			})
+		}
+	}
+	if len(ports) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("analysis %s has no ports for the network group to use", member.ExternalID))
+	}
+
+	groupID := networkGroupID(member.Username, member.GroupName)
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: networkAliasName(member.Alias, groupID),
+			Labels: i.labelKeys.labels(map[string]string{
+				"app-type":        "interactive",
+				"external-id":     member.ExternalID,
+				"user-id":         i.labelKeys.get(dep.Labels, "user-id"),
+				networkGroupLabel: groupID,
+			}),
+			Annotations: i.defaultAnnotations(),
+		},
+		Spec: apiv1.ServiceSpec{
+			Selector: i.labelKeys.selector(map[string]string{"external-id": member.ExternalID}),
+			Ports:    ports,
+		},
+	}, nil
+}
+
+// joinNetworkGroup adds the analysis to the user's network group under the
+// alias. An analysis can only be in one group at a time.
+func (i *Internal) joinNetworkGroup(username, group, externalID, alias string) (*NetworkGroupMember, error) {
+	if err := validateNetworkGroupMember(group, alias); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	existing, err := i.getNetworkGroupMember(externalID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("analysis %s is already in network group %s", externalID, existing.GroupName))
+	}
+
+	members, err := i.networkGroupMembers(username, group)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		if member.Alias == alias {
+			return nil, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("alias %s is already used in network group %s", alias, group))
+		}
+	}
+
+	member := &NetworkGroupMember{
+		Username:   username,
+		GroupName:  group,
+		ExternalID: externalID,
+		Alias:      alias,
+		AddedAt:    time.Now(),
+		Hostname:   networkAliasName(alias, networkGroupID(username, group)),
+	}
+
+	svc, err := i.getNetworkAliasService(member)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = i.db.Exec(addNetworkGroupMemberSQL, username, group, externalID, alias); err != nil {
+		return nil, errors.Wrapf(err, "error adding analysis %s to network group %s", externalID, group)
+	}
+
+	if _, err = i.clientset.CoreV1().Services(i.ViceNamespace).Create(svc); err != nil {
+		i.rollBackNetworkGroupJoin(member, false)
+		return nil, errors.Wrapf(err, "error creating the alias %s for analysis %s", alias, externalID)
+	}
+
+	if err = i.syncNetworkGroup(username, group); err != nil {
+		i.rollBackNetworkGroupJoin(member, true)
+		return nil, err
+	}
+
+	return member, nil
+}
+
+// rollBackNetworkGroupJoin undoes a join that failed part way through: the
+// alias Service is deleted if it was created, the membership is removed, and
+// the group's NetworkPolicy is brought back in line with the remaining
+// members, which deletes it if the join created the group. Failures are
+// logged, since the caller is already returning the error that caused the
+// rollback.
+func (i *Internal) rollBackNetworkGroupJoin(member *NetworkGroupMember, serviceCreated bool) {
+	if serviceCreated {
+		err := i.clientset.CoreV1().Services(i.ViceNamespace).Delete(member.Hostname, &metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			log.Error(errors.Wrapf(err, "error deleting the alias %s for analysis %s", member.Alias, member.ExternalID))
+		}
+	}
+
+	if _, err := i.db.Exec(removeNetworkGroupMemberSQL, member.ExternalID); err != nil {
+		log.Error(errors.Wrapf(err, "error removing analysis %s from network group %s", member.ExternalID, member.GroupName))
+		return
+	}
+
+	if err := i.syncNetworkGroup(member.Username, member.GroupName); err != nil {
+		log.Error(err)
+	}
+}
+
+// leaveNetworkGroup removes the analysis from its network group, if it's in
+// one.
+func (i *Internal) leaveNetworkGroup(externalID string) error {
+	member, err := i.getNetworkGroupMember(externalID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return nil
+	}
+
+	if _, err = i.db.Exec(removeNetworkGroupMemberSQL, externalID); err != nil {
+		return errors.Wrapf(err, "error removing analysis %s from network group %s", externalID, member.GroupName)
+	}
+
+	err = i.clientset.CoreV1().Services(i.ViceNamespace).Delete(member.Hostname, &metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting the alias %s for analysis %s", member.Alias, externalID)
+	}
+
+	return i.syncNetworkGroup(member.Username, member.GroupName)
+}
+
+// ListNetworkGroupsHandler lists the network groups of the user in the 'user'
+// query parameter, keyed by group name.
+func (i *Internal) ListNetworkGroupsHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	username := i.fixUsername(user)
+	members := []NetworkGroupMember{}
+	if err := i.db.Select(&members, listUserNetworkGroupMembersSQL, username); err != nil {
+		return errors.Wrapf(err, "error listing the network groups of %s", username)
+	}
+
+	groups := map[string][]NetworkGroupMember{}
+	for _, member := range members {
+		member.Hostname = networkAliasName(member.Alias, networkGroupID(member.Username, member.GroupName))
+		groups[member.GroupName] = append(groups[member.GroupName], member)
+	}
+
+	return c.JSON(http.StatusOK, map[string]map[string][]NetworkGroupMember{
+		"groups": groups,
+	})
+}
+
+// JoinNetworkGroupHandler adds an analysis owned by the user in the 'user'
+// query parameter to the user's network group in the URL, under the alias in
+// the body of the request. The group is created if it doesn't exist.
+func (i *Internal) JoinNetworkGroupHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelOwn)
+	if err != nil {
+		return err
+	}
+
+	request := &NetworkGroupMemberRequest{}
+	if err = c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	member, err := i.joinNetworkGroup(i.fixUsername(c.QueryParam("user")), c.Param("group"), externalID, request.Alias)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, member)
+}
+
+// LeaveNetworkGroupHandler removes an analysis owned by the user in the
+// 'user' query parameter from the network group in the URL.
+func (i *Internal) LeaveNetworkGroupHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelOwn)
+	if err != nil {
+		return err
+	}
+
+	member, err := i.getNetworkGroupMember(externalID)
+	if err != nil {
+		return err
+	}
+	if member == nil || member.GroupName != c.Param("group") {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s is not in network group %s", externalID, c.Param("group")))
+	}
+
+	if err = i.leaveNetworkGroup(externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
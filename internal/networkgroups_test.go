@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var networkGroupMemberRows = []string{"username", "group_name", "external_id", "alias", "added_at"}
+
+func TestValidateNetworkGroupMember(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateNetworkGroupMember("course-lab", "db"))
+	assert.Error(validateNetworkGroupMember("Course", "db"))
+	assert.Error(validateNetworkGroupMember("course-lab", "my_db"))
+	assert.Error(validateNetworkGroupMember("course-lab", "a12345678901234567890123456789012345678901234567890123456"))
+}
+
+func TestGetNetworkGroupPolicyLabelPrefix(t *testing.T) {
+	i, _ := setupInternal(t, []runtime.Object{})
+	i.labelKeys = newLabelKeys("vice.cyverse.org", false)
+
+	// The members are selected by the same external-id key as everything else.
+	policy := i.getNetworkGroupPolicy("group", []NetworkGroupMember{{ExternalID: "e1"}, {ExternalID: "e2"}})
+	requirement := policy.Spec.PodSelector.MatchExpressions[0]
+	assert.Equal(t, "vice.cyverse.org/external-id", requirement.Key)
+	assert.Equal(t, []string{"e1", "e2"}, requirement.Values)
+}
+
+func TestJoinNetworkGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	dep := userAppDeployment("e1", "postgres", time.Now())
+	dep.Spec.Template.Spec.Containers = []apiv1.Container{
+		{
+			Name:  analysisContainerName,
+			Ports: []apiv1.ContainerPort{{Name: "tcp-a-0", ContainerPort: 5432, Protocol: apiv1.ProtocolTCP}},
+		},
+	}
+	i, mock := setupInternal(t, []runtime.Object{dep})
+	i.NetworkPolicyEnabled = true
+
+	username := "alice" + testConfig.UserSuffix
+	groupID := networkGroupID(username, "lab")
+
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs("e1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs(username, "lab").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows).AddRow(username, "lab", "e0", "notebook", time.Now()))
+	mock.ExpectExec("INSERT INTO vice_network_group_members").
+		WithArgs(username, "lab", "e1", "db").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs(username, "lab").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows).
+			AddRow(username, "lab", "e1", "db", time.Now()).
+			AddRow(username, "lab", "e0", "notebook", time.Now()))
+
+	member, err := i.joinNetworkGroup(username, "lab", "e1", "db")
+	assert.NoError(err)
+	assert.Equal("db-"+groupID, member.Hostname)
+
+	svc, err := i.clientset.CoreV1().Services("vice-apps").Get("db-"+groupID, metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"external-id": "e1"}, svc.Spec.Selector)
+	assert.Equal(int32(5432), svc.Spec.Ports[0].Port)
+	assert.Equal("e1", svc.Labels["external-id"])
+
+	policy, err := i.clientset.NetworkingV1().NetworkPolicies("vice-apps").Get("vice-group-"+groupID, metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal([]string{"e1", "e0"}, policy.Spec.PodSelector.MatchExpressions[0].Values)
+	assert.Equal([]string{"e1", "e0"}, policy.Spec.Ingress[0].From[0].PodSelector.MatchExpressions[0].Values)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestJoinNetworkGroupConflicts(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	username := "alice" + testConfig.UserSuffix
+
+	// The analysis is already in a group.
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows).AddRow(username, "other", "e1", "db", time.Now()))
+	_, err := i.joinNetworkGroup(username, "lab", "e1", "db")
+	assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	// The alias is taken.
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs("e1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs(username, "lab").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows).AddRow(username, "lab", "e0", "db", time.Now()))
+	_, err = i.joinNetworkGroup(username, "lab", "e1", "db")
+	assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestJoinNetworkGroupRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	dep := userAppDeployment("e1", "postgres", time.Now())
+	dep.Spec.Template.Spec.Containers = []apiv1.Container{
+		{
+			Name:  analysisContainerName,
+			Ports: []apiv1.ContainerPort{{Name: "tcp-a-0", ContainerPort: 5432, Protocol: apiv1.ProtocolTCP}},
+		},
+	}
+	i, mock := setupInternal(t, []runtime.Object{dep})
+	i.NetworkPolicyEnabled = true
+
+	username := "alice" + testConfig.UserSuffix
+
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs("e1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs(username, "lab").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows))
+	mock.ExpectExec("INSERT INTO vice_network_group_members").
+		WithArgs(username, "lab", "e1", "db").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs(username, "lab").
+		WillReturnError(sql.ErrConnDone)
+
+	// The policy couldn't be updated, so the alias and the membership are
+	// taken back out.
+	mock.ExpectExec("DELETE FROM vice_network_group_members").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs(username, "lab").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows))
+
+	_, err := i.joinNetworkGroup(username, "lab", "e1", "db")
+	assert.Error(err)
+
+	svcs, err := i.clientset.CoreV1().Services("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(svcs.Items)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLeaveNetworkGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	username := "alice" + testConfig.UserSuffix
+	groupID := networkGroupID(username, "lab")
+
+	i, mock := setupInternal(t, []runtime.Object{
+		&apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: "db-" + groupID, Namespace: "vice-apps"}},
+	})
+	i.NetworkPolicyEnabled = true
+
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows).AddRow(username, "lab", "e1", "db", time.Now()))
+	mock.ExpectExec("DELETE FROM vice_network_group_members").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("FROM vice_network_group_members").WithArgs(username, "lab").
+		WillReturnRows(sqlmock.NewRows(networkGroupMemberRows))
+
+	// The group is empty now, so there's no policy left to delete.
+	assert.NoError(i.leaveNetworkGroup("e1"))
+
+	svcs, err := i.clientset.CoreV1().Services("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(svcs.Items)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
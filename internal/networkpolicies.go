@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"fmt"
+
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// namespaceNameLabel is the label the API server sets on every namespace with
+// the name of the namespace.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// NetworkPolicyEgressRule is an entry in the egress allowlist for VICE
+// analyses. Traffic to the CIDR is allowed on the listed TCP ports, or on all
+// ports if none are listed.
+type NetworkPolicyEgressRule struct {
+	CIDR  string `mapstructure:"cidr"`
+	Ports []int  `mapstructure:"ports"`
+}
+
+func networkPolicyName(job *model.Job) string {
+	return fmt.Sprintf("vice-%s", job.InvocationID)
+}
+
+func networkPolicyPorts(protocol apiv1.Protocol, ports ...int32) []netv1.NetworkPolicyPort {
+	retval := []netv1.NetworkPolicyPort{}
+	for _, p := range ports {
+		proto := protocol
+		port := intstr.FromInt(int(p))
+		retval = append(retval, netv1.NetworkPolicyPort{
+			Protocol: &proto,
+			Port:     &port,
+		})
+	}
+	return retval
+}
+
+func namespacePeers(namespaces ...string) []netv1.NetworkPolicyPeer {
+	retval := []netv1.NetworkPolicyPeer{}
+	for _, ns := range namespaces {
+		retval = append(retval, netv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{namespaceNameLabel: ns},
+			},
+		})
+	}
+	return retval
+}
+
+// getNetworkPolicy returns the NetworkPolicy for the VICE analysis. Incoming
+// traffic is only allowed from the configured namespaces (normally the ingress
+// controller's and app-exposer's) to the proxy and file transfer ports. If no
+// namespaces are configured, any source may connect to those ports.
+// Outgoing traffic is only allowed to DNS, the VICE backend services, and the
+// configured allowlist. It does not call the k8s API.
+func (i *Internal) getNetworkPolicy(job *model.Job) (*netv1.NetworkPolicy, error) {
+	labels, err := i.labelsFromJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	ingressPorts := networkPolicyPorts(apiv1.ProtocolTCP, viceProxyPort, fileTransfersPort)
+	// Requests for the extra TCP ports go through the VICE proxy, so only the
+	// ports it can't proxy are opened.
+	if i.ExposeExtraPorts {
+		for _, port := range i.extraServicePorts(job) {
+			if port.Protocol != apiv1.ProtocolTCP {
+				ingressPorts = append(ingressPorts, networkPolicyPorts(port.Protocol, port.Port)...)
+			}
+		}
+	}
+
+	if port, ok := i.tlsPassthroughPort(job); ok {
+		ingressPorts = append(ingressPorts, networkPolicyPorts(port.Protocol, port.Port)...)
+	}
+
+	egress := []netv1.NetworkPolicyEgressRule{
+		{
+			// DNS lookups can go anywhere.
+			Ports: append(
+				networkPolicyPorts(apiv1.ProtocolUDP, 53),
+				networkPolicyPorts(apiv1.ProtocolTCP, 53)...,
+			),
+		},
+	}
+
+	if i.VICEBackendNamespace != "" {
+		egress = append(egress, netv1.NetworkPolicyEgressRule{
+			To: namespacePeers(i.VICEBackendNamespace),
+		})
+	}
+
+	for _, rule := range i.NetworkPolicyEgress {
+		ports := []int32{}
+		for _, p := range rule.Ports {
+			ports = append(ports, int32(p))
+		}
+		egress = append(egress, netv1.NetworkPolicyEgressRule{
+			To: []netv1.NetworkPolicyPeer{
+				{IPBlock: &netv1.IPBlock{CIDR: rule.CIDR}},
+			},
+			Ports: networkPolicyPorts(apiv1.ProtocolTCP, ports...),
+		})
+	}
+
+	return &netv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        networkPolicyName(job),
+			Labels:      labels,
+			Annotations: i.annotationsFromJob(job),
+		},
+		Spec: netv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: i.labelKeys.selector(map[string]string{
+					"external-id": job.InvocationID,
+				}),
+			},
+			PolicyTypes: []netv1.PolicyType{
+				netv1.PolicyTypeIngress,
+				netv1.PolicyTypeEgress,
+			},
+			Ingress: []netv1.NetworkPolicyIngressRule{
+				{
+					From:  namespacePeers(i.NetworkPolicyFromNamespaces...),
+					Ports: ingressPorts,
+				},
+			},
+			Egress: egress,
+		},
+	}, nil
+}
+
+// UpsertNetworkPolicy creates or updates the NetworkPolicy for the VICE
+// analysis if network policies are enabled.
+func (i *Internal) UpsertNetworkPolicy(job *model.Job) error {
+	if !i.NetworkPolicyEnabled {
+		return nil
+	}
+
+	policy, err := i.getNetworkPolicy(job)
+	if err != nil {
+		return err
+	}
+
+	return i.applyObject(i.ViceNamespace, policy, func() error {
+		npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+		_, err := npclient.Get(policy.Name, metav1.GetOptions{})
+		if err != nil {
+			_, err = npclient.Create(policy)
+		} else {
+			_, err = npclient.Update(policy)
+		}
+		return err
+	})
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// registerUserIPQuery registers the login IP lookup made when labelling
+// resources.
+func registerUserIPQuery(mock sqlmock.Sqlmock, ip string) {
+	mock.ExpectQuery("SELECT l.ip_address").
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow(ip))
+}
+
+func TestUpsertNetworkPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	job := multiPortJob(8888)
+	job.Name = "test analysis"
+	job.Submitter = "test@example.org"
+
+	// Nothing is created when network policies are turned off.
+	assert.NoError(internal.UpsertNetworkPolicy(job))
+	policies, err := internal.clientset.NetworkingV1().NetworkPolicies(internal.ViceNamespace).List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(policies.Items)
+
+	internal.NetworkPolicyEnabled = true
+	internal.NetworkPolicyFromNamespaces = []string{"ingress-nginx", "prod"}
+	internal.NetworkPolicyEgress = []NetworkPolicyEgressRule{
+		{CIDR: "10.1.0.0/16", Ports: []int{1247, 1248}},
+	}
+
+	registerUserIPQuery(mock, "127.0.0.1")
+	registerSubdomainQuery(mock, job.InvocationID, "")
+	assert.NoError(internal.UpsertNetworkPolicy(job))
+
+	policy, err := internal.clientset.NetworkingV1().NetworkPolicies(internal.ViceNamespace).Get(networkPolicyName(job), metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(job.InvocationID, policy.Spec.PodSelector.MatchLabels["external-id"])
+
+	assert.Len(policy.Spec.Ingress, 1)
+	assert.Len(policy.Spec.Ingress[0].From, 2)
+	assert.Equal("ingress-nginx", policy.Spec.Ingress[0].From[0].NamespaceSelector.MatchLabels[namespaceNameLabel])
+	assert.Len(policy.Spec.Ingress[0].Ports, 2)
+
+	// DNS, the VICE backend namespace, and the allowlist entry.
+	assert.Len(policy.Spec.Egress, 3)
+	assert.Equal("10.1.0.0/16", policy.Spec.Egress[2].To[0].IPBlock.CIDR)
+	assert.Len(policy.Spec.Egress[2].Ports, 2)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
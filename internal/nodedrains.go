@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	defaultRelocationTimeout      = 15 * time.Minute
+	defaultRelocationPollInterval = 5 * time.Second
+)
+
+// DrainStatus is how far along the relocation of an analysis off of a node
+// being drained is.
+type DrainStatus string
+
+const (
+	// DrainPending means the analysis hasn't been touched yet.
+	DrainPending DrainStatus = "pending"
+
+	// DrainSaving means the outputs of the analysis are being saved.
+	DrainSaving DrainStatus = "saving"
+
+	// DrainRelocating means the pod of the analysis has been deleted and a new
+	// one is coming up on another node.
+	DrainRelocating DrainStatus = "relocating"
+
+	// DrainRelocated means the analysis is running on another node.
+	DrainRelocated DrainStatus = "relocated"
+
+	// DrainFailed means the analysis couldn't be moved. It's left alone if
+	// its outputs couldn't be saved.
+	DrainFailed DrainStatus = "failed"
+)
+
+// NodeAnalysis is a VICE analysis with a pod on a node.
+type NodeAnalysis struct {
+	ExternalID   string `json:"externalID"`
+	AnalysisName string `json:"analysisName"`
+	Username     string `json:"username"`
+	Pod          string `json:"pod"`
+}
+
+// DrainedAnalysis is the progress of the relocation of an analysis off of a
+// node being drained.
+type DrainedAnalysis struct {
+	NodeAnalysis
+	Status  DrainStatus `json:"status"`
+	NewNode string      `json:"newNode,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// NodeDrain is the progress of the drain of a node.
+type NodeDrain struct {
+	Node       string             `json:"node"`
+	StartedAt  time.Time          `json:"startedAt"`
+	FinishedAt *time.Time         `json:"finishedAt,omitempty"`
+	Analyses   []*DrainedAnalysis `json:"analyses"`
+}
+
+// nodeDrains keeps track of the node drains started since app-exposer
+// started, keyed by node name.
+type nodeDrains struct {
+	mu                sync.Mutex
+	drains            map[string]*NodeDrain
+	relocationTimeout time.Duration
+	pollInterval      time.Duration
+}
+
+func newNodeDrains() *nodeDrains {
+	return &nodeDrains{
+		drains:            map[string]*NodeDrain{},
+		relocationTimeout: defaultRelocationTimeout,
+		pollInterval:      defaultRelocationPollInterval,
+	}
+}
+
+// start records a new drain of the node and returns it. The drain must only
+// be changed through update. An error is returned if the node is already
+// being drained.
+func (n *nodeDrains) start(node string, analyses []NodeAnalysis) (*NodeDrain, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if existing, ok := n.drains[node]; ok && existing.FinishedAt == nil {
+		return nil, echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("node %s is already being drained", node))
+	}
+
+	drain := &NodeDrain{Node: node, StartedAt: time.Now(), Analyses: []*DrainedAnalysis{}}
+	for _, analysis := range analyses {
+		drain.Analyses = append(drain.Analyses, &DrainedAnalysis{NodeAnalysis: analysis, Status: DrainPending})
+	}
+	n.drains[node] = drain
+
+	return drain, nil
+}
+
+// update calls fn with the lock held, so that it can change the progress of a
+// drain.
+func (n *nodeDrains) update(fn func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fn()
+}
+
+// finish records that the drain is over.
+func (n *nodeDrains) finish(drain *NodeDrain) {
+	n.update(func() {
+		now := time.Now()
+		drain.FinishedAt = &now
+	})
+}
+
+// get returns a copy of the latest drain of the node, or nil if the node
+// hasn't been drained.
+func (n *nodeDrains) get(node string) *NodeDrain {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	drain, ok := n.drains[node]
+	if !ok {
+		return nil
+	}
+	return n.copyOf(drain)
+}
+
+// copyOf returns a copy of the drain that's safe to use without the lock.
+// The caller must hold the lock.
+func (n *nodeDrains) copyOf(drain *NodeDrain) *NodeDrain {
+	retval := *drain
+	retval.Analyses = []*DrainedAnalysis{}
+	for _, analysis := range drain.Analyses {
+		a := *analysis
+		retval.Analyses = append(retval.Analyses, &a)
+	}
+	return &retval
+}
+
+// nodeAnalyses returns the VICE analyses with pods on the node, sorted by
+// external ID.
+func (i *Internal) nodeAnalyses(node string) ([]NodeAnalysis, error) {
+	podlist, err := i.podList(i.ViceNamespace, map[string]string{}, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	analyses := []NodeAnalysis{}
+	for _, pod := range podlist.Items {
+		externalID := i.labelKeys.get(pod.Labels, "external-id")
+		if pod.Spec.NodeName != node || externalID == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		meta := i.metaInfo(&pod)
+		analyses = append(analyses, NodeAnalysis{
+			ExternalID:   externalID,
+			AnalysisName: meta.AnalysisName,
+			Username:     meta.Username,
+			Pod:          pod.Name,
+		})
+	}
+
+	sort.Slice(analyses, func(x, y int) bool {
+		return analyses[x].ExternalID < analyses[y].ExternalID
+	})
+
+	return analyses, nil
+}
+
+// cordonNode marks the node as unschedulable so that the relocated analyses
+// don't come back up on it.
+func (i *Internal) cordonNode(node string) error {
+	patch := []byte(`{"spec":{"unschedulable":true}}`)
+	if _, err := i.clientset.CoreV1().Nodes().Patch(node, types.MergePatchType, patch); err != nil {
+		return errors.Wrapf(err, "error cordoning node %s", node)
+	}
+	return nil
+}
+
+// podReady returns true if the pod is running and passing its readiness
+// checks.
+func podReady(pod *apiv1.Pod) bool {
+	if pod.Status.Phase != apiv1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// waitForRelocation waits for the analysis to have a ready pod on a node
+// other than the one being drained and returns the name of that node.
+func (i *Internal) waitForRelocation(externalID, node string) (string, error) {
+	deadline := time.Now().Add(i.nodeDrains.relocationTimeout)
+
+	for {
+		podlist, err := i.podList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+		if err != nil {
+			return "", err
+		}
+
+		for _, pod := range podlist.Items {
+			if pod.Spec.NodeName != "" && pod.Spec.NodeName != node && podReady(&pod) {
+				return pod.Spec.NodeName, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("analysis %s did not come back up within %s", externalID, i.nodeDrains.relocationTimeout)
+		}
+
+		time.Sleep(i.nodeDrains.pollInterval)
+	}
+}
+
+// relocateAnalysis saves the outputs of the analysis, deletes its pod on the
+// node, and waits for the Deployment to bring up a new one somewhere else.
+// The user is told what's happening along the way. The analysis is left alone
+// if its outputs can't be saved.
+func (i *Internal) relocateAnalysis(drain *NodeDrain, analysis *DrainedAnalysis) {
+	setStatus := func(status DrainStatus, err error) {
+		i.nodeDrains.update(func() {
+			analysis.Status = status
+			if err != nil {
+				analysis.Error = err.Error()
+			}
+		})
+	}
+
+	publish := func(msg string) {
+		if err := i.statusPublisher.Running(analysis.ExternalID, msg); err != nil {
+			log.Error(err)
+		}
+	}
+
+	setStatus(DrainSaving, nil)
+	publish(fmt.Sprintf(
+		"analysis %s is moving to another node for maintenance; its outputs are being saved first and it will be unavailable for a few minutes",
+		analysis.AnalysisName,
+	))
+
+	if err := i.snapshotOutputsWithTimeout(analysis.ExternalID); err != nil {
+		log.Error(err)
+		setStatus(DrainFailed, err)
+		publish(fmt.Sprintf("analysis %s could not be moved because its outputs could not be saved", analysis.AnalysisName))
+		return
+	}
+
+	setStatus(DrainRelocating, nil)
+
+	err := i.clientset.CoreV1().Pods(i.ViceNamespace).Delete(analysis.Pod, &metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		err = errors.Wrapf(err, "error deleting pod %s", analysis.Pod)
+		log.Error(err)
+		setStatus(DrainFailed, err)
+		return
+	}
+
+	newNode, err := i.waitForRelocation(analysis.ExternalID, drain.Node)
+	if err != nil {
+		log.Error(err)
+		setStatus(DrainFailed, err)
+		return
+	}
+
+	i.nodeDrains.update(func() {
+		analysis.Status = DrainRelocated
+		analysis.NewNode = newNode
+	})
+	publish(fmt.Sprintf("analysis %s has moved to another node and is available again", analysis.AnalysisName))
+}
+
+// drainNode relocates each of the analyses in the drain in turn, so that the
+// rest of the cluster only has to make room for one of them at a time.
+func (i *Internal) drainNode(drain *NodeDrain) {
+	for _, analysis := range drain.Analyses {
+		i.relocateAnalysis(drain, analysis)
+	}
+
+	i.nodeDrains.finish(drain)
+
+	log.Infof("finished draining the VICE analyses from node %s", drain.Node)
+}
+
+// AdminNodeAnalysesHandler lists the VICE analyses with pods on a node.
+func (i *Internal) AdminNodeAnalysesHandler(c echo.Context) error {
+	node := c.Param("node")
+
+	analyses, err := i.nodeAnalyses(node)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"node":     node,
+		"analyses": analyses,
+	})
+}
+
+// AdminDrainNodeHandler cordons a node and moves each of the VICE analyses on
+// it to another node, saving its outputs first and keeping its user informed.
+// The drain runs in the background; its progress is available from
+// AdminGetNodeDrainHandler.
+func (i *Internal) AdminDrainNodeHandler(c echo.Context) error {
+	node := c.Param("node")
+
+	if _, err := i.clientset.CoreV1().Nodes().Get(node, metav1.GetOptions{}); err != nil {
+		if k8serrors.IsNotFound(err) {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("node %s not found", node))
+		}
+		return errors.Wrapf(err, "error getting node %s", node)
+	}
+
+	analyses, err := i.nodeAnalyses(node)
+	if err != nil {
+		return err
+	}
+
+	drain, err := i.nodeDrains.start(node, analyses)
+	if err != nil {
+		return err
+	}
+
+	if err = i.cordonNode(node); err != nil {
+		i.nodeDrains.finish(drain)
+		return err
+	}
+
+	go i.drainNode(drain)
+
+	return c.JSON(http.StatusAccepted, i.nodeDrains.get(node))
+}
+
+// AdminGetNodeDrainHandler returns the progress of the latest drain of a
+// node.
+func (i *Internal) AdminGetNodeDrainHandler(c echo.Context) error {
+	node := c.Param("node")
+
+	drain := i.nodeDrains.get(node)
+	if drain == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("node %s has not been drained", node))
+	}
+
+	return c.JSON(http.StatusOK, drain)
+}
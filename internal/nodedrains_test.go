@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func nodePod(name, externalID, node string, ready bool) *apiv1.Pod {
+	status := apiv1.ConditionFalse
+	if ready {
+		status = apiv1.ConditionTrue
+	}
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "external-id": externalID, "analysis-name": "notebook"},
+		},
+		Spec: apiv1.PodSpec{NodeName: node},
+		Status: apiv1.PodStatus{
+			Phase:      apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{{Type: apiv1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestNodeAnalyses(t *testing.T) {
+	i, _ := setupInternal(t, []runtime.Object{
+		nodePod("p2", "e2", "n1", true),
+		nodePod("p1", "e1", "n1", true),
+		nodePod("p3", "e3", "n2", true),
+	})
+
+	analyses, err := i.nodeAnalyses("n1")
+	assert.NoError(t, err)
+	assert.Equal(t, []NodeAnalysis{
+		{ExternalID: "e1", AnalysisName: "notebook", Pod: "p1"},
+		{ExternalID: "e2", AnalysisName: "notebook", Pod: "p2"},
+	}, analyses)
+}
+
+func TestRelocateAnalysis(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		&apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1"}},
+		nodePod("p1", "e1", "n1", true),
+		nodePod("p1-new", "e1", "n2", true),
+	})
+	i.UseCSIDriver = true
+	i.SetPodExecutor(&stubExecutor{})
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+	i.nodeDrains.pollInterval = time.Millisecond
+
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	expectStateChange(mock, "e1", RunningState, SavingState)
+	expectStateChange(mock, "e1", SavingState, RunningState)
+
+	analyses, err := i.nodeAnalyses("n1")
+	assert.NoError(err)
+	drain, err := i.nodeDrains.start("n1", analyses)
+	assert.NoError(err)
+
+	// The node can't be drained twice at once.
+	_, err = i.nodeDrains.start("n1", analyses)
+	assert.Error(err)
+
+	assert.NoError(i.cordonNode("n1"))
+	i.drainNode(drain)
+
+	node, err := i.clientset.CoreV1().Nodes().Get("n1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.True(node.Spec.Unschedulable)
+
+	progress := i.nodeDrains.get("n1")
+	assert.NotNil(progress.FinishedAt)
+	assert.Equal(DrainRelocated, progress.Analyses[0].Status)
+	assert.Equal("n2", progress.Analyses[0].NewNode)
+
+	_, err = i.clientset.CoreV1().Pods("vice-apps").Get("p1", metav1.GetOptions{})
+	assert.Error(err)
+
+	// The user hears about the move before and after.
+	assert.Equal("Running", publisher.published[0])
+	assert.Equal("Running", publisher.published[len(publisher.published)-1])
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRelocateAnalysisTimesOut(t *testing.T) {
+	i, mock := setupInternal(t, []runtime.Object{
+		nodePod("p1", "e1", "n1", true),
+		nodePod("p1-new", "e1", "n2", false),
+	})
+	i.UseCSIDriver = true
+	i.SetPodExecutor(&stubExecutor{})
+	i.statusPublisher = &recordingPublisher{}
+	i.nodeDrains.pollInterval = time.Millisecond
+	i.nodeDrains.relocationTimeout = 10 * time.Millisecond
+
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	expectStateChange(mock, "e1", RunningState, SavingState)
+	expectStateChange(mock, "e1", SavingState, RunningState)
+
+	analyses, err := i.nodeAnalyses("n1")
+	assert.NoError(t, err)
+	drain, err := i.nodeDrains.start("n1", analyses)
+	assert.NoError(t, err)
+
+	i.drainNode(drain)
+
+	progress := i.nodeDrains.get("n1")
+	assert.Equal(t, DrainFailed, progress.Analyses[0].Status)
+	assert.Contains(t, progress.Analyses[0].Error, "did not come back up")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// isPaused returns true if the Deployment of an analysis has been scaled down
+// to zero replicas by a pause.
+func isPaused(deployment *v1.Deployment) bool {
+	return deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == 0
+}
+
+// scaleAnalysis sets the number of replicas of the Deployment of the analysis.
+// Nothing else is touched, so the volumes, service, ingress, and labels of the
+// analysis stay in place.
+func (i *Internal) scaleAnalysis(externalID string, replicas int32) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": replicas},
+	})
+	if err != nil {
+		return err
+	}
+
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return err
+	}
+
+	if len(deplist.Items) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no deployment found for analysis %s", externalID))
+	}
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	for _, dep := range deplist.Items {
+		if _, err = depclient.Patch(dep.Name, types.MergePatchType, patch); err != nil {
+			return errors.Wrapf(err, "error scaling deployment %s", dep.Name)
+		}
+	}
+
+	return nil
+}
+
+// pauseAnalysis scales the analysis down to zero replicas and moves it into
+// the Paused state. Only running analyses can be paused. Its usage record is
+// stopped, so the time it spends paused isn't counted against the owner's
+// GPU-hours.
+func (i *Internal) pauseAnalysis(externalID string) error {
+	state, err := i.currentState(externalID, RunningState)
+	if err != nil {
+		return err
+	}
+
+	if state != RunningState {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("analysis %s is %s and can only be paused while it's Running", externalID, state))
+	}
+
+	// The usage has to be stopped while the pods are still around, so that
+	// the nodes they ran on are recorded.
+	i.recordUsageStop(externalID)
+
+	if err = i.scaleAnalysis(externalID, 0); err != nil {
+		i.recordUsageResume(externalID)
+		return err
+	}
+
+	return i.transition(externalID, PausedState, fmt.Sprintf("analysis %s has been paused", externalID))
+}
+
+// resumeAnalysis scales a paused analysis back up to one replica and moves it
+// into the Provisioning state. The deployment watcher moves it into the
+// Running state once the new pod is ready. The analysis counts against the
+// concurrent job limit of its owner again, so it's only resumed if the owner
+// has room for it. Its usage is recorded again from then on, so analyses that
+// use GPUs are only resumed if the owner has GPU-hours left.
+func (i *Internal) resumeAnalysis(ctx context.Context, externalID string) error {
+	state, err := i.currentState(externalID, PausedState)
+	if err != nil {
+		return err
+	}
+
+	if state != PausedState {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("analysis %s is %s, not Paused", externalID, state))
+	}
+
+	a := i.newApps()
+	analysisID, err := a.GetAnalysisIDByExternalID(ctx, externalID)
+	if err != nil {
+		return err
+	}
+	owner, _, err := a.GetUserByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+	if _, err = i.validateConcurrentJobs(ctx, owner); err != nil {
+		return err
+	}
+
+	if i.Quotas.Enabled {
+		gpus, err := i.analysisGPUs(externalID)
+		if err != nil {
+			return err
+		}
+		if gpus > 0 {
+			if _, err = i.validateGPUHoursLeft(ctx, owner); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = i.scaleAnalysis(externalID, 1); err != nil {
+		return err
+	}
+	i.recordUsageResume(externalID)
+
+	return i.transition(externalID, ProvisioningState, fmt.Sprintf("analysis %s is being resumed", externalID))
+}
+
+// PauseAnalysisHandler pauses an analysis that the user in the 'user' query
+// parameter has write access to. The pod is removed, but everything needed to resume the
+// analysis is kept. Paused analyses don't count against the user's job limit
+// and aren't shut down for being idle, but their time limits still apply.
+func (i *Internal) PauseAnalysisHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelWrite)
+	if err != nil {
+		return err
+	}
+
+	if err = i.pauseAnalysis(externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// ResumeAnalysisHandler resumes a paused analysis that the user in the 'user'
+// query parameter has write access to. The job limit of the owner applies.
+func (i *Internal) ResumeAnalysisHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelWrite)
+	if err != nil {
+		return err
+	}
+
+	if err = i.resumeAnalysis(c.Request().Context(), externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminPauseAnalysisHandler pauses an analysis without requiring user
+// information.
+func (i *Internal) AdminPauseAnalysisHandler(c echo.Context) error {
+	externalID, err := i.adminAnalysisExternalID(c)
+	if err != nil {
+		return err
+	}
+
+	if err = i.pauseAnalysis(externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminResumeAnalysisHandler resumes a paused analysis without requiring user
+// information.
+func (i *Internal) AdminResumeAnalysisHandler(c echo.Context) error {
+	externalID, err := i.adminAnalysisExternalID(c)
+	if err != nil {
+		return err
+	}
+
+	if err = i.resumeAnalysis(c.Request().Context(), externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
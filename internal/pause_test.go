@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPauseAndResumeAnalysis(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{appDeployment("e1", "app1")})
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	mock.ExpectExec("UPDATE vice_usage_records").WithArgs("e1", "").WillReturnResult(sqlmock.NewResult(0, 1))
+	registerStateQuery(mock, "e1", &running)
+	mock.ExpectExec("INSERT INTO vice_analysis_states").WithArgs("e1", string(PausedState)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE vice_analysis_uptime").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.pauseAnalysis("e1"))
+
+	dep, err := i.clientset.AppsV1().Deployments("vice-apps").Get("e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.True(isPaused(dep))
+	assert.True(i.deploymentInfo(dep).Paused)
+	assert.Equal("e1", dep.Labels["external-id"])
+
+	// Paused analyses don't count against the job limit, so the owner has
+	// room to resume it.
+	paused := PausedState
+	registerStateQuery(mock, "e1", &paused)
+	externalID, analysisID := "e1", "a1"
+	registerAnalysisIDQuery(mock, &externalID, &analysisID)
+	mock.ExpectQuery("FROM users u").WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("alice"+testConfig.UserSuffix, "u1"))
+	registerLimitQuery(mock, "alice", nil)
+	registerDefaultLimitQuery(mock, 1)
+	mock.ExpectExec("INSERT INTO vice_usage_records").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+	registerStateQuery(mock, "e1", &paused)
+	mock.ExpectExec("INSERT INTO vice_analysis_states").WithArgs("e1", string(ProvisioningState)).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.resumeAnalysis(context.Background(), "e1"))
+
+	dep, err = i.clientset.AppsV1().Deployments("vice-apps").Get("e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.False(isPaused(dep))
+	assert.Equal([]string{"Running", "Running"}, publisher.published)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPauseAnalysisNotRunning(t *testing.T) {
+	i, mock := setupInternal(t, []runtime.Object{appDeployment("e1", "app1")})
+
+	saving := SavingState
+	registerStateQuery(mock, "e1", &saving)
+
+	err := i.pauseAnalysis("e1")
+	assert.Equal(t, http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	dep, err := i.clientset.AppsV1().Deployments("vice-apps").Get("e1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, isPaused(dep))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResumeAnalysisGPUBudgetExhausted(t *testing.T) {
+	dep := requestingDeployment("e1", "test-user", "1", "1Gi", 0)
+	dep.Labels["external-id"] = "e1"
+
+	i, mock := setupInternal(t, []runtime.Object{dep})
+	i.Quotas.Enabled = true
+
+	// The analysis uses a GPU and its owner is out of GPU-hours, so it stays
+	// paused.
+	paused := PausedState
+	registerStateQuery(mock, "e1", &paused)
+	externalID, analysisID := "e1", "a1"
+	registerAnalysisIDQuery(mock, &externalID, &analysisID)
+	mock.ExpectQuery("FROM users u").WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("test-user"+testConfig.UserSuffix, "u1"))
+	registerLimitQuery(mock, "test-user", nil)
+	registerDefaultLimitQuery(mock, 1)
+	expectGPUBudget(mock, 10.25, 10.0)
+
+	err := i.resumeAnalysis(context.Background(), "e1")
+	if assert.Error(t, err) {
+		assert.Equal(t, "ERR_GPU_BUDGET_EXHAUSTED", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	dep, err = i.clientset.AppsV1().Deployments("vice-apps").Get("e1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, isPaused(dep))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPauseAnalysisScaleFailure(t *testing.T) {
+	i, mock := setupInternal(t, []runtime.Object{})
+
+	// The usage is picked back up if the analysis can't be scaled down.
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	mock.ExpectExec("UPDATE vice_usage_records").WithArgs("e1", "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO vice_usage_records").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := i.pauseAnalysis("e1")
+	assert.Equal(t, http.StatusNotFound, err.(*echo.HTTPError).Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIdleShutdownSkipsPaused(t *testing.T) {
+	now := time.Now()
+	dep := idleDeployment("e1", now.Add(-3*time.Hour))
+	var zero int32
+	dep.Spec.Replicas = &zero
+
+	i, mock := setupInternal(t, []runtime.Object{dep})
+	i.IdleShutdown = IdleShutdownConfig{ActivityURL: "http://app-exposer", Timeout: time.Hour}
+
+	shuttingDown := map[string]bool{}
+	assert.NoError(t, i.shutDownIdleAnalyses(now, shuttingDown))
+	assert.Empty(t, shuttingDown)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
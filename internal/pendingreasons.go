@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// Container waiting reasons that mean the container won't start without help.
+var stuckContainerReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// Event reasons for problems with the volumes of a pod.
+var volumeEventReasons = map[string]bool{
+	"FailedAttachVolume": true,
+	"FailedMount":        true,
+}
+
+// eventTime returns the most recent time recorded for the event.
+func eventTime(event *apiv1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	default:
+		return event.FirstTimestamp.Time
+	}
+}
+
+// pendingReason explains why a Pending pod hasn't started, using its
+// conditions, its container statuses, and the events recorded for it. An
+// empty string is returned for pods that aren't Pending or when nothing
+// useful is known.
+func pendingReason(pod *apiv1.Pod, events []apiv1.Event, now time.Time) string {
+	if pod.Status.Phase != apiv1.PodPending {
+		return ""
+	}
+
+	reasons := []string{}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != apiv1.PodScheduled || condition.Status != apiv1.ConditionFalse {
+			continue
+		}
+		msg := condition.Message
+		if msg == "" {
+			msg = condition.Reason
+		}
+		reasons = append(reasons, fmt.Sprintf("waiting for a node: %s", msg))
+	}
+
+	// Only the latest message of each kind of volume problem is interesting,
+	// since they're repeated until the problem goes away.
+	volumeEvents := map[string]*apiv1.Event{}
+
+	// Image pulls that have started but not finished, keyed by the container
+	// they're for.
+	pulls := map[string]*apiv1.Event{}
+
+	for idx := range events {
+		event := &events[idx]
+		switch {
+		case volumeEventReasons[event.Reason]:
+			if latest, ok := volumeEvents[event.Reason]; !ok || eventTime(event).After(eventTime(latest)) {
+				volumeEvents[event.Reason] = event
+			}
+		case event.Reason == "Pulling":
+			if latest, ok := pulls[event.InvolvedObject.FieldPath]; !ok || eventTime(event).After(eventTime(latest)) {
+				pulls[event.InvolvedObject.FieldPath] = event
+			}
+		}
+	}
+
+	for idx := range events {
+		event := &events[idx]
+		if event.Reason != "Pulled" {
+			continue
+		}
+		if pull, ok := pulls[event.InvolvedObject.FieldPath]; ok && !eventTime(event).Before(eventTime(pull)) {
+			delete(pulls, event.InvolvedObject.FieldPath)
+		}
+	}
+
+	for _, reason := range []string{"FailedAttachVolume", "FailedMount"} {
+		if event, ok := volumeEvents[reason]; ok {
+			reasons = append(reasons, fmt.Sprintf("volume problem: %s", event.Message))
+		}
+	}
+
+	statuses := append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting == nil || !stuckContainerReasons[waiting.Reason] {
+			continue
+		}
+		reasons = append(reasons, fmt.Sprintf("container %s: %s: %s", status.Name, waiting.Reason, waiting.Message))
+	}
+
+	containers := []string{}
+	for fieldPath := range pulls {
+		containers = append(containers, fieldPath)
+	}
+	sort.Strings(containers)
+
+	for _, fieldPath := range containers {
+		event := pulls[fieldPath]
+		started := event.FirstTimestamp.Time
+		if started.IsZero() {
+			started = eventTime(event)
+		}
+		reasons = append(reasons, fmt.Sprintf("%s (started %s ago)", event.Message, now.Sub(started).Round(time.Second)))
+	}
+
+	return strings.Join(reasons, "; ")
+}
+
+// podEvents returns the events recorded for the pod. The field selector keeps
+// the listing to the pod's own events instead of every event in the
+// namespace.
+func (i *Internal) podEvents(namespace, podName string) ([]apiv1.Event, error) {
+	eventList, err := i.clientset.CoreV1().Events(namespace).List(metav1.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": podName,
+		}.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the events for pod %s", podName)
+	}
+
+	events := []apiv1.Event{}
+	for _, event := range eventList.Items {
+		if event.InvolvedObject.Kind == "Pod" && event.InvolvedObject.Name == podName {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// addPendingReasons fills in the pending reason for each of the Pending pods
+// in the listing. The events are only looked up for Pending pods, and a
+// failure to look them up leaves the reason based on the pod alone.
+func (i *Internal) addPendingReasons(pods []apiv1.Pod, infos []PodInfo) {
+	now := time.Now()
+	for idx := range pods {
+		pod := &pods[idx]
+		if pod.Status.Phase != apiv1.PodPending {
+			continue
+		}
+
+		events, err := i.podEvents(i.ViceNamespace, pod.Name)
+		if err != nil {
+			log.Error(err)
+		}
+		infos[idx].PendingReason = pendingReason(pod, events, now)
+	}
+}
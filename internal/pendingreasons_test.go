@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// podEvent returns an event for the named pod.
+func podEvent(name, pod, fieldPath, reason, message string, at time.Time) *apiv1.Event {
+	return &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "vice-apps"},
+		InvolvedObject: apiv1.ObjectReference{
+			Kind:      "Pod",
+			Name:      pod,
+			FieldPath: fieldPath,
+		},
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: metav1.NewTime(at),
+		LastTimestamp:  metav1.NewTime(at),
+	}
+}
+
+func TestPendingReason(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	pod := &apiv1.Pod{
+		Status: apiv1.PodStatus{
+			Phase: apiv1.PodPending,
+			Conditions: []apiv1.PodCondition{
+				{
+					Type:    apiv1.PodScheduled,
+					Status:  apiv1.ConditionFalse,
+					Reason:  "Unschedulable",
+					Message: "0/3 nodes are available: 3 Insufficient nvidia.com/gpu.",
+				},
+			},
+		},
+	}
+	assert.Equal("waiting for a node: 0/3 nodes are available: 3 Insufficient nvidia.com/gpu.", pendingReason(pod, nil, now))
+
+	pod.Status.Conditions = nil
+	pod.Status.ContainerStatuses = []apiv1.ContainerStatus{
+		{
+			Name: "analysis",
+			State: apiv1.ContainerState{
+				Waiting: &apiv1.ContainerStateWaiting{Reason: "ContainerCreating"},
+			},
+		},
+		{
+			Name: "vice-proxy",
+			State: apiv1.ContainerState{
+				Waiting: &apiv1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"},
+			},
+		},
+	}
+	events := []apiv1.Event{
+		*podEvent("m1", "p1", "", "FailedMount", "old mount error", now.Add(-2*time.Minute)),
+		*podEvent("m2", "p1", "", "FailedMount", "MountVolume.SetUp failed", now.Add(-time.Minute)),
+		*podEvent("p1", "p1", "spec.containers{analysis}", "Pulling", `Pulling image "jupyter"`, now.Add(-90*time.Second)),
+		*podEvent("p2", "p1", "spec.initContainers{input-files-init}", "Pulling", `Pulling image "porklock"`, now.Add(-3*time.Minute)),
+		*podEvent("p3", "p1", "spec.initContainers{input-files-init}", "Pulled", `Successfully pulled image "porklock"`, now.Add(-2*time.Minute)),
+	}
+
+	assert.Equal(
+		`volume problem: MountVolume.SetUp failed; container vice-proxy: ImagePullBackOff: Back-off pulling image; Pulling image "jupyter" (started 1m30s ago)`,
+		pendingReason(pod, events, now),
+	)
+
+	pod.Status.Phase = apiv1.PodRunning
+	assert.Equal("", pendingReason(pod, events, now))
+}
+
+func TestGetFilteredPodsPendingReason(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	internal, _ := setupInternal(t, []runtime.Object{
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "p1",
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"app-type": "interactive", "external-id": "e1"},
+			},
+			Status: apiv1.PodStatus{Phase: apiv1.PodPending},
+		},
+		podEvent("a1", "p1", "", "FailedAttachVolume", "AttachVolume.Attach failed", now),
+		podEvent("a2", "p2", "", "FailedAttachVolume", "another pod", now),
+	})
+
+	pods, err := internal.getFilteredPods(map[string]string{"external-id": "e1"})
+	assert.NoError(err)
+	assert.Len(pods, 1)
+	assert.Equal("volume problem: AttachVolume.Attach failed", pods[0].PendingReason)
+
+	// Only the pod's own events are listed.
+	selectors := []fields.Selector{}
+	for _, action := range internal.clientset.(*fake.Clientset).Actions() {
+		if list, ok := action.(k8stesting.ListAction); ok && action.GetResource().Resource == "events" {
+			selectors = append(selectors, list.GetListRestrictions().Fields)
+		}
+	}
+	assert.Len(selectors, 1)
+	assert.True(selectors[0].Matches(fields.Set{"involvedObject.kind": "Pod", "involvedObject.name": "p1"}))
+	assert.False(selectors[0].Matches(fields.Set{"involvedObject.kind": "Pod", "involvedObject.name": "p2"}))
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// PermissionsInvalidation identifies the cached permission checks to drop. An
+// empty User drops the checks of every user for the analysis, and an empty
+// AnalysisID drops the checks of every analysis for the user.
+type PermissionsInvalidation struct {
+	User       string `json:"user"`
+	AnalysisID string `json:"analysisID"`
+}
+
+// RequireInvalidationToken is middleware that only lets the request through if
+// it has the configured invalidation token as a bearer token. It's how the
+// permissions and sharing services are allowed to drop cached permission
+// checks, since they don't act as a user. Every request is refused if no
+// token is configured.
+func (i *Internal) RequireInvalidationToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if i.PermissionsInvalidationToken == "" {
+			return echo.NewHTTPError(http.StatusUnauthorized, "no invalidation token is configured")
+		}
+
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(i.PermissionsInvalidationToken)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "a valid invalidation token is required")
+		}
+
+		return next(c)
+	}
+}
+
+// InvalidatePermissionsHandler drops cached permission checks. It's meant to
+// be called when the sharing of an analysis changes, so that the change takes
+// effect right away instead of when the cached checks expire. Dropping checks
+// makes the next requests slower, so it's limited to services with the
+// invalidation token and users who can manage users.
+func (i *Internal) InvalidatePermissionsHandler(c echo.Context) error {
+	request := &PermissionsInvalidation{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if request.User == "" && request.AnalysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user or analysisID must be set")
+	}
+
+	if i.permissions.Cache != nil {
+		i.permissions.Cache.Invalidate(request.User, request.AnalysisID)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
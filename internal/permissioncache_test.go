@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireInvalidationToken(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	handler := internal.RequireInvalidationToken(ok)
+
+	call := func(auth string) error {
+		req := httptest.NewRequest(http.MethodPost, "/vice/permissions/invalidate", nil)
+		if auth != "" {
+			req.Header.Set(echo.HeaderAuthorization, auth)
+		}
+		return handler(echo.New().NewContext(req, httptest.NewRecorder()))
+	}
+
+	// Nothing gets through until a token is configured.
+	err := call("Bearer ")
+	if assert.Error(err) {
+		assert.Equal(http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+	}
+
+	internal.PermissionsInvalidationToken = "s3cret"
+
+	for _, auth := range []string{"", "s3cret", "Bearer wrong", "Bearer "} {
+		err = call(auth)
+		if assert.Error(err, auth) {
+			assert.Equal(http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+		}
+	}
+
+	assert.NoError(call("Bearer s3cret"))
+}
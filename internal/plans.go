@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// planLimitError returns the error for a launch that asks for more of a
+// resource than the user's plan allows.
+func planLimitError(plan *apps.UserPlan, resource string, requested, limit interface{}, units string) error {
+	return common.ErrorResponse{
+		ErrorCode: "ERR_PLAN_LIMIT_EXCEEDED",
+		Message: fmt.Sprintf(
+			"the analysis requests %v %s of %s, but the %s plan allows at most %v",
+			requested, units, resource, plan.Name, limit,
+		),
+		Details: &map[string]interface{}{
+			"plan":      plan.Name,
+			"resource":  resource,
+			"requested": requested,
+			"limit":     limit,
+		},
+	}
+}
+
+// applyPlan checks the resource requests of the job against the ceilings of
+// the plan and lowers the resource limits of the job to the ceilings. Requests
+// above a ceiling are rejected, since the analysis couldn't run with less.
+func applyPlan(job *model.Job, plan *apps.UserPlan) error {
+	container := &job.Steps[0].Component.Container
+
+	if plan.MaxCPUCores != nil {
+		ceiling := float32(*plan.MaxCPUCores)
+		if requested := cpuResourceRequest(job); requested > ceiling {
+			return planLimitError(plan, "cpu", requested, ceiling, "cores")
+		}
+		if cpuResourceLimit(job) > ceiling {
+			container.MaxCPUCores = ceiling
+		}
+	}
+
+	if plan.MaxMemory != nil {
+		ceiling := *plan.MaxMemory
+		if requested := memResourceRequest(job); requested > ceiling {
+			return planLimitError(plan, "memory", requested, ceiling, "bytes")
+		}
+		if memResourceLimit(job) > ceiling {
+			container.MemoryLimit = ceiling
+		}
+	}
+
+	if plan.MaxGPUs != nil {
+		if _, requested := gpuRequest(job); requested > *plan.MaxGPUs {
+			return planLimitError(plan, "gpu", requested, *plan.MaxGPUs, "devices")
+		}
+	}
+
+	return nil
+}
+
+// validatePlanJobLimit makes sure the user can start another analysis without
+// going over the concurrent job limit of their plan.
+func validatePlanJobLimit(user string, plan *apps.UserPlan, jobCount int) (int, error) {
+	limit := *plan.MaxConcurrentJobs
+	if jobCount < limit {
+		return http.StatusOK, nil
+	}
+
+	return http.StatusBadRequest, common.ErrorResponse{
+		ErrorCode: "ERR_LIMIT_REACHED",
+		Message: fmt.Sprintf(
+			"%s is already running %d of the %d concurrent analyses the %s plan allows",
+			user, jobCount, limit, plan.Name,
+		),
+		Details: &map[string]interface{}{
+			"plan":     plan.Name,
+			"jobCount": jobCount,
+			"jobLimit": limit,
+		},
+	}
+}
+
+// validatePlan applies the ceilings of the submitter's plan to the job when
+// plan enforcement is turned on. Users who aren't on a plan aren't limited.
+func (i *Internal) validatePlan(ctx context.Context, job *model.Job) (int, error) {
+	if !i.PlanEnforcement || len(job.Steps) == 0 {
+		return http.StatusOK, nil
+	}
+
+	plan, err := i.newApps().GetUserPlan(ctx, i.fixUsername(job.Submitter))
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "error looking up the plan for %s", job.Submitter)
+	}
+
+	if plan == nil {
+		return http.StatusOK, nil
+	}
+
+	if err = applyPlan(job, plan); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	return http.StatusOK, nil
+}
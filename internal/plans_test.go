@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func float64Pointer(value float64) *float64 {
+	return &value
+}
+
+func int64Pointer(value int64) *int64 {
+	return &value
+}
+
+func TestApplyPlanClampsLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	job := multiPortJob(8888)
+	plan := &apps.UserPlan{Name: "Basic", MaxCPUCores: float64Pointer(2), MaxMemory: int64Pointer(4 * gibibyte)}
+
+	assert.NoError(applyPlan(job, plan))
+	assert.Equal(float32(2), cpuResourceLimit(job))
+	assert.Equal(int64(4*gibibyte), memResourceLimit(job))
+
+	// Limits under the ceilings are left alone.
+	job = multiPortJob(8888)
+	job.Steps[0].Component.Container.MaxCPUCores = 1
+	assert.NoError(applyPlan(job, plan))
+	assert.Equal(float32(1), cpuResourceLimit(job))
+}
+
+func TestApplyPlanRejectsRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	plan := &apps.UserPlan{
+		Name:        "Basic",
+		MaxCPUCores: float64Pointer(2),
+		MaxMemory:   int64Pointer(4 * gibibyte),
+		MaxGPUs:     int64Pointer(0),
+	}
+
+	job := multiPortJob(8888)
+	job.Steps[0].Component.Container.MinCPUCores = 8
+	err := applyPlan(job, plan)
+	assert.Error(err)
+	assert.Equal("ERR_PLAN_LIMIT_EXCEEDED", err.(common.ErrorResponse).ErrorCode)
+	assert.Contains(err.Error(), "cpu")
+
+	job = multiPortJob(8888)
+	job.Steps[0].Component.Container.MinMemoryLimit = 8 * gibibyte
+	err = applyPlan(job, plan)
+	assert.Error(err)
+	assert.Contains(err.Error(), "memory")
+
+	err = applyPlan(deviceJob("/dev/nvidia0"), plan)
+	assert.Error(err)
+	assert.Contains(err.Error(), "gpu")
+
+	// A plan without ceilings doesn't limit anything.
+	assert.NoError(applyPlan(deviceJob("/dev/nvidia0"), &apps.UserPlan{Name: "Unlimited"}))
+}
+
+func TestValidatePlan(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+
+	job := multiPortJob(8888)
+	job.Submitter = "test-user"
+	job.Steps[0].Component.Container.MinCPUCores = 8
+
+	// Plans are ignored unless they're enforced.
+	status, err := i.validatePlan(context.Background(), job)
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	i.PlanEnforcement = true
+
+	mock.ExpectQuery("FROM user_plans").
+		WithArgs("test-user" + testConfig.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "max_cpu_cores", "max_memory", "max_gpus"}).
+			AddRow("Basic", 4.0, nil, nil))
+	status, err = i.validatePlan(context.Background(), job)
+	assert.Error(err)
+	assert.Equal(400, status)
+
+	// Users without a plan aren't limited.
+	mock.ExpectQuery("FROM user_plans").
+		WithArgs("test-user" + testConfig.UserSuffix).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "max_cpu_cores", "max_memory", "max_gpus"}))
+	status, err = i.validatePlan(context.Background(), job)
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestValidateConcurrentJobsPlanLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		viceDeployment(0, "vice-apps", "test-user", nil),
+		viceDeployment(1, "vice-apps", "test-user", nil),
+	})
+	i.PlanEnforcement = true
+
+	planColumns := []string{"name", "max_cpu_cores", "max_memory", "max_gpus", "max_concurrent_jobs"}
+
+	// The plan's limit replaces the default limit.
+	registerLimitQuery(mock, "test-user", nil)
+	registerDefaultLimitQuery(mock, 8)
+	mock.ExpectQuery("FROM user_plans").
+		WithArgs("test-user" + testConfig.UserSuffix).
+		WillReturnRows(sqlmock.NewRows(planColumns).AddRow("Basic", nil, nil, nil, 2))
+	status, err := i.validateConcurrentJobs(context.Background(), "test-user")
+	assert.Equal(400, status)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "2 of the 2 concurrent analyses the Basic plan allows")
+	}
+
+	registerLimitQuery(mock, "test-user", nil)
+	registerDefaultLimitQuery(mock, 1)
+	mock.ExpectQuery("FROM user_plans").
+		WithArgs("test-user" + testConfig.UserSuffix).
+		WillReturnRows(sqlmock.NewRows(planColumns).AddRow("Pro", nil, nil, nil, 4))
+	status, err = i.validateConcurrentJobs(context.Background(), "test-user")
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	// A limit set for the user takes precedence over the plan.
+	registerLimitQuery(mock, "test-user", intPointer(3))
+	registerDefaultLimitQuery(mock, 8)
+	status, err = i.validateConcurrentJobs(context.Background(), "test-user")
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Pod security settings that tools can be exempted from.
+const (
+	SecurityReadOnlyRootFilesystem      = "read_only_root_filesystem"
+	SecurityDropAllCapabilities         = "drop_all_capabilities"
+	SecuritySeccompRuntimeDefault       = "seccomp_runtime_default"
+	SecurityDisallowPrivilegeEscalation = "disallow_privilege_escalation"
+)
+
+const (
+	tmpVolumeName = "tmp"
+	tmpMountPath  = "/tmp"
+)
+
+// PodSecurityConfig turns on hardened security settings for the analysis
+// container and auxiliary containers, so that analyses can meet the
+// restricted PodSecurity standard. Exceptions lists the settings that aren't
+// applied to specific tool images, keyed by image name without the tag.
+type PodSecurityConfig struct {
+	ReadOnlyRootFilesystem      bool                `mapstructure:"read_only_root_filesystem"`
+	DropAllCapabilities         bool                `mapstructure:"drop_all_capabilities"`
+	SeccompRuntimeDefault       bool                `mapstructure:"seccomp_runtime_default"`
+	DisallowPrivilegeEscalation bool                `mapstructure:"disallow_privilege_escalation"`
+	Exceptions                  map[string][]string `mapstructure:"exceptions"`
+}
+
+// ValidatePodSecurity returns an error if any of the exceptions names an
+// unknown setting.
+func ValidatePodSecurity(cfg *PodSecurityConfig) error {
+	known := map[string]bool{
+		SecurityReadOnlyRootFilesystem:      true,
+		SecurityDropAllCapabilities:         true,
+		SecuritySeccompRuntimeDefault:       true,
+		SecurityDisallowPrivilegeEscalation: true,
+	}
+
+	problems := []string{}
+	for image, settings := range cfg.Exceptions {
+		for _, setting := range settings {
+			if !known[setting] {
+				problems = append(problems, fmt.Sprintf("pod security exception %s for %s is not a known setting", setting, image))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// enabled returns true if the setting is turned on and the image isn't
+// exempted from it.
+func (p *PodSecurityConfig) enabled(setting, image string) bool {
+	var on bool
+	switch setting {
+	case SecurityReadOnlyRootFilesystem:
+		on = p.ReadOnlyRootFilesystem
+	case SecurityDropAllCapabilities:
+		on = p.DropAllCapabilities
+	case SecuritySeccompRuntimeDefault:
+		on = p.SeccompRuntimeDefault
+	case SecurityDisallowPrivilegeEscalation:
+		on = p.DisallowPrivilegeEscalation
+	}
+	if !on {
+		return false
+	}
+
+	for _, exempt := range p.Exceptions[image] {
+		if exempt == setting {
+			return false
+		}
+	}
+	return true
+}
+
+// toolContainers returns the tool containers from the job for the analysis
+// container and the auxiliary containers, keyed by container name.
+func toolContainers(job *model.Job) map[string]*model.Container {
+	containers := map[string]*model.Container{
+		analysisContainerName: &job.Steps[0].Component.Container,
+	}
+
+	steps := auxiliarySteps(job)
+	for idx := range steps {
+		containers[auxiliaryContainerName(&steps[idx], idx)] = &steps[idx].Component.Container
+	}
+
+	return containers
+}
+
+// hardenPodTemplate applies the configured security settings to the tool
+// containers in the pod template. Containers with read-only root filesystems
+// get a writable /tmp unless the tool asks to skip it.
+func (i *Internal) hardenPodTemplate(job *model.Job, template *apiv1.PodTemplateSpec) {
+	cfg := &i.PodSecurity
+	tools := toolContainers(job)
+	addTmp := false
+
+	for idx := range template.Spec.Containers {
+		container := &template.Spec.Containers[idx]
+
+		tool, ok := tools[container.Name]
+		if !ok {
+			continue
+		}
+		image := tool.Image.Name
+
+		if container.SecurityContext == nil {
+			container.SecurityContext = &apiv1.SecurityContext{}
+		}
+		sc := container.SecurityContext
+
+		if cfg.enabled(SecurityReadOnlyRootFilesystem, image) {
+			sc.ReadOnlyRootFilesystem = boolPtr(true)
+			if !tool.SkipTmpMount {
+				addTmp = true
+				container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{
+					Name:      tmpVolumeName,
+					MountPath: tmpMountPath,
+				})
+			}
+		}
+
+		if cfg.enabled(SecurityDropAllCapabilities, image) {
+			if sc.Capabilities == nil {
+				sc.Capabilities = &apiv1.Capabilities{}
+			}
+			sc.Capabilities.Drop = []apiv1.Capability{"ALL"}
+		}
+
+		if cfg.enabled(SecurityDisallowPrivilegeEscalation, image) {
+			sc.AllowPrivilegeEscalation = boolPtr(false)
+		}
+
+		// The seccomp profile is still set with an annotation in the k8s
+		// versions we support.
+		if cfg.enabled(SecuritySeccompRuntimeDefault, image) {
+			if template.Annotations == nil {
+				template.Annotations = map[string]string{}
+			}
+			template.Annotations[apiv1.SeccompContainerAnnotationKeyPrefix+container.Name] = apiv1.SeccompProfileRuntimeDefault
+		}
+	}
+
+	if addTmp {
+		template.Spec.Volumes = append(template.Spec.Volumes, apiv1.Volume{
+			Name: tmpVolumeName,
+			VolumeSource: apiv1.VolumeSource{
+				EmptyDir: &apiv1.EmptyDirVolumeSource{},
+			},
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestValidatePodSecurity(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidatePodSecurity(&PodSecurityConfig{}))
+	assert.NoError(ValidatePodSecurity(&PodSecurityConfig{
+		Exceptions: map[string][]string{"discoenv/rstudio": {SecurityReadOnlyRootFilesystem}},
+	}))
+	assert.Error(ValidatePodSecurity(&PodSecurityConfig{
+		Exceptions: map[string][]string{"discoenv/rstudio": {"privileged"}},
+	}))
+}
+
+func TestHardenPodTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.PodSecurity = PodSecurityConfig{
+		ReadOnlyRootFilesystem:      true,
+		DropAllCapabilities:         true,
+		SeccompRuntimeDefault:       true,
+		DisallowPrivilegeEscalation: true,
+		Exceptions:                  map[string][]string{"postgres": {SecurityReadOnlyRootFilesystem}},
+	}
+
+	job := auxiliaryJob(5432)
+	job.Steps[0].Component.Container.Image.Name = "discoenv/jupyter"
+
+	template := &apiv1.PodTemplateSpec{
+		Spec: apiv1.PodSpec{Containers: internal.deploymentContainers(job)},
+	}
+	internal.hardenPodTemplate(job, template)
+
+	for _, container := range template.Spec.Containers {
+		sc := container.SecurityContext
+		switch container.Name {
+		case analysisContainerName:
+			assert.True(*sc.ReadOnlyRootFilesystem)
+			assert.Equal([]apiv1.Capability{"ALL"}, sc.Capabilities.Drop)
+			assert.False(*sc.AllowPrivilegeEscalation)
+			assert.Contains(container.VolumeMounts, apiv1.VolumeMount{Name: tmpVolumeName, MountPath: tmpMountPath})
+		case "aux-postgres-db":
+			assert.Nil(sc.ReadOnlyRootFilesystem)
+			assert.False(*sc.AllowPrivilegeEscalation)
+		default:
+			// Containers app-exposer adds itself are left alone.
+			assert.Nil(sc.AllowPrivilegeEscalation, container.Name)
+		}
+	}
+
+	assert.Equal(apiv1.SeccompProfileRuntimeDefault, template.Annotations[apiv1.SeccompContainerAnnotationKeyPrefix+analysisContainerName])
+	assert.Equal(apiv1.SeccompProfileRuntimeDefault, template.Annotations[apiv1.SeccompContainerAnnotationKeyPrefix+"aux-postgres-db"])
+	assert.Equal(tmpVolumeName, template.Spec.Volumes[len(template.Spec.Volumes)-1].Name)
+}
+
+func TestHardenPodTemplateDisabled(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+
+	job := multiPortJob(8888)
+	template := &apiv1.PodTemplateSpec{
+		Spec: apiv1.PodSpec{Containers: internal.deploymentContainers(job)},
+	}
+	internal.hardenPodTemplate(job, template)
+
+	assert.Empty(t, template.Annotations)
+	assert.Empty(t, template.Spec.Volumes)
+}
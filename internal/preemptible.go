@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// preemptibleLabel marks analysis pods scheduled to preemptible nodes.
+	preemptibleLabel = "preemptible"
+
+	defaultMaxPreemptions = 2
+)
+
+// preemptionReasons are the pod status reasons that mean the pod was killed
+// because its node went away or was reclaimed. Pods evicted by the kubelet
+// because their node ran short of memory or disk have the reason Evicted
+// instead, and those weren't preempted.
+var preemptionReasons = map[string]bool{
+	"Preempting":   true,
+	"Shutdown":     true,
+	"NodeShutdown": true,
+	"NodeLost":     true,
+	"Terminated":   true,
+}
+
+// disruptionPreemptionReasons are the reasons of a DisruptionTarget pod
+// condition that mean the pod was preempted or its node went away. Evictions
+// through the eviction API, which node drains use, aren't included.
+var disruptionPreemptionReasons = map[string]bool{
+	"PreemptionByScheduler":  true,
+	"DeletionByTaintManager": true,
+	"DeletionByPodGC":        true,
+	"TerminationByKubelet":   true,
+}
+
+// PreemptibleConfig schedules the analyses of the listed apps to preemptible
+// (spot) nodes, using the node selector and tolerations to reach them. Once
+// an analysis has been preempted MaxPreemptions times it's moved to a stable
+// node.
+type PreemptibleConfig struct {
+	Apps           []string           `mapstructure:"apps"`
+	NodeSelector   map[string]string  `mapstructure:"node_selector"`
+	Tolerations    []apiv1.Toleration `mapstructure:"tolerations"`
+	MaxPreemptions int                `mapstructure:"max_preemptions"`
+}
+
+func (p *PreemptibleConfig) maxPreemptions() int {
+	if p.MaxPreemptions <= 0 {
+		return defaultMaxPreemptions
+	}
+	return p.MaxPreemptions
+}
+
+// appAllowed returns true if the app's analyses can run on preemptible nodes.
+func (p *PreemptibleConfig) appAllowed(appID string) bool {
+	for _, id := range p.Apps {
+		if id == appID {
+			return true
+		}
+	}
+	return false
+}
+
+const recordPreemptionSQL = `
+	INSERT INTO vice_analysis_preemptions (external_id, pod_name, node_name, reason, preempted_at)
+	VALUES ($1, $2, $3, $4, now())
+	ON CONFLICT (external_id, pod_name) DO NOTHING
+`
+
+const countPreemptionsSQL = `
+	SELECT count(*)
+	  FROM vice_analysis_preemptions
+	 WHERE external_id = $1
+`
+
+// preemptionCount returns the number of times the analysis has been preempted.
+func (i *Internal) preemptionCount(externalID string) (int, error) {
+	var count int
+	if err := i.db.Get(&count, countPreemptionsSQL, externalID); err != nil {
+		return 0, errors.Wrapf(err, "error counting the preemptions of analysis %s", externalID)
+	}
+	return count, nil
+}
+
+// applyPreemptible schedules the analysis to preemptible nodes if its app is
+// allowed to run on them and it hasn't already been preempted too often.
+func (i *Internal) applyPreemptible(job *model.Job, template *apiv1.PodTemplateSpec) error {
+	if !i.Preemptible.appAllowed(job.AppID) {
+		return nil
+	}
+
+	count, err := i.preemptionCount(job.InvocationID)
+	if err != nil {
+		return err
+	}
+	if count >= i.Preemptible.maxPreemptions() {
+		return nil
+	}
+
+	for k, v := range i.Preemptible.NodeSelector {
+		if template.Spec.NodeSelector == nil {
+			template.Spec.NodeSelector = map[string]string{}
+		}
+		template.Spec.NodeSelector[k] = v
+	}
+	template.Spec.Tolerations = append(template.Spec.Tolerations, i.Preemptible.Tolerations...)
+
+	// The labels map is shared with the deployment, so it's copied first.
+	podLabels := map[string]string{preemptibleLabel: "true"}
+	for k, v := range template.Labels {
+		podLabels[k] = v
+	}
+	template.Labels = podLabels
+
+	return nil
+}
+
+// removePreemptible takes the preemptible node settings back out of the pod
+// template.
+func (i *Internal) removePreemptible(template *apiv1.PodTemplateSpec) {
+	for k := range i.Preemptible.NodeSelector {
+		delete(template.Spec.NodeSelector, k)
+	}
+
+	tolerations := []apiv1.Toleration{}
+	for _, toleration := range template.Spec.Tolerations {
+		preemptible := false
+		for _, t := range i.Preemptible.Tolerations {
+			if reflect.DeepEqual(t, toleration) {
+				preemptible = true
+				break
+			}
+		}
+		if !preemptible {
+			tolerations = append(tolerations, toleration)
+		}
+	}
+	template.Spec.Tolerations = tolerations
+
+	delete(template.Labels, preemptibleLabel)
+}
+
+// preemptionReason returns the reason the pod's status gives for it being
+// killed because its node was reclaimed, or an empty string if it wasn't.
+func preemptionReason(pod *apiv1.Pod) string {
+	// The kubelet sets TerminationByKubelet on pods it evicts for node
+	// pressure too.
+	if pod.Status.Reason == "Evicted" {
+		return ""
+	}
+	if preemptionReasons[pod.Status.Reason] {
+		return pod.Status.Reason
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == "DisruptionTarget" && condition.Status == apiv1.ConditionTrue && disruptionPreemptionReasons[condition.Reason] {
+			return condition.Reason
+		}
+	}
+	return ""
+}
+
+// podPreempted returns true if the pod's status says that it was killed
+// because its node was reclaimed.
+func podPreempted(pod *apiv1.Pod) bool {
+	return preemptionReason(pod) != ""
+}
+
+// nodeGone returns true if the node no longer exists or is being deleted.
+func (i *Internal) nodeGone(nodeName string) (bool, error) {
+	if nodeName == "" {
+		return false, nil
+	}
+
+	node, err := i.clientset.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, errors.Wrapf(err, "error getting node %s", nodeName)
+	}
+
+	return node.DeletionTimestamp != nil, nil
+}
+
+// handlePreemptedPod records the preemption of an analysis pod and tells the
+// user the analysis is being rescheduled. The deployment brings up a new pod
+// on its own; once the analysis has been preempted too often the deployment
+// is moved to stable nodes instead.
+func (i *Internal) handlePreemptedPod(pod *apiv1.Pod) error {
+	externalID := i.labelKeys.get(pod.Labels, "external-id")
+	if externalID == "" {
+		return nil
+	}
+
+	// Pods that go away while the analysis is shutting down weren't preempted.
+	state, err := i.currentState(externalID, RunningState)
+	if err != nil {
+		return err
+	}
+	if state.IsTerminal() || state == TerminatingState {
+		return nil
+	}
+
+	// Pods deleted along with their node don't have a reason of their own.
+	reason := preemptionReason(pod)
+	if reason == "" {
+		reason = pod.Status.Reason
+	}
+
+	result, err := i.db.Exec(recordPreemptionSQL, externalID, pod.Name, pod.Spec.NodeName, reason)
+	if err != nil {
+		return errors.Wrapf(err, "error recording the preemption of analysis %s", externalID)
+	}
+
+	// The pod has already been handled if nothing was recorded.
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return err
+	}
+
+	count, err := i.preemptionCount(externalID)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("analysis %s is rescheduling after node %s was preempted", i.labelKeys.get(pod.Labels, "analysis-name"), pod.Spec.NodeName)
+
+	if count >= i.Preemptible.maxPreemptions() {
+		deployments := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+
+		deployment, err := deployments.Get(externalID, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "error getting the deployment for analysis %s", externalID)
+		}
+
+		i.removePreemptible(&deployment.Spec.Template)
+		if _, err = deployments.Update(deployment); err != nil {
+			return errors.Wrapf(err, "error moving analysis %s to a stable node", externalID)
+		}
+
+		msg = fmt.Sprintf("%s; it has been preempted %d times and is moving to a stable node", msg, count)
+	}
+
+	log.Info(msg)
+
+	return i.statusPublisher.Running(externalID, msg)
+}
+
+// StartPreemptionMonitor watches the analysis pods running on preemptible
+// nodes for preemptions. It does nothing unless some apps are allowed to run
+// on preemptible nodes.
+func (i *Internal) StartPreemptionMonitor() {
+	if len(i.Preemptible.Apps) == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			set := labels.Set(i.labelKeys.selector(map[string]string{
+				"app-type":       "interactive",
+				preemptibleLabel: "true",
+			}))
+			factory := informers.NewSharedInformerFactoryWithOptions(
+				i.clientset,
+				0,
+				informers.WithNamespace(i.ViceNamespace),
+				informers.WithTweakListOptions(func(listoptions *metav1.ListOptions) {
+					listoptions.LabelSelector = set.AsSelector().String()
+				}),
+			)
+
+			podInformer := factory.Core().V1().Pods().Informer()
+			podInformerStop := make(chan struct{})
+
+			podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				UpdateFunc: func(oldObj, newObj interface{}) {
+					pod, ok := newObj.(*apiv1.Pod)
+					if !ok || !podPreempted(pod) {
+						return
+					}
+					if err := i.handlePreemptedPod(pod); err != nil {
+						log.Error(err)
+					}
+				},
+
+				DeleteFunc: func(obj interface{}) {
+					if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+						obj = tombstone.Obj
+					}
+					pod, ok := obj.(*apiv1.Pod)
+					if !ok {
+						log.Error(errors.New("unexpected type pod object"))
+						return
+					}
+
+					preempted := podPreempted(pod)
+					if !preempted {
+						gone, err := i.nodeGone(pod.Spec.NodeName)
+						if err != nil {
+							log.Error(err)
+							return
+						}
+						preempted = gone
+					}
+					if !preempted {
+						return
+					}
+
+					if err := i.handlePreemptedPod(pod); err != nil {
+						log.Error(err)
+					}
+				},
+			})
+
+			podInformer.Run(podInformerStop)
+			close(podInformerStop)
+		}
+	}()
+}
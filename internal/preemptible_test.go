@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var spotToleration = apiv1.Toleration{
+	Key:      "spot",
+	Operator: apiv1.TolerationOpEqual,
+	Value:    "true",
+	Effect:   apiv1.TaintEffectNoSchedule,
+}
+
+var preemptibleTestConfig = PreemptibleConfig{
+	Apps:         []string{"app1"},
+	NodeSelector: map[string]string{"lifecycle": "spot"},
+	Tolerations:  []apiv1.Toleration{spotToleration},
+}
+
+func registerPreemptionCount(mock sqlmock.Sqlmock, externalID string, count int) {
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM vice_analysis_preemptions").
+		WithArgs(externalID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+}
+
+func TestApplyPreemptible(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	internal.Preemptible = preemptibleTestConfig
+
+	job := multiPortJob(8888)
+	deploymentLabels := map[string]string{"external-id": job.InvocationID}
+	template := &apiv1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: deploymentLabels}}
+
+	// Apps that aren't listed stay on stable nodes.
+	job.AppID = "app2"
+	assert.NoError(internal.applyPreemptible(job, template))
+	assert.Empty(template.Spec.Tolerations)
+
+	job.AppID = "app1"
+	registerPreemptionCount(mock, job.InvocationID, 0)
+	assert.NoError(internal.applyPreemptible(job, template))
+	assert.Equal("spot", template.Spec.NodeSelector["lifecycle"])
+	assert.Equal([]apiv1.Toleration{spotToleration}, template.Spec.Tolerations)
+	assert.Equal("true", template.Labels[preemptibleLabel])
+	assert.NotContains(deploymentLabels, preemptibleLabel)
+
+	// Analyses that have been preempted too often stay on stable nodes.
+	template = &apiv1.PodTemplateSpec{}
+	registerPreemptionCount(mock, job.InvocationID, defaultMaxPreemptions)
+	assert.NoError(internal.applyPreemptible(job, template))
+	assert.Empty(template.Spec.NodeSelector)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPodPreempted(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.False(podPreempted(&apiv1.Pod{}))
+	assert.True(podPreempted(&apiv1.Pod{Status: apiv1.PodStatus{Reason: "Terminated"}}))
+	assert.True(podPreempted(&apiv1.Pod{Status: apiv1.PodStatus{
+		Conditions: []apiv1.PodCondition{{Type: "DisruptionTarget", Status: apiv1.ConditionTrue, Reason: "DeletionByTaintManager"}},
+	}}))
+
+	// Evictions for node pressure and through the eviction API aren't
+	// preemptions.
+	assert.False(podPreempted(&apiv1.Pod{Status: apiv1.PodStatus{Reason: "Evicted"}}))
+	assert.False(podPreempted(&apiv1.Pod{Status: apiv1.PodStatus{
+		Reason:     "Evicted",
+		Conditions: []apiv1.PodCondition{{Type: "DisruptionTarget", Status: apiv1.ConditionTrue, Reason: "TerminationByKubelet"}},
+	}}))
+	assert.False(podPreempted(&apiv1.Pod{Status: apiv1.PodStatus{
+		Conditions: []apiv1.PodCondition{{Type: "DisruptionTarget", Status: apiv1.ConditionTrue, Reason: "EvictionByEvictionAPI"}},
+	}}))
+}
+
+// preemptedPod returns a pod of analysis e1 that was killed on a spot node.
+func preemptedPod(name string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "e1", "analysis-name": "test", preemptibleLabel: "true"},
+		},
+		Spec:   apiv1.PodSpec{NodeName: "spot-1"},
+		Status: apiv1.PodStatus{Reason: "Terminated"},
+	}
+}
+
+func TestHandlePreemptedPod(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps"},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"external-id": "e1", preemptibleLabel: "true"},
+				},
+				Spec: apiv1.PodSpec{
+					NodeSelector: map[string]string{"lifecycle": "spot", "vice": "true"},
+					Tolerations:  []apiv1.Toleration{{Key: "vice", Operator: apiv1.TolerationOpExists}, spotToleration},
+				},
+			},
+		},
+	}
+
+	internal, mock := setupInternal(t, []runtime.Object{deployment})
+	internal.Preemptible = preemptibleTestConfig
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	running := RunningState
+
+	// The first preemption just reschedules the analysis.
+	registerStateQuery(mock, "e1", &running)
+	mock.ExpectExec("INSERT INTO vice_analysis_preemptions").
+		WithArgs("e1", "pod-1", "spot-1", "Terminated").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	registerPreemptionCount(mock, "e1", 1)
+	assert.NoError(internal.handlePreemptedPod(preemptedPod("pod-1")))
+	assert.Equal([]string{"Running"}, publisher.published)
+
+	// Seeing the same pod again does nothing.
+	registerStateQuery(mock, "e1", &running)
+	mock.ExpectExec("INSERT INTO vice_analysis_preemptions").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(internal.handlePreemptedPod(preemptedPod("pod-1")))
+	assert.Len(publisher.published, 1)
+
+	// The second preemption moves the analysis to a stable node.
+	registerStateQuery(mock, "e1", &running)
+	mock.ExpectExec("INSERT INTO vice_analysis_preemptions").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	registerPreemptionCount(mock, "e1", 2)
+	assert.NoError(internal.handlePreemptedPod(preemptedPod("pod-2")))
+	assert.Len(publisher.published, 2)
+
+	updated, err := internal.clientset.AppsV1().Deployments("vice-apps").Get("e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"vice": "true"}, updated.Spec.Template.Spec.NodeSelector)
+	assert.Len(updated.Spec.Template.Spec.Tolerations, 1)
+	assert.NotContains(updated.Spec.Template.Labels, preemptibleLabel)
+
+	// Pods of analyses that are shutting down weren't preempted.
+	terminating := TerminatingState
+	registerStateQuery(mock, "e1", &terminating)
+	assert.NoError(internal.handlePreemptedPod(preemptedPod("pod-3")))
+	assert.Len(publisher.published, 2)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
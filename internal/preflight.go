@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// LaunchViolation is a problem that would keep a job from launching, or from
+// working once it's launched. Code is the error code the launch would be
+// refused with, if it would be refused. Path is set for problems with an
+// input.
+type LaunchViolation struct {
+	Check   string `json:"check"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+	Path    string `json:"path,omitempty"`
+}
+
+// LaunchValidation is the outcome of validating a job before it's launched.
+// Valid is false if there are any violations.
+type LaunchValidation struct {
+	Valid      bool              `json:"valid"`
+	Violations []LaunchViolation `json:"violations"`
+}
+
+// launchViolation turns an error from one of the checks into a violation. The
+// code is used if the error doesn't come with one of its own.
+func launchViolation(check, code string, err error) LaunchViolation {
+	violation := LaunchViolation{Check: check, Code: code, Message: err.Error()}
+
+	switch e := err.(type) {
+	case common.ErrorResponse:
+		violation.Code = e.ErrorCode
+		violation.Message = e.Message
+	case *echo.HTTPError:
+		violation.Message = fmt.Sprint(e.Message)
+	}
+
+	return violation
+}
+
+// validatePorts returns an error if the ports the analysis listens on can't
+// be exposed. The first port is the one the VICE proxy forwards to, so there
+// has to be at least one, and none of them can collide with each other or
+// with the ports of the containers added to the pod.
+func validatePorts(job *model.Job) error {
+	ports := job.Steps[0].Component.Container.Ports
+	if len(ports) == 0 {
+		return fmt.Errorf("the app doesn't declare a port for the analysis to listen on")
+	}
+
+	reserved := map[int]string{
+		int(viceProxyPort):        "the VICE proxy",
+		int(viceProxyServicePort): "the VICE proxy service",
+		int(fileTransfersPort):    "file transfers",
+	}
+
+	seen := map[int]bool{}
+	for _, p := range ports {
+		switch {
+		case p.ContainerPort < 1 || p.ContainerPort > 65535:
+			return fmt.Errorf("port %d is not between 1 and 65535", p.ContainerPort)
+		case seen[p.ContainerPort]:
+			return fmt.Errorf("port %d is declared more than once", p.ContainerPort)
+		case reserved[p.ContainerPort] != "":
+			return fmt.Errorf("port %d is reserved for %s", p.ContainerPort, reserved[p.ContainerPort])
+		}
+		seen[p.ContainerPort] = true
+	}
+
+	return nil
+}
+
+// checkImageResolvable asks the image's registry whether the image exists,
+// with the image pull secrets the analysis would get. The scheme is the one
+// used to reach the registry.
+func (i *Internal) checkImageResolvable(job *model.Job, scheme string) error {
+	image := job.Steps[0].Component.Container.Image
+	tag := image.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	ref := parseImageReference(image.Name)
+	creds, _, err := i.registryCredentials(i.imagePullSecretNames(image.Name), ref.Registry)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: registryTimeout}
+	return checkImagePullable(client, scheme, ref, tag, creds)
+}
+
+// inputViolations returns a violation for each of the inputs that doesn't
+// exist or that the submitter can't read. Inputs shared through tickets are
+// readable through the ticket, so they aren't checked.
+func (i *Internal) inputViolations(job *model.Job) []LaunchViolation {
+	violations := []LaunchViolation{}
+
+	paths := []string{}
+	for _, input := range job.FilterInputsWithoutTickets() {
+		if input.Value != "" {
+			paths = append(paths, input.Value)
+		}
+	}
+
+	access, err := i.pathAccess(job.Submitter, paths)
+	if err != nil {
+		return append(violations, launchViolation("inputs", "ERR_INPUTS_UNVERIFIED", err))
+	}
+
+	for _, p := range paths {
+		switch {
+		case !access[p].Exists:
+			violations = append(violations, LaunchViolation{
+				Check:   "inputs",
+				Code:    "ERR_INPUT_NOT_FOUND",
+				Message: fmt.Sprintf("%s does not exist", p),
+				Path:    p,
+			})
+		case !access[p].Readable:
+			violations = append(violations, LaunchViolation{
+				Check:   "inputs",
+				Code:    "ERR_INPUT_NOT_READABLE",
+				Message: fmt.Sprintf("%s can't read %s", job.Submitter, p),
+				Path:    p,
+			})
+		}
+	}
+
+	return violations
+}
+
+// validateLaunch checks the job for the problems that would keep it from
+// launching, without launching anything. Unlike a launch, it keeps going
+// after a check fails so that all of the problems are reported at once. The
+// checks in jobChecks are the same ones a launch runs. Capacity and app
+// concurrency limits aren't checked since they only hold the launch in the
+// queue.
+func (i *Internal) validateLaunch(ctx context.Context, request *LaunchRequest, subdomain, registryScheme string) *LaunchValidation {
+	job := &request.Job
+	violations := []LaunchViolation{}
+
+	if len(job.Steps) == 0 {
+		violations = append(violations, LaunchViolation{Check: "job", Code: "ERR_INVALID_JOB", Message: "the job has no steps"})
+		return &LaunchValidation{Violations: violations}
+	}
+
+	if err := i.applyLaunchEnvironment(job, request.LaunchEnvironment); err != nil {
+		violations = append(violations, launchViolation("environment", "ERR_INVALID_ENVIRONMENT", err))
+	}
+
+	if err := i.checkImageResolvable(job, registryScheme); err != nil {
+		violations = append(violations, launchViolation("image", "ERR_IMAGE_UNRESOLVABLE", err))
+	}
+
+	if err := validatePorts(job); err != nil {
+		violations = append(violations, launchViolation("ports", "ERR_INVALID_PORTS", err))
+	}
+
+	for _, check := range jobChecks {
+		if _, err := check.validate(i, ctx, job, 1); err != nil {
+			violations = append(violations, launchViolation(check.name, "", err))
+		}
+	}
+
+	violations = append(violations, i.inputViolations(job)...)
+
+	if subdomain != "" {
+		if err := i.checkSubdomainAvailable(job.InvocationID, subdomain); err != nil {
+			violations = append(violations, launchViolation("subdomain", "ERR_SUBDOMAIN_UNAVAILABLE", err))
+		}
+	}
+
+	return &LaunchValidation{Valid: len(violations) == 0, Violations: violations}
+}
+
+// ValidateLaunchHandler checks the launch request in the body for problems
+// before it's submitted, so that they can be fixed instead of finding out
+// from a failed launch. It takes the same body and subdomain query parameter
+// as the launch endpoint.
+func (i *Internal) ValidateLaunchHandler(c echo.Context) error {
+	request := &LaunchRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, i.validateLaunch(c.Request().Context(), request, c.QueryParam("subdomain"), "https"))
+}
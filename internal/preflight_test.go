@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// preflightJob returns a job for the image that listens on the ports and reads
+// the inputs.
+func preflightJob(image string, ports []int, inputs ...string) *model.Job {
+	container := model.Container{Image: model.ContainerImage{Name: image, Tag: "1.0"}}
+	for _, port := range ports {
+		container.Ports = append(container.Ports, model.Ports{ContainerPort: port})
+	}
+
+	step := model.Step{Component: model.StepComponent{Container: container}}
+	for _, input := range inputs {
+		step.Config.Inputs = append(step.Config.Inputs, model.StepInput{Value: input, Multiplicity: "single"})
+	}
+
+	return &model.Job{
+		InvocationID:    "e1",
+		Submitter:       "ipcdev",
+		ExecutionTarget: "interapps",
+		Steps:           []model.Step{step},
+	}
+}
+
+// fakeDataInfo answers existence and permission lookups. /iplant/home/ipcdev
+// paths are readable, /iplant/home/other paths exist but aren't, and anything
+// else doesn't exist.
+func fakeDataInfo() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Paths []string `json:"paths"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		switch r.URL.Path {
+		case "/existence-marker":
+			paths := map[string]bool{}
+			for _, p := range body.Paths {
+				paths[p] = strings.HasPrefix(p, "/iplant/home/")
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"paths": paths})
+		case "/path-info":
+			paths := map[string]interface{}{}
+			for _, p := range body.Paths {
+				if strings.HasPrefix(p, "/iplant/home/ipcdev/") {
+					paths[p] = map[string]string{"permission": "read"}
+				} else {
+					paths[p] = map[string]string{}
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"paths": paths})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// fakePublicRegistry serves the manifest for tools/app:1.0 without
+// credentials.
+func fakePublicRegistry() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/tools/app/manifests/1.0" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+func TestValidatePorts(t *testing.T) {
+	tests := []struct {
+		ports []int
+		valid bool
+	}{
+		{[]int{8888}, true},
+		{[]int{8888, 8080}, true},
+		{[]int{}, false},
+		{[]int{0}, false},
+		{[]int{70000}, false},
+		{[]int{8888, 8888}, false},
+		{[]int{int(viceProxyPort)}, false},
+		{[]int{8888, int(fileTransfersPort)}, false},
+	}
+
+	for _, test := range tests {
+		err := validatePorts(preflightJob("tools/app", test.ports))
+		assert.Equal(t, test.valid, err == nil, "%v", test.ports)
+	}
+}
+
+func TestInputViolations(t *testing.T) {
+	assert := assert.New(t)
+
+	server := fakeDataInfo()
+	defer server.Close()
+
+	internal, _ := setupInternal(t, nil)
+	internal.DataInfoBaseURL = server.URL
+
+	job := preflightJob("tools/app", []int{8888},
+		"/iplant/home/ipcdev/reads.fq",
+		"/iplant/home/other/secret.fq",
+		"/missing/file.fq",
+	)
+
+	violations := internal.inputViolations(job)
+	assert.Len(violations, 2)
+	assert.Equal("ERR_INPUT_NOT_READABLE", violations[0].Code)
+	assert.Equal("/iplant/home/other/secret.fq", violations[0].Path)
+	assert.Equal("ERR_INPUT_NOT_FOUND", violations[1].Code)
+	assert.Equal("/missing/file.fq", violations[1].Path)
+
+	// Jobs without inputs don't need the data-info service.
+	internal.DataInfoBaseURL = "http://127.0.0.1:0"
+	assert.Empty(internal.inputViolations(preflightJob("tools/app", []int{8888})))
+}
+
+func TestValidateLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := fakePublicRegistry()
+	defer registry.Close()
+	dataInfo := fakeDataInfo()
+	defer dataInfo.Close()
+
+	internal, mock := setupInternal(t, nil)
+	internal.DataInfoBaseURL = dataInfo.URL
+	registryHost := strings.TrimPrefix(registry.URL, "http://")
+
+	// A job with nothing wrong with it.
+	request := &LaunchRequest{Job: *preflightJob(registryHost+"/tools/app", []int{8888}, "/iplant/home/ipcdev/reads.fq")}
+	registerFreezeQuery(mock, "ipcdev", nil)
+	registerLimitQuery(mock, "ipcdev", nil)
+	registerDefaultLimitQuery(mock, 2)
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("my-notebook").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e1"))
+
+	result := internal.validateLaunch(context.Background(), request, "my-notebook", "http")
+	assert.True(result.Valid)
+	assert.Empty(result.Violations)
+
+	// Everything that can go wrong is reported at once, including the checks
+	// that a launch runs.
+	request = &LaunchRequest{Job: *preflightJob(registryHost+"/tools/missing", []int{8888, 8888}, "/missing/file.fq")}
+	reason := "abuse"
+	registerFreezeQuery(mock, "ipcdev", &reason)
+	registerLimitQuery(mock, "ipcdev", nil)
+	registerDefaultLimitQuery(mock, 2)
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("my-notebook").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e2"))
+
+	result = internal.validateLaunch(context.Background(), request, "my-notebook", "http")
+	assert.False(result.Valid)
+
+	checks := []string{}
+	for _, violation := range result.Violations {
+		checks = append(checks, violation.Check)
+	}
+	assert.Equal([]string{"image", "ports", "frozen", "inputs", "subdomain"}, checks)
+	assert.Equal("ERR_IMAGE_UNRESOLVABLE", result.Violations[0].Code)
+	assert.Equal("ERR_USER_FROZEN", result.Violations[2].Code)
+	assert.Equal("subdomain my-notebook is already in use", result.Violations[4].Message)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// PriorityClassConfig names the PriorityClasses for the pods app-exposer
+// creates. Analysis pods get the class for the submitter's plan if there is
+// one, otherwise Analyses. System workloads such as image probes get System.
+// Plans are keyed by lowercased plan name, since that's how the config file
+// keys are read.
+type PriorityClassConfig struct {
+	Analyses string            `mapstructure:"analyses"`
+	System   string            `mapstructure:"system"`
+	Plans    map[string]string `mapstructure:"plans"`
+}
+
+// ValidatePriorityClasses returns an error if any of the PriorityClass names
+// can't be valid.
+func ValidatePriorityClasses(cfg *PriorityClassConfig) error {
+	names := map[string]string{
+		"analyses": cfg.Analyses,
+		"system":   cfg.System,
+	}
+	for plan, name := range cfg.Plans {
+		names[fmt.Sprintf("plans.%s", plan)] = name
+	}
+
+	for key, name := range names {
+		if name == "" {
+			continue
+		}
+		if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+			return fmt.Errorf("priority_classes.%s %s: %s", key, name, strings.Join(msgs, "; "))
+		}
+	}
+
+	return nil
+}
+
+// analysisPriorityClass returns the PriorityClass for the analysis pod. A
+// failure to look up the plan is logged and the default class is used, since
+// it shouldn't stop the launch.
+func (i *Internal) analysisPriorityClass(job *model.Job) string {
+	if len(i.PriorityClasses.Plans) == 0 {
+		return i.PriorityClasses.Analyses
+	}
+
+	plan, err := i.newApps().GetUserPlan(context.Background(), i.fixUsername(job.Submitter))
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up the plan for %s", job.Submitter))
+		return i.PriorityClasses.Analyses
+	}
+
+	if plan != nil {
+		if name, ok := i.PriorityClasses.Plans[strings.ToLower(plan.Name)]; ok && name != "" {
+			return name
+		}
+	}
+
+	return i.PriorityClasses.Analyses
+}
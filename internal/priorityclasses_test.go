@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePriorityClasses(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidatePriorityClasses(&PriorityClassConfig{}))
+	assert.NoError(ValidatePriorityClasses(&PriorityClassConfig{
+		Analyses: "vice-interactive",
+		System:   "vice-system",
+		Plans:    map[string]string{"premium": "vice-premium"},
+	}))
+	assert.Error(ValidatePriorityClasses(&PriorityClassConfig{Analyses: "VICE Interactive"}))
+	assert.Error(ValidatePriorityClasses(&PriorityClassConfig{Plans: map[string]string{"premium": "_premium"}}))
+}
+
+func TestAnalysisPriorityClass(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	job := multiPortJob(8888)
+	job.Submitter = "test-user"
+
+	i.PriorityClasses = PriorityClassConfig{Analyses: "vice-interactive"}
+	assert.Equal("vice-interactive", i.analysisPriorityClass(job))
+
+	i.PriorityClasses.Plans = map[string]string{"premium": "vice-premium"}
+	planColumns := []string{"name", "max_cpu_cores", "max_memory", "max_gpus"}
+
+	mock.ExpectQuery("FROM user_plans").
+		WithArgs("test-user" + testConfig.UserSuffix).
+		WillReturnRows(sqlmock.NewRows(planColumns).AddRow("Premium", nil, nil, nil))
+	assert.Equal("vice-premium", i.analysisPriorityClass(job))
+
+	mock.ExpectQuery("FROM user_plans").
+		WillReturnRows(sqlmock.NewRows(planColumns).AddRow("Basic", nil, nil, nil))
+	assert.Equal("vice-interactive", i.analysisPriorityClass(job))
+
+	mock.ExpectQuery("FROM user_plans").
+		WillReturnRows(sqlmock.NewRows(planColumns))
+	assert.Equal("vice-interactive", i.analysisPriorityClass(job))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
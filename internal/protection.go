@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// protectedLabel is set to "true" on the Deployment and pods of an analysis
+// that's protected from deletion, so the policies that shut analyses down and
+// anything else watching the cluster can leave it alone.
+const protectedLabel = "deletion-protected"
+
+// DeletionProtection records that an analysis can only be torn down when the
+// teardown is forced, who asked for that, and why.
+type DeletionProtection struct {
+	ExternalID  string    `json:"externalID" db:"external_id"`
+	ProtectedBy string    `json:"protectedBy" db:"protected_by"`
+	Reason      string    `json:"reason" db:"reason"`
+	ProtectedAt time.Time `json:"protectedAt" db:"protected_at"`
+}
+
+// DeletionProtectionRequest is the request body for protecting an analysis.
+type DeletionProtectionRequest struct {
+	Reason string `json:"reason"`
+}
+
+const getDeletionProtectionSQL = `
+	SELECT external_id, protected_by, reason, protected_at
+	  FROM vice_deletion_protections
+	 WHERE external_id = $1
+`
+
+const protectAnalysisSQL = `
+	INSERT INTO vice_deletion_protections (external_id, protected_by, reason, protected_at)
+	VALUES ($1, $2, $3, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET protected_by = EXCLUDED.protected_by,
+	       reason = EXCLUDED.reason,
+	       protected_at = EXCLUDED.protected_at
+`
+
+const unprotectAnalysisSQL = `
+	DELETE FROM vice_deletion_protections
+	 WHERE external_id = $1
+`
+
+// isProtected returns true if the labels mark the resource as belonging to a
+// protected analysis.
+func isProtected(labels map[string]string) bool {
+	return labels[protectedLabel] == "true"
+}
+
+// getDeletionProtection returns the deletion protection of the analysis, or
+// nil if it isn't protected.
+func (i *Internal) getDeletionProtection(externalID string) (*DeletionProtection, error) {
+	protection := &DeletionProtection{}
+	err := i.db.QueryRowx(getDeletionProtectionSQL, externalID).StructScan(protection)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the deletion protection of analysis %s", externalID)
+	}
+	return protection, nil
+}
+
+// labelProtection adds the protected label to or removes it from the
+// Deployment and pods of the analysis. The Deployment's pod template is left
+// alone, since changing it would restart the analysis.
+func (i *Internal) labelProtection(externalID string, protected bool) error {
+	var value interface{}
+	if protected {
+		value = "true"
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{protectedLabel: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	filter := map[string]string{"external-id": externalID}
+
+	deplist, err := i.deploymentList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return err
+	}
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	for _, dep := range deplist.Items {
+		if _, err = depclient.Patch(dep.Name, types.MergePatchType, patch); err != nil {
+			return errors.Wrapf(err, "error labeling deployment %s", dep.Name)
+		}
+	}
+
+	podlist, err := i.podList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return err
+	}
+	podclient := i.clientset.CoreV1().Pods(i.ViceNamespace)
+	for _, pod := range podlist.Items {
+		if _, err = podclient.Patch(pod.Name, types.MergePatchType, patch); err != nil {
+			return errors.Wrapf(err, "error labeling pod %s", pod.Name)
+		}
+	}
+
+	return nil
+}
+
+// protectAnalysis records the deletion protection of the analysis and labels
+// its resources.
+func (i *Internal) protectAnalysis(externalID, protectedBy, reason string) (*DeletionProtection, error) {
+	if _, err := i.db.Exec(protectAnalysisSQL, externalID, protectedBy, reason); err != nil {
+		return nil, errors.Wrapf(err, "error protecting analysis %s", externalID)
+	}
+
+	if err := i.labelProtection(externalID, true); err != nil {
+		return nil, err
+	}
+
+	return i.getDeletionProtection(externalID)
+}
+
+// unprotectAnalysis removes the deletion protection of the analysis.
+func (i *Internal) unprotectAnalysis(externalID string) error {
+	if _, err := i.db.Exec(unprotectAnalysisSQL, externalID); err != nil {
+		return errors.Wrapf(err, "error removing the deletion protection of analysis %s", externalID)
+	}
+
+	return i.labelProtection(externalID, false)
+}
+
+// checkDeletionProtection returns an error if the analysis is protected and
+// the request doesn't have the force query parameter set to true. Forcing the
+// teardown of a protected analysis removes its protection.
+func (i *Internal) checkDeletionProtection(c echo.Context, externalID string) error {
+	protection, err := i.getDeletionProtection(externalID)
+	if err != nil {
+		return err
+	}
+	if protection == nil {
+		return nil
+	}
+
+	force := false
+	if value := c.QueryParam("force"); value != "" {
+		if force, err = strconv.ParseBool(value); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("force must be true or false, not %s", value))
+		}
+	}
+
+	if !force {
+		return echo.NewHTTPError(
+			http.StatusConflict,
+			fmt.Sprintf("analysis %s is protected from deletion by %s (%s); set force to true to tear it down anyway", externalID, protection.ProtectedBy, protection.Reason),
+		)
+	}
+
+	log.Infof("forcing the teardown of protected analysis %s", externalID)
+	if _, err = i.db.Exec(unprotectAnalysisSQL, externalID); err != nil {
+		log.Error(errors.Wrapf(err, "error removing the deletion protection of analysis %s", externalID))
+	}
+
+	return nil
+}
+
+// checkAnalysisAccess returns the owner of the analysis after making sure the
+// user either owns it or has at least the permission level on it, directly
+// or through a group. Users with read access can look at an analysis, but
+// controlling it takes write access.
+func (i *Internal) checkAnalysisAccess(ctx context.Context, user, analysisID, level string) (string, error) {
+	a := i.newApps()
+	owner, _, err := a.GetUserByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return "", analysisLookupError(err, analysisID)
+	}
+
+	if i.fixUsername(owner) == i.fixUsername(user) {
+		return owner, nil
+	}
+
+	allowed, err := i.permissions.IsAllowedWithLevel(ctx, strings.TrimSuffix(user, i.UserSuffix), analysisID, level)
+	if err != nil {
+		return "", err
+	}
+
+	if !allowed {
+		return "", echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s does not have %s access to analysis %s", user, level, analysisID))
+	}
+
+	return owner, nil
+}
+
+// userAnalysisExternalID returns the external ID of the analysis in the URL
+// after making sure the user in the 'user' query parameter has at least the
+// permission level on it.
+func (i *Internal) userAnalysisExternalID(c echo.Context, level string) (string, error) {
+	user := c.QueryParam("user")
+	if user == "" {
+		return "", echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	if _, err := i.checkAnalysisAccess(c.Request().Context(), user, analysisID, level); err != nil {
+		return "", err
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return "", err
+	}
+
+	return externalID, nil
+}
+
+// checkControlAccess makes sure that the user in the 'user' query parameter,
+// if there is one, has write access to the analysis. Services that have
+// already checked access call the routes using this without a user.
+func (i *Internal) checkControlAccess(c echo.Context, externalID string) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return nil
+	}
+
+	analysisID, err := i.newApps().GetAnalysisIDByExternalID(c.Request().Context(), externalID)
+	if err != nil {
+		return analysisLookupError(err, externalID)
+	}
+
+	_, err = i.checkAnalysisAccess(c.Request().Context(), user, analysisID, permissions.LevelWrite)
+	return err
+}
+
+// adminAnalysisExternalID returns the external ID of the analysis in the URL.
+func (i *Internal) adminAnalysisExternalID(c echo.Context) (string, error) {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return "", err
+	}
+
+	return externalID, nil
+}
+
+func (i *Internal) protectionResponse(c echo.Context, externalID string) error {
+	protection, err := i.getDeletionProtection(externalID)
+	if err != nil {
+		return err
+	}
+
+	if protection == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s is not protected from deletion", externalID))
+	}
+
+	return c.JSON(http.StatusOK, protection)
+}
+
+func (i *Internal) protectResponse(c echo.Context, externalID, protectedBy string) error {
+	request := &DeletionProtectionRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	protection, err := i.protectAnalysis(externalID, protectedBy, request.Reason)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, protection)
+}
+
+// GetProtectionHandler returns the deletion protection of an analysis owned
+// by the user in the 'user' query parameter.
+func (i *Internal) GetProtectionHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelRead)
+	if err != nil {
+		return err
+	}
+
+	return i.protectionResponse(c, externalID)
+}
+
+// ProtectAnalysisHandler protects an analysis that the user in the 'user'
+// query parameter has write access to from deletion. Tearing it down then requires the force
+// query parameter, and it isn't shut down for reaching its time limit or for
+// being idle.
+func (i *Internal) ProtectAnalysisHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelWrite)
+	if err != nil {
+		return err
+	}
+
+	return i.protectResponse(c, externalID, i.fixUsername(c.QueryParam("user")))
+}
+
+// UnprotectAnalysisHandler removes the deletion protection of an analysis
+// that the user in the 'user' query parameter has write access to.
+func (i *Internal) UnprotectAnalysisHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelWrite)
+	if err != nil {
+		return err
+	}
+
+	if err = i.unprotectAnalysis(externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminGetProtectionHandler returns the deletion protection of an analysis
+// without requiring user information.
+func (i *Internal) AdminGetProtectionHandler(c echo.Context) error {
+	externalID, err := i.adminAnalysisExternalID(c)
+	if err != nil {
+		return err
+	}
+
+	return i.protectionResponse(c, externalID)
+}
+
+// AdminProtectAnalysisHandler protects an analysis from deletion without
+// requiring user information. The protection is recorded as being made by an
+// administrator.
+func (i *Internal) AdminProtectAnalysisHandler(c echo.Context) error {
+	externalID, err := i.adminAnalysisExternalID(c)
+	if err != nil {
+		return err
+	}
+
+	return i.protectResponse(c, externalID, "admin")
+}
+
+// AdminUnprotectAnalysisHandler removes the deletion protection of an
+// analysis without requiring user information.
+func (i *Internal) AdminUnprotectAnalysisHandler(c echo.Context) error {
+	externalID, err := i.adminAnalysisExternalID(c)
+	if err != nil {
+		return err
+	}
+
+	if err = i.unprotectAnalysis(externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var deletionProtectionRows = []string{"external_id", "protected_by", "reason", "protected_at"}
+
+func registerProtectionQuery(mock sqlmock.Sqlmock, externalID string, protected bool) {
+	query := mock.ExpectQuery("FROM vice_deletion_protections").WithArgs(externalID)
+	if !protected {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	query.WillReturnRows(sqlmock.NewRows(deletionProtectionRows).AddRow(externalID, "admin", "course demo", time.Now()))
+}
+
+func protectionContext(query string) echo.Context {
+	req := httptest.NewRequest(http.MethodPost, "/vice/e1/exit"+query, nil)
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func TestCheckDeletionProtection(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	registerProtectionQuery(mock, "e1", false)
+	assert.NoError(i.checkDeletionProtection(protectionContext(""), "e1"))
+
+	registerProtectionQuery(mock, "e1", true)
+	err := i.checkDeletionProtection(protectionContext(""), "e1")
+	assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+
+	registerProtectionQuery(mock, "e1", true)
+	err = i.checkDeletionProtection(protectionContext("?force=maybe"), "e1")
+	assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	// Forcing the teardown removes the protection.
+	registerProtectionQuery(mock, "e1", true)
+	mock.ExpectExec("DELETE FROM vice_deletion_protections").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(i.checkDeletionProtection(protectionContext("?force=true"), "e1"))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestProtectAnalysis(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "p1",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "external-id": "e1"},
+		},
+	}
+	i, mock := setupInternal(t, []runtime.Object{appDeployment("e1", "app1"), pod})
+
+	mock.ExpectExec("INSERT INTO vice_deletion_protections").
+		WithArgs("e1", "alice@example.org", "course demo").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	registerProtectionQuery(mock, "e1", true)
+
+	protection, err := i.protectAnalysis("e1", "alice@example.org", "course demo")
+	assert.NoError(err)
+	assert.Equal("e1", protection.ExternalID)
+
+	dep, err := i.clientset.AppsV1().Deployments("vice-apps").Get("e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.True(isProtected(dep.Labels))
+
+	p, err := i.clientset.CoreV1().Pods("vice-apps").Get("p1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.True(isProtected(p.Labels))
+
+	mock.ExpectExec("DELETE FROM vice_deletion_protections").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(i.unprotectAnalysis("e1"))
+
+	dep, err = i.clientset.AppsV1().Deployments("vice-apps").Get("e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.False(isProtected(dep.Labels))
+	assert.Equal("e1", dep.Labels["external-id"])
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestShutdownPoliciesSkipProtected(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	dep := idleDeployment("e1", now.Add(-3*time.Hour))
+	dep.Labels[protectedLabel] = "true"
+
+	i, mock := setupInternal(t, []runtime.Object{dep})
+	i.IdleShutdown = IdleShutdownConfig{ActivityURL: "http://app-exposer", Timeout: time.Hour}
+
+	// Neither policy looks the analysis up, since it's left out entirely.
+	expiring := map[string]bool{}
+	assert.NoError(i.enforceTimeLimits(now, expiring))
+	assert.Empty(expiring)
+
+	shuttingDown := map[string]bool{}
+	assert.NoError(i.shutDownIdleAnalyses(now, shuttingDown))
+	assert.Empty(shuttingDown)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCheckAnalysisAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	// Bob has read access to the analysis through a group.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"permissions":[{"permission_level":"read","subject":{"subject_type":"group"}}]}`)
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.permissions = &permissions.Permissions{BaseURL: server.URL}
+
+	registerOwner := func() {
+		mock.ExpectQuery("FROM users u").WithArgs("a1").
+			WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("alice"+testConfig.UserSuffix, "u1"))
+	}
+
+	registerOwner()
+	owner, err := i.checkAnalysisAccess(context.Background(), "alice", "a1", permissions.LevelOwn)
+	assert.NoError(err)
+	assert.Equal("alice", owner)
+
+	registerOwner()
+	owner, err = i.checkAnalysisAccess(context.Background(), "bob", "a1", permissions.LevelRead)
+	assert.NoError(err)
+	assert.Equal("alice", owner)
+
+	registerOwner()
+	_, err = i.checkAnalysisAccess(context.Background(), "bob", "a1", permissions.LevelWrite)
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
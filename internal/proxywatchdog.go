@@ -0,0 +1,347 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultProxyStaleAfter    = 2 * time.Minute
+	defaultProxyCheckInterval = 30 * time.Second
+
+	proxyProbeTimeout   = 5 * time.Second
+	proxyRestartTimeout = 10 * time.Second
+)
+
+// Actions taken for proxy incidents.
+const (
+	ProxyActionRestarted     = "restarted"
+	ProxyActionRestartFailed = "restart-failed"
+	ProxyActionNone          = "none"
+)
+
+// ProxyWatchdogConfig turns on the watchdog for the VICE proxy sidecars. The
+// proxies send heartbeats to HeartbeatURL, which is the base URL of
+// app-exposer as seen from the analysis pods. A proxy that hasn't sent one in
+// StaleAfter while its pod is running is probed and restarted.
+type ProxyWatchdogConfig struct {
+	HeartbeatURL  string        `mapstructure:"heartbeat_url"`
+	StaleAfter    time.Duration `mapstructure:"stale_after"`
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+}
+
+func (p *ProxyWatchdogConfig) enabled() bool {
+	return p.HeartbeatURL != ""
+}
+
+func (p *ProxyWatchdogConfig) staleAfter() time.Duration {
+	if p.StaleAfter <= 0 {
+		return defaultProxyStaleAfter
+	}
+	return p.StaleAfter
+}
+
+func (p *ProxyWatchdogConfig) checkInterval() time.Duration {
+	if p.CheckInterval <= 0 {
+		return defaultProxyCheckInterval
+	}
+	return p.CheckInterval
+}
+
+// proxyHeartbeatURL returns the URL the proxy for the analysis sends its
+// heartbeats to.
+func (p *ProxyWatchdogConfig) proxyHeartbeatURL(externalID string) string {
+	return fmt.Sprintf("%s/vice/proxies/%s/heartbeat", strings.TrimSuffix(p.HeartbeatURL, "/"), externalID)
+}
+
+// ProxyIncident records a VICE proxy that stopped sending heartbeats while its
+// analysis was running, and what was done about it.
+type ProxyIncident struct {
+	ID            string     `json:"id" db:"id"`
+	ExternalID    string     `json:"externalID" db:"external_id"`
+	PodName       string     `json:"podName" db:"pod_name"`
+	LastHeartbeat *time.Time `json:"lastHeartbeat,omitempty" db:"last_heartbeat"`
+	DetectedAt    time.Time  `json:"detectedAt" db:"detected_at"`
+	ProbeResult   string     `json:"probeResult" db:"probe_result"`
+	Action        string     `json:"action" db:"action"`
+	ResolvedAt    *time.Time `json:"resolvedAt,omitempty" db:"resolved_at"`
+}
+
+const proxyHeartbeatSQL = `
+	INSERT INTO vice_proxy_heartbeats (external_id, last_seen)
+	VALUES ($1, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET last_seen = EXCLUDED.last_seen
+`
+
+const getProxyHeartbeatsSQL = `
+	SELECT external_id, last_seen
+	  FROM vice_proxy_heartbeats
+	 WHERE external_id = ANY($1)
+`
+
+const resolveProxyIncidentsSQL = `
+	UPDATE vice_proxy_incidents
+	   SET resolved_at = now()
+	 WHERE external_id = $1
+	   AND resolved_at IS NULL
+`
+
+const openProxyIncidentSQL = `
+	INSERT INTO vice_proxy_incidents (external_id, pod_name, last_heartbeat, detected_at, probe_result, action)
+	SELECT $1, $2, $3, now(), '', ''
+	 WHERE NOT EXISTS (
+	       SELECT 1 FROM vice_proxy_incidents
+	        WHERE external_id = $1
+	          AND resolved_at IS NULL
+	 )
+	RETURNING id
+`
+
+const updateProxyIncidentSQL = `
+	UPDATE vice_proxy_incidents
+	   SET probe_result = $2,
+	       action = $3
+	 WHERE id = $1
+`
+
+const listProxyIncidentsSQL = `
+	SELECT id, external_id, pod_name, last_heartbeat, detected_at, probe_result, action, resolved_at
+	  FROM vice_proxy_incidents
+	 WHERE ($1 = false OR resolved_at IS NULL)
+	 ORDER BY detected_at DESC
+	 LIMIT $2
+`
+
+// proxyHeartbeats returns when each of the analyses' proxies last sent a
+// heartbeat, keyed by external ID.
+func (i *Internal) proxyHeartbeats(externalIDs []string) (map[string]time.Time, error) {
+	rows := []struct {
+		ExternalID string    `db:"external_id"`
+		LastSeen   time.Time `db:"last_seen"`
+	}{}
+	if err := i.db.Select(&rows, getProxyHeartbeatsSQL, pq.Array(externalIDs)); err != nil {
+		return nil, errors.Wrap(err, "error looking up the proxy heartbeats")
+	}
+
+	heartbeats := map[string]time.Time{}
+	for _, row := range rows {
+		heartbeats[row.ExternalID] = row.LastSeen
+	}
+	return heartbeats, nil
+}
+
+// proxyStale returns true if the proxy in the pod should have sent a heartbeat
+// by now. Proxies that have never sent one get StaleAfter from when the pod
+// started.
+func (i *Internal) proxyStale(pod *apiv1.Pod, lastSeen time.Time, now time.Time) bool {
+	if pod.Status.Phase != apiv1.PodRunning {
+		return false
+	}
+
+	since := lastSeen
+	if since.IsZero() {
+		if pod.Status.StartTime == nil {
+			return false
+		}
+		since = pod.Status.StartTime.Time
+	}
+
+	return now.Sub(since) > i.ProxyWatchdog.staleAfter()
+}
+
+// probeProxy makes a request to the proxy and describes the result. Any HTTP
+// response means the proxy is up, even if it's a redirect to log in.
+func probeProxy(client *http.Client, url string) string {
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	}
+	defer resp.Body.Close()
+	return fmt.Sprintf("status %d", resp.StatusCode)
+}
+
+// restartProxy kills the proxy process so that its container, and only its
+// container, is restarted by the kubelet.
+func (i *Internal) restartProxy(pod *apiv1.Pod) string {
+	if i.podExecutor == nil {
+		return ProxyActionNone
+	}
+
+	_, stderr, err := i.execWithTimeout(pod.Namespace, pod.Name, viceProxyContainerName, []string{"kill", "1"}, proxyRestartTimeout)
+	if err != nil {
+		log.Errorf("unable to restart the proxy in pod %s: %s %s", pod.Name, err, stderr)
+		return ProxyActionRestartFailed
+	}
+
+	return ProxyActionRestarted
+}
+
+// handleStaleProxy records an incident for the proxy that stopped sending
+// heartbeats, probes it, restarts it, and tells the user. Nothing is done if
+// the analysis already has an open incident.
+func (i *Internal) handleStaleProxy(client *http.Client, pod *apiv1.Pod, lastSeen time.Time) error {
+	externalID := i.labelKeys.get(pod.Labels, "external-id")
+
+	var last *time.Time
+	if !lastSeen.IsZero() {
+		last = &lastSeen
+	}
+
+	var incidentID string
+	err := i.db.QueryRow(openProxyIncidentSQL, externalID, pod.Name, last).Scan(&incidentID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error recording the proxy incident for analysis %s", externalID)
+	}
+
+	probeResult := probeProxy(client, fmt.Sprintf("http://%s:%d/", pod.Status.PodIP, viceProxyPort))
+	action := i.restartProxy(pod)
+
+	if _, err = i.db.Exec(updateProxyIncidentSQL, incidentID, probeResult, action); err != nil {
+		return errors.Wrapf(err, "error updating proxy incident %s", incidentID)
+	}
+
+	msg := fmt.Sprintf("the proxy for analysis %s stopped responding (probe: %s, action: %s)", i.labelKeys.get(pod.Labels, "analysis-name"), probeResult, action)
+	log.Warn(msg)
+
+	return i.statusPublisher.Running(externalID, msg)
+}
+
+// checkProxies looks for running analyses whose proxies have stopped sending
+// heartbeats.
+func (i *Internal) checkProxies(client *http.Client, now time.Time) error {
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"app-type": "interactive"})).AsSelector().String(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "error listing the analysis pods")
+	}
+
+	externalIDs := []string{}
+	for _, pod := range pods.Items {
+		if id := i.labelKeys.get(pod.Labels, "external-id"); id != "" {
+			externalIDs = append(externalIDs, id)
+		}
+	}
+	if len(externalIDs) == 0 {
+		return nil
+	}
+
+	heartbeats, err := i.proxyHeartbeats(externalIDs)
+	if err != nil {
+		return err
+	}
+
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		externalID := i.labelKeys.get(pod.Labels, "external-id")
+		if externalID == "" {
+			continue
+		}
+
+		lastSeen := heartbeats[externalID]
+		if !i.proxyStale(pod, lastSeen, now) {
+			continue
+		}
+
+		if err = i.handleStaleProxy(client, pod, lastSeen); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// StartProxyWatchdog periodically checks for proxies that have stopped
+// sending heartbeats. It does nothing unless the heartbeat URL is configured.
+func (i *Internal) StartProxyWatchdog() {
+	if !i.ProxyWatchdog.enabled() {
+		return
+	}
+
+	client := &http.Client{
+		Timeout: proxyProbeTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	go func() {
+		ticker := time.NewTicker(i.ProxyWatchdog.checkInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := i.checkProxies(client, time.Now()); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// ProxyHeartbeatHandler records that the VICE proxy for an analysis is still
+// up and closes any open incident for it. Only the pods of the analysis can
+// send its heartbeats.
+func (i *Internal) ProxyHeartbeatHandler(c echo.Context) error {
+	externalID := c.Param("external-id")
+	if externalID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "external-id parameter is empty")
+	}
+
+	if _, err := i.verifyTunnelClient(externalID, remoteHost(c.Request())); err != nil {
+		return err
+	}
+
+	if _, err := i.db.Exec(proxyHeartbeatSQL, externalID); err != nil {
+		return errors.Wrapf(err, "error recording the proxy heartbeat for %s", externalID)
+	}
+
+	if _, err := i.db.Exec(resolveProxyIncidentsSQL, externalID); err != nil {
+		return errors.Wrapf(err, "error resolving the proxy incidents for %s", externalID)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminListProxyIncidentsHandler lists the most recent proxy incidents. Only
+// the unresolved ones are listed if the open query parameter is true, and the
+// number returned is set with limit.
+func (i *Internal) AdminListProxyIncidentsHandler(c echo.Context) error {
+	var err error
+
+	open := false
+	if v := c.QueryParam("open"); v != "" {
+		if open, err = strconv.ParseBool(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid open parameter %q", v))
+		}
+	}
+
+	limit := 100
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid limit %q", v))
+		}
+	}
+
+	incidents := []ProxyIncident{}
+	if err = i.db.Select(&incidents, listProxyIncidentsSQL, open, limit); err != nil {
+		return errors.Wrap(err, "error listing the proxy incidents")
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ProxyIncident{
+		"incidents": incidents,
+	})
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// proxyPod returns a running analysis pod that started at the given time.
+func proxyPod(started time.Time) *apiv1.Pod {
+	startTime := metav1.NewTime(started)
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "e1-pod",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "e1", "app-type": "interactive", "analysis-name": "test"},
+		},
+		Status: apiv1.PodStatus{
+			Phase:     apiv1.PodRunning,
+			StartTime: &startTime,
+		},
+	}
+}
+
+func TestProxyStale(t *testing.T) {
+	assert := assert.New(t)
+	internal, _ := setupInternal(t, nil)
+
+	now := time.Now()
+	pod := proxyPod(now.Add(-time.Hour))
+
+	assert.False(internal.proxyStale(pod, now.Add(-time.Minute), now))
+	assert.True(internal.proxyStale(pod, now.Add(-3*time.Minute), now))
+
+	// Proxies that haven't sent a heartbeat yet get time to start up.
+	assert.True(internal.proxyStale(pod, time.Time{}, now))
+	assert.False(internal.proxyStale(proxyPod(now.Add(-time.Minute)), time.Time{}, now))
+
+	pod.Status.Phase = apiv1.PodPending
+	assert.False(internal.proxyStale(pod, now.Add(-time.Hour), now))
+}
+
+func TestProbeProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://cas.example.org/login", http.StatusFound)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	assert.Equal(t, "status 302", probeProxy(client, server.URL))
+	assert.Contains(t, probeProxy(client, "http://127.0.0.1:1/"), "error")
+}
+
+func TestCheckProxies(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	internal, mock := setupInternal(t, []runtime.Object{proxyPod(now.Add(-time.Hour))})
+	executor := &stubExecutor{}
+	internal.SetPodExecutor(executor)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	client := &http.Client{Timeout: time.Second}
+	lastSeen := now.Add(-10 * time.Minute)
+
+	mock.ExpectQuery("FROM vice_proxy_heartbeats").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "last_seen"}).AddRow("e1", lastSeen))
+	mock.ExpectQuery("INSERT INTO vice_proxy_incidents").
+		WithArgs("e1", "e1-pod", lastSeen).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("i1"))
+	mock.ExpectExec("UPDATE vice_proxy_incidents").
+		WithArgs("i1", sqlmock.AnyArg(), ProxyActionRestarted).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(internal.checkProxies(client, now))
+	assert.Equal([][]string{{"kill", "1"}}, executor.commands)
+	assert.Equal([]string{"Running"}, publisher.published)
+
+	// Nothing more is done while the incident is open.
+	mock.ExpectQuery("FROM vice_proxy_heartbeats").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "last_seen"}).AddRow("e1", lastSeen))
+	mock.ExpectQuery("INSERT INTO vice_proxy_incidents").
+		WillReturnError(sql.ErrNoRows)
+
+	assert.NoError(internal.checkProxies(client, now))
+	assert.Len(executor.commands, 1)
+	assert.Len(publisher.published, 1)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestProxyHeartbeatSpoofedAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := proxyPod(time.Now())
+	pod.Status.PodIP = "10.0.0.5"
+	i, mock := setupInternal(t, []runtime.Object{pod})
+
+	call := func(remoteAddr string) error {
+		req := httptest.NewRequest(http.MethodPost, "/vice/proxies/e1/heartbeat", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "10.0.0.5")
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		c.SetParamNames("external-id")
+		c.SetParamValues("e1")
+		return i.ProxyHeartbeatHandler(c)
+	}
+
+	// A caller can't keep the analysis alive by naming its pod in a header.
+	err := call("192.168.1.1:5000")
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	mock.ExpectExec("INSERT INTO vice_proxy_heartbeats").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE vice_proxy_incidents").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(call("10.0.0.5:5000"))
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,372 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const defaultPublicationTimeout = 2 * time.Minute
+
+// Publication statuses. A requested publication is submitted once the outputs
+// of the analysis have been saved.
+const (
+	PublicationRequested = "requested"
+	PublicationSubmitted = "submitted"
+	PublicationFailed    = "failed"
+)
+
+// PublicationConfig turns on the publication of analysis outputs to a
+// data-publication service, such as the CyVerse Data Commons. Datasets are
+// created by posting to the datasets endpoint under URL, with Token as a
+// bearer token if it's set.
+type PublicationConfig struct {
+	URL     string        `mapstructure:"url"`
+	Token   string        `mapstructure:"token"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func (c *PublicationConfig) enabled() bool {
+	return c.URL != ""
+}
+
+func (c *PublicationConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultPublicationTimeout
+	}
+	return c.Timeout
+}
+
+func (c *PublicationConfig) datasetsURL() string {
+	return fmt.Sprintf("%s/datasets", strings.TrimSuffix(c.URL, "/"))
+}
+
+// PublicationMetadata is the descriptive metadata users give for the dataset
+// their outputs are published as.
+type PublicationMetadata struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Creators    []string `json:"creators,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+	License     string   `json:"license,omitempty"`
+}
+
+// PublicationSubmission is the request body sent to the publication service.
+// The outputs are in the result folder of the analysis in the data store,
+// which the service packages into the dataset.
+type PublicationSubmission struct {
+	PublicationMetadata
+	Source     string                   `json:"source"`
+	Provenance *apps.AnalysisProvenance `json:"provenance"`
+}
+
+// publicationServiceResponse is the response body from the publication
+// service. The identifier is usually a DOI.
+type publicationServiceResponse struct {
+	Identifier string `json:"identifier"`
+}
+
+// Publication records the publication of the outputs of an analysis. DatasetID
+// is the identifier of the dataset the service created.
+type Publication struct {
+	AnalysisID  string              `json:"analysisID" db:"analysis_id"`
+	ExternalID  string              `json:"externalID" db:"external_id"`
+	RequestedBy string              `json:"requestedBy" db:"requested_by"`
+	Metadata    PublicationMetadata `json:"metadata" db:"-"`
+	Status      string              `json:"status" db:"status"`
+	DatasetID   string              `json:"datasetID,omitempty" db:"dataset_id"`
+	Error       string              `json:"error,omitempty" db:"error"`
+	RequestedAt time.Time           `json:"requestedAt" db:"requested_at"`
+	UpdatedAt   time.Time           `json:"updatedAt" db:"updated_at"`
+
+	RawMetadata []byte `json:"-" db:"metadata"`
+}
+
+const publicationColumns = `
+	analysis_id, external_id, requested_by, metadata, status,
+	COALESCE(dataset_id, '') AS dataset_id, COALESCE(error, '') AS error,
+	requested_at, updated_at
+`
+
+const getPublicationSQL = `
+	SELECT ` + publicationColumns + `
+	  FROM vice_analysis_publications
+	 WHERE analysis_id = $1
+`
+
+const getRequestedPublicationSQL = `
+	SELECT ` + publicationColumns + `
+	  FROM vice_analysis_publications
+	 WHERE external_id = $1
+	   AND status = 'requested'
+`
+
+const requestPublicationSQL = `
+	INSERT INTO vice_analysis_publications
+	       (analysis_id, external_id, requested_by, metadata, status, requested_at, updated_at)
+	VALUES ($1, $2, $3, $4, 'requested', now(), now())
+	ON CONFLICT (analysis_id) DO UPDATE
+	   SET requested_by = EXCLUDED.requested_by,
+	       metadata = EXCLUDED.metadata,
+	       status = EXCLUDED.status,
+	       dataset_id = NULL,
+	       error = NULL,
+	       requested_at = EXCLUDED.requested_at,
+	       updated_at = EXCLUDED.updated_at
+`
+
+const finishPublicationSQL = `
+	UPDATE vice_analysis_publications
+	   SET status = $2,
+	       dataset_id = NULLIF($3, ''),
+	       error = NULLIF($4, ''),
+	       updated_at = now()
+	 WHERE analysis_id = $1
+`
+
+// scanPublication scans the publication in the row, or returns nil if there
+// isn't one.
+func scanPublication(row interface{ StructScan(interface{}) error }) (*Publication, error) {
+	publication := &Publication{}
+	if err := row.StructScan(publication); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(publication.RawMetadata, &publication.Metadata); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the publication metadata of analysis %s", publication.AnalysisID)
+	}
+
+	return publication, nil
+}
+
+// getPublication returns the publication of the analysis, or nil if its
+// outputs haven't been published.
+func (i *Internal) getPublication(analysisID string) (*Publication, error) {
+	publication, err := scanPublication(i.db.QueryRowx(getPublicationSQL, analysisID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the publication of analysis %s", analysisID)
+	}
+	return publication, nil
+}
+
+// finishPublication records the outcome of submitting the publication.
+func (i *Internal) finishPublication(analysisID, status, datasetID, msg string) {
+	if _, err := i.db.Exec(finishPublicationSQL, analysisID, status, datasetID, msg); err != nil {
+		log.Error(errors.Wrapf(err, "error recording the publication of analysis %s", analysisID))
+	}
+}
+
+// submitPublication sends the publication to the publication service and
+// records the identifier of the dataset it created, or why it failed.
+func (i *Internal) submitPublication(publication *Publication) error {
+	provenance, err := i.newApps().GetAnalysisProvenance(context.Background(), publication.AnalysisID)
+	if err != nil {
+		err = errors.Wrapf(err, "error looking up the provenance of analysis %s", publication.AnalysisID)
+		i.finishPublication(publication.AnalysisID, PublicationFailed, "", err.Error())
+		return err
+	}
+
+	datasetID, err := i.createDataset(&PublicationSubmission{
+		PublicationMetadata: publication.Metadata,
+		Source:              provenance.ResultFolder,
+		Provenance:          provenance,
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "error publishing the outputs of analysis %s", publication.AnalysisID)
+		i.finishPublication(publication.AnalysisID, PublicationFailed, "", err.Error())
+		return err
+	}
+
+	log.Infof("published the outputs of analysis %s as %s", publication.AnalysisID, datasetID)
+	i.finishPublication(publication.AnalysisID, PublicationSubmitted, datasetID, "")
+	return nil
+}
+
+// createDataset posts the submission to the publication service and returns
+// the identifier of the dataset it created.
+func (i *Internal) createDataset(submission *PublicationSubmission) (string, error) {
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, i.Publication.datasetsURL(), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if i.Publication.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", i.Publication.Token))
+	}
+
+	client := &http.Client{Timeout: i.Publication.timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("the publication service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	parsed := &publicationServiceResponse{}
+	if err = json.Unmarshal(respBody, parsed); err != nil {
+		return "", errors.Wrap(err, "error parsing the response from the publication service")
+	}
+	if parsed.Identifier == "" {
+		return "", errors.New("the publication service didn't return a dataset identifier")
+	}
+
+	return parsed.Identifier, nil
+}
+
+// publishSavedOutputs submits the publication requested for an analysis that's
+// being torn down once its outputs have been saved. Nothing is published if
+// the outputs couldn't be saved, since the dataset would be incomplete.
+func (i *Internal) publishSavedOutputs(externalID string, outputsSaved bool) {
+	if !i.Publication.enabled() {
+		return
+	}
+
+	publication, err := scanPublication(i.db.QueryRowx(getRequestedPublicationSQL, externalID))
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up the publication requested for analysis %s", externalID))
+		return
+	}
+	if publication == nil {
+		return
+	}
+
+	if !outputsSaved {
+		i.finishPublication(publication.AnalysisID, PublicationFailed, "", "the outputs of the analysis could not be saved")
+		return
+	}
+
+	go func() {
+		if err := i.submitPublication(publication); err != nil {
+			log.Error(err)
+		}
+	}()
+}
+
+// requestPublication records the publication of the outputs of an analysis.
+// If the analysis is still running, its outputs are published after they've
+// been saved when it's shut down. Otherwise they're published right away.
+func (i *Internal) requestPublication(c echo.Context, analysisID, externalID, requestedBy string) error {
+	if !i.Publication.enabled() {
+		return echo.NewHTTPError(http.StatusNotImplemented, "publication of analysis outputs is not enabled")
+	}
+
+	metadata := &PublicationMetadata{}
+	if err := c.Bind(metadata); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if metadata.Title == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "title is required")
+	}
+
+	existing, err := i.getPublication(analysisID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Status == PublicationSubmitted {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("the outputs of analysis %s have already been published as %s", analysisID, existing.DatasetID))
+	}
+
+	rawMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	if _, err = i.db.Exec(requestPublicationSQL, analysisID, externalID, requestedBy, rawMetadata); err != nil {
+		return errors.Wrapf(err, "error requesting the publication of analysis %s", analysisID)
+	}
+
+	publication, err := i.getPublication(analysisID)
+	if err != nil {
+		return err
+	}
+
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return err
+	}
+	if len(deplist.Items) == 0 {
+		go func() {
+			if err := i.submitPublication(publication); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	return c.JSON(http.StatusAccepted, publication)
+}
+
+func (i *Internal) publicationResponse(c echo.Context, analysisID string) error {
+	publication, err := i.getPublication(analysisID)
+	if err != nil {
+		return err
+	}
+
+	if publication == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("the outputs of analysis %s have not been published", analysisID))
+	}
+
+	return c.JSON(http.StatusOK, publication)
+}
+
+// PublishOutputsHandler asks for the outputs of an analysis to be published to
+// the publication service, with the metadata in the body of the request. The
+// user in the 'user' query parameter needs write access to the analysis. The
+// outputs of a running analysis are published once it's been saved and shut
+// down.
+func (i *Internal) PublishOutputsHandler(c echo.Context) error {
+	externalID, err := i.userAnalysisExternalID(c, permissions.LevelWrite)
+	if err != nil {
+		return err
+	}
+
+	return i.requestPublication(c, c.Param("analysis-id"), externalID, i.fixUsername(c.QueryParam("user")))
+}
+
+// GetPublicationHandler returns the publication of the outputs of an analysis
+// that the user in the 'user' query parameter can read, including the
+// identifier of the dataset once it has been created.
+func (i *Internal) GetPublicationHandler(c echo.Context) error {
+	if _, err := i.userAnalysisExternalID(c, permissions.LevelRead); err != nil {
+		return err
+	}
+
+	return i.publicationResponse(c, c.Param("analysis-id"))
+}
+
+// AdminGetPublicationHandler returns the publication of the outputs of an
+// analysis without requiring user information.
+func (i *Internal) AdminGetPublicationHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	return i.publicationResponse(c, analysisID)
+}
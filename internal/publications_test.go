@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var publicationRows = []string{
+	"analysis_id", "external_id", "requested_by", "metadata", "status", "dataset_id", "error", "requested_at", "updated_at",
+}
+
+func publicationServer(t *testing.T, status int, body string, submissions *[]PublicationSubmission) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/datasets", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		submission := PublicationSubmission{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&submission))
+		*submissions = append(*submissions, submission)
+
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestSubmitPublication(t *testing.T) {
+	assert := assert.New(t)
+
+	submissions := []PublicationSubmission{}
+	server := publicationServer(t, http.StatusCreated, `{"identifier":"doi:10.25739/abcd-1234"}`, &submissions)
+	defer server.Close()
+
+	i, mock := setupInternal(t, nil)
+	i.Publication = PublicationConfig{URL: server.URL + "/", Token: "secret"}
+
+	mock.ExpectQuery("FROM jobs j").
+		WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"analysis_id", "analysis_name", "description", "app_id", "app_name", "username", "result_folder", "start_date", "end_date",
+		}).AddRow("a1", "notebook", "", "app1", "Jupyter Lab", "alice@example.org", "/iplant/home/alice/analyses/notebook", time.Now(), nil))
+	mock.ExpectExec("UPDATE vice_analysis_publications").
+		WithArgs("a1", PublicationSubmitted, "doi:10.25739/abcd-1234", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	publication := &Publication{AnalysisID: "a1", Metadata: PublicationMetadata{Title: "Results", Creators: []string{"Alice"}}}
+	assert.NoError(i.submitPublication(publication))
+
+	assert.Len(submissions, 1)
+	assert.Equal("Results", submissions[0].Title)
+	assert.Equal("/iplant/home/alice/analyses/notebook", submissions[0].Source)
+	assert.Equal("Jupyter Lab", submissions[0].Provenance.AppName)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCreateDatasetRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	submissions := []PublicationSubmission{}
+	server := publicationServer(t, http.StatusBadRequest, "missing creators", &submissions)
+	defer server.Close()
+
+	i, _ := setupInternal(t, nil)
+	i.Publication = PublicationConfig{URL: server.URL, Token: "secret"}
+
+	_, err := i.createDataset(&PublicationSubmission{})
+	assert.EqualError(err, "the publication service returned 400: missing creators")
+}
+
+func TestPublishSavedOutputsNotSaved(t *testing.T) {
+	i, mock := setupInternal(t, nil)
+	i.Publication = PublicationConfig{URL: "http://publication"}
+
+	mock.ExpectQuery("FROM vice_analysis_publications").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(publicationRows).
+			AddRow("a1", "e1", "alice@example.org", []byte(`{"title":"Results"}`), PublicationRequested, "", "", time.Now(), time.Now()))
+	mock.ExpectExec("UPDATE vice_analysis_publications").
+		WithArgs("a1", PublicationFailed, "", "the outputs of the analysis could not be saved").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	i.publishSavedOutputs("e1", false)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRequestPublicationDisabled(t *testing.T) {
+	i, mock := setupInternal(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/a1/publication", strings.NewReader(`{"title":"Results"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	err := i.requestPublication(c, "a1", "e1", "alice@example.org")
+	assert.Equal(t, http.StatusNotImplemented, err.(*echo.HTTPError).Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+
+	// dockerHubAuthKey is the key docker uses for Docker Hub credentials in
+	// its config files.
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+
+	registryTimeout = 30 * time.Second
+)
+
+// manifestMediaTypes are the manifest types accepted when checking whether an
+// image exists.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// imagePullSecretNames returns the names of the image pull secrets for the
+// image used by the analysis. The secrets configured for the image replace
+// the default ones.
+func (i *Internal) imagePullSecretNames(image string) []string {
+	if names, ok := i.ToolImagePullSecrets[image]; ok {
+		return names
+	}
+	return i.ImagePullSecrets
+}
+
+// imagePullSecrets returns the image pull secrets for the analysis pod,
+// covering the images of the auxiliary containers as well.
+func (i *Internal) imagePullSecrets(job *model.Job) []apiv1.LocalObjectReference {
+	images := []string{job.Steps[0].Component.Container.Image.Name}
+	for _, step := range auxiliarySteps(job) {
+		images = append(images, step.Component.Container.Image.Name)
+	}
+
+	var refs []apiv1.LocalObjectReference
+	seen := map[string]bool{}
+	for _, image := range images {
+		for _, name := range i.imagePullSecretNames(image) {
+			if !seen[name] {
+				seen[name] = true
+				refs = append(refs, apiv1.LocalObjectReference{Name: name})
+			}
+		}
+	}
+	return refs
+}
+
+// imageReference is an image name split into the registry it's pulled from
+// and the repository in that registry.
+type imageReference struct {
+	Registry   string
+	Repository string
+}
+
+// parseImageReference splits an image name, without its tag, the same way
+// docker does. Names without a registry host come from Docker Hub.
+func parseImageReference(image string) imageReference {
+	parts := strings.SplitN(image, "/", 2)
+
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return imageReference{Registry: parts[0], Repository: parts[1]}
+	}
+
+	if len(parts) == 1 {
+		return imageReference{Registry: dockerHubRegistry, Repository: "library/" + image}
+	}
+
+	return imageReference{Registry: dockerHubRegistry, Repository: image}
+}
+
+// registryCredentials are the username and password for a registry.
+type registryCredentials struct {
+	Username string
+	Password string
+}
+
+// dockerConfig is the part of a .dockerconfigjson secret that's needed to find
+// registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// credentialsFromSecret returns the credentials for the registry stored in
+// the image pull secret, or nil if it doesn't have any.
+func credentialsFromSecret(secret *apiv1.Secret, registry string) (*registryCredentials, error) {
+	data, ok := secret.Data[apiv1.DockerConfigJsonKey]
+	if !ok {
+		return nil, nil
+	}
+
+	config := &dockerConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, errors.Wrapf(err, "error parsing image pull secret %s", secret.Name)
+	}
+
+	keys := []string{registry, "https://" + registry}
+	if registry == dockerHubRegistry {
+		keys = append(keys, dockerHubAuthKey, "docker.io", "index.docker.io")
+	}
+
+	for _, key := range keys {
+		entry, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+
+		if entry.Username != "" {
+			return &registryCredentials{Username: entry.Username, Password: entry.Password}, nil
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error decoding credentials for %s in image pull secret %s", registry, secret.Name)
+		}
+
+		userpass := strings.SplitN(string(decoded), ":", 2)
+		if len(userpass) != 2 {
+			return nil, fmt.Errorf("malformed credentials for %s in image pull secret %s", registry, secret.Name)
+		}
+
+		return &registryCredentials{Username: userpass[0], Password: userpass[1]}, nil
+	}
+
+	return nil, nil
+}
+
+// registryCredentials looks through the image pull secrets for credentials for
+// the registry. It returns the name of the secret they came from as well.
+func (i *Internal) registryCredentials(secretNames []string, registry string) (*registryCredentials, string, error) {
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+
+	for _, name := range secretNames {
+		secret, err := secretclient.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "error getting image pull secret %s", name)
+		}
+
+		creds, err := credentialsFromSecret(secret, registry)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if creds != nil {
+			return creds, name, nil
+		}
+	}
+
+	return nil, "", nil
+}
+
+// parseBearerChallenge returns the parameters of a Bearer WWW-Authenticate
+// header, or nil if it isn't one.
+func parseBearerChallenge(header string) map[string]string {
+	if !strings.HasPrefix(strings.ToLower(header), "bearer ") {
+		return nil
+	}
+
+	params := map[string]string{}
+	for _, part := range strings.Split(header[len("bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	return params
+}
+
+// registryToken gets a token from the registry's token service for the
+// challenge it sent back.
+func registryToken(client *http.Client, challenge map[string]string, creds *registryCredentials) (string, error) {
+	u, err := url.Parse(challenge["realm"])
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing token realm %s", challenge["realm"])
+	}
+
+	q := u.Query()
+	if service, ok := challenge["service"]; ok {
+		q.Set("service", service)
+	}
+	if scope, ok := challenge["scope"]; ok {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if creds != nil {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "error requesting a registry token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token service returned %s", resp.Status)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "error parsing the registry token")
+	}
+
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// checkImagePullable asks the registry for the manifest of the image, logging
+// in with the credentials if it asks for them. A nil error means the image
+// can be pulled.
+func checkImagePullable(client *http.Client, scheme string, ref imageReference, tag string, creds *registryCredentials) error {
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, ref.Registry, ref.Repository, tag)
+
+	head := func(authorize func(*http.Request)) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		authorize(req)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error contacting registry %s", ref.Registry)
+		}
+		resp.Body.Close()
+		return resp, nil
+	}
+
+	resp, err := head(func(*http.Request) {})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+
+		if bearer := parseBearerChallenge(challenge); bearer != nil {
+			token, err := registryToken(client, bearer, creds)
+			if err != nil {
+				return err
+			}
+			resp, err = head(func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) })
+			if err != nil {
+				return err
+			}
+		} else if creds != nil {
+			resp, err = head(func(req *http.Request) { req.SetBasicAuth(creds.Username, creds.Password) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%s/%s:%s was not found", ref.Registry, ref.Repository, tag)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if creds == nil {
+			return fmt.Errorf("%s requires credentials and no image pull secret has any for it", ref.Registry)
+		}
+		return fmt.Errorf("the credentials for %s were rejected", ref.Registry)
+	default:
+		return fmt.Errorf("registry %s returned %s", ref.Registry, resp.Status)
+	}
+}
+
+// PullCheckRequest is the request body for checking whether an image can be
+// pulled.
+type PullCheckRequest struct {
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+}
+
+// AdminPullCheckHandler checks whether an image can be pulled from its
+// registry with the image pull secrets that analyses using it would get.
+func (i *Internal) AdminPullCheckHandler(c echo.Context) error {
+	request := &PullCheckRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if request.Image == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "image is required")
+	}
+
+	if request.Tag == "" {
+		request.Tag = "latest"
+	}
+
+	ref := parseImageReference(request.Image)
+	secretNames := i.imagePullSecretNames(request.Image)
+
+	creds, secretName, err := i.registryCredentials(secretNames, ref.Registry)
+	if err != nil {
+		return err
+	}
+
+	result := map[string]interface{}{
+		"image":            request.Image,
+		"tag":              request.Tag,
+		"registry":         ref.Registry,
+		"imagePullSecrets": secretNames,
+		"secretUsed":       secretName,
+		"pullable":         true,
+	}
+
+	client := &http.Client{Timeout: registryTimeout}
+	if err = checkImagePullable(client, "https", ref, request.Tag, creds); err != nil {
+		result["pullable"] = false
+		result["error"] = err.Error()
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
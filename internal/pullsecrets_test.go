@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestParseImageReference(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(imageReference{Registry: dockerHubRegistry, Repository: "library/ubuntu"}, parseImageReference("ubuntu"))
+	assert.Equal(imageReference{Registry: dockerHubRegistry, Repository: "discoenv/jupyter"}, parseImageReference("discoenv/jupyter"))
+	assert.Equal(imageReference{Registry: "harbor.cyverse.org", Repository: "de/vice-proxy"}, parseImageReference("harbor.cyverse.org/de/vice-proxy"))
+	assert.Equal(imageReference{Registry: "localhost:5000", Repository: "test"}, parseImageReference("localhost:5000/test"))
+}
+
+func TestImagePullSecretNames(t *testing.T) {
+	i, _ := setupInternal(t, []runtime.Object{})
+	i.ImagePullSecrets = []string{"default-secret"}
+	i.ToolImagePullSecrets = map[string][]string{"harbor.cyverse.org/private/tool": {"private-secret"}}
+
+	assert.Equal(t, []string{"default-secret"}, i.imagePullSecretNames("discoenv/jupyter"))
+	assert.Equal(t, []string{"private-secret"}, i.imagePullSecretNames("harbor.cyverse.org/private/tool"))
+}
+
+func dockerConfigSecret(name, registry, user, password string) *apiv1.Secret {
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "vice-apps"},
+		Type:       apiv1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			apiv1.DockerConfigJsonKey: []byte(`{"auths":{"` + registry + `":{"auth":"` + auth + `"}}}`),
+		},
+	}
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{
+		dockerConfigSecret("other", "quay.io", "q", "q"),
+		dockerConfigSecret("harbor", "harbor.cyverse.org", "robot", "s3cret"),
+	})
+
+	creds, name, err := i.registryCredentials([]string{"other", "harbor"}, "harbor.cyverse.org")
+	assert.NoError(err)
+	assert.Equal("harbor", name)
+	assert.Equal(&registryCredentials{Username: "robot", Password: "s3cret"}, creds)
+
+	creds, name, err = i.registryCredentials([]string{"other"}, "harbor.cyverse.org")
+	assert.NoError(err)
+	assert.Nil(creds)
+	assert.Equal("", name)
+
+	_, _, err = i.registryCredentials([]string{"missing"}, "harbor.cyverse.org")
+	assert.Error(err)
+}
+
+// fakeRegistry serves the manifest for private/tool:1.0 to clients with a
+// token, which it hands out to robot:s3cret.
+func fakeRegistry() *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "robot" || pass != "s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token":"t0ken"}`))
+		case r.Header.Get("Authorization") != "Bearer t0ken":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:private/tool:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/private/tool/manifests/1.0":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestCheckImagePullable(t *testing.T) {
+	assert := assert.New(t)
+
+	server := fakeRegistry()
+	defer server.Close()
+
+	ref := imageReference{
+		Registry:   strings.TrimPrefix(server.URL, "http://"),
+		Repository: "private/tool",
+	}
+	creds := &registryCredentials{Username: "robot", Password: "s3cret"}
+
+	assert.NoError(checkImagePullable(server.Client(), "http", ref, "1.0", creds))
+	assert.Error(checkImagePullable(server.Client(), "http", ref, "2.0", creds))
+	assert.Error(checkImagePullable(server.Client(), "http", ref, "1.0", nil))
+	assert.Error(checkImagePullable(server.Client(), "http", ref, "1.0", &registryCredentials{Username: "robot", Password: "wrong"}))
+}
@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// QuotaConfig turns on the enforcement of the aggregate CPU and memory
+// allotments of plans. The requests of a user's running analyses are added
+// up, and a launch that would push them past their plan's allotment is
+// rejected, or queued until enough of their analyses finish if Queue is true.
+type QuotaConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	Queue   bool `mapstructure:"queue"`
+}
+
+// ResourceUsage is what a user's running analyses have requested. Paused
+// analyses aren't using anything, so they're left out.
+type ResourceUsage struct {
+	Analyses    int     `json:"analyses"`
+	CPUCores    float64 `json:"cpuCores"`
+	MemoryBytes int64   `json:"memoryBytes"`
+	GPUs        int64   `json:"gpus"`
+}
+
+// addRequests adds the requests of the analysis container in the pod spec to
+// the usage.
+func (u *ResourceUsage) addRequests(spec *apiv1.PodSpec) {
+	for _, container := range spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+		requests := container.Resources.Requests
+		u.CPUCores += float64(requests.Cpu().MilliValue()) / 1000
+		u.MemoryBytes += requests.Memory().Value()
+		for _, resource := range gpuResources {
+			if quantity, ok := requests[resource]; ok {
+				u.GPUs += quantity.Value()
+			}
+		}
+	}
+}
+
+// userResourceUsage adds up the requests of the analysis containers of the
+// user's running analyses, including batch analyses that haven't finished.
+// Each replica of an array job is its own Job, so all of them are added up,
+// but the array job counts as one analysis. Analyses labeled with the legacy
+// value of the username label are included.
+func (i *Internal) userResourceUsage(user string) (*ResourceUsage, error) {
+	deployments := []appsv1.Deployment{}
+	batchJobs := []batchv1.Job{}
+	for _, username := range common.LabelValues(user) {
+		deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{"username": username}, []string{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing the analyses of %s", user)
+		}
+		deployments = append(deployments, deplist.Items...)
+
+		jobs, err := i.runningBatchJobs(username)
+		if err != nil {
+			return nil, err
+		}
+		batchJobs = append(batchJobs, jobs...)
+	}
+
+	usage := &ResourceUsage{}
+	for idx := range deployments {
+		dep := &deployments[idx]
+		if isPaused(dep) {
+			continue
+		}
+		usage.Analyses++
+		usage.addRequests(&dep.Spec.Template.Spec)
+	}
+
+	seen := map[string]bool{}
+	for idx := range batchJobs {
+		batchJob := &batchJobs[idx]
+		externalID := i.labelKeys.get(batchJob.Labels, "external-id")
+		if externalID == "" || !seen[externalID] {
+			usage.Analyses++
+			seen[externalID] = true
+		}
+		usage.addRequests(&batchJob.Spec.Template.Spec)
+	}
+
+	return usage, nil
+}
+
+// quotaExceededError returns the error for a launch that would push the user
+// past their plan's allotment of a resource. The details include what the
+// user is already using and the allotment.
+func quotaExceededError(plan *apps.UserPlan, resource string, usage *ResourceUsage, requested, used, limit interface{}, units string) error {
+	return common.ErrorResponse{
+		ErrorCode: "ERR_QUOTA_EXCEEDED",
+		Message: fmt.Sprintf(
+			"the analysis requests %v %s of %s, but the %s plan allows %v in all and %v are already in use",
+			requested, units, resource, plan.Name, limit, used,
+		),
+		Details: &map[string]interface{}{
+			"plan":      plan.Name,
+			"resource":  resource,
+			"requested": requested,
+			"usage":     usage,
+			"limit":     limit,
+		},
+	}
+}
+
+// checkQuota returns the error for the launch if it would push the user past
+// their plan's CPU or memory allotment, or nil if it fits. Each of the
+// replicas of the job requests the full amount. Users without a plan, or whose
+// plan has no allotments, aren't limited.
+func checkQuota(job *model.Job, plan *apps.UserPlan, usage *ResourceUsage, replicas int) error {
+	if plan.TotalCPUCores != nil {
+		requested := float64(cpuResourceRequest(job)) * float64(replicas)
+		if usage.CPUCores+requested > *plan.TotalCPUCores {
+			return quotaExceededError(plan, "cpu", usage, requested, usage.CPUCores, *plan.TotalCPUCores, "cores")
+		}
+	}
+
+	if plan.TotalMemory != nil {
+		requested := memResourceRequest(job) * int64(replicas)
+		if usage.MemoryBytes+requested > *plan.TotalMemory {
+			return quotaExceededError(plan, "memory", usage, requested, usage.MemoryBytes, *plan.TotalMemory, "bytes")
+		}
+	}
+
+	return nil
+}
+
+// userQuota returns the submitter's plan along with what their running
+// analyses are using. The plan is nil if the user isn't on one or it doesn't
+// have any allotments, in which case usage isn't looked up.
+func (i *Internal) userQuota(ctx context.Context, user string) (*apps.UserPlan, *ResourceUsage, error) {
+	plan, err := i.newApps().GetUserPlan(ctx, i.fixUsername(user))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error looking up the plan for %s", user)
+	}
+
+	if plan == nil || (plan.TotalCPUCores == nil && plan.TotalMemory == nil) {
+		return nil, nil, nil
+	}
+
+	usage, err := i.userResourceUsage(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plan, usage, nil
+}
+
+// validateQuota rejects launches that don't fit in the submitter's allotment
+// when quotas are enforced. If over-quota launches are queued, only launches
+// that wouldn't fit even with nothing else running are rejected; the rest are
+// held back by queueLaunchIfBusy. Either way, queueLaunchIfBusy checks again
+// along with the launches that are being let through at the same time.
+func (i *Internal) validateQuota(ctx context.Context, job *model.Job, replicas int) (int, error) {
+	if !i.Quotas.Enabled || len(job.Steps) == 0 {
+		return http.StatusOK, nil
+	}
+
+	plan, usage, err := i.userQuota(ctx, job.Submitter)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if plan == nil {
+		return http.StatusOK, nil
+	}
+
+	if i.Quotas.Queue {
+		usage = &ResourceUsage{}
+	}
+
+	if err = checkQuota(job, plan, usage, replicas); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// userQuotaState is a user's plan and what their analyses are using, for
+// deciding which queued launches fit. Plan is nil if the user isn't limited.
+type userQuotaState struct {
+	plan  *apps.UserPlan
+	usage *ResourceUsage
+}
+
+// check returns the error for the launch if it doesn't fit in the submitter's
+// allotment, or nil if it does.
+func (q *userQuotaState) check(job *model.Job) error {
+	if q == nil || q.plan == nil || len(job.Steps) == 0 {
+		return nil
+	}
+	return checkQuota(job, q.plan, q.usage, 1)
+}
+
+// held returns true if the launch has to wait in the queue until it fits in
+// the submitter's allotment.
+func (q *userQuotaState) held(job *model.Job) bool {
+	return q.check(job) != nil
+}
+
+// add counts the requests of the replicas of the job as being in use.
+func (q *userQuotaState) add(job *model.Job, replicas int) {
+	if q.plan == nil || len(job.Steps) == 0 {
+		return
+	}
+	q.usage.Analyses++
+	q.usage.CPUCores += float64(cpuResourceRequest(job)) * float64(replicas)
+	q.usage.MemoryBytes += memResourceRequest(job) * int64(replicas)
+}
+
+// userQuotas looks up the plans and usage of the submitters of the jobs,
+// keyed by submitter. Errors are logged and the user is treated as not
+// limited, so that a problem looking up usage doesn't hold launches forever.
+func (i *Internal) userQuotas(jobs []*model.Job) map[string]*userQuotaState {
+	quotas := map[string]*userQuotaState{}
+	for _, job := range jobs {
+		if _, ok := quotas[job.Submitter]; ok {
+			continue
+		}
+
+		plan, usage, err := i.userQuota(context.Background(), job.Submitter)
+		if err != nil {
+			log.Error(err)
+			plan = nil
+		}
+		quotas[job.Submitter] = &userQuotaState{plan: plan, usage: usage}
+	}
+	return quotas
+}
+
+// QuotaUsage is how much of something a user is using, along with the limit
+// and how much more they can use before reaching it. Limit and Headroom are
+// nil if the user isn't limited.
+type QuotaUsage struct {
+	Used     float64  `json:"used"`
+	Limit    *float64 `json:"limit"`
+	Headroom *float64 `json:"headroom"`
+}
+
+// newQuotaUsage returns the usage with the headroom left under the limit.
+func newQuotaUsage(used float64, limit *float64) QuotaUsage {
+	usage := QuotaUsage{Used: used, Limit: limit}
+	if limit != nil {
+		headroom := math.Max(*limit-used, 0)
+		usage.Headroom = &headroom
+	}
+	return usage
+}
+
+// QuotaReport is what a user is using and how close they are to the limits
+// enforced at launch. Limits that aren't enforced are left out.
+type QuotaReport struct {
+	Username    string     `json:"username"`
+	Plan        string     `json:"plan,omitempty"`
+	Analyses    QuotaUsage `json:"analyses"`
+	CPUCores    QuotaUsage `json:"cpuCores"`
+	MemoryBytes QuotaUsage `json:"memoryBytes"`
+	GPUs        QuotaUsage `json:"gpus"`
+	GPUHours    *GPUBudget `json:"gpuHours,omitempty"`
+}
+
+// concurrentJobLimit returns the number of analyses the user can run at once,
+// following the same rules as validateConcurrentJobs.
+func (i *Internal) concurrentJobLimit(user string, plan *apps.UserPlan) (int, error) {
+	jobLimit, err := i.getJobLimitForUser(user)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to determine the concurrent job limit for %s", user)
+	}
+	if jobLimit != nil {
+		return int(math.Max(float64(*jobLimit), 0)), nil
+	}
+
+	if i.PlanEnforcement && plan != nil && plan.MaxConcurrentJobs != nil {
+		return *plan.MaxConcurrentJobs, nil
+	}
+
+	defaultJobLimit, err := i.getDefaultJobLimit()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine the default concurrent job limit")
+	}
+	return int(math.Max(float64(defaultJobLimit), 0)), nil
+}
+
+// quotaReport returns the user's usage and the limits that apply to it.
+func (i *Internal) quotaReport(ctx context.Context, user string) (*QuotaReport, error) {
+	plan, err := i.newApps().GetUserPlan(ctx, i.fixUsername(user))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the plan for %s", user)
+	}
+
+	jobCount, err := i.countJobsForUser(ctx, user)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to determine the number of jobs that %s is currently running", user)
+	}
+
+	jobLimit, err := i.concurrentJobLimit(user, plan)
+	if err != nil {
+		return nil, err
+	}
+	analysesLimit := float64(jobLimit)
+
+	usage, err := i.userResourceUsage(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var cpuLimit, memoryLimit *float64
+	if plan != nil && i.Quotas.Enabled {
+		cpuLimit = plan.TotalCPUCores
+		if plan.TotalMemory != nil {
+			limit := float64(*plan.TotalMemory)
+			memoryLimit = &limit
+		}
+	}
+
+	report := &QuotaReport{
+		Username:    user,
+		Analyses:    newQuotaUsage(float64(jobCount), &analysesLimit),
+		CPUCores:    newQuotaUsage(usage.CPUCores, cpuLimit),
+		MemoryBytes: newQuotaUsage(float64(usage.MemoryBytes), memoryLimit),
+		GPUs:        newQuotaUsage(float64(usage.GPUs), nil),
+	}
+
+	if plan != nil {
+		report.Plan = plan.Name
+
+		// The plan's GPU ceiling is per analysis rather than a total, so the
+		// headroom is what the next launch can ask for.
+		if i.PlanEnforcement && plan.MaxGPUs != nil {
+			limit := float64(*plan.MaxGPUs)
+			report.GPUs.Limit = &limit
+			report.GPUs.Headroom = &limit
+		}
+	}
+
+	if i.Quotas.Enabled {
+		if report.GPUHours, err = i.gpuBudget(ctx, user, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// QuotaHandler returns the analyses, resource requests, and GPU-hours the user
+// in the username path parameter is using, along with their plan's limits and
+// the headroom left under them. Users can look up their own quotas; looking
+// up someone else's requires permission to view all analyses.
+func (i *Internal) QuotaHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user is not set")
+	}
+
+	username := c.Param("username")
+	if i.RBACEnabled && i.fixUsername(username) != i.fixUsername(user) && !i.roleFor(user).Has(PermissionViewAnalyses) {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot view the quotas of %s", user, username))
+	}
+
+	report, err := i.quotaReport(c.Request().Context(), username)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
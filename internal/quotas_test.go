@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func neverOverQuota(*model.Job) bool {
+	return false
+}
+
+var quotaPlanColumns = []string{"name", "max_cpu_cores", "max_memory", "max_gpus", "max_concurrent_jobs", "total_cpu_cores", "total_memory"}
+
+// requestingDeployment returns an analysis Deployment for the user whose
+// analysis container requests the CPU and memory.
+func requestingDeployment(name, user, cpu, memory string, replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-type": "interactive", "username": common.LabelValueString(user)},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name: analysisContainerName,
+							Resources: apiv1.ResourceRequirements{
+								Requests: apiv1.ResourceList{
+									apiv1.ResourceCPU:    resourcev1.MustParse(cpu),
+									apiv1.ResourceMemory: resourcev1.MustParse(memory),
+									nvidiaGPUResource:    resourcev1.MustParse("1"),
+								},
+							},
+						},
+						{
+							Name: "vice-proxy",
+							Resources: apiv1.ResourceRequirements{
+								Requests: apiv1.ResourceList{apiv1.ResourceCPU: resourcev1.MustParse("100m")},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestUserResourceUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, []runtime.Object{
+		requestingDeployment("a1", "alice", "2", "4Gi", 1),
+		requestingDeployment("a2", "alice", "500m", "1Gi", 1),
+		requestingDeployment("a3", "alice", "8", "16Gi", 0),
+		requestingDeployment("b1", "bob", "4", "8Gi", 1),
+	})
+
+	usage, err := i.userResourceUsage("alice")
+	assert.NoError(err)
+	assert.Equal(&ResourceUsage{Analyses: 2, CPUCores: 2.5, MemoryBytes: 5 * gibibyte, GPUs: 2}, usage)
+}
+
+// requestingBatchJob returns a Job for a replica of the user's batch analysis
+// whose container requests the CPU and memory. Finished Jobs have completed.
+func requestingBatchJob(name, externalID, user, cpu, memory string, finished bool) *batchv1.Job {
+	batchJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels: map[string]string{
+				"app-type":    "batch",
+				"external-id": externalID,
+				"username":    common.LabelValueString(user),
+			},
+		},
+		Spec: batchv1.JobSpec{
+			Template: requestingDeployment(name, user, cpu, memory, 1).Spec.Template,
+		},
+	}
+	if finished {
+		batchJob.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: apiv1.ConditionTrue}}
+	}
+	return batchJob
+}
+
+func TestUserResourceUsageBatchJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	// The replicas of an array job all use resources, but they're one
+	// analysis.
+	i, _ := setupInternal(t, []runtime.Object{
+		requestingDeployment("a1", "alice", "2", "4Gi", 1),
+		requestingBatchJob("b1-0", "b1", "alice", "1", "2Gi", false),
+		requestingBatchJob("b1-1", "b1", "alice", "1", "2Gi", false),
+		requestingBatchJob("b2", "b2", "alice", "4", "8Gi", true),
+		requestingBatchJob("b3", "b3", "bob", "4", "8Gi", false),
+	})
+
+	usage, err := i.userResourceUsage("alice")
+	assert.NoError(err)
+	assert.Equal(&ResourceUsage{Analyses: 2, CPUCores: 4, MemoryBytes: 8 * gibibyte, GPUs: 3}, usage)
+}
+
+func TestCheckQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	plan := &apps.UserPlan{Name: "Basic", TotalCPUCores: float64Pointer(4), TotalMemory: int64Pointer(8 * gibibyte)}
+
+	job := multiPortJob(8888)
+	job.Steps[0].Component.Container.MinCPUCores = 2
+
+	assert.NoError(checkQuota(job, plan, &ResourceUsage{CPUCores: 2, MemoryBytes: 2 * gibibyte}, 1))
+
+	err := checkQuota(job, plan, &ResourceUsage{CPUCores: 3}, 1)
+	if assert.Error(err) {
+		details := *err.(common.ErrorResponse).Details
+		assert.Equal("cpu", details["resource"])
+		assert.Equal(3.0, details["usage"].(*ResourceUsage).CPUCores)
+		assert.Equal(4.0, details["limit"])
+	}
+
+	err = checkQuota(job, plan, &ResourceUsage{MemoryBytes: 7 * gibibyte}, 1)
+	if assert.Error(err) {
+		assert.Equal("memory", (*err.(common.ErrorResponse).Details)["resource"])
+	}
+
+	// Each replica of an array job requests the full amount.
+	err = checkQuota(job, plan, &ResourceUsage{}, 3)
+	if assert.Error(err) {
+		assert.Equal(6.0, (*err.(common.ErrorResponse).Details)["requested"])
+	}
+
+	// Plans without allotments don't limit anything.
+	assert.NoError(checkQuota(job, &apps.UserPlan{Name: "Unlimited"}, &ResourceUsage{CPUCores: 100}, 1))
+}
+
+func TestValidateQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		requestingDeployment("a1", "test-user", "3", "2Gi", 1),
+	})
+
+	job := multiPortJob(8888)
+	job.Submitter = "test-user"
+	job.Steps[0].Component.Container.MinCPUCores = 2
+
+	expectPlan := func() {
+		mock.ExpectQuery("FROM user_plans").
+			WithArgs("test-user" + testConfig.UserSuffix).
+			WillReturnRows(sqlmock.NewRows(quotaPlanColumns).AddRow("Basic", nil, nil, nil, nil, 4.0, nil))
+	}
+
+	// Quotas are ignored unless they're enabled.
+	status, err := i.validateQuota(context.Background(), job, 1)
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	i.Quotas.Enabled = true
+	expectPlan()
+	status, err = i.validateQuota(context.Background(), job, 1)
+	assert.Equal(400, status)
+	if assert.Error(err) {
+		assert.Equal("ERR_QUOTA_EXCEEDED", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	// When over-quota launches are queued, the launch gets through validation
+	// and waits in the queue instead.
+	i.Quotas.Queue = true
+	expectPlan()
+	status, err = i.validateQuota(context.Background(), job, 1)
+	assert.NoError(err)
+	assert.Equal(200, status)
+
+	expectPlan()
+	assert.True(i.userQuotas([]*model.Job{job})["test-user"].held(job))
+
+	// Launches that could never fit are still rejected.
+	job.Steps[0].Component.Container.MinCPUCores = 6
+	expectPlan()
+	status, err = i.validateQuota(context.Background(), job, 1)
+	assert.Equal(400, status)
+	assert.Error(err)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestQueueLaunchRechecksQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.Quotas.Enabled = true
+
+	expectPlan := func() {
+		mock.ExpectQuery("FROM vice_app_concurrency_limits").
+			WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_running", "updated_at"}))
+		mock.ExpectQuery("FROM user_plans").
+			WithArgs("test-user" + testConfig.UserSuffix).
+			WillReturnRows(sqlmock.NewRows(quotaPlanColumns).AddRow("Basic", nil, nil, nil, nil, 4.0, nil))
+	}
+
+	job := func(externalID string) *model.Job {
+		job := multiPortJob(8888)
+		job.InvocationID = externalID
+		job.AppID = "app"
+		job.Submitter = "test-user"
+		job.Steps[0].Component.Container.MinCPUCores = 3
+		return job
+	}
+
+	// Both launches fit on their own, but only the first one gets the room.
+	expectPlan()
+	position, err := i.queueLaunchIfBusy(job("e1"))
+	assert.NoError(err)
+	assert.Nil(position)
+
+	expectPlan()
+	_, err = i.queueLaunchIfBusy(job("e2"))
+	if assert.Error(err) {
+		assert.Equal("ERR_QUOTA_EXCEEDED", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	// Queued over-quota launches wait instead.
+	i.Quotas.Queue = true
+	expectPlan()
+	position, err = i.queueLaunchIfBusy(job("e2"))
+	assert.NoError(err)
+	if assert.NotNil(position) {
+		assert.Equal(1, position.Position)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNextAdmissibleSkipsOverQuota(t *testing.T) {
+	now := time.Now()
+	first := queued("e1", "alice", now)
+	second := queued("e2", "bob", now)
+
+	aliceOverQuota := func(job *model.Job) bool { return job.Submitter == "alice" }
+
+	assert.Equal(t, second, nextAdmissible([]*queuedLaunch{first, second}, map[string]*AppConcurrencyLimit{}, map[string]int{}, aliceOverQuota))
+	assert.Nil(t, nextAdmissible([]*queuedLaunch{first}, map[string]*AppConcurrencyLimit{}, map[string]int{}, aliceOverQuota))
+}
+
+func TestQuotaHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		requestingDeployment("a1", "test-user", "2", "4Gi", 1),
+		requestingDeployment("a2", "test-user", "1", "2Gi", 1),
+	})
+	i.PlanEnforcement = true
+	i.Quotas.Enabled = true
+
+	planRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows(gpuPlanColumns).AddRow("Basic", nil, nil, 1, 4, 8.0, int64(16*gibibyte), 10.0)
+	}
+	mock.ExpectQuery("FROM user_plans").WithArgs("test-user" + testConfig.UserSuffix).WillReturnRows(planRow())
+	registerLimitQuery(mock, "test-user", nil)
+	mock.ExpectQuery("FROM vice_usage_records").
+		WithArgs("test-user", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"hours"}).AddRow(3.0))
+	mock.ExpectQuery("FROM user_plans").WithArgs("test-user" + testConfig.UserSuffix).WillReturnRows(planRow())
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/vice/quota/test-user?user=test-user", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("username")
+	c.SetParamValues("test-user")
+
+	assert.NoError(i.QuotaHandler(c))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	var report QuotaReport
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal("Basic", report.Plan)
+
+	assert.Equal(2.0, report.Analyses.Used)
+	assert.Equal(4.0, *report.Analyses.Limit)
+	assert.Equal(2.0, *report.Analyses.Headroom)
+
+	assert.Equal(3.0, report.CPUCores.Used)
+	assert.Equal(5.0, *report.CPUCores.Headroom)
+	assert.Equal(float64(10*gibibyte), *report.MemoryBytes.Headroom)
+
+	assert.Equal(2.0, report.GPUs.Used)
+	assert.Equal(1.0, *report.GPUs.Limit)
+
+	if assert.NotNil(report.GPUHours) {
+		assert.Equal(7.0, *report.GPUHours.RemainingHours)
+	}
+}
+
+func TestQuotaHandlerOtherUser(t *testing.T) {
+	i, _ := setupInternal(t, []runtime.Object{})
+	i.RBACEnabled = true
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/vice/quota/bob?user=alice", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("username")
+	c.SetParamValues("bob")
+
+	err := i.QuotaHandler(c)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+}
@@ -0,0 +1,413 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Reference dataset sources.
+const (
+	// ReferenceSourcePVC mounts a pre-provisioned PersistentVolumeClaim in the
+	// VICE namespace.
+	ReferenceSourcePVC = "pvc"
+
+	// ReferenceSourceIRODS mounts an iRODS collection through the iRODS CSI
+	// driver, as the user who launched the analysis.
+	ReferenceSourceIRODS = "irods"
+)
+
+const (
+	referenceDataMountRoot     = "/reference"
+	referenceDataVolumePrefix  = "ref-"
+	maxReferenceDataNameLength = validation.DNS1123LabelMaxLength - len(referenceDataVolumePrefix)
+)
+
+// ReferenceDataset is a curated, read-only dataset such as a reference genome
+// or a set of model weights that analyses can ask to have mounted.
+type ReferenceDataset struct {
+	ID          string    `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	SourceType  string    `json:"sourceType" db:"source_type"`
+	Source      string    `json:"source" db:"source"`
+	MountPath   string    `json:"mountPath" db:"mount_path"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt   time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// ReferenceDatasetUsage is how much a reference dataset has been used.
+type ReferenceDatasetUsage struct {
+	Name           string `json:"name" db:"name"`
+	Launches       int    `json:"launches" db:"launches"`
+	RecentLaunches int    `json:"launchesLast30Days" db:"recent_launches"`
+	UniqueUsers    int    `json:"uniqueUsers" db:"unique_users"`
+	Running        int    `json:"running" db:"running"`
+}
+
+const referenceDatasetColumns = `
+	SELECT id, name, description, source_type, source, mount_path, created_at, updated_at
+	  FROM vice_reference_datasets
+`
+
+const listReferenceDatasetsSQL = referenceDatasetColumns + `
+	 ORDER BY name
+`
+
+const getReferenceDatasetsByNameSQL = referenceDatasetColumns + `
+	 WHERE name = ANY($1)
+	 ORDER BY name
+`
+
+const analysisReferenceDatasetsSQL = `
+	SELECT d.id, d.name, d.description, d.source_type, d.source, d.mount_path, d.created_at, d.updated_at
+	  FROM vice_reference_datasets d
+	  JOIN vice_analysis_reference_data a ON a.dataset_id = d.id
+	 WHERE a.external_id = $1
+	 ORDER BY d.name
+`
+
+const insertReferenceDatasetSQL = `
+	INSERT INTO vice_reference_datasets
+		(name, description, source_type, source, mount_path, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, now(), now())
+	RETURNING id, name, description, source_type, source, mount_path, created_at, updated_at
+`
+
+const updateReferenceDatasetSQL = `
+	UPDATE vice_reference_datasets
+	   SET description = $2,
+	       source_type = $3,
+	       source = $4,
+	       mount_path = $5,
+	       updated_at = now()
+	 WHERE name = $1
+	RETURNING id, name, description, source_type, source, mount_path, created_at, updated_at
+`
+
+const deleteReferenceDatasetSQL = `
+	DELETE FROM vice_reference_datasets
+	 WHERE name = $1
+`
+
+const recordAnalysisReferenceDataSQL = `
+	INSERT INTO vice_analysis_reference_data (external_id, dataset_id, mounted_at)
+	VALUES ($1, $2, now())
+	ON CONFLICT (external_id, dataset_id) DO NOTHING
+`
+
+const referenceDatasetUsageSQL = `
+	SELECT d.name,
+	       count(a.external_id) AS launches,
+	       count(a.external_id) FILTER (WHERE a.mounted_at >= now() - interval '30 days') AS recent_launches,
+	       count(DISTINCT j.user_id) AS unique_users,
+	       count(a.external_id) FILTER (WHERE j.status = 'Running') AS running
+	  FROM vice_reference_datasets d
+	  LEFT JOIN vice_analysis_reference_data a ON a.dataset_id = d.id
+	  LEFT JOIN job_steps s ON s.external_id = a.external_id
+	  LEFT JOIN jobs j ON j.id = s.job_id
+	 GROUP BY d.name
+	 ORDER BY d.name
+`
+
+// validateReferenceDataset fills in the default mount path and returns an
+// error if the dataset can't be mounted.
+func validateReferenceDataset(d *ReferenceDataset) error {
+	problems := []string{}
+
+	if len(d.Name) > maxReferenceDataNameLength {
+		problems = append(problems, fmt.Sprintf("name must be at most %d characters", maxReferenceDataNameLength))
+	}
+	for _, msg := range validation.IsDNS1123Label(d.Name) {
+		problems = append(problems, fmt.Sprintf("name %s: %s", d.Name, msg))
+	}
+
+	switch d.SourceType {
+	case ReferenceSourcePVC:
+		for _, msg := range validation.IsDNS1123Subdomain(d.Source) {
+			problems = append(problems, fmt.Sprintf("source %s: %s", d.Source, msg))
+		}
+	case ReferenceSourceIRODS:
+		if !path.IsAbs(d.Source) {
+			problems = append(problems, fmt.Sprintf("source %s must be an absolute iRODS path", d.Source))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("sourceType must be %s or %s", ReferenceSourcePVC, ReferenceSourceIRODS))
+	}
+
+	if d.MountPath == "" {
+		d.MountPath = path.Join(referenceDataMountRoot, d.Name)
+	}
+	if !path.IsAbs(d.MountPath) || path.Clean(d.MountPath) == "/" {
+		problems = append(problems, fmt.Sprintf("mountPath %s must be an absolute path other than /", d.MountPath))
+	}
+	d.MountPath = path.Clean(d.MountPath)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_INVALID_REFERENCE_DATASET",
+		Message:   fmt.Sprintf("the reference dataset is invalid: %s", strings.Join(problems, "; ")),
+		Details: &map[string]interface{}{
+			"problems": problems,
+		},
+	}
+}
+
+// lookupReferenceData returns the catalog entries for the dataset names
+// requested at launch, or an ErrorResponse naming the ones that aren't in the
+// catalog.
+func (i *Internal) lookupReferenceData(names []string) ([]ReferenceDataset, error) {
+	datasets := []ReferenceDataset{}
+	if len(names) == 0 {
+		return datasets, nil
+	}
+
+	if err := i.db.Select(&datasets, getReferenceDatasetsByNameSQL, pq.Array(names)); err != nil {
+		return nil, errors.Wrap(err, "error looking up the requested reference data")
+	}
+
+	found := map[string]bool{}
+	for _, d := range datasets {
+		found[d.Name] = true
+	}
+
+	missing := []string{}
+	for _, name := range names {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, common.ErrorResponse{
+			ErrorCode: "ERR_UNKNOWN_REFERENCE_DATA",
+			Message:   fmt.Sprintf("reference datasets %s aren't in the catalog", strings.Join(missing, ", ")),
+			Details: &map[string]interface{}{
+				"missing": missing,
+			},
+		}
+	}
+
+	return datasets, nil
+}
+
+// recordReferenceData records the datasets to mount for the analysis. The
+// record is what getDeployment mounts from, and what usage is counted from.
+func (i *Internal) recordReferenceData(externalID string, datasets []ReferenceDataset) error {
+	for _, d := range datasets {
+		if _, err := i.db.Exec(recordAnalysisReferenceDataSQL, externalID, d.ID); err != nil {
+			return errors.Wrapf(err, "error recording reference dataset %s for analysis %s", d.Name, externalID)
+		}
+	}
+	return nil
+}
+
+// referenceDataVolume returns the read-only volume for the dataset.
+func referenceDataVolume(job *model.Job, d *ReferenceDataset) (apiv1.Volume, error) {
+	volume := apiv1.Volume{Name: referenceDataVolumePrefix + d.Name}
+
+	switch d.SourceType {
+	case ReferenceSourcePVC:
+		volume.VolumeSource = apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: d.Source,
+				ReadOnly:  true,
+			},
+		}
+	case ReferenceSourceIRODS:
+		mappings, err := json.Marshal([]IRODSFSPathMapping{
+			{
+				IRODSPath:    d.Source,
+				MappingPath:  "/",
+				ResourceType: "dir",
+			},
+		})
+		if err != nil {
+			return volume, err
+		}
+
+		readOnly := true
+		volume.VolumeSource = apiv1.VolumeSource{
+			CSI: &apiv1.CSIVolumeSource{
+				Driver:   csiDriverName,
+				ReadOnly: &readOnly,
+				VolumeAttributes: map[string]string{
+					"client":            "irodsfuse",
+					"path_mapping_json": string(mappings),
+					"clientUser":        job.Submitter,
+				},
+			},
+		}
+	default:
+		return volume, fmt.Errorf("reference dataset %s has unsupported source type %s", d.Name, d.SourceType)
+	}
+
+	return volume, nil
+}
+
+// recordedReferenceData returns the reference datasets recorded for the
+// analysis.
+func (i *Internal) recordedReferenceData(externalID string) ([]ReferenceDataset, error) {
+	datasets := []ReferenceDataset{}
+	if err := i.db.Select(&datasets, analysisReferenceDatasetsSQL, externalID); err != nil {
+		return nil, errors.Wrapf(err, "error looking up the reference data for analysis %s", externalID)
+	}
+	return datasets, nil
+}
+
+// mountReferenceData mounts the reference datasets read-only into the
+// analysis container and its auxiliary containers.
+func mountReferenceData(job *model.Job, datasets []ReferenceDataset, spec *apiv1.PodSpec) error {
+	for idx := range datasets {
+		d := &datasets[idx]
+
+		volume, err := referenceDataVolume(job, d)
+		if err != nil {
+			return err
+		}
+		spec.Volumes = append(spec.Volumes, volume)
+
+		mount := apiv1.VolumeMount{
+			Name:      volume.Name,
+			MountPath: d.MountPath,
+			ReadOnly:  true,
+		}
+		for c := range spec.Containers {
+			name := spec.Containers[c].Name
+			if name == analysisContainerName || strings.HasPrefix(name, auxiliaryContainerPrefix) {
+				spec.Containers[c].VolumeMounts = append(spec.Containers[c].VolumeMounts, mount)
+			}
+		}
+	}
+
+	return nil
+}
+
+// addReferenceData mounts the reference datasets recorded for the analysis
+// read-only into the analysis container and its auxiliary containers. The
+// datasets are returned.
+func (i *Internal) addReferenceData(job *model.Job, spec *apiv1.PodSpec) ([]ReferenceDataset, error) {
+	datasets, err := i.recordedReferenceData(job.InvocationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = mountReferenceData(job, datasets, spec); err != nil {
+		return nil, err
+	}
+
+	return datasets, nil
+}
+
+// ListReferenceDataHandler lists the reference datasets that can be requested
+// at launch.
+func (i *Internal) ListReferenceDataHandler(c echo.Context) error {
+	datasets := []ReferenceDataset{}
+	if err := i.db.Select(&datasets, listReferenceDatasetsSQL); err != nil {
+		return errors.Wrap(err, "error listing the reference data")
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ReferenceDataset{
+		"datasets": datasets,
+	})
+}
+
+// AdminAddReferenceDataHandler adds a dataset to the reference data catalog.
+func (i *Internal) AdminAddReferenceDataHandler(c echo.Context) error {
+	request := &ReferenceDataset{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateReferenceDataset(request); err != nil {
+		return err
+	}
+
+	dataset := &ReferenceDataset{}
+	err := i.db.QueryRowx(
+		insertReferenceDatasetSQL,
+		request.Name, request.Description, request.SourceType, request.Source, request.MountPath,
+	).StructScan(dataset)
+	if err != nil {
+		return errors.Wrapf(err, "error adding reference dataset %s", request.Name)
+	}
+
+	return c.JSON(http.StatusCreated, dataset)
+}
+
+// AdminUpdateReferenceDataHandler changes a dataset in the reference data
+// catalog. Running analyses keep the volume they were launched with.
+func (i *Internal) AdminUpdateReferenceDataHandler(c echo.Context) error {
+	request := &ReferenceDataset{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	request.Name = c.Param("name")
+
+	if err := validateReferenceDataset(request); err != nil {
+		return err
+	}
+
+	dataset := &ReferenceDataset{}
+	err := i.db.QueryRowx(
+		updateReferenceDatasetSQL,
+		request.Name, request.Description, request.SourceType, request.Source, request.MountPath,
+	).StructScan(dataset)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("reference dataset %s not found", request.Name))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error updating reference dataset %s", request.Name)
+	}
+
+	return c.JSON(http.StatusOK, dataset)
+}
+
+// AdminDeleteReferenceDataHandler removes a dataset from the reference data
+// catalog.
+func (i *Internal) AdminDeleteReferenceDataHandler(c echo.Context) error {
+	name := c.Param("name")
+
+	result, err := i.db.Exec(deleteReferenceDatasetSQL, name)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting reference dataset %s", name)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("reference dataset %s not found", name))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminReferenceDataUsageHandler returns how often each reference dataset has
+// been mounted, by how many users, and by how many running analyses.
+func (i *Internal) AdminReferenceDataUsageHandler(c echo.Context) error {
+	usage := []ReferenceDatasetUsage{}
+	if err := i.db.Select(&usage, referenceDatasetUsageSQL); err != nil {
+		return errors.Wrap(err, "error looking up the reference data usage")
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ReferenceDatasetUsage{
+		"usage": usage,
+	})
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+var referenceDatasetRowColumns = []string{
+	"id", "name", "description", "source_type", "source", "mount_path", "created_at", "updated_at",
+}
+
+func TestValidateReferenceDataset(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &ReferenceDataset{Name: "hg38", SourceType: ReferenceSourcePVC, Source: "hg38-genome"}
+	assert.NoError(validateReferenceDataset(d))
+	assert.Equal("/reference/hg38", d.MountPath)
+
+	d = &ReferenceDataset{Name: "llama", SourceType: ReferenceSourceIRODS, Source: "/iplant/home/shared/llama", MountPath: "/models/llama/"}
+	assert.NoError(validateReferenceDataset(d))
+	assert.Equal("/models/llama", d.MountPath)
+
+	assert.Error(validateReferenceDataset(&ReferenceDataset{Name: "HG38", SourceType: ReferenceSourcePVC, Source: "hg38"}))
+	assert.Error(validateReferenceDataset(&ReferenceDataset{Name: "hg38", SourceType: "nfs", Source: "hg38"}))
+	assert.Error(validateReferenceDataset(&ReferenceDataset{Name: "hg38", SourceType: ReferenceSourceIRODS, Source: "shared/hg38"}))
+	assert.Error(validateReferenceDataset(&ReferenceDataset{Name: "hg38", SourceType: ReferenceSourcePVC, Source: "hg38", MountPath: "/"}))
+}
+
+func TestLookupReferenceData(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	datasets, err := internal.lookupReferenceData(nil)
+	assert.NoError(err)
+	assert.Empty(datasets)
+
+	now := time.Now()
+	mock.ExpectQuery("FROM vice_reference_datasets").
+		WillReturnRows(sqlmock.NewRows(referenceDatasetRowColumns).
+			AddRow("d1", "hg38", "", ReferenceSourcePVC, "hg38-genome", "/reference/hg38", now, now))
+
+	_, err = internal.lookupReferenceData([]string{"hg38", "mm10"})
+	assert.Error(err)
+	assert.Equal("ERR_UNKNOWN_REFERENCE_DATA", err.(common.ErrorResponse).ErrorCode)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAddReferenceData(t *testing.T) {
+	assert := assert.New(t)
+	internal, mock := setupInternal(t, nil)
+
+	job := auxiliaryJob(5432)
+	now := time.Now()
+	mock.ExpectQuery("JOIN vice_analysis_reference_data").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows(referenceDatasetRowColumns).
+			AddRow("d1", "hg38", "", ReferenceSourcePVC, "hg38-genome", "/reference/hg38", now, now).
+			AddRow("d2", "llama", "", ReferenceSourceIRODS, "/iplant/home/shared/llama", "/reference/llama", now, now))
+
+	spec := &apiv1.PodSpec{Containers: internal.deploymentContainers(job)}
+	datasets, err := internal.addReferenceData(job, spec)
+	assert.NoError(err)
+	assert.Len(datasets, 2)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	assert.Len(spec.Volumes, 2)
+	assert.Equal("hg38-genome", spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+	assert.True(spec.Volumes[0].PersistentVolumeClaim.ReadOnly)
+	assert.Equal(csiDriverName, spec.Volumes[1].CSI.Driver)
+	assert.True(*spec.Volumes[1].CSI.ReadOnly)
+	assert.Equal("ipctest", spec.Volumes[1].CSI.VolumeAttributes["clientUser"])
+
+	for _, container := range spec.Containers {
+		mounted := false
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == "ref-hg38" {
+				mounted = true
+				assert.True(mount.ReadOnly)
+				assert.Equal("/reference/hg38", mount.MountPath)
+			}
+		}
+		expected := container.Name == analysisContainerName || container.Name == "aux-postgres-db"
+		assert.Equal(expected, mounted, container.Name)
+	}
+}
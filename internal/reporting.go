@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
@@ -8,7 +9,6 @@ import (
 	"strings"
 
 	"github.com/cyverse-de/app-exposer/apps"
-	"github.com/cyverse-de/app-exposer/permissions"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/apps/v1"
@@ -20,15 +20,7 @@ import (
 )
 
 func getListSelector(customLabels map[string]string) labels.Selector {
-	allLabels := map[string]string{
-		"app-type": "interactive",
-	}
-
-	for k, v := range customLabels {
-		allLabels[k] = v
-	}
-
-	set := labels.Set(allLabels)
+	set := labels.Set(customLabels)
 
 	return set.AsSelector()
 }
@@ -60,8 +52,23 @@ func getListOptions(customLabels map[string]string, missingLabels []string) meta
 	}
 }
 
+// listOptions returns the ListOptions for listing the VICE resources that have
+// the labels in customLabels but are missing the ones in missingLabels, both
+// of which use the bare label keys.
+func (i *Internal) listOptions(customLabels map[string]string, missingLabels []string) metav1.ListOptions {
+	allLabels := map[string]string{
+		"app-type": "interactive",
+	}
+
+	for k, v := range customLabels {
+		allLabels[k] = v
+	}
+
+	return getListOptions(i.labelKeys.selector(allLabels), i.labelKeys.selectorKeys(missingLabels))
+}
+
 func (i *Internal) deploymentList(namespace string, customLabels map[string]string, missingLabels []string) (*v1.DeploymentList, error) {
-	listOptions := getListOptions(customLabels, missingLabels)
+	listOptions := i.listOptions(customLabels, missingLabels)
 
 	depList, err := i.clientset.AppsV1().Deployments(namespace).List(listOptions)
 	if err != nil {
@@ -72,7 +79,7 @@ func (i *Internal) deploymentList(namespace string, customLabels map[string]stri
 }
 
 func (i *Internal) podList(namespace string, customLabels map[string]string, missingLabels []string) (*corev1.PodList, error) {
-	listOptions := getListOptions(customLabels, missingLabels)
+	listOptions := i.listOptions(customLabels, missingLabels)
 
 	podList, err := i.clientset.CoreV1().Pods(namespace).List(listOptions)
 	if err != nil {
@@ -83,7 +90,7 @@ func (i *Internal) podList(namespace string, customLabels map[string]string, mis
 }
 
 func (i *Internal) configmapsList(namespace string, customLabels map[string]string, missingLabels []string) (*corev1.ConfigMapList, error) {
-	listOptions := getListOptions(customLabels, missingLabels)
+	listOptions := i.listOptions(customLabels, missingLabels)
 
 	cfgList, err := i.clientset.CoreV1().ConfigMaps(namespace).List(listOptions)
 	if err != nil {
@@ -94,7 +101,7 @@ func (i *Internal) configmapsList(namespace string, customLabels map[string]stri
 }
 
 func (i *Internal) serviceList(namespace string, customLabels map[string]string, missingLabels []string) (*corev1.ServiceList, error) {
-	listOptions := getListOptions(customLabels, missingLabels)
+	listOptions := i.listOptions(customLabels, missingLabels)
 
 	svcList, err := i.clientset.CoreV1().Services(namespace).List(listOptions)
 	if err != nil {
@@ -105,7 +112,7 @@ func (i *Internal) serviceList(namespace string, customLabels map[string]string,
 }
 
 func (i *Internal) ingressList(namespace string, customLabels map[string]string, missingLabels []string) (*extv1b1.IngressList, error) {
-	listOptions := getListOptions(customLabels, missingLabels)
+	listOptions := i.listOptions(customLabels, missingLabels)
 
 	ingList, err := i.clientset.ExtensionsV1beta1().Ingresses(namespace).List(listOptions)
 	if err != nil {
@@ -119,6 +126,10 @@ func filterMap(values url.Values) map[string]string {
 	q := map[string]string{}
 
 	for k, v := range values {
+		// The user parameter identifies the caller, it isn't a label.
+		if k == "user" {
+			continue
+		}
 		q[k] = v[0]
 	}
 
@@ -138,6 +149,34 @@ type MetaInfo struct {
 	CreationTimestamp string `json:"creationTimestamp"`
 }
 
+// metaInfo returns the MetaInfo for a VICE resource. The original names from
+// the annotations are preferred over the label values, which may have been
+// changed to make them valid labels. Resources created before the annotations
+// were added only have the labels.
+func (i *Internal) metaInfo(obj metav1.Object) MetaInfo {
+	labels := obj.GetLabels()
+	annotations := obj.GetAnnotations()
+
+	original := func(annotation, label string) string {
+		if value, ok := annotations[annotation]; ok && value != "" {
+			return value
+		}
+		return i.labelKeys.get(labels, label)
+	}
+
+	return MetaInfo{
+		Name:              obj.GetName(),
+		Namespace:         obj.GetNamespace(),
+		AnalysisName:      original(analysisNameAnnotation, "analysis-name"),
+		AppName:           original(appNameAnnotation, "app-name"),
+		AppID:             i.labelKeys.get(labels, "app-id"),
+		ExternalID:        i.labelKeys.get(labels, "external-id"),
+		UserID:            i.labelKeys.get(labels, "user-id"),
+		Username:          original(usernameAnnotation, "username"),
+		CreationTimestamp: obj.GetCreationTimestamp().String(),
+	}
+}
+
 // DeploymentInfo contains information returned about a Deployment.
 type DeploymentInfo struct {
 	MetaInfo
@@ -146,18 +185,31 @@ type DeploymentInfo struct {
 	Port    int32    `json:"port"`
 	User    int64    `json:"user"`
 	Group   int64    `json:"group"`
+
+	// GPUResource is the extended resource the analysis gets its GPUs through
+	// and GPUs is how many it has.
+	GPUResource string `json:"gpuResource,omitempty"`
+	GPUs        int64  `json:"gpus"`
+
+	// Paused is true if the analysis has been scaled down by a pause.
+	Paused bool `json:"paused"`
+
+	// BillableSeconds is the accumulated billable runtime of the analysis,
+	// if it has been in a billable state.
+	BillableSeconds *int64 `json:"billableSeconds,omitempty"`
 }
 
-func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
+func (i *Internal) deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
 	var (
 		user    int64
 		group   int64
 		image   string
 		port    int32
 		command []string
+		gpuRes  string
+		gpus    int64
 	)
 
-	labels := deployment.GetObjectMeta().GetLabels()
 	containers := deployment.Spec.Template.Spec.Containers
 
 	for _, container := range containers {
@@ -167,28 +219,24 @@ func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
 			port = container.Ports[0].ContainerPort
 			user = *container.SecurityContext.RunAsUser
 			group = *container.SecurityContext.RunAsGroup
+			gpuRes, gpus = gpuAllocation(&container)
 		}
 
 	}
 
 	return &DeploymentInfo{
-		MetaInfo: MetaInfo{
-			Name:              deployment.GetName(),
-			Namespace:         deployment.GetNamespace(),
-			AnalysisName:      labels["analysis-name"],
-			AppName:           labels["app-name"],
-			AppID:             labels["app-id"],
-			ExternalID:        labels["external-id"],
-			UserID:            labels["user-id"],
-			Username:          labels["username"],
-			CreationTimestamp: deployment.GetCreationTimestamp().String(),
-		},
+		MetaInfo: i.metaInfo(deployment),
 
 		Image:   image,
 		Command: command,
 		Port:    port,
 		User:    user,
 		Group:   group,
+
+		GPUResource: gpuRes,
+		GPUs:        gpus,
+
+		Paused: isPaused(deployment),
 	}
 }
 
@@ -200,23 +248,13 @@ type PodInfo struct {
 	Reason                string                   `json:"reason"`
 	ContainerStatuses     []corev1.ContainerStatus `json:"containerStatuses"`
 	InitContainerStatuses []corev1.ContainerStatus `json:"initContainerStatuses"`
+	MountHealth           *MountHealth             `json:"mountHealth,omitempty"`
+	PendingReason         string                   `json:"pendingReason,omitempty"`
 }
 
-func podInfo(pod *corev1.Pod) *PodInfo {
-	labels := pod.GetObjectMeta().GetLabels()
-
+func (i *Internal) podInfo(pod *corev1.Pod) *PodInfo {
 	return &PodInfo{
-		MetaInfo: MetaInfo{
-			Name:              pod.GetName(),
-			Namespace:         pod.GetNamespace(),
-			AnalysisName:      labels["analysis-name"],
-			AppName:           labels["app-name"],
-			AppID:             labels["app-id"],
-			ExternalID:        labels["external-id"],
-			UserID:            labels["user-id"],
-			Username:          labels["username"],
-			CreationTimestamp: pod.GetCreationTimestamp().String(),
-		},
+		MetaInfo:              i.metaInfo(pod),
 		Phase:                 string(pod.Status.Phase),
 		Message:               pod.Status.Message,
 		Reason:                pod.Status.Reason,
@@ -231,22 +269,10 @@ type ConfigMapInfo struct {
 	Data map[string]string `json:"data"`
 }
 
-func configMapInfo(cm *corev1.ConfigMap) *ConfigMapInfo {
-	labels := cm.GetObjectMeta().GetLabels()
-
+func (i *Internal) configMapInfo(cm *corev1.ConfigMap) *ConfigMapInfo {
 	return &ConfigMapInfo{
-		MetaInfo: MetaInfo{
-			Name:              cm.GetName(),
-			Namespace:         cm.GetNamespace(),
-			AnalysisName:      labels["analysis-name"],
-			AppName:           labels["app-name"],
-			AppID:             labels["app-id"],
-			ExternalID:        labels["external-id"],
-			UserID:            labels["user-id"],
-			Username:          labels["username"],
-			CreationTimestamp: cm.GetCreationTimestamp().String(),
-		},
-		Data: cm.Data,
+		MetaInfo: i.metaInfo(cm),
+		Data:     cm.Data,
 	}
 }
 
@@ -260,41 +286,37 @@ type ServiceInfoPort struct {
 	Protocol       string `json:"protocol"`
 }
 
-//ServiceInfo contains info about a service
+// ServiceInfo contains info about a service
 type ServiceInfo struct {
 	MetaInfo
-	Ports []ServiceInfoPort `json:"ports"`
+	Ports          []ServiceInfoPort `json:"ports"`
+	Endpoints      []ServiceEndpoint `json:"endpoints"`
+	ReadyEndpoints int               `json:"readyEndpoints"`
 }
 
-func serviceInfo(svc *corev1.Service) *ServiceInfo {
-	labels := svc.GetObjectMeta().GetLabels()
-
+func (i *Internal) serviceInfo(svc *corev1.Service) *ServiceInfo {
 	ports := svc.Spec.Ports
 	svcInfoPorts := []ServiceInfoPort{}
 
 	for _, port := range ports {
+		// The API server defaults the protocol to TCP when it isn't set.
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+
 		svcInfoPorts = append(svcInfoPorts, ServiceInfoPort{
 			Name:           port.Name,
 			NodePort:       port.NodePort,
 			TargetPort:     port.TargetPort.IntVal,
 			TargetPortName: port.TargetPort.String(),
 			Port:           port.Port,
-			Protocol:       string(port.Protocol),
+			Protocol:       string(protocol),
 		})
 	}
 
 	return &ServiceInfo{
-		MetaInfo: MetaInfo{
-			Name:              svc.GetName(),
-			Namespace:         svc.GetNamespace(),
-			AnalysisName:      labels["analysis-name"],
-			AppName:           labels["app-name"],
-			AppID:             labels["app-id"],
-			ExternalID:        labels["external-id"],
-			UserID:            labels["user-id"],
-			Username:          labels["username"],
-			CreationTimestamp: svc.GetCreationTimestamp().String(),
-		},
+		MetaInfo: i.metaInfo(svc),
 
 		Ports: svcInfoPorts,
 	}
@@ -307,22 +329,10 @@ type IngressInfo struct {
 	Rules          []extv1b1.IngressRule `json:"rules"`
 }
 
-func ingressInfo(ingress *extv1b1.Ingress) *IngressInfo {
-	labels := ingress.GetObjectMeta().GetLabels()
-
+func (i *Internal) ingressInfo(ingress *extv1b1.Ingress) *IngressInfo {
 	return &IngressInfo{
-		MetaInfo: MetaInfo{
-			Name:              ingress.GetName(),
-			Namespace:         ingress.GetNamespace(),
-			AnalysisName:      labels["analysis-name"],
-			AppName:           labels["app-name"],
-			AppID:             labels["app-id"],
-			ExternalID:        labels["external-id"],
-			UserID:            labels["user-id"],
-			Username:          labels["username"],
-			CreationTimestamp: ingress.GetCreationTimestamp().String(),
-		},
-		Rules: ingress.Spec.Rules,
+		MetaInfo: i.metaInfo(ingress),
+		Rules:    ingress.Spec.Rules,
 		DefaultBackend: fmt.Sprintf(
 			"%s:%d",
 			ingress.Spec.Backend.ServiceName,
@@ -340,10 +350,17 @@ func (i *Internal) getFilteredDeployments(filter map[string]string) ([]Deploymen
 	deployments := []DeploymentInfo{}
 
 	for _, dep := range depList.Items {
-		info := deploymentInfo(&dep)
+		info := i.deploymentInfo(&dep)
 		deployments = append(deployments, *info)
 	}
 
+	metas := []*MetaInfo{}
+	for idx := range deployments {
+		metas = append(metas, &deployments[idx].MetaInfo)
+	}
+	i.backfillMetaInfo(metas)
+	i.addUptimes(deployments)
+
 	return deployments, nil
 }
 
@@ -370,10 +387,18 @@ func (i *Internal) getFilteredPods(filter map[string]string) ([]PodInfo, error)
 	pods := []PodInfo{}
 
 	for _, pod := range podList.Items {
-		info := podInfo(&pod)
+		info := i.podInfo(&pod)
 		pods = append(pods, *info)
 	}
 
+	i.addPendingReasons(podList.Items, pods)
+
+	metas := []*MetaInfo{}
+	for idx := range pods {
+		metas = append(metas, &pods[idx].MetaInfo)
+	}
+	i.backfillMetaInfo(metas)
+
 	return pods, nil
 }
 
@@ -400,10 +425,16 @@ func (i *Internal) getFilteredConfigMaps(filter map[string]string) ([]ConfigMapI
 	cms := []ConfigMapInfo{}
 
 	for _, cm := range cmList.Items {
-		info := configMapInfo(&cm)
+		info := i.configMapInfo(&cm)
 		cms = append(cms, *info)
 	}
 
+	metas := []*MetaInfo{}
+	for idx := range cms {
+		metas = append(metas, &cms[idx].MetaInfo)
+	}
+	i.backfillMetaInfo(metas)
+
 	return cms, nil
 }
 
@@ -427,13 +458,35 @@ func (i *Internal) getFilteredServices(filter map[string]string) ([]ServiceInfo,
 		return nil, err
 	}
 
+	// Failing to look up the endpoints shouldn't keep the services from being listed.
+	endpoints, err := i.serviceEndpoints()
+	if err != nil {
+		log.Error(err)
+		endpoints = map[string][]ServiceEndpoint{}
+	}
+
 	svcs := []ServiceInfo{}
 
 	for _, svc := range svcList.Items {
-		info := serviceInfo(&svc)
+		info := i.serviceInfo(&svc)
+		info.Endpoints = endpoints[svc.Name]
+		if info.Endpoints == nil {
+			info.Endpoints = []ServiceEndpoint{}
+		}
+		for _, endpoint := range info.Endpoints {
+			if endpoint.Ready {
+				info.ReadyEndpoints++
+			}
+		}
 		svcs = append(svcs, *info)
 	}
 
+	metas := []*MetaInfo{}
+	for idx := range svcs {
+		metas = append(metas, &svcs[idx].MetaInfo)
+	}
+	i.backfillMetaInfo(metas)
+
 	return svcs, nil
 }
 
@@ -460,14 +513,20 @@ func (i *Internal) getFilteredIngresses(filter map[string]string) ([]IngressInfo
 	ingresses := []IngressInfo{}
 
 	for _, ingress := range ingList.Items {
-		info := ingressInfo(&ingress)
+		info := i.ingressInfo(&ingress)
 		ingresses = append(ingresses, *info)
 	}
 
+	metas := []*MetaInfo{}
+	for idx := range ingresses {
+		metas = append(metas, &ingresses[idx].MetaInfo)
+	}
+	i.backfillMetaInfo(metas)
+
 	return ingresses, nil
 }
 
-//FilterableIngressesHandler lists ingresses in use by VICE apps.
+// FilterableIngressesHandler lists ingresses in use by VICE apps.
 func (i *Internal) FilterableIngressesHandler(c echo.Context) error {
 	filter := filterMap(c.Request().URL.Query())
 
@@ -489,6 +548,7 @@ type ResourceInfo struct {
 	ConfigMaps  []ConfigMapInfo  `json:"configMaps"`
 	Services    []ServiceInfo    `json:"services"`
 	Ingresses   []IngressInfo    `json:"ingresses"`
+	Tunnels     []TunnelInfo     `json:"tunnels,omitempty"`
 }
 
 func (i *Internal) fixUsername(username string) string {
@@ -519,18 +579,28 @@ func (i *Internal) doResourceListing(filter map[string]string) (*ResourceInfo, e
 		return nil, err
 	}
 
-	ingresses, err := i.getFilteredIngresses(filter)
-	if err != nil {
-		return nil, err
-	}
-
-	return &ResourceInfo{
+	info := &ResourceInfo{
 		Deployments: deployments,
 		Pods:        pods,
 		ConfigMaps:  cms,
 		Services:    svcs,
-		Ingresses:   ingresses,
-	}, nil
+		Ingresses:   []IngressInfo{},
+	}
+
+	// Analyses served through tunnels don't have Ingresses, so the state of
+	// their tunnels is listed instead.
+	if i.tunnelEnabled() {
+		if info.Tunnels, err = i.getFilteredTunnels(filter); err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+
+	if info.Ingresses, err = i.getFilteredIngresses(filter); err != nil {
+		return nil, err
+	}
+
+	return info, nil
 }
 
 // AdminDescribeAnalysisHandler returns a listing entry for a single analysis
@@ -538,14 +608,17 @@ func (i *Internal) doResourceListing(filter map[string]string) (*ResourceInfo, e
 func (i *Internal) AdminDescribeAnalysisHandler(c echo.Context) error {
 	host := c.Param("host")
 
-	filter := map[string]string{
-		"subdomain": host,
+	filter, err := i.hostFilter(host)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
 	listing, err := i.doResourceListing(filter)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	i.addMountHealth(listing)
+
 	return c.JSON(http.StatusOK, listing)
 
 }
@@ -562,8 +635,8 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 	// Since some usernames don't come through the labelling process unscathed, we have to use
 	// the user ID.
 	fixedUser := i.fixUsername(user)
-	a := apps.NewApps(i.db, i.UserSuffix)
-	_, err := a.GetUserID(fixedUser)
+	a := i.newApps()
+	_, err := a.GetUserID(c.Request().Context(), fixedUser)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", fixedUser))
@@ -573,8 +646,9 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 
 	host := c.Param("host")
 
-	filter := map[string]string{
-		"subdomain": host,
+	filter, err := i.hostFilter(host)
+	if err != nil {
+		return err
 	}
 
 	listing, err := i.doResourceListing(filter)
@@ -588,17 +662,13 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 	// is set in the database.
 	if len(listing.Deployments) > 0 {
 		externalID := listing.Deployments[0].ExternalID
-		analysisID, err := a.GetAnalysisIDByExternalID(externalID)
+		analysisID, err := a.GetAnalysisIDByExternalID(c.Request().Context(), externalID)
 		if err != nil {
 			return err
 		}
 
 		// Make sure the user has permissions to look up info about this analysis.
-		p := &permissions.Permissions{
-			BaseURL: i.PermissionsURL,
-		}
-
-		allowed, err := p.IsAllowed(user, analysisID)
+		allowed, err := i.permissions.IsAllowed(c.Request().Context(), user, analysisID)
 		if err != nil {
 			return err
 		}
@@ -608,11 +678,14 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 		}
 	}
 
+	i.addMountHealth(listing)
+
 	return c.JSON(http.StatusOK, listing)
 }
 
 // FilterableResourcesHandler returns all of the k8s resources associated with a VICE analysis
 // but checks permissions to see if the requesting user has permission to access the resource.
+// Analyses shared with the user or with a group they belong to are included.
 func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 	user := c.QueryParam("user")
 	if user == "" {
@@ -622,8 +695,8 @@ func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 	// Since some usernames don't come through the labelling process unscathed, we have to use
 	// the user ID.
 	user = i.fixUsername(user)
-	a := apps.NewApps(i.db, i.UserSuffix)
-	userID, err := a.GetUserID(user)
+	a := i.newApps()
+	userID, err := a.GetUserID(c.Request().Context(), user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", user))
@@ -632,7 +705,6 @@ func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 	}
 
 	filter := filterMap(c.Request().URL.Query())
-	delete(filter, "user")
 
 	filter["user-id"] = userID
 
@@ -643,15 +715,24 @@ func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
+	// The user's own analyses are still listed if the shared ones can't be.
+	delete(filter, "user-id")
+	if err = i.addSharedAnalyses(c.Request().Context(), user, filter, listing); err != nil {
+		log.Error(err)
+	}
+
 	return c.JSON(http.StatusOK, listing)
 
 }
 
 // AdminFilterableResourcesHandler returns all of the k8s resources associated with a VICE analysis.
+// Listings may be served from a short-lived cache; sending a "Cache-Control: no-cache" header
+// bypasses it.
 func (i *Internal) AdminFilterableResourcesHandler(c echo.Context) error {
 	filter := filterMap(c.Request().URL.Query())
+	bypass := c.Request().Header.Get("Cache-Control") == "no-cache"
 
-	listing, err := i.doResourceListing(filter)
+	listing, err := i.cachedResourceListing(filter, bypass)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -659,27 +740,47 @@ func (i *Internal) AdminFilterableResourcesHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, listing)
 }
 
-func populateAnalysisID(a *apps.Apps, existingLabels map[string]string) (map[string]string, error) {
-	if _, ok := existingLabels["analysis-id"]; !ok {
-		externalID, ok := existingLabels["external-id"]
-		if !ok {
+// lookupAnalysisIDs looks up the analysis IDs for all of the label sets that
+// are missing one in a single query, keyed by external ID.
+func (i *Internal) lookupAnalysisIDs(a *apps.Apps, labelSets []map[string]string) map[string]string {
+	externalIDs := []string{}
+	for _, existingLabels := range labelSets {
+		if i.labelKeys.has(existingLabels, "analysis-id") {
+			continue
+		}
+		if externalID := i.labelKeys.get(existingLabels, "external-id"); externalID != "" {
+			externalIDs = append(externalIDs, externalID)
+		}
+	}
+
+	analysisIDs, err := a.GetAnalysisIDsByExternalIDs(context.Background(), externalIDs)
+	if err != nil {
+		log.Debug(errors.Wrap(err, "error getting analysis ids"))
+		return map[string]string{}
+	}
+	return analysisIDs
+}
+
+func (i *Internal) populateAnalysisID(analysisIDs map[string]string, existingLabels map[string]string) (map[string]string, error) {
+	if !i.labelKeys.has(existingLabels, "analysis-id") {
+		externalID := i.labelKeys.get(existingLabels, "external-id")
+		if externalID == "" {
 			return existingLabels, fmt.Errorf("missing external-id key")
 		}
-		analysisID, err := a.GetAnalysisIDByExternalID(externalID)
-		if err != nil {
-			log.Debug(errors.Wrapf(err, "error getting analysis id for external id %s", externalID))
+		if analysisID, ok := analysisIDs[externalID]; ok {
+			i.labelKeys.set(existingLabels, "analysis-id", analysisID)
 		} else {
-			existingLabels["analysis-id"] = analysisID
+			log.Debugf("analysis id for external id %s not found", externalID)
 		}
 	}
 	return existingLabels, nil
 }
 
-func populateSubdomain(existingLabels map[string]string) map[string]string {
-	if _, ok := existingLabels["subdomain"]; !ok {
-		if externalID, ok := existingLabels["external-id"]; ok {
-			if userID, ok := existingLabels["user-id"]; ok {
-				existingLabels["subdomain"] = IngressName(userID, externalID)
+func (i *Internal) populateSubdomain(existingLabels map[string]string) map[string]string {
+	if !i.labelKeys.has(existingLabels, "subdomain") {
+		if externalID := i.labelKeys.get(existingLabels, "external-id"); externalID != "" {
+			if userID := i.labelKeys.get(existingLabels, "user-id"); userID != "" {
+				i.labelKeys.set(existingLabels, "subdomain", IngressName(userID, externalID))
 			}
 		}
 	}
@@ -687,49 +788,71 @@ func populateSubdomain(existingLabels map[string]string) map[string]string {
 	return existingLabels
 }
 
-func populateLoginIP(a *apps.Apps, existingLabels map[string]string) (map[string]string, error) {
-	if _, ok := existingLabels["login-ip"]; !ok {
-		if userID, ok := existingLabels["user-id"]; ok {
-			ipAddr, err := a.GetUserIP(userID)
+func (i *Internal) populateLoginIP(a *apps.Apps, existingLabels map[string]string) (map[string]string, error) {
+	if !i.labelKeys.has(existingLabels, "login-ip") {
+		if userID := i.labelKeys.get(existingLabels, "user-id"); userID != "" {
+			ipAddr, err := a.GetUserIP(context.Background(), userID)
 			if err != nil {
 				return existingLabels, err
 			}
-			existingLabels["login-ip"] = ipAddr
+			i.labelKeys.set(existingLabels, "login-ip", ipAddr)
 		}
 	}
 
 	return existingLabels, nil
 }
 
+// relabelMissingLabels returns the labels that resources need to be missing
+// to be relabeled. While the label keys are being migrated, every resource is
+// relabeled so that the prefixed keys get added to it.
+func (i *Internal) relabelMissingLabels() []string {
+	if i.labelKeys.migrate {
+		return []string{}
+	}
+	return []string{"subdomain"}
+}
+
 func (i *Internal) relabelDeployments() []error {
 	filter := map[string]string{} // Empty on purpose. Only filter based on interactive label.
 	errors := []error{}
 
-	a := apps.NewApps(i.db, i.UserSuffix)
+	a := i.newApps()
 
-	deployments, err := i.deploymentList(i.ViceNamespace, filter, []string{"subdomain"})
+	deployments, err := i.deploymentList(i.ViceNamespace, filter, i.relabelMissingLabels())
 	if err != nil {
 		errors = append(errors, err)
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, deployment := range deployments.Items {
+		labelSets = append(labelSets, deployment.GetLabels())
+	}
+	analysisIDs := i.lookupAnalysisIDs(a, labelSets)
+
 	for _, deployment := range deployments.Items {
 		existingLabels := deployment.GetLabels()
+		original := copyLabels(existingLabels)
 
-		existingLabels = populateSubdomain(existingLabels)
+		i.labelKeys.migrateLabels(existingLabels)
 
-		existingLabels, err = populateLoginIP(a, existingLabels)
+		existingLabels = i.populateSubdomain(existingLabels)
+
+		existingLabels, err = i.populateLoginIP(a, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(a, existingLabels)
+		existingLabels, err = i.populateAnalysisID(analysisIDs, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
 		deployment.SetLabels(existingLabels)
-		_, err = i.clientset.AppsV1().Deployments(i.ViceNamespace).Update(&deployment)
+		err = i.applyLabels(v1.SchemeGroupVersion.WithKind("Deployment"), deployment.Name, original, existingLabels, func() error {
+			_, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).Update(&deployment)
+			return err
+		})
 		if err != nil {
 			errors = append(errors, err)
 		}
@@ -742,31 +865,43 @@ func (i *Internal) relabelConfigMaps() []error {
 	filter := map[string]string{} // Empty on purpose. Only filter based on interactive label.
 	errors := []error{}
 
-	a := apps.NewApps(i.db, i.UserSuffix)
+	a := i.newApps()
 
-	cms, err := i.configmapsList(i.ViceNamespace, filter, []string{"subdomain"})
+	cms, err := i.configmapsList(i.ViceNamespace, filter, i.relabelMissingLabels())
 	if err != nil {
 		errors = append(errors, err)
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, configmap := range cms.Items {
+		labelSets = append(labelSets, configmap.GetLabels())
+	}
+	analysisIDs := i.lookupAnalysisIDs(a, labelSets)
+
 	for _, configmap := range cms.Items {
 		existingLabels := configmap.GetLabels()
+		original := copyLabels(existingLabels)
+
+		i.labelKeys.migrateLabels(existingLabels)
 
-		existingLabels = populateSubdomain(existingLabels)
+		existingLabels = i.populateSubdomain(existingLabels)
 
-		existingLabels, err = populateLoginIP(a, existingLabels)
+		existingLabels, err = i.populateLoginIP(a, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(a, existingLabels)
+		existingLabels, err = i.populateAnalysisID(analysisIDs, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
 		configmap.SetLabels(existingLabels)
-		_, err = i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).Update(&configmap)
+		err = i.applyLabels(corev1.SchemeGroupVersion.WithKind("ConfigMap"), configmap.Name, original, existingLabels, func() error {
+			_, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).Update(&configmap)
+			return err
+		})
 		if err != nil {
 			errors = append(errors, err)
 		}
@@ -779,31 +914,43 @@ func (i *Internal) relabelServices() []error {
 	filter := map[string]string{} // Empty on purpose. Only filter based on interactive label.
 	errors := []error{}
 
-	a := apps.NewApps(i.db, i.UserSuffix)
+	a := i.newApps()
 
-	svcs, err := i.serviceList(i.ViceNamespace, filter, []string{"subdomain"})
+	svcs, err := i.serviceList(i.ViceNamespace, filter, i.relabelMissingLabels())
 	if err != nil {
 		errors = append(errors, err)
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, service := range svcs.Items {
+		labelSets = append(labelSets, service.GetLabels())
+	}
+	analysisIDs := i.lookupAnalysisIDs(a, labelSets)
+
 	for _, service := range svcs.Items {
 		existingLabels := service.GetLabels()
+		original := copyLabels(existingLabels)
+
+		i.labelKeys.migrateLabels(existingLabels)
 
-		existingLabels = populateSubdomain(existingLabels)
+		existingLabels = i.populateSubdomain(existingLabels)
 
-		existingLabels, err = populateLoginIP(a, existingLabels)
+		existingLabels, err = i.populateLoginIP(a, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(a, existingLabels)
+		existingLabels, err = i.populateAnalysisID(analysisIDs, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
 		service.SetLabels(existingLabels)
-		_, err = i.clientset.CoreV1().Services(i.ViceNamespace).Update(&service)
+		err = i.applyLabels(corev1.SchemeGroupVersion.WithKind("Service"), service.Name, original, existingLabels, func() error {
+			_, err := i.clientset.CoreV1().Services(i.ViceNamespace).Update(&service)
+			return err
+		})
 		if err != nil {
 			errors = append(errors, err)
 		}
@@ -816,31 +963,43 @@ func (i *Internal) relabelIngresses() []error {
 	filter := map[string]string{} // Empty on purpose. Only filter based on interactive label.
 	errors := []error{}
 
-	a := apps.NewApps(i.db, i.UserSuffix)
+	a := i.newApps()
 
-	ingresses, err := i.ingressList(i.ViceNamespace, filter, []string{"subdomain"})
+	ingresses, err := i.ingressList(i.ViceNamespace, filter, i.relabelMissingLabels())
 	if err != nil {
 		errors = append(errors, err)
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, ingress := range ingresses.Items {
+		labelSets = append(labelSets, ingress.GetLabels())
+	}
+	analysisIDs := i.lookupAnalysisIDs(a, labelSets)
+
 	for _, ingress := range ingresses.Items {
 		existingLabels := ingress.GetLabels()
+		original := copyLabels(existingLabels)
 
-		existingLabels = populateSubdomain(existingLabels)
+		i.labelKeys.migrateLabels(existingLabels)
 
-		existingLabels, err = populateLoginIP(a, existingLabels)
+		existingLabels = i.populateSubdomain(existingLabels)
+
+		existingLabels, err = i.populateLoginIP(a, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(a, existingLabels)
+		existingLabels, err = i.populateAnalysisID(analysisIDs, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
 		ingress.SetLabels(existingLabels)
-		_, err = i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace).Update(&ingress)
+		err = i.applyLabels(extv1b1.SchemeGroupVersion.WithKind("Ingress"), ingress.Name, original, existingLabels, func() error {
+			_, err := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace).Update(&ingress)
+			return err
+		})
 		if err != nil {
 			errors = append(errors, err)
 		}
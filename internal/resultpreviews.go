@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	// maxPreviewBytes is the most of each result file that's returned.
+	maxPreviewBytes = 256 * 1024
+
+	// previewTimeout is how long reading a result file is allowed to take.
+	previewTimeout = 10 * time.Second
+
+	// defaultWorkingDir is where apps run when the tool doesn't say.
+	defaultWorkingDir = "/de-app-work"
+)
+
+// ResultPreview is the start of a result file declared in an app's result
+// manifest. Text files are returned in Content and anything else is returned
+// base64-encoded in ContentBase64.
+type ResultPreview struct {
+	Path          string `json:"path"`
+	ContentType   string `json:"contentType"`
+	Content       string `json:"content,omitempty"`
+	ContentBase64 string `json:"contentBase64,omitempty"`
+	Truncated     bool   `json:"truncated"`
+	Error         string `json:"error,omitempty"`
+}
+
+// previewCommand returns the command that reads up to one byte more than the
+// preview limit, so that truncation can be detected.
+func previewCommand(filePath string) []string {
+	return []string{"head", "-c", fmt.Sprintf("%d", maxPreviewBytes+1), filePath}
+}
+
+// previewContentType returns the content type for the file from its extension.
+func previewContentType(filePath string) string {
+	if contentType := mime.TypeByExtension(path.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// isTextContent returns true if the content can be returned as a string.
+func isTextContent(contentType string, content []byte) bool {
+	mediaType := strings.SplitN(contentType, ";", 2)[0]
+	textual := strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		mediaType == "application/xml" ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml")
+	return textual && utf8.Valid(content)
+}
+
+// analysisWorkingDir returns the working directory of the analysis container
+// in the pod, which relative manifest paths are resolved against.
+func analysisWorkingDir(pod *apiv1.Pod) string {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == analysisContainerName && container.WorkingDir != "" {
+			return container.WorkingDir
+		}
+	}
+	return defaultWorkingDir
+}
+
+// resultPreview reads the start of the result file from the analysis
+// container. Problems reading one file are reported in its preview rather
+// than failing the others.
+func (i *Internal) resultPreview(pod *apiv1.Pod, manifestPath string) ResultPreview {
+	filePath := manifestPath
+	if !path.IsAbs(filePath) {
+		filePath = path.Join(analysisWorkingDir(pod), filePath)
+	}
+
+	preview := ResultPreview{
+		Path:        manifestPath,
+		ContentType: previewContentType(filePath),
+	}
+
+	stdout, stderr, err := i.execWithTimeout(pod.Namespace, pod.Name, analysisContainerName, previewCommand(filePath), previewTimeout)
+	if err != nil {
+		preview.Error = strings.TrimSpace(fmt.Sprintf("%s %s", err.Error(), stderr))
+		return preview
+	}
+
+	content := []byte(stdout)
+	if len(content) > maxPreviewBytes {
+		content = content[:maxPreviewBytes]
+		preview.Truncated = true
+	}
+
+	if isTextContent(preview.ContentType, content) {
+		preview.Content = string(content)
+	} else {
+		preview.ContentBase64 = base64.StdEncoding.EncodeToString(content)
+	}
+
+	return preview
+}
+
+// resultPreviews returns the previews of the result files declared for the
+// app running in the pod.
+func (i *Internal) resultPreviews(pod *apiv1.Pod) []ResultPreview {
+	previews := []ResultPreview{}
+	for _, manifestPath := range i.ResultManifests[i.labelKeys.get(pod.Labels, "app-id")] {
+		previews = append(previews, i.resultPreview(pod, manifestPath))
+	}
+	return previews
+}
+
+// resultPreviewResponse returns the previews for the analysis served from the
+// host. If user isn't empty, they have to be allowed to access the analysis.
+func (i *Internal) resultPreviewResponse(c echo.Context, host, user string) error {
+	if i.podExecutor == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "result previews are not enabled")
+	}
+
+	filter, err := i.hostFilter(host)
+	if err != nil {
+		return err
+	}
+
+	podList, err := i.podList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return err
+	}
+
+	var pod *apiv1.Pod
+	for idx := range podList.Items {
+		if podList.Items[idx].Status.Phase == apiv1.PodRunning {
+			pod = &podList.Items[idx]
+			break
+		}
+	}
+
+	if pod == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no running analysis found for host %s", host))
+	}
+
+	if user != "" {
+		analysisID, err := i.newApps().GetAnalysisIDByExternalID(c.Request().Context(), i.labelKeys.get(pod.Labels, "external-id"))
+		if err != nil {
+			return errors.Wrapf(err, "error looking up the analysis ID for host %s", host)
+		}
+
+		allowed, err := i.permissions.IsAllowed(c.Request().Context(), user, analysisID)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string][]ResultPreview{
+		"results": i.resultPreviews(pod),
+	})
+}
+
+// ResultPreviewHandler returns the start of each of the result files declared
+// for the app of the analysis served from the host, if the user in the 'user'
+// query parameter can access it.
+func (i *Internal) ResultPreviewHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	return i.resultPreviewResponse(c, c.Param("host"), user)
+}
+
+// AdminResultPreviewHandler returns the start of each of the result files
+// declared for the app of the analysis served from the host without requiring
+// user information.
+func (i *Internal) AdminResultPreviewHandler(c echo.Context) error {
+	return i.resultPreviewResponse(c, c.Param("host"), "")
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fileExecutor is a PodExecutor that returns the contents of files, keyed by
+// the last argument of the command.
+type fileExecutor struct {
+	files map[string]string
+}
+
+func (f *fileExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	content, ok := f.files[command[len(command)-1]]
+	if !ok {
+		return "", "head: cannot open file", errors.New("command terminated with exit code 1")
+	}
+	return content, "", nil
+}
+
+func previewPod(workingDir string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"app-id": "app1", "external-id": "e1"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{Name: analysisContainerName, WorkingDir: workingDir},
+			},
+		},
+	}
+}
+
+func TestResultPreviews(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.ResultManifests = map[string][]string{
+		"app1": {"metrics.json", "/srv/plot.png", "missing.html", "big.txt"},
+	}
+	internal.SetPodExecutor(&fileExecutor{files: map[string]string{
+		"/de-app-work/metrics.json": `{"accuracy": 0.9}`,
+		"/srv/plot.png":             "\x89PNG",
+		"/de-app-work/big.txt":      strings.Repeat("a", maxPreviewBytes+1),
+	}})
+
+	previews := internal.resultPreviews(previewPod(""))
+	assert.Len(previews, 4)
+
+	assert.Equal("metrics.json", previews[0].Path)
+	assert.Equal("application/json", previews[0].ContentType)
+	assert.Equal(`{"accuracy": 0.9}`, previews[0].Content)
+	assert.False(previews[0].Truncated)
+
+	assert.Equal("image/png", previews[1].ContentType)
+	assert.Empty(previews[1].Content)
+	assert.Equal("iVBORw==", previews[1].ContentBase64)
+
+	assert.Contains(previews[2].Error, "cannot open file")
+
+	assert.True(previews[3].Truncated)
+	assert.Len(previews[3].Content, maxPreviewBytes)
+}
+
+func TestResultPreviewsWorkingDir(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+	internal.ResultManifests = map[string][]string{"app1": {"report.html"}}
+	internal.SetPodExecutor(&fileExecutor{files: map[string]string{
+		"/work/report.html": "<h1>done</h1>",
+	}})
+
+	previews := internal.resultPreviews(previewPod("/work"))
+	assert.Equal(t, "<h1>done</h1>", previews[0].Content)
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Role is the level of access someone has to VICE.
+type Role string
+
+// Roles, from least to most access. Each one has all of the permissions of
+// the roles before it.
+const (
+	RoleUser     Role = "user"
+	RoleSupport  Role = "support"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// Permission is something a role allows someone to do.
+type Permission string
+
+// Permissions checked by the routes.
+const (
+	// PermissionUseAnalyses allows launching and managing your own analyses.
+	PermissionUseAnalyses Permission = "analyses:use-own"
+
+	// PermissionViewAnalyses allows looking at anyone's analyses.
+	PermissionViewAnalyses Permission = "analyses:view-all"
+
+	// PermissionControlAnalyses allows changing anyone's analyses, such as
+	// terminating them or extending their time limits.
+	PermissionControlAnalyses Permission = "analyses:control-all"
+
+	// PermissionManageUsers allows changing what users are allowed to do, such
+	// as freezing their launches.
+	PermissionManageUsers Permission = "users:manage"
+
+	// PermissionExecAnalyses allows opening a shell inside anyone's analysis.
+	PermissionExecAnalyses Permission = "analyses:exec"
+)
+
+// roleOrder lists the roles from most to least access.
+var roleOrder = []Role{RoleAdmin, RoleOperator, RoleSupport, RoleUser}
+
+// rolePermissions lists the permissions granted by each role.
+var rolePermissions = map[Role][]Permission{
+	RoleUser: {
+		PermissionUseAnalyses,
+	},
+	RoleSupport: {
+		PermissionUseAnalyses,
+		PermissionViewAnalyses,
+	},
+	RoleOperator: {
+		PermissionUseAnalyses,
+		PermissionViewAnalyses,
+		PermissionControlAnalyses,
+	},
+	RoleAdmin: {
+		PermissionUseAnalyses,
+		PermissionViewAnalyses,
+		PermissionControlAnalyses,
+		PermissionManageUsers,
+		PermissionExecAnalyses,
+	},
+}
+
+// Permissions returns the permissions granted by the role.
+func (r Role) Permissions() []Permission {
+	return rolePermissions[r]
+}
+
+// Has returns true if the role grants the permission.
+func (r Role) Has(permission Permission) bool {
+	for _, p := range r.Permissions() {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRoleMembers returns an error if roles are assigned that don't exist.
+// Everyone not listed has the user role, so it can't be assigned.
+func ValidateRoleMembers(members map[string][]string) error {
+	problems := []string{}
+
+	for role := range members {
+		switch Role(role) {
+		case RoleSupport, RoleOperator, RoleAdmin:
+		default:
+			problems = append(problems, fmt.Sprintf("role %s can't be assigned", role))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid role assignments: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// roleFor returns the role of the user. Users listed under more than one
+// role get the one with the most access.
+func (i *Internal) roleFor(user string) Role {
+	user = i.fixUsername(user)
+
+	for _, role := range roleOrder {
+		for _, member := range i.RoleMembers[string(role)] {
+			if i.fixUsername(member) == user {
+				return role
+			}
+		}
+	}
+
+	return RoleUser
+}
+
+// RequirePermission returns middleware that only lets the request through if
+// the authenticated user has a role granting the permission. The user comes
+// from the identity token rather than the 'user' query parameter, which is
+// set to the authenticated user for the handler. Requests are let through
+// unchecked unless role-based access control is turned on.
+func (i *Internal) RequirePermission(permission Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !i.RBACEnabled {
+				return next(c)
+			}
+
+			user, err := i.authenticate(c)
+			if err != nil {
+				return err
+			}
+
+			if role := i.roleFor(user); !role.Has(permission) {
+				return echo.NewHTTPError(
+					http.StatusForbidden,
+					fmt.Sprintf("user %s has the %s role, which does not grant %s", user, role, permission),
+				)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// MyPermissionsHandler returns the role of the user in the 'user' query
+// parameter and the permissions it grants.
+func (i *Internal) MyPermissionsHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user is not set")
+	}
+
+	role := i.roleFor(user)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"user":        user,
+		"role":        role,
+		"permissions": role.Permissions(),
+		"enforced":    i.RBACEnabled,
+	})
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolePermissions(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(RoleUser.Has(PermissionUseAnalyses))
+	assert.False(RoleUser.Has(PermissionViewAnalyses))
+	assert.True(RoleSupport.Has(PermissionViewAnalyses))
+	assert.False(RoleSupport.Has(PermissionControlAnalyses))
+	assert.True(RoleOperator.Has(PermissionControlAnalyses))
+	assert.False(RoleOperator.Has(PermissionManageUsers))
+	assert.True(RoleAdmin.Has(PermissionManageUsers))
+	assert.False(RoleOperator.Has(PermissionExecAnalyses))
+	assert.True(RoleAdmin.Has(PermissionExecAnalyses))
+	assert.False(Role("nobody").Has(PermissionUseAnalyses))
+}
+
+func TestValidateRoleMembers(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateRoleMembers(nil))
+	assert.NoError(ValidateRoleMembers(map[string][]string{"admin": {"alice"}, "support": {"bob"}}))
+	assert.Error(ValidateRoleMembers(map[string][]string{"user": {"alice"}}))
+	assert.Error(ValidateRoleMembers(map[string][]string{"superuser": {"alice"}}))
+}
+
+func TestRoleFor(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.RoleMembers = map[string][]string{
+		"support":  {"bob", "carol"},
+		"operator": {"carol"},
+		"admin":    {"alice" + testConfig.UserSuffix},
+	}
+
+	assert.Equal(RoleAdmin, internal.roleFor("alice"))
+	assert.Equal(RoleSupport, internal.roleFor("bob"+testConfig.UserSuffix))
+	assert.Equal(RoleOperator, internal.roleFor("carol"))
+	assert.Equal(RoleUser, internal.roleFor("dave"))
+}
+
+func TestRequirePermission(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.RoleMembers = map[string][]string{"support": {"bob"}}
+	internal.IdentityKey = testIdentityKey
+
+	ok := func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}
+	admin := internal.RequirePermission(PermissionViewAnalyses)(ok)
+	user := internal.RequirePermission(PermissionUseAnalyses)(ok)
+
+	call := func(handler echo.HandlerFunc, query, token string) error {
+		req := httptest.NewRequest(http.MethodGet, "/vice/admin/listing"+query, nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		return handler(echo.New().NewContext(req, httptest.NewRecorder()))
+	}
+
+	// Nothing is checked until role-based access control is on.
+	assert.NoError(call(admin, "?user=dave", ""))
+	assert.NoError(call(user, "?user=dave", ""))
+
+	internal.RBACEnabled = true
+
+	// The user parameter doesn't count as being authenticated.
+	err := call(admin, "?user=bob", "")
+	if assert.Error(err) {
+		assert.Equal(http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+	}
+
+	err = call(admin, "", userToken(t, "dave"))
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	err = call(admin, "?user=bob", userToken(t, "dave"))
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(call(admin, "", userToken(t, "bob")))
+
+	err = call(user, "?user=dave", "")
+	if assert.Error(err) {
+		assert.Equal(http.StatusUnauthorized, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(call(user, "?user=dave", userToken(t, "dave")))
+}
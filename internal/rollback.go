@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// launchResourceKind lists and deletes the resources of one kind that are
+// created for an analysis.
+type launchResourceKind struct {
+	kind   string
+	list   func(opts metav1.ListOptions) (runtime.Object, error)
+	delete func(name string) error
+}
+
+// launchResourceKinds returns the kinds of resources created for analyses, in
+// the order they're removed when a launch is rolled back: routing first, so
+// that nothing is sent to the analysis while it's taken apart, and storage
+// last.
+func (i *Internal) launchResourceKinds() []launchResourceKind {
+	ingresses := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
+	policies := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+	services := i.clientset.CoreV1().Services(i.ViceNamespace)
+	deployments := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	jobs := i.clientset.BatchV1().Jobs(i.ViceNamespace)
+	claims := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace)
+	volumes := i.clientset.CoreV1().PersistentVolumes()
+	configMaps := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+
+	deleteOptions := &metav1.DeleteOptions{}
+
+	return []launchResourceKind{
+		{
+			kind:   "ingress",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return ingresses.List(opts) },
+			delete: func(name string) error { return ingresses.Delete(name, deleteOptions) },
+		},
+		{
+			kind:   "network policy",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return policies.List(opts) },
+			delete: func(name string) error { return policies.Delete(name, deleteOptions) },
+		},
+		{
+			kind:   "service",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return services.List(opts) },
+			delete: func(name string) error { return services.Delete(name, deleteOptions) },
+		},
+		{
+			kind:   "deployment",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return deployments.List(opts) },
+			delete: func(name string) error { return deployments.Delete(name, deleteOptions) },
+		},
+		{
+			kind:   "job",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return jobs.List(opts) },
+			delete: func(name string) error { return jobs.Delete(name, jobDeleteOptions()) },
+		},
+		{
+			kind:   "persistent volume claim",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return claims.List(opts) },
+			delete: func(name string) error { return claims.Delete(name, deleteOptions) },
+		},
+		{
+			// Volumes that never got bound to their claim aren't deleted
+			// along with it, so they're deleted explicitly.
+			kind:   "persistent volume",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return volumes.List(opts) },
+			delete: func(name string) error { return volumes.Delete(name, deleteOptions) },
+		},
+		{
+			kind:   "config map",
+			list:   func(opts metav1.ListOptions) (runtime.Object, error) { return configMaps.List(opts) },
+			delete: func(name string) error { return configMaps.Delete(name, deleteOptions) },
+		},
+	}
+}
+
+// names lists the names of the resources of this kind that match opts.
+func (k *launchResourceKind) names(opts metav1.ListOptions) ([]string, error) {
+	list, err := k.list(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, item := range items {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, accessor.GetName())
+	}
+
+	return names, nil
+}
+
+// analysisResources returns the resources that exist for the analysis, keyed
+// by kind and name.
+func (i *Internal) analysisResources(externalID string) (map[string]bool, error) {
+	opts := metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID})).AsSelector().String(),
+	}
+
+	resources := map[string]bool{}
+	for _, kind := range i.launchResourceKinds() {
+		names, err := kind.names(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listing the %s resources for analysis %s", kind.kind, externalID)
+		}
+		for _, name := range names {
+			resources[kind.kind+"/"+name] = true
+		}
+	}
+
+	return resources, nil
+}
+
+// rollbackLaunch deletes the resources for the analysis that weren't in
+// existing, which is what existed before the launch started. Every resource
+// is attempted; the ones that couldn't be deleted are described in the error.
+func (i *Internal) rollbackLaunch(externalID string, existing map[string]bool) error {
+	opts := metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID})).AsSelector().String(),
+	}
+
+	problems := []string{}
+	for _, kind := range i.launchResourceKinds() {
+		names, err := kind.names(opts)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("unable to list the %s resources: %s", kind.kind, err))
+			continue
+		}
+
+		for _, name := range names {
+			if existing[kind.kind+"/"+name] {
+				continue
+			}
+			log.Infof("rolling back %s %s for analysis %s", kind.kind, name, externalID)
+			if err = kind.delete(name); err != nil {
+				problems = append(problems, fmt.Sprintf("unable to delete %s %s: %s", kind.kind, name, err))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// failLaunch rolls back the resources created while provisioning the job
+// failed, then publishes a single Failed status describing both the failure
+// and the cleanup. The launch isn't rolled back if existing is nil, since
+// there's no telling what was there before it. The subdomain recorded for the
+// analysis and the routing of any hostname claimed for it are always released
+// so they can be used by the next launch. It returns err.
+func (i *Internal) failLaunch(job *model.Job, existing map[string]bool, action string, err error) error {
+	msg := fmt.Sprintf("unable to %s for analysis %s: %s", action, job.Name, launchFailureMessage(err))
+
+	if existing != nil {
+		if rollbackErr := i.rollbackLaunch(job.InvocationID, existing); rollbackErr != nil {
+			log.Error(errors.Wrapf(rollbackErr, "error rolling back the launch of analysis %s", job.InvocationID))
+			msg = fmt.Sprintf("%s; some of the resources created for it couldn't be removed", msg)
+		} else {
+			msg = fmt.Sprintf("%s; the resources created for it were removed", msg)
+		}
+	}
+
+	if releaseErr := i.releaseSubdomain(job.InvocationID); releaseErr != nil {
+		log.Error(releaseErr)
+	}
+	if releaseErr := i.unrouteHostnameClaims(job.InvocationID); releaseErr != nil {
+		log.Error(releaseErr)
+	}
+
+	i.transitionAndLog(job.InvocationID, FailedState, msg)
+	return err
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRollbackLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	labels := internal.labelKeys.selector(map[string]string{"external-id": "e1"})
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: "vice-apps", Labels: labels}
+	}
+
+	// A config map from an earlier attempt that should be left alone.
+	_, err := internal.clientset.CoreV1().ConfigMaps("vice-apps").Create(&apiv1.ConfigMap{ObjectMeta: meta("old-cm")})
+	assert.NoError(err)
+
+	existing, err := internal.analysisResources("e1")
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"config map/old-cm": true}, existing)
+
+	// The resources created by the launch before it failed.
+	_, err = internal.clientset.CoreV1().ConfigMaps("vice-apps").Create(&apiv1.ConfigMap{ObjectMeta: meta("excludes-file-e1")})
+	assert.NoError(err)
+	_, err = internal.clientset.AppsV1().Deployments("vice-apps").Create(&appsv1.Deployment{ObjectMeta: meta("e1")})
+	assert.NoError(err)
+	_, err = internal.clientset.CoreV1().Services("vice-apps").Create(&apiv1.Service{ObjectMeta: meta("vice-e1")})
+	assert.NoError(err)
+	_, err = internal.clientset.CoreV1().PersistentVolumeClaims("vice-apps").Create(&apiv1.PersistentVolumeClaim{ObjectMeta: meta("csi-e1")})
+	assert.NoError(err)
+	_, err = internal.clientset.CoreV1().PersistentVolumes().Create(&apiv1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-e1", Labels: labels},
+	})
+	assert.NoError(err)
+
+	// Resources for other analyses are untouched.
+	_, err = internal.clientset.AppsV1().Deployments("vice-apps").Create(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "e2",
+			Namespace: "vice-apps",
+			Labels:    internal.labelKeys.selector(map[string]string{"external-id": "e2"}),
+		},
+	})
+	assert.NoError(err)
+
+	assert.NoError(internal.rollbackLaunch("e1", existing))
+
+	remaining, err := internal.analysisResources("e1")
+	assert.NoError(err)
+	assert.Equal(existing, remaining)
+
+	_, err = internal.clientset.AppsV1().Deployments("vice-apps").Get("e2", metav1.GetOptions{})
+	assert.NoError(err)
+}
+
+func TestRollbackLaunchDeleteFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	labels := internal.labelKeys.selector(map[string]string{"external-id": "e1"})
+
+	_, err := internal.clientset.CoreV1().Services("vice-apps").Create(&apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "vice-e1", Namespace: "vice-apps", Labels: labels},
+	})
+	assert.NoError(err)
+	_, err = internal.clientset.AppsV1().Deployments("vice-apps").Create(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps", Labels: labels},
+	})
+	assert.NoError(err)
+
+	internal.clientset.(*fake.Clientset).PrependReactor("delete", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+
+	err = internal.rollbackLaunch("e1", map[string]bool{})
+	assert.Error(err)
+	assert.Contains(err.Error(), "service vice-e1")
+
+	// The rest of the resources are still removed.
+	remaining, err := internal.analysisResources("e1")
+	assert.NoError(err)
+	assert.Equal(map[string]bool{"service/vice-e1": true}, remaining)
+}
+
+func TestFailLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	labels := internal.labelKeys.selector(map[string]string{"external-id": "e1"})
+	_, err := internal.clientset.AppsV1().Deployments("vice-apps").Create(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps", Labels: labels},
+	})
+	assert.NoError(err)
+
+	mock.ExpectExec("DELETE FROM vice_subdomains").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE vice_hostname_claims").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	registerStateQuery(mock, "e1", nil)
+	mock.ExpectExec("INSERT INTO vice_analysis_states").
+		WithArgs("e1", "Failed").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	createErr := errors.New("admission webhook denied the request")
+	job := &model.Job{InvocationID: "e1", Name: "analysis"}
+	err = internal.failLaunch(job, map[string]bool{}, "create the deployment", createErr)
+	assert.Equal(createErr, err)
+
+	// The deployment is gone and only one status was published for the failure.
+	remaining, err := internal.analysisResources("e1")
+	assert.NoError(err)
+	assert.Empty(remaining)
+	assert.Equal([]string{"Failed"}, publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+}
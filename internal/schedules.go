@@ -0,0 +1,509 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultScheduleCheckInterval  = time.Minute
+	defaultMaxConcurrentScheduled = 4
+)
+
+// LaunchScheduleConfig configures launching templates on a schedule. The
+// schedules are checked for launches and teardowns that are due every
+// CheckInterval. Up to MaxConcurrentLaunches due schedules are launched at
+// once.
+type LaunchScheduleConfig struct {
+	Enabled               bool          `mapstructure:"enabled"`
+	CheckInterval         time.Duration `mapstructure:"check_interval"`
+	MaxConcurrentLaunches int           `mapstructure:"max_concurrent_launches"`
+}
+
+func (l *LaunchScheduleConfig) checkInterval() time.Duration {
+	if l.CheckInterval <= 0 {
+		return defaultScheduleCheckInterval
+	}
+	return l.CheckInterval
+}
+
+func (l *LaunchScheduleConfig) maxConcurrentLaunches() int {
+	if l.MaxConcurrentLaunches <= 0 {
+		return defaultMaxConcurrentScheduled
+	}
+	return l.MaxConcurrentLaunches
+}
+
+// LaunchSchedule launches a template for its owner once at RunAt, or
+// repeatedly on the Cron schedule, which is read in Timezone. The analyses it
+// launches are saved and shut down DurationMinutes after they're launched,
+// unless that's zero. Schedules only launch analyses as their owner, since
+// nobody else agreed to have analyses launched for them. NextRun is empty
+// once the schedule won't launch anything again.
+type LaunchSchedule struct {
+	ID              string     `json:"id" db:"id"`
+	Name            string     `json:"name" db:"name"`
+	TemplateID      string     `json:"templateID" db:"template_id"`
+	Owner           string     `json:"owner" db:"owner"`
+	RunAt           *time.Time `json:"runAt,omitempty" db:"run_at"`
+	Cron            string     `json:"cron,omitempty" db:"cron"`
+	Timezone        string     `json:"timezone,omitempty" db:"timezone"`
+	DurationMinutes int        `json:"durationMinutes" db:"duration_minutes"`
+	Enabled         bool       `json:"enabled" db:"enabled"`
+	NextRun         *time.Time `json:"nextRun,omitempty" db:"next_run"`
+	LastRun         *time.Time `json:"lastRun,omitempty" db:"last_run"`
+	CreatedAt       time.Time  `json:"createdAt" db:"created_at"`
+}
+
+// LaunchScheduleRequest is the request body for adding or updating a launch
+// schedule. Either RunAt or Cron has to be set, but not both. The schedule is
+// enabled unless Enabled is false.
+type LaunchScheduleRequest struct {
+	Name            string     `json:"name"`
+	TemplateID      string     `json:"templateID"`
+	RunAt           *time.Time `json:"runAt"`
+	Cron            string     `json:"cron"`
+	Timezone        string     `json:"timezone"`
+	DurationMinutes int        `json:"durationMinutes"`
+	Enabled         *bool      `json:"enabled"`
+}
+
+const launchScheduleFields = `
+	id, name, template_id, owner, run_at, COALESCE(cron, '') AS cron,
+	COALESCE(timezone, '') AS timezone, duration_minutes, enabled, next_run, last_run, created_at
+`
+
+const launchScheduleColumns = `SELECT ` + launchScheduleFields + `
+	  FROM vice_launch_schedules
+`
+
+const getLaunchScheduleSQL = launchScheduleColumns + `
+	 WHERE id = $1
+`
+
+const listLaunchSchedulesSQL = launchScheduleColumns + `
+	 WHERE owner = $1
+	 ORDER BY name
+`
+
+const dueLaunchSchedulesSQL = launchScheduleColumns + `
+	 WHERE enabled
+	   AND next_run <= $1
+	 ORDER BY next_run
+`
+
+const insertLaunchScheduleSQL = `
+	INSERT INTO vice_launch_schedules
+		(name, template_id, owner, run_at, cron, timezone, duration_minutes, enabled, next_run, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+	RETURNING ` + launchScheduleFields
+
+const updateLaunchScheduleSQL = `
+	UPDATE vice_launch_schedules
+	   SET name = $2,
+	       template_id = $3,
+	       run_at = $4,
+	       cron = $5,
+	       timezone = $6,
+	       duration_minutes = $7,
+	       enabled = $8,
+	       next_run = $9
+	 WHERE id = $1
+	RETURNING ` + launchScheduleFields
+
+const deleteLaunchScheduleSQL = `
+	DELETE FROM vice_launch_schedules
+	 WHERE id = $1
+`
+
+// claimLaunchScheduleSQL moves a due schedule on to its next run. It only
+// succeeds for the first instance of app-exposer to get to the schedule, so
+// the template isn't launched more than once.
+const claimLaunchScheduleSQL = `
+	UPDATE vice_launch_schedules
+	   SET next_run = $3,
+	       last_run = $2
+	 WHERE id = $1
+	   AND next_run = $4
+`
+
+const insertScheduledLaunchSQL = `
+	INSERT INTO vice_scheduled_launches (schedule_id, analysis_id, username, launched_at, teardown_at)
+	VALUES ($1, $2, $3, now(), $4)
+`
+
+const dueScheduledTeardownsSQL = `
+	SELECT analysis_id
+	  FROM vice_scheduled_launches
+	 WHERE teardown_at <= $1
+	   AND NOT torn_down
+`
+
+const markScheduledTeardownSQL = `
+	UPDATE vice_scheduled_launches
+	   SET torn_down = true
+	 WHERE analysis_id = $1
+`
+
+// nextRun returns when the schedule next launches after now, or nil if it
+// won't launch again.
+func (s *LaunchSchedule) nextRun(now time.Time) (*time.Time, error) {
+	if s.Cron == "" {
+		if s.RunAt != nil && s.RunAt.After(now) {
+			next := *s.RunAt
+			return &next, nil
+		}
+		return nil, nil
+	}
+
+	cron, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown time zone %s", s.Timezone)
+	}
+
+	next := cron.next(now.In(loc))
+	if next.IsZero() {
+		return nil, nil
+	}
+	return &next, nil
+}
+
+// launchSchedule builds the schedule described by the request for the owner,
+// who has to be able to use the template.
+func (i *Internal) launchSchedule(request *LaunchScheduleRequest, owner string, now time.Time) (*LaunchSchedule, error) {
+	badRequest := func(format string, args ...interface{}) error {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case request.Name == "":
+		return nil, badRequest("name is required")
+	case request.TemplateID == "":
+		return nil, badRequest("templateID is required")
+	case (request.RunAt == nil) == (request.Cron == ""):
+		return nil, badRequest("either runAt or cron is required, but not both")
+	case request.RunAt != nil && !request.RunAt.After(now):
+		return nil, badRequest("runAt is in the past")
+	case request.DurationMinutes < 0:
+		return nil, badRequest("durationMinutes can't be negative")
+	}
+
+	if _, err := i.launchTemplate(request.TemplateID, owner, false); err != nil {
+		return nil, err
+	}
+
+	schedule := &LaunchSchedule{
+		Name:            request.Name,
+		TemplateID:      request.TemplateID,
+		Owner:           owner,
+		RunAt:           request.RunAt,
+		Cron:            request.Cron,
+		Timezone:        request.Timezone,
+		DurationMinutes: request.DurationMinutes,
+		Enabled:         request.Enabled == nil || *request.Enabled,
+	}
+
+	var err error
+	schedule.NextRun, err = schedule.nextRun(now)
+	if err != nil {
+		return nil, badRequest("%s", err)
+	}
+	if schedule.NextRun == nil {
+		return nil, badRequest("cron expression %s never runs", request.Cron)
+	}
+
+	return schedule, nil
+}
+
+// ownedLaunchSchedule returns the schedule if the user owns it.
+func (i *Internal) ownedLaunchSchedule(id, username string) (*LaunchSchedule, error) {
+	schedule := &LaunchSchedule{}
+	if err := i.db.Get(schedule, getLaunchScheduleSQL, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("launch schedule %s not found", id))
+		}
+		return nil, errors.Wrapf(err, "error looking up launch schedule %s", id)
+	}
+
+	if schedule.Owner != username {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("launch schedule %s not found", id))
+	}
+
+	return schedule, nil
+}
+
+// launchScheduled launches the schedule's template for its owner through the
+// apps service, then records the analysis so that it's torn down on time.
+func (i *Internal) launchScheduled(schedule *LaunchSchedule, now time.Time, teardownAt *time.Time) error {
+	username := schedule.Owner
+
+	template, err := i.launchTemplate(schedule.TemplateID, username, false)
+	if err != nil {
+		return err
+	}
+
+	submission, err := templateSubmission(template, username, now)
+	if err != nil {
+		return err
+	}
+
+	analysisID, err := i.submitAnalysis(username, submission)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("launched template %s as analysis %s for %s on schedule %s", template.ID, analysisID, username, schedule.ID)
+
+	if _, err = i.db.Exec(insertScheduledLaunchSQL, schedule.ID, analysisID, username, teardownAt); err != nil {
+		return errors.Wrapf(err, "error recording the scheduled launch of analysis %s", analysisID)
+	}
+
+	return nil
+}
+
+// runSchedule launches a due schedule's template, once it's moved the
+// schedule on to its next run. Schedules that another instance of
+// app-exposer got to first are skipped.
+func (i *Internal) runSchedule(schedule *LaunchSchedule, now time.Time) error {
+	next, err := schedule.nextRun(now)
+	if err != nil {
+		return errors.Wrapf(err, "error finding the next run of launch schedule %s", schedule.ID)
+	}
+
+	result, err := i.db.Exec(claimLaunchScheduleSQL, schedule.ID, now, next, schedule.NextRun)
+	if err != nil {
+		return errors.Wrapf(err, "error claiming launch schedule %s", schedule.ID)
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+		return err
+	}
+
+	var teardownAt *time.Time
+	if schedule.DurationMinutes > 0 {
+		t := now.Add(time.Duration(schedule.DurationMinutes) * time.Minute)
+		teardownAt = &t
+	}
+
+	if err = i.launchScheduled(schedule, now, teardownAt); err != nil {
+		return errors.Wrapf(err, "launch schedule %s failed", schedule.ID)
+	}
+
+	return nil
+}
+
+// tearDownScheduledLaunches saves and shuts down the scheduled analyses that
+// have reached the end of their time. Analyses already gone are skipped by
+// the shutdown.
+func (i *Internal) tearDownScheduledLaunches(ctx context.Context, now time.Time) error {
+	analysisIDs := []string{}
+	if err := i.db.Select(&analysisIDs, dueScheduledTeardownsSQL, now); err != nil {
+		return errors.Wrap(err, "error listing the scheduled analyses due to be torn down")
+	}
+
+	for _, analysisID := range analysisIDs {
+		externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "error looking up the external ID of scheduled analysis %s", analysisID))
+			continue
+		}
+
+		if _, err = i.db.Exec(markScheduledTeardownSQL, analysisID); err != nil {
+			log.Error(errors.Wrapf(err, "error recording the teardown of analysis %s", analysisID))
+			continue
+		}
+
+		go i.saveAndShutDown(externalID, fmt.Sprintf(
+			"analysis %s has reached the end of its scheduled time, so its outputs are being saved and it's being shut down",
+			externalID,
+		))
+	}
+
+	return nil
+}
+
+// checkLaunchSchedules runs the schedules that are due and tears down the
+// scheduled analyses whose time is up. The schedules are run a few at a time,
+// and each launch is bounded by the timeout on the apps service submission,
+// so a check can't hold up the next one for long.
+func (i *Internal) checkLaunchSchedules(ctx context.Context, now time.Time) error {
+	schedules := []LaunchSchedule{}
+	if err := i.db.Select(&schedules, dueLaunchSchedulesSQL, now); err != nil {
+		return errors.Wrap(err, "error listing the launch schedules that are due")
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, i.LaunchSchedules.maxConcurrentLaunches())
+	for idx := range schedules {
+		schedule := &schedules[idx]
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := i.runSchedule(schedule, now); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return i.tearDownScheduledLaunches(ctx, now)
+}
+
+// StartLaunchSchedules periodically runs the launch schedules that are due.
+// It does nothing unless scheduled launches are enabled.
+func (i *Internal) StartLaunchSchedules() {
+	if !i.LaunchSchedules.Enabled {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(i.LaunchSchedules.checkInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := i.checkLaunchSchedules(context.Background(), time.Now()); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// ListLaunchSchedulesHandler lists the launch schedules owned by the user in
+// the 'user' query parameter.
+func (i *Internal) ListLaunchSchedulesHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	schedules := []LaunchSchedule{}
+	if err := i.db.Select(&schedules, listLaunchSchedulesSQL, i.fixUsername(user)); err != nil {
+		return errors.Wrapf(err, "error listing the launch schedules for %s", user)
+	}
+
+	return c.JSON(http.StatusOK, map[string][]LaunchSchedule{
+		"schedules": schedules,
+	})
+}
+
+// GetLaunchScheduleHandler returns a launch schedule owned by the user in the
+// 'user' query parameter.
+func (i *Internal) GetLaunchScheduleHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	schedule, err := i.ownedLaunchSchedule(c.Param("schedule-id"), i.fixUsername(user))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// AddLaunchScheduleHandler adds a schedule for launching one of the templates
+// the user in the 'user' query parameter can use.
+func (i *Internal) AddLaunchScheduleHandler(c echo.Context) error {
+	if !i.LaunchSchedules.Enabled {
+		return echo.NewHTTPError(http.StatusBadRequest, "scheduled launches are not enabled")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	request := &LaunchScheduleRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	s, err := i.launchSchedule(request, i.fixUsername(user), time.Now())
+	if err != nil {
+		return err
+	}
+
+	schedule := &LaunchSchedule{}
+	err = i.db.Get(schedule, insertLaunchScheduleSQL,
+		s.Name, s.TemplateID, s.Owner, s.RunAt, s.Cron, s.Timezone, s.DurationMinutes, s.Enabled, s.NextRun,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "error saving launch schedule %s for %s", s.Name, user)
+	}
+
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// UpdateLaunchScheduleHandler replaces a launch schedule owned by the user in
+// the 'user' query parameter. Analyses it already launched are still torn
+// down when they were going to be.
+func (i *Internal) UpdateLaunchScheduleHandler(c echo.Context) error {
+	if !i.LaunchSchedules.Enabled {
+		return echo.NewHTTPError(http.StatusBadRequest, "scheduled launches are not enabled")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	request := &LaunchScheduleRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	id := c.Param("schedule-id")
+	if _, err := i.ownedLaunchSchedule(id, i.fixUsername(user)); err != nil {
+		return err
+	}
+
+	s, err := i.launchSchedule(request, i.fixUsername(user), time.Now())
+	if err != nil {
+		return err
+	}
+
+	schedule := &LaunchSchedule{}
+	err = i.db.Get(schedule, updateLaunchScheduleSQL,
+		id, s.Name, s.TemplateID, s.RunAt, s.Cron, s.Timezone, s.DurationMinutes, s.Enabled, s.NextRun,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "error updating launch schedule %s", id)
+	}
+
+	return c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteLaunchScheduleHandler deletes a launch schedule owned by the user in
+// the 'user' query parameter. Analyses it already launched are still torn
+// down when they were going to be.
+func (i *Internal) DeleteLaunchScheduleHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	id := c.Param("schedule-id")
+	if _, err := i.ownedLaunchSchedule(id, i.fixUsername(user)); err != nil {
+		return err
+	}
+
+	if _, err := i.db.Exec(deleteLaunchScheduleSQL, id); err != nil {
+		return errors.Wrapf(err, "error deleting launch schedule %s", id)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// expectScheduleTemplate registers the lookup of a template owned by alice
+// and shared with bob.
+func expectScheduleTemplate(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("FROM vice_launch_templates").
+		WithArgs("t1").
+		WillReturnRows(sqlmock.NewRows(launchTemplateRows).
+			AddRow("t1", "rstudio", "", "alice@example.org", templateRequest, "{bob@example.org}", time.Now(), time.Now()))
+}
+
+func TestLaunchScheduleNextRun(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2026, time.October, 16, 9, 0, 0, 0, time.UTC)
+
+	runAt := now.Add(time.Hour)
+	next, err := (&LaunchSchedule{RunAt: &runAt}).nextRun(now)
+	assert.NoError(err)
+	assert.Equal(&runAt, next)
+
+	// One-time schedules are done once they've run.
+	next, err = (&LaunchSchedule{RunAt: &runAt}).nextRun(runAt)
+	assert.NoError(err)
+	assert.Nil(next)
+
+	next, err = (&LaunchSchedule{Cron: "45 8 * * 1-5"}).nextRun(now)
+	assert.NoError(err)
+	assert.Equal(time.Date(2026, time.October, 19, 8, 45, 0, 0, time.UTC), *next)
+
+	// Cron schedules are read in their time zone.
+	next, err = (&LaunchSchedule{Cron: "45 8 * * 1-5", Timezone: "America/Phoenix"}).nextRun(now)
+	assert.NoError(err)
+	assert.True(time.Date(2026, time.October, 16, 15, 45, 0, 0, time.UTC).Equal(*next))
+
+	_, err = (&LaunchSchedule{Cron: "45 8 * * 1-5", Timezone: "Nowhere/Special"}).nextRun(now)
+	assert.Error(err)
+}
+
+func TestLaunchScheduleValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	now := time.Date(2026, time.October, 16, 9, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	for _, request := range []*LaunchScheduleRequest{
+		{TemplateID: "t1", Cron: "* * * * *"},
+		{Name: "lab", Cron: "* * * * *"},
+		{Name: "lab", TemplateID: "t1"},
+		{Name: "lab", TemplateID: "t1", Cron: "* * * * *", RunAt: &future},
+		{Name: "lab", TemplateID: "t1", RunAt: &past},
+		{Name: "lab", TemplateID: "t1", Cron: "* * * * *", DurationMinutes: -1},
+	} {
+		_, err := i.launchSchedule(request, "alice@example.org", now)
+		assert.Errorf(err, "%+v should be invalid", request)
+	}
+
+	// The owner has to be able to use the template.
+	expectScheduleTemplate(mock)
+	_, err := i.launchSchedule(&LaunchScheduleRequest{Name: "lab", TemplateID: "t1", Cron: "45 8 * * 1-5"}, "carol@example.org", now)
+	if assert.IsType(&echo.HTTPError{}, err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	expectScheduleTemplate(mock)
+	_, err = i.launchSchedule(&LaunchScheduleRequest{Name: "lab", TemplateID: "t1", Cron: "0 0 30 2 *"}, "alice@example.org", now)
+	assert.Error(err)
+
+	expectScheduleTemplate(mock)
+	schedule, err := i.launchSchedule(&LaunchScheduleRequest{
+		Name: "lab", TemplateID: "t1", Cron: "45 8 * * 1-5", DurationMinutes: 90,
+	}, "bob@example.org", now)
+	if assert.NoError(err) {
+		assert.Equal("bob@example.org", schedule.Owner)
+		assert.True(schedule.Enabled)
+		assert.Equal(time.Date(2026, time.October, 19, 8, 45, 0, 0, time.UTC), *schedule.NextRun)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAddLaunchScheduleHandlerDisabled(t *testing.T) {
+	i, _ := setupInternal(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/my/schedules?user=alice", bytes.NewBufferString(`{}`))
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	err := i.AddLaunchScheduleHandler(c)
+	if assert.IsType(t, &echo.HTTPError{}, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestRunScheduleAlreadyClaimed(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	now := time.Date(2026, time.October, 19, 8, 45, 0, 0, time.UTC)
+	schedule := &LaunchSchedule{ID: "s1", TemplateID: "t1", Owner: "alice@example.org", Cron: "45 8 * * 1-5", NextRun: &now}
+
+	// Another instance moved the schedule on first, so nothing is launched.
+	mock.ExpectExec("UPDATE vice_launch_schedules").
+		WithArgs("s1", now, time.Date(2026, time.October, 20, 8, 45, 0, 0, time.UTC), now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(i.runSchedule(schedule, now))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRunSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	now := time.Date(2026, time.October, 19, 8, 45, 0, 0, time.UTC)
+	schedule := &LaunchSchedule{
+		ID:              "s1",
+		TemplateID:      "t1",
+		Owner:           "bob@example.org",
+		RunAt:           &now,
+		NextRun:         &now,
+		DurationMinutes: 90,
+	}
+
+	server, submissions := appsService(t, http.StatusOK, `{"id": "a-3"}`)
+	defer server.Close()
+	i.AppsServiceBaseURL = server.URL
+
+	mock.ExpectExec("UPDATE vice_launch_schedules").
+		WithArgs("s1", now, nil, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectScheduleTemplate(mock)
+	mock.ExpectExec("INSERT INTO vice_scheduled_launches").
+		WithArgs("s1", "a-3", "bob@example.org", now.Add(90*time.Minute)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.runSchedule(schedule, now))
+	if assert.Len(*submissions, 1) {
+		assert.Equal("bob", (*submissions)[0]["user"])
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRunScheduleLaunchFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	now := time.Date(2026, time.October, 19, 8, 45, 0, 0, time.UTC)
+	schedule := &LaunchSchedule{ID: "s1", TemplateID: "t1", Owner: "bob@example.org", RunAt: &now, NextRun: &now}
+
+	server, _ := appsService(t, http.StatusBadRequest, `{"reason": "billing hold"}`)
+	defer server.Close()
+	i.AppsServiceBaseURL = server.URL
+
+	// The apps service rejects the launch, so it isn't recorded.
+	mock.ExpectExec("UPDATE vice_launch_schedules").
+		WithArgs("s1", now, nil, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectScheduleTemplate(mock)
+
+	err := i.runSchedule(schedule, now)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "billing hold")
+	}
+
+	// The template is no longer shared with carol.
+	schedule.Owner = "carol@example.org"
+	mock.ExpectExec("UPDATE vice_launch_schedules").
+		WithArgs("s1", now, nil, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectScheduleTemplate(mock)
+
+	err = i.runSchedule(schedule, now)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "not found")
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCheckLaunchSchedules(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	i.LaunchSchedules.MaxConcurrentLaunches = 1
+	now := time.Date(2026, time.October, 19, 8, 45, 0, 0, time.UTC)
+
+	// A schedule that another instance claimed first doesn't stop the check.
+	mock.ExpectQuery("FROM vice_launch_schedules").
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "name", "template_id", "owner", "run_at", "cron", "timezone",
+			"duration_minutes", "enabled", "next_run", "last_run", "created_at",
+		}).AddRow("s1", "lab", "t1", "bob@example.org", now, "", "", 0, true, now, nil, now))
+	mock.ExpectExec("UPDATE vice_launch_schedules").
+		WithArgs("s1", now, nil, now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT analysis_id FROM vice_scheduled_launches").
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{"analysis_id"}))
+
+	assert.NoError(i.checkLaunchSchedules(context.Background(), now))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestTearDownScheduledLaunches(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	now := time.Now()
+
+	mock.ExpectQuery("SELECT analysis_id FROM vice_scheduled_launches").
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{"analysis_id"}))
+
+	assert.NoError(i.tearDownScheduledLaunches(context.Background(), now))
+	assert.NoError(mock.ExpectationsWereMet())
+}
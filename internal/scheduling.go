@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AntiAffinityPreferred spreads analysis pods across nodes when possible.
+	AntiAffinityPreferred = "preferred"
+
+	// AntiAffinityRequired never schedules two analysis pods in the same
+	// topology domain.
+	AntiAffinityRequired = "required"
+
+	defaultTopologyKey = "kubernetes.io/hostname"
+)
+
+// SchedulingConfig controls where analysis pods are scheduled. It's used both
+// for all analyses and for the analyses of specific apps.
+type SchedulingConfig struct {
+	NodeSelector map[string]string  `mapstructure:"node_selector"`
+	Tolerations  []apiv1.Toleration `mapstructure:"tolerations"`
+	AntiAffinity string             `mapstructure:"anti_affinity"`
+	TopologyKey  string             `mapstructure:"topology_key"`
+}
+
+// AppSchedulingConfig maps app IDs to the scheduling settings for their
+// analyses.
+type AppSchedulingConfig map[string]SchedulingConfig
+
+// podAntiAffinity returns the anti-affinity that keeps the pods matching the
+// labels apart from each other, or nil if the mode doesn't call for it.
+func podAntiAffinity(mode, topologyKey string, matchLabels map[string]string) *apiv1.PodAntiAffinity {
+	if topologyKey == "" {
+		topologyKey = defaultTopologyKey
+	}
+
+	term := apiv1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{
+			MatchLabels: matchLabels,
+		},
+		TopologyKey: topologyKey,
+	}
+
+	switch mode {
+	case AntiAffinityPreferred:
+		return &apiv1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []apiv1.WeightedPodAffinityTerm{
+				{Weight: 100, PodAffinityTerm: term},
+			},
+		}
+	case AntiAffinityRequired:
+		return &apiv1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []apiv1.PodAffinityTerm{term},
+		}
+	default:
+		return nil
+	}
+}
+
+// applyScheduling adds the configured node selector, tolerations, and pod
+// anti-affinity to the pod spec. The settings for the job's app are applied
+// after the global ones, so its node selector entries and anti-affinity win.
+func (i *Internal) applyScheduling(job *model.Job, spec *apiv1.PodSpec) {
+	configs := []SchedulingConfig{i.Scheduling}
+	if appConfig, ok := i.AppScheduling[job.AppID]; ok {
+		configs = append(configs, appConfig)
+	}
+
+	mode, topologyKey := "", ""
+
+	for _, cfg := range configs {
+		for k, v := range cfg.NodeSelector {
+			if spec.NodeSelector == nil {
+				spec.NodeSelector = map[string]string{}
+			}
+			spec.NodeSelector[k] = v
+		}
+
+		spec.Tolerations = append(spec.Tolerations, cfg.Tolerations...)
+
+		if cfg.AntiAffinity != "" {
+			mode, topologyKey = cfg.AntiAffinity, cfg.TopologyKey
+		}
+	}
+
+	if antiAffinity := podAntiAffinity(mode, topologyKey, i.labelKeys.selector(map[string]string{"app-type": "interactive"})); antiAffinity != nil {
+		if spec.Affinity == nil {
+			spec.Affinity = &apiv1.Affinity{}
+		}
+		spec.Affinity.PodAntiAffinity = antiAffinity
+	}
+}
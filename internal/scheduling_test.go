@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestApplyScheduling(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.Scheduling = SchedulingConfig{
+		NodeSelector: map[string]string{"pool": "vice", "zone": "a"},
+		Tolerations:  []apiv1.Toleration{{Key: "vice", Operator: apiv1.TolerationOpExists}},
+		AntiAffinity: AntiAffinityPreferred,
+	}
+	internal.AppScheduling = AppSchedulingConfig{
+		"app1": {
+			NodeSelector: map[string]string{"pool": "bigmem"},
+			Tolerations:  []apiv1.Toleration{{Key: "bigmem", Operator: apiv1.TolerationOpExists}},
+			AntiAffinity: AntiAffinityRequired,
+			TopologyKey:  "topology.kubernetes.io/zone",
+		},
+	}
+
+	job := multiPortJob(8888)
+	spec := &apiv1.PodSpec{Tolerations: []apiv1.Toleration{{Key: "analysis"}}}
+	internal.applyScheduling(job, spec)
+	assert.Equal(map[string]string{"pool": "vice", "zone": "a"}, spec.NodeSelector)
+	assert.Len(spec.Tolerations, 2)
+	assert.Len(spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, 1)
+	assert.Equal(defaultTopologyKey, spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].PodAffinityTerm.TopologyKey)
+
+	// The app's settings are applied on top of the global ones.
+	job.AppID = "app1"
+	spec = &apiv1.PodSpec{Affinity: &apiv1.Affinity{NodeAffinity: &apiv1.NodeAffinity{}}}
+	internal.applyScheduling(job, spec)
+	assert.Equal(map[string]string{"pool": "bigmem", "zone": "a"}, spec.NodeSelector)
+	assert.Len(spec.Tolerations, 2)
+	assert.NotNil(spec.Affinity.NodeAffinity)
+	assert.Empty(spec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	assert.Equal("topology.kubernetes.io/zone", spec.Affinity.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[0].TopologyKey)
+}
+
+func TestApplySchedulingNothingConfigured(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+
+	spec := &apiv1.PodSpec{}
+	internal.applyScheduling(multiPortJob(8888), spec)
+	assert.Equal(t, &apiv1.PodSpec{}, spec)
+}
@@ -11,6 +11,10 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
+func serviceName(job *model.Job) string {
+	return fmt.Sprintf("vice-%s", job.InvocationID)
+}
+
 // getService assembles and returns the Service needed for the VICE analysis.
 // It does not call the k8s API.
 func (i *Internal) getService(job *model.Job, deployment *appsv1.Deployment) (*apiv1.Service, error) {
@@ -21,13 +25,14 @@ func (i *Internal) getService(job *model.Job, deployment *appsv1.Deployment) (*a
 
 	svc := apiv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   fmt.Sprintf("vice-%s", job.InvocationID),
-			Labels: labels,
+			Name:        serviceName(job),
+			Labels:      labels,
+			Annotations: i.annotationsFromJob(job),
 		},
 		Spec: apiv1.ServiceSpec{
-			Selector: map[string]string{
+			Selector: i.labelKeys.selector(map[string]string{
 				"external-id": job.InvocationID,
-			},
+			}),
 			Ports: []apiv1.ServicePort{
 				{
 					Name:       fileTransfersPortName,
@@ -45,5 +50,39 @@ func (i *Internal) getService(job *model.Job, deployment *appsv1.Deployment) (*a
 		},
 	}
 
+	svc.Spec.Ports = append(svc.Spec.Ports, i.extraServicePorts(job)...)
+
+	if port, ok := i.tlsPassthroughPort(job); ok {
+		svc.Spec.Ports = append(svc.Spec.Ports, port)
+	}
+
 	return &svc, nil
 }
+
+// extraServicePorts returns the Service ports for the container ports the app
+// declares beyond the first one. The first port is the one served through the
+// VICE proxy, so it's never exposed directly. Ports that would collide with
+// the ports the Service already uses are skipped.
+func (i *Internal) extraServicePorts(job *model.Job) []apiv1.ServicePort {
+	retval := []apiv1.ServicePort{}
+
+	for idx, port := range i.analysisPorts(job) {
+		if idx == 0 {
+			continue
+		}
+
+		if port.ContainerPort <= 0 || port.ContainerPort == fileTransfersPort || port.ContainerPort == viceProxyServicePort {
+			log.Warnf("not exposing port %d for analysis %s", port.ContainerPort, job.InvocationID)
+			continue
+		}
+
+		retval = append(retval, apiv1.ServicePort{
+			Name:       port.Name,
+			Protocol:   port.Protocol,
+			Port:       port.ContainerPort,
+			TargetPort: intstr.FromString(port.Name),
+		})
+	}
+
+	return retval
+}
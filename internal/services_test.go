@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// multiPortJob returns a job whose tool declares the given container ports.
+func multiPortJob(ports ...int) *model.Job {
+	declared := []model.Ports{}
+	for _, p := range ports {
+		declared = append(declared, model.Ports{ContainerPort: p})
+	}
+
+	return &model.Job{
+		InvocationID: "e1",
+		Steps: []model.Step{
+			{
+				Component: model.StepComponent{
+					Container: model.Container{
+						Ports: declared,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestExtraServicePorts(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+
+	assert.Empty(internal.extraServicePorts(multiPortJob(8888)))
+
+	ports := internal.extraServicePorts(multiPortJob(8888, 5000, 60001, 8080))
+	assert.Len(ports, 2)
+	assert.Equal("tcp-a-1", ports[0].Name)
+	assert.Equal(int32(5000), ports[0].Port)
+	assert.Equal("tcp-a-1", ports[0].TargetPort.String())
+	assert.Equal("tcp-a-3", ports[1].Name)
+	assert.Equal(int32(8080), ports[1].Port)
+}
+
+func TestExtraPortRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	job := multiPortJob(8888, 5000)
+
+	assert.Equal([]string{"/port-5000=http://localhost:5000"}, internal.extraPortRoutes(job))
+
+	// The routes are only handed to the proxy if extra ports are exposed.
+	assert.NotContains(internal.viceProxyCommand(job), "--port-route")
+	internal.ExposeExtraPorts = true
+	assert.Contains(internal.viceProxyCommand(job), "/port-5000=http://localhost:5000")
+}
+
+func TestPortProtocols(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.PortProtocols = map[string]map[string]string{
+		"app1": {"5000": "udp", "5001": "SCTP", "5002": "icmp"},
+	}
+
+	job := multiPortJob(8888, 5000, 5001, 5002)
+	job.AppID = "app1"
+
+	ports := internal.analysisPorts(job)
+	assert.Equal(apiv1.ProtocolTCP, ports[0].Protocol)
+	assert.Equal("tcp-a-0", ports[0].Name)
+	assert.Equal(apiv1.ProtocolUDP, ports[1].Protocol)
+	assert.Equal("udp-a-1", ports[1].Name)
+	assert.Equal(apiv1.ProtocolSCTP, ports[2].Protocol)
+	assert.Equal(apiv1.ProtocolTCP, ports[3].Protocol)
+
+	svcPorts := internal.extraServicePorts(job)
+	assert.Len(svcPorts, 3)
+	assert.Equal(apiv1.ProtocolUDP, svcPorts[0].Protocol)
+	assert.Equal("udp-a-1", svcPorts[0].TargetPort.String())
+
+	// Only the TCP port can be routed through the VICE proxy.
+	assert.Equal([]string{"/port-5002=http://localhost:5002"}, internal.extraPortRoutes(job))
+}
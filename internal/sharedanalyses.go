@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sharedExternalIDs returns the external IDs of the analyses that have been
+// shared with the user, directly or through a group they belong to, leaving
+// out the ones in owned.
+func (i *Internal) sharedExternalIDs(ctx context.Context, user string, owned map[string]bool) ([]string, error) {
+	// The permissions service knows users by their names without the suffix.
+	analysisIDs, err := i.permissions.AccessibleResources(ctx, strings.TrimSuffix(user, i.UserSuffix), "analysis")
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the analyses %s can access", user)
+	}
+
+	externalIDs, err := i.newApps().GetExternalIDsByAnalysisIDs(ctx, analysisIDs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the external IDs of the analyses %s can access", user)
+	}
+
+	retval := []string{}
+	for _, externalID := range externalIDs {
+		if !owned[externalID] {
+			retval = append(retval, externalID)
+		}
+	}
+
+	return retval, nil
+}
+
+// addSharedAnalyses adds the resources of the analyses that have been shared
+// with the user and match the filter to the listing of the user's own
+// analyses. The resources are listed once and then narrowed down to the
+// shared analyses, rather than listed for each of them.
+func (i *Internal) addSharedAnalyses(ctx context.Context, user string, filter map[string]string, listing *ResourceInfo) error {
+	owned := map[string]bool{}
+	for _, dep := range listing.Deployments {
+		owned[dep.ExternalID] = true
+	}
+	for _, pod := range listing.Pods {
+		owned[pod.ExternalID] = true
+	}
+
+	externalIDs, err := i.sharedExternalIDs(ctx, user, owned)
+	if err != nil {
+		return err
+	}
+
+	shared := map[string]bool{}
+	for _, externalID := range externalIDs {
+		if id, ok := filter["external-id"]; ok && id != externalID {
+			continue
+		}
+		shared[externalID] = true
+	}
+
+	if len(shared) == 0 {
+		return nil
+	}
+
+	all, err := i.doResourceListing(filter)
+	if err != nil {
+		return err
+	}
+
+	for _, dep := range all.Deployments {
+		if shared[dep.ExternalID] {
+			listing.Deployments = append(listing.Deployments, dep)
+		}
+	}
+	for _, pod := range all.Pods {
+		if shared[pod.ExternalID] {
+			listing.Pods = append(listing.Pods, pod)
+		}
+	}
+	for _, cm := range all.ConfigMaps {
+		if shared[cm.ExternalID] {
+			listing.ConfigMaps = append(listing.ConfigMaps, cm)
+		}
+	}
+	for _, svc := range all.Services {
+		if shared[svc.ExternalID] {
+			listing.Services = append(listing.Services, svc)
+		}
+	}
+	for _, ingress := range all.Ingresses {
+		if shared[ingress.ExternalID] {
+			listing.Ingresses = append(listing.Ingresses, ingress)
+		}
+	}
+	for _, tunnel := range all.Tunnels {
+		if shared[tunnel.ExternalID] {
+			listing.Tunnels = append(listing.Tunnels, tunnel)
+		}
+	}
+
+	return nil
+}
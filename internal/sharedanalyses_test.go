@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestSharedExternalIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/permissions/subjects/user/alice/analysis", r.URL.Path)
+		fmt.Fprint(w, `{"permissions":[
+			{"permission_level":"own","resource":{"name":"a1"}},
+			{"permission_level":"read","resource":{"name":"a2"}}
+		]}`)
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, nil)
+	i.permissions = &permissions.Permissions{BaseURL: server.URL}
+
+	mock.ExpectQuery("FROM job_steps s").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e1").AddRow("e2"))
+
+	// The user's own analysis is already in the listing.
+	externalIDs, err := i.sharedExternalIDs(context.Background(), "alice"+testConfig.UserSuffix, map[string]bool{"e1": true})
+	assert.NoError(err)
+	assert.Equal([]string{"e2"}, externalIDs)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAddSharedAnalyses(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"permissions":[{"permission_level":"read","resource":{"name":"a2"}}]}`)
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, []runtime.Object{
+		appDeployment("e1", "app1"),
+		appDeployment("e2", "app1"),
+		appDeployment("e3", "app1"),
+	})
+	i.permissions = &permissions.Permissions{BaseURL: server.URL}
+
+	mock.ExpectQuery("FROM job_steps s").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e2"))
+
+	// Only the analysis shared with the user is added to their own.
+	listing := &ResourceInfo{Deployments: []DeploymentInfo{{MetaInfo: MetaInfo{ExternalID: "e1"}}}}
+	assert.NoError(i.addSharedAnalyses(context.Background(), "alice"+testConfig.UserSuffix, map[string]string{}, listing))
+
+	externalIDs := []string{}
+	for _, dep := range listing.Deployments {
+		externalIDs = append(externalIDs, dep.ExternalID)
+	}
+	assert.Equal([]string{"e1", "e2"}, externalIDs)
+}
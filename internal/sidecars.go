@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// SidecarConfig describes an extra container that gets added to every
+// analysis pod, such as a metrics exporter or a security agent. It's also used
+// for the init containers declared for apps. The image, command, args,
+// environment values, and working directory are Go templates that are
+// rendered with a SidecarTemplateData.
+type SidecarConfig struct {
+	Name            string            `mapstructure:"name"`
+	Image           string            `mapstructure:"image"`
+	Command         []string          `mapstructure:"command"`
+	Args            []string          `mapstructure:"args"`
+	Env             map[string]string `mapstructure:"env"`
+	WorkingDir      string            `mapstructure:"working_dir"`
+	Ports           []int32           `mapstructure:"ports"`
+	CPURequest      string            `mapstructure:"cpu_request"`
+	CPULimit        string            `mapstructure:"cpu_limit"`
+	MemoryRequest   string            `mapstructure:"memory_request"`
+	MemoryLimit     string            `mapstructure:"memory_limit"`
+	MountWorkingDir bool              `mapstructure:"mount_working_dir"`
+	RunAsRoot       bool              `mapstructure:"run_as_root"`
+}
+
+// SidecarTemplateData is the job metadata available to sidecar templates and
+// app config templates.
+type SidecarTemplateData struct {
+	ExternalID   string
+	AnalysisName string
+	AppID        string
+	AppName      string
+	Username     string
+	UserID       string
+	Email        string
+	Subdomain    string
+	URL          string
+	Namespace    string
+}
+
+// reservedContainerNames are the names of the containers app-exposer adds to
+// analysis pods itself.
+var reservedContainerNames = []string{
+	analysisContainerName,
+	viceProxyContainerName,
+	fileTransfersContainerName,
+	fileTransfersInitContainerName,
+}
+
+// validateContainerConfigs returns the problems with a list of extra
+// containers for analysis pods. The kind is used in the messages.
+func validateContainerConfigs(kind string, configs []SidecarConfig) []string {
+	problems := []string{}
+	seen := map[string]bool{}
+
+	for _, sidecar := range configs {
+		for _, msg := range validation.IsDNS1123Label(sidecar.Name) {
+			problems = append(problems, fmt.Sprintf("%s name %s: %s", kind, sidecar.Name, msg))
+		}
+		for _, reserved := range reservedContainerNames {
+			if sidecar.Name == reserved {
+				problems = append(problems, fmt.Sprintf("%s name %s is reserved", kind, sidecar.Name))
+			}
+		}
+		if seen[sidecar.Name] {
+			problems = append(problems, fmt.Sprintf("%s name %s is used more than once", kind, sidecar.Name))
+		}
+		seen[sidecar.Name] = true
+
+		if sidecar.Image == "" {
+			problems = append(problems, fmt.Sprintf("%s %s has no image", kind, sidecar.Name))
+		}
+
+		for _, text := range sidecarTemplates(&sidecar) {
+			if _, err := template.New(sidecar.Name).Option("missingkey=error").Parse(text); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %s: %s", kind, sidecar.Name, err))
+			}
+		}
+
+		for _, quantity := range []string{sidecar.CPURequest, sidecar.CPULimit, sidecar.MemoryRequest, sidecar.MemoryLimit} {
+			if quantity == "" {
+				continue
+			}
+			if _, err := resourcev1.ParseQuantity(quantity); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %s resource %s: %s", kind, sidecar.Name, quantity, err))
+			}
+		}
+	}
+
+	return problems
+}
+
+// ValidateSidecars returns an error if any of the configured sidecars can't be
+// added to analysis pods.
+func ValidateSidecars(sidecars []SidecarConfig) error {
+	if problems := validateContainerConfigs("sidecar", sidecars); len(problems) > 0 {
+		return fmt.Errorf("invalid sidecars: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// sidecarTemplates returns all of the templated fields of the sidecar.
+func sidecarTemplates(sidecar *SidecarConfig) []string {
+	templates := []string{sidecar.Image, sidecar.WorkingDir}
+	templates = append(templates, sidecar.Command...)
+	templates = append(templates, sidecar.Args...)
+	for _, v := range sidecar.Env {
+		templates = append(templates, v)
+	}
+	return templates
+}
+
+// sidecarTemplateData returns the job metadata for the sidecar templates.
+func (i *Internal) sidecarTemplateData(job *model.Job) *SidecarTemplateData {
+	return &SidecarTemplateData{
+		ExternalID:   job.InvocationID,
+		AnalysisName: job.Name,
+		AppID:        job.AppID,
+		AppName:      job.AppName,
+		Username:     job.Submitter,
+		UserID:       job.UserID,
+		Email:        job.Email,
+		Subdomain:    i.subdomain(job.UserID, job.InvocationID),
+		URL:          i.getFrontendURL(job).String(),
+		Namespace:    i.ViceNamespace,
+	}
+}
+
+func renderSidecarTemplate(name, text string, data *SidecarTemplateData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing template for sidecar %s", name)
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "error rendering template for sidecar %s", name)
+	}
+
+	return buf.String(), nil
+}
+
+func renderSidecarTemplates(name string, texts []string, data *SidecarTemplateData) ([]string, error) {
+	if len(texts) == 0 {
+		return nil, nil
+	}
+
+	rendered := make([]string, len(texts))
+	for idx, text := range texts {
+		var err error
+		if rendered[idx], err = renderSidecarTemplate(name, text, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return rendered, nil
+}
+
+// sidecarResources returns the resource requests and limits for the sidecar.
+// The quantities are checked by ValidateSidecars at startup.
+func sidecarResources(sidecar *SidecarConfig) apiv1.ResourceRequirements {
+	resources := apiv1.ResourceRequirements{}
+
+	add := func(list *apiv1.ResourceList, name apiv1.ResourceName, quantity string) {
+		if quantity == "" {
+			return
+		}
+		if *list == nil {
+			*list = apiv1.ResourceList{}
+		}
+		(*list)[name] = resourcev1.MustParse(quantity)
+	}
+
+	add(&resources.Requests, apiv1.ResourceCPU, sidecar.CPURequest)
+	add(&resources.Requests, apiv1.ResourceMemory, sidecar.MemoryRequest)
+	add(&resources.Limits, apiv1.ResourceCPU, sidecar.CPULimit)
+	add(&resources.Limits, apiv1.ResourceMemory, sidecar.MemoryLimit)
+
+	return resources
+}
+
+// renderContainer returns the container described by the config, with its
+// templates rendered.
+func (i *Internal) renderContainer(job *model.Job, sidecar *SidecarConfig, data *SidecarTemplateData) (*apiv1.Container, error) {
+	image, err := renderSidecarTemplate(sidecar.Name, sidecar.Image, data)
+	if err != nil {
+		return nil, err
+	}
+
+	workingDir, err := renderSidecarTemplate(sidecar.Name, sidecar.WorkingDir, data)
+	if err != nil {
+		return nil, err
+	}
+
+	command, err := renderSidecarTemplates(sidecar.Name, sidecar.Command, data)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := renderSidecarTemplates(sidecar.Name, sidecar.Args, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort the environment so that the pod spec doesn't change between
+	// renderings of the same job.
+	envNames := []string{}
+	for k := range sidecar.Env {
+		envNames = append(envNames, k)
+	}
+	sort.Strings(envNames)
+
+	env := []apiv1.EnvVar{}
+	for _, k := range envNames {
+		value, err := renderSidecarTemplate(sidecar.Name, sidecar.Env[k], data)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, apiv1.EnvVar{Name: k, Value: value})
+	}
+
+	ports := []apiv1.ContainerPort{}
+	for _, port := range sidecar.Ports {
+		ports = append(ports, apiv1.ContainerPort{
+			ContainerPort: port,
+			Protocol:      apiv1.ProtocolTCP,
+		})
+	}
+
+	container := &apiv1.Container{
+		Name:            sidecar.Name,
+		Image:           image,
+		Command:         command,
+		Args:            args,
+		Env:             env,
+		WorkingDir:      workingDir,
+		Ports:           ports,
+		Resources:       sidecarResources(sidecar),
+		ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
+	}
+
+	if sidecar.MountWorkingDir {
+		container.VolumeMounts = i.analysisVolumeMounts(job)
+	}
+
+	if sidecar.RunAsRoot {
+		container.SecurityContext = &apiv1.SecurityContext{
+			RunAsUser:  int64Ptr(0),
+			RunAsGroup: int64Ptr(0),
+		}
+	}
+
+	return container, nil
+}
+
+// sidecarContainers returns the configured sidecars for the analysis, with
+// their templates rendered. It does not call the k8s API.
+func (i *Internal) sidecarContainers(job *model.Job) ([]apiv1.Container, error) {
+	containers := []apiv1.Container{}
+
+	if len(i.Sidecars) == 0 {
+		return containers, nil
+	}
+
+	data := i.sidecarTemplateData(job)
+
+	for idx := range i.Sidecars {
+		container, err := i.renderContainer(job, &i.Sidecars[idx], data)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, *container)
+	}
+
+	return containers, nil
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestValidateSidecars(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateSidecars(nil))
+	assert.NoError(ValidateSidecars([]SidecarConfig{
+		{Name: "metrics", Image: "example.org/exporter:1.0", Args: []string{"--job={{.ExternalID}}"}, CPURequest: "50m"},
+	}))
+
+	tests := []struct {
+		sidecar SidecarConfig
+		problem string
+	}{
+		{SidecarConfig{Name: "Metrics", Image: "exporter"}, "sidecar name Metrics"},
+		{SidecarConfig{Name: analysisContainerName, Image: "exporter"}, "is reserved"},
+		{SidecarConfig{Name: "metrics"}, "has no image"},
+		{SidecarConfig{Name: "metrics", Image: "exporter", Args: []string{"{{.ExternalID"}}, "sidecar metrics: template"},
+		{SidecarConfig{Name: "metrics", Image: "exporter", MemoryLimit: "lots"}, "resource lots"},
+	}
+
+	for _, test := range tests {
+		err := ValidateSidecars([]SidecarConfig{test.sidecar})
+		if assert.Error(err, "%+v", test.sidecar) {
+			assert.Contains(err.Error(), test.problem)
+		}
+	}
+
+	err := ValidateSidecars([]SidecarConfig{
+		{Name: "metrics", Image: "exporter"},
+		{Name: "metrics", Image: "exporter"},
+	})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "used more than once")
+	}
+}
+
+func TestSidecarContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	defer internal.db.Close()
+
+	internal.Sidecars = []SidecarConfig{
+		{
+			Name:            "metrics",
+			Image:           "example.org/exporter:1.0",
+			Args:            []string{"--job={{.ExternalID}}", "--app={{.AppID}}"},
+			Env:             map[string]string{"B_USER": "{{.Username}}", "A_HOST": "{{.Subdomain}}.example.org"},
+			Ports:           []int32{9100},
+			CPURequest:      "50m",
+			MemoryLimit:     "128Mi",
+			MountWorkingDir: true,
+		},
+	}
+
+	job := multiPortJob(8888)
+	job.AppID = "app1"
+	job.UserID = "u1"
+	job.Submitter = "test"
+
+	registerSubdomainQuery(mock, "e1", "")
+
+	containers, err := internal.sidecarContainers(job)
+	assert.NoError(err)
+	assert.Len(containers, 1)
+
+	sidecar := containers[0]
+	assert.Equal("metrics", sidecar.Name)
+	assert.Equal("example.org/exporter:1.0", sidecar.Image)
+	assert.Equal([]string{"--job=e1", "--app=app1"}, sidecar.Args)
+	assert.Nil(sidecar.Command)
+	assert.Equal([]apiv1.EnvVar{
+		{Name: "A_HOST", Value: IngressName("u1", "e1") + ".example.org"},
+		{Name: "B_USER", Value: "test"},
+	}, sidecar.Env)
+	assert.Equal(int32(9100), sidecar.Ports[0].ContainerPort)
+	assert.Equal("50m", sidecar.Resources.Requests.Cpu().String())
+	assert.Equal("128Mi", sidecar.Resources.Limits.Memory().String())
+	assert.Len(sidecar.VolumeMounts, 1)
+	assert.NoError(mock.ExpectationsWereMet())
+}
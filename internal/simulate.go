@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// Outcomes of the checks in a launch simulation.
+const (
+	SimulationPass    = "pass"
+	SimulationFail    = "fail"
+	SimulationWait    = "wait"
+	SimulationSkipped = "skipped"
+)
+
+// SimulationRequest describes a hypothetical launch. Image is the name and
+// tag of the tool image. Resources that aren't set get the same defaults as a
+// real launch.
+type SimulationRequest struct {
+	User     string  `json:"user"`
+	AppID    string  `json:"appID"`
+	Image    string  `json:"image"`
+	CPUCores float32 `json:"cpuCores"`
+	Memory   int64   `json:"memory"`
+	GPUs     int64   `json:"gpus"`
+}
+
+// SimulationCheck is the outcome of one of the checks a launch goes through.
+// Code is the error code the launch would be refused with.
+type SimulationCheck struct {
+	Name    string `json:"name"`
+	Outcome string `json:"outcome"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// SimulationResult is the outcome of a launch simulation. Launchable is false
+// if any check failed, and Queued is true if the launch would have to wait in
+// the launch queue.
+type SimulationResult struct {
+	Launchable bool              `json:"launchable"`
+	Queued     bool              `json:"queued"`
+	Checks     []SimulationCheck `json:"checks"`
+}
+
+// simulatedJob returns the job that would be submitted for the hypothetical
+// launch. GPUs are requested the way apps request them, through devices.
+func simulatedJob(request *SimulationRequest) *model.Job {
+	image := model.ContainerImage{}
+	image.Name, image.Tag = splitImageTag(request.Image)
+
+	container := model.Container{
+		Image:          image,
+		MinCPUCores:    request.CPUCores,
+		MinMemoryLimit: request.Memory,
+	}
+	for idx := int64(0); idx < request.GPUs; idx++ {
+		device := fmt.Sprintf("/dev/nvidia%d", idx)
+		container.Devices = append(container.Devices, model.Device{HostPath: device, ContainerPath: device})
+	}
+
+	return &model.Job{
+		AppID:           request.AppID,
+		Submitter:       request.User,
+		ExecutionTarget: "interapps",
+		Steps: []model.Step{
+			{Component: model.StepComponent{Container: container}},
+		},
+	}
+}
+
+// simulationCheck turns the outcome of a validation into a check.
+func simulationCheck(name string, err error) SimulationCheck {
+	check := SimulationCheck{Name: name, Outcome: SimulationPass}
+	if err == nil {
+		return check
+	}
+
+	check.Outcome = SimulationFail
+	if response, ok := err.(common.ErrorResponse); ok {
+		check.Code = response.ErrorCode
+		check.Message = response.Message
+	} else {
+		check.Message = err.Error()
+	}
+
+	return check
+}
+
+// simulateLaunch runs the checks a launch goes through without launching
+// anything or changing the launch queue. The checks in jobChecks are the same
+// ones a launch runs, followed by the ones that would hold it in the queue.
+func (i *Internal) simulateLaunch(ctx context.Context, request *SimulationRequest) *SimulationResult {
+	job := simulatedJob(request)
+	result := &SimulationResult{Checks: []SimulationCheck{}}
+
+	for _, check := range jobChecks {
+		if check.skipped != nil {
+			if reason := check.skipped(i); reason != "" {
+				result.Checks = append(result.Checks, SimulationCheck{
+					Name: check.name, Outcome: SimulationSkipped, Message: reason,
+				})
+				continue
+			}
+		}
+
+		_, err := check.validate(i, ctx, job, 1)
+		result.Checks = append(result.Checks, simulationCheck(check.name, err))
+	}
+
+	result.Checks = append(result.Checks, i.simulateAppConcurrency(job.AppID))
+	result.Checks = append(result.Checks, i.simulateCapacity())
+
+	result.Launchable = true
+	for _, check := range result.Checks {
+		switch check.Outcome {
+		case SimulationFail:
+			result.Launchable = false
+		case SimulationWait:
+			result.Queued = true
+		}
+	}
+
+	return result
+}
+
+// simulateAppConcurrency checks whether the app has room under its
+// concurrency limit.
+func (i *Internal) simulateAppConcurrency(appID string) SimulationCheck {
+	limit, err := i.appConcurrencyLimit(appID)
+	if err != nil {
+		return simulationCheck("app-concurrency", err)
+	}
+	if limit == nil {
+		return SimulationCheck{Name: "app-concurrency", Outcome: SimulationPass, Message: "the app has no concurrency limit"}
+	}
+
+	countedAt := time.Now()
+	counts, err := i.countAnalyses()
+	if err != nil {
+		return simulationCheck("app-concurrency", err)
+	}
+
+	i.launchQueue.mu.Lock()
+	countReservations(i.launchQueue.reservations(countedAt), counts, map[string]*userQuotaState{}, map[string]bool{})
+	atLimit := i.appAtLimit(limit, counts.byApp)
+	i.launchQueue.mu.Unlock()
+
+	if atLimit {
+		return SimulationCheck{
+			Name:    "app-concurrency",
+			Outcome: SimulationWait,
+			Message: fmt.Sprintf("app %s is at its limit of %d running analyses, so the launch would be queued", appID, limit.MaxRunning),
+		}
+	}
+
+	return SimulationCheck{
+		Name:    "app-concurrency",
+		Outcome: SimulationPass,
+		Message: fmt.Sprintf("app %s is below its limit of %d running analyses", appID, limit.MaxRunning),
+	}
+}
+
+// simulateCapacity checks whether launch shaping would hold the launch back.
+func (i *Internal) simulateCapacity() SimulationCheck {
+	if !i.LaunchShaping.Enabled {
+		return SimulationCheck{Name: "capacity", Outcome: SimulationSkipped, Message: "launch shaping is not enabled"}
+	}
+
+	i.launchQueue.mu.Lock()
+	waiting := len(i.launchQueue.launches)
+	i.launchQueue.mu.Unlock()
+
+	if waiting > 0 {
+		return SimulationCheck{
+			Name:    "capacity",
+			Outcome: SimulationWait,
+			Message: fmt.Sprintf("%d launches are already queued, so the launch would be queued behind them", waiting),
+		}
+	}
+
+	utilization, err := i.clusterUtilization()
+	if err != nil {
+		return simulationCheck("capacity", err)
+	}
+
+	check := SimulationCheck{
+		Name:    "capacity",
+		Outcome: SimulationPass,
+		Message: fmt.Sprintf("the cluster is at %.0f%% of its capacity, below the %.0f%% threshold", utilization*100, i.LaunchShaping.UtilizationThreshold*100),
+	}
+	if utilization >= i.LaunchShaping.UtilizationThreshold {
+		check.Outcome = SimulationWait
+		check.Message = fmt.Sprintf("the cluster is at %.0f%% of its capacity, over the %.0f%% threshold, so the launch would be queued", utilization*100, i.LaunchShaping.UtilizationThreshold*100)
+	}
+
+	return check
+}
+
+// AdminSimulateLaunchHandler reports which of the checks a launch goes
+// through would pass or fail for the hypothetical launch in the body of the
+// request, without launching anything.
+func (i *Internal) AdminSimulateLaunchHandler(c echo.Context) error {
+	request := &SimulationRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if request.User == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user is required")
+	}
+
+	return c.JSON(http.StatusOK, i.simulateLaunch(c.Request().Context(), request))
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestSimulatedJob(t *testing.T) {
+	assert := assert.New(t)
+
+	job := simulatedJob(&SimulationRequest{
+		User:     "alice",
+		AppID:    "app1",
+		Image:    "harbor.example.org:5000/de/jupyter:1.2",
+		CPUCores: 2,
+		GPUs:     2,
+	})
+
+	container := job.Steps[0].Component.Container
+	assert.Equal("harbor.example.org:5000/de/jupyter", container.Image.Name)
+	assert.Equal("1.2", container.Image.Tag)
+	assert.Equal(float32(2), cpuResourceRequest(job))
+	assert.Equal(int64(2*gibibyte), memResourceRequest(job))
+
+	_, gpus := gpuRequest(job)
+	assert.Equal(int64(2), gpus)
+
+	// Images without a tag keep the port in the name.
+	job = simulatedJob(&SimulationRequest{Image: "harbor.example.org:5000/de/jupyter"})
+	assert.Equal("harbor.example.org:5000/de/jupyter", job.Steps[0].Component.Container.Image.Name)
+	assert.Equal("", job.Steps[0].Component.Container.Image.Tag)
+}
+
+func TestSimulateLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		appDeployment("e1", "license-app"),
+	})
+
+	registerFreezeQuery(mock, "alice", nil)
+	registerLimitQuery(mock, "alice", nil)
+	registerDefaultLimitQuery(mock, 2)
+	registerAppLimitQuery(mock, "license-app", 1)
+
+	result := i.simulateLaunch(context.Background(), &SimulationRequest{User: "alice", AppID: "license-app"})
+	assert.True(result.Launchable)
+	assert.True(result.Queued)
+
+	outcomes := map[string]string{}
+	for _, check := range result.Checks {
+		outcomes[check.Name] = check.Outcome
+	}
+	assert.Equal(map[string]string{
+		"frozen":          SimulationPass,
+		"image":           SimulationSkipped,
+		"auxiliary":       SimulationPass,
+		"plan":            SimulationSkipped,
+		"quota":           SimulationSkipped,
+		"gpu-budget":      SimulationSkipped,
+		"job-limit":       SimulationPass,
+		"app-concurrency": SimulationWait,
+		"capacity":        SimulationSkipped,
+	}, outcomes)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestSimulateLaunchFrozen(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	reason := "abuse"
+	registerFreezeQuery(mock, "alice", &reason)
+	registerLimitQuery(mock, "alice", intPointer(0))
+	registerDefaultLimitQuery(mock, 2)
+
+	result := i.simulateLaunch(context.Background(), &SimulationRequest{User: "alice"})
+	assert.False(result.Launchable)
+	assert.False(result.Queued)
+
+	assert.Equal(SimulationFail, result.Checks[0].Outcome)
+	assert.Equal("ERR_USER_FROZEN", result.Checks[0].Code)
+
+	// The checks are the ones a launch runs, in the same order.
+	for idx, check := range jobChecks {
+		assert.Equal(check.name, result.Checks[idx].Name)
+	}
+
+	jobLimit := result.Checks[len(jobChecks)-1]
+	assert.Equal("job-limit", jobLimit.Name)
+	assert.Equal(SimulationFail, jobLimit.Outcome)
+	assert.Equal("ERR_FORBIDDEN", jobLimit.Code)
+	assert.Equal("alice is not permitted to run jobs", jobLimit.Message)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// outputSyncTimeout is how long the analysis container gets to flush pending
+// writes to the data store.
+const outputSyncTimeout = 5 * time.Minute
+
+// defaultSaveAndExitTimeout is how long save-and-exit waits for the outputs to
+// be saved if no timeout is configured.
+const defaultSaveAndExitTimeout = 2 * time.Hour
+
+// syncOutputs flushes any pending writes on the CSI data mount in the
+// running pods for the analysis, so that the output files make it into iRODS
+// before the persistent volume is released.
+func (i *Internal) syncOutputs(ctx context.Context, externalID string) error {
+	if i.podExecutor == nil {
+		return errors.New("output syncing is not enabled")
+	}
+
+	podList, err := i.podList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != apiv1.PodRunning {
+			continue
+		}
+
+		_, stderr, err := i.execWithContext(ctx, pod.Namespace, pod.Name, analysisContainerName, []string{"sync"}, outputSyncTimeout)
+		if err != nil {
+			return errors.Wrapf(err, "error syncing outputs in pod %s: %s", pod.Name, stderr)
+		}
+	}
+
+	return nil
+}
+
+// snapshotOutputs makes sure that the output files for the analysis are safe
+// in the data store. Analyses using the CSI driver have their data mount
+// flushed. Otherwise, the file transfer sidecar is asked to upload the outputs
+// and this blocks until it's done. Progress is reported through the status
+// publisher. It gives up once the context is done.
+func (i *Internal) snapshotOutputs(ctx context.Context, externalID string) error {
+	if !i.UseCSIDriver {
+		return i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, false)
+	}
+
+	state, err := i.currentState(externalID, RunningState)
+	if err != nil {
+		return err
+	}
+
+	if state != RunningState && state != SavingState {
+		return fmt.Errorf("analysis %s is %s, so its outputs can't be saved", externalID, state)
+	}
+
+	i.transitionAndLog(externalID, SavingState, fmt.Sprintf("saving output files for analysis %s", externalID))
+
+	if err = i.syncOutputs(ctx, externalID); err != nil {
+		msg := fmt.Sprintf("output files for analysis %s could not be saved: %s", externalID, err.Error())
+		i.transitionAndLog(externalID, RunningState, msg)
+		return errors.New(msg)
+	}
+
+	i.transitionAndLog(externalID, RunningState, fmt.Sprintf("output files for analysis %s have been saved", externalID))
+
+	return nil
+}
+
+// snapshotOutputsWithTimeout calls snapshotOutputs, but gives up on it after
+// the save-and-exit timeout. The sync or transfer still running when the
+// timeout is reached is abandoned along with it.
+func (i *Internal) snapshotOutputsWithTimeout(externalID string) error {
+	timeout := i.SaveAndExitTimeout
+	if timeout <= 0 {
+		timeout = defaultSaveAndExitTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := i.snapshotOutputs(ctx, externalID)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("output files for analysis %s were not saved within %s", externalID, timeout)
+	}
+	return err
+}
+
+// saveOutputsBeforeExit is the saving-outputs stage of a teardown. If upload
+// is true, the outputs are saved as they would be for a snapshot. Otherwise
+// only the CSI data mount is flushed, since that's backed by a persistent
+// volume that's about to go away. Either way, the teardown waits no longer
+// than the save-and-exit timeout before it carries on without the outputs.
+func (i *Internal) saveOutputsBeforeExit(t *teardownTracker, externalID string, upload bool) {
+	if upload {
+		if err := t.run(TeardownSavingOutputs, func() error {
+			return i.snapshotOutputsWithTimeout(externalID)
+		}); err != nil {
+			log.Error(errors.Wrapf(err, "error uploading outputs for %s", externalID))
+		}
+		return
+	}
+
+	if !i.UseCSIDriver {
+		t.skip(TeardownSavingOutputs, "outputs are only uploaded by save-and-exit")
+		return
+	}
+
+	state, err := i.currentState(externalID, RunningState)
+	if err != nil {
+		log.Error(err)
+		t.skip(TeardownSavingOutputs, err.Error())
+		return
+	}
+
+	if state != RunningState {
+		t.skip(TeardownSavingOutputs, fmt.Sprintf("analysis is %s", state))
+		return
+	}
+
+	if err = t.run(TeardownSavingOutputs, func() error {
+		return i.snapshotOutputsWithTimeout(externalID)
+	}); err != nil {
+		log.Error(err)
+	}
+}
+
+// finishSaveAndExit publishes the final status of an analysis that's being
+// shut down by save-and-exit, so that users hear whether their outputs were
+// saved before the analysis goes away.
+func (i *Internal) finishSaveAndExit(t *teardownTracker, externalID string) {
+	if t.progress.OutputsSaved {
+		if err := i.markTerminated(externalID, fmt.Sprintf("output files for analysis %s have been saved", externalID)); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	msg := fmt.Sprintf("output files for analysis %s could not be saved before it was shut down", externalID)
+	if _, stage := t.stage(TeardownSavingOutputs); stage.Message != "" {
+		msg = fmt.Sprintf("%s: %s", msg, stage.Message)
+	}
+
+	i.transitionAndLog(externalID, TerminatingState, fmt.Sprintf("termination requested for analysis %s", externalID))
+	i.transitionAndLog(externalID, FailedState, msg)
+}
+
+// SnapshotOutputsHandler handles requests to save the output files for an
+// analysis without shutting it down. The save is done in a goroutine, with
+// its progress reported through the status publisher.
+func (i *Internal) SnapshotOutputsHandler(c echo.Context) error {
+	externalID := c.Param("id")
+
+	go func() {
+		if err := i.snapshotOutputs(context.Background(), externalID); err != nil {
+			log.Error(errors.Wrapf(err, "error saving outputs for %s", externalID))
+		}
+	}()
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// AdminSnapshotOutputsHandler handles requests to save the output files for an
+// analysis based on its analysis ID rather than its external ID.
+func (i *Internal) AdminSnapshotOutputsHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := i.snapshotOutputs(context.Background(), externalID); err != nil {
+			log.Error(errors.Wrapf(err, "error saving outputs for %s", externalID))
+		}
+	}()
+
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// runningPod creates a fake running VICE analysis pod to use for testing.
+func runningPod(externalID string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace: testConfig.ViceNamespace,
+			Name:      "pod-" + externalID,
+			Labels: map[string]string{
+				"app-type":    "interactive",
+				"external-id": externalID,
+			},
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+}
+
+// expectStateChange registers the queries made by a transition to the state.
+// Nothing is written if the analysis is already in the state.
+func expectStateChange(mock sqlmock.Sqlmock, externalID string, from, to AnalysisState) {
+	registerStateQuery(mock, externalID, &from)
+	if from == to {
+		return
+	}
+	mock.ExpectExec("INSERT INTO vice_analysis_states").
+		WithArgs(externalID, string(to)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestSnapshotOutputs(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, []runtime.Object{runningPod("e1")})
+	internal.UseCSIDriver = true
+	internal.statusPublisher = &recordingPublisher{}
+
+	executor := &stubExecutor{}
+	internal.SetPodExecutor(executor)
+
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	expectStateChange(mock, "e1", RunningState, SavingState)
+	expectStateChange(mock, "e1", SavingState, RunningState)
+
+	assert.NoError(internal.snapshotOutputs(context.Background(), "e1"))
+	assert.Equal([][]string{{"sync"}}, executor.commands)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestSnapshotOutputsFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, []runtime.Object{runningPod("e1")})
+	internal.UseCSIDriver = true
+	internal.statusPublisher = &recordingPublisher{}
+	internal.SetPodExecutor(&stubExecutor{err: errors.New("input/output error")})
+
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	expectStateChange(mock, "e1", RunningState, SavingState)
+	expectStateChange(mock, "e1", SavingState, RunningState)
+
+	err := internal.snapshotOutputs(context.Background(), "e1")
+	assert.Error(err)
+	assert.Contains(err.Error(), "input/output error")
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestSnapshotOutputsNotRunning(t *testing.T) {
+	internal, mock := setupInternal(t, nil)
+	internal.UseCSIDriver = true
+
+	provisioning := ProvisioningState
+	registerStateQuery(mock, "e1", &provisioning)
+
+	assert.Error(t, internal.snapshotOutputs(context.Background(), "e1"))
+}
+
+func TestSnapshotOutputsWithTimeout(t *testing.T) {
+	internal, mock := setupInternal(t, []runtime.Object{runningPod("e1")})
+	internal.UseCSIDriver = true
+	internal.SaveAndExitTimeout = time.Millisecond
+	internal.statusPublisher = &recordingPublisher{}
+	executor := &blockingExecutor{release: make(chan struct{})}
+	internal.SetPodExecutor(executor)
+
+	// The hung sync is abandoned rather than left running in the background,
+	// and the analysis goes back to running.
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	expectStateChange(mock, "e1", RunningState, SavingState)
+	expectStateChange(mock, "e1", SavingState, RunningState)
+
+	err := internal.snapshotOutputsWithTimeout("e1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "were not saved within")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&executor.abandoned))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSaveOutputsBeforeExitTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, []runtime.Object{runningPod("e1")})
+	internal.UseCSIDriver = true
+	internal.SaveAndExitTimeout = time.Millisecond
+	internal.statusPublisher = &recordingPublisher{}
+	internal.SetPodExecutor(&blockingExecutor{release: make(chan struct{})})
+
+	// Flushing the data mount for a plain teardown gives up on a hung mount
+	// too, instead of holding up the teardown.
+	running := RunningState
+	registerStateQuery(mock, "e1", &running)
+	registerStateQuery(mock, "e1", &running)
+	expectStateChange(mock, "e1", RunningState, SavingState)
+	expectStateChange(mock, "e1", SavingState, RunningState)
+
+	tracker := &teardownTracker{i: internal, progress: &TeardownProgress{
+		ExternalID: "e1",
+		Stages:     []TeardownStage{{Name: TeardownSavingOutputs, Status: StagePending}},
+	}}
+
+	internal.saveOutputsBeforeExit(tracker, "e1", false)
+	_, stage := tracker.stage(TeardownSavingOutputs)
+	assert.Equal(StageFailed, stage.Status)
+	assert.Contains(stage.Message, "were not saved within")
+}
+
+func TestFinishSaveAndExit(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	tracker := &teardownTracker{i: internal, progress: &TeardownProgress{
+		ExternalID:   "e1",
+		Stages:       []TeardownStage{{Name: TeardownSavingOutputs, Status: StageDone}},
+		OutputsSaved: true,
+	}}
+
+	// markTerminated looks up the state before each transition.
+	terminating := TerminatingState
+	registerStateQuery(mock, "e1", &terminating)
+	expectStateChange(mock, "e1", TerminatingState, CompletedState)
+
+	internal.finishSaveAndExit(tracker, "e1")
+	assert.Equal([]string{"Completed"}, publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestFinishSaveAndExitFailedSave(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	tracker := &teardownTracker{i: internal, progress: &TeardownProgress{
+		ExternalID: "e1",
+		Stages:     []TeardownStage{{Name: TeardownSavingOutputs, Status: StageFailed, Message: "timed out"}},
+	}}
+
+	expectStateChange(mock, "e1", TerminatingState, TerminatingState)
+	expectStateChange(mock, "e1", TerminatingState, FailedState)
+
+	internal.finishSaveAndExit(tracker, "e1")
+	assert.Equal([]string{"Running", "Failed"}, publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+// blockingExecutor is a PodExecutor whose commands don't finish until release
+// is closed or they're abandoned. The number of abandoned commands is counted.
+type blockingExecutor struct {
+	release   chan struct{}
+	abandoned int32
+}
+
+func (b *blockingExecutor) Exec(ctx context.Context, namespace, pod, container string, command []string) (string, string, error) {
+	select {
+	case <-b.release:
+		return "", "", nil
+	case <-ctx.Done():
+		atomic.AddInt32(&b.abandoned, 1)
+		return "", "", ctx.Err()
+	}
+}
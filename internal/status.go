@@ -1,13 +1,8 @@
 package internal
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"net/url"
 	"os"
-	"path"
 
 	"github.com/cyverse-de/messaging"
 	"github.com/pkg/errors"
@@ -25,12 +20,15 @@ type AnalysisStatusPublisher interface {
 	Fail(jobID, msg string) error
 	Success(jobID, msg string) error
 	Running(jobID, msg string) error
+	Queued(jobID, msg string) error
+	ImpendingCancellation(jobID, msg string) error
 }
 
 // JSLPublisher is a concrete implementation of AnalysisStatusPublisher that
-// posts status updates to the job-status-listener service.
+// sends status updates to the job-status-listener service through a
+// StatusTransport.
 type JSLPublisher struct {
-	statusURL string
+	transport StatusTransport
 }
 
 // AnalysisStatus contains the data needed to post a status update to the
@@ -48,50 +46,7 @@ func (j *JSLPublisher) postStatus(jobID, msg string, jobState messaging.JobState
 		Message: msg,
 	}
 
-	u, err := url.Parse(j.statusURL)
-	if err != nil {
-		return errors.Wrapf(
-			err,
-			"error parsing URL %s for job %s before posting %s status",
-			j,
-			jobID,
-			jobState,
-		)
-	}
-	u.Path = path.Join(jobID, "status")
-
-	js, err := json.Marshal(status)
-	if err != nil {
-		return errors.Wrapf(
-			err,
-			"error marshalling JSON for analysis %s before posting %s status",
-			jobID,
-			jobState,
-		)
-
-	}
-	response, err := http.Post(u.String(), "application/json", bytes.NewReader(js))
-	if err != nil {
-		return errors.Wrapf(
-			err,
-			"error returned posting %s status for job %s to %s",
-			jobState,
-			jobID,
-			u.String(),
-		)
-	}
-	if response.StatusCode < 200 || response.StatusCode > 399 {
-		return errors.Wrapf(
-			err,
-			"error status code %d returned after posting %s status for job %s to %s: %s",
-			response.StatusCode,
-			jobState,
-			jobID,
-			u.String(),
-			response.Body,
-		)
-	}
-	return nil
+	return j.transport.SendStatus(jobID, status)
 }
 
 // Fail sends an analysis failure update with the provided message via the AMQP
@@ -116,15 +71,31 @@ func (j *JSLPublisher) Running(jobID, msg string) error {
 	return j.postStatus(jobID, msg, messaging.RunningState)
 }
 
+// Queued sends an analysis queued status update with the provided message via
+// the AMQP broker. Sent while the launch waits in the launch queue, whenever
+// its position changes.
+func (j *JSLPublisher) Queued(jobID, msg string) error {
+	log.Warnf("Sending queued job status update for external-id %s", jobID)
+	return j.postStatus(jobID, msg, messaging.QueuedState)
+}
+
+// ImpendingCancellation sends a status update with the provided message via
+// the AMQP broker saying that the analysis is being shut down. Sent as the
+// analysis moves through the stages of its teardown.
+func (j *JSLPublisher) ImpendingCancellation(jobID, msg string) error {
+	log.Warnf("Sending impending cancellation job status update for external-id %s", jobID)
+	return j.postStatus(jobID, msg, messaging.ImpendingCancellationState)
+}
+
 // MonitorVICEEvents fires up a goroutine that forwards events from the cluster
 // to the status receiving service (probably job-status-listener).
 func (i *Internal) MonitorVICEEvents() {
 	go func(clientset kubernetes.Interface) {
 		for {
 			log.Debug("beginning to monitor k8s events")
-			set := labels.Set(map[string]string{
+			set := labels.Set(i.labelKeys.selector(map[string]string{
 				"app-type": "interactive",
-			})
+			}))
 			factory := informers.NewSharedInformerFactoryWithOptions(
 				clientset,
 				0,
@@ -151,22 +122,35 @@ func (i *Internal) MonitorVICEEvents() {
 
 					labels := depObj.GetLabels()
 
-					jobID, ok := labels["external-id"]
-					if !ok {
+					jobID := i.labelKeys.get(labels, "external-id")
+					if jobID == "" {
 						log.Error(errors.New("deployment is missing external-id label"))
 						return
 					}
 
 					log.Infof("processing deployment addition for job %s", jobID)
 
-					analysisName, ok := labels["analysis-name"]
-					if !ok {
+					analysisName := i.labelKeys.get(labels, "analysis-name")
+					if analysisName == "" {
 						log.Error(errors.New("deployment is missing analysis-name label"))
 						return
 					}
 
-					if err = i.statusPublisher.Running(
+					// The informer replays existing deployments when it starts up, so
+					// only analyses that haven't gotten past provisioning get moved.
+					state, err := i.currentState(jobID, ProvisioningState)
+					if err != nil {
+						log.Error(err)
+						return
+					}
+
+					if state == RequestedState {
+						state = ProvisioningState
+					}
+
+					if err = i.transition(
 						jobID,
+						state,
 						fmt.Sprintf("deployment %s has started for analysis %s", depObj.GetName(), analysisName),
 					); err != nil {
 						log.Error(err)
@@ -185,21 +169,21 @@ func (i *Internal) MonitorVICEEvents() {
 
 					labels := depObj.GetLabels()
 
-					jobID, ok := labels["external-id"]
-					if !ok {
+					jobID := i.labelKeys.get(labels, "external-id")
+					if jobID == "" {
 						log.Error(errors.New("deployment is missing external-id label"))
 						return
 					}
 
 					log.Infof("processing deployment deletion for job %s", jobID)
 
-					analysisName, ok := labels["analysis-name"]
-					if !ok {
+					analysisName := i.labelKeys.get(labels, "analysis-name")
+					if analysisName == "" {
 						log.Error(errors.New("deployment is missing analysis-name label"))
 						return
 					}
 
-					if err = i.statusPublisher.Success(
+					if err = i.markTerminated(
 						jobID,
 						fmt.Sprintf("deployment %s has been deleted for analysis %s", depObj.GetName(), analysisName),
 					); err != nil {
@@ -217,8 +201,8 @@ func (i *Internal) MonitorVICEEvents() {
 						return
 					}
 
-					jobID, ok := depObj.Labels["external-id"]
-					if !ok {
+					jobID := i.labelKeys.get(depObj.Labels, "external-id")
+					if jobID == "" {
 						log.Error(errors.New("deployment is missing external-id label"))
 						return
 					}
@@ -231,6 +215,10 @@ func (i *Internal) MonitorVICEEvents() {
 				},
 			})
 
+			if i.listingCache.enabled() {
+				deploymentInformer.AddEventHandler(i.listingCache.invalidationHandler())
+			}
+
 			deploymentInformer.Run(deploymentInformerStop)
 		}
 	}(i.clientset)
@@ -241,15 +229,27 @@ func (i *Internal) MonitorVICEEvents() {
 func (i *Internal) eventDeploymentModified(deployment *appsv1.Deployment, jobID string) error {
 	var err error
 
-	analysisName := deployment.Labels["analysis-name"]
+	analysisName := i.labelKeys.get(deployment.Labels, "analysis-name")
 
 	if deployment.DeletionTimestamp != nil {
 		// Pod was deleted at some point, don't do anything now.
 		return nil
 	}
 
-	err = i.statusPublisher.Running(
+	// A deployment becoming ready only moves a provisioning analysis along.
+	// Transfers might be running in any of the other states.
+	state, err := i.currentState(jobID, ProvisioningState)
+	if err != nil {
+		return err
+	}
+
+	if deployment.Status.ReadyReplicas > 0 && state == ProvisioningState {
+		state = RunningState
+	}
+
+	err = i.transition(
 		jobID,
+		state,
 		fmt.Sprintf(
 			"deployment %s for analysis %s summary: \n replicas: %d ready replicas: %d \n available replicas: %d \n unavailable replicas: %d",
 			deployment.Name,
@@ -264,6 +264,30 @@ func (i *Internal) eventDeploymentModified(deployment *appsv1.Deployment, jobID
 	return err
 }
 
+// markTerminated moves the analysis through the Terminating state, if it isn't
+// already there, and into the Completed state. Analyses that are already in a
+// terminal state are left alone.
+func (i *Internal) markTerminated(jobID, msg string) error {
+	current, err := i.getAnalysisState(jobID)
+	if err != nil {
+		return err
+	}
+
+	if current != nil {
+		if current.State.IsTerminal() {
+			return nil
+		}
+
+		if current.State != TerminatingState {
+			if err = i.transition(jobID, TerminatingState, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return i.transition(jobID, CompletedState, msg)
+}
+
 func hostname() string {
 	h, err := os.Hostname()
 	if err != nil {
@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/tracing"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// StatusTransport is the interface for types that deliver analysis status
+// updates to the service that records them.
+type StatusTransport interface {
+	SendStatus(jobID string, status *AnalysisStatus) error
+}
+
+// SetStatusTransport changes how status updates are delivered. Updates are
+// POSTed to the job-status-listener as JSON if it's never called.
+func (i *Internal) SetStatusTransport(transport StatusTransport) {
+	i.statusPublisher = &JSLPublisher{transport: transport}
+}
+
+// HTTPStatusTransport POSTs status updates to the job-status-listener as JSON.
+type HTTPStatusTransport struct {
+	statusURL string
+}
+
+// NewHTTPStatusTransport returns a new *HTTPStatusTransport that posts updates
+// to the job-status-listener at statusURL.
+func NewHTTPStatusTransport(statusURL string) *HTTPStatusTransport {
+	return &HTTPStatusTransport{statusURL: statusURL}
+}
+
+// SendStatus posts the status update for the job.
+func (t *HTTPStatusTransport) SendStatus(jobID string, status *AnalysisStatus) error {
+	u, err := url.Parse(t.statusURL)
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"error parsing URL %s for job %s before posting %s status",
+			t.statusURL,
+			jobID,
+			status.State,
+		)
+	}
+	u.Path = path.Join(jobID, "status")
+
+	js, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"error marshalling JSON for analysis %s before posting %s status",
+			jobID,
+			status.State,
+		)
+
+	}
+	response, err := tracing.Client.Post(u.String(), "application/json", bytes.NewReader(js))
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"error returned posting %s status for job %s to %s",
+			status.State,
+			jobID,
+			u.String(),
+		)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 399 {
+		return errors.Wrapf(
+			err,
+			"error status code %d returned after posting %s status for job %s to %s: %s",
+			response.StatusCode,
+			status.State,
+			jobID,
+			u.String(),
+			response.Body,
+		)
+	}
+	return nil
+}
+
+// Default settings for status updates sent over request-reply.
+const (
+	DefaultStatusSubject  = "cyverse.de.vice.status"
+	defaultStatusTimeout  = 5 * time.Second
+	defaultStatusAttempts = 3
+)
+
+// StatusTransportConfig selects how status updates are delivered. Transport
+// is either "http", the default, which posts them to the job-status-listener,
+// or "nats", which sends them to Subject over NATS request-reply and waits up
+// to Timeout for each acknowledgement, trying up to Attempts times.
+type StatusTransportConfig struct {
+	Transport string        `mapstructure:"transport"`
+	Subject   string        `mapstructure:"subject"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+	Attempts  int           `mapstructure:"attempts"`
+}
+
+// RequestReply returns true if status updates go over request-reply.
+func (c *StatusTransportConfig) RequestReply() bool {
+	return c.Transport == "nats"
+}
+
+// Validate returns an error if the transport isn't known.
+func (c *StatusTransportConfig) Validate() error {
+	switch c.Transport {
+	case "", "http", "nats":
+		return nil
+	default:
+		return fmt.Errorf("unknown status transport %q", c.Transport)
+	}
+}
+
+// NewTransport returns the request-reply transport described by the config,
+// sending requests through the requester.
+func (c *StatusTransportConfig) NewTransport(requester Requester) *RequestReplyStatusTransport {
+	subject := c.Subject
+	if subject == "" {
+		subject = DefaultStatusSubject
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultStatusTimeout
+	}
+	attempts := c.Attempts
+	if attempts <= 0 {
+		attempts = defaultStatusAttempts
+	}
+	return NewRequestReplyStatusTransport(requester, subject, timeout, attempts)
+}
+
+// Requester sends a request and waits for the reply. A NATS connection can be
+// adapted to it by returning the data of the reply from Conn.Request.
+type Requester interface {
+	Request(subject string, data []byte, timeout time.Duration) ([]byte, error)
+}
+
+// RequestReplyStatusTransport sends status updates as protobuf messages through
+// a request-reply transport such as NATS and waits for the receiver to
+// acknowledge them. Updates that aren't acknowledged are resent with the same
+// update ID, so that the receiver can drop duplicates.
+//
+// Updates are encoded as:
+//
+//	message AnalysisStatusUpdate {
+//	  string update_id = 1;
+//	  string job_id = 2;
+//	  string host = 3;
+//	  string state = 4;
+//	  string message = 5;
+//	  int64 sent_on = 6; // milliseconds since the epoch
+//	}
+//
+// Acknowledgements are expected as:
+//
+//	message AnalysisStatusAck {
+//	  string update_id = 1;
+//	  bool ok = 2;
+//	  string error = 3;
+//	}
+type RequestReplyStatusTransport struct {
+	requester Requester
+	subject   string
+	timeout   time.Duration
+	attempts  int
+}
+
+// NewRequestReplyStatusTransport returns a new *RequestReplyStatusTransport
+// that sends updates to the subject, waiting up to timeout for each
+// acknowledgement and trying up to attempts times.
+func NewRequestReplyStatusTransport(requester Requester, subject string, timeout time.Duration, attempts int) *RequestReplyStatusTransport {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &RequestReplyStatusTransport{
+		requester: requester,
+		subject:   subject,
+		timeout:   timeout,
+		attempts:  attempts,
+	}
+}
+
+// SendStatus sends the status update for the job and waits for it to be
+// acknowledged.
+func (t *RequestReplyStatusTransport) SendStatus(jobID string, status *AnalysisStatus) error {
+	updateID, err := newUpdateID()
+	if err != nil {
+		return err
+	}
+
+	msg := encodeStatusUpdate(updateID, jobID, status, time.Now())
+
+	for attempt := 1; attempt <= t.attempts; attempt++ {
+		var reply []byte
+
+		reply, err = t.requester.Request(t.subject, msg, t.timeout)
+		if err != nil {
+			log.Warnf("attempt %d of %d to send %s status for %s failed: %s", attempt, t.attempts, status.State, jobID, err)
+			continue
+		}
+
+		return checkStatusAck(updateID, reply)
+	}
+
+	return errors.Wrapf(err, "%s status for %s was not acknowledged", status.State, jobID)
+}
+
+// newUpdateID returns a random ID for a status update.
+func newUpdateID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating a status update ID")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// encodeStatusUpdate returns the protobuf encoding of the status update.
+func encodeStatusUpdate(updateID, jobID string, status *AnalysisStatus, sentOn time.Time) []byte {
+	var b []byte
+
+	appendString := func(num protowire.Number, value string) {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, value)
+	}
+
+	appendString(1, updateID)
+	appendString(2, jobID)
+	appendString(3, status.Host)
+	appendString(4, string(status.State))
+	appendString(5, status.Message)
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(sentOn.UnixNano()/int64(time.Millisecond)))
+
+	return b
+}
+
+// checkStatusAck returns an error unless the reply acknowledges the update.
+func checkStatusAck(updateID string, reply []byte) error {
+	var (
+		ackID  string
+		ok     bool
+		errMsg string
+	)
+
+	b := reply
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "error parsing status acknowledgement")
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			ackID, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			ok = protowire.DecodeBool(v)
+		case num == 3 && typ == protowire.BytesType:
+			errMsg, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "error parsing status acknowledgement")
+		}
+		b = b[n:]
+	}
+
+	if ackID != updateID {
+		return fmt.Errorf("status acknowledgement was for update %s instead of %s", ackID, updateID)
+	}
+
+	if !ok {
+		return fmt.Errorf("status update %s was rejected: %s", updateID, errMsg)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeStatusUpdate is the inverse of encodeStatusUpdate.
+func decodeStatusUpdate(b []byte) (updateID, jobID string, status *AnalysisStatus, err error) {
+	status = &AnalysisStatus{}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", "", nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return "", "", nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			updateID = value
+		case 2:
+			jobID = value
+		case 3:
+			status.Host = value
+		case 4:
+			status.State = messaging.JobState(value)
+		case 5:
+			status.Message = value
+		}
+	}
+
+	return updateID, jobID, status, nil
+}
+
+// encodeStatusAck returns the protobuf encoding of an acknowledgement.
+func encodeStatusAck(updateID string, ok bool, errMsg string) []byte {
+	var b []byte
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, updateID)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, protowire.EncodeBool(ok))
+	if errMsg != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, errMsg)
+	}
+
+	return b
+}
+
+// ackingRequester acknowledges status updates after failing the configured
+// number of times, recording each update it receives.
+type ackingRequester struct {
+	failures int
+	reject   bool
+	subjects []string
+	updates  []string
+}
+
+func (r *ackingRequester) Request(subject string, data []byte, timeout time.Duration) ([]byte, error) {
+	r.subjects = append(r.subjects, subject)
+
+	updateID, _, _, err := decodeStatusUpdate(data)
+	if err != nil {
+		return nil, err
+	}
+	r.updates = append(r.updates, updateID)
+
+	if r.failures > 0 {
+		r.failures--
+		return nil, errors.New("nats: timeout")
+	}
+
+	if r.reject {
+		return encodeStatusAck(updateID, false, "unknown job"), nil
+	}
+	return encodeStatusAck(updateID, true, ""), nil
+}
+
+func TestStatusUpdateEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	status := &AnalysisStatus{Host: "exposer-1", State: messaging.RunningState, Message: "running"}
+	updateID, jobID, decoded, err := decodeStatusUpdate(encodeStatusUpdate("u1", "e1", status, time.Now()))
+	assert.NoError(err)
+	assert.Equal("u1", updateID)
+	assert.Equal("e1", jobID)
+	assert.Equal(status, decoded)
+}
+
+func TestRequestReplyStatusTransportRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	requester := &ackingRequester{failures: 2}
+	transport := NewRequestReplyStatusTransport(requester, "vice.status", time.Second, 3)
+
+	status := &AnalysisStatus{State: messaging.SucceededState}
+	assert.NoError(transport.SendStatus("e1", status))
+
+	// Retries reuse the update ID so the receiver can drop duplicates.
+	assert.Len(requester.updates, 3)
+	assert.Equal(requester.updates[0], requester.updates[2])
+	assert.Equal([]string{"vice.status", "vice.status", "vice.status"}, requester.subjects)
+}
+
+func TestRequestReplyStatusTransportFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	status := &AnalysisStatus{State: messaging.FailedState}
+
+	transport := NewRequestReplyStatusTransport(&ackingRequester{failures: 5}, "vice.status", time.Second, 2)
+	assert.Error(transport.SendStatus("e1", status))
+
+	transport = NewRequestReplyStatusTransport(&ackingRequester{reject: true}, "vice.status", time.Second, 2)
+	err := transport.SendStatus("e1", status)
+	assert.Error(err)
+	assert.Contains(err.Error(), "unknown job")
+}
+
+func TestStatusTransportConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&StatusTransportConfig{}).Validate())
+	assert.NoError((&StatusTransportConfig{Transport: "nats"}).Validate())
+	assert.Error((&StatusTransportConfig{Transport: "carrier-pigeon"}).Validate())
+
+	assert.False((&StatusTransportConfig{Transport: "http"}).RequestReply())
+	assert.True((&StatusTransportConfig{Transport: "nats"}).RequestReply())
+
+	transport := (&StatusTransportConfig{Transport: "nats"}).NewTransport(&ackingRequester{})
+	assert.Equal(DefaultStatusSubject, transport.subject)
+	assert.Equal(defaultStatusTimeout, transport.timeout)
+	assert.Equal(defaultStatusAttempts, transport.attempts)
+}
@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// subdomainPattern matches the subdomains users are allowed to request. They
+// have to be valid DNS labels, which also makes them valid label values.
+var subdomainPattern = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// generatedSubdomainPattern matches the subdomains generated by IngressName.
+// Users can't request one of those, since it could collide with the subdomain
+// of another analysis.
+var generatedSubdomainPattern = regexp.MustCompile(`^a[0-9a-f]{8}$`)
+
+// reservedSubdomains are the subdomains users can't request, since they're
+// commonly used by the services sharing the base domain with the analyses.
+var reservedSubdomains = map[string]bool{
+	"admin":     true,
+	"api":       true,
+	"auth":      true,
+	"de":        true,
+	"ftp":       true,
+	"localhost": true,
+	"login":     true,
+	"mail":      true,
+	"ns1":       true,
+	"ns2":       true,
+	"proxy":     true,
+	"smtp":      true,
+	"vice":      true,
+	"www":       true,
+}
+
+// maxSubdomainLength is the longest a DNS label can be.
+const maxSubdomainLength = 63
+
+// uniqueViolation is the Postgres error code for a unique constraint
+// violation.
+const uniqueViolation = "23505"
+
+const getVanitySubdomainSQL = `
+	SELECT subdomain
+	  FROM vice_subdomains
+	 WHERE external_id = $1
+`
+
+const getExternalIDBySubdomainSQL = `
+	SELECT external_id
+	  FROM vice_subdomains
+	 WHERE subdomain = $1
+`
+
+const setVanitySubdomainSQL = `
+	INSERT INTO vice_subdomains (external_id, subdomain)
+	VALUES ($1, $2)
+	ON CONFLICT (external_id) DO UPDATE
+	   SET subdomain = EXCLUDED.subdomain
+`
+
+const deleteVanitySubdomainSQL = `
+	DELETE FROM vice_subdomains
+	 WHERE external_id = $1
+`
+
+// validateSubdomain returns an error if the subdomain can't be requested for
+// an analysis.
+func validateSubdomain(subdomain string) error {
+	if len(subdomain) > maxSubdomainLength {
+		return fmt.Errorf("subdomain %s is longer than %d characters", subdomain, maxSubdomainLength)
+	}
+
+	if !subdomainPattern.MatchString(subdomain) {
+		return fmt.Errorf("subdomain %s must start with a lowercase letter and contain only lowercase letters, digits, and hyphens", subdomain)
+	}
+
+	if reservedSubdomains[subdomain] || generatedSubdomainPattern.MatchString(subdomain) || uuidPattern.MatchString(subdomain) {
+		return fmt.Errorf("subdomain %s is reserved", subdomain)
+	}
+
+	return nil
+}
+
+// isUniqueViolation returns true if the error came from a unique constraint
+// in the database.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == uniqueViolation
+}
+
+// vanitySubdomain returns the subdomain requested for the analysis, or an
+// empty string if one wasn't requested.
+func (i *Internal) vanitySubdomain(externalID string) (string, error) {
+	var subdomain string
+
+	err := i.db.QueryRow(getVanitySubdomainSQL, externalID).Scan(&subdomain)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "error looking up the subdomain for %s", externalID)
+	}
+
+	return subdomain, nil
+}
+
+// subdomain returns the subdomain the analysis is served from. That's the
+// subdomain requested for it if there is one, otherwise it's the generated one.
+func (i *Internal) subdomain(userID, externalID string) string {
+	vanity, err := i.vanitySubdomain(externalID)
+	if err != nil {
+		log.Error(err)
+	}
+
+	if vanity != "" {
+		return vanity
+	}
+
+	return IngressName(userID, externalID)
+}
+
+// ingressHosts returns the hosts the Ingress for the analysis answers to. The
+// generated subdomain is always included so that links handed out before a
+// subdomain was requested keep working.
+func (i *Internal) ingressHosts(userID, externalID string) []string {
+	hosts := []string{IngressName(userID, externalID)}
+
+	vanity, err := i.vanitySubdomain(externalID)
+	if err != nil {
+		log.Error(err)
+	}
+
+	if vanity != "" {
+		hosts = append(hosts, vanity)
+	}
+
+	return hosts
+}
+
+// hostFilter returns the label filter that finds the resources for the
+// analysis served from the host. Requested subdomains are looked up in the
+// database, since pods started before a subdomain was requested still have
+// the old subdomain label.
+func (i *Internal) hostFilter(host string) (map[string]string, error) {
+	var externalID string
+
+	err := i.db.QueryRow(getExternalIDBySubdomainSQL, host).Scan(&externalID)
+	if err == sql.ErrNoRows {
+		return map[string]string{"subdomain": host}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the analysis for subdomain %s", host)
+	}
+
+	return map[string]string{"external-id": externalID}, nil
+}
+
+// checkSubdomainAvailable returns an error if the subdomain can't be used for
+// the analysis, either because it isn't valid or because another analysis has
+// it.
+func (i *Internal) checkSubdomainAvailable(externalID, subdomain string) error {
+	if err := validateSubdomain(subdomain); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var owner string
+	err := i.db.QueryRow(getExternalIDBySubdomainSQL, subdomain).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrapf(err, "error looking up the analysis for subdomain %s", subdomain)
+	}
+	if err == nil && owner != externalID {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("subdomain %s is already in use", subdomain))
+	}
+
+	// Claimed hostnames are only moved between analyses by their claims.
+	if i.PersistentHostnames.enabled() {
+		claim, err := i.hostnameClaim(subdomain)
+		if err != nil {
+			return err
+		}
+		if claim != nil && claim.ExternalID != externalID {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("subdomain %s is a claimed hostname", subdomain))
+		}
+	}
+
+	return nil
+}
+
+// setSubdomain validates the subdomain and records it for the analysis. The
+// unique constraint on the subdomain settles races with other analyses that
+// request the same subdomain after the availability check.
+func (i *Internal) setSubdomain(externalID, subdomain string) error {
+	if err := i.checkSubdomainAvailable(externalID, subdomain); err != nil {
+		return err
+	}
+
+	if _, err := i.db.Exec(setVanitySubdomainSQL, externalID, subdomain); err != nil {
+		if isUniqueViolation(err) {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("subdomain %s is already in use", subdomain))
+		}
+		return errors.Wrapf(err, "error setting the subdomain for %s to %s", externalID, subdomain)
+	}
+
+	return nil
+}
+
+// releaseSubdomain frees up the subdomain requested for the analysis, if any.
+func (i *Internal) releaseSubdomain(externalID string) error {
+	if _, err := i.db.Exec(deleteVanitySubdomainSQL, externalID); err != nil {
+		return errors.Wrapf(err, "error releasing the subdomain for %s", externalID)
+	}
+	return nil
+}
+
+// applySubdomain updates the running resources for the analysis after its
+// subdomain changes. The Ingress is given a rule for the new host and the
+// subdomain label is updated on everything but the Deployment's pod template,
+// since changing that would restart the analysis.
+func (i *Internal) applySubdomain(externalID, subdomain string) error {
+	listoptions := metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID})).AsSelector().String(),
+	}
+
+	ingressclient := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace)
+	ingresslist, err := ingressclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+
+	for _, ingress := range ingresslist.Items {
+		if len(ingress.Spec.Rules) == 0 {
+			continue
+		}
+
+		userID := i.labelKeys.get(ingress.Labels, "user-id")
+		ingressName := IngressName(userID, externalID)
+		hosts := i.ingressHosts(userID, externalID)
+
+		rules := []extv1beta1.IngressRule{}
+		for _, host := range hosts {
+			rules = append(rules, extv1beta1.IngressRule{
+				Host:             host,
+				IngressRuleValue: *ingress.Spec.Rules[0].IngressRuleValue.DeepCopy(),
+			})
+		}
+		ingress.Spec.Rules = rules
+
+		if len(ingress.Spec.TLS) > 0 {
+			ingress.Spec.TLS = i.ingressTLS(ingressName, hosts)
+		}
+
+		i.labelKeys.set(ingress.Labels, "subdomain", subdomain)
+		if _, err = ingressclient.Update(&ingress); err != nil {
+			return err
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": i.labelKeys.labels(map[string]string{"subdomain": subdomain}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	deplist, err := depclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for _, dep := range deplist.Items {
+		if _, err = depclient.Patch(dep.Name, types.MergePatchType, patch); err != nil {
+			return err
+		}
+	}
+
+	podclient := i.clientset.CoreV1().Pods(i.ViceNamespace)
+	podlist, err := podclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for _, pod := range podlist.Items {
+		if _, err = podclient.Patch(pod.Name, types.MergePatchType, patch); err != nil {
+			return err
+		}
+	}
+
+	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
+	svclist, err := svcclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for _, svc := range svclist.Items {
+		if _, err = svcclient.Patch(svc.Name, types.MergePatchType, patch); err != nil {
+			return err
+		}
+	}
+
+	cmclient := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace)
+	cmlist, err := cmclient.List(listoptions)
+	if err != nil {
+		return err
+	}
+	for _, cm := range cmlist.Items {
+		if _, err = cmclient.Patch(cm.Name, types.MergePatchType, patch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SubdomainRequest is the request body for changing the subdomain of an
+// analysis.
+type SubdomainRequest struct {
+	Subdomain string `json:"subdomain"`
+}
+
+// changeSubdomain records the subdomain requested in the body of the request
+// and updates the analysis to use it.
+func (i *Internal) changeSubdomain(c echo.Context, externalID string) error {
+	request := &SubdomainRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	previous, err := i.vanitySubdomain(externalID)
+	if err != nil {
+		return err
+	}
+
+	if err = i.setSubdomain(externalID, request.Subdomain); err != nil {
+		return err
+	}
+
+	if err = i.applySubdomain(externalID, request.Subdomain); err != nil {
+		return err
+	}
+
+	if previous != request.Subdomain {
+		if previous != "" {
+			i.publishSubdomainEvent(SubdomainReleased, externalID, previous)
+		}
+		i.publishSubdomainEvent(SubdomainAllocated, externalID, request.Subdomain)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"externalID": externalID,
+		"subdomain":  request.Subdomain,
+	})
+}
+
+// SubdomainUpdateHandler changes the subdomain of an analysis owned by the
+// user in the 'user' query parameter.
+func (i *Internal) SubdomainUpdateHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	a := i.newApps()
+	owner, _, err := a.GetUserByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return analysisLookupError(err, analysisID)
+	}
+
+	if i.fixUsername(owner) != i.fixUsername(user) {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s does not own analysis %s", user, analysisID))
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	return i.changeSubdomain(c, externalID)
+}
+
+// AdminSubdomainUpdateHandler changes the subdomain of an analysis without
+// requiring user information in the request.
+func (i *Internal) AdminSubdomainUpdateHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	return i.changeSubdomain(c, externalID)
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// registerSubdomainQuery registers a lookup of the subdomain requested for an
+// analysis. An empty subdomain means none was requested.
+func registerSubdomainQuery(mock sqlmock.Sqlmock, externalID, subdomain string) {
+	query := mock.ExpectQuery("SELECT subdomain FROM vice_subdomains").WithArgs(externalID)
+	if subdomain == "" {
+		query.WillReturnError(sql.ErrNoRows)
+		return
+	}
+	query.WillReturnRows(sqlmock.NewRows([]string{"subdomain"}).AddRow(subdomain))
+}
+
+func TestValidateSubdomain(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateSubdomain("my-notebook"))
+	assert.NoError(validateSubdomain("rstudio2"))
+
+	assert.Error(validateSubdomain(""))
+	assert.Error(validateSubdomain("My-Notebook"))
+	assert.Error(validateSubdomain("2fast"))
+	assert.Error(validateSubdomain("trailing-"))
+	assert.Error(validateSubdomain("has.dots"))
+	assert.Error(validateSubdomain("a1234abcd"))
+	assert.Error(validateSubdomain("www"))
+	assert.Error(validateSubdomain("c6e1f5a2-7d3b-4e5f-9a1b-2c3d4e5f6a7b"))
+	assert.Error(validateSubdomain("a123456789012345678901234567890123456789012345678901234567890123"))
+}
+
+func TestSetSubdomainInUse(t *testing.T) {
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("my-notebook").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e2"))
+
+	assert.Error(t, internal.setSubdomain("e1", "my-notebook"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetSubdomainRace(t *testing.T) {
+	internal, mock := setupInternal(t, nil)
+
+	// Another analysis is given the subdomain between the check and the insert.
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("my-notebook").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO vice_subdomains").
+		WithArgs("e1", "my-notebook").
+		WillReturnError(&pq.Error{Code: uniqueViolation})
+
+	err := internal.setSubdomain("e1", "my-notebook")
+	assert.Equal(t, http.StatusConflict, err.(*echo.HTTPError).Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestApplySubdomain(t *testing.T) {
+	assert := assert.New(t)
+
+	labels := map[string]string{
+		"external-id": "e1",
+		"user-id":     "u1",
+		"subdomain":   IngressName("u1", "e1"),
+	}
+	ingress := &extv1beta1.Ingress{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: testConfig.ViceNamespace, Name: "e1", Labels: labels},
+		Spec: extv1beta1.IngressSpec{
+			Rules: []extv1beta1.IngressRule{{Host: IngressName("u1", "e1")}},
+			TLS:   []extv1beta1.IngressTLS{{}},
+		},
+	}
+	svc := &apiv1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: testConfig.ViceNamespace, Name: "vice-e1", Labels: labels},
+	}
+
+	internal, mock := setupInternal(t, []runtime.Object{ingress, svc})
+	registerSubdomainQuery(mock, "e1", "my-notebook")
+
+	assert.NoError(internal.applySubdomain("e1", "my-notebook"))
+
+	updated, err := internal.clientset.ExtensionsV1beta1().Ingresses(testConfig.ViceNamespace).Get("e1", meta_v1.GetOptions{})
+	assert.NoError(err)
+	assert.Len(updated.Spec.Rules, 2)
+	assert.Equal(IngressName("u1", "e1"), updated.Spec.Rules[0].Host)
+	assert.Equal("my-notebook", updated.Spec.Rules[1].Host)
+	assert.Equal([]string{IngressName("u1", "e1"), "my-notebook"}, updated.Spec.TLS[0].Hosts)
+	assert.Equal("my-notebook", updated.Labels["subdomain"])
+
+	updatedSvc, err := internal.clientset.CoreV1().Services(testConfig.ViceNamespace).Get("vice-e1", meta_v1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("my-notebook", updatedSvc.Labels["subdomain"])
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
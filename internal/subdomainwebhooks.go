@@ -0,0 +1,492 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// Subdomain webhook events.
+const (
+	SubdomainAllocated = "subdomain.allocated"
+	SubdomainReleased  = "subdomain.released"
+)
+
+// Subdomain webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Headers sent with every subdomain webhook. The signature is the hex-encoded
+// HMAC-SHA256 of the timestamp, a period, and the request body, keyed with the
+// endpoint's secret and prefixed with "sha256=". While an endpoint is being
+// moved to a new secret, a second signature keyed with the previous secret
+// follows the first, separated by a comma.
+const (
+	webhookSignatureHeader = "X-Vice-Signature"
+	webhookTimestampHeader = "X-Vice-Timestamp"
+	webhookEventHeader     = "X-Vice-Event"
+	webhookDeliveryHeader  = "X-Vice-Delivery"
+)
+
+const (
+	defaultWebhookMaxAttempts   = 8
+	defaultWebhookRetryInterval = 10 * time.Second
+	maxWebhookRetryDelay        = time.Hour
+	webhookRequestTimeout       = 10 * time.Second
+	defaultDeliveryListLimit    = 100
+)
+
+// SubdomainWebhookEndpoint is a system that's told when subdomains are
+// allocated and released. PreviousSecret is set while the endpoint is being
+// moved to a new secret.
+type SubdomainWebhookEndpoint struct {
+	Name           string `mapstructure:"name"`
+	URL            string `mapstructure:"url"`
+	Secret         string `mapstructure:"secret"`
+	PreviousSecret string `mapstructure:"previous_secret"`
+}
+
+// SubdomainWebhookConfig controls the webhooks sent when subdomains are
+// allocated and released. Failed deliveries are retried with exponential
+// backoff starting at RetryInterval until MaxAttempts have been made.
+type SubdomainWebhookConfig struct {
+	Endpoints     []SubdomainWebhookEndpoint `mapstructure:"endpoints"`
+	MaxAttempts   int                        `mapstructure:"max_attempts"`
+	RetryInterval time.Duration              `mapstructure:"retry_interval"`
+}
+
+// ValidateSubdomainWebhooks returns an error if any of the webhook endpoints
+// can't be delivered to.
+func ValidateSubdomainWebhooks(cfg *SubdomainWebhookConfig) error {
+	seen := map[string]bool{}
+
+	for _, endpoint := range cfg.Endpoints {
+		if endpoint.Name == "" {
+			return fmt.Errorf("a subdomain webhook endpoint has no name")
+		}
+		if seen[endpoint.Name] {
+			return fmt.Errorf("subdomain webhook endpoint %s is listed more than once", endpoint.Name)
+		}
+		seen[endpoint.Name] = true
+
+		if endpoint.URL == "" {
+			return fmt.Errorf("subdomain webhook endpoint %s has no url", endpoint.Name)
+		}
+		if endpoint.Secret == "" {
+			return fmt.Errorf("subdomain webhook endpoint %s has no secret", endpoint.Name)
+		}
+	}
+
+	if cfg.MaxAttempts < 0 || cfg.RetryInterval < 0 {
+		return fmt.Errorf("subdomain webhook max_attempts and retry_interval can't be negative")
+	}
+
+	return nil
+}
+
+func (s *SubdomainWebhookConfig) maxAttempts() int {
+	if s.MaxAttempts == 0 {
+		return defaultWebhookMaxAttempts
+	}
+	return s.MaxAttempts
+}
+
+func (s *SubdomainWebhookConfig) retryInterval() time.Duration {
+	if s.RetryInterval == 0 {
+		return defaultWebhookRetryInterval
+	}
+	return s.RetryInterval
+}
+
+// retryDelay returns how long to wait before the next attempt after the given
+// number of failed attempts.
+func (s *SubdomainWebhookConfig) retryDelay(attempts int) time.Duration {
+	delay := s.retryInterval()
+	for n := 1; n < attempts; n++ {
+		delay *= 2
+		if delay >= maxWebhookRetryDelay {
+			return maxWebhookRetryDelay
+		}
+	}
+	return delay
+}
+
+func (s *SubdomainWebhookConfig) endpoint(name string) (*SubdomainWebhookEndpoint, bool) {
+	for idx := range s.Endpoints {
+		if s.Endpoints[idx].Name == name {
+			return &s.Endpoints[idx], true
+		}
+	}
+	return nil, false
+}
+
+// SubdomainEvent is the body of a subdomain webhook.
+type SubdomainEvent struct {
+	Event      string    `json:"event"`
+	Subdomain  string    `json:"subdomain"`
+	Host       string    `json:"host"`
+	ExternalID string    `json:"externalID"`
+	AnalysisID string    `json:"analysisID"`
+	Username   string    `json:"username"`
+	UserID     string    `json:"userID"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+// WebhookDelivery is the delivery of a subdomain event to one endpoint.
+type WebhookDelivery struct {
+	ID            string          `json:"id" db:"id"`
+	Endpoint      string          `json:"endpoint" db:"endpoint"`
+	Event         string          `json:"event" db:"event"`
+	Subdomain     string          `json:"subdomain" db:"subdomain"`
+	ExternalID    string          `json:"externalID" db:"external_id"`
+	Payload       json.RawMessage `json:"payload" db:"payload"`
+	Status        string          `json:"status" db:"status"`
+	Attempts      int             `json:"attempts" db:"attempts"`
+	LastError     *string         `json:"lastError,omitempty" db:"last_error"`
+	NextAttemptAt *time.Time      `json:"nextAttemptAt,omitempty" db:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"createdAt" db:"created_at"`
+	DeliveredAt   *time.Time      `json:"deliveredAt,omitempty" db:"delivered_at"`
+}
+
+const insertWebhookDeliverySQL = `
+	INSERT INTO vice_subdomain_webhook_deliveries
+		(endpoint, event, subdomain, external_id, payload, status, attempts, next_attempt_at, created_at)
+	VALUES ($1, $2, $3, $4, $5, 'pending', 0, now(), now())
+`
+
+const webhookDeliveryColumns = `
+	SELECT id, endpoint, event, subdomain, external_id, payload, status,
+	       attempts, last_error, next_attempt_at, created_at, delivered_at
+	  FROM vice_subdomain_webhook_deliveries
+`
+
+const dueWebhookDeliveriesSQL = webhookDeliveryColumns + `
+	 WHERE status = 'pending'
+	   AND next_attempt_at <= now()
+	 ORDER BY created_at
+`
+
+const listWebhookDeliveriesSQL = webhookDeliveryColumns + `
+	 WHERE ($1 = '' OR status = $1)
+	   AND ($2 = '' OR subdomain = $2)
+	 ORDER BY created_at DESC
+	 LIMIT $3
+`
+
+// claimWebhookDeliverySQL pushes the next attempt out so that other replicas
+// don't send the same delivery while this one is sending it.
+const claimWebhookDeliverySQL = `
+	UPDATE vice_subdomain_webhook_deliveries
+	   SET next_attempt_at = now() + $2 * interval '1 second'
+	 WHERE id = $1
+	   AND status = 'pending'
+	   AND next_attempt_at <= now()
+`
+
+const webhookDeliveredSQL = `
+	UPDATE vice_subdomain_webhook_deliveries
+	   SET status = 'delivered',
+	       attempts = attempts + 1,
+	       last_error = NULL,
+	       next_attempt_at = NULL,
+	       delivered_at = now()
+	 WHERE id = $1
+`
+
+const webhookAttemptFailedSQL = `
+	UPDATE vice_subdomain_webhook_deliveries
+	   SET status = $2,
+	       attempts = attempts + 1,
+	       last_error = $3,
+	       next_attempt_at = $4
+	 WHERE id = $1
+`
+
+const retryWebhookDeliverySQL = `
+	UPDATE vice_subdomain_webhook_deliveries
+	   SET status = 'pending',
+	       attempts = 0,
+	       next_attempt_at = now()
+	 WHERE id = $1
+	   AND status = 'failed'
+`
+
+// signWebhook returns the signature of the body sent at the timestamp.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts the signed body to the endpoint.
+func sendWebhook(client *http.Client, endpoint *SubdomainWebhookEndpoint, delivery *WebhookDelivery, now time.Time) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, delivery.ID)
+	signature := signWebhook(endpoint.Secret, timestamp, delivery.Payload)
+	if endpoint.PreviousSecret != "" {
+		signature = signature + "," + signWebhook(endpoint.PreviousSecret, timestamp, delivery.Payload)
+	}
+	req.Header.Set(webhookSignatureHeader, signature)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s returned %s", endpoint.URL, resp.Status)
+	}
+
+	return nil
+}
+
+// subdomainEvent returns the event for the subdomain of the analysis. The
+// owner is looked up in the database; failures are logged and leave the owner
+// fields empty, since the event is still worth sending.
+func (i *Internal) subdomainEvent(event, externalID, subdomain string) *SubdomainEvent {
+	e := &SubdomainEvent{
+		Event:      event,
+		Subdomain:  subdomain,
+		Host:       subdomain,
+		ExternalID: externalID,
+		OccurredAt: time.Now(),
+	}
+
+	if host, err := i.ingressTLSHost(subdomain); err == nil {
+		e.Host = host
+	}
+
+	a := i.newApps()
+
+	analysisID, err := a.GetAnalysisIDByExternalID(context.Background(), externalID)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "error looking up the analysis ID for %s", externalID))
+		return e
+	}
+	e.AnalysisID = analysisID
+
+	if e.Username, e.UserID, err = a.GetUserByAnalysisID(context.Background(), analysisID); err != nil {
+		log.Error(errors.Wrapf(err, "error looking up the owner of analysis %s", analysisID))
+	}
+
+	return e
+}
+
+// publishSubdomainEvent queues a delivery of the event to every configured
+// endpoint. Failures are logged rather than returned, since they shouldn't
+// stop the launch or teardown that caused the event.
+func (i *Internal) publishSubdomainEvent(event, externalID, subdomain string) {
+	if len(i.SubdomainWebhooks.Endpoints) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(i.subdomainEvent(event, externalID, subdomain))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, endpoint := range i.SubdomainWebhooks.Endpoints {
+		if _, err = i.db.Exec(insertWebhookDeliverySQL, endpoint.Name, event, subdomain, externalID, payload); err != nil {
+			log.Error(errors.Wrapf(err, "error queueing the %s webhook for %s to %s", event, subdomain, endpoint.Name))
+		}
+	}
+
+	i.wakeWebhookDeliveries()
+}
+
+// publishSubdomainEvents publishes the event for each of the subdomains the
+// analysis is served from.
+func (i *Internal) publishSubdomainEvents(event, userID, externalID string) {
+	if len(i.SubdomainWebhooks.Endpoints) == 0 {
+		return
+	}
+
+	for _, subdomain := range i.ingressHosts(userID, externalID) {
+		i.publishSubdomainEvent(event, externalID, subdomain)
+	}
+}
+
+// analysisSubdomains returns the subdomains the running analysis is served
+// from, or nothing if no webhooks are configured.
+func (i *Internal) analysisSubdomains(externalID string) []string {
+	if len(i.SubdomainWebhooks.Endpoints) == 0 {
+		return nil
+	}
+
+	deployments, err := i.deploymentList(i.ViceNamespace, map[string]string{"external-id": externalID}, []string{})
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	if len(deployments.Items) == 0 {
+		return nil
+	}
+
+	return i.ingressHosts(i.labelKeys.get(deployments.Items[0].Labels, "user-id"), externalID)
+}
+
+func (i *Internal) wakeWebhookDeliveries() {
+	select {
+	case i.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// attemptWebhookDelivery sends the delivery if this replica can claim it and
+// records the outcome.
+func (i *Internal) attemptWebhookDelivery(client *http.Client, delivery *WebhookDelivery, now time.Time) error {
+	cfg := &i.SubdomainWebhooks
+
+	result, err := i.db.Exec(claimWebhookDeliverySQL, delivery.ID, int(webhookRequestTimeout.Seconds())*2)
+	if err != nil {
+		return errors.Wrapf(err, "error claiming webhook delivery %s", delivery.ID)
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+		return err
+	}
+
+	endpoint, ok := cfg.endpoint(delivery.Endpoint)
+	if !ok {
+		_, err = i.db.Exec(webhookAttemptFailedSQL, delivery.ID, DeliveryFailed, "the endpoint is no longer configured", nil)
+		return err
+	}
+
+	sendErr := sendWebhook(client, endpoint, delivery, now)
+	if sendErr == nil {
+		_, err = i.db.Exec(webhookDeliveredSQL, delivery.ID)
+		return err
+	}
+
+	attempts := delivery.Attempts + 1
+	status := DeliveryPending
+	var next *time.Time
+	if attempts >= cfg.maxAttempts() {
+		status = DeliveryFailed
+	} else {
+		t := now.Add(cfg.retryDelay(attempts))
+		next = &t
+	}
+
+	log.Errorf("attempt %d of the %s webhook for %s to %s failed: %s", attempts, delivery.Event, delivery.Subdomain, endpoint.Name, sendErr)
+
+	_, err = i.db.Exec(webhookAttemptFailedSQL, delivery.ID, status, sendErr.Error(), next)
+	return err
+}
+
+// sendDueWebhookDeliveries attempts every pending delivery whose next attempt
+// is due.
+func (i *Internal) sendDueWebhookDeliveries(client *http.Client) {
+	deliveries := []WebhookDelivery{}
+	if err := i.db.Select(&deliveries, dueWebhookDeliveriesSQL); err != nil {
+		log.Error(errors.Wrap(err, "error listing the due webhook deliveries"))
+		return
+	}
+
+	for idx := range deliveries {
+		if err := i.attemptWebhookDelivery(client, &deliveries[idx], time.Now()); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// StartSubdomainWebhooks starts sending subdomain webhooks in the background.
+// Deliveries are sent as soon as they're queued and retried every retry
+// interval.
+func (i *Internal) StartSubdomainWebhooks() {
+	if len(i.SubdomainWebhooks.Endpoints) == 0 {
+		return
+	}
+
+	client := &http.Client{Timeout: webhookRequestTimeout}
+
+	go func() {
+		ticker := time.NewTicker(i.SubdomainWebhooks.retryInterval())
+		defer ticker.Stop()
+
+		for {
+			i.sendDueWebhookDeliveries(client)
+			select {
+			case <-ticker.C:
+			case <-i.webhookWake:
+			}
+		}
+	}()
+}
+
+// AdminListWebhookDeliveriesHandler lists the most recent subdomain webhook
+// deliveries. They can be filtered with the status and subdomain query
+// parameters, and the number returned is set with limit.
+func (i *Internal) AdminListWebhookDeliveriesHandler(c echo.Context) error {
+	status := c.QueryParam("status")
+	switch status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported status %q", status))
+	}
+
+	limit := defaultDeliveryListLimit
+	if l := c.QueryParam("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be a positive integer, not %q", l))
+		}
+	}
+
+	deliveries := []WebhookDelivery{}
+	if err := i.db.Select(&deliveries, listWebhookDeliveriesSQL, status, c.QueryParam("subdomain"), limit); err != nil {
+		return errors.Wrap(err, "error listing the webhook deliveries")
+	}
+
+	return c.JSON(http.StatusOK, map[string][]WebhookDelivery{
+		"deliveries": deliveries,
+	})
+}
+
+// AdminRetryWebhookDeliveryHandler sends a failed delivery again, starting
+// over with its attempts.
+func (i *Internal) AdminRetryWebhookDeliveryHandler(c echo.Context) error {
+	id := c.Param("delivery-id")
+
+	result, err := i.db.Exec(retryWebhookDeliverySQL, id)
+	if err != nil {
+		return errors.Wrapf(err, "error retrying webhook delivery %s", id)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no failed webhook delivery %s", id))
+	}
+
+	i.wakeWebhookDeliveries()
+
+	return c.NoContent(http.StatusAccepted)
+}
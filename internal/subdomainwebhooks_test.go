@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSubdomainWebhooks(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateSubdomainWebhooks(&SubdomainWebhookConfig{}))
+	assert.NoError(ValidateSubdomainWebhooks(&SubdomainWebhookConfig{
+		Endpoints: []SubdomainWebhookEndpoint{{Name: "waf", URL: "https://waf.example.org", Secret: "s"}},
+	}))
+
+	assert.Error(ValidateSubdomainWebhooks(&SubdomainWebhookConfig{
+		Endpoints: []SubdomainWebhookEndpoint{{Name: "waf", URL: "https://waf.example.org"}},
+	}))
+	assert.Error(ValidateSubdomainWebhooks(&SubdomainWebhookConfig{
+		Endpoints: []SubdomainWebhookEndpoint{
+			{Name: "waf", URL: "https://waf.example.org", Secret: "s"},
+			{Name: "waf", URL: "https://dns.example.org", Secret: "s"},
+		},
+	}))
+	assert.Error(ValidateSubdomainWebhooks(&SubdomainWebhookConfig{MaxAttempts: -1}))
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &SubdomainWebhookConfig{RetryInterval: time.Minute}
+	assert.Equal(time.Minute, cfg.retryDelay(1))
+	assert.Equal(2*time.Minute, cfg.retryDelay(2))
+	assert.Equal(8*time.Minute, cfg.retryDelay(4))
+	assert.Equal(time.Hour, cfg.retryDelay(10))
+}
+
+func TestPublishSubdomainEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	i.SubdomainWebhooks.Endpoints = []SubdomainWebhookEndpoint{
+		{Name: "waf", URL: "https://waf.example.org", Secret: "s"},
+		{Name: "dns", URL: "https://dns.example.org", Secret: "s"},
+	}
+
+	mock.ExpectQuery("SELECT j.id").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+	mock.ExpectQuery("SELECT u.username").
+		WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("ipctest@iplantcollaborative.org", "u1"))
+	for _, name := range []string{"waf", "dns"} {
+		mock.ExpectExec("INSERT INTO vice_subdomain_webhook_deliveries").
+			WithArgs(name, SubdomainAllocated, "notebook", "e1", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	i.publishSubdomainEvent(SubdomainAllocated, "e1", "notebook")
+	assert.NoError(mock.ExpectationsWereMet())
+
+	event := i.subdomainEvent(SubdomainAllocated, "e1", "notebook")
+	assert.Equal("notebook.example.run", event.Host)
+}
+
+func TestPublishSubdomainEventNoEndpoints(t *testing.T) {
+	i, mock := setupInternal(t, nil)
+
+	i.publishSubdomainEvent(SubdomainReleased, "e1", "notebook")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func testDelivery() *WebhookDelivery {
+	return &WebhookDelivery{
+		ID:        "d1",
+		Endpoint:  "waf",
+		Event:     SubdomainAllocated,
+		Subdomain: "notebook",
+		Payload:   json.RawMessage(`{"event":"subdomain.allocated"}`),
+		Status:    DeliveryPending,
+		Attempts:  2,
+	}
+}
+
+func TestAttemptWebhookDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, nil)
+	i.SubdomainWebhooks.Endpoints = []SubdomainWebhookEndpoint{{Name: "waf", URL: server.URL, Secret: "s3cret"}}
+
+	mock.ExpectExec("UPDATE vice_subdomain_webhook_deliveries").
+		WithArgs("d1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SET status = 'delivered'").
+		WithArgs("d1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	now := time.Unix(1600000000, 0)
+	assert.NoError(i.attemptWebhookDelivery(server.Client(), testDelivery(), now))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	assert.Equal("1600000000", received.Header.Get(webhookTimestampHeader))
+	assert.Equal(SubdomainAllocated, received.Header.Get(webhookEventHeader))
+	assert.Equal("d1", received.Header.Get(webhookDeliveryHeader))
+	assert.Equal(signWebhook("s3cret", "1600000000", body), received.Header.Get(webhookSignatureHeader))
+}
+
+func TestAttemptWebhookDeliveryFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, nil)
+	i.SubdomainWebhooks.Endpoints = []SubdomainWebhookEndpoint{{Name: "waf", URL: server.URL, Secret: "s"}}
+	i.SubdomainWebhooks.MaxAttempts = 4
+
+	now := time.Now()
+
+	// The third attempt is retried later.
+	mock.ExpectExec("UPDATE vice_subdomain_webhook_deliveries").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SET status = \\$2").
+		WithArgs("d1", DeliveryPending, sqlmock.AnyArg(), now.Add(40*time.Second)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(i.attemptWebhookDelivery(server.Client(), testDelivery(), now))
+
+	// The fourth is the last.
+	delivery := testDelivery()
+	delivery.Attempts = 3
+	mock.ExpectExec("UPDATE vice_subdomain_webhook_deliveries").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SET status = \\$2").
+		WithArgs("d1", DeliveryFailed, sqlmock.AnyArg(), nilTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(i.attemptWebhookDelivery(server.Client(), delivery, now))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAttemptWebhookDeliveryClaimedElsewhere(t *testing.T) {
+	i, mock := setupInternal(t, nil)
+	i.SubdomainWebhooks.Endpoints = []SubdomainWebhookEndpoint{{Name: "waf", URL: "http://127.0.0.1:1", Secret: "s"}}
+
+	mock.ExpectExec("UPDATE vice_subdomain_webhook_deliveries").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, i.attemptWebhookDelivery(http.DefaultClient, testDelivery(), time.Now()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// nilTime matches a nil *time.Time argument.
+type nilTime struct{}
+
+func (nilTime) Match(v driver.Value) bool {
+	return v == nil
+}
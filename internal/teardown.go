@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// Teardown stages, in the order they run.
+const (
+	// TeardownSavingOutputs makes sure the output files are in the data store.
+	TeardownSavingOutputs = "saving-outputs"
+
+	// TeardownRemovingRouting removes the Ingress, Service, network policy,
+	// subdomain, and tunnel, so the analysis can't be reached any more.
+	TeardownRemovingRouting = "removing-routing"
+
+	// TeardownStoppingApp deletes the Deployment, which stops the app.
+	TeardownStoppingApp = "stopping-app"
+
+	// TeardownReleasingStorage deletes the persistent volume claims and
+	// ConfigMaps.
+	TeardownReleasingStorage = "releasing-storage"
+)
+
+var teardownStages = []string{
+	TeardownSavingOutputs,
+	TeardownRemovingRouting,
+	TeardownStoppingApp,
+	TeardownReleasingStorage,
+}
+
+// Teardown stage statuses.
+const (
+	StagePending = "pending"
+	StageRunning = "running"
+	StageDone    = "done"
+	StageSkipped = "skipped"
+	StageFailed  = "failed"
+)
+
+// TeardownStage is the progress of one stage of a teardown.
+type TeardownStage struct {
+	Name       string     `json:"name"`
+	Status     string     `json:"status"`
+	Message    string     `json:"message,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// TeardownProgress is the progress of the teardown of an analysis.
+// OutputsSaved tells users whether their output files made it into the data
+// store before the analysis went away.
+type TeardownProgress struct {
+	ExternalID   string          `json:"externalID"`
+	Stages       []TeardownStage `json:"stages"`
+	OutputsSaved bool            `json:"outputsSaved"`
+	StartedAt    time.Time       `json:"startedAt"`
+	FinishedAt   *time.Time      `json:"finishedAt,omitempty"`
+}
+
+const upsertTeardownSQL = `
+	INSERT INTO vice_analysis_teardowns (external_id, progress, updated_at)
+	VALUES ($1, $2, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET progress = EXCLUDED.progress,
+	       updated_at = EXCLUDED.updated_at
+`
+
+const getTeardownSQL = `
+	SELECT progress
+	  FROM vice_analysis_teardowns
+	 WHERE external_id = $1
+`
+
+// teardownTracker records and publishes the progress of a teardown. Failures
+// to record or publish are logged, since they shouldn't stop the teardown.
+type teardownTracker struct {
+	i        *Internal
+	progress *TeardownProgress
+}
+
+func (i *Internal) startTeardown(externalID string) *teardownTracker {
+	progress := &TeardownProgress{
+		ExternalID: externalID,
+		Stages:     []TeardownStage{},
+		StartedAt:  time.Now(),
+	}
+	for _, name := range teardownStages {
+		progress.Stages = append(progress.Stages, TeardownStage{Name: name, Status: StagePending})
+	}
+
+	t := &teardownTracker{i: i, progress: progress}
+	t.record()
+	return t
+}
+
+func (t *teardownTracker) record() {
+	data, err := json.Marshal(t.progress)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if _, err = t.i.db.Exec(upsertTeardownSQL, t.progress.ExternalID, data); err != nil {
+		log.Error(errors.Wrapf(err, "error recording the teardown progress of analysis %s", t.progress.ExternalID))
+	}
+}
+
+func (t *teardownTracker) stage(name string) (int, *TeardownStage) {
+	for idx := range t.progress.Stages {
+		if t.progress.Stages[idx].Name == name {
+			return idx, &t.progress.Stages[idx]
+		}
+	}
+	panic(fmt.Sprintf("unknown teardown stage %s", name))
+}
+
+// update sets the status of the stage, then records and publishes it.
+func (t *teardownTracker) update(name, status, message string) {
+	idx, stage := t.stage(name)
+	now := time.Now()
+
+	stage.Status = status
+	stage.Message = message
+	if status == StageRunning {
+		stage.StartedAt = &now
+	} else {
+		stage.FinishedAt = &now
+	}
+
+	if name == TeardownSavingOutputs {
+		t.progress.OutputsSaved = status == StageDone
+	}
+
+	t.record()
+
+	msg := fmt.Sprintf("teardown of analysis %s: %s is %s (step %d of %d)", t.progress.ExternalID, name, status, idx+1, len(teardownStages))
+	if message != "" {
+		msg = fmt.Sprintf("%s: %s", msg, message)
+	}
+	if err := t.i.statusPublisher.ImpendingCancellation(t.progress.ExternalID, msg); err != nil {
+		log.Error(err)
+	}
+}
+
+func (t *teardownTracker) skip(name, reason string) {
+	t.update(name, StageSkipped, reason)
+}
+
+// run runs the stage and records whether it worked.
+func (t *teardownTracker) run(name string, fn func() error) error {
+	t.update(name, StageRunning, "")
+
+	if err := fn(); err != nil {
+		t.update(name, StageFailed, err.Error())
+		return err
+	}
+
+	t.update(name, StageDone, "")
+	return nil
+}
+
+func (t *teardownTracker) finish() {
+	now := time.Now()
+	t.progress.FinishedAt = &now
+	t.record()
+}
+
+// getTeardown returns the teardown progress of the analysis, or nil if it
+// hasn't been torn down.
+func (i *Internal) getTeardown(externalID string) (*TeardownProgress, error) {
+	var data []byte
+	err := i.db.QueryRow(getTeardownSQL, externalID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the teardown progress of analysis %s", externalID)
+	}
+
+	progress := &TeardownProgress{}
+	if err = json.Unmarshal(data, progress); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the teardown progress of analysis %s", externalID)
+	}
+
+	return progress, nil
+}
+
+func (i *Internal) teardownResponse(c echo.Context, analysisID, externalID string) error {
+	progress, err := i.getTeardown(externalID)
+	if err != nil {
+		return err
+	}
+
+	if progress == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s has not been torn down", analysisID))
+	}
+
+	return c.JSON(http.StatusOK, progress)
+}
+
+// GetTeardownHandler returns the progress of the teardown of the analysis.
+func (i *Internal) GetTeardownHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if len(externalIDs) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
+	}
+
+	return i.teardownResponse(c, analysisID, externalIDs[0])
+}
+
+// AdminGetTeardownHandler returns the progress of the teardown of the
+// analysis without requiring user information.
+func (i *Internal) AdminGetTeardownHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	return i.teardownResponse(c, analysisID, externalID)
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTeardownTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	// The initial record, then one for every status change, then the finish.
+	for n := 0; n < 1+5+1; n++ {
+		mock.ExpectExec("INSERT INTO vice_analysis_teardowns").
+			WithArgs("e1", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+
+	tracker := internal.startTeardown("e1")
+	for _, stage := range tracker.progress.Stages {
+		assert.Equal(StagePending, stage.Status)
+	}
+
+	assert.NoError(tracker.run(TeardownSavingOutputs, func() error { return nil }))
+	assert.Error(tracker.run(TeardownRemovingRouting, func() error { return errors.New("forbidden") }))
+	tracker.skip(TeardownStoppingApp, "nothing to stop")
+	tracker.finish()
+
+	progress := tracker.progress
+	assert.True(progress.OutputsSaved)
+	assert.Equal(StageDone, progress.Stages[0].Status)
+	assert.NotNil(progress.Stages[0].StartedAt)
+	assert.NotNil(progress.Stages[0].FinishedAt)
+	assert.Equal(StageFailed, progress.Stages[1].Status)
+	assert.Equal("forbidden", progress.Stages[1].Message)
+	assert.Equal(StageSkipped, progress.Stages[2].Status)
+	assert.Equal(StagePending, progress.Stages[3].Status)
+	assert.NotNil(progress.FinishedAt)
+
+	// Every status change is published without moving the analysis back to
+	// Running.
+	assert.Len(publisher.published, 5)
+	for _, published := range publisher.published {
+		assert.Equal("ImpendingCancellation", published)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestTeardownTrackerFailedSave(t *testing.T) {
+	internal, _ := setupInternal(t, nil)
+	internal.statusPublisher = &recordingPublisher{}
+
+	tracker := internal.startTeardown("e1")
+	tracker.run(TeardownSavingOutputs, func() error { return errors.New("upload failed") })
+
+	assert.False(t, tracker.progress.OutputsSaved)
+}
+
+func TestGetTeardown(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+
+	data, _ := json.Marshal(&TeardownProgress{
+		ExternalID:   "e1",
+		Stages:       []TeardownStage{{Name: TeardownSavingOutputs, Status: StageDone}},
+		OutputsSaved: true,
+	})
+	mock.ExpectQuery("SELECT progress FROM vice_analysis_teardowns").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"progress"}).AddRow(data))
+	mock.ExpectQuery("SELECT progress FROM vice_analysis_teardowns").
+		WithArgs("e2").
+		WillReturnRows(sqlmock.NewRows([]string{"progress"}))
+
+	progress, err := internal.getTeardown("e1")
+	assert.NoError(err)
+	assert.True(progress.OutputsSaved)
+	assert.Equal(StageDone, progress.Stages[0].Status)
+
+	progress, err = internal.getTeardown("e2")
+	assert.NoError(err)
+	assert.Nil(progress)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
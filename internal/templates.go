@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// LaunchTemplate is a launch configuration a user saved so that they can
+// launch it again without re-entering it. Request is the analysis submission
+// the apps service accepts: the app, its parameters and inputs, the resources
+// requested and where the outputs go. The users it's shared with can list and
+// launch it, but only the owner can change it.
+type LaunchTemplate struct {
+	ID          string         `json:"id" db:"id"`
+	Name        string         `json:"name" db:"name"`
+	Description string         `json:"description" db:"description"`
+	Owner       string         `json:"owner" db:"owner"`
+	Request     types.JSONText `json:"request" db:"request"`
+	SharedWith  pq.StringArray `json:"sharedWith" db:"shared_with"`
+	CreatedAt   time.Time      `json:"createdAt" db:"created_at"`
+	UpdatedAt   time.Time      `json:"updatedAt" db:"updated_at"`
+}
+
+// LaunchTemplateRequest is the request body for saving a launch template.
+type LaunchTemplateRequest struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Request     types.JSONText `json:"request"`
+}
+
+// LaunchTemplateShares is the request body for setting who a launch template
+// is shared with.
+type LaunchTemplateShares struct {
+	Users []string `json:"users"`
+}
+
+// templateLaunchTimeFormat is the format of the time added to the names of
+// the analyses launched from templates.
+const templateLaunchTimeFormat = "2006-01-02-15-04-05"
+
+// analysisSubmissionTimeout is how long the apps service has to accept an
+// analysis launched from a template.
+const analysisSubmissionTimeout = 30 * time.Second
+
+// submittedAnalysis is the part of the apps service's response to an analysis
+// submission that's used.
+type submittedAnalysis struct {
+	ID string `json:"id"`
+}
+
+const launchTemplateColumns = `
+	SELECT id, name, description, owner, request, shared_with, created_at, updated_at
+	  FROM vice_launch_templates
+`
+
+const getLaunchTemplateSQL = launchTemplateColumns + `
+	 WHERE id = $1
+`
+
+const listLaunchTemplatesSQL = launchTemplateColumns + `
+	 WHERE owner = $1
+	    OR $1 = ANY(shared_with)
+	 ORDER BY name
+`
+
+const insertLaunchTemplateSQL = `
+	INSERT INTO vice_launch_templates (name, description, owner, request, shared_with, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, '{}', now(), now())
+	RETURNING id, name, description, owner, request, shared_with, created_at, updated_at
+`
+
+const updateLaunchTemplateSQL = `
+	UPDATE vice_launch_templates
+	   SET name = $2,
+	       description = $3,
+	       request = $4,
+	       updated_at = now()
+	 WHERE id = $1
+	RETURNING id, name, description, owner, request, shared_with, created_at, updated_at
+`
+
+const shareLaunchTemplateSQL = `
+	UPDATE vice_launch_templates
+	   SET shared_with = $2,
+	       updated_at = now()
+	 WHERE id = $1
+	RETURNING id, name, description, owner, request, shared_with, created_at, updated_at
+`
+
+const deleteLaunchTemplateSQL = `
+	DELETE FROM vice_launch_templates
+	 WHERE id = $1
+`
+
+// canUse returns true if the user owns the template or it's shared with them.
+func (t *LaunchTemplate) canUse(username string) bool {
+	if t.Owner == username {
+		return true
+	}
+	for _, u := range t.SharedWith {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// submission decodes the saved analysis submission.
+func (t *LaunchTemplate) submission() (map[string]interface{}, error) {
+	submission := map[string]interface{}{}
+	if err := json.Unmarshal(t.Request, &submission); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the analysis submission saved in template %s", t.ID)
+	}
+	return submission, nil
+}
+
+// validate returns an error if the template request is missing its name or
+// doesn't contain an analysis submission for an app.
+func (r *LaunchTemplateRequest) validate() error {
+	if r.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+
+	submission := map[string]interface{}{}
+	if len(r.Request) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "request is required")
+	}
+	if err := json.Unmarshal(r.Request, &submission); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("request is not a valid analysis submission: %s", err))
+	}
+	if appID, _ := submission["app_id"].(string); appID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "the analysis submission has no app_id")
+	}
+
+	return nil
+}
+
+// queryLaunchTemplate returns the template found by the query, or nil if
+// there isn't one.
+func (i *Internal) queryLaunchTemplate(query string, args ...interface{}) (*LaunchTemplate, error) {
+	template := &LaunchTemplate{}
+	err := i.db.QueryRowx(query, args...).StructScan(template)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// launchTemplate returns the template if the user can use it. Templates the
+// user can't see are reported as missing, the same as ones that don't exist.
+// If owner is true, the user has to own the template.
+func (i *Internal) launchTemplate(id, username string, owner bool) (*LaunchTemplate, error) {
+	template, err := i.queryLaunchTemplate(getLaunchTemplateSQL, id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up launch template %s", id)
+	}
+
+	if template == nil || !template.canUse(username) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("launch template %s not found", id))
+	}
+	if owner && template.Owner != username {
+		return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("only %s can change launch template %s", template.Owner, id))
+	}
+
+	return template, nil
+}
+
+// templateSubmission returns the analysis submission for launching the
+// template as the user at now. Each launch gets a name of its own, and the
+// apps service creates an output folder named after it, so launches don't
+// write over each other's outputs. When the template is shared with the user,
+// the outputs go to the user's default output folder instead of the owner's.
+func templateSubmission(template *LaunchTemplate, username string, now time.Time) (map[string]interface{}, error) {
+	submission, err := template.submission()
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := submission["name"].(string)
+	if name == "" {
+		name = template.Name
+	}
+	submission["name"] = fmt.Sprintf("%s-%s", name, now.UTC().Format(templateLaunchTimeFormat))
+	submission["create_output_subdir"] = true
+
+	if username != template.Owner {
+		delete(submission, "output_dir")
+	}
+
+	return submission, nil
+}
+
+// submitAnalysis submits the analysis to the apps service as the user, which
+// records it and launches it. The ID of the new analysis is returned. Requests
+// the apps service rejects are reported with the status it returned.
+func (i *Internal) submitAnalysis(username string, submission map[string]interface{}) (string, error) {
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return "", err
+	}
+
+	submitURL, err := url.Parse(i.AppsServiceBaseURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing url %s", i.AppsServiceBaseURL)
+	}
+	submitURL.Path = path.Join(submitURL.Path, "/analyses")
+	q := submitURL.Query()
+	q.Set("user", strings.TrimSuffix(username, i.UserSuffix))
+	submitURL.RawQuery = q.Encode()
+
+	client := &http.Client{Timeout: analysisSubmissionTimeout}
+	resp, err := client.Post(submitURL.String(), echo.MIMEApplicationJSON, bytes.NewReader(body))
+	if err != nil {
+		return "", errors.Wrapf(err, "error from POST %s", submitURL.String())
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading response body from %s", submitURL.String())
+	}
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return "", echo.NewHTTPError(resp.StatusCode, fmt.Sprintf("the analysis was rejected: %s", strings.TrimSpace(string(respBody))))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("the apps service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	parsed := &submittedAnalysis{}
+	if err = json.Unmarshal(respBody, parsed); err != nil {
+		return "", errors.Wrapf(err, "error unmarshalling JSON from %s", submitURL.String())
+	}
+	if parsed.ID == "" {
+		return "", errors.New("the apps service didn't return an analysis ID")
+	}
+
+	return parsed.ID, nil
+}
+
+// ListLaunchTemplatesHandler lists the launch templates owned by or shared
+// with the user in the 'user' query parameter.
+func (i *Internal) ListLaunchTemplatesHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	templates := []LaunchTemplate{}
+	if err := i.db.Select(&templates, listLaunchTemplatesSQL, i.fixUsername(user)); err != nil {
+		return errors.Wrapf(err, "error listing the launch templates for %s", user)
+	}
+
+	return c.JSON(http.StatusOK, map[string][]LaunchTemplate{
+		"templates": templates,
+	})
+}
+
+// GetLaunchTemplateHandler returns a launch template the user in the 'user'
+// query parameter can use.
+func (i *Internal) GetLaunchTemplateHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	template, err := i.launchTemplate(c.Param("template-id"), i.fixUsername(user), false)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, template)
+}
+
+// AddLaunchTemplateHandler saves the launch configuration in the body as a
+// template owned by the user in the 'user' query parameter.
+func (i *Internal) AddLaunchTemplateHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	request := &LaunchTemplateRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := request.validate(); err != nil {
+		return err
+	}
+
+	template, err := i.queryLaunchTemplate(insertLaunchTemplateSQL, request.Name, request.Description, i.fixUsername(user), request.Request)
+	if err != nil {
+		return errors.Wrapf(err, "error saving launch template %s for %s", request.Name, user)
+	}
+
+	return c.JSON(http.StatusOK, template)
+}
+
+// UpdateLaunchTemplateHandler replaces the name, description and launch
+// configuration of a template owned by the user in the 'user' query
+// parameter.
+func (i *Internal) UpdateLaunchTemplateHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	request := &LaunchTemplateRequest{}
+	if err := c.Bind(request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := request.validate(); err != nil {
+		return err
+	}
+
+	id := c.Param("template-id")
+	if _, err := i.launchTemplate(id, i.fixUsername(user), true); err != nil {
+		return err
+	}
+
+	template, err := i.queryLaunchTemplate(updateLaunchTemplateSQL, id, request.Name, request.Description, request.Request)
+	if err != nil {
+		return errors.Wrapf(err, "error updating launch template %s", id)
+	}
+
+	return c.JSON(http.StatusOK, template)
+}
+
+// ShareLaunchTemplateHandler sets the users a template owned by the user in
+// the 'user' query parameter is shared with. The list in the body replaces
+// the current one, so an empty list stops sharing the template.
+func (i *Internal) ShareLaunchTemplateHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	shares := &LaunchTemplateShares{}
+	if err := c.Bind(shares); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	id := c.Param("template-id")
+	if _, err := i.launchTemplate(id, i.fixUsername(user), true); err != nil {
+		return err
+	}
+
+	users := []string{}
+	seen := map[string]bool{}
+	for _, u := range shares.Users {
+		u = i.fixUsername(u)
+		if u != i.fixUsername(user) && !seen[u] {
+			users = append(users, u)
+			seen[u] = true
+		}
+	}
+
+	template, err := i.queryLaunchTemplate(shareLaunchTemplateSQL, id, pq.Array(users))
+	if err != nil {
+		return errors.Wrapf(err, "error sharing launch template %s", id)
+	}
+
+	return c.JSON(http.StatusOK, template)
+}
+
+// DeleteLaunchTemplateHandler deletes a template owned by the user in the
+// 'user' query parameter.
+func (i *Internal) DeleteLaunchTemplateHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	id := c.Param("template-id")
+	if _, err := i.launchTemplate(id, i.fixUsername(user), true); err != nil {
+		return err
+	}
+
+	if _, err := i.db.Exec(deleteLaunchTemplateSQL, id); err != nil {
+		return errors.Wrapf(err, "error deleting launch template %s", id)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// LaunchTemplateHandler launches a template as the user in the 'user' query
+// parameter, who has to own it or have had it shared with them. The analysis
+// is submitted through the apps service, so it's recorded like any other, and
+// the response has its ID.
+func (i *Internal) LaunchTemplateHandler(c echo.Context) error {
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+	username := i.fixUsername(user)
+
+	template, err := i.launchTemplate(c.Param("template-id"), username, false)
+	if err != nil {
+		return err
+	}
+
+	submission, err := templateSubmission(template, username, time.Now())
+	if err != nil {
+		return err
+	}
+
+	analysisID, err := i.submitAnalysis(username, submission)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("launched template %s as analysis %s for %s", template.ID, analysisID, username)
+
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"analysisID": analysisID,
+	})
+}
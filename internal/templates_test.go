@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var launchTemplateRows = []string{"id", "name", "description", "owner", "request", "shared_with", "created_at", "updated_at"}
+
+const templateRequest = `{
+	"app_id": "a1",
+	"system_id": "de",
+	"name": "rstudio",
+	"output_dir": "/iplant/home/alice/analyses",
+	"config": {"s1_p1": "classroom"},
+	"notify": true
+}`
+
+func TestLaunchTemplateRequestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&LaunchTemplateRequest{Name: "rstudio", Request: types.JSONText(templateRequest)}).validate())
+	assert.Error((&LaunchTemplateRequest{Request: types.JSONText(templateRequest)}).validate())
+	assert.Error((&LaunchTemplateRequest{Name: "rstudio"}).validate())
+	assert.Error((&LaunchTemplateRequest{Name: "rstudio", Request: types.JSONText(`{"name": "rstudio"}`)}).validate())
+	assert.Error((&LaunchTemplateRequest{Name: "rstudio", Request: types.JSONText(`[]`)}).validate())
+}
+
+func TestTemplateSubmission(t *testing.T) {
+	assert := assert.New(t)
+
+	template := &LaunchTemplate{ID: "t1", Name: "lab", Owner: "alice@example.org", Request: types.JSONText(templateRequest)}
+	now := time.Date(2026, time.October, 16, 9, 0, 0, 0, time.UTC)
+
+	// The owner's launches keep the saved settings, but each one gets its own
+	// name and output folder.
+	submission, err := templateSubmission(template, "alice@example.org", now)
+	if assert.NoError(err) {
+		assert.Equal("a1", submission["app_id"])
+		assert.Equal("rstudio-2026-10-16-09-00-00", submission["name"])
+		assert.Equal(true, submission["create_output_subdir"])
+		assert.Equal("/iplant/home/alice/analyses", submission["output_dir"])
+		assert.Equal(map[string]interface{}{"s1_p1": "classroom"}, submission["config"])
+	}
+
+	again, err := templateSubmission(template, "alice@example.org", now.Add(time.Second))
+	assert.NoError(err)
+	assert.NotEqual(submission["name"], again["name"])
+
+	// The outputs of users it's shared with go to their own folders.
+	submission, err = templateSubmission(template, "bob@example.org", now)
+	if assert.NoError(err) {
+		assert.NotContains(submission, "output_dir")
+		assert.Equal(true, submission["create_output_subdir"])
+	}
+
+	// The template's name is used if the submission doesn't have one.
+	template.Request = types.JSONText(`{"app_id": "a1"}`)
+	submission, err = templateSubmission(template, "alice@example.org", now)
+	if assert.NoError(err) {
+		assert.Equal("lab-2026-10-16-09-00-00", submission["name"])
+	}
+}
+
+// appsService starts a fake apps service that accepts analysis submissions
+// with the status and response body given, and records the ones it gets.
+// The caller closes it.
+func appsService(t *testing.T, status int, response string) (*httptest.Server, *[]map[string]interface{}) {
+	submissions := &[]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/analyses" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		submission := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&submission); err != nil {
+			t.Error(err)
+		}
+		submission["user"] = r.URL.Query().Get("user")
+		*submissions = append(*submissions, submission)
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	return server, submissions
+}
+
+func TestSubmitAnalysis(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, nil)
+
+	server, submissions := appsService(t, http.StatusOK, `{"id": "a-1", "name": "rstudio"}`)
+	defer server.Close()
+	i.AppsServiceBaseURL = server.URL
+
+	analysisID, err := i.submitAnalysis("bob@example.org", map[string]interface{}{"app_id": "a1"})
+	assert.NoError(err)
+	assert.Equal("a-1", analysisID)
+	if assert.Len(*submissions, 1) {
+		assert.Equal("bob", (*submissions)[0]["user"])
+		assert.Equal("a1", (*submissions)[0]["app_id"])
+	}
+
+	// Submissions the apps service rejects are reported with its status.
+	rejecting, _ := appsService(t, http.StatusBadRequest, `{"reason": "the app is disabled"}`)
+	defer rejecting.Close()
+	i.AppsServiceBaseURL = rejecting.URL
+
+	_, err = i.submitAnalysis("bob@example.org", map[string]interface{}{"app_id": "a1"})
+	if assert.IsType(&echo.HTTPError{}, err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+		assert.Contains(err.Error(), "the app is disabled")
+	}
+
+	failing, _ := appsService(t, http.StatusInternalServerError, `oops`)
+	defer failing.Close()
+	i.AppsServiceBaseURL = failing.URL
+
+	_, err = i.submitAnalysis("bob@example.org", map[string]interface{}{"app_id": "a1"})
+	assert.Error(err)
+	assert.NotContains(err.Error(), "code=")
+}
+
+func TestLaunchTemplateAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	expectTemplate := func() {
+		mock.ExpectQuery("FROM vice_launch_templates").
+			WithArgs("t1").
+			WillReturnRows(sqlmock.NewRows(launchTemplateRows).
+				AddRow("t1", "rstudio", "", "alice@example.org", templateRequest, "{bob@example.org}", time.Now(), time.Now()))
+	}
+
+	expectTemplate()
+	template, err := i.launchTemplate("t1", "alice@example.org", true)
+	assert.NoError(err)
+	assert.Equal([]string{"bob@example.org"}, []string(template.SharedWith))
+
+	expectTemplate()
+	_, err = i.launchTemplate("t1", "bob@example.org", false)
+	assert.NoError(err)
+
+	// Users it's shared with can't change it.
+	expectTemplate()
+	_, err = i.launchTemplate("t1", "bob@example.org", true)
+	if assert.IsType(&echo.HTTPError{}, err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	// Anyone else can't see it at all.
+	expectTemplate()
+	_, err = i.launchTemplate("t1", "carol@example.org", false)
+	if assert.IsType(&echo.HTTPError{}, err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestShareLaunchTemplateHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	mock.ExpectQuery("FROM vice_launch_templates").
+		WithArgs("t1").
+		WillReturnRows(sqlmock.NewRows(launchTemplateRows).
+			AddRow("t1", "rstudio", "", "alice@example.org", templateRequest, "{}", time.Now(), time.Now()))
+	mock.ExpectQuery("UPDATE vice_launch_templates").
+		WithArgs("t1", "{\"bob@example.org\",\"carol@example.org\"}").
+		WillReturnRows(sqlmock.NewRows(launchTemplateRows).
+			AddRow("t1", "rstudio", "", "alice@example.org", templateRequest, "{bob@example.org,carol@example.org}", time.Now(), time.Now()))
+
+	body := `{"users": ["bob", "carol@example.org", "bob@example.org", "alice"]}`
+	req := httptest.NewRequest(http.MethodPut, "/vice/my/templates/t1/shares?user=alice", bytes.NewBufferString(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("template-id")
+	c.SetParamValues("t1")
+
+	assert.NoError(i.ShareLaunchTemplateHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"sharedWith":["bob@example.org","carol@example.org"]`)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchTemplateHandlerNotShared(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	mock.ExpectQuery("FROM vice_launch_templates").
+		WithArgs("t1").
+		WillReturnRows(sqlmock.NewRows(launchTemplateRows).
+			AddRow("t1", "rstudio", "", "alice@example.org", templateRequest, "{bob@example.org}", time.Now(), time.Now()))
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/my/templates/t1/launch?user=carol", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("template-id")
+	c.SetParamValues("t1")
+
+	err := i.LaunchTemplateHandler(c)
+	if assert.IsType(&echo.HTTPError{}, err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchTemplateHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+
+	server, submissions := appsService(t, http.StatusOK, `{"id": "a-2"}`)
+	defer server.Close()
+	i.AppsServiceBaseURL = server.URL
+
+	mock.ExpectQuery("FROM vice_launch_templates").
+		WithArgs("t1").
+		WillReturnRows(sqlmock.NewRows(launchTemplateRows).
+			AddRow("t1", "rstudio", "", "alice@example.org", templateRequest, "{bob@example.org}", time.Now(), time.Now()))
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/my/templates/t1/launch?user=bob", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("template-id")
+	c.SetParamValues("t1")
+
+	assert.NoError(i.LaunchTemplateHandler(c))
+	assert.Equal(http.StatusAccepted, rec.Code)
+	assert.JSONEq(`{"analysisID": "a-2"}`, rec.Body.String())
+	if assert.Len(*submissions, 1) {
+		assert.Equal("bob", (*submissions)[0]["user"])
+		assert.NotContains((*submissions)[0], "output_dir")
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
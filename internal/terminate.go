@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// analysisResourceCount returns how many of the namespaced k8s resources for
+// an analysis match the label selector.
+func (i *Internal) analysisResourceCount(selector string) (int, error) {
+	opts := metav1.ListOptions{LabelSelector: selector}
+	count := 0
+
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(opts)
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing deployments")
+	}
+	count += len(deployments.Items)
+
+	services, err := i.clientset.CoreV1().Services(i.ViceNamespace).List(opts)
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing services")
+	}
+	count += len(services.Items)
+
+	ingresses, err := i.clientset.ExtensionsV1beta1().Ingresses(i.ViceNamespace).List(opts)
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing ingresses")
+	}
+	count += len(ingresses.Items)
+
+	configMaps, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).List(opts)
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing configmaps")
+	}
+	count += len(configMaps.Items)
+
+	claims, err := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).List(opts)
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing persistent volume claims")
+	}
+	count += len(claims.Items)
+
+	return count, nil
+}
+
+// resolveAnalysisID returns the external ID of the analysis identified by
+// either its external ID or its subdomain. An empty string is returned if
+// there's nothing in the cluster for it.
+func (i *Internal) resolveAnalysisID(id string) (string, error) {
+	filter, err := i.hostFilter(id)
+	if err != nil {
+		return "", err
+	}
+
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(filter)).AsSelector().String(),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error looking up the deployment for %s", id)
+	}
+	if len(deployments.Items) > 0 {
+		return i.labelKeys.get(deployments.Items[0].Labels, "external-id"), nil
+	}
+
+	// Vanity subdomains are released along with the routing, so the leftovers
+	// of a partially torn down analysis can only be found by external ID.
+	count, err := i.analysisResourceCount(labels.Set(i.labelKeys.selector(map[string]string{"external-id": id})).AsSelector().String())
+	if err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return id, nil
+	}
+
+	return "", nil
+}
+
+// deleteAnalysisVolumes deletes the persistent volumes left behind for the
+// analysis. They're normally removed along with their claims.
+func (i *Internal) deleteAnalysisVolumes(externalID string) error {
+	pvclient := i.clientset.CoreV1().PersistentVolumes()
+
+	pvlist, err := pvclient.List(metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID})).AsSelector().String(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error listing the persistent volumes for analysis %s", externalID)
+	}
+
+	for _, pv := range pvlist.Items {
+		if err = pvclient.Delete(pv.Name, &metav1.DeleteOptions{}); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// bulkTerminateConcurrency is the most analyses that a bulk termination tears
+// down at once.
+const bulkTerminateConcurrency = 5
+
+// terminateAnalysis tears down the analysis on behalf of an administrator
+// without saving its outputs, removes any persistent volumes left behind, and
+// publishes its terminal status.
+func (i *Internal) terminateAnalysis(externalID string) error {
+	if err := i.teardown(externalID, false); err != nil {
+		return err
+	}
+
+	if err := i.deleteAnalysisVolumes(externalID); err != nil {
+		return err
+	}
+
+	// The deployment watcher does this too, but it won't hear about analyses
+	// whose deployment was already gone.
+	if err := i.markTerminated(externalID, fmt.Sprintf("analysis %s was terminated by an administrator", externalID)); err != nil {
+		log.Error(err)
+	}
+
+	return nil
+}
+
+// terminateInBackground terminates each of the analyses in a goroutine so that
+// the caller isn't waiting on the teardowns. At most bulkTerminateConcurrency
+// of them run at once. Failures are logged, since there's nobody left to
+// report them to.
+func (i *Internal) terminateInBackground(externalIDs []string) {
+	go func() {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, bulkTerminateConcurrency)
+
+		for _, externalID := range externalIDs {
+			wg.Add(1)
+			slots <- struct{}{}
+
+			go func(externalID string) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+
+				if err := i.terminateAnalysis(externalID); err != nil {
+					log.Error(errors.Wrapf(err, "error terminating analysis %s", externalID))
+				}
+			}(externalID)
+		}
+
+		wg.Wait()
+		log.Infof("finished terminating %d analyses", len(externalIDs))
+	}()
+}
+
+// AdminTerminateAnalysisHandler starts tearing down the analysis identified by
+// the external ID or subdomain in the URL without saving its outputs, removing
+// any persistent volumes left behind, and publishing its terminal status. The
+// teardown happens in the background, so a 202 is returned along with the
+// teardown progress as of the request; the teardown endpoint reports how it's
+// going from there. Analyses protected from deletion are only terminated if
+// the force query parameter is true.
+func (i *Internal) AdminTerminateAnalysisHandler(c echo.Context) error {
+	id := c.Param("external-id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "external-id parameter is empty")
+	}
+
+	externalID, err := i.resolveAnalysisID(id)
+	if err != nil {
+		return err
+	}
+	if externalID == "" {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no analysis found for %s", id))
+	}
+
+	if err = i.checkDeletionProtection(c, externalID); err != nil {
+		return err
+	}
+
+	progress, err := i.getTeardown(externalID)
+	if err != nil {
+		return err
+	}
+
+	i.terminateInBackground([]string{externalID})
+
+	return c.JSON(http.StatusAccepted, progress)
+}
+
+// AdminBulkTerminateHandler starts tearing down every running analysis whose
+// labels match all of the labels in the body of the request, which is a JSON
+// object of label names to values, just like the listing filters. At least one
+// label is required so that a missing body doesn't terminate everything.
+// Analyses protected from deletion are skipped unless the force query
+// parameter is true. The teardowns happen in the background, so a 202 is
+// returned along with the outcome for each analysis, where success means that
+// its teardown was started.
+func (i *Internal) AdminBulkTerminateHandler(c echo.Context) error {
+	filter := map[string]string{}
+	if err := c.Bind(&filter); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(filter) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one label is required")
+	}
+
+	externalIDs, err := i.filterExternalIDs(filter)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("terminating %d analyses matching %v", len(externalIDs), filter)
+
+	accepted := []string{}
+	results := i.doForAnalyses(c.Request().Context(), externalIDs, func(result *BulkOperationResult) error {
+		if err := i.checkDeletionProtection(c, result.ExternalID); err != nil {
+			return err
+		}
+		accepted = append(accepted, result.ExternalID)
+		return nil
+	})
+
+	i.terminateInBackground(accepted)
+
+	return c.JSON(http.StatusAccepted, map[string]interface{}{
+		"results": results,
+	})
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestResolveAnalysisID(t *testing.T) {
+	assert := assert.New(t)
+
+	objs := []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "e1",
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"external-id": "e1", "subdomain": "a1b2c3"},
+			},
+		},
+		&apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "excludes-file-e2",
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"external-id": "e2"},
+			},
+		},
+	}
+	internal, mock := setupInternal(t, objs)
+
+	tests := []struct {
+		id       string
+		vanity   string
+		expected string
+	}{
+		{"a1b2c3", "", "e1"},
+		{"my-notebook", "e1", "e1"},
+		{"e1", "", "e1"},
+		{"e2", "", "e2"},
+		{"e3", "", ""},
+	}
+
+	for _, test := range tests {
+		query := mock.ExpectQuery("SELECT external_id FROM vice_subdomains").WithArgs(test.id)
+		if test.vanity == "" {
+			query.WillReturnError(sql.ErrNoRows)
+		} else {
+			query.WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow(test.vanity))
+		}
+
+		externalID, err := internal.resolveAnalysisID(test.id)
+		assert.NoError(err)
+		assert.Equal(test.expected, externalID, test.id)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDeleteAnalysisVolumes(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, []runtime.Object{
+		&apiv1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-data-volume-e1", Labels: map[string]string{"external-id": "e1"}},
+		},
+		&apiv1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-data-volume-e2", Labels: map[string]string{"external-id": "e2"}},
+		},
+	})
+
+	assert.NoError(internal.deleteAnalysisVolumes("e1"))
+
+	pvs, err := internal.clientset.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Len(pvs.Items, 1)
+	assert.Equal("csi-data-volume-e2", pvs.Items[0].Name)
+}
+
+func TestAdminBulkTerminateHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, []runtime.Object{
+		appDeployment("e1", "app1"),
+		appDeployment("e2", "app2"),
+	})
+
+	terminate := func(body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPost, "/vice/admin/terminate", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		return rec, internal.AdminBulkTerminateHandler(echo.New().NewContext(req, rec))
+	}
+
+	// An empty filter would match everything.
+	_, err := terminate("{}")
+	assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+
+	// Protected analyses are reported and left running.
+	mock.ExpectQuery("SELECT s.external_id, j.id FROM jobs j").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "id"}).AddRow("e1", "a1"))
+	registerProtectionQuery(mock, "e1", true)
+
+	rec, err := terminate(`{"app-id": "app1"}`)
+	assert.NoError(err)
+	assert.Equal(http.StatusAccepted, rec.Code)
+
+	response := map[string][]BulkOperationResult{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Len(response["results"], 1)
+	assert.Equal("a1", response["results"][0].AnalysisID)
+	assert.False(response["results"][0].Success)
+	assert.Contains(response["results"][0].Error, "protected from deletion")
+
+	deps, err := internal.clientset.AppsV1().Deployments("vice-apps").List(metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Len(deps.Items, 2)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
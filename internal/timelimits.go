@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const defaultTimeLimitCheckInterval = time.Minute
+
+// defaultTimeLimitWarnings are how long before the time limit users are
+// warned if no warnings are configured.
+var defaultTimeLimitWarnings = []time.Duration{time.Hour, 10 * time.Minute}
+
+// TimeLimitConfig turns on the enforcement of analysis time limits. Every
+// CheckInterval, the planned end date of each running analysis is compared
+// with the current time. Users are warned through a status update when their
+// analysis is within each of the Warnings of its limit, and analyses past
+// their limit are saved and shut down.
+type TimeLimitConfig struct {
+	Enabled       bool            `mapstructure:"enabled"`
+	CheckInterval time.Duration   `mapstructure:"check_interval"`
+	Warnings      []time.Duration `mapstructure:"warnings"`
+}
+
+func (t *TimeLimitConfig) checkInterval() time.Duration {
+	if t.CheckInterval <= 0 {
+		return defaultTimeLimitCheckInterval
+	}
+	return t.CheckInterval
+}
+
+// warnings returns the warning thresholds from the longest to the shortest.
+func (t *TimeLimitConfig) warnings() []time.Duration {
+	warnings := t.Warnings
+	if len(warnings) == 0 {
+		warnings = defaultTimeLimitWarnings
+	}
+	sorted := append([]time.Duration{}, warnings...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] > sorted[b] })
+	return sorted
+}
+
+const plannedEndDatesSQL = `
+	SELECT s.external_id, j.planned_end_date
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	 WHERE s.external_id = ANY($1)
+	   AND j.planned_end_date IS NOT NULL
+`
+
+// The warning is keyed by the planned end date, so that extending the time
+// limit re-arms the warnings.
+const recordTimeLimitWarningSQL = `
+	INSERT INTO vice_time_limit_warnings (external_id, planned_end_date, warning_seconds, sent_at)
+	VALUES ($1, $2, $3, now())
+	ON CONFLICT (external_id, planned_end_date, warning_seconds) DO NOTHING
+`
+
+// plannedEndDates returns the planned end dates of the analyses, keyed by
+// external ID. Analyses without a planned end date are left out.
+func (i *Internal) plannedEndDates(externalIDs []string) (map[string]time.Time, error) {
+	rows := []struct {
+		ExternalID     string    `db:"external_id"`
+		PlannedEndDate time.Time `db:"planned_end_date"`
+	}{}
+	if err := i.db.Select(&rows, plannedEndDatesSQL, pq.Array(externalIDs)); err != nil {
+		return nil, errors.Wrap(err, "error looking up the planned end dates")
+	}
+
+	endDates := map[string]time.Time{}
+	for _, row := range rows {
+		endDates[row.ExternalID] = row.PlannedEndDate
+	}
+	return endDates, nil
+}
+
+// dueWarning returns the shortest warning threshold the analysis is within,
+// or zero if it isn't within any of them.
+func (i *Internal) dueWarning(remaining time.Duration) time.Duration {
+	var due time.Duration
+	for _, warning := range i.TimeLimits.warnings() {
+		if remaining <= warning {
+			due = warning
+		}
+	}
+	return due
+}
+
+// warnTimeLimit tells the user that the analysis is approaching its time
+// limit, unless they've already been warned at this threshold.
+func (i *Internal) warnTimeLimit(externalID, analysisName string, endDate time.Time, warning, remaining time.Duration) error {
+	result, err := i.db.Exec(recordTimeLimitWarningSQL, externalID, endDate, int64(warning/time.Second))
+	if err != nil {
+		return errors.Wrapf(err, "error recording the time limit warning for analysis %s", externalID)
+	}
+
+	sent, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if sent == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf(
+		"analysis %s will reach its time limit in %s, at %s, and will then be saved and shut down unless the time limit is extended",
+		analysisName, remaining.Round(time.Minute), endDate.UTC().Format(time.RFC3339),
+	)
+	if err = i.statusPublisher.Running(externalID, msg); err != nil {
+		return err
+	}
+
+	i.recordAnalysisEvent(externalID, apiv1.EventTypeWarning, EventTimeLimitWarning, msg, false)
+
+	return nil
+}
+
+// analysisClaims keeps track of the analyses that something is already being
+// done to, so that it isn't done twice at once.
+type analysisClaims struct {
+	mu      sync.Mutex
+	claimed map[string]bool
+}
+
+// claim returns true if the analysis wasn't already claimed, and claims it.
+func (a *analysisClaims) claim(externalID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.claimed == nil {
+		a.claimed = map[string]bool{}
+	}
+	if a.claimed[externalID] {
+		return false
+	}
+	a.claimed[externalID] = true
+	return true
+}
+
+func (a *analysisClaims) release(externalID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.claimed, externalID)
+}
+
+// saveAndShutDown saves the outputs of an analysis and shuts it down on
+// behalf of the system, telling the user why with the message. Analyses that
+// an administrator has quarantined, or that are already being torn down, are
+// left alone. The time limit, idle and schedule checks can all decide to shut
+// down the same analysis, so only the first of them to get here goes ahead;
+// once it has started the teardown, the others see its progress.
+func (i *Internal) saveAndShutDown(externalID, msg string) {
+	if !i.shutdowns.claim(externalID) {
+		log.Debugf("analysis %s is already being shut down", externalID)
+		return
+	}
+	defer i.shutdowns.release(externalID)
+
+	progress, err := i.getTeardown(externalID)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if progress != nil {
+		return
+	}
+
+	state, err := i.currentState(externalID, RunningState)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if state == QuarantinedState || state == TerminatingState || state.IsTerminal() {
+		return
+	}
+
+	log.Info(msg)
+	if err = i.statusPublisher.Running(externalID, msg); err != nil {
+		log.Error(err)
+	}
+
+	if err = i.teardown(externalID, true); err != nil {
+		log.Error(errors.Wrapf(err, "error shutting down analysis %s", externalID))
+	}
+}
+
+// enforceTimeLimits warns the users of the running analyses that are close to
+// their time limits and starts shutting down the ones past them, leaving out
+// the analyses protected from deletion. Analyses in expiring are already being
+// shut down; the ones started by this check are added to it, and the ones no
+// longer running are removed.
+func (i *Internal) enforceTimeLimits(now time.Time, expiring map[string]bool) error {
+	deplist, err := i.deploymentList(i.ViceNamespace, map[string]string{}, []string{})
+	if err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	externalIDs := []string{}
+	for _, dep := range deplist.Items {
+		// Protected analyses aren't shut down, so their users aren't warned.
+		if isProtected(dep.Labels) {
+			continue
+		}
+		if id := i.labelKeys.get(dep.Labels, "external-id"); id != "" {
+			names[id] = i.labelKeys.get(dep.Labels, "analysis-name")
+			externalIDs = append(externalIDs, id)
+		}
+	}
+
+	for id := range expiring {
+		if _, ok := names[id]; !ok {
+			delete(expiring, id)
+		}
+	}
+
+	if len(externalIDs) == 0 {
+		return nil
+	}
+
+	endDates, err := i.plannedEndDates(externalIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, externalID := range externalIDs {
+		endDate, ok := endDates[externalID]
+		if !ok || expiring[externalID] {
+			continue
+		}
+
+		remaining := endDate.Sub(now)
+		if remaining <= 0 {
+			expiring[externalID] = true
+			go i.saveAndShutDown(externalID, fmt.Sprintf(
+				"analysis %s has reached its time limit, so its outputs are being saved and it's being shut down",
+				names[externalID],
+			))
+			continue
+		}
+
+		if warning := i.dueWarning(remaining); warning > 0 {
+			if err = i.warnTimeLimit(externalID, names[externalID], endDate, warning, remaining); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StartTimeLimitEnforcement periodically checks the running analyses against
+// their time limits. It does nothing unless enforcement is turned on.
+func (i *Internal) StartTimeLimitEnforcement() {
+	if !i.TimeLimits.Enabled {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(i.TimeLimits.checkInterval())
+		defer ticker.Stop()
+
+		expiring := map[string]bool{}
+		for range ticker.C {
+			if err := i.enforceTimeLimits(time.Now(), expiring); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
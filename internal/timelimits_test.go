@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDueWarning(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := setupInternal(t, nil)
+	i.TimeLimits.Warnings = []time.Duration{10 * time.Minute, 24 * time.Hour, time.Hour}
+
+	assert.Equal(time.Duration(0), i.dueWarning(48*time.Hour))
+	assert.Equal(24*time.Hour, i.dueWarning(2*time.Hour))
+	assert.Equal(time.Hour, i.dueWarning(30*time.Minute))
+	assert.Equal(10*time.Minute, i.dueWarning(time.Minute))
+}
+
+func TestEnforceTimeLimitsWarning(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "e1",
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"app-type": "interactive", "external-id": "e1", "analysis-name": "notebook"},
+			},
+		},
+	})
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+
+	now := time.Now()
+	endDate := now.Add(30 * time.Minute)
+
+	endDates := func() {
+		mock.ExpectQuery("SELECT s.external_id, j.planned_end_date").
+			WillReturnRows(sqlmock.NewRows([]string{"external_id", "planned_end_date"}).AddRow("e1", endDate))
+	}
+
+	// The user is warned once per threshold.
+	endDates()
+	mock.ExpectExec("INSERT INTO vice_time_limit_warnings").
+		WithArgs("e1", endDate, int64(3600)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	endDates()
+	mock.ExpectExec("INSERT INTO vice_time_limit_warnings").
+		WithArgs("e1", endDate, int64(3600)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	expiring := map[string]bool{"gone": true}
+	assert.NoError(i.enforceTimeLimits(now, expiring))
+	assert.NoError(i.enforceTimeLimits(now, expiring))
+
+	assert.Equal([]string{"Running"}, publisher.published)
+	assert.Empty(expiring)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestEnforceTimeLimitsAlreadyExpiring(t *testing.T) {
+	i, mock := setupInternal(t, []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "e1",
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"app-type": "interactive", "external-id": "e1"},
+			},
+		},
+	})
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT s.external_id, j.planned_end_date").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "planned_end_date"}).AddRow("e1", now.Add(-time.Minute)))
+
+	// Nothing more is done for analyses that are already being shut down.
+	expiring := map[string]bool{"e1": true}
+	assert.NoError(t, i.enforceTimeLimits(now, expiring))
+	assert.True(t, expiring["e1"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSaveAndShutDownClaimed(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	i.statusPublisher = publisher
+
+	// Another check is already shutting the analysis down, so the user isn't
+	// told twice and nothing is looked up.
+	assert.True(i.shutdowns.claim("e1"))
+	assert.False(i.shutdowns.claim("e1"))
+	i.saveAndShutDown("e1", "analysis e1 has reached its time limit")
+
+	assert.Empty(publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	i.shutdowns.release("e1")
+	assert.True(i.shutdowns.claim("e1"))
+}
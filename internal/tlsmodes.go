@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// TLSModePassthrough hands the TLS connection to the analysis untouched,
+	// for apps that authenticate users with client certificates themselves.
+	// Requests bypass the VICE proxy and go straight to the first port the app
+	// declares, which has to speak TLS.
+	TLSModePassthrough = "passthrough"
+
+	// TLSModeClientCert terminates TLS at the ingress as usual, but asks for a
+	// client certificate and forwards it to the analysis in request headers.
+	TLSModeClientCert = "client-cert"
+
+	tlsPassthroughPortName = "tcp-tls"
+
+	sslPassthroughAnnotation         = "nginx.ingress.kubernetes.io/ssl-passthrough"
+	backendProtocolAnnotation        = "nginx.ingress.kubernetes.io/backend-protocol"
+	authTLSVerifyClientAnnotation    = "nginx.ingress.kubernetes.io/auth-tls-verify-client"
+	authTLSSecretAnnotation          = "nginx.ingress.kubernetes.io/auth-tls-secret"
+	authTLSPassCertificateAnnotation = "nginx.ingress.kubernetes.io/auth-tls-pass-certificate-to-upstream"
+)
+
+// ValidateAppTLSModes returns an error if any of the per-app TLS modes aren't
+// supported.
+func ValidateAppTLSModes(modes map[string]string) error {
+	problems := []string{}
+
+	for appID, mode := range modes {
+		if mode != TLSModePassthrough && mode != TLSModeClientCert {
+			problems = append(problems, fmt.Sprintf("app %s: unsupported TLS mode %s", appID, mode))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid app TLS modes: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// tlsMode returns the TLS mode configured for the app, or an empty string if
+// TLS is handled the usual way.
+func (i *Internal) tlsMode(job *model.Job) string {
+	return i.AppTLSModes[job.AppID]
+}
+
+// tlsPassthroughPort returns the Service port that passed-through TLS
+// connections are sent to, which is the first port declared by the app. The
+// second return value is false if the app doesn't use TLS passthrough or the
+// port can't be exposed.
+func (i *Internal) tlsPassthroughPort(job *model.Job) (apiv1.ServicePort, bool) {
+	if i.tlsMode(job) != TLSModePassthrough {
+		return apiv1.ServicePort{}, false
+	}
+
+	ports := i.analysisPorts(job)
+	if len(ports) == 0 {
+		return apiv1.ServicePort{}, false
+	}
+
+	port := ports[0]
+	if port.Protocol != apiv1.ProtocolTCP || port.ContainerPort == fileTransfersPort || port.ContainerPort == viceProxyServicePort {
+		log.Warnf("not passing TLS through to port %d for analysis %s", port.ContainerPort, job.InvocationID)
+		return apiv1.ServicePort{}, false
+	}
+
+	return apiv1.ServicePort{
+		Name:       tlsPassthroughPortName,
+		Protocol:   apiv1.ProtocolTCP,
+		Port:       port.ContainerPort,
+		TargetPort: intstr.FromString(port.Name),
+	}, true
+}
+
+// addTLSModeAnnotations adds the annotations for the app's TLS mode to the
+// Ingress annotations. Passthrough Ingresses don't get a certificate, since
+// the ingress controller never terminates their TLS.
+func (i *Internal) addTLSModeAnnotations(job *model.Job, annotations map[string]string) {
+	switch i.tlsMode(job) {
+	case TLSModePassthrough:
+		annotations[sslPassthroughAnnotation] = "true"
+		annotations[backendProtocolAnnotation] = "HTTPS"
+		delete(annotations, "cert-manager.io/issuer")
+		delete(annotations, "cert-manager.io/cluster-issuer")
+	case TLSModeClientCert:
+		annotations[authTLSPassCertificateAnnotation] = "true"
+		if i.IngressClientCertSecret != "" {
+			annotations[authTLSSecretAnnotation] = i.IngressClientCertSecret
+			annotations[authTLSVerifyClientAnnotation] = "on"
+		} else {
+			annotations[authTLSVerifyClientAnnotation] = "optional_no_ca"
+		}
+	}
+}
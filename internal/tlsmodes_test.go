@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAppTLSModes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateAppTLSModes(nil))
+	assert.NoError(ValidateAppTLSModes(map[string]string{"app1": TLSModePassthrough, "app2": TLSModeClientCert}))
+
+	err := ValidateAppTLSModes(map[string]string{"app1": "mutual"})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "app app1: unsupported TLS mode mutual")
+	}
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	defer internal.db.Close()
+
+	internal.IngressTLS = true
+	internal.CertManagerIssuer = "letsencrypt"
+	internal.AppTLSModes = map[string]string{"app1": TLSModePassthrough}
+
+	job := multiPortJob(8443)
+	job.Name = "test analysis"
+	job.Submitter = "test@example.org"
+
+	// Nothing changes for apps that aren't configured.
+	_, ok := internal.tlsPassthroughPort(job)
+	assert.False(ok)
+
+	job.AppID = "app1"
+	port, ok := internal.tlsPassthroughPort(job)
+	assert.True(ok)
+	assert.Equal(tlsPassthroughPortName, port.Name)
+	assert.Equal(int32(8443), port.Port)
+	assert.Equal("tcp-a-0", port.TargetPort.String())
+
+	registerUserIPQuery(mock, "127.0.0.1")
+	registerSubdomainQuery(mock, job.InvocationID, "")
+	svc, err := internal.getService(job, nil)
+	assert.NoError(err)
+	assert.Equal(tlsPassthroughPortName, svc.Spec.Ports[len(svc.Spec.Ports)-1].Name)
+
+	registerUserIPQuery(mock, "127.0.0.1")
+	registerSubdomainQuery(mock, job.InvocationID, "")
+	registerSubdomainQuery(mock, job.InvocationID, "")
+	ingress, err := internal.getIngress(job, svc)
+	assert.NoError(err)
+	assert.Empty(ingress.Spec.TLS)
+	assert.Equal(8443, ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort.IntValue())
+	assert.Equal("true", ingress.Annotations[sslPassthroughAnnotation])
+	assert.Equal("HTTPS", ingress.Annotations[backendProtocolAnnotation])
+	assert.NotContains(ingress.Annotations, "cert-manager.io/cluster-issuer")
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestClientCertAnnotations(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, nil)
+	internal.AppTLSModes = map[string]string{"app1": TLSModeClientCert}
+
+	job := multiPortJob(8888)
+	job.AppID = "app1"
+
+	annotations := map[string]string{}
+	internal.addTLSModeAnnotations(job, annotations)
+	assert.Equal("true", annotations[authTLSPassCertificateAnnotation])
+	assert.Equal("optional_no_ca", annotations[authTLSVerifyClientAnnotation])
+	assert.NotContains(annotations, authTLSSecretAnnotation)
+
+	internal.IngressClientCertSecret = "vice-apps/clinical-ca"
+	annotations = map[string]string{}
+	internal.addTLSModeAnnotations(job, annotations)
+	assert.Equal("on", annotations[authTLSVerifyClientAnnotation])
+	assert.Equal("vice-apps/clinical-ca", annotations[authTLSSecretAnnotation])
+
+	_, ok := internal.tlsPassthroughPort(job)
+	assert.False(ok)
+}
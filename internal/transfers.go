@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -98,7 +99,7 @@ func (i *Internal) fileTransfersVolumeMounts(job *model.Job) []apiv1.VolumeMount
 	return retval
 }
 
-func requestTransfer(svc apiv1.Service, reqpath string) (*transferResponse, error) {
+func requestTransfer(ctx context.Context, svc apiv1.Service, reqpath string) (*transferResponse, error) {
 	var (
 		bodybytes []byte
 		bodyerr   error
@@ -113,7 +114,12 @@ func requestTransfer(svc apiv1.Service, reqpath string) (*transferResponse, erro
 	svcurl.Host = fmt.Sprintf("%s.%s:%d", svc.Name, svc.Namespace, fileTransfersPort)
 	svcurl.Path = reqpath
 
-	resp, posterr := http.Post(svcurl.String(), "", nil)
+	req, err := http.NewRequest(http.MethodPost, svcurl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, posterr := http.DefaultClient.Do(req.WithContext(ctx))
 	if posterr != nil {
 		return nil, errors.Wrapf(posterr, "error POSTing to %s", svcurl.String())
 	}
@@ -138,7 +144,7 @@ func requestTransfer(svc apiv1.Service, reqpath string) (*transferResponse, erro
 	return xferresp, nil
 }
 
-func getTransferDetails(id string, svc apiv1.Service, reqpath string) (*transferResponse, error) {
+func getTransferDetails(ctx context.Context, id string, svc apiv1.Service, reqpath string) (*transferResponse, error) {
 	var (
 		bodybytes []byte
 		bodyerr   error
@@ -153,7 +159,12 @@ func getTransferDetails(id string, svc apiv1.Service, reqpath string) (*transfer
 	svcurl.Host = fmt.Sprintf("%s.%s:%d", svc.Name, svc.Namespace, fileTransfersPort)
 	svcurl.Path = reqpath
 
-	resp, posterr := http.Get(svcurl.String())
+	req, err := http.NewRequest(http.MethodGet, svcurl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, posterr := http.DefaultClient.Do(req.WithContext(ctx))
 	if posterr != nil {
 		return nil, errors.Wrapf(posterr, "error on GET %s", svcurl.String())
 	}
@@ -178,6 +189,15 @@ func getTransferDetails(id string, svc apiv1.Service, reqpath string) (*transfer
 	return xferresp, nil
 }
 
+// transferState returns the lifecycle state an analysis is in while a
+// transfer of the given kind is running.
+func transferState(kind string) AnalysisState {
+	if kind == uploadKind {
+		return SavingState
+	}
+	return StagingState
+}
+
 func isFinished(status string) bool {
 	switch status {
 	case FailedStatus:
@@ -192,14 +212,14 @@ func isFinished(status string) bool {
 // doFileTransfer handles requests to initial file transfers for a VICE
 // analysis. We only need the ID of the job, nothing is required in the
 // body of the request.
-func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool) error {
+func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind string, async bool) error {
 	if i.UseCSIDriver {
 		// if we use CSI Driver, file transfer is not required.
 		msg := fmt.Sprintf("%s succeeded for job %s", kind, externalID)
 
 		log.Info(msg)
 
-		if successerr := i.statusPublisher.Running(externalID, msg); successerr != nil {
+		if successerr := i.transition(externalID, RunningState, msg); successerr != nil {
 			log.Error(successerr)
 		}
 
@@ -214,9 +234,9 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 	// Filter the list of services so only those tagged with an external-id are
 	// returned. external-id is the job ID assigned by the apps service and is
 	// not the same as the analysis ID.
-	set := labels.Set(map[string]string{
+	set := labels.Set(i.labelKeys.selector(map[string]string{
 		"external-id": externalID,
-	})
+	}))
 
 	svclist, err := svcclient.List(metav1.ListOptions{
 		LabelSelector: set.AsSelector().String(),
@@ -229,6 +249,8 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 		return fmt.Errorf("no services with a label of 'external-id=%s' were found", externalID)
 	}
 
+	i.recordAnalysisEvent(externalID, apiv1.EventTypeNormal, EventTransferStarted, fmt.Sprintf("%s started", kind), false)
+
 	// It's technically possibly for multiple services to provide file transfer services,
 	// so we should block until all of them are complete. We're using a WaitGroup to
 	// coordinate the file transfers, since they occur in separate goroutines.
@@ -246,10 +268,11 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 
 			log.Infof("%s transfer for %s", kind, externalID)
 
-			transferObj, xfererr := requestTransfer(svc, reqpath)
+			transferObj, xfererr := requestTransfer(ctx, svc, reqpath)
 			if xfererr != nil {
 				log.Error(xfererr)
 				err = xfererr
+				i.recordAnalysisEvent(externalID, apiv1.EventTypeWarning, EventTransferFailed, fmt.Sprintf("%s could not be requested: %s", kind, xfererr), false)
 				return
 			}
 
@@ -272,17 +295,19 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 
 					log.Error(err)
 
-					if failerr := i.statusPublisher.Running(externalID, msg); failerr != nil {
+					if failerr := i.transition(externalID, RunningState, msg); failerr != nil {
 						log.Error(failerr)
 					}
 
+					i.recordAnalysisEvent(externalID, apiv1.EventTypeWarning, EventTransferFailed, fmt.Sprintf("%s failed", kind), false)
+
 					return
 				case CompletedStatus:
 					msg := fmt.Sprintf("%s succeeded for job %s", kind, externalID)
 
 					log.Info(msg)
 
-					if successerr := i.statusPublisher.Running(externalID, msg); successerr != nil {
+					if successerr := i.transition(externalID, RunningState, msg); successerr != nil {
 						log.Error(successerr)
 					}
 
@@ -290,7 +315,7 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 				case RequestedStatus:
 					msg := fmt.Sprintf("%s requested for job %s", kind, externalID)
 
-					if requestederr := i.statusPublisher.Running(externalID, msg); requestederr != nil {
+					if requestederr := i.transition(externalID, transferState(kind), msg); requestederr != nil {
 						log.Error(err)
 					}
 
@@ -301,7 +326,7 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 
 						log.Info(msg)
 
-						if uploadingerr := i.statusPublisher.Running(externalID, msg); uploadingerr != nil {
+						if uploadingerr := i.transition(externalID, transferState(kind), msg); uploadingerr != nil {
 							log.Error(err)
 						}
 
@@ -314,7 +339,7 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 
 						log.Info(msg)
 
-						if downloadingerr := i.statusPublisher.Running(externalID, msg); downloadingerr != nil {
+						if downloadingerr := i.transition(externalID, transferState(kind), msg); downloadingerr != nil {
 							log.Error(err)
 						}
 
@@ -331,7 +356,7 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 
 				fullreqpath := path.Join(reqpath, transferObj.UUID)
 
-				transferObj, xfererr = getTransferDetails(transferObj.UUID, svc, fullreqpath)
+				transferObj, xfererr = getTransferDetails(ctx, transferObj.UUID, svc, fullreqpath)
 				if xfererr != nil {
 					log.Error(errors.Wrapf(xfererr, "error getting transfer details for transferObj %s", fullreqpath))
 					err = xfererr
@@ -343,7 +368,13 @@ func (i *Internal) doFileTransfer(externalID, reqpath, kind string, async bool)
 					return
 				}
 
-				time.Sleep(5 * time.Second)
+				// Stop waiting on the transfer once the caller has given up on it.
+				select {
+				case <-ctx.Done():
+					err = ctx.Err()
+					return
+				case <-time.After(5 * time.Second):
+				}
 			}
 		}(svc)
 	}
@@ -0,0 +1,345 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// ExposureIngress serves analyses through an Ingress for each of them.
+	ExposureIngress = "ingress"
+
+	// ExposureTunnel serves analyses through a gateway that the analysis pods
+	// connect out to, so that no Ingresses are needed.
+	ExposureTunnel = "tunnel"
+
+	tunnelContainerName = "vice-tunnel"
+
+	// tunnelStaleAfter is how long a tunnel is considered connected after the
+	// client last checked in.
+	tunnelStaleAfter = 90 * time.Second
+)
+
+// TunnelInfo contains the state of the tunnel for a VICE analysis.
+type TunnelInfo struct {
+	ExternalID  string    `json:"externalID" db:"external_id"`
+	Subdomain   string    `json:"subdomain" db:"subdomain"`
+	Endpoint    string    `json:"endpoint" db:"endpoint"`
+	ConnectedAt time.Time `json:"connectedAt" db:"connected_at"`
+	LastSeen    time.Time `json:"lastSeen" db:"last_seen"`
+	Connected   bool      `json:"connected" db:"-"`
+}
+
+// setConnected works out whether the tunnel is still connected.
+func (t *TunnelInfo) setConnected(now time.Time) {
+	t.Connected = now.Sub(t.LastSeen) < tunnelStaleAfter
+}
+
+const registerTunnelSQL = `
+	INSERT INTO vice_tunnels (external_id, subdomain, endpoint, connected_at, last_seen)
+	VALUES ($1, $2, $3, now(), now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET subdomain = EXCLUDED.subdomain,
+	       endpoint = EXCLUDED.endpoint,
+	       connected_at = EXCLUDED.connected_at,
+	       last_seen = EXCLUDED.last_seen
+`
+
+const tunnelHeartbeatSQL = `
+	UPDATE vice_tunnels
+	   SET last_seen = now()
+	 WHERE external_id = $1
+`
+
+const deleteTunnelSQL = `
+	DELETE FROM vice_tunnels
+	 WHERE external_id = $1
+`
+
+const tunnelColumns = `
+	SELECT external_id, subdomain, endpoint, connected_at, last_seen
+	  FROM vice_tunnels
+`
+
+const getTunnelSQL = tunnelColumns + `
+	 WHERE external_id = $1
+`
+
+const getTunnelBySubdomainSQL = tunnelColumns + `
+	 WHERE subdomain = $1
+`
+
+const getTunnelsSQL = tunnelColumns + `
+	 WHERE external_id = ANY($1)
+`
+
+// tunnelEnabled returns true if analyses are served through tunnels rather
+// than Ingresses.
+func (i *Internal) tunnelEnabled() bool {
+	return i.ExposureBackend == ExposureTunnel
+}
+
+// tunnelContainer returns the container that connects the analysis to the
+// tunnel gateway and forwards requests to the VICE proxy.
+func (i *Internal) tunnelContainer(job *model.Job) apiv1.Container {
+	return apiv1.Container{
+		Name:            tunnelContainerName,
+		Image:           i.TunnelClientImage,
+		ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
+		Args: []string{
+			"--gateway", i.TunnelGatewayURL,
+			"--external-id", job.InvocationID,
+			"--target", fmt.Sprintf("http://localhost:%d", viceProxyPort),
+		},
+		SecurityContext: &apiv1.SecurityContext{
+			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+			RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+		},
+	}
+}
+
+// scanTunnel reads a tunnel from a row returned by one of the tunnel queries.
+func scanTunnel(row interface {
+	StructScan(interface{}) error
+}) (*TunnelInfo, error) {
+	tunnel := &TunnelInfo{}
+	if err := row.StructScan(tunnel); err != nil {
+		return nil, err
+	}
+	tunnel.setConnected(time.Now())
+	return tunnel, nil
+}
+
+// getTunnel returns the tunnel for the analysis, or nil if it has never
+// registered one.
+func (i *Internal) getTunnel(externalID string) (*TunnelInfo, error) {
+	tunnel, err := scanTunnel(i.db.QueryRowx(getTunnelSQL, externalID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the tunnel for %s", externalID)
+	}
+	return tunnel, nil
+}
+
+// getTunnelByHost returns the tunnel serving the host, or nil if there isn't
+// one.
+func (i *Internal) getTunnelByHost(host string) (*TunnelInfo, error) {
+	filter, err := i.hostFilter(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if externalID, ok := filter["external-id"]; ok {
+		return i.getTunnel(externalID)
+	}
+
+	tunnel, err := scanTunnel(i.db.QueryRowx(getTunnelBySubdomainSQL, host))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the tunnel for %s", host)
+	}
+	return tunnel, nil
+}
+
+// getFilteredTunnels returns the tunnels for the analyses whose Deployments
+// match the filter.
+func (i *Internal) getFilteredTunnels(filter map[string]string) ([]TunnelInfo, error) {
+	tunnels := []TunnelInfo{}
+
+	depList, err := i.deploymentList(i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	externalIDs := []string{}
+	for _, dep := range depList.Items {
+		if id := i.labelKeys.get(dep.Labels, "external-id"); id != "" {
+			externalIDs = append(externalIDs, id)
+		}
+	}
+
+	if len(externalIDs) == 0 {
+		return tunnels, nil
+	}
+
+	rows, err := i.db.Queryx(getTunnelsSQL, pq.Array(externalIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "error looking up tunnels")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tunnel, err := scanTunnel(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading tunnel")
+		}
+		tunnels = append(tunnels, *tunnel)
+	}
+
+	return tunnels, rows.Err()
+}
+
+// exposedID returns the external ID of the analysis served from the host and
+// whether requests can reach it, either through its Ingress or its tunnel.
+func (i *Internal) exposedID(host string) (string, bool, error) {
+	if !i.tunnelEnabled() {
+		id, err := i.getIDFromHost(host)
+		if err != nil {
+			return "", false, err
+		}
+		return id, true, nil
+	}
+
+	tunnel, err := i.getTunnelByHost(host)
+	if err != nil {
+		return "", false, err
+	}
+	if tunnel == nil {
+		return "", false, fmt.Errorf("no tunnel found for host %s", host)
+	}
+
+	return tunnel.ExternalID, tunnel.Connected, nil
+}
+
+// verifyTunnelClient makes sure the request comes from one of the pods of the
+// analysis, so that one analysis can't take over the tunnel of another. The
+// IP has to be the address of the connection's peer from remoteHost, since
+// headers such as X-Forwarded-For can name any pod.
+func (i *Internal) verifyTunnelClient(externalID, ip string) (*apiv1.Pod, error) {
+	listoptions := metav1.ListOptions{
+		LabelSelector: labels.Set(i.labelKeys.selector(map[string]string{"external-id": externalID})).AsSelector().String(),
+	}
+
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(listoptions)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range pods.Items {
+		if pods.Items[idx].Status.PodIP == ip {
+			return &pods.Items[idx], nil
+		}
+	}
+
+	return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("%s is not a pod of analysis %s", ip, externalID))
+}
+
+// TunnelRegistration is the request body sent by tunnel clients when they
+// connect.
+type TunnelRegistration struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// RegisterTunnelHandler records the tunnel for an analysis when its client
+// connects to the gateway. Only the pods of the analysis can register it.
+func (i *Internal) RegisterTunnelHandler(c echo.Context) error {
+	externalID := c.Param("external-id")
+	if externalID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "external-id parameter is empty")
+	}
+
+	registration := &TunnelRegistration{}
+	if err := c.Bind(registration); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	pod, err := i.verifyTunnelClient(externalID, remoteHost(c.Request()))
+	if err != nil {
+		return err
+	}
+
+	subdomain := i.subdomain(i.labelKeys.get(pod.Labels, "user-id"), externalID)
+
+	if _, err = i.db.Exec(registerTunnelSQL, externalID, subdomain, registration.Endpoint); err != nil {
+		return errors.Wrapf(err, "error registering the tunnel for %s", externalID)
+	}
+
+	tunnel, err := i.getTunnel(externalID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, tunnel)
+}
+
+// TunnelHeartbeatHandler records that the tunnel client for an analysis is
+// still connected. Clients get a 404 if they need to register again.
+func (i *Internal) TunnelHeartbeatHandler(c echo.Context) error {
+	externalID := c.Param("external-id")
+	if externalID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "external-id parameter is empty")
+	}
+
+	if _, err := i.verifyTunnelClient(externalID, remoteHost(c.Request())); err != nil {
+		return err
+	}
+
+	result, err := i.db.Exec(tunnelHeartbeatSQL, externalID)
+	if err != nil {
+		return errors.Wrapf(err, "error recording the tunnel heartbeat for %s", externalID)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no tunnel is registered for %s", externalID))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteTunnel forgets the tunnel for the analysis.
+func (i *Internal) deleteTunnel(externalID string) error {
+	if _, err := i.db.Exec(deleteTunnelSQL, externalID); err != nil {
+		return errors.Wrapf(err, "error deleting the tunnel for %s", externalID)
+	}
+	return nil
+}
+
+// DeregisterTunnelHandler forgets the tunnel for an analysis when its client
+// disconnects cleanly.
+func (i *Internal) DeregisterTunnelHandler(c echo.Context) error {
+	externalID := c.Param("external-id")
+	if externalID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "external-id parameter is empty")
+	}
+
+	if _, err := i.verifyTunnelClient(externalID, remoteHost(c.Request())); err != nil {
+		return err
+	}
+
+	if err := i.deleteTunnel(externalID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// TunnelLookupHandler returns the tunnel serving the host in the URL. It's
+// used by the gateway to route requests.
+func (i *Internal) TunnelLookupHandler(c echo.Context) error {
+	host := c.Param("host")
+
+	tunnel, err := i.getTunnelByHost(host)
+	if err != nil {
+		return err
+	}
+
+	if tunnel == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no tunnel found for host %s", host))
+	}
+
+	return c.JSON(http.StatusOK, tunnel)
+}
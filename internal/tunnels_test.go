@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var tunnelRowColumns = []string{"external_id", "subdomain", "endpoint", "connected_at", "last_seen"}
+
+func TestTunnelConnected(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	tunnel := &TunnelInfo{LastSeen: now.Add(-30 * time.Second)}
+	tunnel.setConnected(now)
+	assert.True(tunnel.Connected)
+
+	tunnel.LastSeen = now.Add(-5 * time.Minute)
+	tunnel.setConnected(now)
+	assert.False(tunnel.Connected)
+}
+
+func TestVerifyTunnelClient(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, []runtime.Object{
+		&apiv1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Namespace: testConfig.ViceNamespace,
+				Name:      "e1-pod",
+				Labels:    map[string]string{"external-id": "e1", "user-id": "u1"},
+			},
+			Status: apiv1.PodStatus{PodIP: "10.0.0.5"},
+		},
+	})
+
+	pod, err := internal.verifyTunnelClient("e1", "10.0.0.5")
+	assert.NoError(err)
+	assert.Equal("e1-pod", pod.Name)
+
+	_, err = internal.verifyTunnelClient("e1", "10.0.0.6")
+	assert.Error(err)
+
+	_, err = internal.verifyTunnelClient("e2", "10.0.0.5")
+	assert.Error(err)
+}
+
+func TestExposedIDThroughTunnel(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	defer internal.db.Close()
+	internal.ExposureBackend = ExposureTunnel
+
+	// A generated subdomain, with a tunnel that has gone quiet.
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("a1234abcd").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT external_id, subdomain, endpoint, connected_at, last_seen FROM vice_tunnels").
+		WithArgs("a1234abcd").
+		WillReturnRows(sqlmock.NewRows(tunnelRowColumns).
+			AddRow("e1", "a1234abcd", "gw-0", time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+
+	id, exposed, err := internal.exposedID("a1234abcd")
+	assert.NoError(err)
+	assert.Equal("e1", id)
+	assert.False(exposed)
+
+	// A requested subdomain is looked up by the analysis it belongs to.
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").
+		WithArgs("my-notebook").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e2"))
+	mock.ExpectQuery("SELECT external_id, subdomain, endpoint, connected_at, last_seen FROM vice_tunnels").
+		WithArgs("e2").
+		WillReturnRows(sqlmock.NewRows(tunnelRowColumns).
+			AddRow("e2", "a5678abcd", "gw-1", time.Now(), time.Now()))
+
+	id, exposed, err = internal.exposedID("my-notebook")
+	assert.NoError(err)
+	assert.Equal("e2", id)
+	assert.True(exposed)
+
+	// No tunnel at all.
+	mock.ExpectQuery("SELECT external_id FROM vice_subdomains").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT external_id, subdomain, endpoint, connected_at, last_seen FROM vice_tunnels").
+		WillReturnError(sql.ErrNoRows)
+
+	_, _, err = internal.exposedID("a0000abcd")
+	assert.Error(err)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestGetFilteredTunnels(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, []runtime.Object{
+		userDeployment("u1", "e1"),
+		userDeployment("u2", "e2"),
+	})
+	defer internal.db.Close()
+
+	mock.ExpectQuery("SELECT external_id, subdomain, endpoint, connected_at, last_seen FROM vice_tunnels").
+		WillReturnRows(sqlmock.NewRows(tunnelRowColumns).
+			AddRow("e1", "a1234abcd", "gw-0", time.Now(), time.Now()))
+
+	tunnels, err := internal.getFilteredTunnels(map[string]string{"user-id": "u1"})
+	assert.NoError(err)
+	assert.Len(tunnels, 1)
+	assert.Equal("e1", tunnels[0].ExternalID)
+	assert.True(tunnels[0].Connected)
+
+	// Nothing is looked up if no analyses match.
+	tunnels, err = internal.getFilteredTunnels(map[string]string{"user-id": "u3"})
+	assert.NoError(err)
+	assert.Empty(tunnels)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestTunnelHeartbeatSpoofedAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, []runtime.Object{
+		&apiv1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Namespace: testConfig.ViceNamespace,
+				Name:      "e1-pod",
+				Labels:    map[string]string{"external-id": "e1"},
+			},
+			Status: apiv1.PodStatus{PodIP: "10.0.0.5"},
+		},
+	})
+
+	call := func(remoteAddr string) error {
+		req := httptest.NewRequest(http.MethodPost, "/vice/tunnels/e1/heartbeat", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "10.0.0.5")
+		req.Header.Set("X-Real-IP", "10.0.0.5")
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		c.SetParamNames("external-id")
+		c.SetParamValues("e1")
+		return internal.TunnelHeartbeatHandler(c)
+	}
+
+	// Forwarding headers naming the pod don't count.
+	err := call("192.168.1.1:5000")
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	mock.ExpectExec("UPDATE vice_tunnels").WithArgs("e1").WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(call("10.0.0.5:5000"))
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// isBillable returns true if time spent in the state counts towards the
+// uptime of an analysis. The analysis has to be up and reachable by the user,
+// so time spent provisioning, paused, or quarantined doesn't count.
+func (s AnalysisState) isBillable() bool {
+	return s == StagingState || s == RunningState || s == SavingState
+}
+
+// AnalysisUptime is the accumulated billable runtime of an analysis.
+type AnalysisUptime struct {
+	ExternalID      string     `json:"externalID" db:"external_id"`
+	BillableSeconds int64      `json:"billableSeconds" db:"billable_seconds"`
+	RunningSince    *time.Time `json:"runningSince,omitempty" db:"running_since"`
+}
+
+// AnalysisUptimeResponse is the billable runtime of an analysis returned by
+// the uptime endpoints.
+type AnalysisUptimeResponse struct {
+	AnalysisID      string     `json:"analysisID"`
+	ExternalID      string     `json:"externalID"`
+	BillableSeconds int64      `json:"billableSeconds"`
+	Billing         bool       `json:"billing"`
+	RunningSince    *time.Time `json:"runningSince"`
+}
+
+// Billing returns true if the analysis is accruing uptime right now.
+func (u *AnalysisUptime) Billing() bool {
+	return u.RunningSince != nil
+}
+
+const startUptimeSQL = `
+	INSERT INTO vice_analysis_uptime (external_id, billable_seconds, running_since)
+	VALUES ($1, 0, now())
+	ON CONFLICT (external_id) DO UPDATE
+	   SET running_since = COALESCE(vice_analysis_uptime.running_since, EXCLUDED.running_since)
+`
+
+const stopUptimeSQL = `
+	UPDATE vice_analysis_uptime
+	   SET billable_seconds = billable_seconds + COALESCE(EXTRACT(EPOCH FROM now() - running_since)::bigint, 0),
+	       running_since = NULL
+	 WHERE external_id = $1
+`
+
+// The uptime includes the time since the analysis last started accruing
+// uptime, so that it's current for analyses that are still running.
+const uptimeColumns = `
+	SELECT external_id,
+	       billable_seconds + COALESCE(EXTRACT(EPOCH FROM now() - running_since)::bigint, 0) AS billable_seconds,
+	       running_since
+	  FROM vice_analysis_uptime
+`
+
+const getUptimeSQL = uptimeColumns + `
+	 WHERE external_id = $1
+`
+
+const getUptimesSQL = uptimeColumns + `
+	 WHERE external_id = ANY($1)
+`
+
+// recordUptime starts or stops the uptime clock for the analysis when it moves
+// into or out of a billable state. Called by transition with the lock on the
+// analysis held, which logs any error rather than failing the transition.
+func (i *Internal) recordUptime(externalID string, from, to AnalysisState) error {
+	switch {
+	case !from.isBillable() && to.isBillable():
+		if _, err := i.db.Exec(startUptimeSQL, externalID); err != nil {
+			return errors.Wrapf(err, "error starting the uptime clock for analysis %s", externalID)
+		}
+	case from.isBillable() && !to.isBillable():
+		if _, err := i.db.Exec(stopUptimeSQL, externalID); err != nil {
+			return errors.Wrapf(err, "error stopping the uptime clock for analysis %s", externalID)
+		}
+	}
+	return nil
+}
+
+// getUptime returns the uptime of the analysis. A nil record is returned if
+// the analysis has never been in a billable state.
+func (i *Internal) getUptime(externalID string) (*AnalysisUptime, error) {
+	uptime := &AnalysisUptime{}
+	err := i.db.QueryRowx(getUptimeSQL, externalID).StructScan(uptime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the uptime of analysis %s", externalID)
+	}
+	return uptime, nil
+}
+
+// getUptimes returns the uptimes of the analyses, keyed by external ID.
+func (i *Internal) getUptimes(externalIDs []string) (map[string]*AnalysisUptime, error) {
+	retval := map[string]*AnalysisUptime{}
+
+	if len(externalIDs) == 0 {
+		return retval, nil
+	}
+
+	rows, err := i.db.Queryx(getUptimesSQL, pq.Array(externalIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "error looking up analysis uptimes")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		uptime := &AnalysisUptime{}
+		if err = rows.StructScan(uptime); err != nil {
+			return nil, errors.Wrap(err, "error reading analysis uptime")
+		}
+		retval[uptime.ExternalID] = uptime
+	}
+
+	return retval, rows.Err()
+}
+
+// addUptimes fills in the uptime of each of the Deployments in the listing.
+// Errors are logged rather than returned so that the listing still works
+// without them.
+func (i *Internal) addUptimes(deployments []DeploymentInfo) {
+	externalIDs := []string{}
+	for _, d := range deployments {
+		if d.ExternalID != "" {
+			externalIDs = append(externalIDs, d.ExternalID)
+		}
+	}
+
+	uptimes, err := i.getUptimes(externalIDs)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for idx := range deployments {
+		if uptime, ok := uptimes[deployments[idx].ExternalID]; ok {
+			deployments[idx].BillableSeconds = &uptime.BillableSeconds
+		}
+	}
+}
+
+func (i *Internal) uptimeResponse(c echo.Context, analysisID, externalID string) error {
+	uptime, err := i.getUptime(externalID)
+	if err != nil {
+		return err
+	}
+
+	if uptime == nil {
+		uptime = &AnalysisUptime{ExternalID: externalID}
+	}
+
+	return c.JSON(http.StatusOK, &AnalysisUptimeResponse{
+		AnalysisID:      analysisID,
+		ExternalID:      externalID,
+		BillableSeconds: uptime.BillableSeconds,
+		Billing:         uptime.Billing(),
+		RunningSince:    uptime.RunningSince,
+	})
+}
+
+// GetUptimeHandler returns the accumulated billable runtime of the analysis
+// for the user.
+func (i *Internal) GetUptimeHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user is not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if len(externalIDs) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
+	}
+
+	return i.uptimeResponse(c, analysisID, externalIDs[0])
+}
+
+// AdminGetUptimeHandler returns the accumulated billable runtime of the
+// analysis without requiring user information.
+func (i *Internal) AdminGetUptimeHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	return i.uptimeResponse(c, analysisID, externalID)
+}
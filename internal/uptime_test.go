@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordUptime(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectExec("INSERT INTO vice_analysis_uptime").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(internal.recordUptime("e1", ProvisioningState, RunningState))
+
+	// Moving between billable states doesn't touch the clock.
+	assert.NoError(internal.recordUptime("e1", RunningState, SavingState))
+
+	mock.ExpectExec("UPDATE vice_analysis_uptime").
+		WithArgs("e1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	assert.NoError(internal.recordUptime("e1", RunningState, PausedState))
+
+	// Neither does moving between states that aren't billable.
+	assert.NoError(internal.recordUptime("e1", PausedState, TerminatingState))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestTransitionUptimeFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+	publisher := &recordingPublisher{}
+	internal.statusPublisher = publisher
+
+	// The transition still happens if the uptime clock can't be started.
+	expectStateChange(mock, "e1", ProvisioningState, RunningState)
+	mock.ExpectExec("INSERT INTO vice_analysis_uptime").
+		WithArgs("e1").
+		WillReturnError(errors.New("connection reset"))
+
+	assert.NoError(internal.transition("e1", RunningState, "running"))
+	assert.Equal([]string{"Running"}, publisher.published)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAddUptimes(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, mock := setupInternal(t, nil)
+
+	mock.ExpectQuery("SELECT external_id, billable_seconds").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "billable_seconds", "running_since"}).
+			AddRow("e1", 3600, time.Now()))
+
+	deployments := []DeploymentInfo{
+		{MetaInfo: MetaInfo{ExternalID: "e1"}},
+		{MetaInfo: MetaInfo{ExternalID: "e2"}},
+	}
+	internal.addUptimes(deployments)
+
+	assert.Equal(int64(3600), *deployments[0].BillableSeconds)
+	assert.Nil(deployments[1].BillableSeconds)
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,480 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// Usage report periods.
+const (
+	ReportWeekly  = "weekly"
+	ReportMonthly = "monthly"
+)
+
+// Usage report delivery methods.
+const (
+	// DeliverNotification sends the report to each recipient through the
+	// notification agent.
+	DeliverNotification = "notification"
+
+	// DeliverObjectStorage uploads the report as a JSON document to object
+	// storage.
+	DeliverObjectStorage = "object_storage"
+)
+
+const (
+	usageReportTopApps = 10
+
+	// usageReportCheckInterval is how often the scheduler checks whether a
+	// report is due.
+	usageReportCheckInterval = time.Hour
+
+	// usageReportRequestTimeout is how long a single delivery is given.
+	usageReportRequestTimeout = 30 * time.Second
+)
+
+// UsageReportGroup is a set of recipients that get the same usage report on
+// the same schedule.
+type UsageReportGroup struct {
+	Name           string            `mapstructure:"name"`
+	Period         string            `mapstructure:"period"`
+	Delivery       string            `mapstructure:"delivery"`
+	Recipients     []string          `mapstructure:"recipients"`
+	StorageURL     string            `mapstructure:"storage_url"`
+	StorageHeaders map[string]string `mapstructure:"storage_headers"`
+}
+
+// ValidateUsageReportGroups returns an error if any of the report groups
+// can't be delivered.
+func ValidateUsageReportGroups(groups []UsageReportGroup, notificationURL string) error {
+	problems := []string{}
+	seen := map[string]bool{}
+
+	for _, group := range groups {
+		if group.Name == "" {
+			problems = append(problems, "a report group has no name")
+		}
+		if seen[group.Name] {
+			problems = append(problems, fmt.Sprintf("report group %s is listed more than once", group.Name))
+		}
+		seen[group.Name] = true
+
+		switch group.Period {
+		case ReportWeekly, ReportMonthly:
+		default:
+			problems = append(problems, fmt.Sprintf("report group %s has unsupported period %q", group.Name, group.Period))
+		}
+
+		switch group.Delivery {
+		case DeliverNotification:
+			if len(group.Recipients) == 0 {
+				problems = append(problems, fmt.Sprintf("report group %s has no recipients", group.Name))
+			}
+			if notificationURL == "" {
+				problems = append(problems, fmt.Sprintf("report group %s needs the notification agent URL", group.Name))
+			}
+		case DeliverObjectStorage:
+			if group.StorageURL == "" {
+				problems = append(problems, fmt.Sprintf("report group %s has no storage_url", group.Name))
+			}
+		default:
+			problems = append(problems, fmt.Sprintf("report group %s has unsupported delivery %q", group.Name, group.Delivery))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid usage reports: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// usageReportPeriod returns the start and end of the most recent complete
+// period before now, in UTC. Weeks start on Monday.
+func usageReportPeriod(period string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	if period == ReportMonthly {
+		end := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return end.AddDate(0, -1, 0), end
+	}
+
+	daysSinceMonday := (int(today.Weekday()) + 6) % 7
+	end := today.AddDate(0, 0, -daysSinceMonday)
+	return end.AddDate(0, 0, -7), end
+}
+
+// AppUsage is the number of times an app was launched.
+type AppUsage struct {
+	AppID    string `json:"appID" db:"app_id"`
+	AppName  string `json:"appName" db:"app_name"`
+	Launches int    `json:"launches" db:"launches"`
+}
+
+// UsageReport summarizes VICE usage over a period.
+type UsageReport struct {
+	Group       string         `json:"group,omitempty"`
+	Period      string         `json:"period"`
+	Start       time.Time      `json:"start"`
+	End         time.Time      `json:"end"`
+	Launches    int            `json:"launches"`
+	UniqueUsers int            `json:"uniqueUsers"`
+	TopApps     []AppUsage     `json:"topApps"`
+	UptimeHours float64        `json:"uptimeHours"`
+	Failures    map[string]int `json:"failures"`
+}
+
+// The reports only cover VICE analyses launched during the period.
+const interactiveJobsInPeriod = `
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN job_types t ON s.job_type_id = t.id
+	 WHERE t.name = 'Interactive'
+	   AND j.start_date >= $1
+	   AND j.start_date < $2
+`
+
+const usageReportTotalsSQL = `
+	SELECT count(*) AS launches,
+	       count(DISTINCT j.user_id) AS unique_users
+` + interactiveJobsInPeriod
+
+const usageReportTopAppsSQL = `
+	SELECT COALESCE(j.app_id, '') AS app_id,
+	       COALESCE(j.app_name, '') AS app_name,
+	       count(*) AS launches
+` + interactiveJobsInPeriod + `
+	 GROUP BY j.app_id, j.app_name
+	 ORDER BY launches DESC, app_name
+	 LIMIT $3
+`
+
+const usageReportUptimeSQL = `
+	SELECT COALESCE(sum(u.billable_seconds + COALESCE(EXTRACT(EPOCH FROM now() - u.running_since)::bigint, 0)), 0)
+	  FROM vice_analysis_uptime u
+	  JOIN job_steps s ON s.external_id = u.external_id
+	  JOIN jobs j ON s.job_id = j.id
+	  JOIN job_types t ON s.job_type_id = t.id
+	 WHERE t.name = 'Interactive'
+	   AND j.start_date >= $1
+	   AND j.start_date < $2
+`
+
+// Analyses that didn't finish successfully are grouped by the last state
+// they reached, falling back to the job status for analyses launched before
+// states were recorded.
+const usageReportFailuresSQL = `
+	SELECT COALESCE(st.state, j.status) AS category,
+	       count(*) AS analyses
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN job_types t ON s.job_type_id = t.id
+	  LEFT JOIN vice_analysis_states st ON st.external_id = s.external_id
+	 WHERE t.name = 'Interactive'
+	   AND j.start_date >= $1
+	   AND j.start_date < $2
+	   AND j.status IN ('Failed', 'Canceled')
+	 GROUP BY category
+`
+
+// composeUsageReport builds the usage report for the period from the
+// database.
+func (i *Internal) composeUsageReport(period string, start, end time.Time) (*UsageReport, error) {
+	report := &UsageReport{
+		Period:   period,
+		Start:    start,
+		End:      end,
+		TopApps:  []AppUsage{},
+		Failures: map[string]int{},
+	}
+
+	if err := i.db.QueryRow(usageReportTotalsSQL, start, end).Scan(&report.Launches, &report.UniqueUsers); err != nil {
+		return nil, errors.Wrap(err, "error counting launches for the usage report")
+	}
+
+	if err := i.db.Select(&report.TopApps, usageReportTopAppsSQL, start, end, usageReportTopApps); err != nil {
+		return nil, errors.Wrap(err, "error looking up the top apps for the usage report")
+	}
+
+	var uptimeSeconds int64
+	if err := i.db.QueryRow(usageReportUptimeSQL, start, end).Scan(&uptimeSeconds); err != nil {
+		return nil, errors.Wrap(err, "error adding up uptime for the usage report")
+	}
+	report.UptimeHours = float64(uptimeSeconds) / 3600
+
+	rows, err := i.db.Query(usageReportFailuresSQL, start, end)
+	if err != nil {
+		return nil, errors.Wrap(err, "error counting failures for the usage report")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			category string
+			count    int
+		)
+		if err = rows.Scan(&category, &count); err != nil {
+			return nil, errors.Wrap(err, "error reading failures for the usage report")
+		}
+		report.Failures[category] = count
+	}
+
+	return report, rows.Err()
+}
+
+// usageReportSummary is the plain-text version of the report used as the
+// notification message.
+func usageReportSummary(report *UsageReport) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "VICE usage from %s to %s\n\n", report.Start.Format("2006-01-02"), report.End.Format("2006-01-02"))
+	fmt.Fprintf(&b, "Launches: %d\n", report.Launches)
+	fmt.Fprintf(&b, "Unique users: %d\n", report.UniqueUsers)
+	fmt.Fprintf(&b, "Uptime hours: %.1f\n", report.UptimeHours)
+
+	if len(report.TopApps) > 0 {
+		b.WriteString("\nTop apps:\n")
+		for _, app := range report.TopApps {
+			fmt.Fprintf(&b, "  %s: %d\n", app.AppName, app.Launches)
+		}
+	}
+
+	if len(report.Failures) > 0 {
+		categories := []string{}
+		for category := range report.Failures {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+
+		b.WriteString("\nUnsuccessful analyses:\n")
+		for _, category := range categories {
+			fmt.Fprintf(&b, "  %s: %d\n", category, report.Failures[category])
+		}
+	}
+
+	return b.String()
+}
+
+// usageReportNotification is the request body sent to the notification agent.
+type usageReportNotification struct {
+	Type          string       `json:"type"`
+	User          string       `json:"user"`
+	Subject       string       `json:"subject"`
+	Message       string       `json:"message"`
+	Email         bool         `json:"email"`
+	EmailTemplate string       `json:"email_template"`
+	Payload       *UsageReport `json:"payload"`
+}
+
+func postReport(method, url string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: usageReportRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", method, url, resp.Status)
+	}
+
+	return nil
+}
+
+// usageReportRecipients returns the recipients the group's reports are
+// tracked for. Uploads to object storage have a single recipient, the empty
+// string.
+func usageReportRecipients(group *UsageReportGroup) []string {
+	if group.Delivery == DeliverNotification {
+		return group.Recipients
+	}
+	return []string{""}
+}
+
+// deliverUsageReport sends the report to one of the group's recipients.
+func (i *Internal) deliverUsageReport(group *UsageReportGroup, recipient string, report *UsageReport) error {
+	switch group.Delivery {
+	case DeliverNotification:
+		notification := &usageReportNotification{
+			Type:          "usage_report",
+			User:          recipient,
+			Subject:       fmt.Sprintf("VICE %s usage report for %s", group.Period, report.Start.Format("2006-01-02")),
+			Message:       usageReportSummary(report),
+			Email:         true,
+			EmailTemplate: "usage_report",
+			Payload:       report,
+		}
+		url := strings.TrimSuffix(i.NotificationAgentURL, "/") + "/notification"
+		if err := postReport(http.MethodPost, url, nil, notification); err != nil {
+			return errors.Wrapf(err, "error sending the usage report to %s", recipient)
+		}
+
+	case DeliverObjectStorage:
+		url := fmt.Sprintf("%s/%s/%s-%s.json",
+			strings.TrimSuffix(group.StorageURL, "/"),
+			group.Name,
+			group.Period,
+			report.Start.Format("2006-01-02"),
+		)
+		if err := postReport(http.MethodPut, url, group.StorageHeaders, report); err != nil {
+			return errors.Wrapf(err, "error uploading the usage report for %s", group.Name)
+		}
+
+	default:
+		return fmt.Errorf("unsupported delivery %s", group.Delivery)
+	}
+
+	return nil
+}
+
+// Each report is claimed for each recipient by inserting a row before it's
+// sent, so that it only goes out once no matter how many app-exposer replicas
+// are running or how often they restart. A row with an empty recipient covers
+// the whole group.
+const claimUsageReportSQL = `
+	INSERT INTO vice_usage_reports (group_name, period_start, recipient, sent_at)
+	SELECT $1, $2, $3, now()
+	 WHERE NOT EXISTS (
+	       SELECT 1
+	         FROM vice_usage_reports
+	        WHERE group_name = $1
+	          AND period_start = $2
+	          AND recipient = ''
+	 )
+	ON CONFLICT (group_name, period_start, recipient) DO NOTHING
+`
+
+const releaseUsageReportSQL = `
+	DELETE FROM vice_usage_reports
+	 WHERE group_name = $1
+	   AND period_start = $2
+	   AND recipient = $3
+`
+
+// claimUsageReport returns true if the report for the period hasn't been sent
+// to the recipient yet, in which case it's now up to the caller to send it.
+func (i *Internal) claimUsageReport(group *UsageReportGroup, start time.Time, recipient string) (bool, error) {
+	result, err := i.db.Exec(claimUsageReportSQL, group.Name, start, recipient)
+	if err != nil {
+		return false, errors.Wrapf(err, "error claiming the usage report for %s", group.Name)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "error claiming the usage report for %s", group.Name)
+	}
+
+	return n > 0, nil
+}
+
+// releaseUsageReport releases the claim on the report for the recipient so
+// that it's tried again later.
+func (i *Internal) releaseUsageReport(group *UsageReportGroup, start time.Time, recipient string) {
+	if _, err := i.db.Exec(releaseUsageReportSQL, group.Name, start, recipient); err != nil {
+		log.Error(errors.Wrapf(err, "error releasing the usage report for %s", group.Name))
+	}
+}
+
+// sendDueUsageReports sends the reports for the most recent complete period
+// of each group to the recipients that haven't gotten them yet.
+func (i *Internal) sendDueUsageReports(now time.Time) {
+	for idx := range i.UsageReportGroups {
+		group := &i.UsageReportGroups[idx]
+		start, end := usageReportPeriod(group.Period, now)
+
+		// The report is only composed once it's known to be needed.
+		var report *UsageReport
+
+		for _, recipient := range usageReportRecipients(group) {
+			claimed, err := i.claimUsageReport(group, start, recipient)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if !claimed {
+				continue
+			}
+
+			if report == nil {
+				if report, err = i.composeUsageReport(group.Period, start, end); err != nil {
+					log.Error(err)
+					i.releaseUsageReport(group, start, recipient)
+					break
+				}
+				report.Group = group.Name
+			}
+
+			if err = i.deliverUsageReport(group, recipient, report); err != nil {
+				log.Error(err)
+				i.releaseUsageReport(group, start, recipient)
+				continue
+			}
+
+			log.Infof("sent the %s usage report for %s starting %s", group.Period, group.Name, start.Format("2006-01-02"))
+		}
+	}
+}
+
+// StartUsageReports fires up a goroutine that sends the usage reports as they
+// come due. It does nothing if no report groups are configured.
+func (i *Internal) StartUsageReports() {
+	if len(i.UsageReportGroups) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(usageReportCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			i.sendDueUsageReports(time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// AdminUsageReportHandler returns the usage report for the most recent
+// complete period without sending it. The period query parameter is weekly
+// or monthly and defaults to weekly.
+func (i *Internal) AdminUsageReportHandler(c echo.Context) error {
+	period := c.QueryParam("period")
+	if period == "" {
+		period = ReportWeekly
+	}
+
+	if period != ReportWeekly && period != ReportMonthly {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported period %s", period))
+	}
+
+	start, end := usageReportPeriod(period, time.Now())
+
+	report, err := i.composeUsageReport(period, start, end)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
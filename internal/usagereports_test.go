@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestUsageReportPeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	// Wednesday.
+	now := time.Date(2020, 3, 11, 15, 4, 5, 0, time.UTC)
+
+	start, end := usageReportPeriod(ReportWeekly, now)
+	assert.Equal(time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(time.Date(2020, 3, 9, 0, 0, 0, 0, time.UTC), end)
+
+	start, end = usageReportPeriod(ReportMonthly, now)
+	assert.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), end)
+
+	// On a Monday the week that just ended is reported.
+	start, _ = usageReportPeriod(ReportWeekly, time.Date(2020, 3, 9, 0, 30, 0, 0, time.UTC))
+	assert.Equal(time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC), start)
+}
+
+func TestValidateUsageReportGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateUsageReportGroups(nil, ""))
+	assert.NoError(ValidateUsageReportGroups([]UsageReportGroup{
+		{Name: "ops", Period: ReportWeekly, Delivery: DeliverNotification, Recipients: []string{"alice"}},
+		{Name: "archive", Period: ReportMonthly, Delivery: DeliverObjectStorage, StorageURL: "https://s3.example.org/reports"},
+	}, "http://notification-agent"))
+
+	assert.Error(ValidateUsageReportGroups([]UsageReportGroup{
+		{Name: "ops", Period: "daily", Delivery: DeliverObjectStorage, StorageURL: "https://s3.example.org/reports"},
+	}, ""))
+	assert.Error(ValidateUsageReportGroups([]UsageReportGroup{
+		{Name: "ops", Period: ReportWeekly, Delivery: DeliverNotification},
+	}, "http://notification-agent"))
+	assert.Error(ValidateUsageReportGroups([]UsageReportGroup{
+		{Name: "ops", Period: ReportWeekly, Delivery: DeliverObjectStorage},
+	}, ""))
+}
+
+func expectUsageReportQueries(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT count").
+		WillReturnRows(sqlmock.NewRows([]string{"launches", "unique_users"}).AddRow(12, 4))
+	mock.ExpectQuery("SELECT COALESCE\\(j.app_id").
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "app_name", "launches"}).
+			AddRow("a1", "JupyterLab", 9).
+			AddRow("a2", "RStudio", 3))
+	mock.ExpectQuery("FROM vice_analysis_uptime").
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(27000))
+	mock.ExpectQuery("AS category").
+		WillReturnRows(sqlmock.NewRows([]string{"category", "analyses"}).AddRow("Failed", 2))
+}
+
+func TestComposeUsageReport(t *testing.T) {
+	assert := assert.New(t)
+	i, mock := setupInternal(t, []runtime.Object{})
+
+	start, end := usageReportPeriod(ReportWeekly, time.Now())
+	expectUsageReportQueries(mock)
+
+	report, err := i.composeUsageReport(ReportWeekly, start, end)
+	assert.NoError(err)
+	assert.Equal(12, report.Launches)
+	assert.Equal(4, report.UniqueUsers)
+	assert.Equal([]AppUsage{{"a1", "JupyterLab", 9}, {"a2", "RStudio", 3}}, report.TopApps)
+	assert.Equal(7.5, report.UptimeHours)
+	assert.Equal(map[string]int{"Failed": 2}, report.Failures)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestSendDueUsageReports(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		uploadedPath string
+		uploaded     UsageReport
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadedPath = r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &uploaded)
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.UsageReportGroups = []UsageReportGroup{
+		{Name: "archive", Period: ReportWeekly, Delivery: DeliverObjectStorage, StorageURL: server.URL},
+		{Name: "ops", Period: ReportWeekly, Delivery: DeliverObjectStorage, StorageURL: server.URL},
+	}
+
+	now := time.Date(2020, 3, 11, 15, 4, 5, 0, time.UTC)
+	start := time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec("INSERT INTO vice_usage_reports").
+		WithArgs("archive", start, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectUsageReportQueries(mock)
+
+	// The ops report has already been sent.
+	mock.ExpectExec("INSERT INTO vice_usage_reports").
+		WithArgs("ops", start, "").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	i.sendDueUsageReports(now)
+
+	assert.NoError(mock.ExpectationsWereMet())
+	assert.Equal("/archive/weekly-2020-03-02.json", uploadedPath)
+	assert.Equal("archive", uploaded.Group)
+	assert.Equal(12, uploaded.Launches)
+}
+
+func TestSendDueUsageReportsReleasesFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.UsageReportGroups = []UsageReportGroup{
+		{Name: "archive", Period: ReportMonthly, Delivery: DeliverObjectStorage, StorageURL: server.URL},
+	}
+
+	start := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec("INSERT INTO vice_usage_reports").
+		WithArgs("archive", start, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectUsageReportQueries(mock)
+	mock.ExpectExec("DELETE FROM vice_usage_reports").
+		WithArgs("archive", start, "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	i.sendDueUsageReports(time.Date(2020, 3, 11, 15, 4, 5, 0, time.UTC))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSendDueUsageReportsPerRecipient(t *testing.T) {
+	assert := assert.New(t)
+
+	users := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/notification", r.URL.Path)
+		notification := &usageReportNotification{}
+		json.NewDecoder(r.Body).Decode(notification)
+		users = append(users, notification.User)
+		if notification.User == "bob" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	i, mock := setupInternal(t, []runtime.Object{})
+	i.NotificationAgentURL = server.URL
+	i.UsageReportGroups = []UsageReportGroup{
+		{Name: "ops", Period: ReportWeekly, Delivery: DeliverNotification, Recipients: []string{"alice", "bob", "carol"}},
+	}
+
+	start := time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	// Alice already got the report, bob's delivery fails, and carol gets it.
+	mock.ExpectExec("INSERT INTO vice_usage_reports").
+		WithArgs("ops", start, "alice").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO vice_usage_reports").
+		WithArgs("ops", start, "bob").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectUsageReportQueries(mock)
+	mock.ExpectExec("DELETE FROM vice_usage_reports").
+		WithArgs("ops", start, "bob").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO vice_usage_reports").
+		WithArgs("ops", start, "carol").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	i.sendDueUsageReports(time.Date(2020, 3, 11, 15, 4, 5, 0, time.UTC))
+
+	assert.Equal([]string{"bob", "carol"}, users)
+	assert.NoError(mock.ExpectationsWereMet())
+}
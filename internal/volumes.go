@@ -134,8 +134,9 @@ func (i *Internal) getPersistentVolume(job *model.Job) (*apiv1.PersistentVolume,
 
 		volume := &apiv1.PersistentVolume{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:   i.getCSIVolumeName(job),
-				Labels: volumeLabels,
+				Name:        i.getCSIVolumeName(job),
+				Labels:      volumeLabels,
+				Annotations: i.annotationsFromJob(job),
 			},
 			Spec: apiv1.PersistentVolumeSpec{
 				Capacity: apiv1.ResourceList{
@@ -181,8 +182,9 @@ func (i *Internal) getPersistentVolumeClaim(job *model.Job) (*apiv1.PersistentVo
 
 		volumeClaim := &apiv1.PersistentVolumeClaim{
 			ObjectMeta: metav1.ObjectMeta{
-				Name:   i.getCSIVolumeClaimName(job),
-				Labels: labels,
+				Name:        i.getCSIVolumeClaimName(job),
+				Labels:      labels,
+				Annotations: i.annotationsFromJob(job),
 			},
 			Spec: apiv1.PersistentVolumeClaimSpec{
 				AccessModes: []apiv1.PersistentVolumeAccessMode{
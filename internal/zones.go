@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/pkg/errors"
+	"gopkg.in/cyverse-de/model.v5"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultZoneTopologyKey = "topology.kubernetes.io/zone"
+
+// ZoneConfig turns on zone-aware scheduling for clusters that span
+// availability zones. Analysis pods are pinned to the zones where their
+// volumes can be attached and where nodes that can run them exist.
+type ZoneConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	TopologyKey string `mapstructure:"topology_key"`
+}
+
+// topologyKey returns the node label that zones are read from.
+func (z *ZoneConfig) topologyKey() string {
+	if z.TopologyKey == "" {
+		return defaultZoneTopologyKey
+	}
+	return z.TopologyKey
+}
+
+// zoneSet is a set of zone names. A nil zoneSet places no constraint on the
+// zone.
+type zoneSet map[string]bool
+
+func (z zoneSet) add(zones ...string) zoneSet {
+	if z == nil {
+		z = zoneSet{}
+	}
+	for _, zone := range zones {
+		z[zone] = true
+	}
+	return z
+}
+
+func (z zoneSet) sorted() []string {
+	zones := []string{}
+	for zone := range z {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// topologyZones returns the zones named for the key in the node selector
+// terms, or nil if none of the terms constrain the key.
+func topologyZones(terms []apiv1.NodeSelectorTerm, key string) zoneSet {
+	var zones zoneSet
+	for _, term := range terms {
+		for _, req := range term.MatchExpressions {
+			if req.Key == key && req.Operator == apiv1.NodeSelectorOpIn {
+				zones = zones.add(req.Values...)
+			}
+		}
+	}
+	return zones
+}
+
+// nodeMatches returns true if the node satisfies the pod's node selector and
+// the In requirements of its required node affinity. The node affinity is
+// satisfied if any of its terms is, since they're ORed.
+func nodeMatches(node *apiv1.Node, spec *apiv1.PodSpec) bool {
+	for k, v := range spec.NodeSelector {
+		if node.Labels[k] != v {
+			return false
+		}
+	}
+
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil || spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+
+	terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) == 0 {
+		return true
+	}
+
+	for idx := range terms {
+		if nodeMatchesTerm(node, &terms[idx]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nodeMatchesTerm returns true if the node satisfies all of the In
+// requirements of the node selector term.
+func nodeMatchesTerm(node *apiv1.Node, term *apiv1.NodeSelectorTerm) bool {
+	for _, req := range term.MatchExpressions {
+		if req.Operator != apiv1.NodeSelectorOpIn {
+			continue
+		}
+		found := false
+		for _, v := range req.Values {
+			if node.Labels[req.Key] == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// computeZones returns the zones of the nodes that can run the analysis,
+// taking the GPUs it needs into account. Nodes without a zone label don't
+// constrain the zone.
+func (i *Internal) computeZones(job *model.Job, spec *apiv1.PodSpec) (zoneSet, error) {
+	key := i.Zones.topologyKey()
+
+	nodes, err := i.clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing nodes")
+	}
+
+	gpuResource, gpuCount := gpuRequest(job)
+
+	zones := zoneSet{}
+	for idx := range nodes.Items {
+		node := &nodes.Items[idx]
+
+		if !nodeMatches(node, spec) {
+			continue
+		}
+
+		if gpuCount > 0 {
+			allocatable, ok := node.Status.Allocatable[gpuResource]
+			if !ok || allocatable.Value() < gpuCount {
+				continue
+			}
+		}
+
+		zone, ok := node.Labels[key]
+		if !ok {
+			return nil, nil
+		}
+		zones.add(zone)
+	}
+
+	return zones, nil
+}
+
+// storageZones returns the zones that the CSI driver's storage class can
+// provision volumes in, or nil if it isn't restricted.
+func (i *Internal) storageZones() (zoneSet, error) {
+	if !i.UseCSIDriver {
+		return nil, nil
+	}
+
+	sc, err := i.clientset.StorageV1().StorageClasses().Get(csiDriverStorageClassName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "error getting storage class %s", csiDriverStorageClassName)
+	}
+
+	var zones zoneSet
+	for _, term := range sc.AllowedTopologies {
+		for _, expr := range term.MatchLabelExpressions {
+			if expr.Key == i.Zones.topologyKey() {
+				zones = zones.add(expr.Values...)
+			}
+		}
+	}
+
+	return zones, nil
+}
+
+// claimZones returns the zones that the volume bound to the claim can be
+// attached in, or nil if it isn't restricted.
+func (i *Internal) claimZones(claimName string) (zoneSet, error) {
+	pvc, err := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).Get(claimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting persistent volume claim %s", claimName)
+	}
+
+	if pvc.Spec.VolumeName == "" {
+		return nil, nil
+	}
+
+	pv, err := i.clientset.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting persistent volume %s", pvc.Spec.VolumeName)
+	}
+
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil, nil
+	}
+
+	return topologyZones(pv.Spec.NodeAffinity.Required.NodeSelectorTerms, i.Zones.topologyKey()), nil
+}
+
+// applyZones restricts the analysis pod to the zones that satisfy its
+// compute, storage, and reference data constraints, or returns an
+// ErrorResponse describing the constraints when no zone satisfies all of them.
+func (i *Internal) applyZones(job *model.Job, spec *apiv1.PodSpec, datasets []ReferenceDataset) error {
+	if !i.Zones.Enabled {
+		return nil
+	}
+
+	constraints := map[string]zoneSet{}
+
+	zones, err := i.computeZones(job, spec)
+	if err != nil {
+		return err
+	}
+	if zones != nil {
+		constraints["compute"] = zones
+	}
+
+	if zones, err = i.storageZones(); err != nil {
+		return err
+	}
+	if zones != nil {
+		constraints["storage"] = zones
+	}
+
+	for _, d := range datasets {
+		if d.SourceType != ReferenceSourcePVC {
+			continue
+		}
+		if zones, err = i.claimZones(d.Source); err != nil {
+			return err
+		}
+		if zones != nil {
+			constraints[fmt.Sprintf("reference data %s", d.Name)] = zones
+		}
+	}
+
+	if len(constraints) == 0 {
+		return nil
+	}
+
+	// Intersect the zones allowed by each of the constraints.
+	var allowed zoneSet
+	for _, zones := range constraints {
+		if allowed == nil {
+			allowed = zoneSet{}.add(zones.sorted()...)
+			continue
+		}
+		for zone := range allowed {
+			if !zones[zone] {
+				delete(allowed, zone)
+			}
+		}
+	}
+
+	if len(allowed) == 0 {
+		names := []string{}
+		details := map[string]interface{}{}
+		for name, zones := range constraints {
+			names = append(names, name)
+			details[name] = zones.sorted()
+		}
+		sort.Strings(names)
+
+		return common.ErrorResponse{
+			ErrorCode: "ERR_NO_COMPATIBLE_ZONE",
+			Message:   fmt.Sprintf("no zone satisfies the %s constraints of analysis %s", strings.Join(names, ", "), job.InvocationID),
+			Details:   &details,
+		}
+	}
+
+	if spec.Affinity == nil {
+		spec.Affinity = &apiv1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &apiv1.NodeAffinity{}
+	}
+	if spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &apiv1.NodeSelector{
+			NodeSelectorTerms: []apiv1.NodeSelectorTerm{{}},
+		}
+	}
+
+	// Node selector terms are ORed, so the requirement is added to each of them.
+	terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for idx := range terms {
+		terms[idx].MatchExpressions = append(terms[idx].MatchExpressions, apiv1.NodeSelectorRequirement{
+			Key:      i.Zones.topologyKey(),
+			Operator: apiv1.NodeSelectorOpIn,
+			Values:   allowed.sorted(),
+		})
+	}
+
+	return nil
+}
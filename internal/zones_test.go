@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// zoneNode returns a VICE node in the zone with the given number of GPUs.
+func zoneNode(name, zone string, gpus int64) *apiv1.Node {
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				viceAffinityKey:        viceAffinityValue,
+				defaultZoneTopologyKey: zone,
+			},
+		},
+		Status: apiv1.NodeStatus{
+			Allocatable: apiv1.ResourceList{},
+		},
+	}
+	if gpus > 0 {
+		node.Labels[gpuAffinityKey] = gpuAffinityValue
+		node.Status.Allocatable[nvidiaGPUResource] = *resourcev1.NewQuantity(gpus, resourcev1.DecimalSI)
+	}
+	return node
+}
+
+// zoneObjects returns the nodes, storage class, and reference data volume of
+// a cluster spanning three zones.
+func zoneObjects() []runtime.Object {
+	return []runtime.Object{
+		zoneNode("node-a", "zone-a", 0),
+		zoneNode("node-b", "zone-b", 1),
+		zoneNode("node-c", "zone-c", 0),
+		&storagev1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: csiDriverStorageClassName},
+			Provisioner: csiDriverName,
+			AllowedTopologies: []apiv1.TopologySelectorTerm{
+				{
+					MatchLabelExpressions: []apiv1.TopologySelectorLabelRequirement{
+						{Key: defaultZoneTopologyKey, Values: []string{"zone-a", "zone-b"}},
+					},
+				},
+			},
+		},
+		&apiv1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "hg38-genome", Namespace: "vice-apps"},
+			Spec:       apiv1.PersistentVolumeClaimSpec{VolumeName: "pv-hg38"},
+		},
+		&apiv1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-hg38"},
+			Spec: apiv1.PersistentVolumeSpec{
+				NodeAffinity: &apiv1.VolumeNodeAffinity{
+					Required: &apiv1.NodeSelector{
+						NodeSelectorTerms: []apiv1.NodeSelectorTerm{
+							{
+								MatchExpressions: []apiv1.NodeSelectorRequirement{
+									{Key: defaultZoneTopologyKey, Operator: apiv1.NodeSelectorOpIn, Values: []string{"zone-a"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// zoneSpec returns a pod spec that requires VICE nodes, and GPU nodes if gpu
+// is true.
+func zoneSpec(gpu bool) *apiv1.PodSpec {
+	reqs := []apiv1.NodeSelectorRequirement{
+		{Key: viceAffinityKey, Operator: apiv1.NodeSelectorOpIn, Values: []string{viceAffinityValue}},
+	}
+	if gpu {
+		reqs = append(reqs, apiv1.NodeSelectorRequirement{
+			Key: gpuAffinityKey, Operator: apiv1.NodeSelectorOpIn, Values: []string{gpuAffinityValue},
+		})
+	}
+	return &apiv1.PodSpec{
+		Affinity: &apiv1.Affinity{
+			NodeAffinity: &apiv1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
+					NodeSelectorTerms: []apiv1.NodeSelectorTerm{{MatchExpressions: reqs}},
+				},
+			},
+		},
+	}
+}
+
+// zoneRequirement returns the zone requirement added to the pod spec, if any.
+func zoneRequirement(spec *apiv1.PodSpec) *apiv1.NodeSelectorRequirement {
+	terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for idx, req := range terms[0].MatchExpressions {
+		if req.Key == defaultZoneTopologyKey {
+			return &terms[0].MatchExpressions[idx]
+		}
+	}
+	return nil
+}
+
+func TestNodeMatchesTerms(t *testing.T) {
+	assert := assert.New(t)
+
+	inZone := func(zone string) apiv1.NodeSelectorTerm {
+		return apiv1.NodeSelectorTerm{
+			MatchExpressions: []apiv1.NodeSelectorRequirement{
+				{Key: viceAffinityKey, Operator: apiv1.NodeSelectorOpIn, Values: []string{viceAffinityValue}},
+				{Key: defaultZoneTopologyKey, Operator: apiv1.NodeSelectorOpIn, Values: []string{zone}},
+			},
+		}
+	}
+
+	spec := zoneSpec(false)
+	spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = []apiv1.NodeSelectorTerm{
+		inZone("zone-a"),
+		inZone("zone-b"),
+	}
+
+	// A node only has to satisfy one of the terms.
+	assert.True(nodeMatches(zoneNode("node-a", "zone-a", 0), spec))
+	assert.True(nodeMatches(zoneNode("node-b", "zone-b", 0), spec))
+	assert.False(nodeMatches(zoneNode("node-c", "zone-c", 0), spec))
+
+	// Every requirement in a term has to be satisfied.
+	node := zoneNode("node-d", "zone-a", 0)
+	delete(node.Labels, viceAffinityKey)
+	assert.False(nodeMatches(node, spec))
+}
+
+func TestApplyZones(t *testing.T) {
+	assert := assert.New(t)
+
+	internal, _ := setupInternal(t, zoneObjects())
+	internal.UseCSIDriver = true
+
+	// Nothing happens unless zones are enabled.
+	spec := zoneSpec(false)
+	assert.NoError(internal.applyZones(multiPortJob(8888), spec, nil))
+	assert.Nil(zoneRequirement(spec))
+
+	internal.Zones.Enabled = true
+
+	spec = zoneSpec(false)
+	assert.NoError(internal.applyZones(multiPortJob(8888), spec, nil))
+	assert.Equal([]string{"zone-a", "zone-b"}, zoneRequirement(spec).Values)
+
+	hg38 := []ReferenceDataset{{Name: "hg38", SourceType: ReferenceSourcePVC, Source: "hg38-genome"}}
+
+	spec = zoneSpec(false)
+	assert.NoError(internal.applyZones(multiPortJob(8888), spec, hg38))
+	assert.Equal([]string{"zone-a"}, zoneRequirement(spec).Values)
+
+	spec = zoneSpec(true)
+	assert.NoError(internal.applyZones(deviceJob("/dev/nvidia0"), spec, nil))
+	assert.Equal([]string{"zone-b"}, zoneRequirement(spec).Values)
+
+	// The only GPU node isn't in the zone the reference data lives in.
+	err := internal.applyZones(deviceJob("/dev/nvidia0"), zoneSpec(true), hg38)
+	assert.Error(err)
+	errResponse, ok := err.(common.ErrorResponse)
+	assert.True(ok)
+	assert.Equal("ERR_NO_COMPATIBLE_ZONE", errResponse.ErrorCode)
+	assert.Equal([]string{"zone-b"}, (*errResponse.Details)["compute"])
+	assert.Equal([]string{"zone-a"}, (*errResponse.Details)["reference data hg38"])
+
+	// No node has two GPUs.
+	err = internal.applyZones(deviceJob("/dev/nvidia0", "/dev/nvidia1"), zoneSpec(true), nil)
+	assert.Error(err)
+}
+
+func TestApplyZonesUnlabeledNodes(t *testing.T) {
+	node := zoneNode("node-a", "", 0)
+	delete(node.Labels, defaultZoneTopologyKey)
+
+	internal, _ := setupInternal(t, []runtime.Object{node})
+	internal.Zones.Enabled = true
+
+	spec := zoneSpec(false)
+	assert.NoError(t, internal.applyZones(multiPortJob(8888), spec, nil))
+	assert.Nil(t, zoneRequirement(spec))
+}
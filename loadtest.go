@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/cyverse-de/model.v5"
+)
+
+// LoadTestConfig contains the settings for a load test run. Load tests are
+// run against an ExposerApp that was created with a fake clientset, so no
+// objects are created in a real cluster. The database is still used, so load
+// tests are pointed at a database of their own, in which the user must exist.
+type LoadTestConfig struct {
+	Rate     int           // The number of iterations to start per second.
+	Duration time.Duration // How long to keep starting new iterations.
+	Username string        // The full username, including the suffix, to launch as.
+	UserID   string        // The UUID of the user to launch as.
+	Token    string        // The identity token sent with each request, if any.
+}
+
+// LatencySummary contains the latency distribution for a single operation
+// performed during a load test. Durations are reported in milliseconds.
+type LatencySummary struct {
+	Count  int     `json:"count"`
+	Errors int     `json:"errors"`
+	Min    float64 `json:"min_ms"`
+	Mean   float64 `json:"mean_ms"`
+	P50    float64 `json:"p50_ms"`
+	P90    float64 `json:"p90_ms"`
+	P99    float64 `json:"p99_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+// LoadTestReport contains the results of a load test run.
+type LoadTestReport struct {
+	Rate       int                        `json:"rate"`
+	Duration   string                     `json:"duration"`
+	Iterations int                        `json:"iterations"`
+	Operations map[string]*LatencySummary `json:"operations"`
+}
+
+// loadTester drives requests through an ExposerApp's router and records how
+// long each one took.
+type loadTester struct {
+	app    *ExposerApp
+	config *LoadTestConfig
+
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newLoadTester(app *ExposerApp, config *LoadTestConfig) *loadTester {
+	return &loadTester{
+		app:       app,
+		config:    config,
+		latencies: map[string][]time.Duration{},
+		errors:    map[string]int{},
+	}
+}
+
+// sameDatabase returns true if the database URIs name the same database on
+// the same server. URIs that can't be parsed are compared as they are.
+func sameDatabase(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	if errA != nil || errB != nil || ua.Host == "" || ub.Host == "" {
+		return a == b
+	}
+
+	hostPort := func(u *url.URL) string {
+		port := u.Port()
+		if port == "" {
+			port = "5432"
+		}
+		return strings.ToLower(u.Hostname()) + ":" + port
+	}
+
+	return hostPort(ua) == hostPort(ub) && strings.Trim(ua.Path, "/") == strings.Trim(ub.Path, "/")
+}
+
+// randomUUID returns a version 4 UUID string.
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// loadTestJob returns a minimal VICE job that can make it through the launch
+// handler.
+func loadTestJob(config *LoadTestConfig, invocationID string) *model.Job {
+	return &model.Job{
+		AppID:           "load-test-app",
+		AppName:         "load-test-app",
+		ExecutionTarget: "interapps",
+		InvocationID:    invocationID,
+		Name:            fmt.Sprintf("load-test-%s", invocationID),
+		OutputDir:       "/iplant/home/load-test/analyses",
+		Submitter:       config.Username,
+		UserID:          config.UserID,
+		Steps: []model.Step{
+			{
+				Component: model.StepComponent{
+					Container: model.Container{
+						Image: model.ContainerImage{
+							Name: "discoenv/load-test",
+							Tag:  "latest",
+						},
+						Ports: []model.Ports{
+							{ContainerPort: 8888},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// record stores the latency and result of a single operation.
+func (l *loadTester) record(op string, elapsed time.Duration, status int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.latencies[op] = append(l.latencies[op], elapsed)
+	if status < 200 || status > 399 {
+		l.errors[op]++
+	}
+}
+
+// do sends a request through the router and records its latency under op.
+func (l *loadTester) do(op, method, target string, body interface{}) int {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			log.Error(err)
+			l.record(op, 0, http.StatusInternalServerError)
+			return http.StatusInternalServerError
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader([]byte{})
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if l.config.Token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+l.config.Token)
+	}
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	l.app.router.ServeHTTP(w, req)
+	elapsed := time.Since(start)
+
+	l.record(op, elapsed, w.Code)
+	return w.Code
+}
+
+// iteration simulates a single user session: a launch, a user listing, an
+// admin listing, and an exit.
+func (l *loadTester) iteration() {
+	invocationID, err := randomUUID()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	l.do("launch", http.MethodPost, "/vice/launch", loadTestJob(l.config, invocationID))
+
+	q := url.Values{}
+	q.Set("user", l.config.Username)
+	l.do("listing", http.MethodGet, fmt.Sprintf("/vice/listing?%s", q.Encode()), nil)
+
+	l.do("admin-listing", http.MethodGet, "/vice/admin/listing", nil)
+
+	l.do("exit", http.MethodPost, fmt.Sprintf("/vice/%s/exit", invocationID), nil)
+}
+
+// Run starts config.Rate iterations per second for config.Duration and
+// returns a report once all of them have finished.
+func (l *loadTester) Run() *LoadTestReport {
+	var wg sync.WaitGroup
+
+	iterations := 0
+	ticker := time.NewTicker(time.Second / time.Duration(l.config.Rate))
+	defer ticker.Stop()
+
+	deadline := time.After(l.config.Duration)
+
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+			iterations++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.iteration()
+			}()
+		case <-deadline:
+			running = false
+		}
+	}
+
+	wg.Wait()
+
+	report := &LoadTestReport{
+		Rate:       l.config.Rate,
+		Duration:   l.config.Duration.String(),
+		Iterations: iterations,
+		Operations: map[string]*LatencySummary{},
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for op, latencies := range l.latencies {
+		report.Operations[op] = summarizeLatencies(latencies, l.errors[op])
+	}
+
+	return report
+}
+
+// percentile returns the value at percentile p (0-100) of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted))*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// summarizeLatencies computes the latency distribution for a set of samples.
+func summarizeLatencies(latencies []time.Duration, errors int) *LatencySummary {
+	summary := &LatencySummary{
+		Count:  len(latencies),
+		Errors: errors,
+	}
+
+	if len(latencies) == 0 {
+		return summary
+	}
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+
+	summary.Min = toMillis(sorted[0])
+	summary.Max = toMillis(sorted[len(sorted)-1])
+	summary.Mean = toMillis(total / time.Duration(len(sorted)))
+	summary.P50 = toMillis(percentile(sorted, 50))
+	summary.P90 = toMillis(percentile(sorted, 90))
+	summary.P99 = toMillis(percentile(sorted, 99))
+
+	return summary
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizeLatencies(t *testing.T) {
+	assert := assert.New(t)
+
+	latencies := []time.Duration{}
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	summary := summarizeLatencies(latencies, 3)
+	assert.Equal(100, summary.Count)
+	assert.Equal(3, summary.Errors)
+	assert.Equal(1.0, summary.Min)
+	assert.Equal(100.0, summary.Max)
+	assert.Equal(50.0, summary.P50)
+	assert.Equal(90.0, summary.P90)
+	assert.Equal(99.0, summary.P99)
+	assert.Equal(50.5, summary.Mean)
+}
+
+func TestSummarizeNoLatencies(t *testing.T) {
+	summary := summarizeLatencies([]time.Duration{}, 0)
+	assert.Equal(t, 0, summary.Count)
+	assert.Equal(t, 0.0, summary.P99)
+}
+
+func TestLoadTestJob(t *testing.T) {
+	assert := assert.New(t)
+
+	id, err := randomUUID()
+	assert.NoError(err)
+	assert.Len(id, 36)
+
+	job := loadTestJob(&LoadTestConfig{Username: "test@example.org", UserID: "u"}, id)
+	assert.Equal(id, job.InvocationID)
+	assert.Equal("interapps", job.ExecutionTarget)
+	assert.Equal(8888, job.Steps[0].Component.Container.Ports[0].ContainerPort)
+}
+
+func TestSameDatabase(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(sameDatabase("postgres://de:pw@db.example.org/de", "postgres://other:pw@DB.example.org:5432/de?sslmode=disable"))
+	assert.False(sameDatabase("postgres://de:pw@db.example.org/de", "postgres://de:pw@db.example.org/de_load_test"))
+	assert.False(sameDatabase("postgres://de:pw@db.example.org/de", "postgres://de:pw@localhost/de"))
+	assert.False(sameDatabase("postgres://de:pw@db.example.org:5433/de", "postgres://de:pw@db.example.org/de"))
+	assert.True(sameDatabase("host=db dbname=de", "host=db dbname=de"))
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
@@ -8,16 +10,22 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 
+	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/tracing"
 	"github.com/cyverse-de/configurate"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog" // pull in to set klog output to stderr
@@ -57,6 +65,11 @@ func main() {
 		checkResourceAccessService    = flag.String("--check-resource-access-service", "check-resource-access", "The name of the service that validates whether a user can access a resource")
 		userSuffix                    = flag.String("user-suffix", "@iplantcollaborative.org", "The user suffix for all users in the DE installation")
 		logLevel                      = flag.String("log-level", "warn", "One of trace, debug, info, warn, error, fatal, or panic.")
+		loadTest                      = flag.Bool("load-test", false, "Run a load test against a fake cluster and exit instead of serving requests")
+		loadTestRate                  = flag.Int("load-test-rate", 5, "(optional) The number of simulated launches/listings to start per second during a load test")
+		loadTestDuration              = flag.Duration("load-test-duration", 30*time.Second, "(optional) How long a load test should run")
+		loadTestUser                  = flag.String("load-test-user", "", "The user to simulate launches for during a load test. Must exist in the database.")
+		loadTestDB                    = flag.String("load-test-db", "", "The URI of the database to use during a load test. Must not be the db.uri database from the config.")
 	)
 
 	// if cluster is set, then
@@ -116,6 +129,22 @@ func main() {
 	}
 	log.Infof("Done reading config from %s", *configPath)
 
+	sampleRatio := 1.0
+	if cfg.IsSet("tracing.sample_ratio") {
+		sampleRatio = cfg.GetFloat64("tracing.sample_ratio")
+	}
+
+	shutdownTracing, err := tracing.Init(context.Background(), &tracing.Config{
+		Enabled:     cfg.GetBool("tracing.enabled"),
+		Endpoint:    cfg.GetString("tracing.endpoint"),
+		Insecure:    cfg.GetBool("tracing.insecure"),
+		SampleRatio: sampleRatio,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Make sure the db.uri URL is parseable
 	if _, err = url.Parse(cfg.GetString("db.uri")); err != nil {
 		log.Fatal(errors.Wrap(err, "Can't parse db.uri in the config file"))
@@ -128,8 +157,8 @@ func main() {
 
 	// Print error and exit if *kubeconfig is not empty and doesn't actually
 	// exist. If *kubeconfig is blank, then the app may be running inside the
-	// cluster, so let things proceed.
-	if *kubeconfig != "" {
+	// cluster, so let things proceed. Load tests don't talk to a cluster at all.
+	if *kubeconfig != "" && !*loadTest {
 		_, err = os.Stat(*kubeconfig)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -143,24 +172,36 @@ func main() {
 	log.Printf("listen port is set to %d\n", *listenPort)
 	log.Printf("kubeconfig is set to '%s', and may be blank", *kubeconfig)
 
-	var config *rest.Config
-	if *kubeconfig != "" {
-		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
-		if err != nil {
-			log.Fatal(errors.Wrapf(err, "error building config from flags using kubeconfig %s", *kubeconfig))
-		}
+	var (
+		clientset kubernetes.Interface
+		config    *rest.Config
+	)
+	if *loadTest {
+		clientset = fake.NewSimpleClientset()
 	} else {
-		// If the home directory doesn't exist and the user doesn't specify a path,
-		// then assume that we're running inside a cluster.
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			log.Fatal(errors.Wrapf(err, "error loading the config inside the cluster"))
+		if *kubeconfig != "" {
+			config, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+			if err != nil {
+				log.Fatal(errors.Wrapf(err, "error building config from flags using kubeconfig %s", *kubeconfig))
+			}
+		} else {
+			// If the home directory doesn't exist and the user doesn't specify a path,
+			// then assume that we're running inside a cluster.
+			config, err = rest.InClusterConfig()
+			if err != nil {
+				log.Fatal(errors.Wrapf(err, "error loading the config inside the cluster"))
+			}
 		}
-	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatal(errors.Wrap(err, "error creating clientset from config"))
+		// Calls to the k8s API get client spans. They aren't children of
+		// the spans for the requests that make them, since this version of
+		// client-go doesn't pass a context along with its requests.
+		config.WrapTransport = tracing.Transport
+
+		clientset, err = kubernetes.NewForConfig(config)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "error creating clientset from config"))
+		}
 	}
 
 	jobStatusURL := cfg.GetString("vice.job-status.base")
@@ -183,6 +224,16 @@ func main() {
 		permissionsURL = "http://permissions"
 	}
 
+	notificationAgentURL := cfg.GetString("notification_agent.base")
+	if notificationAgentURL == "" {
+		notificationAgentURL = "http://notification-agent"
+	}
+
+	dataInfoBaseURL := cfg.GetString("data_info.base")
+	if dataInfoBaseURL == "" {
+		dataInfoBaseURL = "http://data-info"
+	}
+
 	var proxyImage string
 	proxyTag := cfg.GetString("interapps.proxy.tag")
 	if proxyTag == "" {
@@ -192,14 +243,38 @@ func main() {
 	}
 
 	dbURI := cfg.GetString("db.uri")
+
+	// Load tests launch and exit analyses, which writes rows to the
+	// database, so they have to be pointed at a database of their own.
+	if *loadTest {
+		if *loadTestDB == "" {
+			log.Fatal("--load-test-db must be set when running a load test")
+		}
+		if sameDatabase(*loadTestDB, dbURI) {
+			log.Fatal("--load-test-db must not be the db.uri database from the config")
+		}
+		dbURI = *loadTestDB
+	}
+
 	db = sqlx.MustConnect("postgres", dbURI)
 
+	poolConfig := apps.PoolConfig{}
+	if err = cfg.UnmarshalKey("db.pool", &poolConfig); err != nil {
+		log.Fatal(err)
+	}
+	poolConfig.Configure(db)
+
+	lookupCacheConfig := apps.LookupCacheConfig{}
+	if err = cfg.UnmarshalKey("db.lookup_cache", &lookupCacheConfig); err != nil {
+		log.Fatal(err)
+	}
 	exposerInit := &ExposerAppInit{
 		Namespace:                     *namespace,
 		ViceNamespace:                 *viceNamespace,
 		PorklockImage:                 cfg.GetString("vice.file-transfers.image"),
 		PorklockTag:                   cfg.GetString("vice.file-transfers.tag"),
 		UseCSIDriver:                  cfg.GetBool("vice.use_csi_driver"),
+		ExposeExtraPorts:              cfg.GetBool("vice.expose_extra_ports"),
 		InputPathListIdentifier:       cfg.GetString("path_list.file_identifier"),
 		TicketInputPathListIdentifier: cfg.GetString("tickets_path_list.file_identifier"),
 		JobStatusURL:                  jobStatusURL,
@@ -216,14 +291,328 @@ func main() {
 		UserSuffix:                    *userSuffix,
 		MetadataBaseURL:               metadataBaseURL,
 		PermissionsURL:                permissionsURL,
+		PermissionsCacheTTL:           cfg.GetDuration("permissions.cache.ttl"),
+		PermissionsCacheMaxEntries:    cfg.GetInt("permissions.cache.max_entries"),
+		PermissionsInvalidationToken:  cfg.GetString("permissions.cache.invalidation_token"),
+		LookupCache:                   lookupCacheConfig,
+		NotificationAgentURL:          notificationAgentURL,
 		KeycloakBaseURL:               cfg.GetString("keycloak.base"),
 		KeycloakRealm:                 cfg.GetString("keycloak.realm"),
 		KeycloakClientID:              cfg.GetString("keycloak.client-id"),
 		KeycloakClientSecret:          cfg.GetString("keycloak.client-secret"),
+		ListingCacheTTL:               cfg.GetDuration("vice.listing_cache_ttl"),
+		IngressClass:                  cfg.GetString("vice.ingress.class"),
+		ExposureBackend:               cfg.GetString("vice.exposure.backend"),
+		TunnelClientImage:             cfg.GetString("vice.exposure.tunnel.client_image"),
+		TunnelGatewayURL:              cfg.GetString("vice.exposure.tunnel.gateway_url"),
+		IngressAnnotations:            cfg.GetStringMapString("vice.ingress.annotations"),
+		IngressTLS:                    cfg.GetBool("vice.ingress.tls"),
+		CertManagerIssuer:             cfg.GetString("vice.ingress.cert_manager.issuer"),
+		CertManagerIssuerKind:         cfg.GetString("vice.ingress.cert_manager.issuer_kind"),
+		IngressProxyReadTimeout:       cfg.GetInt("vice.ingress.proxy_read_timeout"),
+		IngressProxySendTimeout:       cfg.GetInt("vice.ingress.proxy_send_timeout"),
+		IngressWebSockets:             cfg.GetBool("vice.ingress.websockets"),
+		AppTLSModes:                   cfg.GetStringMapString("vice.ingress.app_tls"),
+		IngressClientCertSecret:       cfg.GetString("vice.ingress.client_cert_secret"),
+		DefaultLabels:                 cfg.GetStringMapString("vice.defaults.labels"),
+		DefaultAnnotations:            cfg.GetStringMapString("vice.defaults.annotations"),
+		LabelPrefix:                   cfg.GetString("vice.labels.prefix"),
+		MigrateLabelKeys:              cfg.GetBool("vice.labels.migrate"),
+		HeadlessServiceApps:           cfg.GetStringSlice("vice.headless_service_apps"),
+		ImagePullSecrets:              cfg.GetStringSlice("vice.image_pull_secrets.default"),
+		ToolImagePullSecrets:          cfg.GetStringMapStringSlice("vice.image_pull_secrets.images"),
+		PlanEnforcement:               cfg.GetBool("vice.plans.enforce"),
+		BlockedEnvironment:            cfg.GetStringSlice("vice.launch_environment.blocked"),
+		ResultManifests:               cfg.GetStringMapStringSlice("vice.result_manifests"),
+		RBACEnabled:                   cfg.GetBool("vice.rbac.enabled"),
+		RoleMembers:                   cfg.GetStringMapStringSlice("vice.rbac.roles"),
+		IdentityKey:                   cfg.GetString("vice.rbac.identity_key"),
+		ImageProbeNamespace:           cfg.GetString("vice.image_probes.namespace"),
+		ImageProbeTimeout:             cfg.GetDuration("vice.image_probes.timeout"),
+		ImageProbeEnforced:            cfg.GetBool("vice.image_probes.enforce"),
+		SaveAndExitTimeout:            cfg.GetDuration("vice.save_and_exit.timeout"),
+		NetworkPolicyEnabled:          cfg.GetBool("vice.network_policy.enabled"),
+		NetworkPolicyFromNamespaces:   cfg.GetStringSlice("vice.network_policy.ingress_namespaces"),
+		LifecycleEvents:               cfg.GetBool("vice.lifecycle_events.enabled"),
+		AsyncLaunches:                 cfg.GetBool("vice.async_launches.enabled"),
+		DataInfoBaseURL:               dataInfoBaseURL,
+	}
+
+	if err = cfg.UnmarshalKey("vice.network_policy.egress", &exposerInit.NetworkPolicyEgress); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.network_policy.egress in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.ingress.app_annotations", &exposerInit.AppIngressAnnotations); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.ingress.app_annotations in the config file"))
+	}
+
+	switch exposerInit.ExposureBackend {
+	case "", internal.ExposureIngress:
+	case internal.ExposureTunnel:
+		if exposerInit.TunnelClientImage == "" || exposerInit.TunnelGatewayURL == "" {
+			log.Fatal("vice.exposure.tunnel.client_image and vice.exposure.tunnel.gateway_url must be set to use tunnels")
+		}
+	default:
+		log.Fatalf("unsupported exposure backend %s", exposerInit.ExposureBackend)
+	}
+
+	if err = internal.ValidateRoleMembers(exposerInit.RoleMembers); err != nil {
+		log.Fatal(err)
+	}
+
+	if exposerInit.RBACEnabled && exposerInit.IdentityKey == "" {
+		log.Fatal("vice.rbac.identity_key must be set when vice.rbac.enabled is true")
+	}
+
+	if err = internal.ValidateAppTLSModes(exposerInit.AppTLSModes); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.port_protocols", &exposerInit.PortProtocols); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.port_protocols in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.defaults.tolerations", &exposerInit.DefaultTolerations); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.defaults.tolerations in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.scheduling.default", &exposerInit.Scheduling); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.scheduling.default in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.scheduling.apps", &exposerInit.AppScheduling); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.scheduling.apps in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.sidecars", &exposerInit.Sidecars); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.sidecars in the config file"))
+	}
+
+	if err = internal.ValidateSidecars(exposerInit.Sidecars); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.app_init_containers", &exposerInit.AppInitContainers); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.app_init_containers in the config file"))
+	}
+
+	if err = internal.ValidateAppInitContainers(exposerInit.AppInitContainers); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.usage_reports", &exposerInit.UsageReportGroups); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.usage_reports in the config file"))
+	}
+
+	if err = internal.ValidateUsageReportGroups(exposerInit.UsageReportGroups, exposerInit.NotificationAgentURL); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.launch_shaping", &exposerInit.LaunchShaping); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.launch_shaping in the config file"))
+	}
+
+	if err = internal.ValidateLaunchShaping(&exposerInit.LaunchShaping); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.subdomain_webhooks", &exposerInit.SubdomainWebhooks); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.subdomain_webhooks in the config file"))
+	}
+
+	if err = internal.ValidateSubdomainWebhooks(&exposerInit.SubdomainWebhooks); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.priority_classes", &exposerInit.PriorityClasses); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.priority_classes in the config file"))
+	}
+
+	if err = internal.ValidatePriorityClasses(&exposerInit.PriorityClasses); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.pod_security", &exposerInit.PodSecurity); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.pod_security in the config file"))
+	}
+
+	if err = internal.ValidatePodSecurity(&exposerInit.PodSecurity); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.zones", &exposerInit.Zones); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.zones in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.preemptible", &exposerInit.Preemptible); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.preemptible in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.proxy_watchdog", &exposerInit.ProxyWatchdog); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.proxy_watchdog in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.exec", &exposerInit.Exec); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.exec in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.audit", &exposerInit.AuditLog); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.audit in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.quotas", &exposerInit.Quotas); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.quotas in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.namespace_quotas", &exposerInit.NamespaceQuotas); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.namespace_quotas in the config file"))
+	}
+
+	if err = internal.ValidateNamespaceQuotas(&exposerInit.NamespaceQuotas); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = cfg.UnmarshalKey("vice.credential_rotation", &exposerInit.CredentialRotation); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.credential_rotation in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.time_limits", &exposerInit.TimeLimits); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.time_limits in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.idle_shutdown", &exposerInit.IdleShutdown); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.idle_shutdown in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.persistent_hostnames", &exposerInit.PersistentHostnames); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.persistent_hostnames in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.publication", &exposerInit.Publication); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.publication in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.image_prepull", &exposerInit.ImagePrepull); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.image_prepull in the config file"))
+	}
+
+	if err = cfg.UnmarshalKey("vice.launch_schedules", &exposerInit.LaunchSchedules); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.launch_schedules in the config file"))
+	}
+
+	if err = internal.ValidateDefaultMetadata(exposerInit.DefaultLabels, exposerInit.DefaultAnnotations); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = internal.ValidateLabelPrefix(exposerInit.LabelPrefix); err != nil {
+		log.Fatal(err)
+	}
+
+	statusTransport := internal.StatusTransportConfig{}
+	if err = cfg.UnmarshalKey("vice.status_updates", &statusTransport); err != nil {
+		log.Fatal(errors.Wrap(err, "error parsing vice.status_updates in the config file"))
+	}
+
+	if err = statusTransport.Validate(); err != nil {
+		log.Fatal(err)
 	}
 
 	app := NewExposerApp(exposerInit, *ingressClass, clientset)
+
+	var natsconn *natsClient
+	if natsURL := cfg.GetString("nats.url"); natsURL != "" {
+		if natsconn, err = newNATSClient(natsURL); err != nil {
+			log.Fatal(err)
+		}
+		defer natsconn.Close()
+	}
+
+	if statusTransport.RequestReply() {
+		if natsconn == nil {
+			log.Fatal("nats.url must be set to send status updates over NATS")
+		}
+		app.internal.SetStatusTransport(statusTransport.NewTransport(natsconn))
+	}
+
+	if cfg.GetBool("nats.requests.enabled") {
+		if natsconn == nil {
+			log.Fatal("nats.url must be set to serve requests over NATS")
+		}
+		if err = app.ServeRequests(natsconn, cfg.GetString("nats.requests.subject_prefix")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if config != nil {
+		app.internal.SetPodExecutor(internal.NewSPDYExecutor(config, clientset))
+
+		applier, err := internal.NewServerSideApplier(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.internal.SetObjectApplier(applier)
+	}
+
+	if *loadTest {
+		if *loadTestUser == "" {
+			log.Fatal("--load-test-user must be set when running a load test")
+		}
+		if *loadTestRate <= 0 {
+			log.Fatal("--load-test-rate must be greater than 0")
+		}
+
+		username := *loadTestUser
+		if !strings.HasSuffix(username, *userSuffix) {
+			username = fmt.Sprintf("%s%s", username, *userSuffix)
+		}
+
+		userID, err := apps.NewApps(db, *userSuffix).GetUserID(context.Background(), username)
+		if err != nil {
+			log.Fatal(errors.Wrapf(err, "error looking up the user ID for %s", username))
+		}
+
+		// The routes are only checked against the identity token when an
+		// identity key is configured, so there's only a token to send then.
+		var token string
+		if exposerInit.IdentityKey != "" {
+			token, err = app.internal.SignIdentityToken(username, time.Now().Add(*loadTestDuration+time.Hour))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		log.Infof("running a load test for %s at %d iterations per second", *loadTestDuration, *loadTestRate)
+		report := newLoadTester(app, &LoadTestConfig{
+			Rate:     *loadTestRate,
+			Duration: *loadTestDuration,
+			Username: username,
+			UserID:   userID,
+			Token:    token,
+		}).Run()
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Printf("listening on port %d", *listenPort)
 	app.internal.MonitorVICEEvents()
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(*listenPort)), app.router))
+	app.internal.MonitorBatchJobs()
+	app.internal.StartUsageReports()
+	app.internal.StartLaunchShaping()
+	app.internal.StartSubdomainWebhooks()
+	app.internal.StartPreemptionMonitor()
+	app.internal.StartProxyWatchdog()
+	app.internal.StartCredentialRotation()
+	app.internal.StartTimeLimitEnforcement()
+	app.internal.StartIdleShutdown()
+	app.internal.StartHostnameReleases()
+	app.internal.StartImagePrepulls()
+	app.internal.StartLaunchSchedules()
+	err = http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(*listenPort)), app.router)
+	shutdownTracing(context.Background())
+	log.Fatal(err)
 }
@@ -0,0 +1,53 @@
+BEGIN;
+
+ALTER TABLE plans
+    DROP COLUMN IF EXISTS max_cpu_cores,
+    DROP COLUMN IF EXISTS max_memory,
+    DROP COLUMN IF EXISTS max_gpus,
+    DROP COLUMN IF EXISTS max_concurrent_jobs,
+    DROP COLUMN IF EXISTS total_cpu_cores,
+    DROP COLUMN IF EXISTS total_memory,
+    DROP COLUMN IF EXISTS gpu_hours;
+
+DROP TABLE IF EXISTS user_instant_launch_defaults;
+
+DROP TABLE IF EXISTS vice_scheduled_launches;
+DROP TABLE IF EXISTS vice_launch_schedules;
+DROP TABLE IF EXISTS vice_launch_templates;
+
+DROP TABLE IF EXISTS vice_analysis_publications;
+DROP TABLE IF EXISTS vice_app_config_templates;
+DROP TABLE IF EXISTS vice_analysis_reference_data;
+DROP TABLE IF EXISTS vice_reference_datasets;
+
+DROP TABLE IF EXISTS vice_image_prepulls;
+DROP TABLE IF EXISTS vice_image_probes;
+
+DROP TABLE IF EXISTS vice_credential_rotations;
+DROP TABLE IF EXISTS vice_exec_sessions;
+DROP TABLE IF EXISTS vice_audit_log;
+DROP TABLE IF EXISTS vice_app_concurrency_limits;
+DROP TABLE IF EXISTS vice_user_freezes;
+
+DROP TABLE IF EXISTS vice_proxy_incidents;
+DROP TABLE IF EXISTS vice_proxy_heartbeats;
+
+DROP TABLE IF EXISTS vice_network_group_members;
+DROP TABLE IF EXISTS vice_tunnels;
+DROP TABLE IF EXISTS vice_subdomain_webhook_deliveries;
+DROP TABLE IF EXISTS vice_hostname_claims;
+DROP TABLE IF EXISTS vice_subdomains;
+
+DROP TABLE IF EXISTS vice_usage_reports;
+DROP TABLE IF EXISTS vice_usage_records;
+
+DROP TABLE IF EXISTS vice_deletion_protections;
+DROP TABLE IF EXISTS vice_time_limit_warnings;
+DROP TABLE IF EXISTS vice_analysis_preemptions;
+DROP TABLE IF EXISTS vice_analysis_activity;
+DROP TABLE IF EXISTS vice_analysis_uptime;
+DROP TABLE IF EXISTS vice_analysis_teardowns;
+DROP TABLE IF EXISTS vice_analysis_states;
+DROP TABLE IF EXISTS vice_launch_records;
+
+COMMIT;
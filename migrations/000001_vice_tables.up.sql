@@ -0,0 +1,368 @@
+-- The tables app-exposer keeps its own VICE state in, along with the plan
+-- limits it enforces. IDs are generated with uuid_generate_v1() from the
+-- uuid-ossp extension, like the rest of the DE database.
+
+BEGIN;
+
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+-- Launches and their resources.
+
+CREATE TABLE IF NOT EXISTS vice_launch_records (
+    external_id text PRIMARY KEY,
+    deployment_name text NOT NULL,
+    service_name text NOT NULL,
+    ingress_name text,
+    pvc_names text[] NOT NULL DEFAULT '{}',
+    subdomain text,
+    params jsonb NOT NULL DEFAULT '{}',
+    launched_at timestamp with time zone NOT NULL DEFAULT now(),
+    terminated_at timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS vice_analysis_states (
+    external_id text PRIMARY KEY,
+    state text NOT NULL,
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS vice_analysis_teardowns (
+    external_id text PRIMARY KEY,
+    progress jsonb NOT NULL,
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS vice_analysis_uptime (
+    external_id text PRIMARY KEY,
+    billable_seconds bigint NOT NULL DEFAULT 0,
+    running_since timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS vice_analysis_activity (
+    external_id text PRIMARY KEY,
+    last_activity_at timestamp with time zone NOT NULL,
+    idle_warned_at timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS vice_analysis_preemptions (
+    external_id text NOT NULL,
+    pod_name text NOT NULL,
+    node_name text NOT NULL DEFAULT '',
+    reason text NOT NULL DEFAULT '',
+    preempted_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (external_id, pod_name)
+);
+
+CREATE TABLE IF NOT EXISTS vice_time_limit_warnings (
+    external_id text NOT NULL,
+    planned_end_date timestamp with time zone NOT NULL,
+    warning_seconds integer NOT NULL,
+    sent_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (external_id, planned_end_date, warning_seconds)
+);
+
+CREATE TABLE IF NOT EXISTS vice_deletion_protections (
+    external_id text PRIMARY KEY,
+    protected_by text NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    protected_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- Usage accounting. There's a record for each replica of an analysis for
+-- each stretch of time it ran, so an analysis that was paused and resumed
+-- has more than one, but only one open record per replica.
+
+CREATE TABLE IF NOT EXISTS vice_usage_records (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    external_id text NOT NULL,
+    replica integer NOT NULL DEFAULT 0,
+    username text NOT NULL,
+    app_id text NOT NULL DEFAULT '',
+    app_name text NOT NULL DEFAULT '',
+    cpu_cores double precision NOT NULL DEFAULT 0,
+    memory_bytes bigint NOT NULL DEFAULT 0,
+    gpus bigint NOT NULL DEFAULT 0,
+    gpu_resource text NOT NULL DEFAULT '',
+    node_name text NOT NULL DEFAULT '',
+    started_at timestamp with time zone NOT NULL DEFAULT now(),
+    stopped_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS vice_usage_records_external_id_index
+    ON vice_usage_records (external_id);
+
+CREATE INDEX IF NOT EXISTS vice_usage_records_username_started_at_index
+    ON vice_usage_records (username, started_at);
+
+CREATE UNIQUE INDEX IF NOT EXISTS vice_usage_records_open_index
+    ON vice_usage_records (external_id, replica)
+    WHERE stopped_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS vice_usage_reports (
+    group_name text NOT NULL,
+    period_start timestamp with time zone NOT NULL,
+    sent_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (group_name, period_start)
+);
+
+-- Subdomains, hostnames and tunnels.
+
+CREATE TABLE IF NOT EXISTS vice_subdomains (
+    external_id text PRIMARY KEY,
+    subdomain text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS vice_hostname_claims (
+    hostname text PRIMARY KEY,
+    username text NOT NULL,
+    app_id text NOT NULL,
+    external_id text,
+    claimed_at timestamp with time zone NOT NULL DEFAULT now(),
+    UNIQUE (username, app_id)
+);
+
+CREATE TABLE IF NOT EXISTS vice_subdomain_webhook_deliveries (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    endpoint text NOT NULL,
+    event text NOT NULL,
+    subdomain text NOT NULL,
+    external_id text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text,
+    next_attempt_at timestamp with time zone,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    delivered_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS vice_subdomain_webhook_deliveries_pending_index
+    ON vice_subdomain_webhook_deliveries (next_attempt_at)
+    WHERE status = 'pending';
+
+CREATE TABLE IF NOT EXISTS vice_tunnels (
+    external_id text PRIMARY KEY,
+    subdomain text NOT NULL,
+    endpoint text NOT NULL,
+    connected_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_seen timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS vice_network_group_members (
+    external_id text PRIMARY KEY,
+    username text NOT NULL,
+    group_name text NOT NULL,
+    alias text NOT NULL,
+    added_at timestamp with time zone NOT NULL DEFAULT now(),
+    UNIQUE (username, group_name, alias)
+);
+
+-- The VICE proxy watchdog.
+
+CREATE TABLE IF NOT EXISTS vice_proxy_heartbeats (
+    external_id text PRIMARY KEY,
+    last_seen timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS vice_proxy_incidents (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    external_id text NOT NULL,
+    pod_name text NOT NULL,
+    last_heartbeat timestamp with time zone,
+    detected_at timestamp with time zone NOT NULL DEFAULT now(),
+    probe_result text NOT NULL DEFAULT '',
+    action text NOT NULL DEFAULT '',
+    resolved_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS vice_proxy_incidents_open_index
+    ON vice_proxy_incidents (external_id)
+    WHERE resolved_at IS NULL;
+
+-- Admin controls.
+
+CREATE TABLE IF NOT EXISTS vice_user_freezes (
+    username text PRIMARY KEY,
+    reason text NOT NULL,
+    frozen_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS vice_app_concurrency_limits (
+    app_id text PRIMARY KEY,
+    max_running integer NOT NULL,
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS vice_audit_log (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+    action text NOT NULL,
+    username text NOT NULL DEFAULT '',
+    target text NOT NULL DEFAULT '',
+    method text NOT NULL,
+    path text NOT NULL,
+    parameters jsonb NOT NULL DEFAULT '{}',
+    body jsonb,
+    result text NOT NULL,
+    status integer NOT NULL,
+    error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS vice_audit_log_recorded_at_index
+    ON vice_audit_log (recorded_at);
+
+CREATE TABLE IF NOT EXISTS vice_exec_sessions (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    external_id text NOT NULL,
+    pod text NOT NULL,
+    container text NOT NULL,
+    command text NOT NULL,
+    username text NOT NULL,
+    remote_addr text NOT NULL DEFAULT '',
+    started_at timestamp with time zone NOT NULL DEFAULT now(),
+    ended_at timestamp with time zone,
+    error text
+);
+
+CREATE TABLE IF NOT EXISTS vice_credential_rotations (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    credential text NOT NULL,
+    version text NOT NULL,
+    status text NOT NULL,
+    message text NOT NULL DEFAULT '',
+    checked_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_credential_rotations_credential_index
+    ON vice_credential_rotations (credential, checked_at);
+
+-- Images.
+
+CREATE TABLE IF NOT EXISTS vice_image_probes (
+    image text NOT NULL,
+    tag text NOT NULL,
+    verdict text NOT NULL,
+    details text NOT NULL DEFAULT '',
+    probed_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (image, tag)
+);
+
+CREATE TABLE IF NOT EXISTS vice_image_prepulls (
+    image text NOT NULL,
+    tag text NOT NULL,
+    requested_by text NOT NULL DEFAULT '',
+    expires_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (image, tag)
+);
+
+-- Reference data and app configuration.
+
+CREATE TABLE IF NOT EXISTS vice_reference_datasets (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    name text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    source_type text NOT NULL,
+    source text NOT NULL,
+    mount_path text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS vice_analysis_reference_data (
+    external_id text NOT NULL,
+    dataset_id uuid NOT NULL REFERENCES vice_reference_datasets (id) ON DELETE CASCADE,
+    mounted_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (external_id, dataset_id)
+);
+
+CREATE TABLE IF NOT EXISTS vice_app_config_templates (
+    app_id text NOT NULL,
+    name text NOT NULL,
+    mount_path text NOT NULL,
+    files jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (app_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS vice_analysis_publications (
+    analysis_id uuid PRIMARY KEY,
+    external_id text NOT NULL,
+    requested_by text NOT NULL,
+    metadata jsonb NOT NULL,
+    status text NOT NULL,
+    dataset_id text,
+    error text,
+    requested_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- Launch templates and schedules.
+
+CREATE TABLE IF NOT EXISTS vice_launch_templates (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    name text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    owner text NOT NULL,
+    request jsonb NOT NULL,
+    shared_with text[] NOT NULL DEFAULT '{}',
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_launch_templates_owner_index
+    ON vice_launch_templates (owner);
+
+CREATE TABLE IF NOT EXISTS vice_launch_schedules (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    name text NOT NULL,
+    template_id uuid NOT NULL REFERENCES vice_launch_templates (id) ON DELETE CASCADE,
+    owner text NOT NULL,
+    run_at timestamp with time zone,
+    cron text,
+    timezone text,
+    duration_minutes integer NOT NULL DEFAULT 0,
+    enabled boolean NOT NULL DEFAULT true,
+    next_run timestamp with time zone,
+    last_run timestamp with time zone,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_launch_schedules_next_run_index
+    ON vice_launch_schedules (next_run)
+    WHERE enabled;
+
+CREATE TABLE IF NOT EXISTS vice_scheduled_launches (
+    analysis_id uuid PRIMARY KEY,
+    schedule_id uuid REFERENCES vice_launch_schedules (id) ON DELETE SET NULL,
+    username text NOT NULL,
+    launched_at timestamp with time zone NOT NULL DEFAULT now(),
+    teardown_at timestamp with time zone,
+    torn_down boolean NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS vice_scheduled_launches_teardown_index
+    ON vice_scheduled_launches (teardown_at)
+    WHERE NOT torn_down;
+
+-- Instant launch defaults set by users.
+
+CREATE TABLE IF NOT EXISTS user_instant_launch_defaults (
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v1(),
+    user_id uuid NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+    defaults jsonb NOT NULL DEFAULT '{}'
+);
+
+-- The limits of plans that VICE launches are held to. A NULL limit means the
+-- plan doesn't have one.
+
+ALTER TABLE plans
+    ADD COLUMN IF NOT EXISTS max_cpu_cores double precision,
+    ADD COLUMN IF NOT EXISTS max_memory bigint,
+    ADD COLUMN IF NOT EXISTS max_gpus bigint,
+    ADD COLUMN IF NOT EXISTS max_concurrent_jobs integer,
+    ADD COLUMN IF NOT EXISTS total_cpu_cores double precision,
+    ADD COLUMN IF NOT EXISTS total_memory bigint,
+    ADD COLUMN IF NOT EXISTS gpu_hours double precision;
+
+COMMIT;
@@ -0,0 +1,12 @@
+-- The launch requests being handled, so that a retried request doesn't
+-- provision an analysis again while another replica, or a replica that was
+-- restarted, is still working on it.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS vice_launch_requests (
+    external_id text PRIMARY KEY,
+    started_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+COMMIT;
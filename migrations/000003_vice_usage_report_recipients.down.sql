@@ -0,0 +1,23 @@
+BEGIN;
+
+-- Keep one row for each report that reached any of its recipients.
+INSERT INTO vice_usage_reports (group_name, period_start, recipient, sent_at)
+SELECT group_name, period_start, '', max(sent_at)
+  FROM vice_usage_reports
+ WHERE recipient <> ''
+ GROUP BY group_name, period_start
+ON CONFLICT DO NOTHING;
+
+DELETE FROM vice_usage_reports
+ WHERE recipient <> '';
+
+ALTER TABLE vice_usage_reports
+    DROP CONSTRAINT IF EXISTS vice_usage_reports_pkey;
+
+ALTER TABLE vice_usage_reports
+    DROP COLUMN IF EXISTS recipient;
+
+ALTER TABLE vice_usage_reports
+    ADD PRIMARY KEY (group_name, period_start);
+
+COMMIT;
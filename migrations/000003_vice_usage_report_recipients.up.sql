@@ -0,0 +1,17 @@
+-- Usage reports are tracked per recipient, so that a report that reached some
+-- of its recipients is only sent again to the ones it didn't reach. Reports
+-- uploaded to object storage, and the reports recorded before this migration,
+-- have an empty recipient, which covers the whole group.
+
+BEGIN;
+
+ALTER TABLE vice_usage_reports
+    ADD COLUMN IF NOT EXISTS recipient text NOT NULL DEFAULT '';
+
+ALTER TABLE vice_usage_reports
+    DROP CONSTRAINT IF EXISTS vice_usage_reports_pkey;
+
+ALTER TABLE vice_usage_reports
+    ADD PRIMARY KEY (group_name, period_start, recipient);
+
+COMMIT;
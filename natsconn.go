@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// natsClient adapts a NATS connection to the request-reply interfaces used by
+// the status transport and the request/reply API.
+type natsClient struct {
+	conn *nats.Conn
+}
+
+// newNATSClient connects to the NATS server at natsURL. The connection keeps
+// trying to reconnect if it's lost.
+func newNATSClient(natsURL string) (*natsClient, error) {
+	conn, err := nats.Connect(
+		natsURL,
+		nats.Name("app-exposer"),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error connecting to NATS at %s", natsURL)
+	}
+	return &natsClient{conn: conn}, nil
+}
+
+// Request sends the data to the subject and returns the data of the reply.
+func (c *natsClient) Request(subject string, data []byte, timeout time.Duration) ([]byte, error) {
+	msg, err := c.conn.Request(subject, data, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Data, nil
+}
+
+// QueueSubscribe subscribes the handler to the subject as a member of the
+// queue group, passing it the data of each request and a function that
+// replies to it.
+func (c *natsClient) QueueSubscribe(subject, queue string, handler func(data []byte, respond func([]byte) error)) error {
+	_, err := c.conn.QueueSubscribe(subject, queue, func(msg *nats.Msg) {
+		handler(msg.Data, msg.Respond)
+	})
+	return err
+}
+
+// Close closes the connection after sending anything still buffered.
+func (c *natsClient) Close() {
+	if err := c.conn.Drain(); err != nil {
+		log.Error(errors.Wrap(err, "error draining the NATS connection"))
+	}
+}
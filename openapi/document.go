@@ -0,0 +1,240 @@
+// Package openapi generates the OpenAPI 3 document for the service's HTTP API
+// from the routes registered with the router, the hand-written documentation
+// in api.yml, and the Go types of the requests and responses.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// Route is a route registered with the router. The path uses echo's syntax
+// for parameters, such as /vice/:analysis-id/state.
+type Route struct {
+	Method  string
+	Path    string
+	Handler string
+}
+
+// Operation fills in the request body and responses of a route with schemas
+// generated from the types of the values, or given as a Schema or Fields.
+type Operation struct {
+	Method    string
+	Path      string
+	Summary   string
+	Request   interface{}
+	Responses map[int]interface{}
+}
+
+// documentedMethods are the methods that are included in the document. Routes
+// registered with echo's Any are also registered for methods such as PROPFIND
+// that aren't worth documenting.
+var documentedMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// pathParamPattern matches the parameters in a path in echo's syntax.
+var pathParamPattern = regexp.MustCompile(`:([^/]+)`)
+
+// openAPIPath converts the path from echo's syntax to OpenAPI's, returning the
+// names of the parameters in it.
+func openAPIPath(path string) (string, []string) {
+	names := []string{}
+	converted := pathParamPattern.ReplaceAllStringFunc(path, func(param string) string {
+		name := strings.TrimPrefix(param, ":")
+		names = append(names, name)
+		return "{" + name + "}"
+	})
+	return converted, names
+}
+
+// handlerName returns the name of the handler function without its package
+// and receiver, such as LaunchAppHandler.
+func handlerName(handler string) string {
+	name := handler
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return strings.TrimSuffix(name, "-fm")
+}
+
+// summarize turns the name of a handler into a summary of what it does, such
+// as "Admin get state" for AdminGetStateHandler.
+func summarize(handler string) string {
+	name := strings.TrimSuffix(handlerName(handler), "Handler")
+
+	words := []string{}
+	start := 0
+	runes := []rune(name)
+	for idx := 1; idx < len(runes); idx++ {
+		upper := unicode.IsUpper(runes[idx])
+		nextLower := idx+1 < len(runes) && unicode.IsLower(runes[idx+1])
+		if upper && (unicode.IsLower(runes[idx-1]) || nextLower) {
+			words = append(words, string(runes[start:idx]))
+			start = idx
+		}
+	}
+	words = append(words, string(runes[start:]))
+
+	for idx := 1; idx < len(words); idx++ {
+		if strings.ToUpper(words[idx]) != words[idx] {
+			words[idx] = strings.ToLower(words[idx])
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// tag returns the tag that groups the route's operation with related ones,
+// which comes from the leading segments of its path.
+func tag(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if segments[0] == "" {
+		return "service"
+	}
+	if len(segments) > 1 && segments[1] == "admin" {
+		return segments[0] + "-admin"
+	}
+	return segments[0]
+}
+
+// object returns the value as a JSON object, adding an empty one to the parent
+// under the key if it isn't there.
+func object(parent map[string]interface{}, key string) map[string]interface{} {
+	if child, ok := parent[key].(map[string]interface{}); ok {
+		return child
+	}
+	child := map[string]interface{}{}
+	parent[key] = child
+	return child
+}
+
+// hasParameter returns true if the operation already describes the path
+// parameter. Parameters given as references are assumed to be the ones named
+// in them.
+func hasParameter(operation map[string]interface{}, components map[string]interface{}, name string) bool {
+	params, _ := operation["parameters"].([]interface{})
+	for _, p := range params {
+		param, _ := p.(map[string]interface{})
+		if ref, ok := param["$ref"].(string); ok {
+			param, _ = components[strings.TrimPrefix(ref, "#/components/parameters/")].(map[string]interface{})
+		}
+		if param["in"] == "path" && param["name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate returns the OpenAPI document for the routes as JSON. The base
+// document, in YAML or JSON, provides the info, servers, components and the
+// hand-written descriptions of paths. Routes that aren't described in it get
+// an operation generated from the route, and the operations fill in the
+// request and response schemas.
+func Generate(base []byte, routes []Route, operations []Operation) ([]byte, error) {
+	doc := map[string]interface{}{}
+	if len(base) > 0 {
+		js, err := yaml.YAMLToJSON(base)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing the base OpenAPI document")
+		}
+		if err = json.Unmarshal(js, &doc); err != nil {
+			return nil, errors.Wrap(err, "error parsing the base OpenAPI document")
+		}
+	}
+	if _, ok := doc["openapi"]; !ok {
+		doc["openapi"] = "3.0.2"
+	}
+
+	paths := object(doc, "paths")
+	components := object(doc, "components")
+	parameters := object(components, "parameters")
+	registry := newSchemaRegistry(object(components, "schemas"))
+
+	for _, route := range routes {
+		if !documentedMethods[route.Method] || strings.Contains(route.Path, "*") {
+			continue
+		}
+
+		path, names := openAPIPath(route.Path)
+		method := strings.ToLower(route.Method)
+		item := object(paths, path)
+
+		operation, documented := item[method].(map[string]interface{})
+		if !documented {
+			operation = map[string]interface{}{
+				"summary": summarize(route.Handler),
+				"responses": map[string]interface{}{
+					"default": map[string]interface{}{"description": "The response from the handler."},
+				},
+			}
+			item[method] = operation
+		}
+		if _, ok := operation["operationId"]; !ok {
+			operation["operationId"] = fmt.Sprintf("%s %s", route.Method, route.Path)
+		}
+		if _, ok := operation["tags"]; !ok {
+			operation["tags"] = []interface{}{tag(route.Path)}
+		}
+
+		for _, name := range names {
+			if hasParameter(operation, parameters, name) {
+				continue
+			}
+			params, _ := operation["parameters"].([]interface{})
+			operation["parameters"] = append(params, map[string]interface{}{
+				"name":     name,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+
+	for _, op := range operations {
+		path, _ := openAPIPath(op.Path)
+		operation, ok := object(paths, path)[strings.ToLower(op.Method)].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("no route is registered for %s %s", op.Method, op.Path)
+		}
+
+		if op.Summary != "" {
+			operation["summary"] = op.Summary
+		}
+
+		if op.Request != nil {
+			body := object(operation, "requestBody")
+			if _, ok := body["required"]; !ok {
+				body["required"] = true
+			}
+			object(object(body, "content"), "application/json")["schema"] = registry.schemaFor(op.Request)
+		}
+
+		if len(op.Responses) > 0 {
+			responses := object(operation, "responses")
+			delete(responses, "default")
+			for code, value := range op.Responses {
+				response := object(responses, strconv.Itoa(code))
+				if _, ok := response["description"]; !ok {
+					response["description"] = http.StatusText(code)
+				}
+				if value != nil {
+					object(object(response, "content"), "application/json")["schema"] = registry.schemaFor(value)
+				}
+			}
+		}
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,160 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testItem struct {
+	Name     string     `json:"name"`
+	Count    int        `json:"count,omitempty"`
+	Tags     []string   `json:"tags"`
+	Created  time.Time  `json:"created"`
+	Parent   *testItem  `json:"parent,omitempty"`
+	Ignored  string     `json:"-"`
+	Finished *time.Time `json:"finished"`
+	hidden   string
+}
+
+type testWrapper struct {
+	testItem
+	Extra map[string]int `json:"extra"`
+}
+
+func TestOpenAPIPath(t *testing.T) {
+	path, names := openAPIPath("/vice/admin/analyses/:analysis-id/state")
+	assert.Equal(t, "/vice/admin/analyses/{analysis-id}/state", path)
+	assert.Equal(t, []string{"analysis-id"}, names)
+
+	path, names = openAPIPath("/vice/listing")
+	assert.Equal(t, "/vice/listing", path)
+	assert.Empty(t, names)
+}
+
+func TestSummarize(t *testing.T) {
+	assert.Equal(t, "Admin get state", summarize("github.com/cyverse-de/app-exposer/internal.(*Internal).AdminGetStateHandler-fm"))
+	assert.Equal(t, "Admin get external ID", summarize("AdminGetExternalIDHandler"))
+	assert.Equal(t, "Filterable config maps", summarize("FilterableConfigMapsHandler"))
+	assert.Equal(t, "Greeting", summarize("main.(*ExposerApp).Greeting-fm"))
+}
+
+func TestTag(t *testing.T) {
+	assert.Equal(t, "vice", tag("/vice/:analysis-id/state"))
+	assert.Equal(t, "vice-admin", tag("/vice/admin/listing"))
+	assert.Equal(t, "service", tag("/"))
+}
+
+func TestSchemaFor(t *testing.T) {
+	schemas := map[string]interface{}{}
+	registry := newSchemaRegistry(schemas)
+
+	assert.Equal(t, Schema{"$ref": "#/components/schemas/testItem"}, registry.schemaFor(testItem{}))
+
+	item := schemas["testItem"].(Schema)
+	assert.Equal(t, []string{"created", "finished", "name", "tags"}, item["required"])
+
+	properties := item["properties"].(map[string]interface{})
+	assert.Len(t, properties, 6)
+	assert.Equal(t, Schema{"type": "string", "format": "date-time"}, properties["created"])
+	assert.Equal(t, Schema{"type": "string", "format": "date-time"}, properties["finished"])
+	assert.Equal(t, Schema{"type": "integer", "format": "int64"}, properties["count"])
+	assert.Equal(t, Schema{"type": "array", "items": Schema{"type": "string"}}, properties["tags"])
+	assert.Equal(t, Schema{"$ref": "#/components/schemas/testItem"}, properties["parent"])
+
+	// The fields of embedded structs are promoted.
+	registry.schemaFor(&testWrapper{})
+	wrapper := schemas["testWrapper"].(Schema)["properties"].(map[string]interface{})
+	assert.Contains(t, wrapper, "name")
+	assert.Equal(t, Schema{"type": "object", "additionalProperties": Schema{"type": "integer", "format": "int64"}}, wrapper["extra"])
+
+	fields := registry.schemaFor(Fields{"ready": true})
+	assert.Equal(t, Schema{"type": "object", "properties": map[string]interface{}{"ready": Schema{"type": "boolean"}}}, fields)
+
+	oneOf := registry.schemaFor(OneOf{"", 1.5})
+	assert.Equal(t, Schema{"oneOf": []interface{}{Schema{"type": "string"}, Schema{"type": "number", "format": "double"}}}, oneOf)
+}
+
+func TestSchemaNameCollision(t *testing.T) {
+	schemas := map[string]interface{}{"testItem": Schema{"type": "object"}}
+	registry := newSchemaRegistry(schemas)
+
+	assert.Equal(t, Schema{"$ref": "#/components/schemas/openapitestItem"}, registry.schemaFor(testItem{}))
+	assert.Equal(t, Schema{"type": "object"}, schemas["testItem"])
+}
+
+const testBase = `
+openapi: 3.0.2
+info:
+  title: test
+paths:
+  /vice/{analysis-id}/state:
+    get:
+      summary: Hand-written summary
+      responses:
+        '200':
+          description: The state.
+`
+
+func TestGenerate(t *testing.T) {
+	routes := []Route{
+		{Method: "GET", Path: "/vice/:analysis-id/state", Handler: "GetStateHandler"},
+		{Method: "POST", Path: "/vice/launch", Handler: "LaunchAppHandler"},
+		{Method: "PROPFIND", Path: "/vice/launch", Handler: "LaunchAppHandler"},
+		{Method: "GET", Path: "/docs/*", Handler: "static"},
+	}
+	operations := []Operation{
+		{
+			Method:    "GET",
+			Path:      "/vice/:analysis-id/state",
+			Responses: map[int]interface{}{200: Fields{"state": ""}},
+		},
+		{
+			Method:    "POST",
+			Path:      "/vice/launch",
+			Request:   testItem{},
+			Responses: map[int]interface{}{202: nil},
+		},
+	}
+
+	generated, err := Generate([]byte(testBase), routes, operations)
+	require.NoError(t, err)
+
+	doc := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(generated, &doc))
+	assert.Equal(t, "test", doc["info"].(map[string]interface{})["title"])
+
+	paths := doc["paths"].(map[string]interface{})
+	assert.Len(t, paths, 2)
+
+	state := paths["/vice/{analysis-id}/state"].(map[string]interface{})["get"].(map[string]interface{})
+	assert.Equal(t, "Hand-written summary", state["summary"])
+	assert.Equal(t, "GET /vice/:analysis-id/state", state["operationId"])
+	assert.Len(t, state["parameters"], 1)
+	ok := state["responses"].(map[string]interface{})["200"].(map[string]interface{})
+	assert.Equal(t, "The state.", ok["description"])
+	assert.Contains(t, ok, "content")
+
+	launch := paths["/vice/launch"].(map[string]interface{})
+	assert.Len(t, launch, 1)
+	post := launch["post"].(map[string]interface{})
+	assert.Equal(t, "Launch app", post["summary"])
+	assert.Equal(t, []interface{}{"vice"}, post["tags"])
+	assert.Contains(t, post, "requestBody")
+	responses := post["responses"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"202": map[string]interface{}{"description": "Accepted"}}, responses)
+
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	assert.Contains(t, schemas, "testItem")
+}
+
+func TestGenerateUnregisteredOperation(t *testing.T) {
+	_, err := Generate(nil, nil, []Operation{{Method: "GET", Path: "/missing"}})
+	assert.Error(t, err)
+
+	_, err = Generate([]byte("paths: ["), nil, nil)
+	assert.Error(t, err)
+}
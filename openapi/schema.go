@@ -0,0 +1,218 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schema is an OpenAPI schema object, used as is.
+type Schema map[string]interface{}
+
+// Fields describes an object by a value for each of its properties, for
+// responses that are maps rather than structs. The schema of each property is
+// generated from the type of its value.
+type Fields map[string]interface{}
+
+// OneOf describes a value that has the schema of one of the values, for
+// responses that differ depending on how the request was handled.
+type OneOf []interface{}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	marshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schemaRegistry generates schemas from Go types. Named struct types are added
+// to the components of the document once and referred to from then on.
+type schemaRegistry struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+func newSchemaRegistry(schemas map[string]interface{}) *schemaRegistry {
+	return &schemaRegistry{
+		schemas: schemas,
+		names:   map[reflect.Type]string{},
+	}
+}
+
+// schemaFor returns the schema for the value, which is either a Schema, a
+// Fields, a OneOf or a value of the type to generate the schema from.
+func (r *schemaRegistry) schemaFor(v interface{}) Schema {
+	switch v := v.(type) {
+	case nil:
+		return Schema{}
+	case Schema:
+		return v
+	case Fields:
+		properties := map[string]interface{}{}
+		for name, value := range v {
+			properties[name] = r.schemaFor(value)
+		}
+		return Schema{"type": "object", "properties": properties}
+	case OneOf:
+		schemas := []interface{}{}
+		for _, value := range v {
+			schemas = append(schemas, r.schemaFor(value))
+		}
+		return Schema{"oneOf": schemas}
+	}
+	return r.typeSchema(reflect.TypeOf(v))
+}
+
+// isTime returns true for types that encode as timestamps, including the
+// ones that wrap time.Time such as metav1.Time.
+func isTime(t reflect.Type) bool {
+	return t == timeType || (t.Kind() == reflect.Struct && t.Name() == "Time" && t.NumField() > 0 && t.Field(0).Type == timeType)
+}
+
+func (r *schemaRegistry) typeSchema(t reflect.Type) Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case isTime(t):
+		return Schema{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return Schema{}
+	case t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType):
+		// Types with their own encoding can be anything.
+		return Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return Schema{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return Schema{"type": "integer", "format": "int32"}
+	case reflect.Float32:
+		return Schema{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return Schema{"type": "number", "format": "double"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "format": "byte"}
+		}
+		return Schema{"type": "array", "items": r.typeSchema(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": r.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return r.structSchema(t)
+		}
+		return r.ref(t)
+	}
+
+	return Schema{}
+}
+
+// ref returns a reference to the schema for the named struct type, adding it
+// to the components if it's not there yet.
+func (r *schemaRegistry) ref(t reflect.Type) Schema {
+	name, ok := r.names[t]
+	if !ok {
+		name = r.schemaName(t)
+		r.names[t] = name
+
+		// The placeholder keeps the name taken while the fields are
+		// generated, since they can refer back to the type.
+		r.schemas[name] = Schema{}
+		r.schemas[name] = r.structSchema(t)
+	}
+	return Schema{"$ref": "#/components/schemas/" + name}
+}
+
+// schemaName returns an unused name for the type's schema. Types from
+// different packages with the same name are told apart by their package.
+func (r *schemaRegistry) schemaName(t reflect.Type) string {
+	name := t.Name()
+	if _, taken := r.schemas[name]; !taken {
+		return name
+	}
+
+	pkg := t.PkgPath()
+	if idx := strings.LastIndex(pkg, "/"); idx >= 0 {
+		pkg = pkg[idx+1:]
+	}
+	pkg = strings.NewReplacer(".", "", "-", "").Replace(pkg)
+
+	qualified := pkg + name
+	for n := 2; ; n++ {
+		if _, taken := r.schemas[qualified]; !taken {
+			return qualified
+		}
+		qualified = fmt.Sprintf("%s%s%d", pkg, name, n)
+	}
+}
+
+// structSchema returns the object schema for the struct type, following the
+// rules of encoding/json. Fields without omitempty are always present, so
+// they're listed as required.
+func (r *schemaRegistry) structSchema(t reflect.Type) Schema {
+	properties := map[string]interface{}{}
+	required := []string{}
+	r.addFields(t, properties, &required)
+
+	schema := Schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (r *schemaRegistry) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := field.Name
+		omitempty := false
+		if tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, option := range parts[1:] {
+				if option == "omitempty" {
+					omitempty = true
+				}
+			}
+		}
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		// The fields of embedded structs are promoted unless they're given a
+		// name of their own.
+		if field.Anonymous && fieldType.Kind() == reflect.Struct && (tag == "" || strings.HasPrefix(tag, ",")) {
+			r.addFields(fieldType, properties, required)
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		properties[name] = r.typeSchema(field.Type)
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+}
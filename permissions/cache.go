@@ -0,0 +1,123 @@
+package permissions
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCacheMaxEntries is the number of permission checks cached if no
+// maximum is configured.
+const DefaultCacheMaxEntries = 1000
+
+type cacheEntry struct {
+	user     string
+	resource string
+	level    string
+	expires  time.Time
+}
+
+// Cache remembers the permission levels found by permission checks for a
+// short time, keyed by the user and the resource. Entries have to be
+// invalidated explicitly when the sharing of a resource changes, otherwise
+// they're used until they expire.
+type Cache struct {
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+}
+
+// NewCache returns a *Cache that keeps results for the TTL and holds at most
+// maxEntries of them. A maxEntries of zero or less uses
+// DefaultCacheMaxEntries.
+func NewCache(ttl time.Duration, maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+	return &Cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]cacheEntry{},
+	}
+}
+
+func cacheKey(user, resource string) string {
+	return user + "\x00" + resource
+}
+
+// get returns the cached permission level of the user on the resource and
+// whether there was one. An empty level means the user has no access.
+func (c *Cache) get(user, resource string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(user, resource)
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.level, true
+}
+
+// set caches the permission level of the user on the resource. If the cache
+// is full, the expired entries are dropped, followed by the one closest to
+// expiring if that doesn't make enough room.
+func (c *Cache) set(user, resource, level string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	key := cacheKey(user, resource)
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		var (
+			oldestKey string
+			oldest    time.Time
+		)
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldestKey == "" || entry.expires.Before(oldest) {
+				oldestKey, oldest = k, entry.expires
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldestKey)
+		}
+	}
+
+	c.entries[key] = cacheEntry{
+		user:     user,
+		resource: resource,
+		level:    level,
+		expires:  now.Add(c.ttl),
+	}
+}
+
+// Invalidate drops the cached result for the user and the resource. An empty
+// user drops the results for every user of the resource, and an empty
+// resource drops the results for every resource of the user.
+func (c *Cache) Invalidate(user, resource string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, entry := range c.entries {
+		if (user == "" || entry.user == user) && (resource == "" || entry.resource == resource) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// Len returns the number of cached results, including the expired ones that
+// haven't been dropped yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,91 @@
+package permissions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCache(time.Millisecond, 10)
+	c.set("alice", "a1", LevelOwn)
+
+	level, ok := c.get("alice", "a1")
+	assert.True(ok)
+	assert.Equal(LevelOwn, level)
+
+	time.Sleep(5 * time.Millisecond)
+	_, ok = c.get("alice", "a1")
+	assert.False(ok)
+	assert.Equal(0, c.Len())
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCache(time.Minute, 2)
+	c.set("alice", "a1", LevelOwn)
+	time.Sleep(time.Millisecond)
+	c.set("alice", "a2", LevelOwn)
+	time.Sleep(time.Millisecond)
+	c.set("alice", "a3", "")
+
+	// The entry closest to expiring makes room for the new one.
+	assert.Equal(2, c.Len())
+	_, ok := c.get("alice", "a1")
+	assert.False(ok)
+	level, ok := c.get("alice", "a3")
+	assert.True(ok)
+	assert.Empty(level)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCache(time.Minute, 10)
+	c.set("alice", "a1", LevelOwn)
+	c.set("bob", "a1", LevelRead)
+	c.set("alice", "a2", LevelOwn)
+
+	c.Invalidate("", "a1")
+	assert.Equal(1, c.Len())
+
+	c.set("bob", "a1", LevelRead)
+	c.Invalidate("alice", "")
+	assert.Equal(1, c.Len())
+	_, ok := c.get("bob", "a1")
+	assert.True(ok)
+}
+
+func TestIsAllowedCached(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal("/permissions/subjects/user/alice/analysis/a1", r.URL.Path)
+		fmt.Fprint(w, `{"permissions":[{"permission_level":"own"}]}`)
+	}))
+	defer server.Close()
+
+	p := &Permissions{BaseURL: server.URL, Cache: NewCache(time.Minute, 10)}
+
+	for n := 0; n < 3; n++ {
+		allowed, err := p.IsAllowed(context.Background(), "alice", "a1")
+		assert.NoError(err)
+		assert.True(allowed)
+	}
+	assert.Equal(1, requests)
+
+	p.Cache.Invalidate("alice", "a1")
+	_, err := p.IsAllowed(context.Background(), "alice", "a1")
+	assert.NoError(err)
+	assert.Equal(2, requests)
+}
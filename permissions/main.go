@@ -1,16 +1,23 @@
 package permissions
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
+
+	"github.com/cyverse-de/app-exposer/tracing"
 )
 
 // Permissions performs operations related to checking permissions.
 type Permissions struct {
 	BaseURL string
+
+	// Cache holds the permission levels found by permission checks. Nothing
+	// is cached if it's nil.
+	Cache *Cache
 }
 
 // Resource is an item that can have permissions attached to it in the
@@ -52,17 +59,30 @@ type Lookup struct {
 	SubjectType  string
 	Resource     string
 	ResourceType string
+
+	// IncludeGroups also returns the permissions granted to the groups the
+	// subject belongs to.
+	IncludeGroups bool
 }
 
 // GetPermissions returns subjects information about a subject.
-func (p *Permissions) GetPermissions(lookup *Lookup) (*PermissionList, error) {
+func (p *Permissions) GetPermissions(ctx context.Context, lookup *Lookup) (*PermissionList, error) {
 	requrl, err := url.Parse(p.BaseURL)
 	if err != nil {
 		return nil, err
 	}
 
 	requrl.Path = filepath.Join(requrl.Path, "permissions/subjects", lookup.SubjectType, lookup.Subject, lookup.ResourceType, lookup.Resource)
-	resp, err := http.Get(requrl.String())
+	if lookup.IncludeGroups {
+		q := requrl.Query()
+		q.Set("lookup", "true")
+		requrl.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tracing.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -82,27 +102,122 @@ func (p *Permissions) GetPermissions(lookup *Lookup) (*PermissionList, error) {
 	return retval, nil
 }
 
+// The permission levels the permissions service grants, from least to most
+// access.
+const (
+	LevelRead  = "read"
+	LevelWrite = "write"
+	LevelAdmin = "admin"
+	LevelOwn   = "own"
+)
+
+var levelRanks = map[string]int{
+	LevelRead:  1,
+	LevelWrite: 2,
+	LevelAdmin: 3,
+	LevelOwn:   4,
+}
+
 // IsAllowed will return true if the user is allowed to access the running app
-// and false if they're not. An error might be returned as well. Access should
-// be denied if an error is returned, even if the boolean return value is true.
-func (p *Permissions) IsAllowed(user, resource string) (bool, error) {
-	lookup := &Lookup{
-		Subject:      user,
-		SubjectType:  "user",
-		Resource:     resource,
-		ResourceType: "analysis",
+// and false if they're not. Access granted to a group the user belongs to
+// counts. An error might be returned as well. Access should be denied if an
+// error is returned, even if the boolean return value is true.
+func (p *Permissions) IsAllowed(ctx context.Context, user, resource string) (bool, error) {
+	level, err := p.Level(ctx, user, resource)
+	if err != nil {
+		return false, err
 	}
+	return level != "", nil
+}
 
-	l, err := p.GetPermissions(lookup)
+// IsAllowedWithLevel returns true if the user has at least the permission
+// level on the analysis, either directly or through a group they belong to.
+// Access should be denied if an error is returned.
+func (p *Permissions) IsAllowedWithLevel(ctx context.Context, user, resource, level string) (bool, error) {
+	actual, err := p.Level(ctx, user, resource)
 	if err != nil {
 		return false, err
 	}
+	return actual != "" && levelRanks[actual] >= levelRanks[level], nil
+}
+
+// Level returns the highest permission level the user has on the analysis,
+// either directly or through a group they belong to. An empty level means the
+// user can't access it.
+func (p *Permissions) Level(ctx context.Context, user, resource string) (string, error) {
+	if p.Cache != nil {
+		if level, ok := p.Cache.get(user, resource); ok {
+			return level, nil
+		}
+	}
+
+	level, err := p.lookupLevel(ctx, user, resource)
+	if err != nil {
+		return "", err
+	}
+
+	if p.Cache != nil {
+		p.Cache.set(user, resource, level)
+	}
+
+	return level, nil
+}
+
+// lookupLevel asks the permissions service for the highest permission level
+// the user has on the analysis.
+func (p *Permissions) lookupLevel(ctx context.Context, user, resource string) (string, error) {
+	lookup := &Lookup{
+		Subject:       user,
+		SubjectType:   "user",
+		Resource:      resource,
+		ResourceType:  "analysis",
+		IncludeGroups: true,
+	}
 
-	if len(l.Permissions) > 0 {
-		if l.Permissions[0].Level != "" {
-			return true, nil
+	l, err := p.GetPermissions(ctx, lookup)
+	if err != nil {
+		return "", err
+	}
+
+	level := ""
+	for _, permission := range l.Permissions {
+		if permission.Level == "" {
+			continue
+		}
+		if level == "" || levelRanks[permission.Level] > levelRanks[level] {
+			level = permission.Level
 		}
 	}
 
-	return false, nil
+	return level, nil
+}
+
+// AccessibleResources returns the names of the resources of the type that the
+// user can access, either directly or through a group they belong to.
+func (p *Permissions) AccessibleResources(ctx context.Context, user, resourceType string) ([]string, error) {
+	lookup := &Lookup{
+		Subject:       user,
+		SubjectType:   "user",
+		ResourceType:  resourceType,
+		IncludeGroups: true,
+	}
+
+	l, err := p.GetPermissions(ctx, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	// A resource shows up once for each way the user has access to it.
+	seen := map[string]bool{}
+	retval := []string{}
+	for _, permission := range l.Permissions {
+		name := permission.Resource.Name
+		if name == "" || permission.Level == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		retval = append(retval, name)
+	}
+
+	return retval, nil
 }
@@ -0,0 +1,71 @@
+package permissions
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessibleResources(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/permissions/subjects/user/alice/analysis", r.URL.Path)
+		assert.Equal("true", r.URL.Query().Get("lookup"))
+		fmt.Fprint(w, `{"permissions":[
+			{"permission_level":"own","resource":{"name":"a1"},"subject":{"subject_id":"alice","subject_type":"user"}},
+			{"permission_level":"read","resource":{"name":"a2"},"subject":{"subject_id":"lab","subject_type":"group"}},
+			{"permission_level":"write","resource":{"name":"a2"},"subject":{"subject_id":"alice","subject_type":"user"}}
+		]}`)
+	}))
+	defer server.Close()
+
+	p := &Permissions{BaseURL: server.URL}
+	resources, err := p.AccessibleResources(context.Background(), "alice", "analysis")
+	assert.NoError(err)
+	assert.Equal([]string{"a1", "a2"}, resources)
+}
+
+func TestIsAllowedIncludesGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("lookup") != "true" {
+			fmt.Fprint(w, `{"permissions":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"permissions":[{"permission_level":"read","subject":{"subject_type":"group"}}]}`)
+	}))
+	defer server.Close()
+
+	p := &Permissions{BaseURL: server.URL}
+	allowed, err := p.IsAllowed(context.Background(), "alice", "a1")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+}
+
+func TestIsAllowedWithLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"permissions":[
+			{"permission_level":"read","subject":{"subject_type":"user"}},
+			{"permission_level":"write","subject":{"subject_type":"group"}}
+		]}`)
+	}))
+	defer server.Close()
+
+	p := &Permissions{BaseURL: server.URL}
+
+	level, err := p.Level(context.Background(), "alice", "a1")
+	assert.NoError(err)
+	assert.Equal(LevelWrite, level)
+
+	for want, required := range map[bool]string{true: LevelWrite, false: LevelOwn} {
+		allowed, err := p.IsAllowedWithLevel(context.Background(), "alice", "a1", required)
+		assert.NoError(err)
+		assert.Equal(want, allowed, required)
+	}
+}
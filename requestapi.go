@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// RequestSubscriber subscribes to the subjects of the request/reply API. A
+// NATS connection can be adapted to it by calling Conn.QueueSubscribe with a
+// handler that passes along the data of each message and Msg.Respond.
+type RequestSubscriber interface {
+	QueueSubscribe(subject, queue string, handler func(data []byte, respond func([]byte) error)) error
+}
+
+// DefaultRequestSubjectPrefix is the prefix of the request/reply API's
+// subjects if one isn't configured.
+const DefaultRequestSubjectPrefix = "cyverse.app-exposer.vice"
+
+// requestQueue is the queue group the subscriptions join, so that each request
+// is handled by only one app-exposer instance.
+const requestQueue = "app-exposer"
+
+// requestOperation is an operation of the request/reply API. Requests are
+// served by the same route as the HTTP API, so the two behave the same.
+type requestOperation struct {
+	subject string
+	method  string
+	path    string
+}
+
+// requestOperations lists the operations available over request/reply. The
+// subjects are relative to the configured prefix.
+var requestOperations = []requestOperation{
+	{subject: "launch", method: http.MethodPost, path: "/vice/launch"},
+	{subject: "terminate", method: http.MethodPost, path: "/vice/:id/exit"},
+	{subject: "describe", method: http.MethodGet, path: "/vice/:host/description"},
+	{subject: "listing", method: http.MethodGet, path: "/vice/listing"},
+	{subject: "time-limit.get", method: http.MethodGet, path: "/vice/:analysis-id/time-limit"},
+	{subject: "time-limit.extend", method: http.MethodPost, path: "/vice/:analysis-id/time-limit"},
+}
+
+// APIRequest is the JSON body of a request made over request/reply. Params
+// fill in the parameters in the path of the operation's route, Query holds
+// the query parameters, such as user, and Body is the request body, if the
+// route takes one.
+type APIRequest struct {
+	Params map[string]string `json:"params"`
+	Query  map[string]string `json:"query"`
+	Body   json.RawMessage   `json:"body,omitempty"`
+}
+
+// APIReply is the JSON body of a reply sent over request/reply. StatusCode is
+// the HTTP status code the route responded with and Body is the response,
+// which is an error response for status codes of 400 and above.
+type APIReply struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+// requestPath fills the parameters into the path of the route.
+func (o *requestOperation) requestPath(params map[string]string) (string, error) {
+	segments := strings.Split(o.path, "/")
+	for idx, segment := range segments {
+		if !strings.HasPrefix(segment, ":") {
+			continue
+		}
+		name := strings.TrimPrefix(segment, ":")
+		value := params[name]
+		if value == "" {
+			return "", fmt.Errorf("the %s parameter is required for %s", name, o.subject)
+		}
+		segments[idx] = url.PathEscape(value)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// newAPIErrorReply returns a reply for a request that couldn't be passed to
+// the route.
+func newAPIErrorReply(code int, err error) *APIReply {
+	body, _ := json.Marshal(map[string]string{"message": err.Error()})
+	return &APIReply{StatusCode: code, Body: body}
+}
+
+// serveRequest runs the request for the operation through the router and
+// returns the reply.
+func (e *ExposerApp) serveRequest(op *requestOperation, data []byte) *APIReply {
+	request := &APIRequest{}
+	if err := json.Unmarshal(data, request); err != nil {
+		return newAPIErrorReply(http.StatusBadRequest, errors.Wrap(err, "error parsing the request"))
+	}
+
+	path, err := op.requestPath(request.Params)
+	if err != nil {
+		return newAPIErrorReply(http.StatusBadRequest, err)
+	}
+
+	query := url.Values{}
+	for name, value := range request.Query {
+		query.Set(name, value)
+	}
+	if len(query) > 0 {
+		path = path + "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(op.method, path, bytes.NewReader(request.Body))
+	if err != nil {
+		return newAPIErrorReply(http.StatusBadRequest, err)
+	}
+	if len(request.Body) > 0 {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+
+	reply := &APIReply{StatusCode: rec.Code}
+	if body := bytes.TrimSpace(rec.Body.Bytes()); len(body) > 0 {
+		if json.Valid(body) {
+			reply.Body = body
+		} else {
+			reply.Body, _ = json.Marshal(string(body))
+		}
+	}
+	return reply
+}
+
+// ServeRequests subscribes to the subjects of the request/reply API, which
+// start with the prefix. Each request is served by the same route as the
+// equivalent HTTP request, so internal services can call app-exposer without
+// going through the HTTP ingress.
+func (e *ExposerApp) ServeRequests(subscriber RequestSubscriber, prefix string) error {
+	if prefix == "" {
+		prefix = DefaultRequestSubjectPrefix
+	}
+
+	for idx := range requestOperations {
+		op := &requestOperations[idx]
+		subject := prefix + "." + op.subject
+
+		err := subscriber.QueueSubscribe(subject, requestQueue, func(data []byte, respond func([]byte) error) {
+			reply, err := json.Marshal(e.serveRequest(op, data))
+			if err != nil {
+				log.Error(errors.Wrapf(err, "error encoding the reply to %s", subject))
+				return
+			}
+			if err = respond(reply); err != nil {
+				log.Error(errors.Wrapf(err, "error replying to %s", subject))
+			}
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error subscribing to %s", subject)
+		}
+	}
+
+	return nil
+}
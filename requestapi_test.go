@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// recordingSubscriber keeps the handlers subscribed to each subject.
+type recordingSubscriber struct {
+	handlers map[string]func(data []byte, respond func([]byte) error)
+}
+
+func (s *recordingSubscriber) QueueSubscribe(subject, queue string, handler func(data []byte, respond func([]byte) error)) error {
+	s.handlers[subject] = handler
+	return nil
+}
+
+// request sends the request to the subject and returns the reply.
+func (s *recordingSubscriber) request(t *testing.T, subject, data string) *APIReply {
+	handler, ok := s.handlers[subject]
+	if !ok {
+		t.Fatalf("nothing subscribed to %s", subject)
+	}
+
+	reply := &APIReply{}
+	handler([]byte(data), func(msg []byte) error {
+		return json.Unmarshal(msg, reply)
+	})
+	return reply
+}
+
+func TestServeRequests(t *testing.T) {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	testinit := &ExposerAppInit{
+		Namespace:     "testing",
+		ViceNamespace: "vice-apps",
+		db:            sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	testapp := NewExposerApp(testinit, "linkerd", fake.NewSimpleClientset())
+
+	subscriber := &recordingSubscriber{handlers: map[string]func([]byte, func([]byte) error){}}
+	if err = testapp.ServeRequests(subscriber, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriber.handlers) != len(requestOperations) {
+		t.Errorf("%d subjects were subscribed to, not %d", len(subscriber.handlers), len(requestOperations))
+	}
+
+	// Requests go through the same route as the HTTP API.
+	mock.ExpectQuery("SELECT u.id FROM users u").WillReturnError(sql.ErrNoRows)
+	reply := subscriber.request(t, DefaultRequestSubjectPrefix+".listing", `{"query": {"user": "nobody"}}`)
+	if reply.StatusCode != http.StatusNotFound {
+		t.Errorf("status code was %d not %d", reply.StatusCode, http.StatusNotFound)
+	}
+	if !strings.Contains(string(reply.Body), "not found") {
+		t.Errorf("unexpected reply body %s", reply.Body)
+	}
+
+	// Parameters in the path of the route are required.
+	reply = subscriber.request(t, DefaultRequestSubjectPrefix+".describe", `{"query": {"user": "nobody"}}`)
+	if reply.StatusCode != http.StatusBadRequest {
+		t.Errorf("status code was %d not %d", reply.StatusCode, http.StatusBadRequest)
+	}
+
+	reply = subscriber.request(t, DefaultRequestSubjectPrefix+".launch", `not json`)
+	if reply.StatusCode != http.StatusBadRequest {
+		t.Errorf("status code was %d not %d", reply.StatusCode, http.StatusBadRequest)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestPath(t *testing.T) {
+	op := &requestOperation{subject: "terminate", method: http.MethodPost, path: "/vice/:id/exit"}
+
+	path, err := op.requestPath(map[string]string{"id": "a/b"})
+	if err != nil {
+		t.Error(err)
+	}
+	if path != "/vice/a%2Fb/exit" {
+		t.Errorf("path was %s not /vice/a%%2Fb/exit", path)
+	}
+
+	if _, err = op.requestPath(map[string]string{}); err == nil {
+		t.Error("no error for a missing parameter")
+	}
+}
@@ -0,0 +1,112 @@
+// Package tracing sets up OpenTelemetry tracing for app-exposer. Spans are
+// exported to an OTLP collector over gRPC, and the trace context is read from
+// and passed along in W3C Trace Context headers.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the name app-exposer's spans are reported under.
+const ServiceName = "app-exposer"
+
+const instrumentationName = "github.com/cyverse-de/app-exposer"
+
+// Config contains the settings for exporting spans.
+type Config struct {
+	// Enabled turns on exporting spans. The trace context is still passed
+	// along to other services when it's off.
+	Enabled bool
+
+	// Endpoint is the host:port of the collector's OTLP gRPC receiver. The
+	// exporter's default is used if it's empty.
+	Endpoint string
+
+	// Insecure connects to the collector without TLS.
+	Insecure bool
+
+	// SampleRatio is the fraction of new traces that are sampled. Traces
+	// started by other services follow the caller's decision.
+	SampleRatio float64
+}
+
+// Init installs the global tracer provider and propagator. The returned
+// function flushes any spans that haven't been exported yet and stops the
+// exporter; it should be called before the service exits.
+func Init(ctx context.Context, config *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var opts []otlpgrpc.Option
+	if config.Endpoint != "" {
+		opts = append(opts, otlpgrpc.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		opts = append(opts, otlpgrpc.WithInsecure())
+	}
+
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(opts...))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating the OTLP exporter")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(sdkresource.NewWithAttributes(semconv.ServiceNameKey.String(ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer for app-exposer's own spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// StartSpan starts a span named after the operation as a child of the span in
+// the context, if there is one.
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanOption) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// RecordError marks the span as failed if err isn't nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Transport wraps the round tripper so that each request sent through it gets
+// a client span and carries the trace context of the request's context.
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(rt)
+}
+
+// Client is an HTTP client with a traced transport.
+var Client = &http.Client{Transport: Transport(http.DefaultTransport)}
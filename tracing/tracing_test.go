@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestInitDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	shutdown, err := Init(context.Background(), &Config{})
+	assert.NoError(err)
+	assert.NoError(shutdown(context.Background()))
+}
+
+func TestClientPropagatesTraceContext(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := Init(context.Background(), &Config{})
+	assert.NoError(err)
+
+	provider := sdktrace.NewTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	ctx, span := StartSpan(context.Background(), "test")
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	assert.NoError(err)
+	resp, err := Client.Do(req)
+	assert.NoError(err)
+	resp.Body.Close()
+
+	assert.Contains(traceparent, span.SpanContext().TraceID().String())
+}